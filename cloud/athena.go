@@ -0,0 +1,159 @@
+package cloud
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/athena"
+	"github.com/aws/aws-sdk-go/service/athena/athenaiface"
+	"k8s.io/klog"
+)
+
+// Athena queries are billed by the bytes they scan and take up to a minute, while the Cost and Usage Report is
+// updated only a few times a day, so results are cached for the configured TTL, or defaultAthenaCacheTTL. Queries
+// still queued or running after the configured timeout, or defaultAthenaQueryTimeout, are stopped.
+const (
+	defaultAthenaCacheTTL     = 6 * time.Hour
+	defaultAthenaQueryTimeout = 5 * time.Minute
+	athenaPollInterval        = 2 * time.Second
+)
+
+// athenaResultCache caches the out of cluster costs returned by Athena queries, keyed by their SQL
+type athenaResultCache struct {
+	lock    sync.Mutex
+	results map[string]*cachedAthenaResult
+}
+
+type cachedAthenaResult struct {
+	result  *ExternalAllocationsResult
+	expires time.Time
+}
+
+// get returns the cached result of the given query, which scanned no bytes, if it hasn't expired
+func (c *athenaResultCache) get(key string) (*ExternalAllocationsResult, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	cached, ok := c.results[key]
+	if !ok || time.Now().After(cached.expires) {
+		return nil, false
+	}
+	return &ExternalAllocationsResult{Allocations: cached.result.Allocations, Cached: true}, true
+}
+
+// set caches the result of the given query for the given TTL, dropping expired results
+func (c *athenaResultCache) set(key string, result *ExternalAllocationsResult, ttl time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.results == nil {
+		c.results = make(map[string]*cachedAthenaResult)
+	}
+	now := time.Now()
+	for k, cached := range c.results {
+		if now.After(cached.expires) {
+			delete(c.results, k)
+		}
+	}
+	c.results[key] = &cachedAthenaResult{result: result, expires: now.Add(ttl)}
+}
+
+// athenaDuration parses the configured duration of the given name, returning the given default if it's unset or
+// invalid
+func athenaDuration(value string, defaultDuration time.Duration, name string) time.Duration {
+	if value == "" {
+		return defaultDuration
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		klog.V(1).Infof("Invalid Athena %s \"%s\", using %s", name, value, defaultDuration)
+		return defaultDuration
+	}
+	return d
+}
+
+// WaitForAthenaQuery polls the execution of the given Athena query until it completes, returning an error if it
+// fails or is cancelled. Queries still queued or running after the given timeout are stopped, and an error
+// reporting their state is returned.
+func WaitForAthenaQuery(svc athenaiface.AthenaAPI, id string, timeout time.Duration) (*athena.QueryExecution, error) {
+	deadline := time.Now().Add(timeout)
+	input := &athena.GetQueryExecutionInput{QueryExecutionId: aws.String(id)}
+	for {
+		output, err := svc.GetQueryExecution(input)
+		if err != nil {
+			return nil, err
+		}
+		execution := output.QueryExecution
+		state := aws.StringValue(execution.Status.State)
+		switch state {
+		case athena.QueryExecutionStateSucceeded:
+			return execution, nil
+		case athena.QueryExecutionStateFailed, athena.QueryExecutionStateCancelled:
+			return nil, fmt.Errorf("Athena query %s %s: %s", id, strings.ToLower(state), aws.StringValue(execution.Status.StateChangeReason))
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			if _, err := svc.StopQueryExecution(&athena.StopQueryExecutionInput{QueryExecutionId: aws.String(id)}); err != nil {
+				klog.V(1).Infof("Error stopping Athena query %s: %s", id, err.Error())
+			}
+			return nil, fmt.Errorf("Athena query %s timed out after %s while %s", id, timeout, state)
+		}
+		if remaining > athenaPollInterval {
+			remaining = athenaPollInterval
+		}
+		time.Sleep(remaining)
+	}
+}
+
+// athenaAllocations reads the out of cluster costs of the given aggregators from all pages of the results of the
+// given Athena query, as queried by AthenaExternalAllocationsSQL
+func athenaAllocations(svc athenaiface.AthenaAPI, id string, aggregators []string) ([]*OutOfClusterAllocation, error) {
+	// columns are the start date, a column per aggregator, the product code and the cost
+	n := len(aggregators)
+	var allocations []*OutOfClusterAllocation
+	var parseErr error
+	header := true
+	input := &athena.GetQueryResultsInput{QueryExecutionId: aws.String(id)}
+	err := svc.GetQueryResultsPages(input, func(page *athena.GetQueryResultsOutput, lastPage bool) bool {
+		for _, r := range page.ResultSet.Rows {
+			// the first row of the first page holds the column names
+			if header {
+				header = false
+				continue
+			}
+			if len(r.Data) != n+3 {
+				parseErr = fmt.Errorf("Unexpected number of columns %d in out of cluster costs; expected %d", len(r.Data), n+3)
+				return false
+			}
+			cost, err := strconv.ParseFloat(athenaValue(r.Data[n+2]), 64)
+			if err != nil {
+				parseErr = err
+				return false
+			}
+			values := make([]string, 0, n)
+			for _, datum := range r.Data[1 : n+1] {
+				values = append(values, athenaValue(datum))
+			}
+			allocations = append(allocations, newOutOfClusterAllocation(aggregators, values, athenaValue(r.Data[n+1]), cost))
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	if parseErr != nil {
+		return nil, parseErr
+	}
+	return allocations, nil
+}
+
+// athenaValue returns the value of the given result datum, or "" if it's null
+func athenaValue(d *athena.Datum) string {
+	if d == nil || d.VarCharValue == nil {
+		return ""
+	}
+	return *d.VarCharValue
+}
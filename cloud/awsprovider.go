@@ -11,7 +11,9 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"path"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -36,13 +38,23 @@ import (
 const awsAccessKeyIDEnvVar = "AWS_ACCESS_KEY_ID"
 const awsAccessKeySecretEnvVar = "AWS_SECRET_ACCESS_KEY"
 const supportedSpotFeedVersion = "1"
+
+// spotFeedTimestampLayout is the layout of the timestamps of spot data feed records, e.g. "2020-01-01 00:00:00 UTC"
+const spotFeedTimestampLayout = "2006-01-02 15:04:05 MST"
+
+// The spot data feed is published hourly. Spot prices older than the configured staleness, or
+// defaultSpotDataStaleness, are no longer trusted, and spot nodes are priced by estimate instead.
+const (
+	spotDataRefreshInterval  = time.Hour
+	defaultSpotDataStaleness = 3 * time.Hour
+)
 const SpotInfoUpdateType = "spotinfo"
 const AthenaInfoUpdateType = "athenainfo"
 
 // AWS represents an Amazon Provider
 type AWS struct {
 	Pricing                 map[string]*AWSProductTerms
-	SpotPricingByInstanceID map[string]*spotInfo
+	SpotPricingByInstanceID map[string]*SpotInfo
 	ValidPricingKeys        map[string]bool
 	Clientset               *kubernetes.Clientset
 	BaseCPUPrice            string
@@ -52,13 +64,18 @@ type AWS struct {
 	BaseSpotRAMPrice        string
 	SpotLabelName           string
 	SpotLabelValue          string
+	SpotLabels              map[string]string
 	ServiceKeyName          string
 	ServiceKeySecret        string
 	SpotDataRegion          string
 	SpotDataBucket          string
 	SpotDataPrefix          string
+	SpotDataStaleness       time.Duration
 	ProjectID               string
 	DownloadPricingDataLock sync.RWMutex
+	downloadLock            sync.Mutex // serializes downloads, which take DownloadPricingDataLock only to swap in their data
+	spotDataRefresh         sync.Once
+	athenaResults           athenaResultCache
 	*CustomProvider
 }
 
@@ -225,6 +242,7 @@ type AwsSpotFeedInfo struct {
 	ServiceKeySecret string `json:"serviceKeySecret"`
 	SpotLabel        string `json:"spotLabel"`
 	SpotLabelValue   string `json:"spotLabelValue"`
+	Staleness        string `json:"staleness,omitempty"`
 }
 
 type AwsAthenaInfo struct {
@@ -289,6 +307,7 @@ func (aws *AWS) UpdateConfig(r io.Reader, updateType string) (*CustomPricing, er
 		c.SpotDataRegion = a.Region
 		c.SpotLabel = a.SpotLabel
 		c.SpotLabelValue = a.SpotLabelValue
+		c.SpotDataStaleness = a.Staleness
 
 	} else if updateType == AthenaInfoUpdateType {
 		a := AwsAthenaInfo{}
@@ -343,6 +362,7 @@ func (aws *AWS) UpdateConfig(r io.Reader, updateType string) (*CustomPricing, er
 type awsKey struct {
 	SpotLabelName  string
 	SpotLabelValue string
+	SpotLabels     map[string]string
 	Labels         map[string]string
 	ProviderID     string
 }
@@ -375,7 +395,7 @@ func (k *awsKey) Features() string {
 	key := region + "," + instanceType + "," + operatingSystem
 	usageType := "preemptible"
 	spotKey := key + "," + usageType
-	if l, ok := k.Labels["lifecycle"]; ok && l == "EC2Spot" {
+	if IsSpotNode(k.Labels, k.SpotLabels) {
 		return spotKey
 	}
 	if l, ok := k.Labels[k.SpotLabelName]; ok && l == k.SpotLabelValue {
@@ -384,13 +404,28 @@ func (k *awsKey) Features() string {
 	return key
 }
 
+// awsStorageTiers are the us-east-1 prices of provisioned IOPS and throughput, by EBS volume type
+var awsStorageTiers = map[string]*StorageTier{
+	"io1": &StorageTier{IOPSCost: 0.065 / 730},
+	"io2": &StorageTier{IOPSCost: 0.065 / 730},
+	"gp3": &StorageTier{IOPSCost: 0.005 / 730, IncludedIOPS: 3000, ThroughputCost: 0.04 / 730, IncludedThroughput: 125},
+}
+
 func (aws *AWS) PVPricing(pvk PVKey) (*PV, error) {
+	var tier *StorageTier
+	if key, ok := pvk.(*awsPVKey); ok {
+		tier = awsStorageTiers[key.StorageClassParameters["type"]]
+	}
+	aws.DownloadPricingDataLock.RLock()
+	defer aws.DownloadPricingDataLock.RUnlock()
 	pricing, ok := aws.Pricing[pvk.Features()]
-	if !ok {
+	if !ok || pricing.PV == nil {
 		klog.V(4).Infof("Persistent Volume pricing not found for %s: %s", pvk.GetStorageClass(), pvk.Features())
-		return &PV{}, nil
+		return &PV{Tier: tier}, nil
 	}
-	return pricing.PV, nil
+	pv := *pricing.PV
+	pv.Tier = tier
+	return &pv, nil
 }
 
 type awsPVKey struct {
@@ -437,6 +472,7 @@ func (aws *AWS) GetKey(labels map[string]string) Key {
 	return &awsKey{
 		SpotLabelName:  aws.SpotLabelName,
 		SpotLabelValue: aws.SpotLabelValue,
+		SpotLabels:     aws.SpotLabels,
 		Labels:         labels,
 		ProviderID:     labels["providerID"],
 	}
@@ -450,14 +486,16 @@ func (aws *AWS) isPreemptible(key string) bool {
 	return false
 }
 
-// DownloadPricingData fetches data from the AWS Pricing API
+// DownloadPricingData fetches data from the AWS Pricing API. The data is downloaded without holding
+// DownloadPricingDataLock, which is only taken to swap it in, so that pricing lookups aren't held up meanwhile.
 func (aws *AWS) DownloadPricingData() error {
-	aws.DownloadPricingDataLock.Lock()
-	defer aws.DownloadPricingDataLock.Unlock()
+	aws.downloadLock.Lock()
+	defer aws.downloadLock.Unlock()
 	c, err := GetDefaultPricingData("aws.json")
 	if err != nil {
 		klog.V(1).Infof("Error downloading default pricing data: %s", err.Error())
 	}
+	aws.DownloadPricingDataLock.Lock()
 	aws.BaseCPUPrice = c.CPU
 	aws.BaseRAMPrice = c.RAM
 	aws.BaseGPUPrice = c.GPU
@@ -465,12 +503,15 @@ func (aws *AWS) DownloadPricingData() error {
 	aws.BaseSpotRAMPrice = c.SpotRAM
 	aws.SpotLabelName = c.SpotLabel
 	aws.SpotLabelValue = c.SpotLabelValue
+	aws.SpotLabels = spotNodeLabels(c)
 	aws.SpotDataBucket = c.SpotDataBucket
 	aws.SpotDataPrefix = c.SpotDataPrefix
 	aws.ProjectID = c.ProjectID
 	aws.SpotDataRegion = c.SpotDataRegion
+	aws.SpotDataStaleness = spotDataStaleness(c.SpotDataStaleness)
 	aws.ServiceKeyName = c.ServiceKeyName
 	aws.ServiceKeySecret = c.ServiceKeySecret
+	aws.DownloadPricingDataLock.Unlock()
 
 	if len(aws.SpotDataBucket) != 0 && len(aws.ProjectID) == 0 {
 		klog.V(1).Infof("using SpotDataBucket \"%s\" without ProjectID will not end well", aws.SpotDataBucket)
@@ -513,8 +554,9 @@ func (aws *AWS) DownloadPricingData() error {
 		pvkeys[key.Features()] = key
 	}
 
-	aws.Pricing = make(map[string]*AWSProductTerms)
-	aws.ValidPricingKeys = make(map[string]bool)
+	// Build the new pricing data aside, so that the current prices are kept should the download fail
+	pricing := make(map[string]*AWSProductTerms)
+	validPricingKeys := make(map[string]bool)
 	skusToKeys := make(map[string]string)
 
 	pricingURL := "https://pricing.us-east-1.amazonaws.com/offers/v1.0/aws/AmazonEC2/current/index.json"
@@ -532,6 +574,8 @@ func (aws *AWS) DownloadPricingData() error {
 		if err == io.EOF {
 			klog.V(2).Infof("done loading \"%s\"\n", pricingURL)
 			break
+		} else if err != nil {
+			return err
 		}
 		if t == "products" {
 			_, err := dec.Token() // this should parse the opening "{""
@@ -563,12 +607,12 @@ func (aws *AWS) DownloadPricingData() error {
 							VCpu:    product.Attributes.VCpu,
 							GPU:     product.Attributes.GPU,
 						}
-						aws.Pricing[key] = productTerms
-						aws.Pricing[spotKey] = productTerms
+						pricing[key] = productTerms
+						pricing[spotKey] = productTerms
 						skusToKeys[product.Sku] = key
 					}
-					aws.ValidPricingKeys[key] = true
-					aws.ValidPricingKeys[spotKey] = true
+					validPricingKeys[key] = true
+					validPricingKeys[spotKey] = true
 				} else if strings.Contains(product.Attributes.UsageType, "EBS:Volume") {
 					// UsageTypes may be prefixed with a region code - we're removing this when using
 					// volTypes to keep lookups generic
@@ -585,11 +629,11 @@ func (aws *AWS) DownloadPricingData() error {
 						Sku: product.Sku,
 						PV:  pv,
 					}
-					aws.Pricing[key] = productTerms
-					aws.Pricing[spotKey] = productTerms
+					pricing[key] = productTerms
+					pricing[spotKey] = productTerms
 					skusToKeys[product.Sku] = key
-					aws.ValidPricingKeys[key] = true
-					aws.ValidPricingKeys[spotKey] = true
+					validPricingKeys[key] = true
+					validPricingKeys[spotKey] = true
 				}
 			}
 		}
@@ -629,21 +673,21 @@ func (aws *AWS) DownloadPricingData() error {
 						key, ok := skusToKeys[sku.(string)]
 						spotKey := key + ",preemptible"
 						if ok {
-							aws.Pricing[key].OnDemand = offerTerm
-							aws.Pricing[spotKey].OnDemand = offerTerm
+							pricing[key].OnDemand = offerTerm
+							pricing[spotKey].OnDemand = offerTerm
 							if strings.Contains(key, "EBS:VolumeP-IOPS.piops") {
 								// If the specific UsageType is the per IO cost used on io1 volumes
 								// we need to add the per IO cost to the io1 PV cost
 								cost := offerTerm.PriceDimensions[sku.(string)+OnDemandRateCode+HourlyRateCode].PricePerUnit.USD
 								// Add the per IO cost to the PV object for the io1 volume type
-								aws.Pricing[key].PV.CostPerIO = cost
+								pricing[key].PV.CostPerIO = cost
 							} else if strings.Contains(key, "EBS:Volume") {
 								// If volume, we need to get hourly cost and add it to the PV object
 								cost := offerTerm.PriceDimensions[sku.(string)+OnDemandRateCode+HourlyRateCode].PricePerUnit.USD
 								costFloat, _ := strconv.ParseFloat(cost, 64)
 								hourlyPrice := costFloat / 730
 
-								aws.Pricing[key].PV.Cost = strconv.FormatFloat(hourlyPrice, 'f', -1, 64)
+								pricing[key].PV.Cost = strconv.FormatFloat(hourlyPrice, 'f', -1, 64)
 							}
 						}
 					}
@@ -659,15 +703,90 @@ func (aws *AWS) DownloadPricingData() error {
 			}
 		}
 	}
+	aws.DownloadPricingDataLock.Lock()
+	aws.Pricing = pricing
+	aws.ValidPricingKeys = validPricingKeys
+	aws.DownloadPricingDataLock.Unlock()
+
+	aws.downloadSpotData()
+	aws.spotDataRefresh.Do(func() {
+		go aws.refreshSpotData()
+	})
+
+	return nil
+}
+
+// awsPricingCache is the pricing data of AWS saved to the pricing cache
+type awsPricingCache struct {
+	Pricing          map[string]*AWSProductTerms `json:"pricing"`
+	ValidPricingKeys map[string]bool             `json:"validPricingKeys"`
+}
+
+// SavePricingData writes the pricing data last downloaded from the AWS Pricing API
+func (aws *AWS) SavePricingData(w io.Writer) error {
+	aws.DownloadPricingDataLock.RLock()
+	defer aws.DownloadPricingDataLock.RUnlock()
+	return json.NewEncoder(w).Encode(&awsPricingCache{
+		Pricing:          aws.Pricing,
+		ValidPricingKeys: aws.ValidPricingKeys,
+	})
+}
 
-	sp, err := parseSpotData(aws.SpotDataBucket, aws.SpotDataPrefix, aws.ProjectID, aws.SpotDataRegion, aws.ServiceKeyName, aws.ServiceKeySecret)
+// LoadPricingData replaces the pricing data with that written by SavePricingData
+func (aws *AWS) LoadPricingData(r io.Reader) error {
+	cached := &awsPricingCache{}
+	if err := json.NewDecoder(r).Decode(cached); err != nil {
+		return err
+	}
+	aws.DownloadPricingDataLock.Lock()
+	defer aws.DownloadPricingDataLock.Unlock()
+	aws.Pricing = cached.Pricing
+	aws.ValidPricingKeys = cached.ValidPricingKeys
+	return nil
+}
+
+// downloadSpotData replaces the spot prices by instance ID with those of the latest spot data feed, keeping
+// the current prices when the feed cannot be downloaded. It takes DownloadPricingDataLock only to read the
+// configuration of the feed and to swap in its prices.
+func (aws *AWS) downloadSpotData() {
+	aws.DownloadPricingDataLock.RLock()
+	bucket, prefix, projectID, region := aws.SpotDataBucket, aws.SpotDataPrefix, aws.ProjectID, aws.SpotDataRegion
+	keyName, keySecret := aws.ServiceKeyName, aws.ServiceKeySecret
+	aws.DownloadPricingDataLock.RUnlock()
+
+	if bucket == "" {
+		klog.V(3).Infof("Skipping AWS spot data download: no spot data bucket configured")
+		return
+	}
+	sp, err := parseSpotData(bucket, prefix, projectID, region, keyName, keySecret)
 	if err != nil {
 		klog.V(1).Infof("Skipping AWS spot data download: %s", err.Error())
-	} else {
-		aws.SpotPricingByInstanceID = sp
+		return
 	}
+	aws.DownloadPricingDataLock.Lock()
+	aws.SpotPricingByInstanceID = sp
+	aws.DownloadPricingDataLock.Unlock()
+}
 
-	return nil
+// refreshSpotData downloads the spot data feed every spotDataRefreshInterval, as it is published
+func (aws *AWS) refreshSpotData() {
+	for {
+		time.Sleep(spotDataRefreshInterval)
+		aws.downloadSpotData()
+	}
+}
+
+// spotDataStaleness parses the configured age beyond which spot data feed prices are not used
+func spotDataStaleness(staleness string) time.Duration {
+	if staleness == "" {
+		return defaultSpotDataStaleness
+	}
+	d, err := time.ParseDuration(staleness)
+	if err != nil || d <= 0 {
+		klog.V(1).Infof("Invalid spot data staleness \"%s\", using %s", staleness, defaultSpotDataStaleness)
+		return defaultSpotDataStaleness
+	}
+	return d
 }
 
 // Stubbed NetworkPricing for AWS. Pull directly from aws.json for now
@@ -696,36 +815,55 @@ func (c *AWS) NetworkPricing() (*Network, error) {
 	}, nil
 }
 
-// AllNodePricing returns all the billing data fetched.
+// LoadBalancerPricing returns the hourly cost of a load balancer, defaulting to the price of a classic ELB
+func (*AWS) LoadBalancerPricing() (*LoadBalancer, error) {
+	cpricing, err := GetDefaultPricingData("aws.json")
+	if err != nil {
+		return nil, err
+	}
+	return loadBalancerPricing(cpricing, 0.025)
+}
+
+// GPUPricing returns the hourly price of a GPU of each model, by which the price of a GPU instance is split
+// between its GPUs and the rest of the instance. EC2 prices GPUs only as part of their instances, so only the
+// models priced by the config are.
+func (*AWS) GPUPricing() (*GPUPricing, error) {
+	cpricing, err := GetDefaultPricingData("aws.json")
+	if err != nil {
+		return nil, err
+	}
+	return gpuPricing(cpricing, nil, nil)
+}
+
+// AllNodePricing returns all the billing data fetched, along with any instance type rate overrides.
 func (aws *AWS) AllNodePricing() (interface{}, error) {
 	aws.DownloadPricingDataLock.RLock()
 	defer aws.DownloadPricingDataLock.RUnlock()
-	return aws.Pricing, nil
+	return withRateOverrides(aws, aws.Pricing), nil
 }
 
 func (aws *AWS) createNode(terms *AWSProductTerms, usageType string, k Key) (*Node, error) {
 	key := k.Features()
 	if aws.isPreemptible(key) {
 		if spotInfo, ok := aws.SpotPricingByInstanceID[k.ID()]; ok { // try and match directly to an ID for pricing. We'll still need the features
-			var spotcost string
-			arr := strings.Split(spotInfo.Charge, " ")
-			if len(arr) == 2 {
-				spotcost = arr[0]
+			spotcost, err := spotInfo.HourlyCharge(aws.SpotDataStaleness)
+			if err != nil {
+				klog.V(1).Infof("Warning: estimating spot cost of node %s: %s", k.ID(), err.Error())
 			} else {
-				klog.V(2).Infof("Spot data for node %s is missing", k.ID())
+				klog.V(3).Infof("Spot cost for %s: %s", k.ID(), spotcost)
+				return &Node{
+					Cost:         spotcost,
+					VCPU:         terms.VCpu,
+					RAM:          terms.Memory,
+					GPU:          terms.GPU,
+					Storage:      terms.Storage,
+					BaseCPUPrice: aws.BaseCPUPrice,
+					BaseRAMPrice: aws.BaseRAMPrice,
+					BaseGPUPrice: aws.BaseGPUPrice,
+					UsageType:    usageType,
+					Lifecycle:    LifecycleSpot,
+				}, nil
 			}
-			klog.V(1).Infof("SPOT COST FOR %s: %s", k.Features, spotcost)
-			return &Node{
-				Cost:         spotcost,
-				VCPU:         terms.VCpu,
-				RAM:          terms.Memory,
-				GPU:          terms.GPU,
-				Storage:      terms.Storage,
-				BaseCPUPrice: aws.BaseCPUPrice,
-				BaseRAMPrice: aws.BaseRAMPrice,
-				BaseGPUPrice: aws.BaseGPUPrice,
-				UsageType:    usageType,
-			}, nil
 		}
 		return &Node{
 			VCPU:         terms.VCpu,
@@ -738,6 +876,7 @@ func (aws *AWS) createNode(terms *AWSProductTerms, usageType string, k Key) (*No
 			BaseRAMPrice: aws.BaseRAMPrice,
 			BaseGPUPrice: aws.BaseGPUPrice,
 			UsageType:    usageType,
+			Lifecycle:    LifecycleSpot,
 		}, nil
 	}
 	c, ok := terms.OnDemand.PriceDimensions[terms.Sku+OnDemandRateCode+HourlyRateCode]
@@ -755,11 +894,18 @@ func (aws *AWS) createNode(terms *AWSProductTerms, usageType string, k Key) (*No
 		BaseRAMPrice: aws.BaseRAMPrice,
 		BaseGPUPrice: aws.BaseGPUPrice,
 		UsageType:    usageType,
+		Lifecycle:    LifecycleOnDemand,
 	}, nil
 }
 
-// NodePricing takes in a key from GetKey and returns a Node object for use in building the cost model.
+// NodePricing takes in a key from GetKey and returns a Node object for use in building the cost model,
+// priced by the rate override of its instance type, if any, or else by its list price.
 func (aws *AWS) NodePricing(k Key) (*Node, error) {
+	node, err := aws.listNodePricing(k)
+	return withRateOverride(aws, k, node, err)
+}
+
+func (aws *AWS) listNodePricing(k Key) (*Node, error) {
 	aws.DownloadPricingDataLock.RLock()
 	defer aws.DownloadPricingDataLock.RUnlock()
 
@@ -918,41 +1064,81 @@ func (*AWS) AddServiceKey(formValues url.Values) error {
 
 // GetDisks returns the AWS disks backing PVs. Useful because sometimes k8s will not clean up PVs correctly. Requires a json config in /var/configs with key region.
 func (*AWS) GetDisks() ([]byte, error) {
+	volumeResult, _, err := describeAWSVolumes()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(volumeResult)
+}
+
+// ListOrphanedDisks lists the EBS volumes of the region of the cluster which are attached to no instance, except
+// those in backing
+func (*AWS) ListOrphanedDisks(backing map[string]bool) ([]*Disk, error) {
+	volumeResult, region, err := describeAWSVolumes()
+	if err != nil {
+		return nil, err
+	}
+	disks := []*Disk{}
+	for _, volume := range volumeResult.Volumes {
+		id := aws.StringValue(volume.VolumeId)
+		if aws.StringValue(volume.State) != ec2.VolumeStateAvailable || backing[id] {
+			continue
+		}
+		disk := &Disk{
+			ID:      id,
+			Region:  region,
+			Zone:    aws.StringValue(volume.AvailabilityZone),
+			Type:    aws.StringValue(volume.VolumeType),
+			Bytes:   float64(aws.Int64Value(volume.Size)) * 1024 * 1024 * 1024,
+			IOPS:    float64(aws.Int64Value(volume.Iops)),
+			Created: aws.TimeValue(volume.CreateTime),
+			Labels:  make(map[string]string),
+		}
+		for _, tag := range volume.Tags {
+			disk.Labels[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+		}
+		disks = append(disks, disk)
+	}
+	return disks, nil
+}
+
+// describeAWSVolumes describes the EBS volumes of the region of the cluster, returned along with the region
+func describeAWSVolumes() (*ec2.DescribeVolumesOutput, string, error) {
 	jsonFile, err := os.Open("/var/configs/key.json")
 	if err == nil {
 		byteValue, _ := ioutil.ReadAll(jsonFile)
 		var result map[string]string
 		err := json.Unmarshal([]byte(byteValue), &result)
 		if err != nil {
-			return nil, err
+			return nil, "", err
 		}
 		err = os.Setenv(awsAccessKeyIDEnvVar, result["access_key_ID"])
 		if err != nil {
-			return nil, err
+			return nil, "", err
 		}
 		err = os.Setenv(awsAccessKeySecretEnvVar, result["secret_access_key"])
 		if err != nil {
-			return nil, err
+			return nil, "", err
 		}
 	} else if os.IsNotExist(err) {
 		klog.V(2).Infof("Using Default Credentials")
 	} else {
-		return nil, err
+		return nil, "", err
 	}
 	defer jsonFile.Close()
 	clusterConfig, err := os.Open("/var/configs/cluster.json")
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 	defer clusterConfig.Close()
 	b, err := ioutil.ReadAll(clusterConfig)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 	var clusterConf map[string]string
 	err = json.Unmarshal([]byte(b), &clusterConf)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 	region := aws.String(clusterConf["region"])
 	c := &aws.Config{
@@ -967,13 +1153,13 @@ func (*AWS) GetDisks() ([]byte, error) {
 		if aerr, ok := err.(awserr.Error); ok {
 			switch aerr.Code() {
 			default:
-				return nil, aerr
+				return nil, "", aerr
 			}
 		} else {
-			return nil, err
+			return nil, "", err
 		}
 	}
-	return json.Marshal(volumeResult)
+	return volumeResult, clusterConf["region"], nil
 }
 
 // ConvertToGlueColumnFormat takes a string and runs through various regex
@@ -1024,22 +1210,23 @@ func ConvertToGlueColumnFormat(column_name string) string {
 
 // ExternalAllocations represents tagged assets outside the scope of kubernetes.
 // "start" and "end" are dates of the format YYYY-MM-DD
-// "aggregator" is the tag used to determine how to allocate those assets, ie namespace, pod, etc.
-func (a *AWS) ExternalAllocations(start string, end string, aggregator string) ([]*OutOfClusterAllocation, error) {
+// "aggregators" are the tags used to determine how to allocate those assets, ie namespace, pod, etc.
+// Results are cached for the configured athenaCacheTTL, unless a refresh is forced.
+func (a *AWS) ExternalAllocations(eq *ExternalAllocationsQuery) (*ExternalAllocationsResult, error) {
 	customPricing, err := a.GetConfig()
 	if err != nil {
 		return nil, err
 	}
-	aggregator_column_name := "resource_tags_user_kubernetes_" + aggregator
-	aggregator_column_name = ConvertToGlueColumnFormat(aggregator_column_name)
-	query := fmt.Sprintf(`SELECT   
-		CAST(line_item_usage_start_date AS DATE) as start_date,
-		%s,
-		line_item_product_code,
-		SUM(line_item_blended_cost) as blended_cost
-	FROM %s as cost_data
-	WHERE line_item_usage_start_date BETWEEN date '%s' AND date '%s'
-	GROUP BY 1,2,3`, aggregator_column_name, customPricing.AthenaTable, start, end)
+	query, err := AthenaExternalAllocationsSQL(customPricing.AthenaTable, eq)
+	if err != nil {
+		return nil, err
+	}
+	cacheKey := strings.Join([]string{customPricing.AthenaRegion, customPricing.AthenaDatabase, query}, "\n")
+	if !eq.ForceRefresh {
+		if result, ok := a.athenaResults.get(cacheKey); ok {
+			return result, nil
+		}
+	}
 
 	if customPricing.ServiceKeyName != "" {
 		err = os.Setenv(awsAccessKeyIDEnvVar, customPricing.ServiceKeyName)
@@ -1080,50 +1267,22 @@ func (a *AWS) ExternalAllocations(start string, end string, aggregator string) (
 	klog.V(2).Infof("StartQueryExecution result:")
 	klog.V(2).Infof(res.GoString())
 
-	var qri athena.GetQueryExecutionInput
-	qri.SetQueryExecutionId(*res.QueryExecutionId)
-
-	var qrop *athena.GetQueryExecutionOutput
-	duration := time.Duration(2) * time.Second // Pause for 2 seconds
-
-	for {
-		qrop, err = svc.GetQueryExecution(&qri)
-		if err != nil {
-			return nil, err
-		}
-		if *qrop.QueryExecution.Status.State != "RUNNING" {
-			break
-		}
-		time.Sleep(duration)
+	timeout := athenaDuration(customPricing.AthenaQueryTimeout, defaultAthenaQueryTimeout, "query timeout")
+	execution, err := WaitForAthenaQuery(svc, *res.QueryExecutionId, timeout)
+	if err != nil {
+		return nil, err
 	}
-	var oocAllocs []*OutOfClusterAllocation
-	if *qrop.QueryExecution.Status.State == "SUCCEEDED" {
-
-		var ip athena.GetQueryResultsInput
-		ip.SetQueryExecutionId(*res.QueryExecutionId)
-
-		op, err := svc.GetQueryResults(&ip)
-		if err != nil {
-			return nil, err
-		}
-
-		for _, r := range op.ResultSet.Rows[1:(len(op.ResultSet.Rows) - 1)] {
-
-			cost, err := strconv.ParseFloat(*r.Data[3].VarCharValue, 64)
-			if err != nil {
-				return nil, err
-			}
-			ooc := &OutOfClusterAllocation{
-				Aggregator:  aggregator,
-				Environment: *r.Data[1].VarCharValue,
-				Service:     *r.Data[2].VarCharValue,
-				Cost:        cost,
-			}
-			oocAllocs = append(oocAllocs, ooc)
-		}
+	result := &ExternalAllocationsResult{}
+	if stats := execution.Statistics; stats != nil && stats.DataScannedInBytes != nil {
+		result.BytesScanned = *stats.DataScannedInBytes
+	}
+	result.Allocations, err = athenaAllocations(svc, *res.QueryExecutionId, eq.Aggregators)
+	if err != nil {
+		return nil, err
 	}
 
-	return oocAllocs, nil // TODO: transform the QuerySQL lines into the new OutOfClusterAllocation Struct
+	a.athenaResults.set(cacheKey, result, athenaDuration(customPricing.AthenaCacheTTL, defaultAthenaCacheTTL, "cache TTL"))
+	return result, nil
 }
 
 // QuerySQL can query a properly configured Athena database.
@@ -1219,7 +1378,8 @@ func (a *AWS) QuerySQL(query string) ([]byte, error) {
 	return nil, fmt.Errorf("Error getting query results : %s", *qrop.QueryExecution.Status.State)
 }
 
-type spotInfo struct {
+// SpotInfo is a record of the AWS spot data feed: the charge of a spot instance for an hour
+type SpotInfo struct {
 	Timestamp   string `csv:"Timestamp"`
 	UsageType   string `csv:"UsageType"`
 	Operation   string `csv:"Operation"`
@@ -1231,34 +1391,56 @@ type spotInfo struct {
 	Version     string `csv:"Version"`
 }
 
-type fnames []*string
-
-func (f fnames) Len() int {
-	return len(f)
+// HourlyCharge returns the charge of the spot instance for the hour of the record, or an error when the
+// record is malformed or older than staleness
+func (s *SpotInfo) HourlyCharge(staleness time.Duration) (string, error) {
+	arr := strings.Split(s.Charge, " ")
+	if len(arr) != 2 {
+		return "", fmt.Errorf("malformed spot data charge \"%s\"", s.Charge)
+	}
+	if _, err := strconv.ParseFloat(arr[0], 64); err != nil {
+		return "", fmt.Errorf("malformed spot data charge \"%s\"", s.Charge)
+	}
+	t, err := time.Parse(spotFeedTimestampLayout, s.Timestamp)
+	if err != nil {
+		return "", fmt.Errorf("malformed spot data timestamp \"%s\"", s.Timestamp)
+	}
+	if age := time.Since(t); age > staleness {
+		return "", fmt.Errorf("spot data is %s old, older than the %s staleness threshold", age.Round(time.Minute), staleness)
+	}
+	return arr[0], nil
 }
 
-func (f fnames) Swap(i, j int) {
-	f[i], f[j] = f[j], f[i]
+// spotFeedFileTime returns the hour covered by the spot data feed file with the given key, which is named
+// "<prefix>/<account ID>.<YYYY-MM-DD-HH>.<n>.<ID>.gz", whatever dots the prefix has
+func spotFeedFileTime(key string) (time.Time, error) {
+	parts := strings.Split(path.Base(key), ".")
+	if len(parts) < 2 {
+		return time.Time{}, fmt.Errorf("no hour in the file name")
+	}
+	return time.Parse("2006-01-02-15", parts[1])
 }
 
-func (f fnames) Less(i, j int) bool {
-	key1 := strings.Split(*f[i], ".")
-	key2 := strings.Split(*f[j], ".")
-
-	t1, err := time.Parse("2006-01-02-15", key1[1])
-	if err != nil {
-		klog.V(1).Info("Unable to parse timestamp" + key1[1])
-		return false
-	}
-	t2, err := time.Parse("2006-01-02-15", key2[1])
-	if err != nil {
-		klog.V(1).Info("Unable to parse timestamp" + key2[1])
-		return false
+// SortSpotFeedKeys sorts the keys of spot data feed files by the hour they cover, and by name within an hour. Keys
+// without an hour are sorted first, so that the charges of the files with one take precedence.
+func SortSpotFeedKeys(keys []*string) {
+	hours := make(map[*string]time.Time, len(keys))
+	for _, key := range keys {
+		t, err := spotFeedFileTime(*key)
+		if err != nil {
+			klog.V(1).Infof("Unable to parse the hour of spot data file \"%s\": %s", *key, err.Error())
+		}
+		hours[key] = t
 	}
-	return t1.Before(t2)
+	sort.SliceStable(keys, func(i, j int) bool {
+		if ti, tj := hours[keys[i]], hours[keys[j]]; !ti.Equal(tj) {
+			return ti.Before(tj)
+		}
+		return *keys[i] < *keys[j]
+	})
 }
 
-func parseSpotData(bucket string, prefix string, projectID string, region string, accessKeyID string, accessKeySecret string) (map[string]*spotInfo, error) {
+func parseSpotData(bucket string, prefix string, projectID string, region string, accessKeyID string, accessKeySecret string) (map[string]*SpotInfo, error) {
 
 	if accessKeyID != "" && accessKeySecret != "" { // credentials may exist on the actual AWS node-- if so, use those. If not, override with the service key
 		err := os.Setenv(awsAccessKeyIDEnvVar, accessKeyID)
@@ -1318,14 +1500,10 @@ func parseSpotData(bucket string, prefix string, projectID string, region string
 		keys = append(keys, obj.Key)
 	}
 
-	versionRx := regexp.MustCompile("^#Version: (\\d+)\\.\\d+$")
-	header, err := csvutil.Header(spotInfo{}, "csv")
-	if err != nil {
-		return nil, err
-	}
-	fieldsPerRecord := len(header)
+	// files are named by the hour they cover, so are parsed in order, keeping the latest charge of each instance
+	SortSpotFeedKeys(keys)
 
-	spots := make(map[string]*spotInfo)
+	spots := make(map[string]*SpotInfo)
 	for _, key := range keys {
 		getObj := &s3.GetObjectInput{
 			Bucket: aws.String(bucket),
@@ -1338,66 +1516,84 @@ func parseSpotData(bucket string, prefix string, projectID string, region string
 			return nil, err
 		}
 
-		r := bytes.NewReader(buf.Bytes())
-
-		gr, err := gzip.NewReader(r)
+		// a corrupt file is skipped rather than discarding the whole feed
+		err = ParseSpotFeed(bytes.NewReader(buf.Bytes()), spots)
 		if err != nil {
-			return nil, err
+			klog.V(1).Infof("Skipping spot data file \"%s\": %s", *key, err.Error())
 		}
+	}
+	return spots, nil
+}
 
-		csvReader := csv.NewReader(gr)
-		csvReader.Comma = '\t'
-		csvReader.FieldsPerRecord = fieldsPerRecord
+// ParseSpotFeed decodes a gzipped spot data feed file into spots, by instance ID, replacing the records of instances
+// already in spots. It returns an error if the file can't be read or is of an unsupported version.
+func ParseSpotFeed(r io.Reader, spots map[string]*SpotInfo) error {
+	versionRx := regexp.MustCompile("^#Version: (\\d+)\\.\\d+$")
+	header, err := csvutil.Header(SpotInfo{}, "csv")
+	if err != nil {
+		return err
+	}
+	fieldsPerRecord := len(header)
 
-		dec, err := csvutil.NewDecoder(csvReader, header...)
-		if err != nil {
-			return nil, err
-		}
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer gr.Close()
 
-		var foundVersion string
-		for {
-			spot := spotInfo{}
-			err := dec.Decode(&spot)
-			csvParseErr, isCsvParseErr := err.(*csv.ParseError)
-			if err == io.EOF {
-				break
-			} else if err == csvutil.ErrFieldCount || (isCsvParseErr && csvParseErr.Err == csv.ErrFieldCount) {
-				rec := dec.Record()
-				// the first two "Record()" will be the comment lines
-				// and they show up as len() == 1
-				// the first of which is "#Version"
-				// the second of which is "#Fields: "
-				if len(rec) != 1 {
-					klog.V(2).Infof("Expected %d spot info fields but received %d: %s", fieldsPerRecord, len(rec), rec)
-					continue
-				}
-				if len(foundVersion) == 0 {
-					spotFeedVersion := rec[0]
-					klog.V(3).Infof("Spot feed version is \"%s\"", spotFeedVersion)
-					matches := versionRx.FindStringSubmatch(spotFeedVersion)
-					if matches != nil {
-						foundVersion = matches[1]
-						if foundVersion != supportedSpotFeedVersion {
-							klog.V(2).Infof("Unsupported spot info feed version: wanted \"%s\" got \"%s\"", supportedSpotFeedVersion, foundVersion)
-							break
-						}
+	csvReader := csv.NewReader(gr)
+	csvReader.Comma = '\t'
+	csvReader.FieldsPerRecord = fieldsPerRecord
+
+	dec, err := csvutil.NewDecoder(csvReader, header...)
+	if err != nil {
+		return err
+	}
+
+	var foundVersion string
+	for {
+		spot := SpotInfo{}
+		err := dec.Decode(&spot)
+		csvParseErr, isCsvParseErr := err.(*csv.ParseError)
+		if err == io.EOF {
+			break
+		} else if err == csvutil.ErrFieldCount || (isCsvParseErr && csvParseErr.Err == csv.ErrFieldCount) {
+			rec := dec.Record()
+			// the first two "Record()" will be the comment lines
+			// and they show up as len() == 1
+			// the first of which is "#Version"
+			// the second of which is "#Fields: "
+			if len(rec) != 1 {
+				klog.V(2).Infof("Expected %d spot info fields but received %d: %s", fieldsPerRecord, len(rec), rec)
+				continue
+			}
+			if len(foundVersion) == 0 {
+				spotFeedVersion := rec[0]
+				klog.V(3).Infof("Spot feed version is \"%s\"", spotFeedVersion)
+				matches := versionRx.FindStringSubmatch(spotFeedVersion)
+				if matches != nil {
+					foundVersion = matches[1]
+					if foundVersion != supportedSpotFeedVersion {
+						return fmt.Errorf("Unsupported spot info feed version: wanted \"%s\" got \"%s\"", supportedSpotFeedVersion, foundVersion)
 					}
-					continue
-				} else if strings.Index(rec[0], "#") == 0 {
-					continue
-				} else {
-					klog.V(3).Infof("skipping non-TSV line: %s", rec)
-					continue
 				}
-			} else if err != nil {
-				klog.V(2).Infof("Error during spot info decode: %+v", err)
+				continue
+			} else if strings.Index(rec[0], "#") == 0 {
+				continue
+			} else {
+				klog.V(3).Infof("skipping non-TSV line: %s", rec)
 				continue
 			}
-
-			klog.V(3).Infof("Found spot info %+v", spot)
-			spots[spot.InstanceID] = &spot
+		} else if isCsvParseErr {
+			klog.V(2).Infof("Error during spot info decode: %+v", err)
+			continue
+		} else if err != nil {
+			// the file itself cannot be read, e.g. it is truncated
+			return err
 		}
-		gr.Close()
+
+		klog.V(3).Infof("Found spot info %+v", spot)
+		spots[spot.InstanceID] = &spot
 	}
-	return spots, nil
+	return nil
 }
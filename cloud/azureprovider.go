@@ -164,18 +164,27 @@ func checkRegionID(regionID string, regions map[string]string) bool {
 
 type Azure struct {
 	allPrices               map[string]*Node
+	diskPrices              map[string]*PV
+	spotLabels              map[string]string
 	DownloadPricingDataLock sync.RWMutex
 	Clientset               *kubernetes.Clientset
+	RetailPricesURL         string // Defaults to AzureRetailPricesURL
+	clusterMetadata         map[string]string
+	clusterMetadataLock     sync.Mutex
 }
 
 type azureKey struct {
-	Labels map[string]string
+	Labels     map[string]string
+	SpotLabels map[string]string
 }
 
 func (k *azureKey) Features() string {
 	region := strings.ToLower(k.Labels[v1.LabelZoneRegion])
 	instance := k.Labels[v1.LabelInstanceType]
 	usageType := "ondemand"
+	if IsSpotNode(k.Labels, k.SpotLabels) {
+		usageType = "preemptible"
+	}
 	return fmt.Sprintf("%s,%s,%s", region, instance, usageType)
 }
 
@@ -189,7 +198,8 @@ func (k *azureKey) ID() string {
 
 func (az *Azure) GetKey(labels map[string]string) Key {
 	return &azureKey{
-		Labels: labels,
+		Labels:     labels,
+		SpotLabels: az.spotLabels,
 	}
 }
 
@@ -279,7 +289,8 @@ func (az *Azure) GetManagementPlatform() (string, error) {
 	return "", nil
 }
 
-// DownloadPricingData uses provided azure "best guesses" for pricing
+// DownloadPricingData fetches prices from the rate card of the configured subscription, or else from the
+// public Azure Retail Prices API
 func (az *Azure) DownloadPricingData() error {
 	az.DownloadPricingDataLock.Lock()
 	defer az.DownloadPricingDataLock.Unlock()
@@ -288,6 +299,10 @@ func (az *Azure) DownloadPricingData() error {
 	if err != nil {
 		return err
 	}
+	az.spotLabels = spotNodeLabels(config)
+	if config.AzureSubscriptionID == "" {
+		return az.downloadRetailPricingData(config)
+	}
 	var authorizer autorest.Authorizer
 
 	if config.AzureClientID != "" && config.AzureClientSecret != "" && config.AzureTenantID != "" {
@@ -361,14 +376,14 @@ func (az *Azure) DownloadPricingData() error {
 			}
 
 			usageType := ""
-			if !strings.Contains(meterName, "Low Priority") {
+			if !strings.Contains(meterName, "Low Priority") && !strings.HasSuffix(meterName, " Spot") {
 				usageType = "ondemand"
 			} else {
 				usageType = "preemptible"
 			}
 
 			var instanceTypes []string
-			name := strings.TrimSuffix(meterName, " Low Priority")
+			name := strings.TrimSuffix(strings.TrimSuffix(meterName, " Low Priority"), " Spot")
 			instanceType := strings.Split(name, "/")
 			for _, it := range instanceType {
 				instanceTypes = append(instanceTypes, strings.Replace(it, " ", "_", 1))
@@ -392,26 +407,67 @@ func (az *Azure) DownloadPricingData() error {
 			for _, instanceType := range instanceTypes {
 
 				key := fmt.Sprintf("%s,%s,%s", region, instanceType, usageType)
+				if _, ok := allPrices[key]; ok && strings.Contains(meterName, "Low Priority") {
+					continue // spot prices take precedence over those of the low priority VMs they replace
+				}
 				allPrices[key] = &Node{
 					Cost:         priceStr,
 					BaseCPUPrice: baseCPUPrice,
+					UsageType:    usageType,
+					Lifecycle:    LifecycleForUsageType(usageType),
 				}
 			}
 		}
 	}
 	az.allPrices = allPrices
+	az.diskPrices = nil
+	return nil
+}
+
+// azurePricingCache is the pricing data of Azure saved to the pricing cache
+type azurePricingCache struct {
+	NodePrices map[string]*Node `json:"nodePrices"`
+	DiskPrices map[string]*PV   `json:"diskPrices"`
+}
+
+// SavePricingData writes the pricing data last downloaded from the rate card or the Retail Prices API
+func (az *Azure) SavePricingData(w io.Writer) error {
+	az.DownloadPricingDataLock.RLock()
+	defer az.DownloadPricingDataLock.RUnlock()
+	return json.NewEncoder(w).Encode(&azurePricingCache{
+		NodePrices: az.allPrices,
+		DiskPrices: az.diskPrices,
+	})
+}
+
+// LoadPricingData replaces the pricing data with that written by SavePricingData
+func (az *Azure) LoadPricingData(r io.Reader) error {
+	cached := &azurePricingCache{}
+	if err := json.NewDecoder(r).Decode(cached); err != nil {
+		return err
+	}
+	az.DownloadPricingDataLock.Lock()
+	defer az.DownloadPricingDataLock.Unlock()
+	az.allPrices = cached.NodePrices
+	az.diskPrices = cached.DiskPrices
 	return nil
 }
 
-// AllNodePricing returns the Azure pricing objects stored
+// AllNodePricing returns the Azure pricing objects stored, along with any instance type rate overrides
 func (az *Azure) AllNodePricing() (interface{}, error) {
 	az.DownloadPricingDataLock.RLock()
 	defer az.DownloadPricingDataLock.RUnlock()
-	return az.allPrices, nil
+	return withRateOverrides(az, az.allPrices), nil
 }
 
-// NodePricing returns Azure pricing data for a single node
+// NodePricing returns Azure pricing data for a single node, priced by the rate override of its instance type,
+// if any, or else by its list price
 func (az *Azure) NodePricing(key Key) (*Node, error) {
+	node, err := az.listNodePricing(key)
+	return withRateOverride(az, key, node, err)
+}
+
+func (az *Azure) listNodePricing(key Key) (*Node, error) {
 	az.DownloadPricingDataLock.RLock()
 	defer az.DownloadPricingDataLock.RUnlock()
 	if n, ok := az.allPrices[key.Features()]; ok {
@@ -430,30 +486,60 @@ func (az *Azure) NodePricing(key Key) (*Node, error) {
 	}, nil
 }
 
-// Stubbed NetworkPricing for Azure. Pull directly from azure.json for now
+// azureNetworkEgress are the per GB prices of Azure bandwidth between availability zones, between regions
+// within a continent, and out to the internet, past the first 100 GB of each month
+var azureNetworkEgress = &Network{
+	ZoneNetworkEgressCost:     0.01,
+	RegionNetworkEgressCost:   0.02,
+	InternetNetworkEgressCost: 0.087,
+}
+
+// NetworkPricing returns the egress prices of azure.json, defaulting to the Azure bandwidth prices
 func (c *Azure) NetworkPricing() (*Network, error) {
 	cpricing, err := GetDefaultPricingData("azure.json")
 	if err != nil {
 		return nil, err
 	}
-	znec, err := strconv.ParseFloat(cpricing.ZoneNetworkEgress, 64)
-	if err != nil {
-		return nil, err
+	network := *azureNetworkEgress
+	if cpricing.ZoneNetworkEgress != "" {
+		network.ZoneNetworkEgressCost, err = strconv.ParseFloat(cpricing.ZoneNetworkEgress, 64)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if cpricing.RegionNetworkEgress != "" {
+		network.RegionNetworkEgressCost, err = strconv.ParseFloat(cpricing.RegionNetworkEgress, 64)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if cpricing.InternetNetworkEgress != "" {
+		network.InternetNetworkEgressCost, err = strconv.ParseFloat(cpricing.InternetNetworkEgress, 64)
+		if err != nil {
+			return nil, err
+		}
 	}
-	rnec, err := strconv.ParseFloat(cpricing.RegionNetworkEgress, 64)
+	return &network, nil
+}
+
+// LoadBalancerPricing returns the hourly cost of a load balancer, defaulting to the price of a standard load balancer
+func (*Azure) LoadBalancerPricing() (*LoadBalancer, error) {
+	cpricing, err := GetDefaultPricingData("azure.json")
 	if err != nil {
 		return nil, err
 	}
-	inec, err := strconv.ParseFloat(cpricing.InternetNetworkEgress, 64)
+	return loadBalancerPricing(cpricing, 0.025)
+}
+
+// GPUPricing returns the hourly price of a GPU of each model, by which the price of a GPU instance is split
+// between its GPUs and the rest of the instance. Azure prices GPUs only as part of their VM sizes, so only the
+// models priced by the config are.
+func (*Azure) GPUPricing() (*GPUPricing, error) {
+	cpricing, err := GetDefaultPricingData("azure.json")
 	if err != nil {
 		return nil, err
 	}
-
-	return &Network{
-		ZoneNetworkEgressCost:     znec,
-		RegionNetworkEgressCost:   rnec,
-		InternetNetworkEgressCost: inec,
-	}, nil
+	return gpuPricing(cpricing, nil, nil)
 }
 
 type azurePvKey struct {
@@ -474,14 +560,19 @@ func (key *azurePvKey) GetStorageClass() string {
 	return key.StorageClass
 }
 
+// Features keys the volume by its region and the managed disk SKU of its storage class, e.g. "eastus,Premium_LRS"
 func (key *azurePvKey) Features() string {
-	storageClass := key.StorageClassParameters["type"]
-	if storageClass == "pd-ssd" {
-		storageClass = "ssd"
-	} else if storageClass == "pd-standard" {
-		storageClass = "pdstandard"
+	return strings.ToLower(key.Labels[v1.LabelZoneRegion]) + "," + key.diskSKU()
+}
+
+// diskSKU returns the managed disk SKU named by the parameters of the storage class of the volume
+func (key *azurePvKey) diskSKU() string {
+	for k, v := range key.StorageClassParameters {
+		if strings.EqualFold(k, "skuname") || strings.EqualFold(k, "storageaccounttype") {
+			return v
+		}
 	}
-	return key.Labels[v1.LabelZoneRegion] + "," + storageClass
+	return ""
 }
 
 func (*Azure) GetDisks() ([]byte, error) {
@@ -507,10 +598,67 @@ func (az *Azure) ClusterInfo() (map[string]string, error) {
 	m["provider"] = "azure"
 	m["remoteReadEnabled"] = strconv.FormatBool(remoteEnabled)
 	m["id"] = os.Getenv(clusterIDKey)
+	for k, v := range az.getClusterMetadata() {
+		if k == "name" && c.ClusterName != "" {
+			continue
+		}
+		m[k] = v
+	}
 	return m, nil
 
 }
 
+// getClusterMetadata returns the cluster metadata read from the nodes, listing them only until a read succeeds
+func (az *Azure) getClusterMetadata() map[string]string {
+	az.clusterMetadataLock.Lock()
+	defer az.clusterMetadataLock.Unlock()
+	if az.clusterMetadata == nil {
+		if m, ok := azureClusterMetadata(az.Clientset); ok {
+			az.clusterMetadata = m
+		}
+	}
+	return az.clusterMetadata
+}
+
+// azureProviderID matches the subscription and resource group in the provider ID of an AKS node, e.g.
+// "azure:///subscriptions/SUB/resourceGroups/MC_rg_cluster_eastus/providers/Microsoft.Compute/..."
+var azureProviderID = regexp.MustCompile(`(?i)^azure:///subscriptions/([^/]+)/resourceGroups/([^/]+)/`)
+
+// azureClusterMetadata reads the name, resource group, subscription and region of the AKS cluster from the
+// provider ID and labels of its nodes, which sit in the node resource group "MC_RESOURCEGROUP_CLUSTER_REGION".
+// ok is false if no node could be read.
+func azureClusterMetadata(clientset *kubernetes.Clientset) (m map[string]string, ok bool) {
+	m = make(map[string]string)
+	if clientset == nil {
+		return m, false
+	}
+	nodes, err := clientset.CoreV1().Nodes().List(metav1.ListOptions{})
+	if err != nil || len(nodes.Items) == 0 {
+		return m, false
+	}
+	n := nodes.Items[0]
+	if region := n.Labels[v1.LabelZoneRegion]; region != "" {
+		m["region"] = region
+	}
+	nodeResourceGroup := n.Labels["kubernetes.azure.com/cluster"]
+	if match := azureProviderID.FindStringSubmatch(n.Spec.ProviderID); match != nil {
+		m["subscriptionID"] = match[1]
+		if nodeResourceGroup == "" {
+			nodeResourceGroup = match[2]
+		}
+	}
+	if nodeResourceGroup != "" {
+		m["nodeResourceGroup"] = nodeResourceGroup
+	}
+	// Resource group and cluster names may themselves contain underscores, in which case they can't be told apart
+	parts := strings.Split(nodeResourceGroup, "_")
+	if len(parts) == 4 && strings.EqualFold(parts[0], "MC") {
+		m["resourceGroup"] = parts[1]
+		m["name"] = parts[2]
+	}
+	return m, true
+}
+
 func (az *Azure) AddServiceKey(url url.Values) error {
 	return nil
 }
@@ -574,12 +722,34 @@ func (az *Azure) GetConfig() (*CustomPricing, error) {
 	return c, nil
 }
 
-func (az *Azure) ExternalAllocations(string, string, string) ([]*OutOfClusterAllocation, error) {
+func (az *Azure) ExternalAllocations(*ExternalAllocationsQuery) (*ExternalAllocationsResult, error) {
 	return nil, nil
 }
 
-func (az *Azure) PVPricing(PVKey) (*PV, error) {
-	return nil, nil
+// azureStorageTiers are the eastus prices of provisioned IOPS and throughput, by managed disk SKU
+var azureStorageTiers = map[string]*StorageTier{
+	"UltraSSD_LRS":  &StorageTier{IOPSCost: 0.0496 / 730, ThroughputCost: 0.0345 / 730},
+	"PremiumV2_LRS": &StorageTier{IOPSCost: 0.0049 / 730, IncludedIOPS: 3000, ThroughputCost: 0.04 / 730, IncludedThroughput: 125},
+}
+
+// PVPricing returns the price of the capacity of the managed disk SKU of the volume, where the retail prices
+// list it, and that of its provisioned performance
+func (az *Azure) PVPricing(pvk PVKey) (*PV, error) {
+	az.DownloadPricingDataLock.RLock()
+	defer az.DownloadPricingDataLock.RUnlock()
+	key, ok := pvk.(*azurePvKey)
+	if !ok {
+		return nil, nil
+	}
+	tier := azureStorageTiers[key.diskSKU()]
+	pricing, ok := az.diskPrices[key.Features()]
+	if !ok {
+		klog.V(4).Infof("Persistent Volume pricing not found for %s: %s", pvk.GetStorageClass(), pvk.Features())
+		return &PV{Tier: tier}, nil
+	}
+	pv := *pricing
+	pv.Tier = tier
+	return &pv, nil
 }
 
 func (az *Azure) GetLocalStorageQuery() (string, error) {
@@ -0,0 +1,209 @@
+package cloud
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+)
+
+// AzureRetailPricesURL is the Azure Retail Prices API, which lists the public prices of each meter without authentication
+const AzureRetailPricesURL = "https://prices.azure.com/api/retail/prices"
+
+// azureDiskProducts map the managed disk products of the Retail Prices API to the storage account type, less
+// its redundancy, by which storage classes name the disk SKU
+var azureDiskProducts = map[string]string{
+	"Premium SSD Managed Disks":  "Premium",
+	"Standard SSD Managed Disks": "StandardSSD",
+	"Standard HDD Managed Disks": "Standard",
+}
+
+// azureDiskTierMeter matches the monthly meter of the 1 TiB tier of each managed disk product, by which the
+// capacity of a disk of that product is priced per GB, e.g. "P30 LRS Disk"
+var azureDiskTierMeter = regexp.MustCompile(`^[PES]30 (LRS|ZRS) Disk$`)
+
+const azureDiskTierGB = 1024
+
+// azureRetailPrice is an item of the Azure Retail Prices API
+type azureRetailPrice struct {
+	CurrencyCode  string  `json:"currencyCode"`
+	RetailPrice   float64 `json:"retailPrice"`
+	ArmRegionName string  `json:"armRegionName"`
+	ArmSkuName    string  `json:"armSkuName"`
+	MeterName     string  `json:"meterName"`
+	ProductName   string  `json:"productName"`
+	SkuName       string  `json:"skuName"`
+	ServiceName   string  `json:"serviceName"`
+	UnitOfMeasure string  `json:"unitOfMeasure"`
+	Type          string  `json:"type"`
+}
+
+type azureRetailPricesPage struct {
+	Items        []*azureRetailPrice `json:"Items"`
+	NextPageLink string              `json:"NextPageLink"`
+}
+
+// downloadRetailPricingData prices the nodes and managed disks of the regions of the cluster by the Azure Retail
+// Prices API, for clusters without the subscription credentials the rate card requires
+func (az *Azure) downloadRetailPricingData(config *CustomPricing) error {
+	regions := azureClusterRegions(az.Clientset)
+	baseURL := az.RetailPricesURL
+	if baseURL == "" {
+		baseURL = AzureRetailPricesURL
+	}
+
+	vmFilter := "serviceName eq 'Virtual Machines' and priceType eq 'Consumption'"
+	vmPrices, err := getAzureRetailPrices(baseURL, config.CurrencyCode, vmFilter, regions)
+	if err != nil {
+		return err
+	}
+	diskProducts := []string{}
+	for product := range azureDiskProducts {
+		diskProducts = append(diskProducts, fmt.Sprintf("productName eq '%s'", product))
+	}
+	sort.Strings(diskProducts)
+	diskFilter := fmt.Sprintf("serviceName eq 'Storage' and priceType eq 'Consumption' and (%s)", strings.Join(diskProducts, " or "))
+	diskPrices, err := getAzureRetailPrices(baseURL, config.CurrencyCode, diskFilter, regions)
+	if err != nil {
+		return err
+	}
+
+	az.allPrices = azureRetailNodePrices(vmPrices, config.CPU)
+	az.diskPrices = azureRetailDiskPrices(diskPrices)
+	klog.V(2).Infof("Priced %d Azure VM sizes and %d managed disk SKUs from the retail prices API", len(az.allPrices), len(az.diskPrices))
+	return nil
+}
+
+// azureClusterRegions returns the regions of the nodes of the cluster, or none if they cannot be listed
+func azureClusterRegions(clientset *kubernetes.Clientset) []string {
+	if clientset == nil {
+		return nil
+	}
+	nodes, err := clientset.CoreV1().Nodes().List(metav1.ListOptions{})
+	if err != nil {
+		klog.V(1).Infof("Fetching Azure prices of all regions, as nodes could not be listed: %s", err.Error())
+		return nil
+	}
+	seen := make(map[string]bool)
+	regions := []string{}
+	for _, n := range nodes.Items {
+		region := strings.ToLower(n.Labels[v1.LabelZoneRegion])
+		if region != "" && !seen[region] {
+			seen[region] = true
+			regions = append(regions, region)
+		}
+	}
+	sort.Strings(regions)
+	return regions
+}
+
+// getAzureRetailPrices fetches every page of the retail prices matching the given filter in the given regions,
+// or in all regions if none are given
+func getAzureRetailPrices(baseURL string, currency string, filter string, regions []string) ([]*azureRetailPrice, error) {
+	if len(regions) > 0 {
+		regionFilters := make([]string, 0, len(regions))
+		for _, region := range regions {
+			regionFilters = append(regionFilters, fmt.Sprintf("armRegionName eq '%s'", region))
+		}
+		filter = fmt.Sprintf("%s and (%s)", filter, strings.Join(regionFilters, " or "))
+	}
+	query := url.Values{}
+	query.Set("$filter", filter)
+	if currency != "" {
+		query.Set("currencyCode", currency)
+	}
+	next := baseURL + "?" + query.Encode()
+	klog.V(2).Infof("Fetching Azure retail prices from URL: %s", next)
+
+	prices := []*azureRetailPrice{}
+	for next != "" {
+		page, err := getAzureRetailPricesPage(next)
+		if err != nil {
+			return nil, err
+		}
+		prices = append(prices, page.Items...)
+		next = page.NextPageLink
+	}
+	return prices, nil
+}
+
+func getAzureRetailPricesPage(pageURL string) (*azureRetailPricesPage, error) {
+	resp, err := http.Get(pageURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Azure retail prices request failed with status %s", resp.Status)
+	}
+	page := &azureRetailPricesPage{}
+	if err := json.NewDecoder(resp.Body).Decode(page); err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+// azureRetailNodePrices keys the hourly prices of Linux VM sizes by region, VM size and usage type, as the
+// rate card prices are keyed
+func azureRetailNodePrices(prices []*azureRetailPrice, baseCPUPrice string) map[string]*Node {
+	allPrices := make(map[string]*Node)
+	for _, p := range prices {
+		if p.ArmSkuName == "" || p.UnitOfMeasure != "1 Hour" {
+			continue
+		}
+		if strings.Contains(p.ProductName, "Windows") || strings.Contains(p.SkuName, "Promo") {
+			continue
+		}
+
+		usageType := "ondemand"
+		lowPriority := strings.HasSuffix(p.MeterName, " Low Priority")
+		if lowPriority || strings.HasSuffix(p.MeterName, " Spot") {
+			usageType = "preemptible"
+		}
+
+		key := fmt.Sprintf("%s,%s,%s", strings.ToLower(p.ArmRegionName), p.ArmSkuName, usageType)
+		if _, ok := allPrices[key]; ok && lowPriority {
+			continue // spot prices take precedence over those of the low priority VMs they replace
+		}
+		allPrices[key] = &Node{
+			Cost:         strconv.FormatFloat(p.RetailPrice, 'f', -1, 64),
+			BaseCPUPrice: baseCPUPrice,
+			UsageType:    usageType,
+			Lifecycle:    LifecycleForUsageType(usageType),
+		}
+	}
+	return allPrices
+}
+
+// azureRetailDiskPrices keys the hourly price per GB of each managed disk SKU by region and storage account
+// type, e.g. "eastus,Premium_LRS"
+func azureRetailDiskPrices(prices []*azureRetailPrice) map[string]*PV {
+	diskPrices := make(map[string]*PV)
+	for _, p := range prices {
+		accountType, ok := azureDiskProducts[p.ProductName]
+		if !ok {
+			continue
+		}
+		match := azureDiskTierMeter.FindStringSubmatch(p.MeterName)
+		if match == nil || p.UnitOfMeasure != "1/Month" {
+			continue
+		}
+		region := strings.ToLower(p.ArmRegionName)
+		sku := accountType + "_" + match[1]
+		diskPrices[region+","+sku] = &PV{
+			Cost:   strconv.FormatFloat(p.RetailPrice/azureDiskTierGB/730, 'f', -1, 64),
+			Class:  sku,
+			Region: region,
+		}
+	}
+	return diskPrices
+}
@@ -0,0 +1,118 @@
+package cloud
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// The periods over which the spend of a budget is reset
+const (
+	BudgetMonthly = "monthly" // calendar months, in UTC
+	BudgetWeekly  = "weekly"  // weeks from Monday, in UTC
+)
+
+// The formats of the payload POSTed to the webhook of a budget
+const (
+	BudgetWebhookGeneric = "generic"
+	BudgetWebhookSlack   = "slack"
+)
+
+// DefaultBudgetThresholds are the fractions of the amount of a budget at which it alerts, unless it sets its own
+var DefaultBudgetThresholds = []float64{0.8, 1}
+
+// Budget is the amount the cost of an aggregation, e.g. the namespace "team-a", must not exceed over each period,
+// with the fractions of it at which to alert and the webhook to alert
+type Budget struct {
+	ID            string    `json:"id"`                 // set from the aggregation and window, as returned by BudgetID
+	Field         string    `json:"field"`              // aggregation field, e.g. "namespace" or "label"
+	SubField      string    `json:"subfield,omitempty"` // aggregation subfield, e.g. the name of the label
+	Value         string    `json:"value"`              // the aggregation whose cost is budgeted, e.g. "team-a"
+	Window        string    `json:"window"`             // BudgetMonthly or BudgetWeekly
+	Amount        float64   `json:"amount"`             // in the default currency, $CURRENCY or USD
+	Thresholds    []float64 `json:"thresholds,omitempty"`
+	WebhookURL    string    `json:"webhookURL,omitempty"`    // the default budget webhook is alerted if unset
+	WebhookFormat string    `json:"webhookFormat,omitempty"` // BudgetWebhookGeneric, the default, or BudgetWebhookSlack
+}
+
+// BudgetID returns the ID of the budget of the given aggregation over the given window, e.g. "namespace:team-a:monthly"
+// or "label:team:ml:weekly", by which budgets are keyed
+func BudgetID(field, subfield, value, window string) string {
+	components := []string{field}
+	if subfield != "" {
+		components = append(components, subfield)
+	}
+	return strings.Join(append(components, value, window), ":")
+}
+
+// Validate normalizes the budget, setting its ID, thresholds and webhook format, and returns an error if it's invalid
+func (b *Budget) Validate() error {
+	if b.Field == "" || b.Value == "" {
+		return fmt.Errorf("Invalid budget; field and value are required")
+	}
+	b.Window = strings.ToLower(b.Window)
+	if b.Window != BudgetMonthly && b.Window != BudgetWeekly {
+		return fmt.Errorf("Invalid budget window '%s'; must be '%s' or '%s'", b.Window, BudgetMonthly, BudgetWeekly)
+	}
+	if b.Amount <= 0 {
+		return fmt.Errorf("Invalid budget amount %g; must be positive", b.Amount)
+	}
+	if len(b.Thresholds) == 0 {
+		b.Thresholds = append([]float64{}, DefaultBudgetThresholds...)
+	}
+	for _, t := range b.Thresholds {
+		if t <= 0 {
+			return fmt.Errorf("Invalid budget threshold %g; must be a positive fraction of the amount, e.g. 0.8", t)
+		}
+	}
+	sort.Float64s(b.Thresholds)
+	if b.WebhookURL != "" {
+		u, err := url.Parse(b.WebhookURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("Invalid budget webhook URL '%s'; must be an http or https URL", b.WebhookURL)
+		}
+	}
+	b.WebhookFormat = strings.ToLower(b.WebhookFormat)
+	if b.WebhookFormat == "" {
+		b.WebhookFormat = BudgetWebhookGeneric
+	}
+	if b.WebhookFormat != BudgetWebhookGeneric && b.WebhookFormat != BudgetWebhookSlack {
+		return fmt.Errorf("Invalid budget webhook format '%s'; must be '%s' or '%s'", b.WebhookFormat, BudgetWebhookGeneric, BudgetWebhookSlack)
+	}
+	b.ID = BudgetID(b.Field, b.SubField, b.Value, b.Window)
+	return nil
+}
+
+// Budgets parses the budgets of the given config, which are a JSON array of Budget
+func Budgets(c *CustomPricing) ([]*Budget, error) {
+	if c == nil {
+		return []*Budget{}, nil
+	}
+	return parseBudgets(c.Budgets)
+}
+
+func parseBudgets(s string) ([]*Budget, error) {
+	budgets := []*Budget{}
+	if strings.TrimSpace(s) == "" {
+		return budgets, nil
+	}
+	if err := json.Unmarshal([]byte(s), &budgets); err != nil {
+		return nil, fmt.Errorf("Invalid budgets; expected a JSON array of budgets: %s", err.Error())
+	}
+	ids := make(map[string]bool)
+	for _, b := range budgets {
+		if b == nil {
+			return nil, fmt.Errorf("Invalid budgets; expected a JSON array of budgets")
+		}
+		if err := b.Validate(); err != nil {
+			return nil, err
+		}
+		if ids[b.ID] {
+			return nil, fmt.Errorf("Invalid budgets; more than one budget of %s", b.ID)
+		}
+		ids[b.ID] = true
+	}
+	return budgets, nil
+}
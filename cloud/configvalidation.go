@@ -0,0 +1,159 @@
+package cloud
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// currencyCodes are the active ISO 4217 currency codes
+var currencyCodes = map[string]bool{
+	"AED": true, "AFN": true, "ALL": true, "AMD": true, "ANG": true, "AOA": true, "ARS": true, "AUD": true,
+	"AWG": true, "AZN": true, "BAM": true, "BBD": true, "BDT": true, "BGN": true, "BHD": true, "BIF": true,
+	"BMD": true, "BND": true, "BOB": true, "BRL": true, "BSD": true, "BTN": true, "BWP": true, "BYN": true,
+	"BZD": true, "CAD": true, "CDF": true, "CHF": true, "CLP": true, "CNY": true, "COP": true, "CRC": true,
+	"CUP": true, "CVE": true, "CZK": true, "DJF": true, "DKK": true, "DOP": true, "DZD": true, "EGP": true,
+	"ERN": true, "ETB": true, "EUR": true, "FJD": true, "FKP": true, "GBP": true, "GEL": true, "GHS": true,
+	"GIP": true, "GMD": true, "GNF": true, "GTQ": true, "GYD": true, "HKD": true, "HNL": true, "HTG": true,
+	"HUF": true, "IDR": true, "ILS": true, "INR": true, "IQD": true, "IRR": true, "ISK": true, "JMD": true,
+	"JOD": true, "JPY": true, "KES": true, "KGS": true, "KHR": true, "KMF": true, "KPW": true, "KRW": true,
+	"KWD": true, "KYD": true, "KZT": true, "LAK": true, "LBP": true, "LKR": true, "LRD": true, "LSL": true,
+	"LYD": true, "MAD": true, "MDL": true, "MGA": true, "MKD": true, "MMK": true, "MNT": true, "MOP": true,
+	"MRU": true, "MUR": true, "MVR": true, "MWK": true, "MXN": true, "MYR": true, "MZN": true, "NAD": true,
+	"NGN": true, "NIO": true, "NOK": true, "NPR": true, "NZD": true, "OMR": true, "PAB": true, "PEN": true,
+	"PGK": true, "PHP": true, "PKR": true, "PLN": true, "PYG": true, "QAR": true, "RON": true, "RSD": true,
+	"RUB": true, "RWF": true, "SAR": true, "SBD": true, "SCR": true, "SDG": true, "SEK": true, "SGD": true,
+	"SHP": true, "SLE": true, "SOS": true, "SRD": true, "SSP": true, "STN": true, "SVC": true, "SYP": true,
+	"SZL": true, "THB": true, "TJS": true, "TMT": true, "TND": true, "TOP": true, "TRY": true, "TTD": true,
+	"TWD": true, "TZS": true, "UAH": true, "UGX": true, "USD": true, "UYU": true, "UZS": true, "VES": true,
+	"VND": true, "VUV": true, "WST": true, "XAF": true, "XCD": true, "XOF": true, "XPF": true, "YER": true,
+	"ZAR": true, "ZMW": true, "ZWL": true,
+}
+
+// priceFields are the config fields holding a single price
+var priceFields = map[string]bool{
+	"CPU": true, "SpotCPU": true, "RAM": true, "SpotRAM": true, "GPU": true, "SpotGPU": true, "Storage": true,
+	"ZoneNetworkEgress": true, "RegionNetworkEgress": true, "InternetNetworkEgress": true,
+	"ClusterManagementFee": true, "LoadBalancerCost": true,
+}
+
+// markupFields are the config fields holding a markup percentage
+var markupFields = map[string]bool{
+	"CpuMarkup": true, "RamMarkup": true, "GpuMarkup": true, "StorageMarkup": true, "OverallMarkup": true,
+}
+
+// CustomPricingKeys returns the keys by which UpdateConfig sets the fields of the config, as serialized
+func CustomPricingKeys() []string {
+	t := reflect.TypeOf(CustomPricing{})
+	keys := []string{}
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if name == "" {
+			name = t.Field(i).Name
+		}
+		if ValidateCustomPricingField(strings.Title(name)) == nil {
+			keys = append(keys, name)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// ValidateCustomPricingValue returns an error if the given value of the named field would corrupt cost
+// calculations: prices must be non-negative numbers, the discount a percentage from 0% to 100%, markups
+// non-negative percentages, and the currency a known ISO 4217 code. Optional fields may be left empty.
+func ValidateCustomPricingValue(name string, value string) error {
+	field, ok := reflect.TypeOf(CustomPricing{}).FieldByName(name)
+	if !ok {
+		return fmt.Errorf("No such field: %s in obj", name)
+	}
+	if value == "" && strings.Contains(field.Tag.Get("json"), ",omitempty") {
+		return nil
+	}
+
+	switch {
+	case priceFields[name]:
+		price, err := strconv.ParseFloat(value, 64)
+		if err != nil || price < 0 {
+			return fmt.Errorf("Invalid price '%s'; must be a non-negative number, e.g. \"0.031611\"", value)
+		}
+	case name == "Discount":
+		// costs discounted by a discount schedule instead may leave the discount empty
+		if value == "" {
+			return nil
+		}
+		if !strings.HasSuffix(value, "%") {
+			return fmt.Errorf("Invalid discount '%s'; must be a percentage from 0%% to 100%%, e.g. \"10%%\"", value)
+		}
+		discount, err := strconv.ParseFloat(value[:len(value)-1], 64)
+		if err != nil || discount < 0 || discount > 100 {
+			return fmt.Errorf("Invalid discount '%s'; must be a percentage from 0%% to 100%%, e.g. \"10%%\"", value)
+		}
+	case name == "DiscountSchedule":
+		if _, err := parseDiscountSchedule(value); err != nil {
+			return err
+		}
+	case markupFields[name]:
+		if _, err := parseMarkup(value, 0); err != nil {
+			return err
+		}
+	case name == "CostRules":
+		if _, err := parseCostRules(value); err != nil {
+			return err
+		}
+	case name == "InstanceTypeRates":
+		if _, err := parseInstanceTypeRates(value); err != nil {
+			return err
+		}
+	case name == "CustomPricesByLabel":
+		if _, err := parseCustomPriceSelectors(value); err != nil {
+			return err
+		}
+	case name == "AthenaCacheTTL" || name == "AthenaQueryTimeout":
+		if d, err := time.ParseDuration(value); err != nil || d <= 0 {
+			return fmt.Errorf("Invalid duration '%s'; must be positive, e.g. \"6h\"", value)
+		}
+	case name == "ExternalTagMappings":
+		if _, err := parseExternalTagMappings(value); err != nil {
+			return err
+		}
+	case name == "NetworkEgressSplit":
+		if _, err := parseEgressSplit(value); err != nil {
+			return err
+		}
+	case name == "Budgets":
+		if _, err := parseBudgets(value); err != nil {
+			return err
+		}
+	case name == "CurrencyCode":
+		if !currencyCodes[strings.ToUpper(value)] {
+			return fmt.Errorf("Invalid currency '%s'; must be an ISO 4217 code, e.g. \"USD\"", value)
+		}
+	case name == "CurrencyRates":
+		for _, pair := range strings.Split(value, ",") {
+			kv := strings.Split(strings.TrimSpace(pair), ":")
+			if len(kv) != 2 || !currencyCodes[strings.ToUpper(strings.TrimSpace(kv[0]))] {
+				return fmt.Errorf("Invalid currency rate '%s'; expected the form CURRENCY:RATE with an ISO 4217 currency", pair)
+			}
+			if rate, err := strconv.ParseFloat(strings.TrimSpace(kv[1]), 64); err != nil || rate <= 0 {
+				return fmt.Errorf("Invalid currency rate '%s'; rate must be a positive number", pair)
+			}
+		}
+	case name == "GpuPricing" || name == "SpotGPUPricing":
+		if _, err := parseGPUPrices(value); err != nil {
+			return err
+		}
+	case name == "RamUnit":
+		if unit := strings.ToLower(value); unit != RAMUnitBinary && unit != RAMUnitDecimal {
+			return fmt.Errorf("Invalid ramUnit '%s'; must be '%s' or '%s'", value, RAMUnitBinary, RAMUnitDecimal)
+		}
+	case name == "CustomPricesEnabled":
+		if value != "true" && value != "false" {
+			return fmt.Errorf("Invalid customPricesEnabled '%s'; must be 'true' or 'false'", value)
+		}
+	}
+	return nil
+}
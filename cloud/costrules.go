@@ -0,0 +1,131 @@
+package cloud
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Kinds of CostRule selectors, in increasing order of specificity
+const (
+	costRuleNamespacePattern = iota
+	costRuleLabel
+	costRuleNamespace
+)
+
+// CostRule overrides the discount and markup of the costs of containers in the namespaces matching a pattern,
+// or carrying a label, e.g. to charge back one tenant at a markup and pass a negotiated discount on to another.
+// A nil Discount or Markup leaves the global discount or the configured markups respectively.
+type CostRule struct {
+	Rule       string   // the rule as configured
+	Namespace  string   // namespace, or pattern thereof where "*" matches any characters, e.g. "tenant-a-*"
+	LabelName  string   // name of the label to match, when matching by label rather than namespace
+	LabelValue string   // value of the label to match
+	Discount   *float64 // fraction by which costs are discounted
+	Markup     *float64 // fraction by which discounted costs are marked up
+}
+
+// Matches reports whether the rule applies to containers in the given namespace with the given labels
+func (r *CostRule) Matches(namespace string, labels map[string]string) bool {
+	if r.LabelName != "" {
+		value, ok := labels[r.LabelName]
+		return ok && value == r.LabelValue
+	}
+	matched, _ := path.Match(r.Namespace, namespace)
+	return matched
+}
+
+// specificity ranks the rule by the kind of its selector and then, for namespace patterns, by the number of
+// characters they match literally
+func (r *CostRule) specificity() (int, int) {
+	if r.LabelName != "" {
+		return costRuleLabel, 0
+	}
+	if !strings.ContainsAny(r.Namespace, "*?[") {
+		return costRuleNamespace, 0
+	}
+	return costRuleNamespacePattern, len(strings.NewReplacer("*", "", "?", "").Replace(r.Namespace))
+}
+
+// MatchCostRule returns the most specific of the given rules applying to containers in the given namespace with
+// the given labels, or nil if none does. A rule naming a namespace is more specific than one selecting a label,
+// which is more specific than one matching a namespace pattern; ties go to the rule listed first.
+func MatchCostRule(rules []*CostRule, namespace string, labels map[string]string) *CostRule {
+	var match *CostRule
+	matchKind, matchLiteral := 0, 0
+	for _, r := range rules {
+		if !r.Matches(namespace, labels) {
+			continue
+		}
+		kind, literal := r.specificity()
+		if match == nil || kind > matchKind || (kind == matchKind && literal > matchLiteral) {
+			match, matchKind, matchLiteral = r, kind, literal
+		}
+	}
+	return match
+}
+
+// CostRules parses the cost rules of the given config, which are of the form "SELECTOR,DISCOUNT,MARKUP;..."
+// where SELECTOR is "namespace=PATTERN" or "label.NAME=VALUE", and DISCOUNT and MARKUP are percentages that
+// may be left empty to keep the defaults, e.g. "namespace=tenant-a-*,,15%;label.team=ml,30%,".
+func CostRules(c *CustomPricing) ([]*CostRule, error) {
+	if c == nil {
+		return []*CostRule{}, nil
+	}
+	return parseCostRules(c.CostRules)
+}
+
+func parseCostRules(s string) ([]*CostRule, error) {
+	rules := []*CostRule{}
+	if strings.TrimSpace(s) == "" {
+		return rules, nil
+	}
+	for _, entry := range strings.Split(s, ";") {
+		entry = strings.TrimSpace(entry)
+		components := strings.Split(entry, ",")
+		if len(components) != 3 {
+			return nil, fmt.Errorf("Invalid cost rule '%s'; expected the form SELECTOR,DISCOUNT,MARKUP", entry)
+		}
+		for i := range components {
+			components[i] = strings.TrimSpace(components[i])
+		}
+		r := &CostRule{Rule: entry}
+
+		kv := strings.SplitN(components[0], "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return nil, fmt.Errorf("Invalid cost rule selector '%s' in '%s'; expected namespace=PATTERN or label.NAME=VALUE", components[0], entry)
+		}
+		switch {
+		case kv[0] == "namespace":
+			if _, err := path.Match(kv[1], ""); err != nil {
+				return nil, fmt.Errorf("Invalid namespace pattern '%s' in '%s'", kv[1], entry)
+			}
+			r.Namespace = kv[1]
+		case strings.HasPrefix(kv[0], "label.") && len(kv[0]) > len("label."):
+			r.LabelName = strings.TrimPrefix(kv[0], "label.")
+			r.LabelValue = kv[1]
+		default:
+			return nil, fmt.Errorf("Invalid cost rule selector '%s' in '%s'; expected namespace=PATTERN or label.NAME=VALUE", components[0], entry)
+		}
+
+		if components[1] != "" {
+			discount, err := parseMarkup(components[1], 0)
+			if err != nil || discount > 1 {
+				return nil, fmt.Errorf("Invalid discount '%s' in cost rule '%s'; must be a percentage from 0%% to 100%%", components[1], entry)
+			}
+			r.Discount = &discount
+		}
+		if components[2] != "" {
+			markup, err := parseMarkup(components[2], 0)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid markup '%s' in cost rule '%s'; must be a non-negative percentage", components[2], entry)
+			}
+			r.Markup = &markup
+		}
+		if r.Discount == nil && r.Markup == nil {
+			return nil, fmt.Errorf("Invalid cost rule '%s'; a discount or markup is required", entry)
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
@@ -0,0 +1,90 @@
+package cloud
+
+import (
+	"fmt"
+	"strings"
+)
+
+// CustomPriceSelector prices the nodes matching a label selector in place of the global custom prices, when
+// custom prices are enabled, e.g. to price a pool of memory optimized nodes apart from general purpose ones.
+// Prices are as those of the config, and an empty GPU price leaves that of the global custom prices.
+type CustomPriceSelector struct {
+	Selector map[string]string `json:"selector"`
+	CPU      string            `json:"CPU"`
+	RAM      string            `json:"RAM"`
+	GPU      string            `json:"GPU,omitempty"`
+}
+
+// Matches reports whether the node of the given labels has every label of the selector
+func (s *CustomPriceSelector) Matches(labels map[string]string) bool {
+	for k, v := range s.Selector {
+		if value, ok := labels[k]; !ok || value != v {
+			return false
+		}
+	}
+	return true
+}
+
+// MatchCustomPriceSelector returns the first of the given selectors matching the node of the given labels, or
+// nil if none does
+func MatchCustomPriceSelector(selectors []*CustomPriceSelector, labels map[string]string) *CustomPriceSelector {
+	for _, s := range selectors {
+		if s.Matches(labels) {
+			return s
+		}
+	}
+	return nil
+}
+
+// CustomPriceSelectors parses the custom prices by node label selector of the given config, in the order listed,
+// which are of the form "SELECTOR:PRICES;..." where SELECTOR is "LABEL=VALUE,..." and PRICES are hourly prices
+// per CPU, per GB of RAM and optionally per GPU, e.g. "node-pool=highmem:cpu=0.025,ram=0.0052".
+func CustomPriceSelectors(c *CustomPricing) ([]*CustomPriceSelector, error) {
+	if c == nil {
+		return []*CustomPriceSelector{}, nil
+	}
+	return parseCustomPriceSelectors(c.CustomPricesByLabel)
+}
+
+func parseCustomPriceSelectors(s string) ([]*CustomPriceSelector, error) {
+	selectors := []*CustomPriceSelector{}
+	if strings.TrimSpace(s) == "" {
+		return selectors, nil
+	}
+	for _, entry := range strings.Split(s, ";") {
+		entry = strings.TrimSpace(entry)
+		kv := strings.SplitN(entry, ":", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("Invalid custom prices '%s'; expected the form LABEL=VALUE,...:cpu=PRICE,ram=PRICE", entry)
+		}
+		selector := &CustomPriceSelector{Selector: make(map[string]string)}
+		for _, pair := range strings.Split(kv[0], ",") {
+			label := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+			if len(label) != 2 || strings.TrimSpace(label[0]) == "" || strings.TrimSpace(label[1]) == "" {
+				return nil, fmt.Errorf("Invalid label selector '%s' in '%s'; expected LABEL=VALUE", pair, entry)
+			}
+			selector.Selector[strings.TrimSpace(label[0])] = strings.TrimSpace(label[1])
+		}
+		for _, pair := range strings.Split(kv[1], ",") {
+			price := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+			if len(price) != 2 || validateRate(strings.TrimSpace(price[1])) != nil {
+				return nil, fmt.Errorf("Invalid price '%s' in '%s'; expected RESOURCE=PRICE with a non-negative price", pair, entry)
+			}
+			switch strings.ToLower(strings.TrimSpace(price[0])) {
+			case "cpu":
+				selector.CPU = strings.TrimSpace(price[1])
+			case "ram":
+				selector.RAM = strings.TrimSpace(price[1])
+			case "gpu":
+				selector.GPU = strings.TrimSpace(price[1])
+			default:
+				return nil, fmt.Errorf("Invalid price '%s' in '%s'; resource must be cpu, ram or gpu", pair, entry)
+			}
+		}
+		if selector.CPU == "" || selector.RAM == "" {
+			return nil, fmt.Errorf("Invalid custom prices '%s'; prices must include cpu and ram", entry)
+		}
+		selectors = append(selectors, selector)
+	}
+	return selectors, nil
+}
@@ -9,15 +9,19 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
 )
 
 type NodePrice struct {
-	CPU string
-	RAM string
-	GPU string
+	CPU     string
+	RAM     string
+	GPU     string
+	Storage string `json:",omitempty"`
+	Rule    string `json:",omitempty"` // ID of the NodePricingRule the prices are from, if any
 }
 
 type CustomProvider struct {
@@ -25,14 +29,23 @@ type CustomProvider struct {
 	Pricing                 map[string]*NodePrice
 	SpotLabel               string
 	SpotLabelValue          string
+	SpotLabels              map[string]string
 	GPULabel                string
 	GPULabelValue           string
 	DownloadPricingDataLock sync.RWMutex
+
+	nodeRules              []*NodePricingRule
+	nodePricingFile        string
+	nodePricingFileModTime time.Time
+	nodePricingWatch       sync.Once
+	nodePrices             map[string]*pricedNode // the prices each node was last priced at by the node pricing rules
+	nodePricesLock         sync.Mutex
 }
 
 type customProviderKey struct {
 	SpotLabel      string
 	SpotLabelValue string
+	SpotLabels     map[string]string
 	GPULabel       string
 	GPULabelValue  string
 	Labels         map[string]string
@@ -108,11 +121,25 @@ func (*CustomProvider) GetDisks() ([]byte, error) {
 	return nil, nil
 }
 
+// AllNodePricing returns the custom prices, along with the prices of each node priced by the node pricing
+// rules, keyed "node,NAME", with the rule matching it, if any, and any instance type rate overrides
 func (cp *CustomProvider) AllNodePricing() (interface{}, error) {
 	cp.DownloadPricingDataLock.RLock()
 	defer cp.DownloadPricingDataLock.RUnlock()
 
-	return cp.Pricing, nil
+	if cp.nodeRules == nil {
+		return withRateOverrides(cp, cp.Pricing), nil
+	}
+	pricing := make(map[string]*NodePrice, len(cp.Pricing))
+	for k, v := range cp.Pricing {
+		pricing[k] = v
+	}
+	cp.nodePricesLock.Lock()
+	defer cp.nodePricesLock.Unlock()
+	for node, priced := range cp.nodePrices {
+		pricing["node,"+node] = priced.price
+	}
+	return withRateOverrides(cp, pricing), nil
 }
 
 func (cp *CustomProvider) NodePricing(key Key) (*Node, error) {
@@ -120,6 +147,10 @@ func (cp *CustomProvider) NodePricing(key Key) (*Node, error) {
 	defer cp.DownloadPricingDataLock.RUnlock()
 
 	k := key.Features()
+	lifecycle := LifecycleOnDemand
+	if k == "default,spot" {
+		lifecycle = LifecycleSpot
+	}
 	var gpuCount string
 	if _, ok := cp.Pricing[k]; !ok {
 		k = "default"
@@ -129,12 +160,52 @@ func (cp *CustomProvider) NodePricing(key Key) (*Node, error) {
 		gpuCount = "1" // TODO: support more than one gpu.
 	}
 
-	return &Node{
-		VCPUCost: cp.Pricing[k].CPU,
-		RAMCost:  cp.Pricing[k].RAM,
-		GPUCost:  cp.Pricing[k].GPU,
-		GPU:      gpuCount,
-	}, nil
+	node := &Node{
+		VCPUCost:  cp.Pricing[k].CPU,
+		RAMCost:   cp.Pricing[k].RAM,
+		GPUCost:   cp.Pricing[k].GPU,
+		GPU:       gpuCount,
+		Lifecycle: lifecycle,
+	}
+	if ck, ok := key.(*customProviderKey); ok {
+		node, _ = withRateOverride(cp, key, node, nil)
+		cp.applyNodePricingRule(node, ck.Labels)
+	}
+	return node, nil
+}
+
+// applyNodePricingRule prices the given node by the node pricing rule matching it, if rules are loaded, counting
+// it as unmatched, at the global custom prices, if none does
+func (cp *CustomProvider) applyNodePricingRule(node *Node, labels map[string]string) {
+	rule, loaded := cp.nodePricingRule(labels)
+	if !loaded {
+		return
+	}
+	name := labels[v1.LabelHostname]
+	if rule == nil {
+		klog.V(3).Infof("No node pricing rule matches node %s; using the global custom prices", name)
+	} else {
+		if rule.CPU != "" {
+			node.VCPUCost = rule.CPU
+		}
+		if rule.RAM != "" {
+			node.RAMCost = rule.RAM
+		}
+		if rule.GPU != "" && node.GPU != "" {
+			node.GPUCost = rule.GPU
+		}
+		if rule.Storage != "" {
+			node.StorageCost = rule.Storage
+		}
+		node.PricingRule = rule.ID()
+	}
+	cp.recordNodePrice(name, &NodePrice{
+		CPU:     node.VCPUCost,
+		RAM:     node.RAMCost,
+		GPU:     node.GPUCost,
+		Storage: node.StorageCost,
+		Rule:    node.PricingRule,
+	})
 }
 
 func (cp *CustomProvider) DownloadPricingData() error {
@@ -151,8 +222,13 @@ func (cp *CustomProvider) DownloadPricingData() error {
 	}
 	cp.SpotLabel = p.SpotLabel
 	cp.SpotLabelValue = p.SpotLabelValue
+	cp.SpotLabels = spotNodeLabels(p)
 	cp.GPULabel = p.GpuLabel
 	cp.GPULabelValue = p.GpuLabelValue
+	cp.loadNodePricingFile(p.NodePricingFile)
+	if p.NodePricingFile != "" {
+		cp.nodePricingWatch.Do(cp.watchNodePricingFile)
+	}
 	cp.Pricing["default"] = &NodePrice{
 		CPU: p.CPU,
 		RAM: p.RAM,
@@ -173,6 +249,7 @@ func (cp *CustomProvider) GetKey(labels map[string]string) Key {
 	return &customProviderKey{
 		SpotLabel:      cp.SpotLabel,
 		SpotLabelValue: cp.SpotLabelValue,
+		SpotLabels:     cp.SpotLabels,
 		GPULabel:       cp.GPULabel,
 		GPULabelValue:  cp.GPULabelValue,
 		Labels:         labels,
@@ -181,8 +258,8 @@ func (cp *CustomProvider) GetKey(labels map[string]string) Key {
 
 // ExternalAllocations represents tagged assets outside the scope of kubernetes.
 // "start" and "end" are dates of the format YYYY-MM-DD
-// "aggregator" is the tag used to determine how to allocate those assets, ie namespace, pod, etc.
-func (*CustomProvider) ExternalAllocations(start string, end string, aggregator string) ([]*OutOfClusterAllocation, error) {
+// "aggregators" are the tags used to determine how to allocate those assets, ie namespace, pod, etc.
+func (*CustomProvider) ExternalAllocations(eq *ExternalAllocationsQuery) (*ExternalAllocationsResult, error) {
 	return nil, nil // TODO: transform the QuerySQL lines into the new OutOfClusterAllocation Struct
 }
 
@@ -225,6 +302,24 @@ func (*CustomProvider) NetworkPricing() (*Network, error) {
 	}, nil
 }
 
+// LoadBalancerPricing returns the hourly cost of a load balancer, defaulting to the price of a GCP forwarding rule
+func (*CustomProvider) LoadBalancerPricing() (*LoadBalancer, error) {
+	cpricing, err := GetDefaultPricingData("default.json")
+	if err != nil {
+		return nil, err
+	}
+	return loadBalancerPricing(cpricing, 0.025)
+}
+
+// GPUPricing returns the hourly price of a GPU of each model, as configured; GPU and spotGPU price the rest
+func (*CustomProvider) GPUPricing() (*GPUPricing, error) {
+	cpricing, err := GetDefaultPricingData("default.json")
+	if err != nil {
+		return nil, err
+	}
+	return gpuPricing(cpricing, nil, nil)
+}
+
 func (*CustomProvider) GetPVKey(pv *v1.PersistentVolume, parameters map[string]string) PVKey {
 	return &awsPVKey{
 		Labels:           pv.Labels,
@@ -247,5 +342,8 @@ func (cpk *customProviderKey) Features() string {
 	if cpk.Labels[cpk.SpotLabel] != "" && cpk.Labels[cpk.SpotLabel] == cpk.SpotLabelValue {
 		return "default,spot"
 	}
+	if IsSpotNode(cpk.Labels, cpk.SpotLabels) {
+		return "default,spot"
+	}
 	return "default" // TODO: multiple custom pricing support.
 }
@@ -0,0 +1,103 @@
+package cloud
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DiscountSegment is a discount taking effect at a time, e.g. that of a new contract, until the next segment of
+// the schedule takes effect
+type DiscountSegment struct {
+	EffectiveFrom time.Time `json:"effectiveFrom"`
+	Discount      float64   `json:"discount"` // fraction by which costs are discounted
+}
+
+// DiscountSegments is a schedule of discounts, in the order they take effect
+type DiscountSegments []*DiscountSegment
+
+// At returns the discount in effect at the given time, which before the first segment takes effect is that of
+// the first segment, so that a schedule of one segment discounts all costs alike. It returns false if the
+// schedule is empty.
+func (s DiscountSegments) At(t time.Time) (float64, bool) {
+	if len(s) == 0 {
+		return 0, false
+	}
+	discount := s[0].Discount
+	for _, segment := range s {
+		if segment.EffectiveFrom.After(t) {
+			break
+		}
+		discount = segment.Discount
+	}
+	return discount, true
+}
+
+// Over returns the discount of costs incurred evenly from start until end, weighting the discount of each segment
+// by the time it is in effect over the window, so that window totals are discounted as the sum of their samples
+// is. It returns false if the schedule is empty.
+func (s DiscountSegments) Over(start, end time.Time) (float64, bool) {
+	if !end.After(start) {
+		return s.At(start)
+	}
+	if len(s) == 0 {
+		return 0, false
+	}
+	total := 0.0
+	from := start
+	for _, segment := range s {
+		if !segment.EffectiveFrom.After(from) {
+			continue
+		}
+		if !segment.EffectiveFrom.Before(end) {
+			break
+		}
+		discount, _ := s.At(from)
+		total += discount * segment.EffectiveFrom.Sub(from).Seconds()
+		from = segment.EffectiveFrom
+	}
+	discount, _ := s.At(from)
+	total += discount * end.Sub(from).Seconds()
+	return total / end.Sub(start).Seconds(), true
+}
+
+// DiscountSchedule parses the discount schedule of the given config, which is of the form
+// "EFFECTIVEFROM=DISCOUNT;..." where EFFECTIVEFROM is a date or RFC 3339 time, e.g.
+// "2019-01-01=10%;2020-07-01=15%". With a schedule, costs are discounted by the segment in effect at the time
+// they were incurred in place of the discount setting.
+func DiscountSchedule(c *CustomPricing) (DiscountSegments, error) {
+	if c == nil {
+		return DiscountSegments{}, nil
+	}
+	return parseDiscountSchedule(c.DiscountSchedule)
+}
+
+func parseDiscountSchedule(s string) (DiscountSegments, error) {
+	segments := DiscountSegments{}
+	if strings.TrimSpace(s) == "" {
+		return segments, nil
+	}
+	for _, entry := range strings.Split(s, ";") {
+		entry = strings.TrimSpace(entry)
+		kv := strings.SplitN(entry, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("Invalid discount segment '%s'; expected the form EFFECTIVEFROM=DISCOUNT", entry)
+		}
+		from := strings.TrimSpace(kv[0])
+		effectiveFrom, err := time.Parse(time.RFC3339, from)
+		if err != nil {
+			effectiveFrom, err = time.Parse("2006-01-02", from)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Invalid effective time '%s' in '%s'; must be a date or RFC 3339 time, e.g. \"2020-07-01\"", from, entry)
+		}
+		discount, err := parseMarkup(kv[1], 0)
+		if err != nil || discount > 1 || strings.TrimSpace(kv[1]) == "" {
+			return nil, fmt.Errorf("Invalid discount '%s' in '%s'; must be a percentage from 0%% to 100%%", strings.TrimSpace(kv[1]), entry)
+		}
+		segments = append(segments, &DiscountSegment{EffectiveFrom: effectiveFrom, Discount: discount})
+	}
+	sort.SliceStable(segments, func(i, j int) bool { return segments[i].EffectiveFrom.Before(segments[j].EffectiveFrom) })
+	return segments, nil
+}
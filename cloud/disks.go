@@ -0,0 +1,43 @@
+package cloud
+
+import (
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// Disk is a block storage disk of the cloud account, such as an EBS volume or a persistent disk
+type Disk struct {
+	ID         string            `json:"id"` // the volume ID on AWS, the disk name on GCP
+	Region     string            `json:"region"`
+	Zone       string            `json:"zone"`
+	Type       string            `json:"type"` // as in the "type" parameter of a storage class, e.g. "gp2" or "pd-ssd"
+	Bytes      float64           `json:"bytes"`
+	IOPS       float64           `json:"iops,omitempty"`
+	Throughput float64           `json:"throughput,omitempty"` // MiB/s
+	Created    time.Time         `json:"created"`
+	Labels     map[string]string `json:"labels,omitempty"` // tags on AWS
+}
+
+// OrphanedDiskLister is implemented by providers which can list the disks of the account which are attached to no
+// instance, such as the disks of persistent volumes deleted with a Retain reclaim policy
+type OrphanedDiskLister interface {
+	// ListOrphanedDisks lists the unattached disks, except those with an ID in backing, as returned by DiskID
+	ListOrphanedDisks(backing map[string]bool) ([]*Disk, error)
+}
+
+// DiskID returns the ID of the disk backing the given persistent volume, as in Disk, or "" if it isn't backed by a
+// disk. IDs are taken from in-tree volume sources, e.g. "aws://us-east-1a/vol-0abc", and from the handles of CSI
+// volumes, e.g. "projects/p/zones/us-central1-a/disks/pvc-123", as their last path segment.
+func DiskID(pv *v1.PersistentVolume) string {
+	id := ""
+	switch {
+	case pv.Spec.AWSElasticBlockStore != nil:
+		id = pv.Spec.AWSElasticBlockStore.VolumeID
+	case pv.Spec.GCEPersistentDisk != nil:
+		id = pv.Spec.GCEPersistentDisk.PDName
+	case pv.Spec.CSI != nil:
+		id = pv.Spec.CSI.VolumeHandle
+	}
+	return lastPathSegment(id)
+}
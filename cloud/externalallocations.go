@@ -0,0 +1,207 @@
+package cloud
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// ExternalAllocationsQuery selects the out of cluster costs returned by ExternalAllocations, and how they are
+// grouped. Filters are pushed down into the billing query, so that only matching costs are scanned and returned.
+type ExternalAllocationsQuery struct {
+	Start        string            // start of the range, e.g. "2019-04-20"
+	End          string            // end of the range, e.g. "2019-04-27"
+	Aggregators  []string          // Kubernetes tags by which costs are grouped, e.g. "namespace", in order
+	Verbatim     bool              // aggregators are tags as named in the billing data, e.g. "team", rather than Kubernetes tags
+	TagFilters   map[string]string // tags costs must carry, and their values, e.g. "team": "payments"
+	Services     []string          // services or products costs must be of, e.g. "AmazonRDS"; any if empty
+	ForceRefresh bool              // re-run the query, rather than returning cached results, where they're cached
+}
+
+// ExternalAllocationsResult is the out of cluster costs matching a query, and the bytes the query scanned,
+// by which the billing backend charges for it, when it reports them
+type ExternalAllocationsResult struct {
+	Allocations  []*OutOfClusterAllocation
+	BytesScanned int64
+	Cached       bool // whether the result was cached, rather than queried, in which case no bytes were scanned
+}
+
+// sortedTagFilters returns the keys of the tag filters of the query in order, so that queries are stable
+func (q *ExternalAllocationsQuery) sortedTagFilters() []string {
+	keys := make([]string, 0, len(q.TagFilters))
+	for k := range q.TagFilters {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// aggregatorTag returns the tag of the billing data by which the query groups costs by the given aggregator
+func (q *ExternalAllocationsQuery) aggregatorTag(aggregator string) string {
+	if q.Verbatim {
+		return aggregator
+	}
+	return "kubernetes_" + aggregator
+}
+
+// newOutOfClusterAllocation returns the allocation of the given cost to the given values of the aggregators
+// of a query, which are joined by commas when costs are grouped by more than one
+func newOutOfClusterAllocation(aggregators []string, values []string, service string, cost float64) *OutOfClusterAllocation {
+	return &OutOfClusterAllocation{
+		Aggregator:  strings.Join(aggregators, ","),
+		Environment: strings.Join(values, ","),
+		Service:     service,
+		Cost:        cost,
+	}
+}
+
+// athenaString quotes the given value as a SQL string literal
+func athenaString(s string) string {
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
+
+// AthenaExternalAllocationsSQL returns the Athena query of the costs of the given Cost and Usage Report table
+// selected by the given query. Kubernetes tags are those of the form "kubernetes_TAG", as in
+// "resource_tags_user_kubernetes_namespace", unless the query's aggregators are verbatim, and services are
+// product codes, e.g. "AmazonRDS".
+func AthenaExternalAllocationsSQL(table string, q *ExternalAllocationsQuery) (string, error) {
+	if len(q.Aggregators) == 0 {
+		return "", fmt.Errorf("At least one aggregator is required")
+	}
+	columns := make([]string, 0, len(q.Aggregators))
+	for _, aggregator := range q.Aggregators {
+		columns = append(columns, ConvertToGlueColumnFormat("resource_tags_user_"+q.aggregatorTag(aggregator)))
+	}
+
+	conditions := []string{fmt.Sprintf("line_item_usage_start_date BETWEEN date %s AND date %s", athenaString(q.Start), athenaString(q.End))}
+	for _, key := range q.sortedTagFilters() {
+		column := ConvertToGlueColumnFormat("resource_tags_user_" + key)
+		conditions = append(conditions, fmt.Sprintf("%s = %s", column, athenaString(q.TagFilters[key])))
+	}
+	if len(q.Services) > 0 {
+		services := make([]string, 0, len(q.Services))
+		for _, service := range q.Services {
+			services = append(services, athenaString(service))
+		}
+		conditions = append(conditions, fmt.Sprintf("line_item_product_code IN (%s)", strings.Join(services, ", ")))
+	}
+
+	groups := make([]string, 0, len(columns)+2)
+	for i := 1; i <= len(columns)+2; i++ {
+		groups = append(groups, fmt.Sprintf("%d", i))
+	}
+
+	return fmt.Sprintf(`SELECT
+		CAST(line_item_usage_start_date AS DATE) as start_date,
+		%s,
+		line_item_product_code,
+		SUM(line_item_blended_cost) as blended_cost
+	FROM %s as cost_data
+	WHERE %s
+	GROUP BY %s`, strings.Join(columns, ",\n\t\t"), table, strings.Join(conditions, "\n\t\tAND "), strings.Join(groups, ",")), nil
+}
+
+// BigQueryExternalAllocationsSQL returns the BigQuery query, and its parameters, of the costs of the given
+// billing export table selected by the given query. Kubernetes tags are the labels of the form
+// "kubernetes_TAG", unless the query's aggregators are verbatim, and services are service descriptions, e.g. "Cloud SQL". Without aggregators, costs are
+// grouped by each of the Kubernetes labels they carry in turn.
+func BigQueryExternalAllocationsSQL(table string, q *ExternalAllocationsQuery) (string, []bigquery.QueryParameter) {
+	params := []bigquery.QueryParameter{
+		{Name: "start", Value: q.Start},
+		{Name: "end", Value: q.End},
+	}
+	conditions := []string{"usage_start_time >= TIMESTAMP(@start) AND usage_start_time < TIMESTAMP(@end)"}
+	for i, key := range q.sortedTagFilters() {
+		conditions = append(conditions, fmt.Sprintf("EXISTS(SELECT 1 FROM UNNEST(labels) AS l WHERE l.key = @tagKey%d AND l.value = @tagValue%d)", i, i))
+		params = append(params,
+			bigquery.QueryParameter{Name: fmt.Sprintf("tagKey%d", i), Value: key},
+			bigquery.QueryParameter{Name: fmt.Sprintf("tagValue%d", i), Value: q.TagFilters[key]},
+		)
+	}
+	if len(q.Services) > 0 {
+		conditions = append(conditions, "service.description IN UNNEST(@services)")
+		params = append(params, bigquery.QueryParameter{Name: "services", Value: q.Services})
+	}
+	where := strings.Join(conditions, "\n\t\t\t\t\t\tAND ")
+
+	if len(q.Aggregators) == 0 {
+		return fmt.Sprintf(`SELECT
+					service,
+					labels.key as aggregator,
+					labels.value as environment,
+					SUM(cost) as cost
+					FROM  (SELECT
+							service.description as service,
+							labels,
+							cost
+						FROM %s
+						WHERE %s)
+						LEFT JOIN UNNEST(labels) as labels
+						ON labels.key = "kubernetes_namespace" OR labels.key = "kubernetes_container" OR labels.key = "kubernetes_deployment" OR labels.key = "kubernetes_pod" OR labels.key = "kubernetes_daemonset"
+				GROUP BY aggregator, environment, service;`, table, where), params
+	}
+
+	columns := make([]string, 0, len(q.Aggregators))
+	selects := make([]string, 0, len(q.Aggregators))
+	for i, aggregator := range q.Aggregators {
+		column := fmt.Sprintf("aggregator%d", i)
+		columns = append(columns, column)
+		selects = append(selects, fmt.Sprintf("(SELECT l.value FROM UNNEST(labels) AS l WHERE l.key = @%s LIMIT 1) as %s", column, column))
+		params = append(params, bigquery.QueryParameter{Name: column, Value: q.aggregatorTag(aggregator)})
+	}
+	return fmt.Sprintf(`SELECT
+					service,
+					%s,
+					SUM(cost) as cost
+					FROM  (SELECT
+							service.description as service,
+							%s,
+							cost
+						FROM %s
+						WHERE %s)
+				GROUP BY service, %s;`, strings.Join(columns, ",\n\t\t\t\t\t"), strings.Join(selects, ",\n\t\t\t\t\t\t\t"), table, where, strings.Join(columns, ", ")), params
+}
+
+// ExternalTag returns the tag by which out of cluster costs are matched to aggregations by the given field and
+// subfield, as configured by the externalTagMappings of the given config, which are of the form "FIELD=TAG;..."
+// where FIELD is an aggregation field, or "label.NAME" for labels, e.g. "label.team=team;namespace=ns". Mapped
+// tags are named as in the billing data, while fields without a mapping are matched by the Kubernetes tag of
+// the same name as the field, or as the label, e.g. "kubernetes_namespace".
+func ExternalTag(c *CustomPricing, field string, subfield string) (string, error) {
+	mappings := map[string]string{}
+	if c != nil {
+		var err error
+		if mappings, err = parseExternalTagMappings(c.ExternalTagMappings); err != nil {
+			return "", err
+		}
+	}
+	name := field
+	if field == "label" {
+		name = "label." + subfield
+	}
+	if tag, ok := mappings[name]; ok {
+		return tag, nil
+	}
+	if field == "label" {
+		return "kubernetes_" + subfield, nil
+	}
+	return "kubernetes_" + field, nil
+}
+
+func parseExternalTagMappings(s string) (map[string]string, error) {
+	mappings := make(map[string]string)
+	if strings.TrimSpace(s) == "" {
+		return mappings, nil
+	}
+	for _, entry := range strings.Split(s, ";") {
+		entry = strings.TrimSpace(entry)
+		kv := strings.SplitN(entry, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" || strings.TrimSpace(kv[1]) == "" {
+			return nil, fmt.Errorf("Invalid external tag mapping '%s'; expected the form FIELD=TAG", entry)
+		}
+		mappings[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	return mappings, nil
+}
@@ -14,6 +14,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"k8s.io/klog"
 
@@ -49,6 +50,7 @@ type GCP struct {
 	BaseCPUPrice            string
 	ProjectID               string
 	BillingDataDataset      string
+	SpotLabels              map[string]string
 	DownloadPricingDataLock sync.RWMutex
 	*CustomProvider
 }
@@ -183,33 +185,21 @@ func (gcp *GCP) UpdateConfig(r io.Reader, updateType string) (*CustomPricing, er
 
 // ExternalAllocations represents tagged assets outside the scope of kubernetes.
 // "start" and "end" are dates of the format YYYY-MM-DD
-// "aggregator" is the tag used to determine how to allocate those assets, ie namespace, pod, etc.
-func (gcp *GCP) ExternalAllocations(start string, end string, aggregator string) ([]*OutOfClusterAllocation, error) {
+// "aggregators" are the tags used to determine how to allocate those assets, ie namespace, pod, etc.
+func (gcp *GCP) ExternalAllocations(eq *ExternalAllocationsQuery) (*ExternalAllocationsResult, error) {
 	c, err := GetDefaultPricingData("gcp.json")
 	if err != nil {
 		return nil, err
 	}
 	// start, end formatted like: "2019-04-20 00:00:00"
-	queryString := fmt.Sprintf(`SELECT
-					service,
-					labels.key as aggregator,
-					labels.value as environment,
-					SUM(cost) as cost
-					FROM  (SELECT 
-							service.description as service,
-							labels,
-							cost 
-						FROM %s
-						WHERE usage_start_time >= "%s" AND usage_start_time < "%s")
-						LEFT JOIN UNNEST(labels) as labels
-						ON labels.key = "kubernetes_namespace" OR labels.key = "kubernetes_container" OR labels.key = "kubernetes_deployment" OR labels.key = "kubernetes_pod" OR labels.key = "kubernetes_daemonset"
-				GROUP BY aggregator, environment, service;`, c.BillingDataDataset, start, end) // For example, "billing_data.gcp_billing_export_v1_01AC9F_74CF1D_5565A2"
+	queryString, params := BigQueryExternalAllocationsSQL(c.BillingDataDataset, eq) // For example, "billing_data.gcp_billing_export_v1_01AC9F_74CF1D_5565A2"
 	klog.V(4).Infof("Querying \"%s\" with : %s", c.ProjectID, queryString)
-	return gcp.QuerySQL(queryString)
+	return gcp.QuerySQL(queryString, params, eq.Aggregators)
 }
 
-// QuerySQL should query BigQuery for billing data for out of cluster costs.
-func (gcp *GCP) QuerySQL(query string) ([]*OutOfClusterAllocation, error) {
+// QuerySQL should query BigQuery for billing data for out of cluster costs, grouped by the given aggregators as
+// queried by BigQueryExternalAllocationsSQL.
+func (gcp *GCP) QuerySQL(query string, params []bigquery.QueryParameter, aggregators []string) (*ExternalAllocationsResult, error) {
 	c, err := GetDefaultPricingData("gcp.json")
 	if err != nil {
 		return nil, err
@@ -221,23 +211,69 @@ func (gcp *GCP) QuerySQL(query string) ([]*OutOfClusterAllocation, error) {
 	}
 
 	q := client.Query(query)
-	it, err := q.Read(ctx)
+	q.Parameters = params
+	job, err := q.Run(ctx)
 	if err != nil {
 		return nil, err
 	}
-	var allocations []*OutOfClusterAllocation
+	status, err := job.Wait(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := status.Err(); err != nil {
+		return nil, err
+	}
+	result := &ExternalAllocationsResult{}
+	if stats := status.Statistics; stats != nil {
+		result.BytesScanned = stats.TotalBytesProcessed
+		if qs, ok := stats.Details.(*bigquery.QueryStatistics); ok && qs.TotalBytesBilled > 0 {
+			result.BytesScanned = qs.TotalBytesBilled
+		}
+	}
+	it, err := job.Read(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(aggregators) == 0 {
+		for {
+			var a gcpAllocation
+			err := it.Next(&a)
+			if err == iterator.Done {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			result.Allocations = append(result.Allocations, gcpAllocationToOutOfClusterAllocation(a))
+		}
+		return result, nil
+	}
+
+	// Columns are the service, a column per aggregator and the cost
+	n := len(aggregators)
 	for {
-		var a gcpAllocation
-		err := it.Next(&a)
+		var row []bigquery.Value
+		err := it.Next(&row)
 		if err == iterator.Done {
 			break
 		}
 		if err != nil {
 			return nil, err
 		}
-		allocations = append(allocations, gcpAllocationToOutOfClusterAllocation(a))
+		if len(row) != n+2 {
+			return nil, fmt.Errorf("Unexpected number of columns %d in out of cluster costs; expected %d", len(row), n+2)
+		}
+		values := make([]string, 0, n)
+		for _, v := range row[1 : n+1] {
+			value, _ := v.(string)
+			values = append(values, value)
+		}
+		service, _ := row[0].(string)
+		cost, _ := row[n+1].(float64)
+		result.Allocations = append(result.Allocations, newOutOfClusterAllocation(aggregators, values, service, cost))
 	}
-	return allocations, nil
+	return result, nil
 }
 
 // ClusterName returns the name of a GKE cluster, as provided by metadata.
@@ -282,6 +318,61 @@ func (*GCP) AddServiceKey(formValues url.Values) error {
 
 // GetDisks returns the GCP disks backing PVs. Useful because sometimes k8s will not clean up PVs correctly. Requires a json config in /var/configs with key region.
 func (*GCP) GetDisks() ([]byte, error) {
+	svc, projID, err := gcpComputeService()
+	if err != nil {
+		return nil, err
+	}
+	res, err := svc.Disks.AggregatedList(projID).Do()
+
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(res)
+
+}
+
+// ListOrphanedDisks lists the persistent disks of the project which are attached to no instance, except those in
+// backing
+func (*GCP) ListOrphanedDisks(backing map[string]bool) ([]*Disk, error) {
+	svc, projID, err := gcpComputeService()
+	if err != nil {
+		return nil, err
+	}
+	disks := []*Disk{}
+	err = svc.Disks.AggregatedList(projID).Pages(context.Background(), func(page *compute.DiskAggregatedList) error {
+		for _, scoped := range page.Items {
+			for _, d := range scoped.Disks {
+				if len(d.Users) > 0 || backing[d.Name] {
+					continue
+				}
+				disk := &Disk{
+					ID:     d.Name,
+					Zone:   lastPathSegment(d.Zone),
+					Region: lastPathSegment(d.Region),
+					Type:   lastPathSegment(d.Type),
+					Bytes:  float64(d.SizeGb) * 1024 * 1024 * 1024,
+					Labels: d.Labels,
+				}
+				if i := strings.LastIndex(disk.Zone, "-"); disk.Region == "" && i >= 0 {
+					// zonal disks are in the region of their zone, e.g. us-central1 of us-central1-a
+					disk.Region = disk.Zone[:i]
+				}
+				if created, err := time.Parse(time.RFC3339, d.CreationTimestamp); err == nil {
+					disk.Created = created
+				}
+				disks = append(disks, disk)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return disks, nil
+}
+
+// gcpComputeService returns a client of the compute API, and the project of the cluster as given by the metadata API
+func gcpComputeService() (*compute.Service, string, error) {
 	// metadata API setup
 	metadataClient := metadata.NewClient(&http.Client{Transport: userAgentTransport{
 		userAgent: "kubecost",
@@ -289,25 +380,24 @@ func (*GCP) GetDisks() ([]byte, error) {
 	}})
 	projID, err := metadataClient.ProjectID()
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
 	client, err := google.DefaultClient(oauth2.NoContext,
 		"https://www.googleapis.com/auth/compute.readonly")
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 	svc, err := compute.New(client)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
-	res, err := svc.Disks.AggregatedList(projID).Do()
-
-	if err != nil {
-		return nil, err
-	}
-	return json.Marshal(res)
+	return svc, projID, nil
+}
 
+// lastPathSegment returns the last segment of the given path or URL, e.g. "pd-ssd" of ".../diskTypes/pd-ssd"
+func lastPathSegment(path string) string {
+	return path[strings.LastIndex(path, "/")+1:]
 }
 
 // GCPPricing represents GCP pricing data for a SKU
@@ -520,6 +610,7 @@ func (gcp *GCP) parsePage(r io.Reader, inputKeys map[string]Key, pvKeys map[stri
 										}
 									*/
 									product.Node.UsageType = usageType
+									product.Node.Lifecycle = LifecycleForUsageType(usageType)
 									gcpPricingList[candidateKey] = product
 								}
 								if _, ok := gcpPricingList[candidateKeyGPU]; ok {
@@ -537,6 +628,7 @@ func (gcp *GCP) parsePage(r io.Reader, inputKeys map[string]Key, pvKeys map[stri
 										}
 									*/
 									product.Node.UsageType = usageType
+									product.Node.Lifecycle = LifecycleForUsageType(usageType)
 									gcpPricingList[candidateKeyGPU] = product
 								}
 								break
@@ -554,6 +646,7 @@ func (gcp *GCP) parsePage(r io.Reader, inputKeys map[string]Key, pvKeys map[stri
 										}
 									*/
 									product.Node.UsageType = usageType
+									product.Node.Lifecycle = LifecycleForUsageType(usageType)
 									gcpPricingList[candidateKey] = product
 								}
 								if _, ok := gcpPricingList[candidateKeyGPU]; ok {
@@ -569,6 +662,7 @@ func (gcp *GCP) parsePage(r io.Reader, inputKeys map[string]Key, pvKeys map[stri
 										}
 									*/
 									product.Node.UsageType = usageType
+									product.Node.Lifecycle = LifecycleForUsageType(usageType)
 									gcpPricingList[candidateKeyGPU] = product
 								}
 								break
@@ -664,6 +758,7 @@ func (gcp *GCP) DownloadPricingData() error {
 	gcp.BaseCPUPrice = c.CPU
 	gcp.ProjectID = c.ProjectID
 	gcp.BillingDataDataset = c.BillingDataDataset
+	gcp.SpotLabels = spotNodeLabels(c)
 
 	nodeList, err := gcp.Clientset.CoreV1().Nodes().List(metav1.ListOptions{})
 	if err != nil {
@@ -713,15 +808,48 @@ func (gcp *GCP) DownloadPricingData() error {
 	return nil
 }
 
+// SavePricingData writes the pricing data last downloaded from the GCP billing API
+func (gcp *GCP) SavePricingData(w io.Writer) error {
+	gcp.DownloadPricingDataLock.RLock()
+	defer gcp.DownloadPricingDataLock.RUnlock()
+	return json.NewEncoder(w).Encode(gcp.Pricing)
+}
+
+// LoadPricingData replaces the pricing data with that written by SavePricingData
+func (gcp *GCP) LoadPricingData(r io.Reader) error {
+	var pricing map[string]*GCPPricing
+	if err := json.NewDecoder(r).Decode(&pricing); err != nil {
+		return err
+	}
+	gcp.DownloadPricingDataLock.Lock()
+	defer gcp.DownloadPricingDataLock.Unlock()
+	gcp.Pricing = pricing
+	return nil
+}
+
+// gcpStorageTiers are the us-central1 prices of provisioned IOPS and throughput, by persistent disk type
+var gcpStorageTiers = map[string]*StorageTier{
+	"pd-extreme":           &StorageTier{IOPSCost: 0.065 / 730},
+	"hyperdisk-extreme":    &StorageTier{IOPSCost: 0.032 / 730},
+	"hyperdisk-balanced":   &StorageTier{IOPSCost: 0.005 / 730, IncludedIOPS: 3000, ThroughputCost: 0.04 / 730, IncludedThroughput: 140},
+	"hyperdisk-throughput": &StorageTier{ThroughputCost: 0.05 / 730},
+}
+
 func (gcp *GCP) PVPricing(pvk PVKey) (*PV, error) {
 	gcp.DownloadPricingDataLock.RLock()
 	defer gcp.DownloadPricingDataLock.RUnlock()
+	var tier *StorageTier
+	if key, ok := pvk.(*pvKey); ok {
+		tier = gcpStorageTiers[key.StorageClassParameters["type"]]
+	}
 	pricing, ok := gcp.Pricing[pvk.Features()]
-	if !ok {
+	if !ok || pricing.PV == nil {
 		klog.V(4).Infof("Persistent Volume pricing not found for %s: %s", pvk.GetStorageClass(), pvk.Features())
-		return &PV{}, nil
+		return &PV{Tier: tier}, nil
 	}
-	return pricing.PV, nil
+	pv := *pricing.PV
+	pv.Tier = tier
+	return &pv, nil
 }
 
 // Stubbed NetworkPricing for GCP. Pull directly from gcp.json for now
@@ -750,6 +878,24 @@ func (c *GCP) NetworkPricing() (*Network, error) {
 	}, nil
 }
 
+// LoadBalancerPricing returns the hourly cost of a load balancer, defaulting to the price of a forwarding rule
+func (*GCP) LoadBalancerPricing() (*LoadBalancer, error) {
+	cpricing, err := GetDefaultPricingData("gcp.json")
+	if err != nil {
+		return nil, err
+	}
+	return loadBalancerPricing(cpricing, 0.025)
+}
+
+// GPUPricing returns the hourly price of a GPU of each model, defaulting to the list price of each attached GPU
+func (*GCP) GPUPricing() (*GPUPricing, error) {
+	cpricing, err := GetDefaultPricingData("gcp.json")
+	if err != nil {
+		return nil, err
+	}
+	return gpuPricing(cpricing, gcpGPUPrices, gcpSpotGPUPrices)
+}
+
 type pvKey struct {
 	Labels                 map[string]string
 	StorageClass           string
@@ -780,12 +926,14 @@ func (key *pvKey) Features() string {
 }
 
 type gcpKey struct {
-	Labels map[string]string
+	Labels     map[string]string
+	SpotLabels map[string]string
 }
 
 func (gcp *GCP) GetKey(labels map[string]string) Key {
 	return &gcpKey{
-		Labels: labels,
+		Labels:     labels,
+		SpotLabels: gcp.SpotLabels,
 	}
 }
 
@@ -796,7 +944,7 @@ func (gcp *gcpKey) ID() string {
 func (gcp *gcpKey) GPUType() string {
 	if t, ok := gcp.Labels[GKE_GPU_TAG]; ok {
 		var usageType string
-		if t, ok := gcp.Labels["cloud.google.com/gke-preemptible"]; ok && t == "true" {
+		if IsSpotNode(gcp.Labels, gcp.SpotLabels) {
 			usageType = "preemptible"
 		} else {
 			usageType = "ondemand"
@@ -818,7 +966,7 @@ func (gcp *gcpKey) Features() string {
 	region := strings.ToLower(gcp.Labels[v1.LabelZoneRegion])
 	var usageType string
 
-	if t, ok := gcp.Labels["cloud.google.com/gke-preemptible"]; ok && t == "true" {
+	if IsSpotNode(gcp.Labels, gcp.SpotLabels) {
 		usageType = "preemptible"
 	} else {
 		usageType = "ondemand"
@@ -831,15 +979,21 @@ func (gcp *gcpKey) Features() string {
 	return region + "," + instanceType + "," + usageType
 }
 
-// AllNodePricing returns the GCP pricing objects stored
+// AllNodePricing returns the GCP pricing objects stored, along with any instance type rate overrides
 func (gcp *GCP) AllNodePricing() (interface{}, error) {
 	gcp.DownloadPricingDataLock.RLock()
 	defer gcp.DownloadPricingDataLock.RUnlock()
-	return gcp.Pricing, nil
+	return withRateOverrides(gcp, gcp.Pricing), nil
 }
 
-// NodePricing returns GCP pricing data for a single node
+// NodePricing returns GCP pricing data for a single node, priced by the rate override of its instance type,
+// if any, or else by its list price
 func (gcp *GCP) NodePricing(key Key) (*Node, error) {
+	node, err := gcp.listNodePricing(key)
+	return withRateOverride(gcp, key, node, err)
+}
+
+func (gcp *GCP) listNodePricing(key Key) (*Node, error) {
 	gcp.DownloadPricingDataLock.RLock()
 	defer gcp.DownloadPricingDataLock.RUnlock()
 	if n, ok := gcp.Pricing[key.Features()]; ok {
@@ -0,0 +1,146 @@
+package cloud
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// GPUModelLabels are the node labels naming the model of the GPUs attached to a node, in order of precedence
+var GPUModelLabels = []string{
+	"nvidia.com/gpu.product",
+	"cloud.google.com/gke-accelerator",
+	"k8s.amazonaws.com/accelerator",
+	"accelerator",
+}
+
+// gcpGPUPrices and gcpSpotGPUPrices are the list hourly prices of a single GPU of each model, on
+// demand and preemptible respectively, as attached to a GCP instance
+var gcpGPUPrices = map[string]float64{
+	"a100": 2.934,
+	"v100": 2.48,
+	"p100": 1.46,
+	"p4":   0.60,
+	"t4":   0.35,
+	"k80":  0.45,
+}
+
+var gcpSpotGPUPrices = map[string]float64{
+	"a100": 0.88,
+	"v100": 0.74,
+	"p100": 0.43,
+	"p4":   0.216,
+	"t4":   0.11,
+	"k80":  0.135,
+}
+
+// GPUPricing is the interface by which the provider and cost model communicate the hourly price of a
+// single GPU of each model, keyed by model, e.g. "t4" or "nvidia-tesla-t4"
+type GPUPricing struct {
+	OnDemand map[string]float64
+	Spot     map[string]float64
+}
+
+// Cost returns the hourly price of a single GPU of the given model, on spot or on demand, and whether the
+// model is priced at all. A model is priced by its own key, or else by the most specific key naming one or
+// more of its dash separated components, so that "t4" prices "nvidia-tesla-t4" and "Tesla-T4".
+func (g *GPUPricing) Cost(model string, spot bool) (float64, bool) {
+	if g == nil || model == "" {
+		return 0, false
+	}
+	prices := g.OnDemand
+	if spot {
+		prices = g.Spot
+	}
+	model = normalizeGPUModel(model)
+	if price, ok := prices[model]; ok {
+		return price, true
+	}
+	price, found, longest := 0.0, false, 0
+	for key, p := range prices {
+		if strings.Contains("-"+model+"-", "-"+key+"-") && len(key) > longest {
+			price, found, longest = p, true, len(key)
+		}
+	}
+	return price, found
+}
+
+// GPUModel returns the normalized model of the GPUs attached to a node with the given labels, or "" if
+// the node names none
+func GPUModel(labels map[string]string) string {
+	for _, label := range GPUModelLabels {
+		if model, ok := labels[label]; ok && model != "" {
+			return normalizeGPUModel(model)
+		}
+	}
+	return ""
+}
+
+// CustomGPUPricing parses the per model GPU prices of the given config, which are of the form
+// "MODEL:COST,..." e.g. "a100:2.93,t4:0.35", on demand by gpuPricing and on spot by spotGPUPricing
+func CustomGPUPricing(c *CustomPricing) (*GPUPricing, error) {
+	onDemand, err := parseGPUPrices(c.GpuPricing)
+	if err != nil {
+		return nil, err
+	}
+	spot, err := parseGPUPrices(c.SpotGPUPricing)
+	if err != nil {
+		return nil, err
+	}
+	return &GPUPricing{
+		OnDemand: onDemand,
+		Spot:     spot,
+	}, nil
+}
+
+// gpuPricing returns the per model GPU prices of the given config, falling back to the given defaults for
+// the models it does not price
+func gpuPricing(c *CustomPricing, defaultOnDemand, defaultSpot map[string]float64) (*GPUPricing, error) {
+	custom, err := CustomGPUPricing(c)
+	if err != nil {
+		return nil, err
+	}
+	g := &GPUPricing{
+		OnDemand: make(map[string]float64),
+		Spot:     make(map[string]float64),
+	}
+	for model, price := range defaultOnDemand {
+		g.OnDemand[model] = price
+	}
+	for model, price := range defaultSpot {
+		g.Spot[model] = price
+	}
+	for model, price := range custom.OnDemand {
+		g.OnDemand[model] = price
+	}
+	for model, price := range custom.Spot {
+		g.Spot[model] = price
+	}
+	return g, nil
+}
+
+// parseGPUPrices parses prices of the form "MODEL:COST,..."
+func parseGPUPrices(s string) (map[string]float64, error) {
+	prices := make(map[string]float64)
+	if s == "" {
+		return prices, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		kv := strings.SplitN(strings.TrimSpace(pair), ":", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return nil, fmt.Errorf("Invalid GPU price '%s'; expected the form MODEL:COST", pair)
+		}
+		price, err := strconv.ParseFloat(strings.TrimSpace(kv[1]), 64)
+		if err != nil || price < 0 {
+			return nil, fmt.Errorf("Invalid GPU price '%s'; expected the form MODEL:COST", pair)
+		}
+		prices[normalizeGPUModel(kv[0])] = price
+	}
+	return prices, nil
+}
+
+// normalizeGPUModel lower cases the given model, separating its components by dashes
+func normalizeGPUModel(model string) string {
+	model = strings.ToLower(strings.TrimSpace(model))
+	return strings.NewReplacer(" ", "-", "_", "-").Replace(model)
+}
@@ -0,0 +1,60 @@
+package cloud
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Markup is the fraction by which the discounted cost of each category is marked up, e.g. to recover overhead
+// when charging back, where 0.1 is a 10% markup
+type Markup struct {
+	CPU     float64
+	RAM     float64
+	GPU     float64
+	Storage float64
+}
+
+// CustomMarkup parses the markups of the given config, which are percentages e.g. "10%". The markup of a
+// category is its cpuMarkup, ramMarkup, gpuMarkup or storageMarkup if set, or else the overallMarkup, which
+// defaults to none.
+func CustomMarkup(c *CustomPricing) (*Markup, error) {
+	if c == nil {
+		return &Markup{}, nil
+	}
+	overall, err := parseMarkup(c.OverallMarkup, 0)
+	if err != nil {
+		return nil, err
+	}
+	m := &Markup{}
+	if m.CPU, err = parseMarkup(c.CpuMarkup, overall); err != nil {
+		return nil, err
+	}
+	if m.RAM, err = parseMarkup(c.RamMarkup, overall); err != nil {
+		return nil, err
+	}
+	if m.GPU, err = parseMarkup(c.GpuMarkup, overall); err != nil {
+		return nil, err
+	}
+	if m.Storage, err = parseMarkup(c.StorageMarkup, overall); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// parseMarkup parses a non-negative percentage of the form "N%" as a fraction, returning the given default if
+// it is empty
+func parseMarkup(s string, defaultMarkup float64) (float64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return defaultMarkup, nil
+	}
+	if !strings.HasSuffix(s, "%") {
+		return 0, fmt.Errorf("Invalid markup '%s'; must be a non-negative percentage, e.g. \"10%%\"", s)
+	}
+	markup, err := strconv.ParseFloat(strings.TrimSpace(s[:len(s)-1]), 64)
+	if err != nil || markup < 0 {
+		return 0, fmt.Errorf("Invalid markup '%s'; must be a non-negative percentage, e.g. \"10%%\"", s)
+	}
+	return markup / 100, nil
+}
@@ -0,0 +1,57 @@
+package cloud
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// EgressSplit is the fraction of the egress of pods estimated to stay within their zone, to cross zones within
+// their region, to cross regions and to reach the internet, used to price egress which isn't measured by
+// destination
+type EgressSplit struct {
+	IntraZone   float64
+	CrossZone   float64
+	CrossRegion float64
+	Internet    float64
+}
+
+// CustomEgressSplit parses the networkEgressSplit of the given config, the percentages of egress within a zone,
+// across zones, across regions and to the internet, e.g. "70%,20%,5%,5%", which must add up to 100%. It returns
+// nil if the split isn't set, in which case egress isn't estimated.
+func CustomEgressSplit(c *CustomPricing) (*EgressSplit, error) {
+	if c == nil || strings.TrimSpace(c.NetworkEgressSplit) == "" {
+		return nil, nil
+	}
+	return parseEgressSplit(c.NetworkEgressSplit)
+}
+
+func parseEgressSplit(s string) (*EgressSplit, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return nil, fmt.Errorf("Invalid egress split '%s'; expected the percentages of egress within a zone, across zones, across regions and to the internet, e.g. \"70%%,20%%,5%%,5%%\"", s)
+	}
+	fractions := make([]float64, 0, len(parts))
+	total := 0.0
+	for _, part := range parts {
+		part = strings.TrimSpace(part)
+		if !strings.HasSuffix(part, "%") {
+			return nil, fmt.Errorf("Invalid egress split percentage '%s'; must be a percentage from 0%% to 100%%, e.g. \"20%%\"", part)
+		}
+		percentage, err := strconv.ParseFloat(strings.TrimSpace(part[:len(part)-1]), 64)
+		if err != nil || percentage < 0 || percentage > 100 {
+			return nil, fmt.Errorf("Invalid egress split percentage '%s'; must be a percentage from 0%% to 100%%, e.g. \"20%%\"", part)
+		}
+		fractions = append(fractions, percentage/100)
+		total += percentage
+	}
+	if total < 99.99 || total > 100.01 {
+		return nil, fmt.Errorf("Invalid egress split '%s'; percentages must add up to 100%%", s)
+	}
+	return &EgressSplit{
+		IntraZone:   fractions[0],
+		CrossZone:   fractions[1],
+		CrossRegion: fractions[2],
+		Internet:    fractions[3],
+	}, nil
+}
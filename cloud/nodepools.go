@@ -0,0 +1,23 @@
+package cloud
+
+// UnknownNodePool is the node pool of nodes without any of NodePoolLabels
+const UnknownNodePool = "__unknown__"
+
+// NodePoolLabels are the node labels naming the pool, or group, a node was provisioned by, set by the managed
+// node pools and autoscalers of each provider, in order of precedence
+var NodePoolLabels = []string{
+	"cloud.google.com/gke-nodepool",
+	"eks.amazonaws.com/nodegroup",
+	"karpenter.sh/provisioner-name",
+}
+
+// NodePool returns the pool of a node with the given labels, by the first of NodePoolLabels it carries, or
+// UnknownNodePool if it carries none
+func NodePool(labels map[string]string) string {
+	for _, label := range NodePoolLabels {
+		if pool, ok := labels[label]; ok && pool != "" {
+			return pool
+		}
+	}
+	return UnknownNodePool
+}
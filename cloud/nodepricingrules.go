@@ -0,0 +1,249 @@
+package cloud
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog"
+)
+
+const (
+	// nodePricingFileInterval is how often the node pricing file is checked for changes
+	nodePricingFileInterval = time.Minute
+	// nodePricesRetention is how long the prices of a node are reported by AllNodePricing after it was last
+	// priced, so that those of nodes since removed are dropped
+	nodePricesRetention = time.Hour
+)
+
+// UnmatchedNodePricingCounter counts the nodes priced at the global custom prices because no rule of the node
+// pricing file matched them, once each time a node becomes unmatched rather than each time it is priced
+var UnmatchedNodePricingCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "kubecost_custom_pricing_unmatched_nodes_total",
+	Help: "kubecost_custom_pricing_unmatched_nodes_total Nodes priced at the global custom prices because no node pricing rule matched them",
+}, []string{"node"})
+
+// NodePricingRule prices the nodes it matches: the node of the given name, or else those carrying every label
+// of its selector. Prices are hourly, per CPU, per GB of RAM, per GPU and per GB of storage, which prices the
+// volumes claimed by the pods of the node; those left unset fall back to the global custom prices.
+type NodePricingRule struct {
+	Name     string            `json:"name,omitempty"`
+	Node     string            `json:"node,omitempty"`
+	Selector map[string]string `json:"selector,omitempty"`
+	CPU      string            `json:"cpu,omitempty"`
+	RAM      string            `json:"ram,omitempty"`
+	GPU      string            `json:"gpu,omitempty"`
+	Storage  string            `json:"storage,omitempty"`
+}
+
+// Matches reports whether the rule prices the node of the given name and labels
+func (r *NodePricingRule) Matches(node string, labels map[string]string) bool {
+	if r.Node != "" {
+		return r.Node == node
+	}
+	for k, v := range r.Selector {
+		if labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// ID names the rule, by its name or else by the node or selector it matches
+func (r *NodePricingRule) ID() string {
+	if r.Name != "" {
+		return r.Name
+	}
+	if r.Node != "" {
+		return "node=" + r.Node
+	}
+	pairs := make([]string, 0, len(r.Selector))
+	for k, v := range r.Selector {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// MatchNodePricingRule returns the rule pricing the node of the given name and labels: the first naming the node,
+// or else the first whose selector it matches, or nil if none do
+func MatchNodePricingRule(rules []*NodePricingRule, node string, labels map[string]string) *NodePricingRule {
+	for _, r := range rules {
+		if r.Node != "" && r.Matches(node, labels) {
+			return r
+		}
+	}
+	for _, r := range rules {
+		if r.Node == "" && r.Matches(node, labels) {
+			return r
+		}
+	}
+	return nil
+}
+
+// LoadNodePricingRules reads the node pricing rules of the given file: a JSON list of rules if it is named
+// "*.json", or else a CSV with the header "name,node,selector,cpu,ram,gpu,storage", in any order and with
+// any columns omitted, where selectors are of the form "LABEL=VALUE,..."
+func LoadNodePricingRules(path string) ([]*NodePricingRule, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var rules []*NodePricingRule
+	if strings.HasSuffix(strings.ToLower(path), ".json") {
+		err = json.NewDecoder(f).Decode(&rules)
+	} else {
+		rules, err = parseNodePricingCSV(f)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Invalid node pricing file %s: %s", path, err.Error())
+	}
+	for i, r := range rules {
+		if r.Node == "" && len(r.Selector) == 0 {
+			return nil, fmt.Errorf("Invalid node pricing file %s: rule %d matches neither a node nor a selector", path, i+1)
+		}
+	}
+	return rules, nil
+}
+
+func parseNodePricingCSV(r io.Reader) ([]*NodePricingRule, error) {
+	records, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return []*NodePricingRule{}, nil
+	}
+	columns := make(map[string]int)
+	for i, name := range records[0] {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	column := func(record []string, name string) string {
+		if i, ok := columns[name]; ok && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+
+	rules := make([]*NodePricingRule, 0, len(records)-1)
+	for _, record := range records[1:] {
+		rule := &NodePricingRule{
+			Name:    column(record, "name"),
+			Node:    column(record, "node"),
+			CPU:     column(record, "cpu"),
+			RAM:     column(record, "ram"),
+			GPU:     column(record, "gpu"),
+			Storage: column(record, "storage"),
+		}
+		if selector := column(record, "selector"); selector != "" {
+			rule.Selector = make(map[string]string)
+			for _, pair := range strings.Split(selector, ",") {
+				kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+				if len(kv) != 2 || kv[0] == "" {
+					return nil, fmt.Errorf("invalid selector '%s'; expected the form LABEL=VALUE,...", selector)
+				}
+				rule.Selector[kv[0]] = kv[1]
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// loadNodePricingFile reloads the rules of the node pricing file when it has changed since last loaded,
+// keeping the rules last loaded if it can't be read
+func (cp *CustomProvider) loadNodePricingFile(path string) {
+	if path == "" {
+		cp.nodeRules = nil
+		cp.nodePricingFile = ""
+		return
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		klog.V(1).Infof("Unable to read node pricing file: %s", err.Error())
+		return
+	}
+	if path == cp.nodePricingFile && info.ModTime().Equal(cp.nodePricingFileModTime) {
+		return
+	}
+	rules, err := LoadNodePricingRules(path)
+	if err != nil {
+		klog.V(1).Infof("Keeping the last node pricing rules loaded: %s", err.Error())
+		return
+	}
+	cp.nodeRules = rules
+	cp.nodePricingFile = path
+	cp.nodePricingFileModTime = info.ModTime()
+	klog.V(2).Infof("Loaded %d node pricing rules from %s", len(rules), path)
+}
+
+// watchNodePricingFile reloads the node pricing file whenever it changes, such as when the ConfigMap it is
+// mounted from is updated
+func (cp *CustomProvider) watchNodePricingFile() {
+	go func() {
+		for {
+			time.Sleep(nodePricingFileInterval)
+			c, err := cp.GetConfig()
+			if err != nil {
+				klog.V(1).Infof("Unable to reload node pricing file: %s", err.Error())
+				continue
+			}
+			cp.DownloadPricingDataLock.Lock()
+			cp.loadNodePricingFile(c.NodePricingFile)
+			cp.DownloadPricingDataLock.Unlock()
+			cp.pruneNodePrices(time.Now().Add(-nodePricesRetention))
+		}
+	}()
+}
+
+// nodePricingRule returns the rule of the node pricing file pricing the node with the given labels, named by
+// its hostname label, and whether rules were loaded at all
+func (cp *CustomProvider) nodePricingRule(labels map[string]string) (*NodePricingRule, bool) {
+	if cp.nodeRules == nil {
+		return nil, false
+	}
+	return MatchNodePricingRule(cp.nodeRules, labels[v1.LabelHostname], labels), true
+}
+
+// pricedNode is the price a node was last priced at by the node pricing rules, and when
+type pricedNode struct {
+	price    *NodePrice
+	pricedAt time.Time
+}
+
+// recordNodePrice records the price the node of the given name was priced at, counting it as unmatched if no
+// rule priced it and one did, or none was recorded, before
+func (cp *CustomProvider) recordNodePrice(name string, price *NodePrice) {
+	cp.nodePricesLock.Lock()
+	defer cp.nodePricesLock.Unlock()
+	if cp.nodePrices == nil {
+		cp.nodePrices = make(map[string]*pricedNode)
+	}
+	if previous, ok := cp.nodePrices[name]; price.Rule == "" && (!ok || previous.price.Rule != "") {
+		UnmatchedNodePricingCounter.WithLabelValues(name).Inc()
+	}
+	cp.nodePrices[name] = &pricedNode{
+		price:    price,
+		pricedAt: time.Now(),
+	}
+}
+
+// pruneNodePrices drops the prices of the nodes not priced since the given time
+func (cp *CustomProvider) pruneNodePrices(since time.Time) {
+	cp.nodePricesLock.Lock()
+	defer cp.nodePricesLock.Unlock()
+	for name, priced := range cp.nodePrices {
+		if priced.pricedAt.Before(since) {
+			delete(cp.nodePrices, name)
+		}
+	}
+}
@@ -0,0 +1,12 @@
+package cloud
+
+import "io"
+
+// PricingCacher is implemented by providers whose downloaded pricing data can be saved to a local cache, to be
+// restored when the pricing API can't be reached, such as at startup
+type PricingCacher interface {
+	// SavePricingData writes the pricing data last downloaded
+	SavePricingData(w io.Writer) error
+	// LoadPricingData replaces the pricing data with that written by SavePricingData
+	LoadPricingData(r io.Reader) error
+}
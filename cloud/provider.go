@@ -10,6 +10,7 @@ import (
 	"net/url"
 	"os"
 	"reflect"
+	"strconv"
 	"strings"
 
 	"k8s.io/klog"
@@ -37,27 +38,36 @@ var createTableStatements = []string{
 // Node is the interface by which the provider and cost model communicate Node prices.
 // The provider will best-effort try to fill out this struct.
 type Node struct {
-	Cost             string `json:"hourlyCost"`
-	VCPU             string `json:"CPU"`
-	VCPUCost         string `json:"CPUHourlyCost"`
-	RAM              string `json:"RAM"`
-	RAMBytes         string `json:"RAMBytes"`
-	RAMCost          string `json:"RAMGBHourlyCost"`
-	Storage          string `json:"storage"`
-	StorageCost      string `json:"storageHourlyCost"`
-	UsesBaseCPUPrice bool   `json:"usesDefaultPrice"`
-	BaseCPUPrice     string `json:"baseCPUPrice"` // Used to compute an implicit RAM GB/Hr price when RAM pricing is not provided.
-	BaseRAMPrice     string `json:"baseRAMPrice"` // Used to compute an implicit RAM GB/Hr price when RAM pricing is not provided.
-	BaseGPUPrice     string `json:"baseGPUPrice"`
-	UsageType        string `json:"usageType"`
-	GPU              string `json:"gpu"` // GPU represents the number of GPU on the instance
-	GPUName          string `json:"gpuName"`
-	GPUCost          string `json:"gpuCost"`
+	Cost             string            `json:"hourlyCost"`
+	VCPU             string            `json:"CPU"`
+	VCPUCost         string            `json:"CPUHourlyCost"`
+	RAM              string            `json:"RAM"`
+	RAMBytes         string            `json:"RAMBytes"`
+	RAMCost          string            `json:"RAMGBHourlyCost"`
+	Storage          string            `json:"storage"`
+	StorageCost      string            `json:"storageHourlyCost"`
+	UsesBaseCPUPrice bool              `json:"usesDefaultPrice"`
+	BaseCPUPrice     string            `json:"baseCPUPrice"` // Used to compute an implicit RAM GB/Hr price when RAM pricing is not provided.
+	BaseRAMPrice     string            `json:"baseRAMPrice"` // Used to compute an implicit RAM GB/Hr price when RAM pricing is not provided.
+	BaseGPUPrice     string            `json:"baseGPUPrice"`
+	UsageType        string            `json:"usageType"`
+	GPU              string            `json:"gpu"` // GPU represents the number of GPU on the instance
+	GPUName          string            `json:"gpuName"`
+	GPUCost          string            `json:"gpuCost"`
+	Lifecycle        string            `json:"lifecycle,omitempty"`        // LifecycleSpot or LifecycleOnDemand, when resolved
+	PricingRate      string            `json:"pricingRate,omitempty"`      // The PricingRate applied to the node, when resolved
+	ReservedCoverage string            `json:"reservedCoverage,omitempty"` // Fraction of the node covered by a reservation
+	PricingRule      string            `json:"pricingRule,omitempty"`      // ID of the NodePricingRule the node is priced by, if any
+	RateOverride     string            `json:"rateOverride,omitempty"`     // Instance type of the InstanceTypeRate the node is priced by, if any
+	Labels           map[string]string `json:"labels,omitempty"`           // Labels of the node naming its pool or selected by custom prices
 }
 
-// IsSpot determines whether or not a Node uses spot by usage type
+// IsSpot determines whether or not a Node uses spot by its resolved lifecycle, or else by usage type
 func (n *Node) IsSpot() bool {
-	return strings.Contains(n.UsageType, "spot") || strings.Contains(n.UsageType, "emptible")
+	if n.Lifecycle != "" {
+		return n.Lifecycle == LifecycleSpot
+	}
+	return LifecycleForUsageType(n.UsageType) == LifecycleSpot
 }
 
 // Network is the interface by which the provider and cost model communicate network egress prices.
@@ -68,6 +78,12 @@ type Network struct {
 	InternetNetworkEgressCost float64
 }
 
+// LoadBalancer is the interface by which the provider and cost model communicate the prices of the
+// cloud load balancers provisioned for LoadBalancer services.
+type LoadBalancer struct {
+	HourlyCost float64
+}
+
 // PV is the interface by which the provider and cost model communicate PV prices.
 // The provider will best-effort try to fill out this struct.
 type PV struct {
@@ -77,6 +93,14 @@ type PV struct {
 	Size       string            `json:"size"`
 	Region     string            `json:"region"`
 	Parameters map[string]string `json:"parameters"`
+	Tier       *StorageTier      `json:"-"`
+
+	// Cost is broken down into the hourly cost per GB of capacity and the hourly cost of the
+	// provisioned IOPS and throughput of the whole volume, when the latter is priced
+	StorageCost     string `json:"storageCost,omitempty"`
+	PerformanceCost string `json:"performanceCost,omitempty"`
+	IOPS            string `json:"iops,omitempty"`
+	Throughput      string `json:"throughput,omitempty"`
 }
 
 // Key represents a way for nodes to match between the k8s API and a pricing API
@@ -106,15 +130,19 @@ type CustomPricing struct {
 	CPU                   string `json:"CPU"`
 	SpotCPU               string `json:"spotCPU"`
 	RAM                   string `json:"RAM"`
+	RamUnit               string `json:"ramUnit,omitempty"` // RAMUnitBinary (default) or RAMUnitDecimal, the GB by which RAM is priced
 	SpotRAM               string `json:"spotRAM"`
 	GPU                   string `json:"GPU"`
 	SpotGPU               string `json:"spotGPU"`
+	GpuPricing            string `json:"gpuPricing,omitempty"`     // Hourly prices of a GPU of each model, e.g. "a100:2.93,t4:0.35"; GPU prices those not listed
+	SpotGPUPricing        string `json:"spotGPUPricing,omitempty"` // Hourly spot prices of a GPU of each model; SpotGPU prices those not listed
 	Storage               string `json:"storage"`
 	ZoneNetworkEgress     string `json:"zoneNetworkEgress"`
 	RegionNetworkEgress   string `json:"regionNetworkEgress"`
 	InternetNetworkEgress string `json:"internetNetworkEgress"`
 	SpotLabel             string `json:"spotLabel,omitempty"`
 	SpotLabelValue        string `json:"spotLabelValue,omitempty"`
+	SpotNodeLabels        string `json:"spotNodeLabels,omitempty"` // Node labels identifying spot nodes, e.g. "karpenter.sh/capacity-type=spot"; defaults to DefaultSpotLabels
 	GpuLabel              string `json:"gpuLabel,omitempty"`
 	GpuLabelValue         string `json:"gpuLabelValue,omitempty"`
 	ServiceKeyName        string `json:"awsServiceKeyName,omitempty"`
@@ -122,21 +150,42 @@ type CustomPricing struct {
 	SpotDataRegion        string `json:"awsSpotDataRegion,omitempty"`
 	SpotDataBucket        string `json:"awsSpotDataBucket,omitempty"`
 	SpotDataPrefix        string `json:"awsSpotDataPrefix,omitempty"`
+	SpotDataStaleness     string `json:"awsSpotDataStaleness,omitempty"` // Age beyond which spot data feed prices fall back to estimates, e.g. "3h"
 	ProjectID             string `json:"projectID,omitempty"`
 	AthenaBucketName      string `json:"athenaBucketName"`
 	AthenaRegion          string `json:"athenaRegion"`
 	AthenaDatabase        string `json:"athenaDatabase"`
 	AthenaTable           string `json:"athenaTable"`
+	AthenaCacheTTL        string `json:"athenaCacheTTL,omitempty"`     // Duration for which Athena query results are cached, e.g. "6h"
+	AthenaQueryTimeout    string `json:"athenaQueryTimeout,omitempty"` // Duration after which queued or running Athena queries are stopped, e.g. "5m"
 	BillingDataDataset    string `json:"billingDataDataset,omitempty"`
 	CustomPricesEnabled   string `json:"customPricesEnabled"`
+	CustomPricesByLabel   string `json:"customPricesByLabel,omitempty"` // Custom prices of the nodes matching label selectors, the first matching applying, e.g. "node-pool=highmem:cpu=0.025,ram=0.0052"
 	AzureSubscriptionID   string `json:"azureSubscriptionID"`
 	AzureClientID         string `json:"azureClientID"`
 	AzureClientSecret     string `json:"azureClientSecret"`
 	AzureTenantID         string `json:"azureTenantID"`
 	AzureBillingRegion    string `json:"azureBillingRegion"`
 	CurrencyCode          string `json:"currencyCode"`
+	CurrencyRates         string `json:"currencyRates,omitempty"` // Comma separated units of each currency per USD, e.g. "EUR:0.91,GBP:0.79"
 	Discount              string `json:"discount"`
+	DiscountSchedule      string `json:"discountSchedule,omitempty"` // Discounts effective from each date, in place of discount, e.g. "2019-01-01=10%;2020-07-01=15%"
 	ClusterName           string `json:"clusterName"`
+	ClusterManagementFee  string `json:"clusterManagementFee,omitempty"` // Hourly fee charged per cluster by the provider, e.g. "0.10"
+	LoadBalancerCost      string `json:"loadBalancerCost,omitempty"`     // Hourly cost of each load balancer
+	StorageClassPricing   string `json:"storageClassPricing,omitempty"`  // Hourly prices overriding those of each storage class, e.g. "fast:0.0002,0.00009,0.00005"
+	ReservedInstances     string `json:"reservedInstances,omitempty"`    // Reserved instance and savings plan coverage, e.g. "m5,us-east-1,60%,62%;c5.xlarge,*,10,0.107"
+	NodePricingFile       string `json:"nodePricingFile,omitempty"`      // Path to a CSV or JSON file of NodePricingRules, e.g. mounted from a ConfigMap
+	CpuMarkup             string `json:"cpuMarkup,omitempty"`            // Percentage by which discounted CPU costs are marked up, e.g. "10%"
+	RamMarkup             string `json:"ramMarkup,omitempty"`            // Percentage by which discounted RAM costs are marked up
+	GpuMarkup             string `json:"gpuMarkup,omitempty"`            // Percentage by which discounted GPU costs are marked up
+	StorageMarkup         string `json:"storageMarkup,omitempty"`        // Percentage by which discounted storage costs are marked up
+	OverallMarkup         string `json:"overallMarkup,omitempty"`        // Markup of the categories without their own markup
+	CostRules             string `json:"costRules,omitempty"`            // Discounts and markups overriding the defaults by namespace or label, e.g. "namespace=tenant-a-*,,15%"
+	InstanceTypeRates     string `json:"instanceTypeRates,omitempty"`    // Negotiated rates overriding list prices by instance type, e.g. "m5.2xlarge:0.32"
+	ExternalTagMappings   string `json:"externalTagMappings,omitempty"`  // Tags matching out of cluster costs to aggregation fields, e.g. "label.team=team"
+	NetworkEgressSplit    string `json:"networkEgressSplit,omitempty"`   // Percentages of unmeasured pod egress within a zone, across zones, across regions and to the internet, e.g. "70%,20%,5%,5%"
+	Budgets               string `json:"budgets,omitempty"`              // JSON array of the Budgets alerted by the budget evaluator, edited through the /budgets endpoints
 }
 
 // Provider represents a k8s provider.
@@ -147,6 +196,8 @@ type Provider interface {
 	NodePricing(Key) (*Node, error)
 	PVPricing(PVKey) (*PV, error)
 	NetworkPricing() (*Network, error)
+	LoadBalancerPricing() (*LoadBalancer, error)
+	GPUPricing() (*GPUPricing, error)
 	AllNodePricing() (interface{}, error)
 	DownloadPricingData() error
 	GetKey(map[string]string) Key
@@ -155,7 +206,7 @@ type Provider interface {
 	GetConfig() (*CustomPricing, error)
 	GetManagementPlatform() (string, error)
 	GetLocalStorageQuery() (string, error)
-	ExternalAllocations(string, string, string) ([]*OutOfClusterAllocation, error)
+	ExternalAllocations(*ExternalAllocationsQuery) (*ExternalAllocationsResult, error)
 }
 
 // ClusterName returns the name defined in cluster info, defaulting to the
@@ -174,6 +225,21 @@ func ClusterName(p Provider) string {
 	return name
 }
 
+// RAM units by which RAM prices are quoted per GB: binary GB (GiB) of 1024³ bytes, or decimal GB of 10⁹ bytes
+const (
+	RAMUnitBinary  = "binary"
+	RAMUnitDecimal = "decimal"
+)
+
+// RAMBytesPerGB returns the number of bytes in a GB of RAM as priced under the given config, which is 10⁹ when
+// its ramUnit is RAMUnitDecimal, and 1024³ otherwise
+func RAMBytesPerGB(c *CustomPricing) float64 {
+	if c != nil && strings.ToLower(c.RamUnit) == RAMUnitDecimal {
+		return 1e9
+	}
+	return 1024 * 1024 * 1024
+}
+
 // CustomPricesEnabled returns the boolean equivalent of the cloup provider's custom prices flag,
 // indicating whether or not the cluster is using custom pricing.
 func CustomPricesEnabled(p Provider) bool {
@@ -238,6 +304,37 @@ func GetDefaultPricingData(fname string) (*CustomPricing, error) {
 	}
 }
 
+// loadBalancerPricing returns the load balancer price set in the given pricing config, falling back to
+// the given default price if it is not set
+func loadBalancerPricing(c *CustomPricing, defaultHourlyCost float64) (*LoadBalancer, error) {
+	lb := &LoadBalancer{
+		HourlyCost: defaultHourlyCost,
+	}
+	if c.LoadBalancerCost != "" {
+		hourly, err := strconv.ParseFloat(c.LoadBalancerCost, 64)
+		if err != nil {
+			return nil, err
+		}
+		lb.HourlyCost = hourly
+	}
+	return lb, nil
+}
+
+// ValidateCustomPricingField returns an error if SetCustomPricingField could not set the named field
+func ValidateCustomPricingField(name string) error {
+	field, ok := reflect.TypeOf(CustomPricing{}).FieldByName(name)
+	if !ok {
+		return fmt.Errorf("No such field: %s in obj", name)
+	}
+	if field.PkgPath != "" {
+		return fmt.Errorf("Cannot set %s field value", name)
+	}
+	if field.Type.Kind() != reflect.String {
+		return fmt.Errorf("Provided value type didn't match custom pricing field type")
+	}
+	return nil
+}
+
 func SetCustomPricingField(obj *CustomPricing, name string, value string) error {
 	structValue := reflect.ValueOf(obj).Elem()
 	structFieldValue := structValue.FieldByName(name)
@@ -0,0 +1,207 @@
+package cloud
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog"
+)
+
+// rateOverridePrefix prefixes the keys of the rate overrides listed by AllNodePricing
+const rateOverridePrefix = "override,"
+
+// InstanceTypeRate is a negotiated hourly rate for on-demand nodes of an instance type, overriding its list
+// price: either a whole-node rate, or CPU, RAM and optionally GPU rates. Rates are as those of a Node.
+type InstanceTypeRate struct {
+	InstanceType string `json:"instanceType"`
+	Node         string `json:"hourlyCost,omitempty"`
+	CPU          string `json:"CPUHourlyCost,omitempty"`
+	RAM          string `json:"RAMGBHourlyCost,omitempty"`
+	GPU          string `json:"gpuCost,omitempty"`
+}
+
+// apply prices the given node at the rate, leaving a whole-node rate to be split across its resources as
+// list prices are
+func (r *InstanceTypeRate) apply(n *Node) {
+	if r.Node != "" {
+		n.Cost = r.Node
+		n.VCPUCost = ""
+		n.RAMCost = ""
+		n.GPUCost = ""
+	} else {
+		n.Cost = ""
+		n.VCPUCost = r.CPU
+		n.RAMCost = r.RAM
+		n.GPUCost = r.GPU
+	}
+	n.UsesBaseCPUPrice = false
+	n.RateOverride = r.InstanceType
+}
+
+// instanceTypeRatesCache holds the rate overrides last parsed, so that they're only parsed again once the
+// config changes rather than each time a node is priced
+var instanceTypeRatesCache struct {
+	sync.Mutex
+	parsed bool
+	config string
+	rates  map[string]*InstanceTypeRate
+	err    error
+}
+
+// InstanceTypeRates parses the rate overrides of the given config, keyed by lower case instance type, which are
+// of the form "TYPE:RATE;..." where RATE is a whole-node hourly rate, e.g. "m5.2xlarge:0.32", or hourly rates
+// per CPU, per GB of RAM and per GPU, e.g. "n2-standard-8:cpu=0.025,ram=0.0033". The rates returned are shared,
+// so mustn't be modified.
+func InstanceTypeRates(c *CustomPricing) (map[string]*InstanceTypeRate, error) {
+	if c == nil {
+		return map[string]*InstanceTypeRate{}, nil
+	}
+	instanceTypeRatesCache.Lock()
+	defer instanceTypeRatesCache.Unlock()
+	if !instanceTypeRatesCache.parsed || instanceTypeRatesCache.config != c.InstanceTypeRates {
+		instanceTypeRatesCache.rates, instanceTypeRatesCache.err = parseInstanceTypeRates(c.InstanceTypeRates)
+		instanceTypeRatesCache.config = c.InstanceTypeRates
+		instanceTypeRatesCache.parsed = true
+	}
+	return instanceTypeRatesCache.rates, instanceTypeRatesCache.err
+}
+
+func parseInstanceTypeRates(s string) (map[string]*InstanceTypeRate, error) {
+	rates := make(map[string]*InstanceTypeRate)
+	if strings.TrimSpace(s) == "" {
+		return rates, nil
+	}
+	for _, entry := range strings.Split(s, ";") {
+		entry = strings.TrimSpace(entry)
+		kv := strings.SplitN(entry, ":", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return nil, fmt.Errorf("Invalid instance type rate '%s'; expected the form TYPE:RATE", entry)
+		}
+		r := &InstanceTypeRate{InstanceType: strings.TrimSpace(kv[0])}
+		value := strings.TrimSpace(kv[1])
+		if !strings.Contains(value, "=") {
+			if err := validateRate(value); err != nil {
+				return nil, fmt.Errorf("Invalid rate '%s' in '%s'; must be a non-negative number", value, entry)
+			}
+			r.Node = value
+		} else {
+			for _, pair := range strings.Split(value, ",") {
+				rate := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+				if len(rate) != 2 || validateRate(strings.TrimSpace(rate[1])) != nil {
+					return nil, fmt.Errorf("Invalid rate '%s' in '%s'; expected RESOURCE=RATE with a non-negative rate", pair, entry)
+				}
+				switch strings.ToLower(strings.TrimSpace(rate[0])) {
+				case "cpu":
+					r.CPU = strings.TrimSpace(rate[1])
+				case "ram":
+					r.RAM = strings.TrimSpace(rate[1])
+				case "gpu":
+					r.GPU = strings.TrimSpace(rate[1])
+				default:
+					return nil, fmt.Errorf("Invalid rate '%s' in '%s'; resource must be cpu, ram or gpu", pair, entry)
+				}
+			}
+			if r.CPU == "" || r.RAM == "" {
+				return nil, fmt.Errorf("Invalid instance type rate '%s'; rates per resource must include cpu and ram", entry)
+			}
+		}
+		rates[strings.ToLower(r.InstanceType)] = r
+	}
+	return rates, nil
+}
+
+func validateRate(s string) error {
+	rate, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return err
+	}
+	if rate < 0 {
+		return fmt.Errorf("must not be negative")
+	}
+	return nil
+}
+
+// withRateOverride returns the node of the given key priced by the rate override of its instance type, if it
+// is on demand and has one, in place of the given list pricing and error. It applies to the list pricing, before
+// the node pricing rules of the custom provider and the reservations covering the node, which compose with it:
+// a rule overrides only the prices it sets, and a reservation blends the overridden rate with its own.
+func withRateOverride(p Provider, k Key, node *Node, err error) (*Node, error) {
+	labels := keyLabels(k)
+	if labels == nil || isPreemptibleKey(k) {
+		return node, err
+	}
+	c, cerr := p.GetConfig()
+	if cerr != nil {
+		return node, err
+	}
+	rates, rerr := InstanceTypeRates(c)
+	if rerr != nil {
+		klog.V(1).Infof("Ignoring instance type rates: %s", rerr.Error())
+		return node, err
+	}
+	rate, ok := rates[strings.ToLower(labels[v1.LabelInstanceType])]
+	if !ok {
+		return node, err
+	}
+
+	// list pricing may be shared, so is copied rather than modified
+	overridden := &Node{}
+	if node != nil && err == nil {
+		*overridden = *node
+	}
+	rate.apply(overridden)
+	return overridden, nil
+}
+
+// withRateOverrides returns the given pricing data, a map keyed by string, along with the configured rate
+// overrides keyed "override,TYPE", so that it's apparent which instance types aren't priced by it
+func withRateOverrides(p Provider, pricing interface{}) interface{} {
+	c, err := p.GetConfig()
+	if err != nil {
+		return pricing
+	}
+	rates, err := InstanceTypeRates(c)
+	if err != nil || len(rates) == 0 {
+		return pricing
+	}
+	all := make(map[string]interface{})
+	v := reflect.ValueOf(pricing)
+	if v.Kind() == reflect.Map {
+		for _, key := range v.MapKeys() {
+			all[key.String()] = v.MapIndex(key).Interface()
+		}
+	}
+	for _, rate := range rates {
+		all[rateOverridePrefix+rate.InstanceType] = rate
+	}
+	return all
+}
+
+// keyLabels returns the labels of the node of the given key, or nil if they're unknown
+func keyLabels(k Key) map[string]string {
+	switch key := k.(type) {
+	case *awsKey:
+		return key.Labels
+	case *gcpKey:
+		return key.Labels
+	case *azureKey:
+		return key.Labels
+	case *customProviderKey:
+		return key.Labels
+	}
+	return nil
+}
+
+// isPreemptibleKey reports whether the given key is of a spot or preemptible node, as priced by its features
+func isPreemptibleKey(k Key) bool {
+	for _, feature := range strings.Split(k.Features(), ",") {
+		if feature == "preemptible" || feature == "spot" {
+			return true
+		}
+	}
+	return false
+}
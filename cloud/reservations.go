@@ -0,0 +1,117 @@
+package cloud
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Pricing rates a node is resolved to, exposed on Node
+const (
+	PricingRateOnDemand = "ondemand"
+	PricingRateSpot     = "spot"
+	PricingRateReserved = "reserved" // fully covered by a reservation
+	PricingRateBlended  = "blended"  // partially covered by a reservation
+)
+
+// Reservation is a commitment, such as reserved instances or a savings plan, covering some of the nodes of
+// an instance type or family in a region at an effective rate. Exactly one of Count and Coverage, and one
+// of HourlyRate and OnDemandFraction, is set.
+type Reservation struct {
+	InstanceType     string  // instance type, e.g. "m5.xlarge", or family, e.g. "m5"
+	Region           string  // region, or "*" for any
+	Count            int     // number of nodes covered
+	Coverage         float64 // fraction of nodes covered
+	HourlyRate       float64 // effective hourly rate of a covered node
+	OnDemandFraction float64 // effective rate of a covered node as a fraction of its on-demand rate
+}
+
+// Matches reports whether the reservation applies to nodes of the given instance type and region
+func (r *Reservation) Matches(instanceType, region string) bool {
+	if r.Region != "*" && !strings.EqualFold(r.Region, region) {
+		return false
+	}
+	return instanceType == r.InstanceType ||
+		strings.HasPrefix(instanceType, r.InstanceType+".") ||
+		strings.HasPrefix(instanceType, r.InstanceType+"-")
+}
+
+// ReservedRate returns the effective hourly rate of a covered node with the given on-demand rate
+func (r *Reservation) ReservedRate(onDemandRate float64) float64 {
+	if r.OnDemandFraction > 0 {
+		return onDemandRate * r.OnDemandFraction
+	}
+	return r.HourlyRate
+}
+
+// Reservations parses the reservations of the given config, which are of the form
+// "TYPE,REGION,COVERAGE,RATE;..." where COVERAGE is a number of nodes, e.g. "10", or a percentage of
+// the matching nodes, e.g. "60%", and RATE is an hourly rate, e.g. "0.12", or a percentage of the
+// on-demand rate, e.g. "62%".
+func Reservations(c *CustomPricing) ([]*Reservation, error) {
+	reservations := []*Reservation{}
+	if c.ReservedInstances == "" {
+		return reservations, nil
+	}
+	for _, entry := range strings.Split(c.ReservedInstances, ";") {
+		components := strings.Split(strings.TrimSpace(entry), ",")
+		if len(components) != 4 {
+			return nil, fmt.Errorf("Invalid reservation '%s'; expected the form TYPE,REGION,COVERAGE,RATE", entry)
+		}
+		for i := range components {
+			components[i] = strings.TrimSpace(components[i])
+		}
+		if components[0] == "" || components[1] == "" {
+			return nil, fmt.Errorf("Invalid reservation '%s'; instance type and region are required", entry)
+		}
+		r := &Reservation{
+			InstanceType: components[0],
+			Region:       components[1],
+		}
+
+		coverage, isPercent, err := parseReservationValue(components[2])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid reservation coverage '%s' in '%s'", components[2], entry)
+		}
+		if isPercent {
+			if coverage > 1 {
+				return nil, fmt.Errorf("Invalid reservation coverage '%s' in '%s'; must not exceed 100%%", components[2], entry)
+			}
+			r.Coverage = coverage
+		} else {
+			if coverage != float64(int(coverage)) {
+				return nil, fmt.Errorf("Invalid reservation coverage '%s' in '%s'; must be a whole number of nodes", components[2], entry)
+			}
+			r.Count = int(coverage)
+		}
+
+		rate, isPercent, err := parseReservationValue(components[3])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid reservation rate '%s' in '%s'", components[3], entry)
+		}
+		if isPercent {
+			r.OnDemandFraction = rate
+		} else {
+			r.HourlyRate = rate
+		}
+
+		reservations = append(reservations, r)
+	}
+	return reservations, nil
+}
+
+// parseReservationValue parses a non-negative number, or a percentage thereof as a fraction
+func parseReservationValue(s string) (float64, bool, error) {
+	isPercent := strings.HasSuffix(s, "%")
+	v, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+	if err != nil {
+		return 0, false, err
+	}
+	if v < 0 {
+		return 0, false, fmt.Errorf("must not be negative")
+	}
+	if isPercent {
+		v = v / 100
+	}
+	return v, isPercent, nil
+}
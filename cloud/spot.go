@@ -0,0 +1,82 @@
+package cloud
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/klog"
+)
+
+// Lifecycles a node is resolved to, exposed on Node
+const (
+	LifecycleSpot     = "spot"
+	LifecycleOnDemand = "ondemand"
+)
+
+// DefaultSpotLabels are the node labels, and the values thereof, set on spot and preemptible nodes by
+// the managed node pools and autoscalers of each provider. Values are compared case-insensitively.
+var DefaultSpotLabels = map[string]string{
+	"cloud.google.com/gke-preemptible":      "true",
+	"cloud.google.com/gke-spot":             "true",
+	"karpenter.sh/capacity-type":            "spot",
+	"eks.amazonaws.com/capacityType":        "spot",
+	"kubernetes.azure.com/scalesetpriority": "spot",
+	"lifecycle":                             "EC2Spot",
+}
+
+// SpotNodeLabels returns the node labels identifying spot nodes under the given config: those of the
+// spotNodeLabels setting, of the form "LABEL=VALUE,...", or DefaultSpotLabels when unset, along with the
+// spotLabel and spotLabelValue settings when set.
+func SpotNodeLabels(c *CustomPricing) (map[string]string, error) {
+	labels := make(map[string]string)
+	if c.SpotNodeLabels == "" {
+		for k, v := range DefaultSpotLabels {
+			labels[k] = v
+		}
+	} else {
+		for _, pair := range strings.Split(c.SpotNodeLabels, ",") {
+			kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+			if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+				return nil, fmt.Errorf("Invalid spot node label '%s'; expected the form LABEL=VALUE", pair)
+			}
+			labels[kv[0]] = kv[1]
+		}
+	}
+	if c.SpotLabel != "" && c.SpotLabelValue != "" {
+		labels[c.SpotLabel] = c.SpotLabelValue
+	}
+	return labels, nil
+}
+
+// IsSpotNode determines whether a node with the given labels is a spot node, i.e. carries any of the
+// given spot labels with its value. DefaultSpotLabels are used when spotLabels is nil.
+func IsSpotNode(labels map[string]string, spotLabels map[string]string) bool {
+	if spotLabels == nil {
+		spotLabels = DefaultSpotLabels
+	}
+	for label, value := range spotLabels {
+		if v, ok := labels[label]; ok && strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// LifecycleForUsageType resolves the lifecycle of a node priced by the given usage type
+func LifecycleForUsageType(usageType string) string {
+	if strings.Contains(usageType, "spot") || strings.Contains(usageType, "emptible") {
+		return LifecycleSpot
+	}
+	return LifecycleOnDemand
+}
+
+// spotNodeLabels resolves the spot labels of the given config, falling back to the defaults when they
+// cannot be parsed
+func spotNodeLabels(c *CustomPricing) map[string]string {
+	labels, err := SpotNodeLabels(c)
+	if err != nil {
+		klog.V(1).Infof("Using default spot node labels: %s", err.Error())
+		return DefaultSpotLabels
+	}
+	return labels
+}
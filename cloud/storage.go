@@ -0,0 +1,115 @@
+package cloud
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// StorageTier is the price of the performance a persistent volume is provisioned with, on top of the price
+// of its capacity. Volumes come with IncludedIOPS and IncludedThroughput at no extra cost.
+type StorageTier struct {
+	IOPSCost           float64 // hourly, per provisioned IOPS
+	ThroughputCost     float64 // hourly, per provisioned MiB/s
+	IncludedIOPS       float64
+	IncludedThroughput float64
+}
+
+// HourlyCost returns the hourly cost of provisioning a volume of this tier with the given IOPS and throughput
+func (t *StorageTier) HourlyCost(iops, throughput float64) float64 {
+	cost := 0.0
+	if iops > t.IncludedIOPS {
+		cost += (iops - t.IncludedIOPS) * t.IOPSCost
+	}
+	if throughput > t.IncludedThroughput {
+		cost += (throughput - t.IncludedThroughput) * t.ThroughputCost
+	}
+	return cost
+}
+
+// StorageClassPrice is a custom price for the volumes of a storage class, overriding the provider's pricing
+type StorageClassPrice struct {
+	StorageCost float64 // hourly, per GB
+	Tier        *StorageTier
+}
+
+// iopsParameters and throughputParameters are the lower-cased storage class parameters and CSI volume
+// attributes by which each provider's provisioner sets the performance of a volume
+var (
+	iopsParameters       = []string{"iops", "provisioned-iops-on-create", "diskiopsreadwrite"}
+	iopsPerGBParameters  = []string{"iopspergb"}
+	throughputParameters = []string{"throughput", "provisioned-throughput-on-create", "diskmbpsreadwrite"}
+)
+
+// ProvisionedPerformance returns the IOPS and throughput, in MiB/s, the given volume was provisioned with, read
+// from the parameters of its storage class and, where set, the attributes of its CSI volume source.
+func ProvisionedPerformance(pv *v1.PersistentVolume, parameters map[string]string) (float64, float64) {
+	attributes := make(map[string]string)
+	for k, v := range parameters {
+		attributes[strings.ToLower(k)] = v
+	}
+	if pv.Spec.CSI != nil {
+		for k, v := range pv.Spec.CSI.VolumeAttributes {
+			attributes[strings.ToLower(k)] = v
+		}
+	}
+
+	iops := firstParameter(attributes, iopsParameters)
+	if iops == 0 {
+		if iopsPerGB := firstParameter(attributes, iopsPerGBParameters); iopsPerGB > 0 {
+			if storage, ok := pv.Spec.Capacity[v1.ResourceStorage]; ok {
+				iops = iopsPerGB * float64(storage.Value()) / 1024 / 1024 / 1024
+			}
+		}
+	}
+	return iops, firstParameter(attributes, throughputParameters)
+}
+
+func firstParameter(attributes map[string]string, names []string) float64 {
+	for _, name := range names {
+		if v, ok := attributes[name]; ok {
+			f, err := strconv.ParseFloat(v, 64)
+			if err == nil {
+				return f
+			}
+		}
+	}
+	return 0
+}
+
+// StorageClassPricing parses the per storage class price overrides of the given config, which are of the form
+// "CLASS:STORAGE,IOPS,THROUGHPUT;..." with hourly prices per GB, per provisioned IOPS and per provisioned MiB/s.
+func StorageClassPricing(c *CustomPricing) (map[string]*StorageClassPrice, error) {
+	prices := make(map[string]*StorageClassPrice)
+	if c.StorageClassPricing == "" {
+		return prices, nil
+	}
+	for _, class := range strings.Split(c.StorageClassPricing, ";") {
+		kv := strings.SplitN(strings.TrimSpace(class), ":", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("Invalid storage class pricing '%s'; expected the form CLASS:STORAGE,IOPS,THROUGHPUT", class)
+		}
+		components := strings.Split(kv[1], ",")
+		if len(components) != 3 {
+			return nil, fmt.Errorf("Invalid storage class pricing '%s'; expected the form CLASS:STORAGE,IOPS,THROUGHPUT", class)
+		}
+		values := make([]float64, len(components))
+		for i, component := range components {
+			v, err := strconv.ParseFloat(strings.TrimSpace(component), 64)
+			if err != nil || v < 0 {
+				return nil, fmt.Errorf("Invalid storage class pricing '%s'; prices must be non-negative numbers", class)
+			}
+			values[i] = v
+		}
+		prices[strings.TrimSpace(kv[0])] = &StorageClassPrice{
+			StorageCost: values[0],
+			Tier: &StorageTier{
+				IOPSCost:       values[1],
+				ThroughputCost: values[2],
+			},
+		}
+	}
+	return prices, nil
+}
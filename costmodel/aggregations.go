@@ -4,6 +4,7 @@ import (
 	"math"
 	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/kubecost/cost-model/cloud"
@@ -11,6 +12,26 @@ import (
 	"k8s.io/klog"
 )
 
+// defaultTimestampBucket is the number of seconds to which the timestamps of samples are rounded when merging
+// vectors of cost data whose resolution is not known
+const defaultTimestampBucket = 10.0
+
+// TimestampBucket returns the number of seconds to which the timestamps of samples of the given resolution are
+// rounded when merging vectors, so that each bucket holds one sample of each series: the resolution in whole
+// seconds, or defaultTimestampBucket if the resolution is not known
+func TimestampBucket(resolution time.Duration) float64 {
+	bucket := math.Round(resolution.Seconds())
+	if bucket < 1 {
+		return defaultTimestampBucket
+	}
+	return bucket
+}
+
+// roundTimestamp rounds the given timestamp to the nearest multiple of bucket seconds
+func roundTimestamp(timestamp float64, bucket float64) float64 {
+	return math.Round(timestamp/bucket) * bucket
+}
+
 type Aggregation struct {
 	Aggregator         string    `json:"aggregation"`
 	AggregatorSubField string    `json:"aggregationSubfield"`
@@ -23,13 +44,26 @@ type Aggregation struct {
 	PVCostVector       []*Vector `json:"pvCostVector,omitempty"`
 	GPUAllocation      []*Vector `json:"-"`
 	GPUCostVector      []*Vector `json:"gpuCostVector,omitempty"`
+	NetworkCostVector  []*Vector `json:"networkCostVector,omitempty"`
 	CPUCost            float64   `json:"cpuCost"`
 	RAMCost            float64   `json:"ramCost"`
 	GPUCost            float64   `json:"gpuCost"`
 	PVCost             float64   `json:"pvCost"`
 	NetworkCost        float64   `json:"networkCost"`
+	LBCost             float64   `json:"lbCost"`
 	SharedCost         float64   `json:"sharedCost"`
+	MarkupCost         float64   `json:"markupCost"`
+	ExternalCost       float64   `json:"externalCost"`
+	IdleCost           float64   `json:"idleCost,omitempty"` // only set on the aggregation keyed by IdleAggregationKey
 	TotalCost          float64   `json:"totalCost"`
+	AppliedDiscount    float64   `json:"appliedDiscount"`    // fraction by which costs were discounted, weighted by cost under cost rules
+	AppliedMarkup      float64   `json:"appliedMarkup"`      // fraction by which discounted costs were marked up
+	CPUAllocationTotal float64   `json:"cpuAllocationTotal"` // core-hours allocated, by which CPUCost is divided for a unit rate
+	RAMAllocationTotal float64   `json:"ramAllocationTotal"` // GB-hours allocated
+	GPUAllocationTotal float64   `json:"gpuAllocationTotal"` // GPU-hours allocated
+
+	listCost     float64 // cost before discount, from which AppliedDiscount is derived
+	ramByteHours float64 // byte-hours of RAM allocated, from which RAMAllocationTotal is derived
 }
 
 type SharedResourceInfo struct {
@@ -68,7 +102,109 @@ func NewSharedResourceInfo(shareResources bool, sharedNamespaces []string, label
 	return sr
 }
 
+const (
+	// IdleModeCoefficient spreads idle cost into each aggregation by scaling container costs
+	IdleModeCoefficient = "coefficient"
+	// IdleModeCategory reports idle cost as its own aggregation, keyed by IdleAggregationKey
+	IdleModeCategory = "category"
+
+	// IdleAggregationKey is the key of the synthetic aggregation holding idle cost in IdleModeCategory
+	IdleAggregationKey = "__idle__"
+)
+
+// AggregationMetadata describes how the costs in an aggregation response were computed
+type AggregationMetadata struct {
+	Start              string   `json:"start"`
+	End                string   `json:"end"`
+	Timezone           string   `json:"timezone,omitempty"` // the time zone whose days the window is aligned to, if any
+	Discount           float64  `json:"discount"`
+	AllocationPolicy   string   `json:"allocationPolicy"`
+	IdleMode           string   `json:"idleMode,omitempty"`
+	IdleCoefficient    float64  `json:"idleCoefficient"`
+	IdleCost           *float64 `json:"idleCost,omitempty"`         // only computed if idle cost is allocated
+	TotalClusterCost   *float64 `json:"totalClusterCost,omitempty"` // only computed if idle cost is allocated
+	TotalAllocatedCost float64  `json:"totalAllocatedCost"`
+	ManagementFee      float64  `json:"managementFee,omitempty"`
+}
+
+// AggregationResponse is the response of the aggregated cost model API
+type AggregationResponse struct {
+	Aggregations map[string]*Aggregation `json:"aggregations"`
+	Metadata     *AggregationMetadata    `json:"metadata"`
+	Warnings     []string                `json:"-"` // reported alongside the response, and kept with it when cached
+}
+
+// AggregationSummary is the grand total of each cost category across the aggregations of a response, including
+// any synthetic aggregations, e.g. of idle cost. Shared costs are included as split between the aggregations, so
+// SharedCost is the total cost of shared resources. IdleCost is only set with idle cost reported as a category.
+type AggregationSummary struct {
+	Count        int     `json:"count"`
+	CPUCost      float64 `json:"cpuCost"`
+	RAMCost      float64 `json:"ramCost"`
+	GPUCost      float64 `json:"gpuCost"`
+	PVCost       float64 `json:"pvCost"`
+	NetworkCost  float64 `json:"networkCost"`
+	LBCost       float64 `json:"lbCost"`
+	SharedCost   float64 `json:"sharedCost"`
+	MarkupCost   float64 `json:"markupCost"`
+	ExternalCost float64 `json:"externalCost"`
+	IdleCost     float64 `json:"idleCost,omitempty"`
+	TotalCost    float64 `json:"totalCost"`
+}
+
+// SummarizeAggregations sums each cost category across the given aggregations
+func SummarizeAggregations(aggregations map[string]*Aggregation) *AggregationSummary {
+	summary := &AggregationSummary{Count: len(aggregations)}
+	for _, agg := range aggregations {
+		summary.CPUCost += agg.CPUCost
+		summary.RAMCost += agg.RAMCost
+		summary.GPUCost += agg.GPUCost
+		summary.PVCost += agg.PVCost
+		summary.NetworkCost += agg.NetworkCost
+		summary.LBCost += agg.LBCost
+		summary.SharedCost += agg.SharedCost
+		summary.MarkupCost += agg.MarkupCost
+		summary.ExternalCost += agg.ExternalCost
+		summary.IdleCost += agg.IdleCost
+		summary.TotalCost += agg.TotalCost
+	}
+	return summary
+}
+
 func ComputeIdleCoefficient(costData map[string]*CostData, cli prometheusClient.Client, cp cloud.Provider, discount float64, windowString, offset string) (float64, error) {
+	totalClusterCostOverWindow, err := ClusterCostOverWindow(cli, cp, discount, windowString, offset)
+	if err != nil {
+		return 0.0, err
+	}
+	totalContainerCost := TotalContainerCost(cp, costData, discount)
+
+	return IdleCoefficient(totalContainerCost, totalClusterCostOverWindow), nil
+}
+
+// IdleCoefficient returns the ratio of allocated cost to total cluster cost, by which container costs
+// are divided to distribute idle cost across them
+func IdleCoefficient(totalContainerCost, totalClusterCost float64) float64 {
+	if totalClusterCost == 0.0 {
+		return 0.0
+	}
+	return totalContainerCost / totalClusterCost
+}
+
+// ComputeIdleCost returns the difference between the total cost of the cluster over the given window
+// and the cost allocated to the given containers, i.e. the cost of idle resources.
+func ComputeIdleCost(costData map[string]*CostData, cli prometheusClient.Client, cp cloud.Provider, discount float64, windowString, offset string) (float64, error) {
+	totalClusterCostOverWindow, err := ClusterCostOverWindow(cli, cp, discount, windowString, offset)
+	if err != nil {
+		return 0.0, err
+	}
+	totalContainerCost := TotalContainerCost(cp, costData, discount)
+
+	return totalClusterCostOverWindow - totalContainerCost, nil
+}
+
+// ClusterCostOverWindow returns the discounted total cost of the cluster over the given window. The
+// cluster management fee is excluded, as it cannot be allocated to containers and so is not idle.
+func ClusterCostOverWindow(cli prometheusClient.Client, cp cloud.Provider, discount float64, windowString, offset string) (float64, error) {
 	windowDuration, err := time.ParseDuration(windowString)
 	if err != nil {
 		return 0.0, err
@@ -78,13 +214,27 @@ func ComputeIdleCoefficient(costData map[string]*CostData, cli prometheusClient.
 		return 0.0, err
 	}
 	totalClusterCost, err := strconv.ParseFloat(totals.TotalCost[0][1], 64)
-	if err != nil || totalClusterCost == 0.0 {
+	if err != nil {
 		return 0.0, err
 	}
-	totalClusterCostOverWindow := (totalClusterCost / 730) * windowDuration.Hours() * (1 - discount)
+	if len(totals.ManagementCost) > 0 {
+		managementCost, err := strconv.ParseFloat(totals.ManagementCost[0][1], 64)
+		if err != nil {
+			return 0.0, err
+		}
+		totalClusterCost -= managementCost
+	}
+	return (totalClusterCost / 730) * windowDuration.Hours() * (1 - discount), nil
+}
+
+// TotalContainerCost sums the discounted cost of all given cost data, without applying an idle coefficient.
+func TotalContainerCost(cp cloud.Provider, costData map[string]*CostData, discount float64) float64 {
+	pricing := newPricingConfig(cp)
 	totalContainerCost := 0.0
 	for _, costDatum := range costData {
-		cpuv, ramv, gpuv, pvvs := getPriceVectors(cp, costDatum, discount, 1)
+		// the cost of allocated resources is that charged by the provider, so is computed without the cost rules
+		// and markups adjusting what is charged back
+		cpuv, ramv, gpuv, pvvs, _ := getPriceVectors(pricing, costDatum, discount, 1, false, defaultTimestampBucket)
 		totalContainerCost += totalVector(cpuv)
 		totalContainerCost += totalVector(ramv)
 		totalContainerCost += totalVector(gpuv)
@@ -92,13 +242,130 @@ func ComputeIdleCoefficient(costData map[string]*CostData, cli prometheusClient.
 			totalContainerCost += totalVector(pv)
 		}
 	}
+	return totalContainerCost
+}
 
-	return (totalContainerCost / totalClusterCostOverWindow), nil
+// NodeIdleCost is the cost of a node over a window, split into the cost allocated to containers
+// running on it and the idle remainder
+type NodeIdleCost struct {
+	Node           string  `json:"node"`
+	HourlyCost     float64 `json:"hourlyCost"`
+	TotalCost      float64 `json:"totalCost"`
+	AllocatedCost  float64 `json:"allocatedCost"`
+	IdleCost       float64 `json:"idleCost"`
+	IdlePercentage float64 `json:"idlePercentage"`
+}
+
+// ComputeIdleByNode joins cost data to the given nodes by node name, returning for each node its discounted
+// cost over windowHours, the cost allocated to its containers and the idle remainder. Nodes without any
+// containers are entirely idle. The hourly cost of a node is its list price, as recorded by node_total_hourly_cost,
+// and its total cost is discounted as node_total_hourly_cost_discounted is.
+func ComputeIdleByNode(cp cloud.Provider, costData map[string]*CostData, nodes []*NodeAsset, windowHours float64, discount float64) map[string]*NodeIdleCost {
+	costDataByNode := make(map[string]map[string]*CostData)
+	for key, costDatum := range costData {
+		if _, ok := costDataByNode[costDatum.NodeName]; !ok {
+			costDataByNode[costDatum.NodeName] = make(map[string]*CostData)
+		}
+		costDataByNode[costDatum.NodeName][key] = costDatum
+	}
+
+	idleCosts := make(map[string]*NodeIdleCost)
+	for _, node := range nodes {
+		idle := &NodeIdleCost{
+			Node:       node.Name,
+			HourlyCost: node.TotalHourlyCost,
+			TotalCost:  node.TotalHourlyCost * windowHours * (1 - discount),
+		}
+		if nodeCostData, ok := costDataByNode[node.Name]; ok {
+			idle.AllocatedCost = TotalContainerCost(cp, nodeCostData, discount)
+		}
+		idle.IdleCost = idle.TotalCost - idle.AllocatedCost
+		if idle.TotalCost > 0 {
+			idle.IdlePercentage = idle.IdleCost / idle.TotalCost * 100
+		}
+		idleCosts[node.Name] = idle
+	}
+
+	for name := range costDataByNode {
+		if _, ok := idleCosts[name]; !ok {
+			klog.V(4).Infof("No pricing found for node %s, its allocated cost is not included in idle costs", name)
+		}
+	}
+
+	return idleCosts
+}
+
+// NodePoolIdleCost is the cost of the nodes of a node pool over a window, split into the cost allocated to
+// containers running on them and the idle remainder
+type NodePoolIdleCost struct {
+	NodePool       string  `json:"nodePool"`
+	Nodes          int     `json:"nodes"`
+	HourlyCost     float64 `json:"hourlyCost"`
+	TotalCost      float64 `json:"totalCost"`
+	AllocatedCost  float64 `json:"allocatedCost"`
+	IdleCost       float64 `json:"idleCost"`
+	IdlePercentage float64 `json:"idlePercentage"`
+}
+
+// ComputeIdleByNodePool sums the idle costs of the given nodes, as computed by ComputeIdleByNode, by their node
+// pools. Nodes without a pool are summed under cloud.UnknownNodePool.
+func ComputeIdleByNodePool(idleByNode map[string]*NodeIdleCost, nodes []*NodeAsset) map[string]*NodePoolIdleCost {
+	idleCosts := make(map[string]*NodePoolIdleCost)
+	for _, node := range nodes {
+		nodeIdle, ok := idleByNode[node.Name]
+		if !ok {
+			continue
+		}
+		pool := node.NodePool
+		if pool == "" {
+			pool = cloud.UnknownNodePool
+		}
+		idle, ok := idleCosts[pool]
+		if !ok {
+			idle = &NodePoolIdleCost{NodePool: pool}
+			idleCosts[pool] = idle
+		}
+		idle.Nodes++
+		idle.HourlyCost += nodeIdle.HourlyCost
+		idle.TotalCost += nodeIdle.TotalCost
+		idle.AllocatedCost += nodeIdle.AllocatedCost
+		idle.IdleCost += nodeIdle.IdleCost
+	}
+	for _, idle := range idleCosts {
+		if idle.TotalCost > 0 {
+			idle.IdlePercentage = idle.IdleCost / idle.TotalCost * 100
+		}
+	}
+	return idleCosts
+}
+
+// AddIdleAggregation adds a synthetic aggregation, keyed by IdleAggregationKey, holding the given idle
+// cost to the results of AggregateCostModel. It should only be used when costs were aggregated with an
+// idle coefficient of 1.0, otherwise idle cost is counted twice.
+func AddIdleAggregation(aggregations map[string]*Aggregation, field string, subfield string, idleCost float64) {
+	aggregations[IdleAggregationKey] = &Aggregation{
+		Aggregator:         field,
+		AggregatorSubField: subfield,
+		Environment:        IdleAggregationKey,
+		IdleCost:           idleCost,
+		TotalCost:          idleCost,
+	}
 }
 
 // AggregateCostModel reduces the dimensions of raw cost data by field and, optionally, by time. The field parameter determines the field
-// by which to group data, with an optional subfield, e.g. for groupings like field="label" and subfield="app" for grouping by "label.app".
+// by which to group data, with an optional subfield, e.g. for groupings like field="label" and subfield="app" for grouping by "label.app",
+// or field="annotation" and subfield="finance.example.com/cost-center" for grouping by that annotation.
 func AggregateCostModel(cp cloud.Provider, costData map[string]*CostData, field string, subfield string, timeSeries bool, discount float64, idleCoefficient float64, sr *SharedResourceInfo) map[string]*Aggregation {
+	return AggregateCostModelAtResolution(cp, costData, field, subfield, timeSeries, discount, idleCoefficient, sr, 0)
+}
+
+// AggregateCostModelAtResolution aggregates cost data like AggregateCostModel, merging the samples of its time
+// series in buckets of the given resolution, the step of the queries the cost data was computed from. With no
+// resolution, samples are merged in buckets of defaultTimestampBucket.
+func AggregateCostModelAtResolution(cp cloud.Provider, costData map[string]*CostData, field string, subfield string, timeSeries bool, discount float64, idleCoefficient float64, sr *SharedResourceInfo, resolution time.Duration) map[string]*Aggregation {
+	bucket := TimestampBucket(resolution)
+	pricing := newPricingConfig(cp)
+
 	// aggregations collects key-value pairs of resource group-to-aggregated data
 	// e.g. namespace-to-data or label-value-to-data
 	aggregations := make(map[string]*Aggregation)
@@ -109,57 +376,98 @@ func AggregateCostModel(cp cloud.Provider, costData map[string]*CostData, field
 
 	for _, costDatum := range costData {
 		if sr != nil && sr.ShareResources && sr.IsSharedResource(costDatum) {
-			cpuv, ramv, gpuv, pvvs := getPriceVectors(cp, costDatum, discount, idleCoefficient)
+			cpuv, ramv, gpuv, pvvs, adjustment := getPriceVectors(pricing, costDatum, discount, idleCoefficient, true, bucket)
+			sharedResourceCost += adjustment.markupCost
 			sharedResourceCost += totalVector(cpuv)
 			sharedResourceCost += totalVector(ramv)
 			sharedResourceCost += totalVector(gpuv)
 			for _, pv := range pvvs {
 				sharedResourceCost += totalVector(pv)
 			}
+			sharedResourceCost += totalVector(costDatum.NetworkData)
 		} else {
 			if field == "cluster" {
-				aggregateDatum(cp, aggregations, costDatum, field, subfield, costDatum.ClusterID, discount, idleCoefficient)
+				aggregateDatum(pricing, aggregations, costDatum, field, subfield, costDatum.ClusterID, discount, idleCoefficient, timeSeries, bucket)
 			} else if field == "namespace" {
-				aggregateDatum(cp, aggregations, costDatum, field, subfield, costDatum.Namespace, discount, idleCoefficient)
+				aggregateDatum(pricing, aggregations, costDatum, field, subfield, costDatum.Namespace, discount, idleCoefficient, timeSeries, bucket)
 			} else if field == "service" {
 				if len(costDatum.Services) > 0 {
-					aggregateDatum(cp, aggregations, costDatum, field, subfield, costDatum.Services[0], discount, idleCoefficient)
+					aggregateDatum(pricing, aggregations, costDatum, field, subfield, costDatum.Services[0], discount, idleCoefficient, timeSeries, bucket)
 				}
 			} else if field == "deployment" {
 				if len(costDatum.Deployments) > 0 {
-					aggregateDatum(cp, aggregations, costDatum, field, subfield, costDatum.Deployments[0], discount, idleCoefficient)
+					aggregateDatum(pricing, aggregations, costDatum, field, subfield, costDatum.Deployments[0], discount, idleCoefficient, timeSeries, bucket)
+				}
+			} else if field == "statefulset" {
+				if len(costDatum.Statefulsets) > 0 {
+					aggregateDatum(pricing, aggregations, costDatum, field, subfield, costDatum.Statefulsets[0], discount, idleCoefficient, timeSeries, bucket)
+				}
+			} else if field == "daemonset" {
+				if len(costDatum.Daemonsets) > 0 {
+					aggregateDatum(pricing, aggregations, costDatum, field, subfield, costDatum.Daemonsets[0], discount, idleCoefficient, timeSeries, bucket)
 				}
+			} else if field == "job" {
+				// the runs of a CronJob, each a Job of its own, are aggregated as one
+				if len(costDatum.CronJobs) > 0 {
+					aggregateDatum(pricing, aggregations, costDatum, field, subfield, costDatum.CronJobs[0], discount, idleCoefficient, timeSeries, bucket)
+				} else if len(costDatum.Jobs) > 0 {
+					aggregateDatum(pricing, aggregations, costDatum, field, subfield, costDatum.Jobs[0], discount, idleCoefficient, timeSeries, bucket)
+				}
+			} else if field == "cronjob" {
+				if len(costDatum.CronJobs) > 0 {
+					aggregateDatum(pricing, aggregations, costDatum, field, subfield, costDatum.CronJobs[0], discount, idleCoefficient, timeSeries, bucket)
+				}
+			} else if field == "nodepool" {
+				aggregateDatum(pricing, aggregations, costDatum, field, subfield, cloud.NodePool(costDatum.NodeData.Labels), discount, idleCoefficient, timeSeries, bucket)
 			} else if field == "label" {
 				if costDatum.Labels != nil {
 					if subfieldName, ok := costDatum.Labels[subfield]; ok {
-						aggregateDatum(cp, aggregations, costDatum, field, subfield, subfieldName, discount, idleCoefficient)
+						aggregateDatum(pricing, aggregations, costDatum, field, subfield, subfieldName, discount, idleCoefficient, timeSeries, bucket)
 					}
 				}
+			} else if field == "annotation" {
+				if costDatum.Annotations != nil {
+					if subfieldName, ok := costDatum.Annotations[subfield]; ok {
+						aggregateDatum(pricing, aggregations, costDatum, field, subfield, subfieldName, discount, idleCoefficient, timeSeries, bucket)
+					}
+				}
+			} else if field == "image" {
+				// the subfield is how the image references are normalized. Images are only known for cached pods.
+				image := UnknownImageAggregationKey
+				if costDatum.Image != "" {
+					image = NormalizeImage(costDatum.Image, subfield)
+				}
+				aggregateDatum(pricing, aggregations, costDatum, field, subfield, image, discount, idleCoefficient, timeSeries, bucket)
 			}
 		}
 	}
 
 	for _, agg := range aggregations {
-		agg.CPUCost = totalVector(agg.CPUCostVector)
-		agg.RAMCost = totalVector(agg.RAMCostVector)
-		agg.GPUCost = totalVector(agg.GPUCostVector)
-		agg.PVCost = totalVector(agg.PVCostVector)
+		if timeSeries {
+			agg.CPUCost = totalVector(agg.CPUCostVector)
+			agg.RAMCost = totalVector(agg.RAMCostVector)
+			agg.GPUCost = totalVector(agg.GPUCostVector)
+			agg.PVCost = totalVector(agg.PVCostVector)
+			agg.NetworkCost = totalVector(agg.NetworkCostVector)
+			agg.CPUAllocationTotal = totalVector(agg.CPUAllocation)
+			agg.ramByteHours = totalVector(agg.RAMAllocation)
+			agg.GPUAllocationTotal = totalVector(agg.GPUAllocation)
+		}
+		agg.RAMAllocationTotal = agg.ramByteHours / pricing.bytesPerGB
 		agg.SharedCost = sharedResourceCost / float64(len(aggregations))
-		agg.TotalCost = agg.CPUCost + agg.RAMCost + agg.GPUCost + agg.PVCost + agg.SharedCost
-
-		// remove time series data if it is not explicitly requested
-		if !timeSeries {
-			agg.CPUCostVector = nil
-			agg.RAMCostVector = nil
-			agg.PVCostVector = nil
-			agg.GPUCostVector = nil
+		agg.TotalCost = agg.CPUCost + agg.RAMCost + agg.GPUCost + agg.PVCost + agg.NetworkCost + agg.SharedCost + agg.MarkupCost
+		if cost := agg.CPUCost + agg.RAMCost + agg.GPUCost + agg.PVCost; cost > 0 {
+			agg.AppliedDiscount = 1 - cost/agg.listCost
+			agg.AppliedMarkup = agg.MarkupCost / cost
 		}
 	}
 
 	return aggregations
 }
 
-func aggregateDatum(cp cloud.Provider, aggregations map[string]*Aggregation, costDatum *CostData, field string, subfield string, key string, discount float64, idleCoefficient float64) {
+// aggregateDatum adds the costs of the given cost datum to its aggregation. Without timeSeries, only the total
+// costs are accumulated, so that the cost vectors of large clusters are not merged only to be summed and dropped.
+func aggregateDatum(pricing *pricingConfig, aggregations map[string]*Aggregation, costDatum *CostData, field string, subfield string, key string, discount float64, idleCoefficient float64, timeSeries bool, bucket float64) {
 	// add new entry to aggregation results if a new
 	if _, ok := aggregations[key]; !ok {
 		agg := &Aggregation{}
@@ -170,24 +478,114 @@ func aggregateDatum(cp cloud.Provider, aggregations map[string]*Aggregation, cos
 		aggregations[key] = agg
 	}
 
-	mergeVectors(cp, costDatum, aggregations[key], discount, idleCoefficient)
+	if timeSeries {
+		mergeVectors(pricing, costDatum, aggregations[key], discount, idleCoefficient, bucket)
+	} else {
+		addTotals(pricing, costDatum, aggregations[key], discount, idleCoefficient, bucket)
+	}
 }
 
-func mergeVectors(cp cloud.Provider, costDatum *CostData, aggregation *Aggregation, discount float64, idleCoefficient float64) {
-	aggregation.CPUAllocation = addVectors(costDatum.CPUAllocation, aggregation.CPUAllocation)
-	aggregation.RAMAllocation = addVectors(costDatum.RAMAllocation, aggregation.RAMAllocation)
-	aggregation.GPUAllocation = addVectors(costDatum.GPUReq, aggregation.GPUAllocation)
+// mergeVectors adds the allocation and cost vectors of the given cost datum to those of the aggregation, in
+// buckets of the given number of seconds
+func mergeVectors(pricing *pricingConfig, costDatum *CostData, aggregation *Aggregation, discount float64, idleCoefficient float64, bucket float64) {
+	aggregation.CPUAllocation = addVectors(costDatum.CPUAllocation, aggregation.CPUAllocation, bucket)
+	aggregation.RAMAllocation = addVectors(costDatum.RAMAllocation, aggregation.RAMAllocation, bucket)
+	aggregation.GPUAllocation = addVectors(costDatum.GPUReq, aggregation.GPUAllocation, bucket)
+
+	cpuv, ramv, gpuv, pvvs, adjustment := getPriceVectors(pricing, costDatum, discount, idleCoefficient, true, bucket)
+	aggregation.MarkupCost += adjustment.markupCost
+	aggregation.listCost += adjustment.listCost
+	aggregation.CPUCostVector = addVectors(cpuv, aggregation.CPUCostVector, bucket)
+	aggregation.RAMCostVector = addVectors(ramv, aggregation.RAMCostVector, bucket)
+	aggregation.GPUCostVector = addVectors(gpuv, aggregation.GPUCostVector, bucket)
+	for _, vectorList := range pvvs {
+		aggregation.PVCostVector = addVectors(aggregation.PVCostVector, vectorList, bucket)
+	}
+	// network egress is billed as used, so it is neither discounted nor marked up
+	aggregation.NetworkCostVector = addVectors(costDatum.NetworkData, aggregation.NetworkCostVector, bucket)
+}
 
-	cpuv, ramv, gpuv, pvvs := getPriceVectors(cp, costDatum, discount, idleCoefficient)
-	aggregation.CPUCostVector = addVectors(cpuv, aggregation.CPUCostVector)
-	aggregation.RAMCostVector = addVectors(ramv, aggregation.RAMCostVector)
-	aggregation.GPUCostVector = addVectors(gpuv, aggregation.GPUCostVector)
+// addTotals adds the total costs and allocations of the given cost datum to those of the aggregation, without its
+// cost and allocation vectors
+func addTotals(pricing *pricingConfig, costDatum *CostData, aggregation *Aggregation, discount float64, idleCoefficient float64, bucket float64) {
+	aggregation.CPUAllocationTotal += totalVector(costDatum.CPUAllocation)
+	aggregation.ramByteHours += totalVector(costDatum.RAMAllocation)
+	aggregation.GPUAllocationTotal += totalVector(costDatum.GPUReq)
+
+	cpuv, ramv, gpuv, pvvs, adjustment := getPriceVectors(pricing, costDatum, discount, idleCoefficient, true, bucket)
+	aggregation.MarkupCost += adjustment.markupCost
+	aggregation.listCost += adjustment.listCost
+	aggregation.CPUCost += totalVector(cpuv)
+	aggregation.RAMCost += totalVector(ramv)
+	aggregation.GPUCost += totalVector(gpuv)
 	for _, vectorList := range pvvs {
-		aggregation.PVCostVector = addVectors(aggregation.PVCostVector, vectorList)
+		aggregation.PVCost += totalVector(vectorList)
+	}
+	aggregation.NetworkCost += totalVector(costDatum.NetworkData)
+}
+
+// priceAdjustment is how the costs of a cost datum were adjusted from list prices
+type priceAdjustment struct {
+	listCost   float64 // cost before discount
+	markupCost float64 // cost by which the discounted costs are marked up
+}
+
+// pricingConfig is the custom pricing config by which cost data is priced, parsed once for all the cost data
+// priced together rather than for each cost datum. Parts of the config which fail to parse are logged and
+// left unset.
+type pricingConfig struct {
+	customPricing       *cloud.CustomPricing
+	customPricesEnabled bool
+	bytesPerGB          float64
+	gpuPricing          *cloud.GPUPricing
+	selectors           []*cloud.CustomPriceSelector
+	markup              *cloud.Markup
+	schedule            cloud.DiscountSegments
+	rules               []*cloud.CostRule
+}
+
+// newPricingConfig loads and parses the custom pricing config of the given provider
+func newPricingConfig(cp cloud.Provider) *pricingConfig {
+	customPricing, err := cp.GetConfig()
+	if err != nil {
+		klog.Errorf("failed to load custom pricing: %s", err)
+	}
+	pricing := &pricingConfig{
+		customPricing:       customPricing,
+		customPricesEnabled: cloud.CustomPricesEnabled(cp) && err == nil,
+		bytesPerGB:          cloud.RAMBytesPerGB(customPricing),
+		markup:              &cloud.Markup{},
+	}
+	if pricing.customPricesEnabled {
+		if pricing.gpuPricing, err = cloud.CustomGPUPricing(customPricing); err != nil {
+			klog.Errorf("failed to load custom GPU pricing: %s", err)
+			pricing.gpuPricing = nil
+		}
+		if pricing.selectors, err = cloud.CustomPriceSelectors(customPricing); err != nil {
+			klog.Errorf("failed to load custom prices by selector: %s", err)
+			pricing.selectors = nil
+		}
 	}
+	if markup, err := cloud.CustomMarkup(customPricing); err != nil {
+		klog.Errorf("failed to load markup: %s", err)
+	} else {
+		pricing.markup = markup
+	}
+	if pricing.schedule, err = cloud.DiscountSchedule(customPricing); err != nil {
+		klog.Errorf("failed to load discount schedule: %s", err)
+		pricing.schedule = nil
+	}
+	if pricing.rules, err = cloud.CostRules(customPricing); err != nil {
+		klog.Errorf("failed to load cost rules: %s", err)
+		pricing.rules = nil
+	}
+	return pricing
 }
 
-func getPriceVectors(cp cloud.Provider, costDatum *CostData, discount float64, idleCoefficient float64) ([]*Vector, []*Vector, []*Vector, [][]*Vector) {
+// getPriceVectors returns the discounted CPU, RAM, GPU and PV cost vectors of the given cost datum, timestamped
+// in buckets of the given number of seconds, and how its costs were adjusted. With applyRules, the discount and
+// markup are those of the most specific cost rule matching the cost datum, if any.
+func getPriceVectors(pricing *pricingConfig, costDatum *CostData, discount float64, idleCoefficient float64, applyRules bool, bucket float64) ([]*Vector, []*Vector, []*Vector, [][]*Vector, *priceAdjustment) {
 	cpuCostStr := costDatum.NodeData.VCPUCost
 	ramCostStr := costDatum.NodeData.RAMCost
 	gpuCostStr := costDatum.NodeData.GPUCost
@@ -195,11 +593,17 @@ func getPriceVectors(cp cloud.Provider, costDatum *CostData, discount float64, i
 
 	// If custom pricing is enabled and can be retrieved, replace
 	// default cost values with custom values
-	customPricing, err := cp.GetConfig()
-	if err != nil {
-		klog.Errorf("failed to load custom pricing: %s", err)
-	}
-	if cloud.CustomPricesEnabled(cp) && err == nil {
+	customPricing := pricing.customPricing
+	bytesPerGB := pricing.bytesPerGB
+	// nodes priced by a node pricing rule or a rate override keep their prices, as those are already custom, and
+	// their volumes are priced at the storage price of the rule, if set, or else at the custom storage price
+	customPricesEnabled := pricing.customPricesEnabled
+	rulePriced := costDatum.NodeData.PricingRule != ""
+	if customPricesEnabled && (rulePriced || costDatum.NodeData.RateOverride != "") {
+		if pvCostStr == "" {
+			pvCostStr = customPricing.Storage
+		}
+	} else if customPricesEnabled {
 		if costDatum.NodeData.IsSpot() {
 			cpuCostStr = customPricing.SpotCPU
 			ramCostStr = customPricing.SpotRAM
@@ -209,7 +613,44 @@ func getPriceVectors(cp cloud.Provider, costDatum *CostData, discount float64, i
 			ramCostStr = customPricing.RAM
 			gpuCostStr = customPricing.GPU
 		}
+		if pricing.gpuPricing != nil {
+			if gpuPrice, ok := pricing.gpuPricing.Cost(costDatum.NodeData.GPUName, costDatum.NodeData.IsSpot()); ok {
+				gpuCostStr = strconv.FormatFloat(gpuPrice, 'f', -1, 64)
+			}
+		}
 		pvCostStr = customPricing.Storage
+
+		// the first custom prices selecting the node by its labels take precedence over the global ones
+		if selector := cloud.MatchCustomPriceSelector(pricing.selectors, costDatum.NodeData.Labels); selector != nil {
+			cpuCostStr = selector.CPU
+			ramCostStr = selector.RAM
+			if selector.GPU != "" {
+				gpuCostStr = selector.GPU
+			}
+		}
+	}
+
+	markup := pricing.markup
+	// a discount schedule discounts each sample by the discount in effect at its time, in place of the given
+	// discount, unless a cost rule overrides the discount
+	schedule := pricing.schedule
+	if applyRules {
+		if rule := cloud.MatchCostRule(pricing.rules, costDatum.Namespace, costDatum.Labels); rule != nil {
+			if rule.Discount != nil {
+				discount = *rule.Discount
+				schedule = nil
+			}
+			if rule.Markup != nil {
+				markup = &cloud.Markup{CPU: *rule.Markup, RAM: *rule.Markup, GPU: *rule.Markup, Storage: *rule.Markup}
+			}
+		}
+	}
+
+	discountAt := func(timestamp float64) float64 {
+		if d, ok := schedule.At(time.Unix(int64(timestamp), 0)); ok {
+			return d
+		}
+		return discount
 	}
 
 	cpuCost, _ := strconv.ParseFloat(cpuCostStr, 64)
@@ -217,27 +658,32 @@ func getPriceVectors(cp cloud.Provider, costDatum *CostData, discount float64, i
 	gpuCost, _ := strconv.ParseFloat(gpuCostStr, 64)
 	pvCost, _ := strconv.ParseFloat(pvCostStr, 64)
 
+	listCost := 0.0
+
 	cpuv := make([]*Vector, 0, len(costDatum.CPUAllocation))
 	for _, val := range costDatum.CPUAllocation {
+		listCost += val.Value * cpuCost / idleCoefficient
 		cpuv = append(cpuv, &Vector{
-			Timestamp: math.Round(val.Timestamp/10) * 10,
-			Value:     val.Value * cpuCost * (1 - discount) * 1 / idleCoefficient,
+			Timestamp: roundTimestamp(val.Timestamp, bucket),
+			Value:     val.Value * cpuCost * (1 - discountAt(val.Timestamp)) * 1 / idleCoefficient,
 		})
 	}
 
 	ramv := make([]*Vector, 0, len(costDatum.RAMAllocation))
 	for _, val := range costDatum.RAMAllocation {
+		listCost += (val.Value / bytesPerGB) * ramCost / idleCoefficient
 		ramv = append(ramv, &Vector{
-			Timestamp: math.Round(val.Timestamp/10) * 10,
-			Value:     (val.Value / 1024 / 1024 / 1024) * ramCost * (1 - discount) * 1 / idleCoefficient,
+			Timestamp: roundTimestamp(val.Timestamp, bucket),
+			Value:     (val.Value / bytesPerGB) * ramCost * (1 - discountAt(val.Timestamp)) * 1 / idleCoefficient,
 		})
 	}
 
 	gpuv := make([]*Vector, 0, len(costDatum.GPUReq))
 	for _, val := range costDatum.GPUReq {
+		listCost += val.Value * gpuCost / idleCoefficient
 		gpuv = append(gpuv, &Vector{
-			Timestamp: math.Round(val.Timestamp/10) * 10,
-			Value:     val.Value * gpuCost * (1 - discount) * 1 / idleCoefficient,
+			Timestamp: roundTimestamp(val.Timestamp, bucket),
+			Value:     val.Value * gpuCost * (1 - discountAt(val.Timestamp)) * 1 / idleCoefficient,
 		})
 	}
 
@@ -247,22 +693,31 @@ func getPriceVectors(cp cloud.Provider, costDatum *CostData, discount float64, i
 		if pvcData.Volume != nil {
 			cost, _ := strconv.ParseFloat(pvcData.Volume.Cost, 64)
 
-			// override with custom pricing if enabled
-			if cloud.CustomPricesEnabled(cp) {
+			// override with custom pricing if enabled, or with the storage price of the node pricing rule
+			if customPricesEnabled || (rulePriced && pvCostStr != "") {
 				cost = pvCost
 			}
 
 			for _, val := range pvcData.Values {
+				listCost += (val.Value / 1024 / 1024 / 1024) * cost / idleCoefficient
 				pvv = append(pvv, &Vector{
-					Timestamp: math.Round(val.Timestamp/10) * 10,
-					Value:     (val.Value / 1024 / 1024 / 1024) * cost * (1 - discount) * 1 / idleCoefficient,
+					Timestamp: roundTimestamp(val.Timestamp, bucket),
+					Value:     (val.Value / 1024 / 1024 / 1024) * cost * (1 - discountAt(val.Timestamp)) * 1 / idleCoefficient,
 				})
 			}
 			pvvs = append(pvvs, pvv)
 		}
 	}
 
-	return cpuv, ramv, gpuv, pvvs
+	adjustment := &priceAdjustment{
+		listCost:   listCost,
+		markupCost: totalVector(cpuv)*markup.CPU + totalVector(ramv)*markup.RAM + totalVector(gpuv)*markup.GPU,
+	}
+	for _, pvv := range pvvs {
+		adjustment.markupCost += totalVector(pvv) * markup.Storage
+	}
+
+	return cpuv, ramv, gpuv, pvvs, adjustment
 }
 
 func totalVector(vectors []*Vector) float64 {
@@ -273,13 +728,15 @@ func totalVector(vectors []*Vector) float64 {
 	return total
 }
 
-func addVectors(req []*Vector, used []*Vector) []*Vector {
+// addVectors returns the sum of the given vectors, with their timestamps rounded to buckets of the given number of
+// seconds, so that samples of the same bucket are added together
+func addVectors(req []*Vector, used []*Vector, bucket float64) []*Vector {
 	if req == nil || len(req) == 0 {
 		for _, usedV := range used {
 			if usedV.Timestamp == 0 {
 				continue
 			}
-			usedV.Timestamp = math.Round(usedV.Timestamp/10) * 10
+			usedV.Timestamp = roundTimestamp(usedV.Timestamp, bucket)
 		}
 		return used
 	}
@@ -288,7 +745,7 @@ func addVectors(req []*Vector, used []*Vector) []*Vector {
 			if reqV.Timestamp == 0 {
 				continue
 			}
-			reqV.Timestamp = math.Round(reqV.Timestamp/10) * 10
+			reqV.Timestamp = roundTimestamp(reqV.Timestamp, bucket)
 		}
 		return req
 	}
@@ -300,7 +757,7 @@ func addVectors(req []*Vector, used []*Vector) []*Vector {
 		if reqV.Timestamp == 0 {
 			continue
 		}
-		reqV.Timestamp = math.Round(reqV.Timestamp/10) * 10
+		reqV.Timestamp = roundTimestamp(reqV.Timestamp, bucket)
 		reqMap[reqV.Timestamp] = reqV.Value
 		timestamps = append(timestamps, reqV.Timestamp)
 	}
@@ -309,7 +766,7 @@ func addVectors(req []*Vector, used []*Vector) []*Vector {
 		if usedV.Timestamp == 0 {
 			continue
 		}
-		usedV.Timestamp = math.Round(usedV.Timestamp/10) * 10
+		usedV.Timestamp = roundTimestamp(usedV.Timestamp, bucket)
 		usedMap[usedV.Timestamp] = usedV.Value
 		if _, ok := reqMap[usedV.Timestamp]; !ok { // no need to double add, since we'll range over sorted timestamps and check.
 			timestamps = append(timestamps, usedV.Timestamp)
@@ -335,3 +792,162 @@ func addVectors(req []*Vector, used []*Vector) []*Vector {
 
 	return allocation
 }
+
+// FilterAggregations returns the aggregations with the given keys, sharing them with the given aggregations. As
+// it filters only what is reported, costs shared across all aggregations remain shared across all of them.
+func FilterAggregations(aggregations map[string]*Aggregation, keys []string) map[string]*Aggregation {
+	filtered := make(map[string]*Aggregation, len(keys))
+	for _, key := range keys {
+		if agg, ok := aggregations[key]; ok {
+			filtered[key] = agg
+		}
+	}
+	return filtered
+}
+
+// ExcludeNamespaces returns the given cost data without the datums of the given namespaces, so that they are
+// neither aggregated nor shared. The original cost data is not modified.
+func ExcludeNamespaces(costData map[string]*CostData, namespaces []string) map[string]*CostData {
+	if len(namespaces) == 0 || costData == nil {
+		return costData
+	}
+	excluded := make(map[string]bool, len(namespaces))
+	for _, ns := range namespaces {
+		excluded[ns] = true
+	}
+
+	included := make(map[string]*CostData, len(costData))
+	for key, cd := range costData {
+		if !excluded[cd.Namespace] {
+			included[key] = cd
+		}
+	}
+	return included
+}
+
+// AddSharedCost splits the given cost evenly into the shared cost of each aggregation, e.g. to share
+// the cluster management fee, which cannot be attributed to any resource. The synthetic idle and unmounted
+// aggregations take no share.
+func AddSharedCost(aggregations map[string]*Aggregation, sharedCost float64) {
+	sharing := []*Aggregation{}
+	for key, agg := range aggregations {
+		if key == IdleAggregationKey || key == UnmountedAggregationKey || strings.HasSuffix(key, "/"+UnmountedAggregationKey) {
+			continue
+		}
+		sharing = append(sharing, agg)
+	}
+	if len(sharing) == 0 {
+		return
+	}
+	share := sharedCost / float64(len(sharing))
+	for _, agg := range sharing {
+		agg.SharedCost += share
+		agg.TotalCost += share
+	}
+}
+
+// scaleAggregations multiplies every cost in the given aggregations by factor, in place
+func scaleAggregations(aggregations map[string]*Aggregation, factor float64) {
+	for _, agg := range aggregations {
+		agg.CPUCost *= factor
+		agg.RAMCost *= factor
+		agg.GPUCost *= factor
+		agg.PVCost *= factor
+		agg.NetworkCost *= factor
+		agg.SharedCost *= factor
+		agg.MarkupCost *= factor
+		agg.ExternalCost *= factor
+		agg.IdleCost *= factor
+		agg.LBCost *= factor
+		agg.TotalCost *= factor
+		scaleVectors(agg.CPUCostVector, factor)
+		scaleVectors(agg.RAMCostVector, factor)
+		scaleVectors(agg.PVCostVector, factor)
+		scaleVectors(agg.GPUCostVector, factor)
+		scaleVectors(agg.NetworkCostVector, factor)
+	}
+}
+
+// The change of an aggregation between two windows, as reported by AggregationDiff.Change
+const (
+	AggregationAdded   = "added"   // only in the second window
+	AggregationRemoved = "removed" // only in the first window
+	AggregationChanged = "changed" // in both windows, whether or not its costs differ
+)
+
+// CostDiff is the change of a cost from window A to window B. PercentChange is relative to A, so is nil when
+// A is zero, e.g. for aggregations added in B.
+type CostDiff struct {
+	A             float64  `json:"a"`
+	B             float64  `json:"b"`
+	Delta         float64  `json:"delta"`
+	PercentChange *float64 `json:"percentChange"`
+}
+
+func newCostDiff(a, b float64) *CostDiff {
+	diff := &CostDiff{A: a, B: b, Delta: b - a}
+	if a != 0 {
+		percent := 100 * (b - a) / a
+		diff.PercentChange = &percent
+	}
+	return diff
+}
+
+// AggregationDiff is the change of each cost category of an aggregation from window A to window B
+type AggregationDiff struct {
+	Environment  string    `json:"environment"`
+	Change       string    `json:"change"`
+	CPUCost      *CostDiff `json:"cpuCost"`
+	RAMCost      *CostDiff `json:"ramCost"`
+	GPUCost      *CostDiff `json:"gpuCost"`
+	PVCost       *CostDiff `json:"pvCost"`
+	NetworkCost  *CostDiff `json:"networkCost"`
+	LBCost       *CostDiff `json:"lbCost"`
+	SharedCost   *CostDiff `json:"sharedCost"`
+	MarkupCost   *CostDiff `json:"markupCost"`
+	ExternalCost *CostDiff `json:"externalCost"`
+	IdleCost     *CostDiff `json:"idleCost"`
+	TotalCost    *CostDiff `json:"totalCost"`
+}
+
+// DiffAggregations compares the aggregations of window A to those of window B, by key. Aggregations present in
+// only one of the windows are compared to zero costs in the other.
+func DiffAggregations(a map[string]*Aggregation, b map[string]*Aggregation) map[string]*AggregationDiff {
+	diffs := make(map[string]*AggregationDiff, len(a)+len(b))
+	for key := range a {
+		diffs[key] = nil
+	}
+	for key := range b {
+		diffs[key] = nil
+	}
+
+	for key := range diffs {
+		aggA, inA := a[key]
+		aggB, inB := b[key]
+		change := AggregationChanged
+		if !inA || aggA == nil {
+			aggA = &Aggregation{}
+			change = AggregationAdded
+		}
+		if !inB || aggB == nil {
+			aggB = &Aggregation{}
+			change = AggregationRemoved
+		}
+		diffs[key] = &AggregationDiff{
+			Environment:  key,
+			Change:       change,
+			CPUCost:      newCostDiff(aggA.CPUCost, aggB.CPUCost),
+			RAMCost:      newCostDiff(aggA.RAMCost, aggB.RAMCost),
+			GPUCost:      newCostDiff(aggA.GPUCost, aggB.GPUCost),
+			PVCost:       newCostDiff(aggA.PVCost, aggB.PVCost),
+			NetworkCost:  newCostDiff(aggA.NetworkCost, aggB.NetworkCost),
+			LBCost:       newCostDiff(aggA.LBCost, aggB.LBCost),
+			SharedCost:   newCostDiff(aggA.SharedCost, aggB.SharedCost),
+			MarkupCost:   newCostDiff(aggA.MarkupCost, aggB.MarkupCost),
+			ExternalCost: newCostDiff(aggA.ExternalCost, aggB.ExternalCost),
+			IdleCost:     newCostDiff(aggA.IdleCost, aggB.IdleCost),
+			TotalCost:    newCostDiff(aggA.TotalCost, aggB.TotalCost),
+		}
+	}
+	return diffs
+}
@@ -0,0 +1,77 @@
+package costmodel
+
+import (
+	"fmt"
+	"os"
+)
+
+const (
+	// AllocationPolicyMax allocates each container the greater of its request and usage at each timestamp, so
+	// that containers using more than they request, or requesting nothing, are costed by their usage
+	AllocationPolicyMax = "max"
+	// AllocationPolicyRequest allocates each container its requests, regardless of usage
+	AllocationPolicyRequest = "request"
+	// AllocationPolicyUsage allocates each container its usage, regardless of requests
+	AllocationPolicyUsage = "usage"
+
+	allocationPolicyEnvVar = "ALLOCATION_POLICY"
+)
+
+// ValidateAllocationPolicy returns the given policy by which CPU and RAM are allocated, defaulting to
+// $ALLOCATION_POLICY or, if unset, AllocationPolicyMax, or an error if it is not a known policy
+func ValidateAllocationPolicy(policy string) (string, error) {
+	if policy == "" {
+		policy = os.Getenv(allocationPolicyEnvVar)
+		if policy == "" {
+			return AllocationPolicyMax, nil
+		}
+	}
+	if policy != AllocationPolicyMax && policy != AllocationPolicyRequest && policy != AllocationPolicyUsage {
+		return "", fmt.Errorf("Invalid allocationPolicy '%s'; must be '%s', '%s' or '%s'", policy, AllocationPolicyMax, AllocationPolicyRequest, AllocationPolicyUsage)
+	}
+	return policy, nil
+}
+
+// ApplyAllocationPolicy returns the given cost data with the CPU and RAM allocation of each container derived
+// from its requests or usage alone, as the policy dictates. Allocations are the maximum of the two as computed,
+// so are kept under AllocationPolicyMax, as well as for containers whose cost data doesn't report requests and
+// usage, e.g. when read back from a remote database. The original cost data is not modified.
+func ApplyAllocationPolicy(costData map[string]*CostData, policy string) map[string]*CostData {
+	if policy == AllocationPolicyMax || costData == nil {
+		return costData
+	}
+
+	applied := make(map[string]*CostData, len(costData))
+	for key, cd := range costData {
+		newCd := *cd
+		cpu, ram := cd.CPUReq, cd.RAMReq
+		if policy == AllocationPolicyUsage {
+			cpu, ram = cd.CPUUsed, cd.RAMUsed
+		}
+		// pod overhead is allocated on top of either
+		if cpu != nil {
+			newCd.CPUAllocation = addVectors(policyAllocation(cpu), policyAllocation(cd.CPUOverhead), defaultTimestampBucket)
+		}
+		if ram != nil {
+			newCd.RAMAllocation = addVectors(policyAllocation(ram), policyAllocation(cd.RAMOverhead), defaultTimestampBucket)
+		}
+		applied[key] = &newCd
+	}
+	return applied
+}
+
+// policyAllocation copies the samples of the given request or usage vectors, omitting the zero vector by which
+// missing data is reported
+func policyAllocation(vectors []*Vector) []*Vector {
+	allocation := make([]*Vector, 0, len(vectors))
+	for _, val := range vectors {
+		if val.Timestamp == 0 {
+			continue
+		}
+		allocation = append(allocation, &Vector{
+			Timestamp: val.Timestamp,
+			Value:     val.Value,
+		})
+	}
+	return allocation
+}
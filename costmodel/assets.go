@@ -0,0 +1,133 @@
+package costmodel
+
+import (
+	"strconv"
+
+	costAnalyzerCloud "github.com/kubecost/cost-model/cloud"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog"
+)
+
+// NodeAsset is a node in the cluster along with its resolved hourly pricing
+type NodeAsset struct {
+	Name            string  `json:"name"`
+	InstanceType    string  `json:"instanceType"`
+	Region          string  `json:"region"`
+	NodePool        string  `json:"nodePool"`
+	Spot            bool    `json:"spot"`
+	PricingRate     string  `json:"pricingRate,omitempty"`
+	CPUCores        float64 `json:"cpuCores"`
+	RAMBytes        float64 `json:"ramBytes"`
+	GPUCount        float64 `json:"gpuCount"`
+	CPUHourlyCost   float64 `json:"cpuHourlyCost"`
+	RAMHourlyCost   float64 `json:"ramHourlyCost"`
+	GPUHourlyCost   float64 `json:"gpuHourlyCost"`
+	TotalHourlyCost float64 `json:"totalHourlyCost"`
+}
+
+// PVAsset is a persistent volume in the cluster along with its resolved hourly pricing
+type PVAsset struct {
+	Name            string  `json:"name"`
+	StorageClass    string  `json:"storageClass"`
+	Region          string  `json:"region"`
+	Bytes           float64 `json:"bytes"`
+	GBHourlyCost    float64 `json:"gbHourlyCost"`
+	TotalHourlyCost float64 `json:"totalHourlyCost"`
+}
+
+// Assets is the priced inventory of the nodes and persistent volumes currently in the cluster
+type Assets struct {
+	Nodes             []*NodeAsset `json:"nodes"`
+	PersistentVolumes []*PVAsset   `json:"persistentVolumes"`
+}
+
+// ComputeAssets lists every node and persistent volume in the cluster cache, priced by the given provider
+func (cm *CostModel) ComputeAssets(cp costAnalyzerCloud.Provider) (*Assets, error) {
+	nodeCosts, err := getNodeCost(cm.Cache, cp)
+	if err != nil {
+		return nil, err
+	}
+
+	assets := &Assets{
+		Nodes:             []*NodeAsset{},
+		PersistentVolumes: []*PVAsset{},
+	}
+
+	bytesPerGB := ramBytesPerGB(cp)
+	for _, n := range cm.Cache.GetAllNodes() {
+		node := &NodeAsset{
+			Name:         n.Name,
+			InstanceType: n.Labels[v1.LabelInstanceType],
+			Region:       n.Labels[v1.LabelZoneRegion],
+			NodePool:     costAnalyzerCloud.NodePool(n.Labels),
+			CPUCores:     float64(n.Status.Capacity.Cpu().Value()),
+			RAMBytes:     float64(n.Status.Capacity.Memory().Value()),
+		}
+
+		cnode, ok := nodeCosts[n.Name]
+		if !ok || cnode == nil {
+			klog.V(3).Infof("No pricing found for node %s", n.Name)
+			assets.Nodes = append(assets.Nodes, node)
+			continue
+		}
+
+		node.Spot = cnode.IsSpot()
+		node.PricingRate = cnode.PricingRate
+		if cpu, err := strconv.ParseFloat(cnode.VCPU, 64); err == nil {
+			node.CPUCores = cpu
+		}
+		node.GPUCount = parseAssetFloat(cnode.GPU)
+		node.CPUHourlyCost = parseAssetFloat(cnode.VCPUCost) * node.CPUCores
+		node.RAMHourlyCost = parseAssetFloat(cnode.RAMCost) * node.RAMBytes / bytesPerGB
+		node.GPUHourlyCost = parseAssetFloat(cnode.GPUCost) * node.GPUCount
+		node.TotalHourlyCost = node.CPUHourlyCost + node.RAMHourlyCost + node.GPUHourlyCost
+
+		assets.Nodes = append(assets.Nodes, node)
+	}
+
+	storageClassMap := getStorageClassParameters(cm.Cache)
+	for _, pv := range cm.Cache.GetAllPersistentVolumes() {
+		assets.PersistentVolumes = append(assets.PersistentVolumes, priceVolume(storageClassMap, cp, pv))
+	}
+
+	return assets, nil
+}
+
+// priceVolume resolves the hourly pricing of the given persistent volume, given the parameters of each storage class
+func priceVolume(storageClassMap map[string]map[string]string, cp costAnalyzerCloud.Provider, pv *v1.PersistentVolume) *PVAsset {
+	cacPv := &costAnalyzerCloud.PV{
+		Class:      pv.Spec.StorageClassName,
+		Region:     pv.Labels[v1.LabelZoneRegion],
+		Parameters: storageClassMap[pv.Spec.StorageClassName],
+	}
+	err := GetPVCost(cacPv, pv, cp)
+	if err != nil {
+		// GetPVCost falls back to the default storage price on error
+		klog.V(3).Infof("Error pricing pv %s, using default: %s", pv.Name, err.Error())
+	}
+
+	asset := &PVAsset{
+		Name:         pv.Name,
+		StorageClass: cacPv.Class,
+		Region:       cacPv.Region,
+		GBHourlyCost: parseAssetFloat(cacPv.Cost),
+	}
+	if storage, ok := pv.Spec.Capacity[v1.ResourceStorage]; ok {
+		asset.Bytes = float64(storage.Value())
+	}
+	asset.TotalHourlyCost = asset.GBHourlyCost * asset.Bytes / 1024 / 1024 / 1024
+	return asset
+}
+
+// parseAssetFloat parses a price or quantity from the provider, treating missing or malformed values as 0
+func parseAssetFloat(s string) float64 {
+	if s == "" {
+		return 0
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		klog.V(3).Infof("Could not parse %s as a float", s)
+		return 0
+	}
+	return f
+}
@@ -0,0 +1,80 @@
+package costmodel
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	"k8s.io/klog"
+)
+
+const (
+	apiAuthTokenEnvVar     = "API_AUTH_TOKEN"
+	apiAuthAllRoutesEnvVar = "API_AUTH_ALL_ROUTES"
+)
+
+// RequireBearerToken wraps the given handler so that it responds 401 Unauthorized to requests without the given
+// token in their "Authorization: Bearer" header. Without a token, auth is off and the handler is returned as is.
+func RequireBearerToken(token string, handle httprouter.Handle) httprouter.Handle {
+	if token == "" {
+		return handle
+	}
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		header := r.Header.Get("Authorization")
+		const prefix = "Bearer "
+		if len(header) < len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) ||
+			subtle.ConstantTimeCompare([]byte(strings.TrimSpace(header[len(prefix):])), []byte(token)) != 1 {
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+			w.Header().Set("WWW-Authenticate", `Bearer realm="cost-model"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write(wrapData(nil, NewCodedError(ErrorCodeUnauthorized, fmt.Errorf("Missing or invalid bearer token"))))
+			return
+		}
+		handle(w, r, ps)
+	}
+}
+
+// RequireBearerTokenWhen wraps the given handler so that it requires the given token, as RequireBearerToken does,
+// of the requests for which mutates is true, e.g. those of a reading route whose parameters flush a cache
+func RequireBearerTokenWhen(token string, mutates func(*http.Request) bool, handle httprouter.Handle) httprouter.Handle {
+	if token == "" {
+		return handle
+	}
+	required := RequireBearerToken(token, handle)
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		if mutates(r) {
+			required(w, r, ps)
+			return
+		}
+		handle(w, r, ps)
+	}
+}
+
+// apiAuthFromEnv returns wrappers of the handlers of routes which mutate state, of those which only read it, and
+// of those which mutate state only when mutates is true of the request. The bearer token in API_AUTH_TOKEN is
+// required by mutating routes and requests, and by reading routes too if API_AUTH_ALL_ROUTES is "true". With
+// API_AUTH_TOKEN unset, none requires auth.
+func apiAuthFromEnv() (mutating func(httprouter.Handle) httprouter.Handle, reading func(httprouter.Handle) httprouter.Handle, mutatingWhen func(func(*http.Request) bool, httprouter.Handle) httprouter.Handle) {
+	token := os.Getenv(apiAuthTokenEnvVar)
+	allRoutes := os.Getenv(apiAuthAllRoutesEnvVar) == "true"
+	if token == "" {
+		klog.V(1).Infof("%s is not set; the API does not require auth", apiAuthTokenEnvVar)
+	}
+	mutating = func(handle httprouter.Handle) httprouter.Handle {
+		return RequireBearerToken(token, handle)
+	}
+	reading = func(handle httprouter.Handle) httprouter.Handle {
+		if !allRoutes {
+			return handle
+		}
+		return RequireBearerToken(token, handle)
+	}
+	mutatingWhen = func(mutates func(*http.Request) bool, handle httprouter.Handle) httprouter.Handle {
+		return reading(RequireBearerTokenWhen(token, mutates, handle))
+	}
+	return mutating, reading, mutatingWhen
+}
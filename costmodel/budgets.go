@@ -0,0 +1,406 @@
+package costmodel
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	costAnalyzerCloud "github.com/kubecost/cost-model/cloud"
+	"k8s.io/klog"
+)
+
+const (
+	budgetEvaluationIntervalEnvVar  = "BUDGET_EVALUATION_INTERVAL"
+	budgetWebhookURLEnvVar          = "BUDGET_WEBHOOK_URL"
+	budgetAlertsFile                = "budget-alerts.json" // in the config directory
+	budgetWebhookTimeout            = 10 * time.Second
+	defaultBudgetEvaluationInterval = time.Hour
+)
+
+// BudgetStatus is the spend of a budget over its current period, as of its last evaluation. Budgets which haven't
+// been evaluated yet have no EvaluatedAt.
+type BudgetStatus struct {
+	Budget           *costAnalyzerCloud.Budget `json:"budget"`
+	PeriodStart      string                    `json:"periodStart,omitempty"`
+	PeriodEnd        string                    `json:"periodEnd,omitempty"`
+	Currency         string                    `json:"currency,omitempty"`
+	Spend            float64                   `json:"spend"`
+	SpendFraction    float64                   `json:"spendFraction"`
+	ProjectedSpend   float64                   `json:"projectedSpend"`             // at the end of the period, at the rate so far
+	AlertedThreshold float64                   `json:"alertedThreshold,omitempty"` // the highest threshold alerted in the period
+	EvaluatedAt      string                    `json:"evaluatedAt,omitempty"`
+	Error            string                    `json:"error,omitempty"`
+}
+
+// BudgetAlert is the body POSTed to the webhook of a budget in the generic format when its spend crosses a threshold
+type BudgetAlert struct {
+	Budget        *costAnalyzerCloud.Budget `json:"budget"`
+	Threshold     float64                   `json:"threshold"`
+	Currency      string                    `json:"currency"`
+	Spend         float64                   `json:"spend"`
+	SpendFraction float64                   `json:"spendFraction"`
+	PeriodStart   string                    `json:"periodStart"`
+	PeriodEnd     string                    `json:"periodEnd"`
+	FiredAt       string                    `json:"firedAt"`
+}
+
+// budgetState is the spend of a budget in its current period, in the base currency, until the end of its last
+// evaluation, and the highest threshold alerted in the period
+type budgetState struct {
+	PeriodStart string  `json:"periodStart"`
+	Threshold   float64 `json:"threshold"`
+	Spend       float64 `json:"spend,omitempty"`
+	SpentUntil  string  `json:"spentUntil,omitempty"`
+}
+
+// BudgetEvaluator evaluates the spend of the budgets of the config over their current period every Interval, and
+// alerts the webhook of a budget when its spend crosses one of its thresholds. Each threshold is alerted once per
+// period, unless the alert fails to be delivered, and if the spend crosses more than one threshold between
+// evaluations only the highest is alerted. Spend is the discounted cost allocated to the aggregation of a budget,
+// without idle costs, converted to the default currency. It is accumulated across evaluations, so that each only
+// computes the costs since the last. The spend and thresholds alerted are saved to StateFile, if set, so that
+// neither is lost on restart.
+type BudgetEvaluator struct {
+	Cloud      func() costAnalyzerCloud.Provider
+	Interval   time.Duration
+	WebhookURL string // alerted for the budgets without a webhook of their own, if set
+	StateFile  string
+
+	// CostData computes the cost data of each container from start until end in hourly windows
+	CostData func(start, end time.Time) (map[string]*CostData, error)
+
+	evaluateLock sync.Mutex
+	stateLock    sync.RWMutex
+	statuses     map[string]*BudgetStatus
+	states       map[string]*budgetState
+}
+
+// NewBudgetEvaluator returns an evaluator of the budgets of the config of the provider returned by cp every interval,
+// restoring the thresholds already alerted from stateFile, if set
+func NewBudgetEvaluator(cp func() costAnalyzerCloud.Provider, interval time.Duration, webhookURL string, stateFile string, costData func(start, end time.Time) (map[string]*CostData, error)) *BudgetEvaluator {
+	e := &BudgetEvaluator{
+		Cloud:      cp,
+		Interval:   interval,
+		WebhookURL: webhookURL,
+		StateFile:  stateFile,
+		CostData:   costData,
+		statuses:   make(map[string]*BudgetStatus),
+		states:     make(map[string]*budgetState),
+	}
+	if stateFile != "" {
+		if err := e.loadState(); err != nil && !os.IsNotExist(err) {
+			klog.V(1).Infof("Failed to load budget state from %s: %s", stateFile, err.Error())
+		}
+	}
+	return e
+}
+
+// BudgetPeriod returns the start and end of the period of the given window, BudgetMonthly or BudgetWeekly, at the
+// given time, in UTC
+func BudgetPeriod(window string, now time.Time) (time.Time, time.Time) {
+	now = now.UTC()
+	if window == costAnalyzerCloud.BudgetWeekly {
+		day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+		start := day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+		return start, start.AddDate(0, 0, 7)
+	}
+	start := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	return start, start.AddDate(0, 1, 0)
+}
+
+// Evaluate adds the spend of each budget since its last evaluation in its period, until the last whole hour before
+// now, and alerts those whose spend crossed a threshold not yet alerted in the period. Evaluations are serialized.
+func (e *BudgetEvaluator) Evaluate(now time.Time) error {
+	e.evaluateLock.Lock()
+	defer e.evaluateLock.Unlock()
+
+	cp := e.Cloud()
+	cfg, err := cp.GetConfig()
+	if err != nil {
+		return err
+	}
+	budgets, err := costAnalyzerCloud.Budgets(cfg)
+	if err != nil {
+		return err
+	}
+	currency := DefaultCurrency()
+	rate, err := CurrencyRate(cp, currency)
+	if err != nil {
+		return err
+	}
+	discount := configDiscount(cfg)
+	end := now.UTC().Truncate(time.Hour)
+
+	// the cost data since each time budgets were last evaluated until, and its aggregations by each field, are
+	// computed once for all those budgets
+	type sinceCosts struct {
+		data         map[string]*CostData
+		err          error
+		aggregations map[string]map[string]*Aggregation
+	}
+	costs := make(map[time.Time]*sinceCosts)
+	statuses := make(map[string]*BudgetStatus)
+	for _, b := range budgets {
+		start, periodEnd := BudgetPeriod(b.Window, end)
+		status := &BudgetStatus{
+			Budget:      b,
+			PeriodStart: start.Format(time.RFC3339),
+			PeriodEnd:   periodEnd.Format(time.RFC3339),
+			Currency:    currency,
+			EvaluatedAt: now.UTC().Format(time.RFC3339),
+		}
+		statuses[b.ID] = status
+
+		e.stateLock.Lock()
+		state, ok := e.states[b.ID]
+		if !ok || state.PeriodStart != status.PeriodStart {
+			state = &budgetState{PeriodStart: status.PeriodStart}
+			e.states[b.ID] = state
+		}
+		spend := state.Spend
+		since, err := time.Parse(time.RFC3339, state.SpentUntil)
+		e.stateLock.Unlock()
+		if err != nil || since.Before(start) {
+			since = start
+		}
+
+		// nothing has been spent since the last evaluation until another whole hour has passed
+		if end.After(since) {
+			sc, ok := costs[since]
+			if !ok {
+				sc = &sinceCosts{aggregations: make(map[string]map[string]*Aggregation)}
+				sc.data, sc.err = e.CostData(since, end)
+				costs[since] = sc
+			}
+			if sc.err != nil {
+				status.Error = sc.err.Error()
+				status.Spend = spend * rate
+				continue
+			}
+			aggKey := b.Field + "," + b.SubField
+			if _, ok := sc.aggregations[aggKey]; !ok {
+				sc.aggregations[aggKey] = AggregateCostModel(cp, sc.data, b.Field, b.SubField, false, discount, 1.0, nil)
+			}
+			if agg, ok := sc.aggregations[aggKey][b.Value]; ok {
+				spend += agg.TotalCost
+			}
+			e.stateLock.Lock()
+			state.Spend = spend
+			state.SpentUntil = end.Format(time.RFC3339)
+			e.stateLock.Unlock()
+		}
+
+		status.Spend = spend * rate
+		status.SpendFraction = status.Spend / b.Amount
+		if elapsed := end.Sub(start).Hours(); elapsed > 0 {
+			status.ProjectedSpend = status.Spend / elapsed * periodEnd.Sub(start).Hours()
+		}
+		e.alert(status, state)
+	}
+
+	e.stateLock.Lock()
+	e.statuses = statuses
+	for id := range e.states {
+		if _, ok := statuses[id]; !ok {
+			delete(e.states, id)
+		}
+	}
+	e.stateLock.Unlock()
+	if err := e.saveState(); err != nil {
+		klog.V(1).Infof("Failed to save budget state to %s: %s", e.StateFile, err.Error())
+	}
+	return nil
+}
+
+// alert alerts the webhook of the budget of the given status with the highest threshold its spend crossed, if that
+// is higher than any alerted in its period, recording it in the given state of the budget once delivered
+func (e *BudgetEvaluator) alert(status *BudgetStatus, state *budgetState) {
+	b := status.Budget
+	e.stateLock.RLock()
+	alerted := state.Threshold
+	e.stateLock.RUnlock()
+
+	threshold := 0.0
+	for _, t := range b.Thresholds {
+		if t > alerted && status.SpendFraction >= t {
+			threshold = t
+		}
+	}
+	if threshold == 0 {
+		status.AlertedThreshold = alerted
+		return
+	}
+
+	webhookURL := b.WebhookURL
+	if webhookURL == "" {
+		webhookURL = e.WebhookURL
+	}
+	if webhookURL == "" {
+		klog.V(2).Infof("Budget %s crossed %g of its amount, but no webhook is configured", b.ID, threshold)
+	} else if err := postBudgetAlert(webhookURL, b.WebhookFormat, &BudgetAlert{
+		Budget:        b,
+		Threshold:     threshold,
+		Currency:      status.Currency,
+		Spend:         status.Spend,
+		SpendFraction: status.SpendFraction,
+		PeriodStart:   status.PeriodStart,
+		PeriodEnd:     status.PeriodEnd,
+		FiredAt:       status.EvaluatedAt,
+	}); err != nil {
+		// the threshold is alerted again on the next evaluation
+		klog.V(1).Infof("Failed to alert budget %s: %s", b.ID, err.Error())
+		status.AlertedThreshold = alerted
+		return
+	}
+
+	e.stateLock.Lock()
+	state.Threshold = threshold
+	e.stateLock.Unlock()
+	status.AlertedThreshold = threshold
+}
+
+// postBudgetAlert POSTs the given alert to the given webhook, as a BudgetAlert or, in the BudgetWebhookSlack format,
+// as a Slack message
+func postBudgetAlert(webhookURL string, format string, alert *BudgetAlert) error {
+	var payload interface{} = alert
+	if format == costAnalyzerCloud.BudgetWebhookSlack {
+		b := alert.Budget
+		aggregation := b.Field
+		if b.SubField != "" {
+			aggregation += " " + b.SubField
+		}
+		payload = map[string]string{
+			"text": fmt.Sprintf("Budget alert: %s %s has spent %.2f of its %s budget of %.2f (%.0f%%) since %s",
+				aggregation, b.Value, alert.Spend, b.Window, b.Amount, alert.SpendFraction*100, alert.PeriodStart[:len("2006-01-02")]),
+		}
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: budgetWebhookTimeout}
+	resp, err := client.Post(webhookURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Statuses returns the status of each budget of the config, as of its last evaluation, in the order configured
+func (e *BudgetEvaluator) Statuses() ([]*BudgetStatus, error) {
+	cfg, err := e.Cloud().GetConfig()
+	if err != nil {
+		return nil, err
+	}
+	budgets, err := costAnalyzerCloud.Budgets(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	e.stateLock.RLock()
+	defer e.stateLock.RUnlock()
+	statuses := make([]*BudgetStatus, 0, len(budgets))
+	for _, b := range budgets {
+		status, ok := e.statuses[b.ID]
+		if !ok {
+			status = &BudgetStatus{Budget: b}
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// loadState restores the spend and thresholds alerted from StateFile
+func (e *BudgetEvaluator) loadState() error {
+	f, err := os.Open(e.StateFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	states := make(map[string]*budgetState)
+	if err := json.NewDecoder(f).Decode(&states); err != nil {
+		return err
+	}
+	e.stateLock.Lock()
+	e.states = states
+	e.stateLock.Unlock()
+	return nil
+}
+
+// saveState writes the spend and thresholds alerted to StateFile, if set, through a temporary file so that a crash mid-write
+// doesn't corrupt the previous state
+func (e *BudgetEvaluator) saveState() error {
+	if e.StateFile == "" {
+		return nil
+	}
+	e.stateLock.RLock()
+	body, err := json.Marshal(e.states)
+	e.stateLock.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	tmp := e.StateFile + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(body)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, e.StateFile)
+}
+
+// Run evaluates the budgets right away and then every Interval, until ctx is done, returning a channel closed once
+// it stops
+func (e *BudgetEvaluator) Run(ctx context.Context) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		delay := time.Duration(0)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+			if err := e.Evaluate(time.Now()); err != nil {
+				klog.V(1).Infof("Failed to evaluate budgets: %s", err.Error())
+			}
+			delay = e.Interval
+		}
+	}()
+	return done
+}
+
+// budgetEvaluatorFromEnv returns an evaluator of the budgets every BUDGET_EVALUATION_INTERVAL, hourly by default,
+// alerting BUDGET_WEBHOOK_URL, if set, for the budgets without a webhook of their own
+func budgetEvaluatorFromEnv(cp func() costAnalyzerCloud.Provider, stateFile string, costData func(start, end time.Time) (map[string]*CostData, error)) (*BudgetEvaluator, error) {
+	interval, err := durationFromEnv(budgetEvaluationIntervalEnvVar, defaultBudgetEvaluationInterval)
+	if err != nil {
+		return nil, err
+	}
+	webhookURL := os.Getenv(budgetWebhookURLEnvVar)
+	if webhookURL != "" {
+		u, err := url.Parse(webhookURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("Invalid %s '%s'; must be an http or https URL", budgetWebhookURLEnvVar, webhookURL)
+		}
+	}
+	return NewBudgetEvaluator(cp, interval, webhookURL, stateFile, costData), nil
+}
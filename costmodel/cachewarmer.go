@@ -0,0 +1,101 @@
+package costmodel
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"k8s.io/klog"
+)
+
+// cacheWarmWindowsEnvVar lists the windows, e.g. "1d,7d", of the aggregations to compute and cache on startup
+const cacheWarmWindowsEnvVar = "CACHE_WARM_WINDOWS"
+
+// cacheWarmWindows reads the windows of the aggregations to warm the cache with from CACHE_WARM_WINDOWS,
+// skipping those that aren't valid windows
+func cacheWarmWindows() []string {
+	windows := []string{}
+	for _, window := range strings.Split(os.Getenv(cacheWarmWindowsEnvVar), ",") {
+		if window = strings.TrimSpace(window); window == "" {
+			continue
+		}
+		normalized, err := normalizeTimeParam(window)
+		if err == nil {
+			_, err = time.ParseDuration(normalized)
+		}
+		if err != nil {
+			klog.V(1).Infof("Not warming the cache for invalid window '%s' of %s", window, cacheWarmWindowsEnvVar)
+			continue
+		}
+		windows = append(windows, window)
+	}
+	return windows
+}
+
+// WarmCache waits for the given refresher to first download pricing data, then computes and caches the
+// aggregation by namespace of each of the given windows in turn, as requested of AggregateCostModel without
+// other parameters, so that the first such requests after a restart hit the cache. It returns a channel closed
+// once warming completes.
+func (a *Accesses) WarmCache(refresher *PricingRefresher, windows []string) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		<-refresher.Downloaded()
+		for _, window := range windows {
+			start := time.Now()
+			if err := a.warmAggregation(window); err != nil {
+				klog.V(1).Infof("Failed to warm the cache for window %s: %s", window, err.Error())
+				continue
+			}
+			klog.V(2).Infof("Warmed the cache for window %s in %s", window, time.Since(start))
+		}
+	}()
+	return done
+}
+
+// warmAggregation requests the aggregation by namespace of the given window of AggregateCostModel, which caches
+// it under the same key as requests from clients
+func (a *Accesses) warmAggregation(window string) error {
+	query := url.Values{}
+	query.Set("window", window)
+	query.Set("aggregation", "namespace")
+	r, err := http.NewRequest("GET", "/aggregatedCostModel?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	w := &bufferedResponseWriter{header: make(http.Header), status: http.StatusOK}
+	a.AggregateCostModel(w, r, nil)
+
+	envelope := &DataEnvelope{}
+	if err := json.Unmarshal(w.body.Bytes(), envelope); err != nil {
+		return err
+	}
+	if w.status != http.StatusOK || envelope.Code != http.StatusOK {
+		return fmt.Errorf("%s", envelope.Message)
+	}
+	return nil
+}
+
+// bufferedResponseWriter captures the response of a handler invoked internally
+type bufferedResponseWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *bufferedResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *bufferedResponseWriter) Write(b []byte) (int, error) {
+	return w.body.Write(b)
+}
+
+func (w *bufferedResponseWriter) WriteHeader(status int) {
+	w.status = status
+}
@@ -0,0 +1,132 @@
+package costmodel
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Cost categories, by which aggregations may be restricted to a subset of their costs
+const (
+	CostCategoryCPU     = "cpu"
+	CostCategoryRAM     = "ram"
+	CostCategoryGPU     = "gpu"
+	CostCategoryPV      = "pv"
+	CostCategoryNetwork = "network" // network egress and load balancers
+	CostCategoryShared  = "shared"  // shared resources and the cluster management fee
+)
+
+var costCategories = []string{CostCategoryCPU, CostCategoryRAM, CostCategoryGPU, CostCategoryPV, CostCategoryNetwork, CostCategoryShared}
+
+// CostCategories is a set of cost categories. The empty set includes every category.
+type CostCategories map[string]bool
+
+// ParseCostCategories parses a comma-separated list of cost categories, returning an error if any is not a
+// known category
+func ParseCostCategories(s string) (CostCategories, error) {
+	categories := CostCategories{}
+	for _, category := range strings.Split(s, ",") {
+		category = strings.ToLower(strings.TrimSpace(category))
+		if category == "" {
+			continue
+		}
+		known := false
+		for _, c := range costCategories {
+			if c == category {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return nil, fmt.Errorf("Invalid cost category '%s'; must be one of %s", category, strings.Join(costCategories, ", "))
+		}
+		categories[category] = true
+	}
+	return categories, nil
+}
+
+// Includes reports whether the given category is one of the categories
+func (c CostCategories) Includes(category string) bool {
+	return len(c) == 0 || c[category]
+}
+
+// String returns the categories as a sorted, comma-separated list, which is empty when every category is included
+func (c CostCategories) String() string {
+	categories := make([]string, 0, len(c))
+	for category := range c {
+		categories = append(categories, category)
+	}
+	sort.Strings(categories)
+	return strings.Join(categories, ",")
+}
+
+// FilterCostCategories returns the given cost data without the allocations of the resources of the categories
+// not included, so that they are not priced when aggregated. The original cost data is not modified.
+func FilterCostCategories(costData map[string]*CostData, categories CostCategories) map[string]*CostData {
+	if len(categories) == 0 {
+		return costData
+	}
+
+	filtered := make(map[string]*CostData, len(costData))
+	for key, cd := range costData {
+		newCd := *cd
+		if !categories.Includes(CostCategoryCPU) {
+			newCd.CPUAllocation = nil
+		}
+		if !categories.Includes(CostCategoryRAM) {
+			newCd.RAMAllocation = nil
+		}
+		if !categories.Includes(CostCategoryGPU) {
+			newCd.GPUReq = nil
+		}
+		if !categories.Includes(CostCategoryPV) {
+			newCd.PVCData = nil
+		}
+		if !categories.Includes(CostCategoryNetwork) {
+			newCd.NetworkData = nil
+		}
+		filtered[key] = &newCd
+	}
+	return filtered
+}
+
+// ApplyCostCategories removes the costs of the categories not included from the given aggregations, and from
+// their total costs
+func ApplyCostCategories(aggregations map[string]*Aggregation, categories CostCategories) {
+	if len(categories) == 0 {
+		return
+	}
+
+	for _, agg := range aggregations {
+		if !categories.Includes(CostCategoryCPU) {
+			agg.TotalCost -= agg.CPUCost
+			agg.CPUCost = 0
+			agg.CPUCostVector = nil
+		}
+		if !categories.Includes(CostCategoryRAM) {
+			agg.TotalCost -= agg.RAMCost
+			agg.RAMCost = 0
+			agg.RAMCostVector = nil
+		}
+		if !categories.Includes(CostCategoryGPU) {
+			agg.TotalCost -= agg.GPUCost
+			agg.GPUCost = 0
+			agg.GPUCostVector = nil
+		}
+		if !categories.Includes(CostCategoryPV) {
+			agg.TotalCost -= agg.PVCost
+			agg.PVCost = 0
+			agg.PVCostVector = nil
+		}
+		if !categories.Includes(CostCategoryNetwork) {
+			agg.TotalCost -= agg.NetworkCost + agg.LBCost
+			agg.NetworkCost = 0
+			agg.LBCost = 0
+			agg.NetworkCostVector = nil
+		}
+		if !categories.Includes(CostCategoryShared) {
+			agg.TotalCost -= agg.SharedCost
+			agg.SharedCost = 0
+		}
+	}
+}
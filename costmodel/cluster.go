@@ -2,6 +2,7 @@ package costmodel
 
 import (
 	"fmt"
+	"strconv"
 	"time"
 
 	costAnalyzerCloud "github.com/kubecost/cost-model/cloud"
@@ -17,7 +18,7 @@ const (
 	  )`
 
 	queryClusterRAM = `sum(
-		avg(kube_node_status_capacity_memory_bytes %s) by (node) / 1024 / 1024 / 1024 * avg(node_ram_hourly_cost %s) by (node) * 730
+		avg(kube_node_status_capacity_memory_bytes %s) by (node) / %f * avg(node_ram_hourly_cost %s) by (node) * 730
 	  )`
 
 	queryStorage = `sum(
@@ -32,11 +33,98 @@ const (
 	  ) %s`
 )
 
+// defaultClusterManagementFees are the hourly per-cluster fees charged by managed kubernetes offerings,
+// keyed by the provider reported in ClusterInfo
+var defaultClusterManagementFees = map[string]float64{
+	"GCP": 0.10,
+	"AWS": 0.10,
+}
+
 type Totals struct {
-	TotalCost   [][]string `json:"totalcost"`
-	CPUCost     [][]string `json:"cpucost"`
-	MemCost     [][]string `json:"memcost"`
-	StorageCost [][]string `json:"storageCost"`
+	TotalCost      [][]string `json:"totalcost"`
+	CPUCost        [][]string `json:"cpucost"`
+	MemCost        [][]string `json:"memcost"`
+	StorageCost    [][]string `json:"storageCost"`
+	ManagementCost [][]string `json:"managementCost"`
+
+	// UnmountedPVCost is the part of StorageCost spent on persistent volumes not mounted by any pod
+	UnmountedPVCost [][]string `json:"unmountedPVCost,omitempty"`
+}
+
+// AddUnmountedPVCost sets the unmounted persistent volume cost of the totals, at each timestamp of the total
+// cost, to the given hourly cost as a monthly rate like the other line items. It is already part of the
+// storage and total cost.
+func AddUnmountedPVCost(totals *Totals, hourlyCost float64) {
+	totals.UnmountedPVCost = [][]string{}
+	for _, dataPoint := range totals.TotalCost {
+		totals.UnmountedPVCost = append(totals.UnmountedPVCost, []string{dataPoint[0], fmt.Sprintf("%f", hourlyCost*730)})
+	}
+}
+
+// ramBytesPerGB returns the number of bytes in a GB of RAM as priced by the given provider, defaulting to
+// binary GB when its config cannot be loaded
+func ramBytesPerGB(cp costAnalyzerCloud.Provider) float64 {
+	c, err := cp.GetConfig()
+	if err != nil {
+		klog.V(1).Infof("Failed to load config, pricing RAM by binary GB: %s", err.Error())
+		return costAnalyzerCloud.RAMBytesPerGB(nil)
+	}
+	return costAnalyzerCloud.RAMBytesPerGB(c)
+}
+
+// ClusterManagementFee returns the hourly management fee of the cluster. The fee set in the pricing
+// config takes precedence; otherwise it defaults by provider, where AWS clusters are only charged
+// when they are run by EKS.
+func ClusterManagementFee(cp costAnalyzerCloud.Provider) (float64, error) {
+	c, err := cp.GetConfig()
+	if err != nil {
+		return 0.0, err
+	}
+	if c.ClusterManagementFee != "" {
+		fee, err := strconv.ParseFloat(c.ClusterManagementFee, 64)
+		if err != nil {
+			return 0.0, fmt.Errorf("Invalid clusterManagementFee '%s': %s", c.ClusterManagementFee, err)
+		}
+		return fee, nil
+	}
+
+	info, err := cp.ClusterInfo()
+	if err != nil {
+		return 0.0, err
+	}
+	provider := info["provider"]
+	if provider == "AWS" {
+		platform, err := cp.GetManagementPlatform()
+		if err != nil {
+			return 0.0, err
+		}
+		if platform != "eks" {
+			return 0.0, nil
+		}
+	}
+	return defaultClusterManagementFees[provider], nil
+}
+
+// ClusterManagementFeeOverWindow prorates the hourly management fee over the given window, which may
+// be shorter than an hour
+func ClusterManagementFeeOverWindow(fee float64, window time.Duration) float64 {
+	return fee * window.Hours()
+}
+
+// addManagementCost sets the management cost of the totals at each timestamp of the total cost, as a
+// monthly rate like the other line items, and adds it to the total cost
+func addManagementCost(totals *Totals, fee float64) error {
+	monthly := fee * 730
+	totals.ManagementCost = [][]string{}
+	for _, dataPoint := range totals.TotalCost {
+		total, err := strconv.ParseFloat(dataPoint[1], 64)
+		if err != nil {
+			return err
+		}
+		dataPoint[1] = fmt.Sprintf("%f", total+monthly)
+		totals.ManagementCost = append(totals.ManagementCost, []string{dataPoint[0], fmt.Sprintf("%f", monthly)})
+	}
+	return nil
 }
 
 func resultToTotals(qr interface{}) ([][]string, error) {
@@ -129,7 +217,7 @@ func ClusterCosts(cli prometheusClient.Client, cloud costAnalyzerCloud.Provider,
 	}
 
 	qCores := fmt.Sprintf(queryClusterCores, offset, offset, offset)
-	qRAM := fmt.Sprintf(queryClusterRAM, offset, offset)
+	qRAM := fmt.Sprintf(queryClusterRAM, offset, ramBytesPerGB(cloud), offset)
 	qStorage := fmt.Sprintf(queryStorage, windowString, offset, windowString, offset, localStorageQuery)
 	qTotal := fmt.Sprintf(queryTotal, localStorageQuery)
 
@@ -172,12 +260,24 @@ func ClusterCosts(cli prometheusClient.Client, cloud costAnalyzerCloud.Provider,
 		return nil, err
 	}
 
-	return &Totals{
+	// an unknown management fee omits it, rather than failing the cluster costs
+	managementFee, err := ClusterManagementFee(cloud)
+	if err != nil {
+		klog.V(1).Infof("Unable to determine the cluster management fee, omitting it: %s", err.Error())
+		managementFee = 0.0
+	}
+
+	totals := &Totals{
 		TotalCost:   clusterTotal,
 		CPUCost:     coreTotal,
 		MemCost:     ramTotal,
 		StorageCost: storageTotal,
-	}, nil
+	}
+	err = addManagementCost(totals, managementFee)
+	if err != nil {
+		return nil, err
+	}
+	return totals, nil
 
 }
 
@@ -211,7 +311,7 @@ func ClusterCostsOverTime(cli prometheusClient.Client, cloud costAnalyzerCloud.P
 	}
 
 	qCores := fmt.Sprintf(queryClusterCores, offset, offset, offset)
-	qRAM := fmt.Sprintf(queryClusterRAM, offset, offset)
+	qRAM := fmt.Sprintf(queryClusterRAM, offset, ramBytesPerGB(cloud), offset)
 	qStorage := fmt.Sprintf(queryStorage, windowString, offset, windowString, offset, localStorageQuery)
 	qTotal := fmt.Sprintf(queryTotal, localStorageQuery)
 
@@ -254,11 +354,23 @@ func ClusterCostsOverTime(cli prometheusClient.Client, cloud costAnalyzerCloud.P
 		return nil, err
 	}
 
-	return &Totals{
+	// an unknown management fee omits it, rather than failing the cluster costs
+	managementFee, err := ClusterManagementFee(cloud)
+	if err != nil {
+		klog.V(1).Infof("Unable to determine the cluster management fee, omitting it: %s", err.Error())
+		managementFee = 0.0
+	}
+
+	totals := &Totals{
 		TotalCost:   clusterTotal,
 		CPUCost:     coreTotal,
 		MemCost:     ramTotal,
 		StorageCost: storageTotal,
-	}, nil
+	}
+	err = addManagementCost(totals, managementFee)
+	if err != nil {
+		return nil, err
+	}
+	return totals, nil
 
 }
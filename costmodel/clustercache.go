@@ -4,6 +4,7 @@ import (
 	"sync"
 
 	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
 	v1 "k8s.io/api/core/v1"
 	stv1 "k8s.io/api/storage/v1"
 	"k8s.io/apimachinery/pkg/fields"
@@ -31,6 +32,9 @@ type ClusterCache interface {
 	// GetAllDeployments returns all the cached deployments
 	GetAllDeployments() []*appsv1.Deployment
 
+	// GetAllJobs returns all the cached jobs
+	GetAllJobs() []*batchv1.Job
+
 	// GetAllPersistentVolumes returns all the cached persistent volumes
 	GetAllPersistentVolumes() []*v1.PersistentVolume
 
@@ -47,6 +51,7 @@ type KubernetesClusterCache struct {
 	podWatch          WatchController
 	serviceWatch      WatchController
 	deploymentsWatch  WatchController
+	jobsWatch         WatchController
 	pvWatch           WatchController
 	storageClassWatch WatchController
 }
@@ -59,6 +64,7 @@ func initializeCache(wc WatchController, wg *sync.WaitGroup, cancel chan struct{
 func NewKubernetesClusterCache(client kubernetes.Interface) ClusterCache {
 	coreRestClient := client.CoreV1().RESTClient()
 	appsRestClient := client.AppsV1().RESTClient()
+	batchRestClient := client.BatchV1().RESTClient()
 	storageRestClient := client.StorageV1().RESTClient()
 
 	kcc := &KubernetesClusterCache{
@@ -68,13 +74,14 @@ func NewKubernetesClusterCache(client kubernetes.Interface) ClusterCache {
 		podWatch:          NewCachingWatcher(coreRestClient, "pods", &v1.Pod{}, "", fields.Everything()),
 		serviceWatch:      NewCachingWatcher(coreRestClient, "services", &v1.Service{}, "", fields.Everything()),
 		deploymentsWatch:  NewCachingWatcher(appsRestClient, "deployments", &appsv1.Deployment{}, "", fields.Everything()),
+		jobsWatch:         NewCachingWatcher(batchRestClient, "jobs", &batchv1.Job{}, "", fields.Everything()),
 		pvWatch:           NewCachingWatcher(coreRestClient, "persistentvolumes", &v1.PersistentVolume{}, "", fields.Everything()),
 		storageClassWatch: NewCachingWatcher(storageRestClient, "storageclasses", &stv1.StorageClass{}, "", fields.Everything()),
 	}
 
 	// Wait for each caching watcher to initialize
 	var wg sync.WaitGroup
-	wg.Add(7)
+	wg.Add(8)
 
 	cancel := make(chan struct{})
 
@@ -83,6 +90,7 @@ func NewKubernetesClusterCache(client kubernetes.Interface) ClusterCache {
 	go initializeCache(kcc.podWatch, &wg, cancel)
 	go initializeCache(kcc.serviceWatch, &wg, cancel)
 	go initializeCache(kcc.deploymentsWatch, &wg, cancel)
+	go initializeCache(kcc.jobsWatch, &wg, cancel)
 	go initializeCache(kcc.pvWatch, &wg, cancel)
 	go initializeCache(kcc.storageClassWatch, &wg, cancel)
 
@@ -97,6 +105,7 @@ func (kcc *KubernetesClusterCache) Run(stopCh chan struct{}) {
 	go kcc.podWatch.Run(1, stopCh)
 	go kcc.serviceWatch.Run(1, stopCh)
 	go kcc.deploymentsWatch.Run(1, stopCh)
+	go kcc.jobsWatch.Run(1, stopCh)
 	go kcc.pvWatch.Run(1, stopCh)
 	go kcc.storageClassWatch.Run(1, stopCh)
 }
@@ -146,6 +155,15 @@ func (kcc *KubernetesClusterCache) GetAllDeployments() []*appsv1.Deployment {
 	return deployments
 }
 
+func (kcc *KubernetesClusterCache) GetAllJobs() []*batchv1.Job {
+	var jobs []*batchv1.Job
+	items := kcc.jobsWatch.GetAll()
+	for _, job := range items {
+		jobs = append(jobs, job.(*batchv1.Job))
+	}
+	return jobs
+}
+
 func (kcc *KubernetesClusterCache) GetAllPersistentVolumes() []*v1.PersistentVolume {
 	var pvs []*v1.PersistentVolume
 	items := kcc.pvWatch.GetAll()
@@ -163,3 +181,17 @@ func (kcc *KubernetesClusterCache) GetAllStorageClasses() []*stv1.StorageClass {
 	}
 	return storageClasses
 }
+
+// emptyClusterCache caches nothing, for the models of clusters other than the local one, whose pods, nodes and
+// volumes are then read from their prometheus alone
+type emptyClusterCache struct{}
+
+func (emptyClusterCache) Run(stopCh chan struct{})                        {}
+func (emptyClusterCache) GetAllNamespaces() []*v1.Namespace               { return nil }
+func (emptyClusterCache) GetAllNodes() []*v1.Node                         { return nil }
+func (emptyClusterCache) GetAllPods() []*v1.Pod                           { return nil }
+func (emptyClusterCache) GetAllServices() []*v1.Service                   { return nil }
+func (emptyClusterCache) GetAllDeployments() []*appsv1.Deployment         { return nil }
+func (emptyClusterCache) GetAllJobs() []*batchv1.Job                      { return nil }
+func (emptyClusterCache) GetAllPersistentVolumes() []*v1.PersistentVolume { return nil }
+func (emptyClusterCache) GetAllStorageClasses() []*stv1.StorageClass      { return nil }
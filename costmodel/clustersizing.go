@@ -0,0 +1,430 @@
+package costmodel
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/kubecost/cost-model/cloud"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/klog"
+)
+
+// defaultMaxPods is the number of pods the kubelet allows on a node by default, which candidate node types, having
+// no node to read it from, are assumed to allow
+const defaultMaxPods = 110
+
+// labelInstanceTypeStable is the instance type label which newer kubelets set alongside v1.LabelInstanceType
+const labelInstanceTypeStable = "node.kubernetes.io/instance-type"
+
+// nodeInstanceType returns the instance type of a node with the given labels, by either instance type label
+func nodeInstanceType(labels map[string]string) string {
+	if instanceType := labels[v1.LabelInstanceType]; instanceType != "" {
+		return instanceType
+	}
+	return labels[labelInstanceTypeStable]
+}
+
+const (
+	// ClusterSizingNoInstanceType is the status of nodes without an instance type label, which are kept as they
+	// are rather than recommended
+	ClusterSizingNoInstanceType = "no instance type"
+	// ClusterSizingNotPriced is the status of node types the provider has no price for
+	ClusterSizingNotPriced = "not priced"
+	// ClusterSizingUnknownCapacity is the status of candidate node types whose CPU or RAM the provider doesn't list
+	ClusterSizingUnknownCapacity = "unknown capacity"
+	// ClusterSizingTooSmall is the status of node types which can't fit the largest pod
+	ClusterSizingTooSmall = "too small for the largest pod"
+)
+
+// ResourceDemand is the peak and 95th percentile of the aggregate demand for a resource over a window
+type ResourceDemand struct {
+	Peak float64 `json:"peak"`
+	P95  float64 `json:"p95"`
+}
+
+// SizingNodeType is a node type considered by ComputeClusterSizing, with the capacity of a node of the type, and its
+// Status if it can't be recommended
+type SizingNodeType struct {
+	InstanceType string  `json:"instanceType"`
+	CPUCores     float64 `json:"cpuCores"` // allocatable
+	RAMBytes     float64 `json:"ramBytes"` // allocatable
+	Pods         int     `json:"pods"`     // allocatable
+	HourlyCost   float64 `json:"hourlyCost"`
+	Current      bool    `json:"current"` // whether any cached node is of the type
+	Status       string  `json:"status,omitempty"`
+}
+
+// NodeTypeCount is a number of nodes of a type
+type NodeTypeCount struct {
+	InstanceType string  `json:"instanceType"`
+	Count        int     `json:"count"`
+	HourlyCost   float64 `json:"hourlyCost"` // of each node
+}
+
+// ClusterSizing compares the allocatable capacity of the nodes of a cluster with the aggregate requests and usage of
+// its containers over a window, and recommends the cheapest nodes which fit the greater of peak requests and 95th
+// percentile usage, plus headroom, along with the monthly savings of replacing the current nodes with them. Nodes
+// without an instance type are kept as they are, so their capacity counts towards the demand.
+type ClusterSizing struct {
+	Nodes                  int               `json:"nodes"`
+	CPUAllocatable         float64           `json:"cpuAllocatable"` // cores
+	RAMAllocatable         float64           `json:"ramAllocatable"` // bytes
+	PodAllocatable         int               `json:"podAllocatable"`
+	Pods                   int               `json:"pods"`
+	CPURequests            ResourceDemand    `json:"cpuRequests"` // cores
+	CPUUsage               ResourceDemand    `json:"cpuUsage"`    // cores
+	RAMRequests            ResourceDemand    `json:"ramRequests"` // bytes
+	RAMUsage               ResourceDemand    `json:"ramUsage"`    // bytes
+	Headroom               float64           `json:"headroom"`
+	CPURequired            float64           `json:"cpuRequired"` // cores
+	RAMRequired            float64           `json:"ramRequired"` // bytes
+	PodsRequired           int               `json:"podsRequired"`
+	LargestPodCPU          float64           `json:"largestPodCpu"` // cores
+	LargestPodRAM          float64           `json:"largestPodRam"` // bytes
+	NodeTypes              []*SizingNodeType `json:"nodeTypes"`
+	CurrentMonthlyCost     float64           `json:"currentMonthlyCost"`
+	Recommendation         []*NodeTypeCount  `json:"recommendation"`
+	RecommendedMonthlyCost float64           `json:"recommendedMonthlyCost"`
+	MonthlySavings         float64           `json:"monthlySavings"`
+}
+
+// aggregateDemand returns the peak and 95th percentile of the sum, at each timestamp, of the given vectors of each
+// of the containers of the given cost data, skipping init containers, which don't run for long
+func aggregateDemand(costData map[string]*CostData, vectors func(*CostData) []*Vector) ResourceDemand {
+	totals := make(map[float64]float64)
+	for _, costDatum := range costData {
+		if costDatum.IsInitContainer {
+			continue
+		}
+		for _, v := range vectors(costDatum) {
+			totals[v.Timestamp] += v.Value
+		}
+	}
+
+	summed := make([]*Vector, 0, len(totals))
+	demand := ResourceDemand{}
+	for timestamp, value := range totals {
+		summed = append(summed, &Vector{Timestamp: timestamp, Value: value})
+		demand.Peak = math.Max(demand.Peak, value)
+	}
+	demand.P95 = VectorQuantile(summed, 0.95)
+	return demand
+}
+
+// nodeAllocatable returns the allocatable CPU, in cores, RAM, in bytes, and pods of the given node, falling back to
+// its capacity, or for pods the kubelet's default, for nodes which don't report them
+func nodeAllocatable(node *v1.Node) (float64, float64, int) {
+	quantity := func(name v1.ResourceName) (resource.Quantity, bool) {
+		if q, ok := node.Status.Allocatable[name]; ok {
+			return q, true
+		}
+		q, ok := node.Status.Capacity[name]
+		return q, ok
+	}
+
+	cpu, _ := quantity(v1.ResourceCPU)
+	ram, _ := quantity(v1.ResourceMemory)
+	pods := defaultMaxPods
+	if q, ok := quantity(v1.ResourcePods); ok {
+		pods = int(q.Value())
+	}
+	return float64(cpu.MilliValue()) / 1000, float64(ram.Value()), pods
+}
+
+// nodeHourlyCost returns the hourly price of the given priced node with the given cores and bytes of RAM, by its
+// resources, or its total price if its resources aren't priced
+func nodeHourlyCost(cnode *cloud.Node, cpu, ram, bytesPerGB float64) float64 {
+	if cnode == nil {
+		return 0
+	}
+	cost := parseAssetFloat(cnode.VCPUCost)*cpu +
+		parseAssetFloat(cnode.RAMCost)*ram/bytesPerGB +
+		parseAssetFloat(cnode.GPUCost)*parseAssetFloat(cnode.GPU)
+	if cost == 0 {
+		cost = parseAssetFloat(cnode.Cost)
+	}
+	return cost
+}
+
+// candidateRAMBytes returns the RAM of the given node priced by the provider, in bytes, from its RAMBytes or its RAM,
+// e.g. "3.75 GiB", or 0 if it has neither
+func candidateRAMBytes(cnode *cloud.Node) float64 {
+	if bytes := parseAssetFloat(cnode.RAMBytes); bytes > 0 {
+		return bytes
+	}
+	ram := strings.TrimSuffix(strings.Replace(cnode.RAM, " ", "", -1), "B")
+	q, err := resource.ParseQuantity(ram)
+	if err != nil {
+		return 0
+	}
+	return float64(q.Value())
+}
+
+// kubeReserved estimates the CPU, in cores, and RAM, in bytes, the kubelet reserves on a node of the given
+// capacity, by the tiers GKE reserves by, which other providers reserve similarly to: 6% of the first core, 1% of
+// the next, 0.5% of the next two and 0.25% of the rest, and 25% of the first 4GiB of RAM, 20% of the next 4GiB,
+// 10% of the next 8GiB, 6% of the next 112GiB and 2% of the rest, plus 100MiB for eviction.
+func kubeReserved(cpu, ram float64) (float64, float64) {
+	tiered := func(amount float64, tiers [][2]float64) float64 {
+		reserved := 0.0
+		for _, tier := range tiers {
+			size, rate := tier[0], tier[1]
+			reserved += math.Min(amount, size) * rate
+			amount -= size
+			if amount <= 0 {
+				break
+			}
+		}
+		return reserved
+	}
+	gib := float64(1 << 30)
+	reservedCPU := tiered(cpu, [][2]float64{{1, 0.06}, {1, 0.01}, {2, 0.005}, {math.Inf(1), 0.0025}})
+	reservedRAM := tiered(ram, [][2]float64{{4 * gib, 0.25}, {4 * gib, 0.2}, {8 * gib, 0.1}, {112 * gib, 0.06}, {math.Inf(1), 0.02}})
+	return reservedCPU, reservedRAM + 100*(1<<20)
+}
+
+// priceCandidateType prices a node of the given instance type, labeled like the given node, by the same pricing
+// data the provider lists in AllNodePricing. Since the provider only lists the capacity of such a node, its
+// allocatable CPU and RAM are estimated by kubeReserved, to compare with the allocatable resources of the current
+// nodes, and its pods are the kubelet's default.
+func priceCandidateType(cp cloud.Provider, template map[string]string, instanceType string, bytesPerGB float64) *SizingNodeType {
+	labels := make(map[string]string, len(template)+2)
+	for k, v := range template {
+		if k != "providerID" {
+			labels[k] = v
+		}
+	}
+	labels[v1.LabelInstanceType] = instanceType
+	labels[labelInstanceTypeStable] = instanceType
+
+	nodeType := &SizingNodeType{
+		InstanceType: instanceType,
+		Pods:         defaultMaxPods,
+	}
+	cnode, err := cp.NodePricing(cp.GetKey(labels))
+	if err != nil || cnode == nil {
+		klog.V(3).Infof("No pricing found for candidate node type %s: %v", instanceType, err)
+		nodeType.Status = ClusterSizingNotPriced
+		return nodeType
+	}
+	nodeType.CPUCores = parseAssetFloat(cnode.VCPU)
+	nodeType.RAMBytes = candidateRAMBytes(cnode)
+	if nodeType.CPUCores <= 0 || nodeType.RAMBytes <= 0 {
+		nodeType.Status = ClusterSizingUnknownCapacity
+		return nodeType
+	}
+	// nodes are priced by their capacity
+	nodeType.HourlyCost = nodeHourlyCost(cnode, nodeType.CPUCores, nodeType.RAMBytes, bytesPerGB)
+	reservedCPU, reservedRAM := kubeReserved(nodeType.CPUCores, nodeType.RAMBytes)
+	nodeType.CPUCores -= reservedCPU
+	nodeType.RAMBytes -= reservedRAM
+	if nodeType.HourlyCost <= 0 {
+		nodeType.Status = ClusterSizingNotPriced
+	}
+	return nodeType
+}
+
+// nodesOfType returns how many nodes of the given type fit the given CPU, RAM and pods, and at least one
+func nodesOfType(nodeType *SizingNodeType, cpu, ram float64, pods int) int {
+	count := 1
+	count = maxInt(count, int(math.Ceil(cpu/nodeType.CPUCores)))
+	count = maxInt(count, int(math.Ceil(ram/nodeType.RAMBytes)))
+	count = maxInt(count, int(math.Ceil(float64(pods)/float64(nodeType.Pods))))
+	return count
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// recommendNodes returns the cheapest nodes which fit the given CPU, RAM and pods, either all of one of the given
+// node types, or all but one of them with the last replaced by a cheaper node of another type which fits the
+// remainder. Only types which fit the largest pod are used for the bulk of the nodes, so it can be scheduled.
+func recommendNodes(nodeTypes []*SizingNodeType, cpu, ram float64, pods int) ([]*NodeTypeCount, float64) {
+	var best []*NodeTypeCount
+	bestCost := math.Inf(1)
+	consider := func(counts []*NodeTypeCount) {
+		cost := 0.0
+		for _, c := range counts {
+			cost += float64(c.Count) * c.HourlyCost
+		}
+		if cost < bestCost {
+			best, bestCost = counts, cost
+		}
+	}
+
+	for _, bulk := range nodeTypes {
+		if bulk.Status != "" {
+			continue
+		}
+		count := nodesOfType(bulk, cpu, ram, pods)
+		consider([]*NodeTypeCount{{InstanceType: bulk.InstanceType, Count: count, HourlyCost: bulk.HourlyCost}})
+		if count == 1 {
+			continue
+		}
+
+		remainingCPU := cpu - float64(count-1)*bulk.CPUCores
+		remainingRAM := ram - float64(count-1)*bulk.RAMBytes
+		remainingPods := pods - (count-1)*bulk.Pods
+		for _, last := range nodeTypes {
+			// the last node needn't fit the largest pod, which fits on the others
+			if last == bulk || (last.Status != "" && last.Status != ClusterSizingTooSmall) {
+				continue
+			}
+			if nodesOfType(last, remainingCPU, remainingRAM, remainingPods) > 1 {
+				continue
+			}
+			consider([]*NodeTypeCount{
+				{InstanceType: bulk.InstanceType, Count: count - 1, HourlyCost: bulk.HourlyCost},
+				{InstanceType: last.InstanceType, Count: 1, HourlyCost: last.HourlyCost},
+			})
+		}
+	}
+	return best, bestCost
+}
+
+// ComputeClusterSizing compares the allocatable capacity of the cached nodes with the aggregate requests and usage
+// of the containers of the given cost data, and recommends the cheapest nodes, of the instance types of the cached
+// nodes or of the given candidate types, which fit the greater of peak requests and 95th percentile usage, the pods
+// which haven't terminated and the largest of them, all with the given fraction of headroom. Savings are at the
+// discounted prices of the provider.
+func ComputeClusterSizing(cache ClusterCache, cp cloud.Provider, costData map[string]*CostData, headroom float64, candidateTypes []string, discount float64) (*ClusterSizing, error) {
+	nodeCosts, err := getNodeCost(cache, cp)
+	if err != nil {
+		return nil, err
+	}
+	bytesPerGB := ramBytesPerGB(cp)
+
+	sizing := &ClusterSizing{
+		Headroom:    headroom,
+		CPURequests: aggregateDemand(costData, func(c *CostData) []*Vector { return c.CPUReq }),
+		CPUUsage:    aggregateDemand(costData, func(c *CostData) []*Vector { return c.CPUUsed }),
+		RAMRequests: aggregateDemand(costData, func(c *CostData) []*Vector { return c.RAMReq }),
+		RAMUsage:    aggregateDemand(costData, func(c *CostData) []*Vector { return c.RAMUsed }),
+		NodeTypes:   []*SizingNodeType{},
+	}
+
+	for _, pod := range cache.GetAllPods() {
+		if pod.Status.Phase == v1.PodSucceeded || pod.Status.Phase == v1.PodFailed {
+			continue
+		}
+		sizing.Pods++
+		sizing.LargestPodCPU = math.Max(sizing.LargestPodCPU, podRequest(pod, v1.ResourceCPU))
+		sizing.LargestPodRAM = math.Max(sizing.LargestPodRAM, podRequest(pod, v1.ResourceMemory))
+	}
+
+	// nodes without an instance type can't be recommended, so they're kept, and the rest of the nodes sized to the
+	// demand they don't fit
+	var template map[string]string
+	keptNodes, keptCPU, keptRAM, keptPods, keptCost := 0, 0.0, 0.0, 0, 0.0
+	nodeTypes := make(map[string]*SizingNodeType)
+	typeNodes := make(map[string]int)
+	for _, n := range cache.GetAllNodes() {
+		cpu, ram, pods := nodeAllocatable(n)
+		// nodes are priced by their capacity, as in ComputeAssets
+		capacityCPU := float64(n.Status.Capacity.Cpu().Value())
+		cost := 0.0
+		if cnode := nodeCosts[n.Name]; cnode != nil {
+			if vcpu := parseAssetFloat(cnode.VCPU); vcpu > 0 {
+				capacityCPU = vcpu
+			}
+			cost = nodeHourlyCost(cnode, capacityCPU, float64(n.Status.Capacity.Memory().Value()), bytesPerGB)
+		}
+		sizing.Nodes++
+		sizing.CPUAllocatable += cpu
+		sizing.RAMAllocatable += ram
+		sizing.PodAllocatable += pods
+		sizing.CurrentMonthlyCost += cost * 730
+
+		instanceType := nodeInstanceType(n.Labels)
+		if instanceType == "" {
+			keptNodes++
+			keptCPU, keptRAM, keptPods, keptCost = keptCPU+cpu, keptRAM+ram, keptPods+pods, keptCost+cost
+			continue
+		}
+		if template == nil {
+			template = n.Labels
+		}
+
+		// a type is as large as its smallest node, and costs the average of them
+		nodeType, ok := nodeTypes[instanceType]
+		if !ok {
+			nodeType = &SizingNodeType{InstanceType: instanceType, CPUCores: cpu, RAMBytes: ram, Pods: pods, Current: true}
+			nodeTypes[instanceType] = nodeType
+		}
+		nodeType.CPUCores = math.Min(nodeType.CPUCores, cpu)
+		nodeType.RAMBytes = math.Min(nodeType.RAMBytes, ram)
+		if pods < nodeType.Pods {
+			nodeType.Pods = pods
+		}
+		nodeType.HourlyCost = (nodeType.HourlyCost*float64(typeNodes[instanceType]) + cost) / float64(typeNodes[instanceType]+1)
+		typeNodes[instanceType]++
+	}
+	if keptNodes > 0 {
+		sizing.NodeTypes = append(sizing.NodeTypes, &SizingNodeType{
+			CPUCores:   keptCPU / float64(keptNodes),
+			RAMBytes:   keptRAM / float64(keptNodes),
+			Pods:       keptPods / keptNodes,
+			HourlyCost: keptCost / float64(keptNodes),
+			Current:    true,
+			Status:     ClusterSizingNoInstanceType,
+		})
+	}
+
+	for _, candidate := range candidateTypes {
+		if _, ok := nodeTypes[candidate]; ok || candidate == "" {
+			continue
+		}
+		nodeTypes[candidate] = priceCandidateType(cp, template, candidate, bytesPerGB)
+	}
+
+	sizing.CPURequired = math.Max(sizing.CPURequests.Peak, sizing.CPUUsage.P95) * (1 + headroom)
+	sizing.RAMRequired = math.Max(sizing.RAMRequests.Peak, sizing.RAMUsage.P95) * (1 + headroom)
+	sizing.PodsRequired = int(math.Ceil(float64(sizing.Pods) * (1 + headroom)))
+
+	typed := []*SizingNodeType{}
+	for _, nodeType := range nodeTypes {
+		switch {
+		case nodeType.Status != "":
+		case nodeType.HourlyCost <= 0:
+			nodeType.Status = ClusterSizingNotPriced
+		case nodeType.CPUCores < sizing.LargestPodCPU || nodeType.RAMBytes < sizing.LargestPodRAM || nodeType.Pods < 1:
+			nodeType.Status = ClusterSizingTooSmall
+		}
+		sizing.NodeTypes = append(sizing.NodeTypes, nodeType)
+		typed = append(typed, nodeType)
+	}
+	sort.SliceStable(sizing.NodeTypes, func(i, j int) bool {
+		return sizing.NodeTypes[i].InstanceType < sizing.NodeTypes[j].InstanceType
+	})
+	sort.SliceStable(typed, func(i, j int) bool {
+		return typed[i].InstanceType < typed[j].InstanceType
+	})
+
+	cpu := math.Max(sizing.CPURequired-keptCPU, 0)
+	ram := math.Max(sizing.RAMRequired-keptRAM, 0)
+	pods := maxInt(sizing.PodsRequired-keptPods, 0)
+	sizing.Recommendation = []*NodeTypeCount{}
+	recommendedCost := keptCost
+	if keptNodes == 0 || cpu > 0 || ram > 0 || pods > 0 {
+		recommendation, cost := recommendNodes(typed, cpu, ram, pods)
+		if recommendation == nil {
+			return nil, fmt.Errorf("No node type fits the largest pod, requesting %.3f cores and %.0f bytes of RAM", sizing.LargestPodCPU, sizing.LargestPodRAM)
+		}
+		sizing.Recommendation = recommendation
+		recommendedCost += cost
+	}
+	if keptNodes > 0 {
+		sizing.Recommendation = append(sizing.Recommendation, &NodeTypeCount{Count: keptNodes, HourlyCost: keptCost / float64(keptNodes)})
+	}
+
+	sizing.RecommendedMonthlyCost = recommendedCost * 730
+	sizing.MonthlySavings = (sizing.CurrentMonthlyCost - sizing.RecommendedMonthlyCost) * (1 - discount)
+	return sizing, nil
+}
@@ -0,0 +1,217 @@
+package costmodel
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	costAnalyzerCloud "github.com/kubecost/cost-model/cloud"
+	"k8s.io/klog"
+)
+
+const (
+	configHistorySizeEnvVar  = "CONFIG_HISTORY_SIZE"
+	defaultConfigHistorySize = 100
+	configHistoryFile        = "history.json"
+
+	// redactedConfigValue replaces the values of secrets in the config history
+	redactedConfigValue = "********"
+)
+
+// ConfigChange is the change of the value of a config key, keyed as in the serialized config
+type ConfigChange struct {
+	Key string `json:"key"`
+	Old string `json:"old"`
+	New string `json:"new"`
+}
+
+// ConfigRevision records an update of the config: when, by whom if known, and what changed
+type ConfigRevision struct {
+	Revision  int             `json:"revision"`
+	Timestamp time.Time       `json:"timestamp"`
+	User      string          `json:"user,omitempty"`
+	Changes   []*ConfigChange `json:"changes"`
+}
+
+// ConfigHistory keeps the latest MaxRevisions revisions of the config, persisted to Path so that they survive
+// restarts. The values of secrets are redacted, and so can't be rolled back.
+type ConfigHistory struct {
+	Path         string
+	MaxRevisions int
+
+	lock      sync.Mutex
+	revisions []*ConfigRevision
+}
+
+// NewConfigHistory returns the config history persisted to the given path, or an empty history if there is
+// none or it can't be read
+func NewConfigHistory(path string, maxRevisions int) *ConfigHistory {
+	h := &ConfigHistory{
+		Path:         path,
+		MaxRevisions: maxRevisions,
+		revisions:    []*ConfigRevision{},
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			klog.V(1).Infof("Unable to read config history: %s", err.Error())
+		}
+		return h
+	}
+	if err := json.Unmarshal(b, &h.revisions); err != nil {
+		klog.V(1).Infof("Invalid config history %s: %s", path, err.Error())
+		h.revisions = []*ConfigRevision{}
+	}
+	return h
+}
+
+// Revisions returns the revisions of the config, oldest first
+func (h *ConfigHistory) Revisions() []*ConfigRevision {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return append([]*ConfigRevision{}, h.revisions...)
+}
+
+// Record adds a revision of the changes from before to after, if any, made by the given user
+func (h *ConfigHistory) Record(before, after *costAnalyzerCloud.CustomPricing, user string) (*ConfigRevision, error) {
+	changes := diffConfigs(before, after)
+	if len(changes) == 0 {
+		return nil, nil
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	revision := &ConfigRevision{
+		Revision:  1,
+		Timestamp: time.Now().UTC(),
+		User:      user,
+		Changes:   changes,
+	}
+	if len(h.revisions) > 0 {
+		revision.Revision = h.revisions[len(h.revisions)-1].Revision + 1
+	}
+	h.revisions = append(h.revisions, revision)
+	if h.MaxRevisions > 0 && len(h.revisions) > h.MaxRevisions {
+		h.revisions = h.revisions[len(h.revisions)-h.MaxRevisions:]
+	}
+	return revision, h.save()
+}
+
+// RollbackUpdates returns the config updates, keyed by field name as accepted by UpdateConfig, restoring the
+// config as of the given revision by reverting every later revision
+func (h *ConfigHistory) RollbackUpdates(revision int) (map[string]string, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	i := -1
+	for j, r := range h.revisions {
+		if r.Revision == revision {
+			i = j
+		}
+	}
+	if i < 0 {
+		return nil, fmt.Errorf("No such config revision: %d", revision)
+	}
+
+	fields := configFieldNames()
+	updates := make(map[string]string)
+	for j := len(h.revisions) - 1; j > i; j-- {
+		for _, change := range h.revisions[j].Changes {
+			if field, ok := fields[change.Key]; ok && change.Old != redactedConfigValue {
+				updates[field] = change.Old
+			}
+		}
+	}
+	return updates, nil
+}
+
+// save writes the history to Path, through a temporary file so that a crash mid-write doesn't corrupt it.
+// The lock must be held.
+func (h *ConfigHistory) save() error {
+	b, err := json.Marshal(h.revisions)
+	if err != nil {
+		return err
+	}
+	tmp := h.Path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, h.Path)
+}
+
+// diffConfigs returns the changes of each key from before to after, redacting the values of secrets
+func diffConfigs(before, after *costAnalyzerCloud.CustomPricing) []*ConfigChange {
+	changes := []*ConfigChange{}
+	t := reflect.TypeOf(*after)
+	beforeVal := reflect.ValueOf(*before)
+	afterVal := reflect.ValueOf(*after)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Type.Kind() != reflect.String || beforeVal.Field(i).String() == afterVal.Field(i).String() {
+			continue
+		}
+		change := &ConfigChange{
+			Key: configKey(field),
+			Old: beforeVal.Field(i).String(),
+			New: afterVal.Field(i).String(),
+		}
+		if strings.Contains(field.Name, "Secret") {
+			change.Old = redactedConfigValue
+			change.New = redactedConfigValue
+		}
+		changes = append(changes, change)
+	}
+	return changes
+}
+
+// configFieldNames maps the key of each config field, as serialized, to its field name
+func configFieldNames() map[string]string {
+	t := reflect.TypeOf(costAnalyzerCloud.CustomPricing{})
+	fields := make(map[string]string, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		fields[configKey(t.Field(i))] = t.Field(i).Name
+	}
+	return fields
+}
+
+func configKey(field reflect.StructField) string {
+	if name := strings.Split(field.Tag.Get("json"), ",")[0]; name != "" {
+		return name
+	}
+	return field.Name
+}
+
+// configUser identifies the caller updating the config by the X-User header or else, so as not to record the
+// token itself, by a fingerprint of the bearer token authorizing the request
+func configUser(r *http.Request) string {
+	if user := r.Header.Get("X-User"); user != "" {
+		return user
+	}
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		sum := sha256.Sum256([]byte(strings.TrimPrefix(auth, "Bearer ")))
+		return "token:" + hex.EncodeToString(sum[:])[:12]
+	}
+	return ""
+}
+
+// configHistorySize reads the number of config revisions to keep from CONFIG_HISTORY_SIZE
+func configHistorySize() (int, error) {
+	value := os.Getenv(configHistorySizeEnvVar)
+	if value == "" {
+		return defaultConfigHistorySize, nil
+	}
+	size, err := strconv.Atoi(value)
+	if err != nil || size <= 0 {
+		return 0, fmt.Errorf("Invalid %s '%s'; must be a positive number of revisions", configHistorySizeEnvVar, value)
+	}
+	return size, nil
+}
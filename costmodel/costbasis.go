@@ -0,0 +1,82 @@
+package costmodel
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	// CostBasisRequest costs CPU by its allocation: the greater of the cores requested and used
+	CostBasisRequest = "request"
+	// CostBasisUsage costs CPU by the cores actually used, for showback that rewards efficiency
+	CostBasisUsage = "usage"
+)
+
+// maxCostBasisFallbacks bounds the number of containers named in the warning of ApplyCostBasis
+const maxCostBasisFallbacks = 10
+
+// ValidateCostBasis returns the given CPU cost basis, defaulting to CostBasisRequest, or an error if it is not
+// a known basis
+func ValidateCostBasis(basis string) (string, error) {
+	if basis == "" {
+		return CostBasisRequest, nil
+	}
+	if basis != CostBasisRequest && basis != CostBasisUsage {
+		return "", fmt.Errorf("Invalid costBasis '%s'; must be '%s' or '%s'", basis, CostBasisRequest, CostBasisUsage)
+	}
+	return basis, nil
+}
+
+// ApplyCostBasis returns the given cost data with the CPU allocation of each container set to its CPU usage
+// when basis is CostBasisUsage. Containers without usage data keep their allocation, and are named in the
+// returned warnings. The original cost data is not modified.
+func ApplyCostBasis(costData map[string]*CostData, basis string) (map[string]*CostData, []string) {
+	if basis != CostBasisUsage || costData == nil {
+		return costData, nil
+	}
+
+	var fallbacks []string
+	usage := make(map[string]*CostData, len(costData))
+	for key, cd := range costData {
+		if !hasUsage(cd.CPUUsed) {
+			usage[key] = cd
+			fallbacks = append(fallbacks, key)
+			continue
+		}
+		newCd := *cd
+		newCd.CPUAllocation = make([]*Vector, 0, len(cd.CPUUsed))
+		for _, val := range cd.CPUUsed {
+			if val.Timestamp == 0 {
+				continue
+			}
+			newCd.CPUAllocation = append(newCd.CPUAllocation, &Vector{
+				Timestamp: val.Timestamp,
+				Value:     val.Value,
+			})
+		}
+		usage[key] = &newCd
+	}
+	if len(fallbacks) == 0 {
+		return usage, nil
+	}
+
+	sort.Strings(fallbacks)
+	named := fallbacks
+	if len(named) > maxCostBasisFallbacks {
+		named = append(named[:maxCostBasisFallbacks:maxCostBasisFallbacks], "...")
+	}
+	warning := fmt.Sprintf("CPU usage unavailable for %d containers, costed by allocation instead: %s", len(fallbacks), strings.Join(named, ", "))
+	return usage, []string{warning}
+}
+
+// hasUsage reports whether the given usage vectors hold any sample; missing usage is reported as no vectors
+// or as a single zero vector
+func hasUsage(used []*Vector) bool {
+	for _, val := range used {
+		if val.Timestamp != 0 {
+			return true
+		}
+	}
+	return false
+}
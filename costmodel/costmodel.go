@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"math"
 	"net/http"
+	"os"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
@@ -15,6 +17,7 @@ import (
 	"github.com/kubecost/cost-model/cloud"
 	costAnalyzerCloud "github.com/kubecost/cost-model/cloud"
 	prometheusClient "github.com/prometheus/client_golang/api"
+	"golang.org/x/sync/errgroup"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
@@ -40,11 +43,29 @@ const (
 
 	clusterIDKey  = "CLUSTER_ID"
 	remoteEnabled = "REMOTE_WRITE_ENABLED"
+
+	// clusterLabel is the label identifying the cluster of series in a Prometheus scraping several clusters,
+	// e.g. an external label added by Thanos
+	clusterLabel = "cluster"
 )
 
+// LocalClusterID returns the ID of the cluster the cost model runs in, CLUSTER_ID, defaulting to the name
+// defined in cluster info. Series without a cluster label are attributed to it, so CLUSTER_ID must match the
+// cluster label of the local cluster when Prometheus scrapes several clusters.
+func LocalClusterID(cp costAnalyzerCloud.Provider) string {
+	if id := os.Getenv(clusterIDKey); id != "" {
+		return id
+	}
+	return cloud.ClusterName(cp)
+}
+
 type CostModel struct {
 	Cache ClusterCache
 
+	// LongTermPrometheusClient, if set, serves range queries for data older than LocalRetention
+	LongTermPrometheusClient prometheusClient.Client
+	LocalRetention           time.Duration
+
 	stop chan struct{}
 }
 
@@ -62,6 +83,7 @@ func NewCostModel(client kubernetes.Interface) *CostModel {
 type CostData struct {
 	Name            string                       `json:"name,omitempty"`
 	PodName         string                       `json:"podName,omitempty"`
+	PodUID          string                       `json:"podUID,omitempty"` // with NodeName, identifies the pod's data on each node it ran on
 	NodeName        string                       `json:"nodeName,omitempty"`
 	NodeData        *costAnalyzerCloud.Node      `json:"node,omitempty"`
 	Namespace       string                       `json:"namespace,omitempty"`
@@ -70,20 +92,65 @@ type CostData struct {
 	Daemonsets      []string                     `json:"daemonsets,omitempty"`
 	Statefulsets    []string                     `json:"statefulsets,omitempty"`
 	Jobs            []string                     `json:"jobs,omitempty"`
+	CronJobs        []string                     `json:"cronjobs,omitempty"` // CronJobs which ran the first of Jobs
+	Image           string                       `json:"image,omitempty"`    // as given in the pod spec
 	RAMReq          []*Vector                    `json:"ramreq,omitempty"`
 	RAMUsed         []*Vector                    `json:"ramused,omitempty"`
 	CPUReq          []*Vector                    `json:"cpureq,omitempty"`
 	CPUUsed         []*Vector                    `json:"cpuused,omitempty"`
 	RAMAllocation   []*Vector                    `json:"ramallocated,omitempty"`
 	CPUAllocation   []*Vector                    `json:"cpuallocated,omitempty"`
+	RAMOverhead     []*Vector                    `json:"ramoverhead,omitempty"` // share of the pod overhead, included in RAMAllocation
+	CPUOverhead     []*Vector                    `json:"cpuoverhead,omitempty"` // share of the pod overhead, included in CPUAllocation
+	IsInitContainer bool                         `json:"isInitContainer,omitempty"`
 	GPUReq          []*Vector                    `json:"gpureq,omitempty"`
 	PVCData         []*PersistentVolumeClaimData `json:"pvcData,omitempty"`
 	NetworkData     []*Vector                    `json:"network,omitempty"`
 	Labels          map[string]string            `json:"labels,omitempty"`
+	Annotations     map[string]string            `json:"-"` // to aggregate by, but not returned, as annotations may be large or sensitive
 	NamespaceLabels map[string]string            `json:"namespaceLabels,omitempty"`
 	ClusterID       string                       `json:"clusterId"`
 }
 
+// MergeCostDataRanges merges the cost data of the containers over a later range into that over an earlier one,
+// appending the samples of each, and returns the merged cost data. Either may be nil.
+func MergeCostDataRanges(costData map[string]*CostData, later map[string]*CostData) map[string]*CostData {
+	if costData == nil {
+		return later
+	}
+	for key, cd := range later {
+		merged, ok := costData[key]
+		if !ok {
+			costData[key] = cd
+			continue
+		}
+		merged.RAMReq = append(merged.RAMReq, cd.RAMReq...)
+		merged.RAMUsed = append(merged.RAMUsed, cd.RAMUsed...)
+		merged.CPUReq = append(merged.CPUReq, cd.CPUReq...)
+		merged.CPUUsed = append(merged.CPUUsed, cd.CPUUsed...)
+		merged.RAMAllocation = append(merged.RAMAllocation, cd.RAMAllocation...)
+		merged.CPUAllocation = append(merged.CPUAllocation, cd.CPUAllocation...)
+		merged.RAMOverhead = append(merged.RAMOverhead, cd.RAMOverhead...)
+		merged.CPUOverhead = append(merged.CPUOverhead, cd.CPUOverhead...)
+		merged.GPUReq = append(merged.GPUReq, cd.GPUReq...)
+		merged.NetworkData = append(merged.NetworkData, cd.NetworkData...)
+		for _, pvc := range cd.PVCData {
+			found := false
+			for _, mergedPVC := range merged.PVCData {
+				if mergedPVC.Namespace == pvc.Namespace && mergedPVC.Claim == pvc.Claim {
+					mergedPVC.Values = append(mergedPVC.Values, pvc.Values...)
+					found = true
+					break
+				}
+			}
+			if !found {
+				merged.PVCData = append(merged.PVCData, pvc)
+			}
+		}
+	}
+	return costData
+}
+
 type Vector struct {
 	Timestamp float64 `json:"timestamp"`
 	Value     float64 `json:"value"`
@@ -97,16 +164,16 @@ const (
 					count_over_time(kube_pod_container_resource_requests_memory_bytes{container!="",container!="POD", node!=""}[%s] %s) 
 					*  
 					avg_over_time(kube_pod_container_resource_requests_memory_bytes{container!="",container!="POD", node!=""}[%s] %s)
-				) by (namespace,container,pod,node) , "container_name","$1","container","(.+)"
+				) by (cluster,namespace,container,pod,node) , "container_name","$1","container","(.+)"
 			), "pod_name","$1","pod","(.+)"
 		)
-	) by (namespace,container_name,pod_name,node)`
+	) by (cluster,namespace,container_name,pod_name,node)`
 	queryRAMUsageStr = `sort_desc(
 		avg(
 			label_replace(count_over_time(container_memory_working_set_bytes{container_name!="",container_name!="POD", instance!=""}[%s] %s), "node", "$1", "instance","(.+)") 
 			* 
 			label_replace(avg_over_time(container_memory_working_set_bytes{container_name!="",container_name!="POD", instance!=""}[%s] %s), "node", "$1", "instance","(.+)") 
-		) by (namespace,container_name,pod_name,node)
+		) by (cluster,namespace,container_name,pod_name,node)
 	)`
 	queryCPURequestsStr = `avg(
 		label_replace(
@@ -115,17 +182,28 @@ const (
 					count_over_time(kube_pod_container_resource_requests_cpu_cores{container!="",container!="POD", node!=""}[%s] %s) 
 					*  
 					avg_over_time(kube_pod_container_resource_requests_cpu_cores{container!="",container!="POD", node!=""}[%s] %s)
-				) by (namespace,container,pod,node) , "container_name","$1","container","(.+)"
+				) by (cluster,namespace,container,pod,node) , "container_name","$1","container","(.+)"
 			), "pod_name","$1","pod","(.+)"
 		) 
-	) by (namespace,container_name,pod_name,node)`
+	) by (cluster,namespace,container_name,pod_name,node)`
 	queryCPUUsageStr = `avg(
 		label_replace(
 		rate( 
 			container_cpu_usage_seconds_total{container_name!="",container_name!="POD",instance!=""}[%s] %s
 		) , "node", "$1", "instance", "(.+)"
 		)
-	) by (namespace,container_name,pod_name,node)`
+	) by (cluster,namespace,container_name,pod_name,node)`
+	// queryCPUUsageRangeStr weights the CPU usage rate of each container by the number of samples of it in each
+	// window, so that once normalized, like the requests, containers which ran for part of a window are only
+	// charged for that part
+	queryCPUUsageRangeStr = `avg(
+		label_replace(
+			count_over_time(container_cpu_usage_seconds_total{container_name!="",container_name!="POD",instance!=""}[%s] %s)
+			*
+			rate(container_cpu_usage_seconds_total{container_name!="",container_name!="POD",instance!=""}[%s] %s)
+		, "node", "$1", "instance", "(.+)"
+		)
+	) by (cluster,namespace,container_name,pod_name,node)`
 	queryGPURequestsStr = `avg(
 		label_replace(
 			label_replace(
@@ -133,10 +211,10 @@ const (
 					count_over_time(kube_pod_container_resource_requests{resource="nvidia_com_gpu", container!="",container!="POD", node!=""}[%s] %s) 
 					*  
 					avg_over_time(kube_pod_container_resource_requests{resource="nvidia_com_gpu", container!="",container!="POD", node!=""}[%s] %s)
-				) by (namespace,container,pod,node) , "container_name","$1","container","(.+)"
+				) by (cluster,namespace,container,pod,node) , "container_name","$1","container","(.+)"
 			), "pod_name","$1","pod","(.+)"
 		) 
-	) by (namespace,container_name,pod_name,node)`
+	) by (cluster,namespace,container_name,pod_name,node)`
 	queryPVRequestsStr = `avg(kube_persistentvolumeclaim_info) by (persistentvolumeclaim, storageclass, namespace, volumename) 
 						* 
 						on (persistentvolumeclaim, namespace) group_right(storageclass, volumename) 
@@ -148,8 +226,9 @@ const (
 )
 
 type PrometheusMetadata struct {
-	Running            bool `json:"running"`
-	KubecostDataExists bool `json:"kubecostDataExists"`
+	Running            bool                `json:"running"`
+	KubecostDataExists bool                `json:"kubecostDataExists"`
+	LongTerm           *PrometheusMetadata `json:"longTerm,omitempty"`
 }
 
 // ValidatePrometheus tells the model what data prometheus has on it.
@@ -232,12 +311,14 @@ func getUptimeData(qr interface{}) ([]*Vector, bool, error) {
 	return jobData, kubecostMetrics, nil
 }
 
-func ComputeUptimes(cli prometheusClient.Client) (map[string]float64, error) {
+// ComputeUptimes returns the uptime in seconds of each container, keyed by ContainerMetric, attributing containers
+// without a cluster label to the local cluster
+func ComputeUptimes(cli prometheusClient.Client, cp costAnalyzerCloud.Provider) (map[string]float64, error) {
 	res, err := Query(cli, `container_start_time_seconds{container_name != "POD",container_name != ""}`)
 	if err != nil {
 		return nil, err
 	}
-	vectors, err := GetContainerMetricVector(res, false, 0)
+	vectors, err := getContainerMetricVector(res, false, 0, LocalClusterID(cp))
 	if err != nil {
 		return nil, err
 	}
@@ -253,73 +334,92 @@ func ComputeUptimes(cli prometheusClient.Client) (map[string]float64, error) {
 	return results, nil
 }
 
-func (cm *CostModel) ComputeCostData(cli prometheusClient.Client, clientset kubernetes.Interface, cp costAnalyzerCloud.Provider, window string, offset string, filterNamespace string) (map[string]*CostData, error) {
+func (cm *CostModel) ComputeCostData(cli prometheusClient.Client, clientset kubernetes.Interface, cp costAnalyzerCloud.Provider, window string, offset string, filterNamespace string) (map[string]*CostData, []string, error) {
 	queryRAMRequests := fmt.Sprintf(queryRAMRequestsStr, window, offset, window, offset)
 	queryRAMUsage := fmt.Sprintf(queryRAMUsageStr, window, offset, window, offset)
 	queryCPURequests := fmt.Sprintf(queryCPURequestsStr, window, offset, window, offset)
 	queryCPUUsage := fmt.Sprintf(queryCPUUsageStr, window, offset)
 	queryGPURequests := fmt.Sprintf(queryGPURequestsStr, window, offset, window, offset)
 	queryPVRequests := fmt.Sprintf(queryPVRequestsStr)
-	queryNetZoneRequests := fmt.Sprintf(queryZoneNetworkUsage, window, "")
-	queryNetRegionRequests := fmt.Sprintf(queryRegionNetworkUsage, window, "")
-	queryNetInternetRequests := fmt.Sprintf(queryInternetNetworkUsage, window, "")
+	queryNetZoneRequests := fmt.Sprintf(queryZoneNetworkUsage, window, offset)
+	queryNetRegionRequests := fmt.Sprintf(queryRegionNetworkUsage, window, offset)
+	queryNetInternetRequests := fmt.Sprintf(queryInternetNetworkUsage, window, offset)
+	queryNetTransmit := fmt.Sprintf(queryPodNetworkTransmit, window, offset)
 	normalization := fmt.Sprintf(normalizationStr, window, offset)
 
-	// Retrieve cluster ID from cloud provider's cluster info
-	clusterName := cloud.ClusterName(cp)
+	// Containers without a cluster label run in the local cluster
+	clusterID := LocalClusterID(cp)
+	egressSplit := networkEgressSplit(cp)
+
+	// partial responses are reported in the warnings, as on the range path
+	var queryWarnings warningSet
+	instantQuery := func(query string) (interface{}, error) {
+		res, err := Query(cli, query)
+		if err == nil {
+			queryWarnings.add(responseWarnings(res))
+		}
+		return res, err
+	}
 
 	var wg sync.WaitGroup
-	wg.Add(11)
+	wg.Add(12)
 
 	var promErr error
 	var resultRAMRequests interface{}
 	go func() {
-		resultRAMRequests, promErr = Query(cli, queryRAMRequests)
+		resultRAMRequests, promErr = instantQuery(queryRAMRequests)
 		defer wg.Done()
 	}()
 	var resultRAMUsage interface{}
 	go func() {
-		resultRAMUsage, promErr = Query(cli, queryRAMUsage)
+		resultRAMUsage, promErr = instantQuery(queryRAMUsage)
 		defer wg.Done()
 	}()
 	var resultCPURequests interface{}
 	go func() {
-		resultCPURequests, promErr = Query(cli, queryCPURequests)
+		resultCPURequests, promErr = instantQuery(queryCPURequests)
 		defer wg.Done()
 	}()
 	var resultCPUUsage interface{}
 	go func() {
-		resultCPUUsage, promErr = Query(cli, queryCPUUsage)
+		resultCPUUsage, promErr = instantQuery(queryCPUUsage)
 		defer wg.Done()
 	}()
 	var resultGPURequests interface{}
 	go func() {
-		resultGPURequests, promErr = Query(cli, queryGPURequests)
+		resultGPURequests, promErr = instantQuery(queryGPURequests)
 		defer wg.Done()
 	}()
 	var resultPVRequests interface{}
 	go func() {
-		resultPVRequests, promErr = Query(cli, queryPVRequests)
+		resultPVRequests, promErr = instantQuery(queryPVRequests)
 		defer wg.Done()
 	}()
 	var resultNetZoneRequests interface{}
 	go func() {
-		resultNetZoneRequests, promErr = Query(cli, queryNetZoneRequests)
+		resultNetZoneRequests, promErr = instantQuery(queryNetZoneRequests)
 		defer wg.Done()
 	}()
 	var resultNetRegionRequests interface{}
 	go func() {
-		resultNetRegionRequests, promErr = Query(cli, queryNetRegionRequests)
+		resultNetRegionRequests, promErr = instantQuery(queryNetRegionRequests)
 		defer wg.Done()
 	}()
 	var resultNetInternetRequests interface{}
 	go func() {
-		resultNetInternetRequests, promErr = Query(cli, queryNetInternetRequests)
+		resultNetInternetRequests, promErr = instantQuery(queryNetInternetRequests)
+		defer wg.Done()
+	}()
+	var resultNetTransmit interface{}
+	go func() {
 		defer wg.Done()
+		if egressSplit != nil {
+			resultNetTransmit, promErr = instantQuery(queryNetTransmit)
+		}
 	}()
 	var normalizationResult interface{}
 	go func() {
-		normalizationResult, promErr = Query(cli, normalization)
+		normalizationResult, promErr = instantQuery(normalization)
 		defer wg.Done()
 	}()
 
@@ -350,21 +450,29 @@ func (cm *CostModel) ComputeCostData(cli prometheusClient.Client, clientset kube
 	wg.Wait()
 
 	if promErr != nil {
-		return nil, fmt.Errorf("Error querying prometheus: %s", promErr.Error())
+		return nil, nil, NewCodedError(ErrorCodePromUnavailable, fmt.Errorf("Error querying prometheus: %s", promErr.Error()))
 	}
 	if k8sErr != nil {
-		return nil, fmt.Errorf("Error querying the kubernetes api: %s", k8sErr.Error())
+		return nil, nil, fmt.Errorf("Error querying the kubernetes api: %s", k8sErr.Error())
 	}
 
 	normalizationValue, err := getNormalization(normalizationResult)
 	if err != nil {
-		return nil, fmt.Errorf("Error parsing normalization values: " + err.Error())
+		// without kube-state-metrics, usage is normalized by the samples of cAdvisor instead
+		fallbackResult, fallbackErr := instantQuery(fmt.Sprintf(normalizationFallbackStr, window, offset))
+		if fallbackErr != nil {
+			return nil, nil, fmt.Errorf("Error parsing normalization values: " + err.Error())
+		}
+		normalizationValue, fallbackErr = getNormalization(fallbackResult)
+		if fallbackErr != nil {
+			return nil, nil, fmt.Errorf("Error parsing normalization values: " + err.Error())
+		}
 	}
 
 	nodes, err := getNodeCost(cm.Cache, cp)
 	if err != nil {
 		klog.V(1).Infof("Warning, no Node cost model available: " + err.Error())
-		return nil, err
+		return nil, nil, NewCodedError(ErrorCodePricingMissing, err)
 	}
 
 	pvClaimMapping, err := getPVInfoVector(resultPVRequests)
@@ -374,7 +482,7 @@ func (cm *CostModel) ComputeCostData(cli prometheusClient.Client, clientset kube
 	if pvClaimMapping != nil {
 		err = addPVData(cm.Cache, pvClaimMapping, cp)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 	}
 
@@ -383,62 +491,88 @@ func (cm *CostModel) ComputeCostData(cli prometheusClient.Client, clientset kube
 		klog.V(1).Infof("Unable to get Network Cost Data: %s", err.Error())
 		networkUsageMap = make(map[string]*NetworkUsageData)
 	}
+	if egressSplit != nil {
+		if err := estimateNetworkUsageData(networkUsageMap, resultNetTransmit, egressSplit, false); err != nil {
+			klog.V(1).Infof("Unable to estimate Network Cost Data: %s", err.Error())
+		}
+	}
 
 	containerNameCost := make(map[string]*CostData)
 	containers := make(map[string]bool)
+	warnings := queryWarnings.list()
 
-	RAMReqMap, err := GetContainerMetricVector(resultRAMRequests, true, normalizationValue)
+	RAMReqMap, err := getContainerMetricVector(resultRAMRequests, true, normalizationValue, clusterID)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	CPUReqMap, err := getContainerMetricVector(resultCPURequests, true, normalizationValue, clusterID)
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	windowDuration, windowEnd, windowErr := queryWindowEnd(window, offset, now)
+	if windowErr != nil && (len(RAMReqMap) == 0 || len(CPUReqMap) == 0) {
+		return nil, nil, NewCodedError(ErrorCodeBadWindow, windowErr)
+	}
+	// the requests of running containers which prometheus has none of, e.g. as kube-state-metrics is not running,
+	// are estimated from the specs of the cached pods, rather than costing their allocation by usage alone. The
+	// cached pods are those running now, so this is only done for windows which end now.
+	if windowErr == nil && !windowEnd.Before(now) {
+		specCPU, specRAM := podRequestVectors(podlist, clusterID, windowDuration, windowEnd, now)
+		if estimated := addAbsentRequests(RAMReqMap, specRAM); estimated > 0 {
+			warnings = append(warnings, specRequestsWarning("RAM", estimated))
+		}
+		if estimated := addAbsentRequests(CPUReqMap, specCPU); estimated > 0 {
+			warnings = append(warnings, specRequestsWarning("CPU", estimated))
+		}
 	}
 	for key := range RAMReqMap {
 		containers[key] = true
 	}
 
-	RAMUsedMap, err := GetContainerMetricVector(resultRAMUsage, true, normalizationValue)
+	RAMUsedMap, err := getContainerMetricVector(resultRAMUsage, true, normalizationValue, clusterID)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	for key := range RAMUsedMap {
 		containers[key] = true
 	}
-	CPUReqMap, err := GetContainerMetricVector(resultCPURequests, true, normalizationValue)
-	if err != nil {
-		return nil, err
-	}
 	for key := range CPUReqMap {
 		containers[key] = true
 	}
-	GPUReqMap, err := GetContainerMetricVector(resultGPURequests, true, normalizationValue)
+	GPUReqMap, err := getContainerMetricVector(resultGPURequests, true, normalizationValue, clusterID)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	for key := range GPUReqMap {
 		containers[key] = true
 	}
-	CPUUsedMap, err := GetContainerMetricVector(resultCPUUsage, false, 0) // No need to normalize here, as this comes from a counter
+	CPUUsedMap, err := getContainerMetricVector(resultCPUUsage, false, 0, clusterID) // No need to normalize here, as this comes from a counter
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	for key := range CPUUsedMap {
 		containers[key] = true
 	}
 	currentContainers := make(map[string]v1.Pod)
+	currentPods := make(map[string]v1.Pod)
 	for _, pod := range podlist {
 		if pod.Status.Phase != v1.PodRunning {
 			continue
 		}
-		cs, err := newContainerMetricsFromPod(*pod)
+		cs, err := newContainerMetricsFromPod(clusterID, *pod)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		for _, c := range cs {
 			containers[c.Key()] = true // captures any containers that existed for a time < a prometheus scrape interval. We currently charge 0 for this but should charge something.
 			currentContainers[c.Key()] = *pod
 		}
+		currentPods[pod.GetObjectMeta().GetNamespace()+","+pod.GetObjectMeta().GetName()] = *pod
 	}
 	missingNodes := make(map[string]*costAnalyzerCloud.Node)
 	missingContainers := make(map[string]*CostData)
+	historicalContainers := make(map[string]*CostData) // of pods not in the cluster cache, including missingContainers
 	for key := range containers {
 		if _, ok := containerNameCost[key]; ok {
 			continue // because ordering is important for the allocation model (all PV's applied to the first), just dedupe if it's already been added.
@@ -507,7 +641,7 @@ func (cm *CostModel) ComputeCostData(cli prometheusClient.Client, clientset kube
 				containerName := container.Name
 
 				// recreate the key and look up data for this container
-				newKey := newContainerMetricFromValues(ns, podName, containerName, pod.Spec.NodeName).Key()
+				newKey := newContainerMetricFromValues(clusterID, ns, podName, containerName, pod.Spec.NodeName).Key()
 
 				RAMReqV, ok := RAMReqMap[newKey]
 				if !ok {
@@ -544,7 +678,9 @@ func (cm *CostModel) ComputeCostData(cli prometheusClient.Client, clientset kube
 
 				costs := &CostData{
 					Name:            containerName,
+					Image:           container.Image,
 					PodName:         podName,
+					PodUID:          string(pod.GetObjectMeta().GetUID()),
 					NodeName:        nodeName,
 					Namespace:       ns,
 					Deployments:     podDeployments,
@@ -561,8 +697,9 @@ func (cm *CostModel) ComputeCostData(cli prometheusClient.Client, clientset kube
 					PVCData:         pvReq,
 					NetworkData:     netReq,
 					Labels:          podLabels,
+					Annotations:     costDataAnnotations(pod),
 					NamespaceLabels: nsLabels,
-					ClusterID:       clusterName,
+					ClusterID:       clusterID,
 				}
 				costs.CPUAllocation = getContainerAllocation(costs.CPUReq, costs.CPUUsed)
 				costs.RAMAllocation = getContainerAllocation(costs.RAMReq, costs.RAMUsed)
@@ -577,7 +714,7 @@ func (cm *CostModel) ComputeCostData(cli prometheusClient.Client, clientset kube
 			klog.V(4).Info("The container " + key + " has been deleted. Calculating allocation but resulting object will be missing data.")
 			c, err := NewContainerMetricFromKey(key)
 			if err != nil {
-				return nil, err
+				return nil, nil, err
 			}
 			RAMReqV, ok := RAMReqMap[key]
 			if !ok {
@@ -605,14 +742,19 @@ func (cm *CostModel) ComputeCostData(cli prometheusClient.Client, clientset kube
 				CPUUsedV = []*Vector{&Vector{}}
 			}
 
-			node, ok := nodes[c.NodeName]
+			// only the nodes of the local cluster are cached; those of other clusters are priced from their history
+			var node *costAnalyzerCloud.Node
+			ok = false
+			if c.ClusterID == clusterID {
+				node, ok = nodes[c.NodeName]
+			}
 			if !ok {
-				klog.V(2).Infof("Node \"%s\" has been deleted from Kubernetes. Query historical data to get it.", c.NodeName)
-				if n, ok := missingNodes[c.NodeName]; ok {
+				klog.V(2).Infof("Node \"%s\" of cluster \"%s\" is not in the cluster cache. Query historical data to get it.", c.NodeName, c.ClusterID)
+				if n, ok := missingNodes[nodeKey(c.ClusterID, c.NodeName)]; ok {
 					node = n
 				} else {
 					node = &costAnalyzerCloud.Node{}
-					missingNodes[c.NodeName] = node
+					missingNodes[nodeKey(c.ClusterID, c.NodeName)] = node
 				}
 			}
 			namespacelabels, ok := namespaceLabelsMapping[c.Namespace]
@@ -631,29 +773,43 @@ func (cm *CostModel) ComputeCostData(cli prometheusClient.Client, clientset kube
 				CPUUsed:         CPUUsedV,
 				GPUReq:          GPUReqV,
 				NamespaceLabels: namespacelabels,
-				ClusterID:       clusterName,
+				ClusterID:       c.ClusterID,
 			}
 			costs.CPUAllocation = getContainerAllocation(costs.CPUReq, costs.CPUUsed)
 			costs.RAMAllocation = getContainerAllocation(costs.RAMReq, costs.RAMUsed)
-			if filterNamespace == "" {
-				containerNameCost[key] = costs
-				missingContainers[key] = costs
-			} else if costs.Namespace == filterNamespace {
+			pod, rescheduled := currentPods[c.Namespace+","+c.PodName]
+			rescheduled = rescheduled && c.ClusterID == clusterID
+			if rescheduled {
+				setRescheduledPodMetadata(costs, pod, podDeploymentsMapping, podServicesMapping, namespacelabels)
+			}
+			if filterNamespace == "" || costs.Namespace == filterNamespace {
 				containerNameCost[key] = costs
-				missingContainers[key] = costs
+				historicalContainers[key] = costs
+				if !rescheduled {
+					missingContainers[key] = costs
+				}
 			}
 		}
 	}
-	err = findDeletedNodeInfo(cli, missingNodes, window)
+	if windowErr == nil {
+		intervals := instantIntervals(windowDuration, windowEnd, now)
+		addInitContainers(containerNameCost, podlist, clusterID, intervals)
+		addPodOverhead(containerNameCost, podlist, clusterID, intervals)
+	} else {
+		klog.V(1).Infof("Omitting init containers and pod overhead: %s", windowErr.Error())
+	}
+	err = findDeletedNodeInfo(cli, missingNodes, window, clusterID)
 
 	if err != nil {
 		klog.V(1).Infof("Error fetching historical node data: %s", err.Error())
 	}
+	resolveJobOwners(cli, cm.Cache, containerNameCost, missingContainers, window)
+	resolvePodUIDs(cli, historicalContainers, window)
 	err = findDeletedPodInfo(cli, missingContainers, window)
 	if err != nil {
 		klog.V(1).Infof("Error fetching historical pod data: %s", err.Error())
 	}
-	return containerNameCost, err
+	return containerNameCost, warnings, err
 }
 
 func findDeletedPodInfo(cli prometheusClient.Client, missingContainers map[string]*CostData, window string) error {
@@ -665,15 +821,21 @@ func findDeletedPodInfo(cli prometheusClient.Client, missingContainers map[strin
 			klog.V(1).Infof("Error parsing historical labels: %s", err.Error())
 		}
 		podLabels := make(map[string]map[string]string)
+		podLabelsByUID := make(map[string]map[string]string)
 		if podLabelsResult != nil {
-			podLabels, err = labelsFromPrometheusQuery(podLabelsResult)
+			podLabels, podLabelsByUID, err = labelsFromPrometheusQuery(podLabelsResult)
 			if err != nil {
 				klog.V(1).Infof("Error parsing historical labels: %s", err.Error())
 			}
 		}
 		for key, costData := range missingContainers {
 			cm, _ := NewContainerMetricFromKey(key)
-			labels, ok := podLabels[cm.PodName]
+			// pods are joined to their labels by UID, where both record it, so that those of a pod aren't taken
+			// from another of the same name
+			labels, ok := podLabelsByUID[costData.PodUID]
+			if !ok || costData.PodUID == "" {
+				labels, ok = podLabels[cm.PodName]
+			}
 			if !ok {
 				klog.V(1).Infof("Unable to find historical data for pod '%s'", cm.PodName)
 				labels = make(map[string]string)
@@ -690,42 +852,52 @@ func findDeletedPodInfo(cli prometheusClient.Client, missingContainers map[strin
 	return nil
 }
 
-func labelsFromPrometheusQuery(qr interface{}) (map[string]map[string]string, error) {
+// labelsFromPrometheusQuery returns the labels of each pod in the result of a query of kube_pod_labels series, keyed
+// by pod name, and by pod UID for the series which record it
+func labelsFromPrometheusQuery(qr interface{}) (map[string]map[string]string, map[string]map[string]string, error) {
 	toReturn := make(map[string]map[string]string)
+	byUID := make(map[string]map[string]string)
 	data, ok := qr.(map[string]interface{})["data"]
 	if !ok {
 		e, err := wrapPrometheusError(qr)
 		if err != nil {
-			return toReturn, err
+			return toReturn, byUID, err
 		}
-		return toReturn, fmt.Errorf(e)
+		return toReturn, byUID, fmt.Errorf(e)
 	}
 	for _, val := range data.(map[string]interface{})["result"].([]interface{}) {
 		metricInterface, ok := val.(map[string]interface{})["metric"]
 		if !ok {
-			return toReturn, fmt.Errorf("Metric field does not exist in data result vector")
+			return toReturn, byUID, fmt.Errorf("Metric field does not exist in data result vector")
 		}
 		metricMap, ok := metricInterface.(map[string]interface{})
 		if !ok {
-			return toReturn, fmt.Errorf("Metric field is improperly formatted")
+			return toReturn, byUID, fmt.Errorf("Metric field is improperly formatted")
 		}
 		pod, ok := metricMap["pod"]
 		if !ok {
-			return toReturn, fmt.Errorf("pod field does not exist in data result vector")
+			return toReturn, byUID, fmt.Errorf("pod field does not exist in data result vector")
 		}
 		podName, ok := pod.(string)
 		if !ok {
-			return toReturn, fmt.Errorf("pod field is improperly formatted")
+			return toReturn, byUID, fmt.Errorf("pod field is improperly formatted")
+		}
+		uid, _ := metricMap["uid"].(string)
+		if _, ok := byUID[uid]; !ok && uid != "" {
+			byUID[uid] = make(map[string]string)
 		}
 
 		for labelName, labelValue := range metricMap {
 			parsedLabelName := labelName
 			parsedLv, ok := labelValue.(string)
 			if !ok {
-				return toReturn, fmt.Errorf("label value is improperly formatted")
+				return toReturn, byUID, fmt.Errorf("label value is improperly formatted")
 			}
 			if strings.HasPrefix(parsedLabelName, "label_") {
 				l := strings.Replace(parsedLabelName, "label_", "", 1)
+				if uid != "" {
+					byUID[uid][l] = parsedLv
+				}
 				if podLabels, ok := toReturn[podName]; ok {
 					podLabels[l] = parsedLv
 				} else {
@@ -735,21 +907,36 @@ func labelsFromPrometheusQuery(qr interface{}) (map[string]map[string]string, er
 			}
 		}
 	}
-	return toReturn, nil
+	return toReturn, byUID, nil
 }
 
-func findDeletedNodeInfo(cli prometheusClient.Client, missingNodes map[string]*costAnalyzerCloud.Node, window string) error {
-	if len(missingNodes) > 0 {
-		q := make([]string, 0, len(missingNodes))
-		for nodename := range missingNodes {
-			klog.V(3).Infof("Finding data for deleted node %v", nodename)
-			q = append(q, nodename)
+// nodeKey identifies a node by its cluster, as nodes of the same name may run in each of the clusters scraped by a
+// federated Prometheus
+func nodeKey(clusterID string, nodeName string) string {
+	return clusterID + "," + nodeName
+}
+
+// findDeletedNodeInfo prices the given nodes, keyed by nodeKey, by the average of their historical prices over the
+// window. The prices of each cluster are queried by its cluster label, which the series of the local cluster,
+// localClusterID, may lack.
+func findDeletedNodeInfo(cli prometheusClient.Client, missingNodes map[string]*costAnalyzerCloud.Node, window string, localClusterID string) error {
+	nodesByCluster := make(map[string][]string)
+	for key := range missingNodes {
+		s := strings.SplitN(key, ",", 2)
+		klog.V(3).Infof("Finding data for deleted node %v of cluster %v", s[1], s[0])
+		nodesByCluster[s[0]] = append(nodesByCluster[s[0]], s[1])
+	}
+
+	for cluster, nodeNames := range nodesByCluster {
+		l := strings.Join(nodeNames, "|")
+		clusterMatcher := fmt.Sprintf(`%s="%s"`, clusterLabel, cluster)
+		if cluster == localClusterID {
+			clusterMatcher = fmt.Sprintf(`%s=~"|%s"`, clusterLabel, regexp.QuoteMeta(cluster))
 		}
-		l := strings.Join(q, "|")
 
-		queryHistoricalCPUCost := fmt.Sprintf(`avg_over_time(node_cpu_hourly_cost{instance=~"%s"}[%s])`, l, window)
-		queryHistoricalRAMCost := fmt.Sprintf(`avg_over_time(node_ram_hourly_cost{instance=~"%s"}[%s])`, l, window)
-		queryHistoricalGPUCost := fmt.Sprintf(`avg_over_time(node_gpu_hourly_cost{instance=~"%s"}[%s])`, l, window)
+		queryHistoricalCPUCost := fmt.Sprintf(`avg_over_time(node_cpu_hourly_cost{instance=~"%s",%s}[%s])`, l, clusterMatcher, window)
+		queryHistoricalRAMCost := fmt.Sprintf(`avg_over_time(node_ram_hourly_cost{instance=~"%s",%s}[%s])`, l, clusterMatcher, window)
+		queryHistoricalGPUCost := fmt.Sprintf(`avg_over_time(node_gpu_hourly_cost{instance=~"%s",%s}[%s])`, l, clusterMatcher, window)
 
 		cpuCostResult, err := Query(cli, queryHistoricalCPUCost)
 		if err != nil {
@@ -778,25 +965,24 @@ func findDeletedNodeInfo(cli prometheusClient.Client, missingNodes map[string]*c
 		}
 
 		if len(cpuCosts) == 0 {
-			klog.V(1).Infof("Historical data for node prices not available. Ingest this server's /metrics endpoint to get that data.")
+			klog.V(1).Infof("Historical data for node prices of cluster %s not available. Ingest this server's /metrics endpoint to get that data.", cluster)
 		}
 
 		for node, costv := range cpuCosts {
-			if _, ok := missingNodes[node]; ok {
-				missingNodes[node].VCPUCost = fmt.Sprintf("%f", costv[0].Value)
+			if n, ok := missingNodes[nodeKey(cluster, node)]; ok {
+				n.VCPUCost = fmt.Sprintf("%f", costv[0].Value)
 			}
 		}
 		for node, costv := range ramCosts {
-			if _, ok := missingNodes[node]; ok {
-				missingNodes[node].RAMCost = fmt.Sprintf("%f", costv[0].Value)
+			if n, ok := missingNodes[nodeKey(cluster, node)]; ok {
+				n.RAMCost = fmt.Sprintf("%f", costv[0].Value)
 			}
 		}
 		for node, costv := range gpuCosts {
-			if _, ok := missingNodes[node]; ok {
-				missingNodes[node].GPUCost = fmt.Sprintf("%f", costv[0].Value)
+			if n, ok := missingNodes[nodeKey(cluster, node)]; ok {
+				n.GPUCost = fmt.Sprintf("%f", costv[0].Value)
 			}
 		}
-
 	}
 	return nil
 }
@@ -869,16 +1055,7 @@ func addPVData(cache ClusterCache, pvClaimMapping map[string]*PersistentVolumeCl
 	if err != nil {
 		return err
 	}
-	storageClasses := cache.GetAllStorageClasses()
-	storageClassMap := make(map[string]map[string]string)
-	for _, storageClass := range storageClasses {
-		params := storageClass.Parameters
-		storageClassMap[storageClass.ObjectMeta.Name] = params
-		if storageClass.GetAnnotations()["storageclass.kubernetes.io/is-default-class"] == "true" || storageClass.GetAnnotations()["storageclass.beta.kubernetes.io/is-default-class"] == "true" {
-			storageClassMap["default"] = params
-			storageClassMap[""] = params
-		}
-	}
+	storageClassMap := getStorageClassParameters(cache)
 
 	pvs := cache.GetAllPersistentVolumes()
 	pvMap := make(map[string]*costAnalyzerCloud.PV)
@@ -892,6 +1069,9 @@ func addPVData(cache ClusterCache, pvClaimMapping map[string]*PersistentVolumeCl
 			Region:     pv.Labels[v1.LabelZoneRegion],
 			Parameters: parameters,
 		}
+		if capacity, ok := pv.Spec.Capacity[v1.ResourceStorage]; ok {
+			cacPv.Size = fmt.Sprintf("%d", capacity.Value())
+		}
 		err := GetPVCost(cacPv, pv, cloud)
 		if err != nil {
 			return err
@@ -912,6 +1092,24 @@ func addPVData(cache ClusterCache, pvClaimMapping map[string]*PersistentVolumeCl
 	return nil
 }
 
+// getStorageClassParameters maps each storage class name to its parameters. The default storage class is
+// also listed under "default" and "", for volumes which don't name a class.
+func getStorageClassParameters(cache ClusterCache) map[string]map[string]string {
+	storageClassMap := make(map[string]map[string]string)
+	for _, storageClass := range cache.GetAllStorageClasses() {
+		params := storageClass.Parameters
+		storageClassMap[storageClass.ObjectMeta.Name] = params
+		if storageClass.GetAnnotations()["storageclass.kubernetes.io/is-default-class"] == "true" || storageClass.GetAnnotations()["storageclass.beta.kubernetes.io/is-default-class"] == "true" {
+			storageClassMap["default"] = params
+			storageClassMap[""] = params
+		}
+	}
+	return storageClassMap
+}
+
+// GetPVCost sets the hourly cost per GB of the given volume. When the volume is provisioned with IOPS or
+// throughput that are priced by its storage tier, their cost is spread over its capacity, so that the
+// cost reflects the real rate, and the breakdown is recorded on the volume.
 func GetPVCost(pv *costAnalyzerCloud.PV, kpv *v1.PersistentVolume, cp costAnalyzerCloud.Provider) error {
 	cfg, err := cp.GetConfig()
 	if err != nil {
@@ -923,20 +1121,91 @@ func GetPVCost(pv *costAnalyzerCloud.PV, kpv *v1.PersistentVolume, cp costAnalyz
 		pv.Cost = cfg.Storage
 		return err
 	}
-	if pvWithCost == nil || pvWithCost.Cost == "" {
-		pv.Cost = cfg.Storage
-		return nil // set default cost
+
+	pv.Cost = cfg.Storage // set default cost
+	var tier *costAnalyzerCloud.StorageTier
+	if pvWithCost != nil {
+		if pvWithCost.Cost != "" {
+			pv.Cost = pvWithCost.Cost
+		}
+		tier = pvWithCost.Tier
 	}
-	pv.Cost = pvWithCost.Cost
+
+	classPrices, err := costAnalyzerCloud.StorageClassPricing(cfg)
+	if err != nil {
+		klog.V(1).Infof("Ignoring storage class pricing: %s", err.Error())
+	} else if classPrice, ok := classPrices[kpv.Spec.StorageClassName]; ok {
+		pv.Cost = strconv.FormatFloat(classPrice.StorageCost, 'f', -1, 64)
+		tier = classPrice.Tier
+	}
+
+	if tier == nil {
+		return nil
+	}
+	iops, throughput := costAnalyzerCloud.ProvisionedPerformance(kpv, pv.Parameters)
+	performanceCost := tier.HourlyCost(iops, throughput)
+	storage, ok := kpv.Spec.Capacity[v1.ResourceStorage]
+	if performanceCost == 0 || !ok || storage.Value() == 0 {
+		return nil
+	}
+	storageCost, err := strconv.ParseFloat(pv.Cost, 64)
+	if err != nil {
+		return err
+	}
+
+	pv.StorageCost = pv.Cost
+	pv.PerformanceCost = strconv.FormatFloat(performanceCost, 'f', -1, 64)
+	pv.IOPS = strconv.FormatFloat(iops, 'f', -1, 64)
+	pv.Throughput = strconv.FormatFloat(throughput, 'f', -1, 64)
+	pv.Cost = strconv.FormatFloat(storageCost+performanceCost/(float64(storage.Value())/1024/1024/1024), 'f', -1, 64)
 	return nil
 }
 
+// nodeLabelKeys returns the keys of the node labels carried on priced nodes: those naming their pool, and those
+// selected by the custom prices of the given config
+func nodeLabelKeys(cfg *costAnalyzerCloud.CustomPricing) map[string]bool {
+	keys := make(map[string]bool)
+	for _, k := range costAnalyzerCloud.NodePoolLabels {
+		keys[k] = true
+	}
+	selectors, err := costAnalyzerCloud.CustomPriceSelectors(cfg)
+	if err != nil {
+		klog.V(1).Infof("Ignoring custom prices by label: %s", err.Error())
+		return keys
+	}
+	for _, selector := range selectors {
+		for k := range selector.Selector {
+			keys[k] = true
+		}
+	}
+	return keys
+}
+
 func getNodeCost(cache ClusterCache, cp costAnalyzerCloud.Provider) (map[string]*costAnalyzerCloud.Node, error) {
 	cfg, err := cp.GetConfig()
 	if err != nil {
 		return nil, err
 	}
 
+	spotLabels, err := costAnalyzerCloud.SpotNodeLabels(cfg)
+	if err != nil {
+		klog.V(1).Infof("Using default spot node labels: %s", err.Error())
+		spotLabels = nil
+	}
+
+	customGPUPricing, err := costAnalyzerCloud.CustomGPUPricing(cfg)
+	if err != nil {
+		klog.V(1).Infof("Ignoring configured GPU model prices: %s", err.Error())
+		customGPUPricing = nil
+	}
+	gpuPricing, err := cp.GPUPricing()
+	if err != nil {
+		klog.V(1).Infof("Ignoring GPU model prices: %s", err.Error())
+		gpuPricing = nil
+	}
+
+	labelKeys := nodeLabelKeys(cfg)
+
 	nodeList := cache.GetAllNodes()
 	nodes := make(map[string]*costAnalyzerCloud.Node)
 
@@ -952,6 +1221,17 @@ func getNodeCost(cache ClusterCache, cp costAnalyzerCloud.Provider) (map[string]
 			continue
 		}
 		newCnode := *cnode
+		newCnode.Labels = make(map[string]string)
+		for k, v := range nodeLabels {
+			if labelKeys[k] {
+				newCnode.Labels[k] = v
+			}
+		}
+		if costAnalyzerCloud.IsSpotNode(nodeLabels, spotLabels) {
+			newCnode.Lifecycle = costAnalyzerCloud.LifecycleSpot
+		} else if newCnode.Lifecycle == "" {
+			newCnode.Lifecycle = costAnalyzerCloud.LifecycleForUsageType(newCnode.UsageType)
+		}
 
 		var cpu float64
 		if newCnode.VCPU == "" {
@@ -968,6 +1248,18 @@ func getNodeCost(cache ClusterCache, cp costAnalyzerCloud.Provider) (map[string]
 		ram = float64(n.Status.Capacity.Memory().Value())
 		newCnode.RAMBytes = fmt.Sprintf("%f", ram)
 
+		if newCnode.GPUName == "" {
+			newCnode.GPUName = costAnalyzerCloud.GPUModel(nodeLabels)
+		}
+
+		if newCnode.GPU != "" && newCnode.GPUCost != "" && newCnode.RateOverride == "" {
+			// The provider priced the gpu itself, but configured prices for its model take precedence, unless
+			// it is priced by a rate override
+			if gpuPrice, ok := customGPUPricing.Cost(newCnode.GPUName, newCnode.IsSpot()); ok {
+				newCnode.GPUCost = fmt.Sprintf("%f", gpuPrice)
+			}
+		}
+
 		if newCnode.GPU != "" && newCnode.GPUCost == "" {
 			// We couldn't find a gpu cost, so fix cpu and ram, then accordingly
 			klog.V(4).Infof("GPU without cost found for %s, calculating...", cp.GetKey(nodeLabels).Features())
@@ -984,7 +1276,7 @@ func getNodeCost(cache ClusterCache, cp costAnalyzerCloud.Provider) (map[string]
 				return nil, err
 			}
 
-			defaultGPU, err := strconv.ParseFloat(cfg.RAM, 64)
+			defaultGPU, err := strconv.ParseFloat(cfg.GPU, 64)
 			if err != nil {
 				klog.V(3).Infof("Could not parse default gpu price")
 				return nil, err
@@ -993,8 +1285,7 @@ func getNodeCost(cache ClusterCache, cp costAnalyzerCloud.Provider) (map[string]
 			cpuToRAMRatio := defaultCPU / defaultRAM
 			gpuToRAMRatio := defaultGPU / defaultRAM
 
-			ramGB := ram / 1024 / 1024 / 1024
-			ramMultiple := gpuToRAMRatio + cpu*cpuToRAMRatio + ramGB
+			ramGB := ram / costAnalyzerCloud.RAMBytesPerGB(cfg)
 
 			var nodePrice float64
 			if newCnode.Cost != "" {
@@ -1011,9 +1302,20 @@ func getNodeCost(cache ClusterCache, cp costAnalyzerCloud.Provider) (map[string]
 				}
 			}
 
-			ramPrice := (nodePrice / ramMultiple)
-			cpuPrice := ramPrice * cpuToRAMRatio
-			gpuPrice := ramPrice * gpuToRAMRatio
+			var ramPrice, cpuPrice, gpuPrice float64
+			gpuCount, _ := strconv.ParseFloat(newCnode.GPU, 64)
+			modelPrice, ok := gpuPricing.Cost(newCnode.GPUName, newCnode.IsSpot())
+			if ok && gpuCount > 0 && gpuCount*modelPrice < nodePrice {
+				// Price the gpus by their model, and split the rest of the node price across cpu and ram
+				gpuPrice = modelPrice
+				ramPrice = (nodePrice - gpuCount*gpuPrice) / (cpu*cpuToRAMRatio + ramGB)
+				cpuPrice = ramPrice * cpuToRAMRatio
+			} else {
+				ramMultiple := gpuToRAMRatio + cpu*cpuToRAMRatio + ramGB
+				ramPrice = (nodePrice / ramMultiple)
+				cpuPrice = ramPrice * cpuToRAMRatio
+				gpuPrice = ramPrice * gpuToRAMRatio
+			}
 
 			newCnode.VCPUCost = fmt.Sprintf("%f", cpuPrice)
 			newCnode.RAMCost = fmt.Sprintf("%f", ramPrice)
@@ -1036,7 +1338,7 @@ func getNodeCost(cache ClusterCache, cp costAnalyzerCloud.Provider) (map[string]
 			}
 
 			cpuToRAMRatio := defaultCPU / defaultRAM
-			ramGB := ram / 1024 / 1024 / 1024
+			ramGB := ram / costAnalyzerCloud.RAMBytesPerGB(cfg)
 			ramMultiple := cpu*cpuToRAMRatio + ramGB
 
 			var nodePrice float64
@@ -1067,6 +1369,8 @@ func getNodeCost(cache ClusterCache, cp costAnalyzerCloud.Provider) (map[string]
 		nodes[name] = &newCnode
 	}
 
+	applyReservations(nodes, nodeList, cfg)
+
 	return nodes, nil
 }
 
@@ -1121,6 +1425,13 @@ func getPodDeployments(cache ClusterCache, podList []*v1.Pod) (map[string]map[st
 			}
 		}
 	}
+
+	// deployments are listed in no particular order, so are sorted for pods selected by more than one
+	for _, pods := range podDeploymentsMapping {
+		for _, deployments := range pods {
+			sort.Strings(deployments)
+		}
+	}
 	return podDeploymentsMapping, nil
 }
 
@@ -1131,142 +1442,166 @@ func costDataPassesFilters(costs *CostData, namespace string, cluster string) bo
 	return passesNamespace && passesCluster
 }
 
+// RemoteCostDataRange reads the cost data from start to end, in steps of the window, from the remote database to
+// which clusters write their metrics, without querying Prometheus
+func RemoteCostDataRange(start, end time.Time, windowString string, filterNamespace string, filterCluster string) (map[string]*CostData, error) {
+	remoteLayout := "2006-01-02T15:04:05Z"
+	remoteStartStr := start.UTC().Format(remoteLayout)
+	remoteEndStr := end.UTC().Format(remoteLayout)
+	klog.V(1).Infof("Using remote database for query from %s to %s with window %s", remoteStartStr, remoteEndStr, windowString)
+	data, err := CostDataRangeFromSQL("", "", windowString, remoteStartStr, remoteEndStr)
+	if err != nil {
+		return nil, err
+	}
+	for key, costs := range data {
+		if !costDataPassesFilters(costs, filterNamespace, filterCluster) {
+			delete(data, key)
+		}
+	}
+	return data, nil
+}
+
 func (cm *CostModel) ComputeCostDataRange(cli prometheusClient.Client, clientset kubernetes.Interface, cp costAnalyzerCloud.Provider,
-	startString, endString, windowString string, filterNamespace string, filterCluster string, remoteEnabled bool) (map[string]*CostData, error) {
+	startString, endString, windowString string, filterNamespace string, filterCluster string, remoteEnabled bool, allowPartial bool) (map[string]*CostData, []string, error) {
 	queryRAMRequests := fmt.Sprintf(queryRAMRequestsStr, windowString, "", windowString, "")
 	queryRAMUsage := fmt.Sprintf(queryRAMUsageStr, windowString, "", windowString, "")
 	queryCPURequests := fmt.Sprintf(queryCPURequestsStr, windowString, "", windowString, "")
-	queryCPUUsage := fmt.Sprintf(queryCPUUsageStr, windowString, "")
+	queryCPUUsage := fmt.Sprintf(queryCPUUsageRangeStr, windowString, "", windowString, "")
 	queryGPURequests := fmt.Sprintf(queryGPURequestsStr, windowString, "", windowString, "")
 	queryPVRequests := fmt.Sprintf(queryPVRequestsStr)
 	queryNetZoneRequests := fmt.Sprintf(queryZoneNetworkUsage, windowString, "")
 	queryNetRegionRequests := fmt.Sprintf(queryRegionNetworkUsage, windowString, "")
 	queryNetInternetRequests := fmt.Sprintf(queryInternetNetworkUsage, windowString, "")
+	queryNetTransmit := fmt.Sprintf(queryPodNetworkTransmit, windowString, "")
 	normalization := fmt.Sprintf(normalizationStr, windowString, "")
+	egressSplit := networkEgressSplit(cp)
 
 	layout := "2006-01-02T15:04:05.000Z"
 
 	start, err := time.Parse(layout, startString)
 	if err != nil {
 		klog.V(1).Infof("Error parsing time " + startString + ". Error: " + err.Error())
-		return nil, err
+		return nil, nil, err
 	}
 	end, err := time.Parse(layout, endString)
 	if err != nil {
 		klog.V(1).Infof("Error parsing time " + endString + ". Error: " + err.Error())
-		return nil, err
+		return nil, nil, err
 	}
 	window, err := time.ParseDuration(windowString)
 	if err != nil {
 		klog.V(1).Infof("Error parsing time " + windowString + ". Error: " + err.Error())
-		return nil, err
+		return nil, nil, err
 	}
-	clusterName := cloud.ClusterName(cp)
+	// Containers without a cluster label run in the local cluster
+	clusterID := LocalClusterID(cp)
 	if remoteEnabled == true {
-		remoteLayout := "2006-01-02T15:04:05Z"
-		remoteStartStr := start.Format(remoteLayout)
-		remoteEndStr := end.Format(remoteLayout)
-		klog.V(1).Infof("Using remote database for query from %s to %s with window %s", startString, endString, windowString)
-		return CostDataRangeFromSQL("", "", windowString, remoteStartStr, remoteEndStr)
-	}
+		data, err := RemoteCostDataRange(start, end, windowString, filterNamespace, filterCluster)
+		return data, nil, err
+	}
+
+	maxSpan := MaxQueryRangeSpan()
+	var warnings warningSet
+
+	// the queries below are independent of each other, so they are dispatched concurrently, bounded by
+	// MAX_QUERY_CONCURRENCY so a single long range request doesn't flood prometheus. The first failure
+	// cancels the queries which are still waiting or in flight.
+	g, ctx := errgroup.WithContext(context.Background())
+	sem := make(chan struct{}, MaxQueryConcurrency())
+	promQuery := func(result *interface{}, query func() (interface{}, error)) {
+		g.Go(func() error {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			defer func() { <-sem }()
+			if err := ctx.Err(); err != nil {
+				return err
+			}
 
-	var wg sync.WaitGroup
-	wg.Add(11)
+			res, err := query()
+			if err != nil {
+				return NewCodedError(ErrorCodePromUnavailable, fmt.Errorf("Error querying prometheus: %s", err.Error()))
+			}
+			*result = res
+			return nil
+		})
+	}
+	queryRange := func(result *interface{}, query string) {
+		promQuery(result, func() (interface{}, error) {
+			res, w, err := QueryRangeWithRetention(ctx, cli, cm.LongTermPrometheusClient, cm.LocalRetention, query, start, end, window, maxSpan, allowPartial)
+			warnings.add(w)
+			return res, err
+		})
+	}
 
-	var promErr error
 	var resultRAMRequests interface{}
-	go func() {
-		resultRAMRequests, promErr = QueryRange(cli, queryRAMRequests, start, end, window)
-		defer wg.Done()
-	}()
+	queryRange(&resultRAMRequests, queryRAMRequests)
 	var resultRAMUsage interface{}
-	go func() {
-		resultRAMUsage, promErr = QueryRange(cli, queryRAMUsage, start, end, window)
-		defer wg.Done()
-	}()
+	queryRange(&resultRAMUsage, queryRAMUsage)
 	var resultCPURequests interface{}
-	go func() {
-		resultCPURequests, promErr = QueryRange(cli, queryCPURequests, start, end, window)
-		defer wg.Done()
-	}()
+	queryRange(&resultCPURequests, queryCPURequests)
 	var resultCPUUsage interface{}
-	go func() {
-		resultCPUUsage, promErr = QueryRange(cli, queryCPUUsage, start, end, window)
-		defer wg.Done()
-	}()
+	queryRange(&resultCPUUsage, queryCPUUsage)
 	var resultGPURequests interface{}
-	go func() {
-		resultGPURequests, promErr = QueryRange(cli, queryGPURequests, start, end, window)
-		defer wg.Done()
-	}()
+	queryRange(&resultGPURequests, queryGPURequests)
 	var resultPVRequests interface{}
-	go func() {
-		resultPVRequests, promErr = QueryRange(cli, queryPVRequests, start, end, window)
-		defer wg.Done()
-	}()
+	queryRange(&resultPVRequests, queryPVRequests)
 	var resultNetZoneRequests interface{}
-	go func() {
-		resultNetZoneRequests, promErr = QueryRange(cli, queryNetZoneRequests, start, end, window)
-		defer wg.Done()
-	}()
+	queryRange(&resultNetZoneRequests, queryNetZoneRequests)
 	var resultNetRegionRequests interface{}
-	go func() {
-		resultNetRegionRequests, promErr = QueryRange(cli, queryNetRegionRequests, start, end, window)
-		defer wg.Done()
-	}()
+	queryRange(&resultNetRegionRequests, queryNetRegionRequests)
 	var resultNetInternetRequests interface{}
-	go func() {
-		resultNetInternetRequests, promErr = QueryRange(cli, queryNetInternetRequests, start, end, window)
-		defer wg.Done()
-	}()
+	queryRange(&resultNetInternetRequests, queryNetInternetRequests)
+	var resultNetTransmit interface{}
+	if egressSplit != nil {
+		queryRange(&resultNetTransmit, queryNetTransmit)
+	}
 	var normalizationResult interface{}
-	go func() {
-		normalizationResult, promErr = Query(cli, normalization)
-		defer wg.Done()
-	}()
+	promQuery(&normalizationResult, func() (interface{}, error) {
+		res, err := queryWithContext(ctx, cli, normalization)
+		if err == nil {
+			warnings.add(responseWarnings(res))
+		}
+		return res, err
+	})
 
 	podDeploymentsMapping := make(map[string]map[string][]string)
 	podServicesMapping := make(map[string]map[string][]string)
 	namespaceLabelsMapping := make(map[string]map[string]string)
 	podlist := cm.Cache.GetAllPods()
-	var k8sErr error
-	go func() {
-
+	g.Go(func() error {
+		var k8sErr error
 		podDeploymentsMapping, k8sErr = getPodDeployments(cm.Cache, podlist)
 		if k8sErr != nil {
-			return
+			return fmt.Errorf("Error querying the kubernetes api: %s", k8sErr.Error())
 		}
 
 		podServicesMapping, k8sErr = getPodServices(cm.Cache, podlist)
 		if k8sErr != nil {
-			return
+			return fmt.Errorf("Error querying the kubernetes api: %s", k8sErr.Error())
 		}
 		namespaceLabelsMapping, k8sErr = getNamespaceLabels(cm.Cache)
 		if k8sErr != nil {
-			return
+			return fmt.Errorf("Error querying the kubernetes api: %s", k8sErr.Error())
 		}
+		return nil
+	})
 
-		wg.Done()
-	}()
-
-	wg.Wait()
-
-	if promErr != nil {
-		return nil, fmt.Errorf("Error querying prometheus: %s", promErr.Error())
-	}
-	if k8sErr != nil {
-		return nil, fmt.Errorf("Error querying the kubernetes api: %s", k8sErr.Error())
+	if err := g.Wait(); err != nil {
+		return nil, nil, err
 	}
 
 	normalizationValue, err := getNormalization(normalizationResult)
 	if err != nil {
-		return nil, fmt.Errorf("Error parsing normalization values: " + err.Error())
+		return nil, nil, fmt.Errorf("Error parsing normalization values: " + err.Error())
 	}
 
 	nodes, err := getNodeCost(cm.Cache, cp)
 	if err != nil {
 		klog.V(1).Infof("Warning, no cost model available: " + err.Error())
-		return nil, err
+		return nil, nil, NewCodedError(ErrorCodePricingMissing, err)
 	}
 
 	pvClaimMapping, err := getPVInfoVectors(resultPVRequests)
@@ -1277,7 +1612,7 @@ func (cm *CostModel) ComputeCostDataRange(cli prometheusClient.Client, clientset
 	if pvClaimMapping != nil {
 		err = addPVData(cm.Cache, pvClaimMapping, cp)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 	}
 
@@ -1286,63 +1621,78 @@ func (cm *CostModel) ComputeCostDataRange(cli prometheusClient.Client, clientset
 		klog.V(1).Infof("Unable to get Network Cost Data: %s", err.Error())
 		networkUsageMap = make(map[string]*NetworkUsageData)
 	}
+	if egressSplit != nil {
+		if err := estimateNetworkUsageData(networkUsageMap, resultNetTransmit, egressSplit, true); err != nil {
+			klog.V(1).Infof("Unable to estimate Network Cost Data: %s", err.Error())
+		}
+	}
 
 	containerNameCost := make(map[string]*CostData)
 	containers := make(map[string]bool)
 
-	RAMReqMap, err := GetContainerMetricVectors(resultRAMRequests, true, normalizationValue)
+	RAMReqMap, err := getContainerMetricVectors(resultRAMRequests, true, normalizationValue, clusterID)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	for key := range RAMReqMap {
 		containers[key] = true
 	}
 
-	RAMUsedMap, err := GetContainerMetricVectors(resultRAMUsage, true, normalizationValue)
+	RAMUsedMap, err := getContainerMetricVectors(resultRAMUsage, true, normalizationValue, clusterID)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	for key := range RAMUsedMap {
 		containers[key] = true
 	}
-	CPUReqMap, err := GetContainerMetricVectors(resultCPURequests, true, normalizationValue)
+	CPUReqMap, err := getContainerMetricVectors(resultCPURequests, true, normalizationValue, clusterID)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	for key := range CPUReqMap {
 		containers[key] = true
 	}
-	GPUReqMap, err := GetContainerMetricVectors(resultGPURequests, true, normalizationValue)
+	GPUReqMap, err := getContainerMetricVectors(resultGPURequests, true, normalizationValue, clusterID)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	for key := range GPUReqMap {
 		containers[key] = true
 	}
-	CPUUsedMap, err := GetContainerMetricVectors(resultCPUUsage, false, 0) // No need to normalize here, as this comes from a counter
+	CPUUsedMap, err := getContainerMetricVectors(resultCPUUsage, true, normalizationValue, clusterID)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	for key := range CPUUsedMap {
 		containers[key] = true
 	}
+	intervals := rangeIntervals(start, end, window)
 	currentContainers := make(map[string]v1.Pod)
+	currentPods := make(map[string]v1.Pod)
 	for _, pod := range podlist {
-		if pod.Status.Phase != v1.PodRunning {
+		// pods which have completed, e.g. those of jobs, are costed by their metrics within the window like running
+		// ones, keeping their metadata, but are left out if they have none, unless their statuses show they ran in
+		// the window, e.g. for less than a scrape interval
+		terminated := pod.Status.Phase == v1.PodSucceeded || pod.Status.Phase == v1.PodFailed
+		if pod.Status.Phase != v1.PodRunning && !terminated {
 			continue
 		}
-		cs, err := newContainerMetricsFromPod(*pod)
+		cs, err := newContainerMetricsFromPod(clusterID, *pod)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		for _, c := range cs {
-			containers[c.Key()] = true // captures any containers that existed for a time < a prometheus scrape interval. We currently charge 0 for this but should charge something.
+			if !terminated || ranWithin(pod, intervals) {
+				containers[c.Key()] = true // captures any containers that existed for a time < a prometheus scrape interval. We currently charge 0 for this but should charge something.
+			}
 			currentContainers[c.Key()] = *pod
 		}
+		currentPods[pod.GetObjectMeta().GetNamespace()+","+pod.GetObjectMeta().GetName()] = *pod
 	}
 
 	missingNodes := make(map[string]*costAnalyzerCloud.Node)
 	missingContainers := make(map[string]*CostData)
+	historicalContainers := make(map[string]*CostData) // of pods not in the cluster cache, including missingContainers
 	for key := range containers {
 		if _, ok := containerNameCost[key]; ok {
 			continue // because ordering is important for the allocation model (all PV's applied to the first), just dedupe if it's already been added.
@@ -1410,7 +1760,7 @@ func (cm *CostModel) ComputeCostDataRange(cli prometheusClient.Client, clientset
 			for i, container := range pod.Spec.Containers {
 				containerName := container.Name
 
-				newKey := newContainerMetricFromValues(ns, podName, containerName, pod.Spec.NodeName).Key()
+				newKey := newContainerMetricFromValues(clusterID, ns, podName, containerName, pod.Spec.NodeName).Key()
 
 				RAMReqV, ok := RAMReqMap[newKey]
 				if !ok {
@@ -1447,7 +1797,9 @@ func (cm *CostModel) ComputeCostDataRange(cli prometheusClient.Client, clientset
 
 				costs := &CostData{
 					Name:            containerName,
+					Image:           container.Image,
 					PodName:         podName,
+					PodUID:          string(pod.GetObjectMeta().GetUID()),
 					NodeName:        nodeName,
 					Namespace:       ns,
 					Deployments:     podDeployments,
@@ -1463,9 +1815,10 @@ func (cm *CostModel) ComputeCostDataRange(cli prometheusClient.Client, clientset
 					GPUReq:          GPUReqV,
 					PVCData:         pvReq,
 					Labels:          podLabels,
+					Annotations:     costDataAnnotations(pod),
 					NetworkData:     netReq,
 					NamespaceLabels: nsLabels,
-					ClusterID:       clusterName,
+					ClusterID:       clusterID,
 				}
 				costs.CPUAllocation = getContainerAllocation(costs.CPUReq, costs.CPUUsed)
 				costs.RAMAllocation = getContainerAllocation(costs.RAMReq, costs.RAMUsed)
@@ -1505,14 +1858,19 @@ func (cm *CostModel) ComputeCostDataRange(cli prometheusClient.Client, clientset
 				CPUUsedV = []*Vector{}
 			}
 
-			node, ok := nodes[c.NodeName]
+			// only the nodes of the local cluster are cached; those of other clusters are priced from their history
+			var node *costAnalyzerCloud.Node
+			ok = false
+			if c.ClusterID == clusterID {
+				node, ok = nodes[c.NodeName]
+			}
 			if !ok {
-				klog.V(2).Infof("Node \"%s\" has been deleted from Kubernetes. Query historical data to get it.", c.NodeName)
-				if n, ok := missingNodes[c.NodeName]; ok {
+				klog.V(2).Infof("Node \"%s\" of cluster \"%s\" is not in the cluster cache. Query historical data to get it.", c.NodeName, c.ClusterID)
+				if n, ok := missingNodes[nodeKey(c.ClusterID, c.NodeName)]; ok {
 					node = n
 				} else {
 					node = &costAnalyzerCloud.Node{}
-					missingNodes[c.NodeName] = node
+					missingNodes[nodeKey(c.ClusterID, c.NodeName)] = node
 				}
 			}
 			namespacelabels, ok := namespaceLabelsMapping[c.Namespace]
@@ -1531,33 +1889,46 @@ func (cm *CostModel) ComputeCostDataRange(cli prometheusClient.Client, clientset
 				CPUUsed:         CPUUsedV,
 				GPUReq:          GPUReqV,
 				NamespaceLabels: namespacelabels,
-				ClusterID:       clusterName,
+				ClusterID:       c.ClusterID,
 			}
 			costs.CPUAllocation = getContainerAllocation(costs.CPUReq, costs.CPUUsed)
 			costs.RAMAllocation = getContainerAllocation(costs.RAMReq, costs.RAMUsed)
+			pod, rescheduled := currentPods[c.Namespace+","+c.PodName]
+			rescheduled = rescheduled && c.ClusterID == clusterID
+			if rescheduled {
+				setRescheduledPodMetadata(costs, pod, podDeploymentsMapping, podServicesMapping, namespacelabels)
+			}
 
 			if costDataPassesFilters(costs, filterNamespace, filterCluster) {
 				containerNameCost[key] = costs
-				missingContainers[key] = costs
+				historicalContainers[key] = costs
+				if !rescheduled {
+					missingContainers[key] = costs
+				}
 			}
 		}
 	}
+	correctPartialIntervals(containerNameCost, podlist, clusterID, intervals)
+	addInitContainers(containerNameCost, podlist, clusterID, intervals)
+	addPodOverhead(containerNameCost, podlist, clusterID, intervals)
 
 	w := end.Sub(start)
 	w += window
 	if w.Minutes() > 0 {
 		wStr := fmt.Sprintf("%dm", int(w.Minutes()))
-		err = findDeletedNodeInfo(cli, missingNodes, wStr)
+		err = findDeletedNodeInfo(cli, missingNodes, wStr, clusterID)
 		if err != nil {
 			klog.V(1).Infof("Error fetching historical node data: %s", err.Error())
 		}
+		resolveJobOwners(cli, cm.Cache, containerNameCost, missingContainers, wStr)
+		resolvePodUIDs(cli, historicalContainers, wStr)
 		err = findDeletedPodInfo(cli, missingContainers, wStr)
 		if err != nil {
 			klog.V(1).Infof("Error fetching historical pod data: %s", err.Error())
 		}
 	}
 
-	return containerNameCost, err
+	return containerNameCost, warnings.list(), err
 }
 
 func getNamespaceLabels(cache ClusterCache) (map[string]map[string]string, error) {
@@ -1570,30 +1941,87 @@ func getNamespaceLabels(cache ClusterCache) (map[string]map[string]string, error
 }
 
 func getDaemonsetsOfPod(pod v1.Pod) []string {
-	for _, ownerReference := range pod.ObjectMeta.OwnerReferences {
-		if ownerReference.Kind == "DaemonSet" {
-			return []string{ownerReference.Name}
+	return PodControllers(pod, "DaemonSet")
+}
+
+// setRescheduledPodMetadata sets the metadata of the given pod on the cost data of one of its containers on a
+// node it has since been rescheduled from, e.g. the pod of a StatefulSet, which keeps its name. Container data is
+// keyed by node, so that the samples on each node are priced by its rates, but belong to the same pod, so that it
+// aggregates as one. The node of costs is kept.
+func setRescheduledPodMetadata(costs *CostData, pod v1.Pod, podDeploymentsMapping map[string]map[string][]string, podServicesMapping map[string]map[string][]string, nsLabels map[string]string) {
+	ns := pod.GetObjectMeta().GetNamespace()
+	name := pod.GetObjectMeta().GetName()
+	costs.Deployments = podDeploymentsMapping[ns][name]
+	costs.Services = podServicesMapping[ns][name]
+	costs.Daemonsets = getDaemonsetsOfPod(pod)
+	costs.Jobs = getJobsOfPod(pod)
+	costs.Statefulsets = getStatefulSetsOfPod(pod)
+	costs.Annotations = costDataAnnotations(pod)
+
+	labels := make(map[string]string)
+	for k, v := range pod.GetObjectMeta().GetLabels() {
+		labels[k] = v
+	}
+	for k, v := range nsLabels {
+		if _, ok := labels[k]; !ok {
+			labels[k] = v
 		}
 	}
-	return []string{}
+	costs.Labels = labels
 }
 
-func getJobsOfPod(pod v1.Pod) []string {
-	for _, ownerReference := range pod.ObjectMeta.OwnerReferences {
-		if ownerReference.Kind == "Job" {
-			return []string{ownerReference.Name}
+// lastAppliedConfigAnnotation is the annotation by which kubectl records the last configuration applied to an
+// object, which is too large to carry on cost data
+const lastAppliedConfigAnnotation = "kubectl.kubernetes.io/last-applied-configuration"
+
+// costDataAnnotations returns the annotations of the given pod which are carried on its cost data, by which it
+// may be aggregated
+func costDataAnnotations(pod v1.Pod) map[string]string {
+	if len(pod.Annotations) == 0 {
+		return nil
+	}
+	annotations := make(map[string]string, len(pod.Annotations))
+	for k, v := range pod.Annotations {
+		if k != lastAppliedConfigAnnotation {
+			annotations[k] = v
 		}
 	}
-	return []string{}
+	return annotations
+}
+
+func getJobsOfPod(pod v1.Pod) []string {
+	return PodControllers(pod, "Job")
 }
 
 func getStatefulSetsOfPod(pod v1.Pod) []string {
-	for _, ownerReference := range pod.ObjectMeta.OwnerReferences {
-		if ownerReference.Kind == "StatefulSet" {
-			return []string{ownerReference.Name}
+	return PodControllers(pod, "StatefulSet")
+}
+
+// PodControllers returns the names of the owners of the given kind of the pod, starting with its managing
+// controller if it is of that kind, and then in order of name, so that pods owned by more than one are
+// consistently aggregated by the first
+func PodControllers(pod v1.Pod, kind string) []string {
+	return ownerControllers(pod.ObjectMeta.OwnerReferences, kind)
+}
+
+func ownerControllers(ownerReferences []metav1.OwnerReference, kind string) []string {
+	controller := ""
+	owners := []string{}
+	for _, ownerReference := range ownerReferences {
+		if ownerReference.Kind != kind {
+			continue
+		}
+		if controller == "" && ownerReference.Controller != nil && *ownerReference.Controller {
+			controller = ownerReference.Name
+			continue
 		}
+		owners = append(owners, ownerReference.Name)
+	}
+	sort.Strings(owners)
+	if controller != "" {
+		owners = append([]string{controller}, owners...)
 	}
-	return []string{}
+	return owners
 }
 
 type PersistentVolumeClaimData struct {
@@ -1836,12 +2264,17 @@ func getPVInfoVector(qr interface{}) (map[string]*PersistentVolumeClaimData, err
 }
 
 func QueryRange(cli prometheusClient.Client, query string, start, end time.Time, step time.Duration) (interface{}, error) {
+	return queryRangeWithContext(context.Background(), cli, query, start, end, step)
+}
+
+func queryRangeWithContext(ctx context.Context, cli prometheusClient.Client, query string, start, end time.Time, step time.Duration) (interface{}, error) {
 	u := cli.URL(epQueryRange, nil)
 	q := u.Query()
 	q.Set("query", query)
 	q.Set("start", start.Format(time.RFC3339Nano))
 	q.Set("end", end.Format(time.RFC3339Nano))
 	q.Set("step", strconv.FormatFloat(step.Seconds(), 'f', 3, 64))
+	setThanosQueryParams(q)
 	u.RawQuery = q.Encode()
 
 	req, err := http.NewRequest(http.MethodPost, u.String(), nil)
@@ -1849,25 +2282,49 @@ func QueryRange(cli prometheusClient.Client, query string, start, end time.Time,
 		return nil, err
 	}
 
-	resp, body, warnings, err := cli.Do(context.Background(), req)
+	release, err := acquirePrometheusQuery(ctx)
+	if err != nil {
+		return nil, NewCodedError(ErrorCodePromUnavailable, fmt.Errorf("Error waiting to fetch query %s: %s", query, err.Error()))
+	}
+	resp, body, warnings, err := cli.Do(ctx, req)
+	release()
 	for _, w := range warnings {
 		klog.V(3).Infof("%s", w)
 	}
 	if err != nil {
-		return nil, fmt.Errorf("%s Error %s fetching query %s", resp.StatusCode, err.Error(), query)
+		if resp == nil {
+			return nil, NewCodedError(ErrorCodePromUnavailable, fmt.Errorf("Error %s fetching query %s", err.Error(), query))
+		}
+		return nil, NewCodedError(ErrorCodePromUnavailable, fmt.Errorf("%d Error %s fetching query %s", resp.StatusCode, err.Error(), query))
 	}
 	var toReturn interface{}
 	err = json.Unmarshal(body, &toReturn)
 	if err != nil {
 		return nil, fmt.Errorf("Error %s fetching query %s", err.Error(), query)
 	}
+	if ThanosEnabled() {
+		toReturn = dedupReplicaSeries(toReturn, ThanosReplicaLabels())
+	}
 	return toReturn, err
 }
 
 func Query(cli prometheusClient.Client, query string) (interface{}, error) {
+	return queryWithContext(context.Background(), cli, query)
+}
+
+func queryWithContext(ctx context.Context, cli prometheusClient.Client, query string) (interface{}, error) {
+	return queryAtWithContext(ctx, cli, query, time.Time{})
+}
+
+// queryAtWithContext evaluates the given instant query at the given time, or at the time of the query if it's zero
+func queryAtWithContext(ctx context.Context, cli prometheusClient.Client, query string, at time.Time) (interface{}, error) {
 	u := cli.URL(epQuery, nil)
 	q := u.Query()
 	q.Set("query", query)
+	if !at.IsZero() {
+		q.Set("time", at.UTC().Format(time.RFC3339Nano))
+	}
+	setThanosQueryParams(q)
 	u.RawQuery = q.Encode()
 
 	req, err := http.NewRequest(http.MethodPost, u.String(), nil)
@@ -1875,18 +2332,29 @@ func Query(cli prometheusClient.Client, query string) (interface{}, error) {
 		return nil, err
 	}
 
-	resp, body, warnings, err := cli.Do(context.Background(), req)
+	release, err := acquirePrometheusQuery(ctx)
+	if err != nil {
+		return nil, NewCodedError(ErrorCodePromUnavailable, fmt.Errorf("Error waiting to fetch query %s: %s", query, err.Error()))
+	}
+	resp, body, warnings, err := cli.Do(ctx, req)
+	release()
 	for _, w := range warnings {
 		klog.V(3).Infof("%s", w)
 	}
 	if err != nil {
-		return nil, fmt.Errorf("%s Error %s fetching query %s", resp.StatusCode, err.Error(), query)
+		if resp == nil {
+			return nil, NewCodedError(ErrorCodePromUnavailable, fmt.Errorf("Error %s fetching query %s", err.Error(), query))
+		}
+		return nil, NewCodedError(ErrorCodePromUnavailable, fmt.Errorf("%d Error %s fetching query %s", resp.StatusCode, err.Error(), query))
 	}
 	var toReturn interface{}
 	err = json.Unmarshal(body, &toReturn)
 	if err != nil {
 		return nil, fmt.Errorf("Error %s fetching query %s", err.Error(), query)
 	}
+	if ThanosEnabled() {
+		toReturn = dedupReplicaSeries(toReturn, ThanosReplicaLabels())
+	}
 	return toReturn, nil
 }
 
@@ -1916,7 +2384,10 @@ func getNormalization(qr interface{}) (float64, error) {
 	return 0, fmt.Errorf("Normalization data is empty, kube-state-metrics or node-exporter may not be running")
 }
 
+// ContainerMetric identifies a container, by the cluster it runs in so that the containers of the clusters
+// scraped by a federated Prometheus are told apart
 type ContainerMetric struct {
+	ClusterID     string
 	Namespace     string
 	PodName       string
 	ContainerName string
@@ -1924,9 +2395,11 @@ type ContainerMetric struct {
 }
 
 func (c *ContainerMetric) Key() string {
-	return c.Namespace + "," + c.PodName + "," + c.ContainerName + "," + c.NodeName
+	return c.ClusterID + "," + c.Namespace + "," + c.PodName + "," + c.ContainerName + "," + c.NodeName
 }
 
+// NewContainerMetricFromKey parses the given key of a container. Keys from before containers were identified by
+// their cluster, "namespace,pod,container,node", are accepted, without a cluster.
 func NewContainerMetricFromKey(key string) (*ContainerMetric, error) {
 	s := strings.Split(key, ",")
 	if len(s) == 4 {
@@ -1937,11 +2410,21 @@ func NewContainerMetricFromKey(key string) (*ContainerMetric, error) {
 			NodeName:      s[3],
 		}, nil
 	}
+	if len(s) == 5 {
+		return &ContainerMetric{
+			ClusterID:     s[0],
+			Namespace:     s[1],
+			PodName:       s[2],
+			ContainerName: s[3],
+			NodeName:      s[4],
+		}, nil
+	}
 	return nil, fmt.Errorf("Not a valid key")
 }
 
-func newContainerMetricFromValues(ns string, podName string, containerName string, nodeName string) *ContainerMetric {
+func newContainerMetricFromValues(clusterID string, ns string, podName string, containerName string, nodeName string) *ContainerMetric {
 	return &ContainerMetric{
+		ClusterID:     clusterID,
 		Namespace:     ns,
 		PodName:       podName,
 		ContainerName: containerName,
@@ -1949,7 +2432,7 @@ func newContainerMetricFromValues(ns string, podName string, containerName strin
 	}
 }
 
-func newContainerMetricsFromPod(pod v1.Pod) ([]*ContainerMetric, error) {
+func newContainerMetricsFromPod(clusterID string, pod v1.Pod) ([]*ContainerMetric, error) {
 	podName := pod.GetObjectMeta().GetName()
 	ns := pod.GetObjectMeta().GetNamespace()
 	node := pod.Spec.NodeName
@@ -1957,6 +2440,7 @@ func newContainerMetricsFromPod(pod v1.Pod) ([]*ContainerMetric, error) {
 	for _, container := range pod.Spec.Containers {
 		containerName := container.Name
 		cs = append(cs, &ContainerMetric{
+			ClusterID:     clusterID,
 			Namespace:     ns,
 			PodName:       podName,
 			ContainerName: containerName,
@@ -1966,7 +2450,9 @@ func newContainerMetricsFromPod(pod v1.Pod) ([]*ContainerMetric, error) {
 	return cs, nil
 }
 
-func newContainerMetricFromPrometheus(metrics map[string]interface{}) (*ContainerMetric, error) {
+// newContainerMetricFromPrometheus identifies the container of the given series, which runs in the cluster of
+// its cluster label or, if it has none, e.g. if it was scraped by the local Prometheus, the given cluster
+func newContainerMetricFromPrometheus(metrics map[string]interface{}, defaultClusterID string) (*ContainerMetric, error) {
 	cName, ok := metrics["container_name"]
 	if !ok {
 		return nil, fmt.Errorf("Prometheus vector does not have container name")
@@ -2000,7 +2486,12 @@ func newContainerMetricFromPrometheus(metrics map[string]interface{}) (*Containe
 	if !ok {
 		return nil, fmt.Errorf("Prometheus vector does not have string node")
 	}
+	clusterID := defaultClusterID
+	if cluster, ok := metrics[clusterLabel].(string); ok && cluster != "" {
+		clusterID = cluster
+	}
 	return &ContainerMetric{
+		ClusterID:     clusterID,
 		ContainerName: containerName,
 		PodName:       podName,
 		Namespace:     namespace,
@@ -2008,7 +2499,13 @@ func newContainerMetricFromPrometheus(metrics map[string]interface{}) (*Containe
 	}, nil
 }
 
+// GetContainerMetricVector returns the value of each container in the given instant query result, keyed by
+// ContainerMetric. Containers without a cluster label are attributed to the cluster of CLUSTER_ID.
 func GetContainerMetricVector(qr interface{}, normalize bool, normalizationValue float64) (map[string][]*Vector, error) {
+	return getContainerMetricVector(qr, normalize, normalizationValue, os.Getenv(clusterIDKey))
+}
+
+func getContainerMetricVector(qr interface{}, normalize bool, normalizationValue float64, defaultClusterID string) (map[string][]*Vector, error) {
 	data, ok := qr.(map[string]interface{})["data"]
 	if !ok {
 		e, err := wrapPrometheusError(qr)
@@ -2031,7 +2528,7 @@ func GetContainerMetricVector(qr interface{}, normalize bool, normalizationValue
 		if !ok {
 			return nil, fmt.Errorf("Prometheus vector does not have metric labels")
 		}
-		containerMetric, err := newContainerMetricFromPrometheus(metric)
+		containerMetric, err := newContainerMetricFromPrometheus(metric, defaultClusterID)
 		if err != nil {
 			return nil, err
 		}
@@ -2058,7 +2555,13 @@ func GetContainerMetricVector(qr interface{}, normalize bool, normalizationValue
 	return containerData, nil
 }
 
+// GetContainerMetricVectors returns the values of each container in the given range query result, keyed by
+// ContainerMetric. Containers without a cluster label are attributed to the cluster of CLUSTER_ID.
 func GetContainerMetricVectors(qr interface{}, normalize bool, normalizationValue float64) (map[string][]*Vector, error) {
+	return getContainerMetricVectors(qr, normalize, normalizationValue, os.Getenv(clusterIDKey))
+}
+
+func getContainerMetricVectors(qr interface{}, normalize bool, normalizationValue float64, defaultClusterID string) (map[string][]*Vector, error) {
 	data, ok := qr.(map[string]interface{})["data"]
 	if !ok {
 		e, err := wrapPrometheusError(qr)
@@ -2081,7 +2584,7 @@ func GetContainerMetricVectors(qr interface{}, normalize bool, normalizationValu
 		if !ok {
 			return nil, fmt.Errorf("Prometheus vector does not have metric labels")
 		}
-		containerMetric, err := newContainerMetricFromPrometheus(metric)
+		containerMetric, err := newContainerMetricFromPrometheus(metric, defaultClusterID)
 		if err != nil {
 			return nil, err
 		}
@@ -0,0 +1,113 @@
+package costmodel
+
+import (
+	"fmt"
+
+	prometheusClient "github.com/prometheus/client_golang/api"
+	"k8s.io/klog"
+)
+
+const (
+	queryHistoricalPodJobs     = `max(max_over_time(kube_pod_owner{owner_kind="Job"}[%s])) by (namespace,pod,owner_name)`
+	queryHistoricalJobCronJobs = `max(max_over_time(kube_job_owner{owner_kind="CronJob"}[%s])) by (namespace,job_name,owner_name)`
+)
+
+// getJobCronJobs returns the CronJobs which own each cached Job, keyed by "namespace,job". Jobs without a CronJob
+// are included with none, to tell them from Jobs which are gone.
+func getJobCronJobs(cache ClusterCache) map[string][]string {
+	jobCronJobs := make(map[string][]string)
+	for _, job := range cache.GetAllJobs() {
+		key := job.GetObjectMeta().GetNamespace() + "," + job.GetObjectMeta().GetName()
+		jobCronJobs[key] = ownerControllers(job.GetObjectMeta().GetOwnerReferences(), "CronJob")
+	}
+	return jobCronJobs
+}
+
+// resolveJobOwners sets the CronJobs of the given cost data by the owners of their Jobs, so that all the runs of a
+// CronJob, each with its own Job and pod names, aggregate as one. Jobs are looked up in the cluster cache, or,
+// once they are deleted, e.g. by the history limits of their CronJob, by the owners recorded by
+// kube-state-metrics over the window, by which the Jobs of missing containers are set too.
+func resolveJobOwners(cli prometheusClient.Client, cache ClusterCache, costData map[string]*CostData, missingContainers map[string]*CostData, window string) {
+	jobCronJobs := getJobCronJobs(cache)
+
+	historical := false
+	for _, costs := range costData {
+		if len(costs.Jobs) > 0 {
+			if _, ok := jobCronJobs[costs.Namespace+","+costs.Jobs[0]]; !ok {
+				historical = true
+				break
+			}
+		}
+	}
+	if len(missingContainers) > 0 {
+		historical = true
+	}
+
+	podJobs := make(map[string]string)
+	if historical {
+		podJobsResult, err := Query(cli, fmt.Sprintf(queryHistoricalPodJobs, window))
+		if err == nil {
+			podJobs, err = ownersFromPrometheusQuery(podJobsResult, "pod")
+		}
+		if err != nil {
+			klog.V(1).Infof("Error fetching historical pod owners: %s", err.Error())
+		}
+
+		jobCronJobsResult, err := Query(cli, fmt.Sprintf(queryHistoricalJobCronJobs, window))
+		var historicalJobCronJobs map[string]string
+		if err == nil {
+			historicalJobCronJobs, err = ownersFromPrometheusQuery(jobCronJobsResult, "job_name")
+		}
+		if err != nil {
+			klog.V(1).Infof("Error fetching historical job owners: %s", err.Error())
+		}
+		for job, cronJob := range historicalJobCronJobs {
+			if _, ok := jobCronJobs[job]; !ok {
+				jobCronJobs[job] = []string{cronJob}
+			}
+		}
+	}
+
+	for key, costs := range costData {
+		if _, ok := missingContainers[key]; ok && len(costs.Jobs) == 0 {
+			if job, ok := podJobs[costs.Namespace+","+costs.PodName]; ok {
+				costs.Jobs = []string{job}
+			}
+		}
+		if len(costs.Jobs) > 0 {
+			costs.CronJobs = jobCronJobs[costs.Namespace+","+costs.Jobs[0]]
+		}
+	}
+}
+
+// ownersFromPrometheusQuery returns the owners of the objects named by the given label in the result of a query
+// of kube_*_owner series, keyed by "namespace,name"
+func ownersFromPrometheusQuery(qr interface{}, objectLabel string) (map[string]string, error) {
+	toReturn := make(map[string]string)
+	data, ok := qr.(map[string]interface{})["data"]
+	if !ok {
+		e, err := wrapPrometheusError(qr)
+		if err != nil {
+			return toReturn, err
+		}
+		return toReturn, fmt.Errorf(e)
+	}
+	for _, val := range data.(map[string]interface{})["result"].([]interface{}) {
+		metricInterface, ok := val.(map[string]interface{})["metric"]
+		if !ok {
+			return toReturn, fmt.Errorf("Metric field does not exist in data result vector")
+		}
+		metricMap, ok := metricInterface.(map[string]interface{})
+		if !ok {
+			return toReturn, fmt.Errorf("Metric field is improperly formatted")
+		}
+		ns, _ := metricMap["namespace"].(string)
+		name, _ := metricMap[objectLabel].(string)
+		owner, _ := metricMap["owner_name"].(string)
+		if ns == "" || name == "" || owner == "" || owner == "<none>" {
+			continue
+		}
+		toReturn[ns+","+name] = owner
+	}
+	return toReturn, nil
+}
@@ -0,0 +1,179 @@
+package costmodel
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	costAnalyzerCloud "github.com/kubecost/cost-model/cloud"
+)
+
+const (
+	currencyEnvVar = "CURRENCY"
+
+	// BaseCurrency is the currency all prices are computed in before conversion
+	BaseCurrency = "USD"
+)
+
+// DefaultCurrency returns the currency costs are reported in when a request doesn't specify one, read from
+// CURRENCY and defaulting to USD.
+func DefaultCurrency() string {
+	currency := strings.ToUpper(os.Getenv(currencyEnvVar))
+	if currency == "" {
+		return BaseCurrency
+	}
+	return currency
+}
+
+// CurrencyRate returns the number of units of currency per US dollar, as configured in the currencyRates
+// field of the pricing config.
+func CurrencyRate(cp costAnalyzerCloud.Provider, currency string) (float64, error) {
+	currency = strings.ToUpper(currency)
+	if currency == BaseCurrency {
+		return 1.0, nil
+	}
+
+	c, err := cp.GetConfig()
+	if err != nil {
+		return 0, err
+	}
+	rates, err := parseCurrencyRates(c.CurrencyRates)
+	if err != nil {
+		return 0, err
+	}
+	rate, ok := rates[currency]
+	if !ok {
+		return 0, fmt.Errorf("No conversion rate from %s to %s configured", BaseCurrency, currency)
+	}
+	return rate, nil
+}
+
+// parseCurrencyRates parses rates of the form "EUR:0.91,GBP:0.79"
+func parseCurrencyRates(ratesStr string) (map[string]float64, error) {
+	rates := make(map[string]float64)
+	if ratesStr == "" {
+		return rates, nil
+	}
+	for _, pair := range strings.Split(ratesStr, ",") {
+		kv := strings.Split(strings.TrimSpace(pair), ":")
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("Invalid currency rate '%s'; expected the form CURRENCY:RATE", pair)
+		}
+		rate, err := strconv.ParseFloat(strings.TrimSpace(kv[1]), 64)
+		if err != nil || rate <= 0 {
+			return nil, fmt.Errorf("Invalid currency rate '%s'; rate must be a positive number", pair)
+		}
+		rates[strings.ToUpper(strings.TrimSpace(kv[0]))] = rate
+	}
+	return rates, nil
+}
+
+// ConvertAggregationsCurrency multiplies every cost in the given aggregations by rate, in place
+func ConvertAggregationsCurrency(aggregations map[string]*Aggregation, rate float64) {
+	if rate == 1.0 {
+		return
+	}
+	scaleAggregations(aggregations, rate)
+}
+
+// ConvertAggregationMetadataCurrency multiplies the cost totals in the given metadata by rate, in place
+func ConvertAggregationMetadataCurrency(metadata *AggregationMetadata, rate float64) {
+	if metadata.IdleCost != nil {
+		*metadata.IdleCost *= rate
+	}
+	if metadata.TotalClusterCost != nil {
+		*metadata.TotalClusterCost *= rate
+	}
+	metadata.TotalAllocatedCost *= rate
+	metadata.ManagementFee *= rate
+}
+
+// ConvertNetworkCostsCurrency multiplies every cost in the given network costs by rate, in place
+func ConvertNetworkCostsCurrency(networkCosts map[string]*NetworkCosts, rate float64) {
+	for _, c := range networkCosts {
+		c.ZoneEgressCost *= rate
+		c.RegionEgressCost *= rate
+		c.InternetEgressCost *= rate
+		c.TotalCost *= rate
+	}
+}
+
+// ConvertCostDataCurrency returns a copy of the given cost data with every price multiplied by rate. Node and
+// volume pricing is shared between containers, so it is copied rather than converted in place.
+func ConvertCostDataCurrency(costData map[string]*CostData, rate float64) map[string]*CostData {
+	if rate == 1.0 || costData == nil {
+		return costData
+	}
+
+	nodes := make(map[*costAnalyzerCloud.Node]*costAnalyzerCloud.Node)
+	volumes := make(map[*costAnalyzerCloud.PV]*costAnalyzerCloud.PV)
+
+	converted := make(map[string]*CostData, len(costData))
+	for key, cd := range costData {
+		newCd := *cd
+		if cd.NodeData != nil {
+			node, ok := nodes[cd.NodeData]
+			if !ok {
+				n := *cd.NodeData
+				n.Cost = scalePrice(n.Cost, rate)
+				n.VCPUCost = scalePrice(n.VCPUCost, rate)
+				n.RAMCost = scalePrice(n.RAMCost, rate)
+				n.StorageCost = scalePrice(n.StorageCost, rate)
+				n.BaseCPUPrice = scalePrice(n.BaseCPUPrice, rate)
+				n.BaseRAMPrice = scalePrice(n.BaseRAMPrice, rate)
+				n.BaseGPUPrice = scalePrice(n.BaseGPUPrice, rate)
+				n.GPUCost = scalePrice(n.GPUCost, rate)
+				node = &n
+				nodes[cd.NodeData] = node
+			}
+			newCd.NodeData = node
+		}
+		if cd.PVCData != nil {
+			newCd.PVCData = make([]*PersistentVolumeClaimData, 0, len(cd.PVCData))
+			for _, pvc := range cd.PVCData {
+				newPvc := *pvc
+				if pvc.Volume != nil {
+					volume, ok := volumes[pvc.Volume]
+					if !ok {
+						v := *pvc.Volume
+						v.Cost = scalePrice(v.Cost, rate)
+						v.CostPerIO = scalePrice(v.CostPerIO, rate)
+						v.StorageCost = scalePrice(v.StorageCost, rate)
+						v.PerformanceCost = scalePrice(v.PerformanceCost, rate)
+						volume = &v
+						volumes[pvc.Volume] = volume
+					}
+					newPvc.Volume = volume
+				}
+				newCd.PVCData = append(newCd.PVCData, &newPvc)
+			}
+		}
+		if cd.NetworkData != nil {
+			newCd.NetworkData = make([]*Vector, 0, len(cd.NetworkData))
+			for _, v := range cd.NetworkData {
+				newCd.NetworkData = append(newCd.NetworkData, &Vector{Timestamp: v.Timestamp, Value: v.Value * rate})
+			}
+		}
+		converted[key] = &newCd
+	}
+	return converted
+}
+
+// scalePrice multiplies a price string from the provider by rate, leaving prices which can't be parsed as-is
+func scalePrice(price string, rate float64) string {
+	if price == "" {
+		return price
+	}
+	p, err := strconv.ParseFloat(price, 64)
+	if err != nil {
+		return price
+	}
+	return strconv.FormatFloat(p*rate, 'f', -1, 64)
+}
+
+func scaleVectors(vectors []*Vector, rate float64) {
+	for _, v := range vectors {
+		v.Value *= rate
+	}
+}
@@ -0,0 +1,237 @@
+package costmodel
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog"
+)
+
+const (
+	diskCacheDirEnvVar      = "DISK_CACHE_DIR"
+	diskCacheMaxBytesEnvVar = "DISK_CACHE_MAX_BYTES"
+
+	defaultDiskCacheMaxBytes = 100 * 1024 * 1024
+
+	diskCacheFileSuffix = ".json"
+)
+
+// diskCacheEntry is an aggregation response as persisted, along with the key and time it was cached under
+type diskCacheEntry struct {
+	Key      string               `json:"key"`
+	Created  time.Time            `json:"created"`
+	Response *AggregationResponse `json:"response"`
+	Warnings []string             `json:"warnings,omitempty"`
+}
+
+// DiskCache persists aggregation responses to files in Dir, keyed by their aggKey, so that a restart doesn't
+// force every aggregation to be recomputed at once. Responses older than TTL are ignored, and the least recently
+// used are evicted once the files take up more than MaxBytes. A nil DiskCache caches nothing.
+type DiskCache struct {
+	Dir      string
+	MaxBytes int64
+	TTL      time.Duration
+
+	lock  sync.Mutex
+	clock uint64            // incremented each time a file is used
+	used  map[string]uint64 // the clock when each file was last used, by name; files cached before a restart are unused
+}
+
+// NewDiskCache returns a cache of aggregation responses in the given directory, creating it if necessary
+func NewDiskCache(dir string, maxBytes int64, ttl time.Duration) (*DiskCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &DiskCache{Dir: dir, MaxBytes: maxBytes, TTL: ttl}, nil
+}
+
+// diskCacheFromEnv returns the cache in DISK_CACHE_DIR bounded by DISK_CACHE_MAX_BYTES, or nil if DISK_CACHE_DIR
+// isn't set. Responses expire after the given TTL, which is that of the in-memory cache, so that the disk cache
+// doesn't serve responses the in-memory cache would have recomputed.
+func diskCacheFromEnv(ttl time.Duration) (*DiskCache, error) {
+	dir := os.Getenv(diskCacheDirEnvVar)
+	if dir == "" {
+		return nil, nil
+	}
+	maxBytes := int64(defaultDiskCacheMaxBytes)
+	if value := os.Getenv(diskCacheMaxBytesEnvVar); value != "" {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("Invalid %s '%s'; must be a positive number of bytes", diskCacheMaxBytesEnvVar, value)
+		}
+		maxBytes = n
+	}
+	return NewDiskCache(dir, maxBytes, ttl)
+}
+
+func (c *DiskCache) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(c.Dir, hex.EncodeToString(sum[:])+diskCacheFileSuffix)
+}
+
+// touch records the file at the given path as the most recently used
+func (c *DiskCache) touch(path string) {
+	if c.used == nil {
+		c.used = make(map[string]uint64)
+	}
+	c.clock++
+	c.used[filepath.Base(path)] = c.clock
+}
+
+// remove deletes the file at the given path, and its use
+func (c *DiskCache) remove(path string) error {
+	delete(c.used, filepath.Base(path))
+	return os.Remove(path)
+}
+
+// Get returns the response cached under the given key, if it hasn't expired, marking it as recently used
+func (c *DiskCache) Get(key string) (*AggregationResponse, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	path := c.path(key)
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			klog.V(1).Infof("Unable to read disk cache: %s", err.Error())
+		}
+		return nil, false
+	}
+	var entry diskCacheEntry
+	if err := json.Unmarshal(b, &entry); err != nil || entry.Key != key || entry.Response == nil {
+		c.remove(path)
+		return nil, false
+	}
+	if time.Since(entry.Created) > c.TTL {
+		c.remove(path)
+		return nil, false
+	}
+	c.touch(path)
+	entry.Response.Warnings = entry.Warnings
+	return entry.Response, true
+}
+
+// Set caches the given response under the given key, evicting the least recently used responses if the cache
+// is then larger than MaxBytes
+func (c *DiskCache) Set(key string, response *AggregationResponse) {
+	if c == nil {
+		return
+	}
+	b, err := json.Marshal(&diskCacheEntry{
+		Key:      key,
+		Created:  time.Now(),
+		Response: response,
+		Warnings: response.Warnings,
+	})
+	if err != nil {
+		klog.V(1).Infof("Unable to serialize %s for the disk cache: %s", key, err.Error())
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	path := c.path(key)
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		klog.V(1).Infof("Unable to write disk cache: %s", err.Error())
+		return
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		klog.V(1).Infof("Unable to write disk cache: %s", err.Error())
+		return
+	}
+	c.touch(path)
+	c.evict()
+}
+
+// evict removes the least recently used files until the cache takes up no more than MaxBytes. Files not used
+// since a restart are evicted first, oldest first.
+func (c *DiskCache) evict() {
+	files, err := c.files()
+	if err != nil {
+		klog.V(1).Infof("Unable to list disk cache: %s", err.Error())
+		return
+	}
+	size := int64(0)
+	for _, f := range files {
+		size += f.Size()
+	}
+	sort.Slice(files, func(i, j int) bool {
+		usedI, usedJ := c.used[files[i].Name()], c.used[files[j].Name()]
+		if usedI != usedJ {
+			return usedI < usedJ
+		}
+		return files[i].ModTime().Before(files[j].ModTime())
+	})
+	for _, f := range files {
+		if size <= c.MaxBytes {
+			return
+		}
+		if err := c.remove(filepath.Join(c.Dir, f.Name())); err != nil {
+			klog.V(1).Infof("Unable to evict from disk cache: %s", err.Error())
+			continue
+		}
+		size -= f.Size()
+	}
+}
+
+func (c *DiskCache) files() ([]os.FileInfo, error) {
+	infos, err := ioutil.ReadDir(c.Dir)
+	if err != nil {
+		return nil, err
+	}
+	files := []os.FileInfo{}
+	for _, info := range infos {
+		if !info.IsDir() && strings.HasSuffix(info.Name(), diskCacheFileSuffix) {
+			files = append(files, info)
+		}
+	}
+	return files, nil
+}
+
+// Flush removes every cached response
+func (c *DiskCache) Flush() {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	files, err := c.files()
+	if err != nil {
+		klog.V(1).Infof("Unable to list disk cache: %s", err.Error())
+		return
+	}
+	for _, f := range files {
+		c.remove(filepath.Join(c.Dir, f.Name()))
+	}
+}
+
+// Size returns the number of responses in the cache
+func (c *DiskCache) Size() int {
+	if c == nil {
+		return 0
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	files, err := c.files()
+	if err != nil {
+		return 0
+	}
+	return len(files)
+}
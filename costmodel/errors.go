@@ -0,0 +1,53 @@
+package costmodel
+
+// Error codes identify the kind of failure of a request in the ErrorCode of its envelope, so that clients can
+// handle failures without parsing messages. They are part of the API, so must not change once released.
+const (
+	// ErrorCodeInternal is the code of failures of any other kind
+	ErrorCodeInternal = "INTERNAL"
+	// ErrorCodeBadRequest is the code of requests with missing or invalid parameters
+	ErrorCodeBadRequest = "BAD_REQUEST"
+	// ErrorCodeBadWindow is the code of requests with an invalid window, offset, resolution or time zone
+	ErrorCodeBadWindow = "BAD_WINDOW"
+	// ErrorCodeInvalidConfig is the code of config updates with unknown keys or invalid values
+	ErrorCodeInvalidConfig = "INVALID_CONFIG"
+	// ErrorCodePromUnavailable is the code of failures to query Prometheus
+	ErrorCodePromUnavailable = "PROM_UNAVAILABLE"
+	// ErrorCodePricingMissing is the code of failures to load the pricing config or price nodes
+	ErrorCodePricingMissing = "PRICING_MISSING"
+	// ErrorCodeUnauthorized is the code of requests without the API auth token, when API_AUTH_TOKEN is set
+	ErrorCodeUnauthorized = "UNAUTHORIZED"
+)
+
+// CodedError is an error reported to clients along with one of the error codes
+type CodedError struct {
+	Code string
+	Err  error
+}
+
+func (e *CodedError) Error() string {
+	return e.Err.Error()
+}
+
+// NewCodedError marks the given error with the given code, unless it is nil or already marked with a code
+func NewCodedError(code string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*CodedError); ok {
+		return err
+	}
+	return &CodedError{Code: code, Err: err}
+}
+
+// ErrorCode returns the code of the given error, which is ErrorCodeInternal if it isn't marked with one, or ""
+// if it is nil
+func ErrorCode(err error) string {
+	if err == nil {
+		return ""
+	}
+	if coded, ok := err.(*CodedError); ok {
+		return coded.Code
+	}
+	return ErrorCodeInternal
+}
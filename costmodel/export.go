@@ -0,0 +1,398 @@
+package costmodel
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/jszwec/csvutil"
+	costAnalyzerCloud "github.com/kubecost/cost-model/cloud"
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/klog"
+)
+
+const (
+	costExportPathEnvVar      = "COST_EXPORT_PATH"
+	costExportFormatEnvVar    = "COST_EXPORT_FORMAT"
+	costExportIntervalEnvVar  = "COST_EXPORT_INTERVAL"
+	defaultCostExportInterval = 24 * time.Hour
+	defaultCostExportBackoff  = time.Minute
+)
+
+const (
+	// ExportFormatParquet exports cost snapshots as Parquet files
+	ExportFormatParquet = "parquet"
+	// ExportFormatCSV exports cost snapshots as CSV files with a header row
+	ExportFormatCSV = "csv"
+)
+
+// ExportUploader uploads the files of cost snapshots to object storage
+type ExportUploader interface {
+	// Upload stores the given file at the given path within the bucket of the uploader, replacing any file there
+	Upload(ctx context.Context, path string, body []byte) error
+	// URL returns the URL of the given path within the bucket of the uploader
+	URL(path string) string
+}
+
+// s3ExportUploader uploads to an S3 bucket, with the credentials and region of the environment
+type s3ExportUploader struct {
+	bucket   string
+	uploader *s3manager.Uploader
+}
+
+func (u *s3ExportUploader) Upload(ctx context.Context, path string, body []byte) error {
+	_, err := u.uploader.UploadWithContext(ctx, &s3manager.UploadInput{
+		Bucket: aws.String(u.bucket),
+		Key:    aws.String(path),
+		Body:   bytes.NewReader(body),
+	})
+	return err
+}
+
+func (u *s3ExportUploader) URL(path string) string {
+	return "s3://" + u.bucket + "/" + path
+}
+
+// gcsExportUploader uploads to a GCS bucket, with the application default credentials
+type gcsExportUploader struct {
+	bucket string
+	client *storage.Client
+}
+
+func (u *gcsExportUploader) Upload(ctx context.Context, path string, body []byte) error {
+	w := u.client.Bucket(u.bucket).Object(path).NewWriter(ctx)
+	if _, err := w.Write(body); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+func (u *gcsExportUploader) URL(path string) string {
+	return "gs://" + u.bucket + "/" + path
+}
+
+// namespaceExportRow is a row of the extract of the cost of each namespace over the window of a snapshot
+type namespaceExportRow struct {
+	WindowStart string  `csv:"window_start"`
+	WindowEnd   string  `csv:"window_end"`
+	ClusterID   string  `csv:"cluster_id"`
+	Namespace   string  `csv:"namespace"`
+	CPUCost     float64 `csv:"cpu_cost"`
+	RAMCost     float64 `csv:"ram_cost"`
+	GPUCost     float64 `csv:"gpu_cost"`
+	PVCost      float64 `csv:"pv_cost"`
+	NetworkCost float64 `csv:"network_cost"`
+	TotalCost   float64 `csv:"total_cost"`
+}
+
+// containerExportRow is a row of the extract of the allocations and cost of each container over the window of a
+// snapshot
+type containerExportRow struct {
+	WindowStart  string  `csv:"window_start"`
+	WindowEnd    string  `csv:"window_end"`
+	ClusterID    string  `csv:"cluster_id"`
+	Namespace    string  `csv:"namespace"`
+	Pod          string  `csv:"pod"`
+	Container    string  `csv:"container"`
+	Node         string  `csv:"node"`
+	CPUCoreHours float64 `csv:"cpu_core_hours"`
+	RAMByteHours float64 `csv:"ram_byte_hours"`
+	GPUHours     float64 `csv:"gpu_hours"`
+	CPUCost      float64 `csv:"cpu_cost"`
+	RAMCost      float64 `csv:"ram_cost"`
+	GPUCost      float64 `csv:"gpu_cost"`
+	PVCost       float64 `csv:"pv_cost"`
+	NetworkCost  float64 `csv:"network_cost"`
+	TotalCost    float64 `csv:"total_cost"`
+}
+
+// CostExporter exports snapshots of the cost of the previous day, by namespace and by container, to object
+// storage every Interval, retrying failures with exponential backoff from MinBackoff up to Interval. Snapshots
+// are written under PathTemplate, in which {date} is replaced by the date of the window, as "2006-01-02" for
+// whole UTC days or by its start and end, as "2006-01-02T1504Z-2006-01-02T1504Z", otherwise, and {cluster} by
+// the ID of the cluster, as Parquet or, if Format is ExportFormatCSV, CSV files.
+type CostExporter struct {
+	Cloud        costAnalyzerCloud.Provider
+	Uploader     ExportUploader
+	PathTemplate string
+	Format       string
+	Interval     time.Duration
+	MinBackoff   time.Duration
+	Errors       prometheus.Counter // counts failed exports, if set
+
+	// CostData computes the cost data of each container from start until end in hourly windows
+	CostData func(start, end time.Time) (map[string]*CostData, error)
+
+	cloudLock sync.RWMutex // guards Cloud once exporting, as SetCloud replaces it
+}
+
+// SetCloud replaces the provider by which costs are priced. Exports in progress keep the provider they began with.
+func (e *CostExporter) SetCloud(cp costAnalyzerCloud.Provider) {
+	e.cloudLock.Lock()
+	defer e.cloudLock.Unlock()
+	e.Cloud = cp
+}
+
+// NewCostExporter returns an exporter of the cost data computed by costData to the given uploader every interval
+func NewCostExporter(cp costAnalyzerCloud.Provider, uploader ExportUploader, pathTemplate string, format string, interval time.Duration, errors prometheus.Counter, costData func(start, end time.Time) (map[string]*CostData, error)) (*CostExporter, error) {
+	if format != ExportFormatParquet && format != ExportFormatCSV {
+		return nil, fmt.Errorf("Invalid export format '%s'; must be '%s' or '%s'", format, ExportFormatParquet, ExportFormatCSV)
+	}
+	return &CostExporter{
+		Cloud:        cp,
+		Uploader:     uploader,
+		PathTemplate: strings.Trim(pathTemplate, "/"),
+		Format:       format,
+		Interval:     interval,
+		MinBackoff:   defaultCostExportBackoff,
+		Errors:       errors,
+		CostData:     costData,
+	}, nil
+}
+
+// Export computes the cost of each namespace and each container from start until end and uploads them, returning
+// the URLs of the uploaded files
+func (e *CostExporter) Export(ctx context.Context, start, end time.Time) ([]string, error) {
+	e.cloudLock.RLock()
+	cp := e.Cloud
+	e.cloudLock.RUnlock()
+
+	data, err := e.CostData(start, end)
+	if err != nil {
+		return nil, err
+	}
+	c, err := cp.GetConfig()
+	if err != nil {
+		return nil, NewCodedError(ErrorCodePricingMissing, err)
+	}
+	discount, err := parseDiscount(c)
+	if err != nil {
+		return nil, NewCodedError(ErrorCodePricingMissing, err)
+	}
+
+	data = withNodeData(data)
+
+	windowStart := start.UTC().Format(time.RFC3339)
+	windowEnd := end.UTC().Format(time.RFC3339)
+	clusterID := LocalClusterID(cp)
+
+	namespaces := []namespaceExportRow{}
+	for namespace, agg := range AggregateCostModel(cp, data, "namespace", "", false, discount, 1.0, nil) {
+		namespaces = append(namespaces, namespaceExportRow{
+			WindowStart: windowStart,
+			WindowEnd:   windowEnd,
+			ClusterID:   agg.Cluster,
+			Namespace:   namespace,
+			CPUCost:     agg.CPUCost,
+			RAMCost:     agg.RAMCost,
+			GPUCost:     agg.GPUCost,
+			PVCost:      agg.PVCost,
+			NetworkCost: agg.NetworkCost,
+			TotalCost:   agg.TotalCost,
+		})
+	}
+	sort.Slice(namespaces, func(i, j int) bool {
+		return namespaces[i].ClusterID+"/"+namespaces[i].Namespace < namespaces[j].ClusterID+"/"+namespaces[j].Namespace
+	})
+
+	keys := make([]string, 0, len(data))
+	for key := range data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	pricing := newPricingConfig(cp)
+	containers := make([]containerExportRow, 0, len(keys))
+	for _, key := range keys {
+		cd := data[key]
+		cpuv, ramv, gpuv, pvvs, adjustment := getPriceVectors(pricing, cd, discount, 1.0, true, defaultTimestampBucket)
+		row := containerExportRow{
+			WindowStart:  windowStart,
+			WindowEnd:    windowEnd,
+			ClusterID:    cd.ClusterID,
+			Namespace:    cd.Namespace,
+			Pod:          cd.PodName,
+			Container:    cd.Name,
+			Node:         cd.NodeName,
+			CPUCoreHours: totalVector(cd.CPUAllocation),
+			RAMByteHours: totalVector(cd.RAMAllocation),
+			GPUHours:     totalVector(cd.GPUReq),
+			CPUCost:      totalVector(cpuv),
+			RAMCost:      totalVector(ramv),
+			GPUCost:      totalVector(gpuv),
+			NetworkCost:  totalVector(cd.NetworkData),
+		}
+		for _, pvv := range pvvs {
+			row.PVCost += totalVector(pvv)
+		}
+		row.TotalCost = row.CPUCost + row.RAMCost + row.GPUCost + row.PVCost + row.NetworkCost + adjustment.markupCost
+		containers = append(containers, row)
+	}
+
+	dir := strings.NewReplacer("{date}", exportDate(start, end), "{cluster}", clusterID).Replace(e.PathTemplate)
+	var urls []string
+	for name, rows := range map[string]interface{}{"namespaces": namespaces, "containers": containers} {
+		var body bytes.Buffer
+		if e.Format == ExportFormatCSV {
+			b, err := csvutil.Marshal(rows)
+			if err != nil {
+				return nil, err
+			}
+			body.Write(b)
+		} else if err := writeParquet(&body, rows); err != nil {
+			return nil, err
+		}
+		path := name + "." + e.Format
+		if dir != "" {
+			path = dir + "/" + path
+		}
+		if err := e.Uploader.Upload(ctx, path, body.Bytes()); err != nil {
+			return nil, fmt.Errorf("Unable to upload %s: %s", e.Uploader.URL(path), err.Error())
+		}
+		urls = append(urls, e.Uploader.URL(path))
+	}
+	sort.Strings(urls)
+	return urls, nil
+}
+
+// withNodeData returns the given cost data with that of containers on unknown nodes priced as of a node without
+// prices. The cost data may be cached, so those containers are copied rather than changed in place.
+func withNodeData(data map[string]*CostData) map[string]*CostData {
+	priced := make(map[string]*CostData, len(data))
+	for key, cd := range data {
+		if cd.NodeData == nil {
+			c := *cd
+			c.NodeData = &costAnalyzerCloud.Node{}
+			cd = &c
+		}
+		priced[key] = cd
+	}
+	return priced
+}
+
+// exportDate returns the date by which the given window is exported: the date of whole UTC days, and its start
+// and end otherwise, so that partial windows don't replace the export of the day
+func exportDate(start, end time.Time) string {
+	start, end = start.UTC(), end.UTC()
+	if start.Equal(start.Truncate(24*time.Hour)) && end.Equal(start.Add(24*time.Hour)) {
+		return start.Format("2006-01-02")
+	}
+	layout := "2006-01-02T1504Z"
+	return start.Format(layout) + "-" + end.Format(layout)
+}
+
+// exportErr exports the given window, counting a failure in Errors
+func (e *CostExporter) exportErr(ctx context.Context, start, end time.Time) ([]string, error) {
+	urls, err := e.Export(ctx, start, end)
+	if err != nil && e.Errors != nil {
+		e.Errors.Inc()
+	}
+	return urls, err
+}
+
+// previousDay returns the window of the last whole UTC day before the given time
+func previousDay(now time.Time) (time.Time, time.Time) {
+	end := now.UTC().Truncate(24 * time.Hour)
+	return end.Add(-24 * time.Hour), end
+}
+
+// Run exports the previous day right away and then every Interval, until ctx is done, returning a channel
+// closed once it stops
+func (e *CostExporter) Run(ctx context.Context) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		failures := 0
+		delay := time.Duration(0)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+
+			start, end := previousDay(time.Now())
+			urls, err := e.exportErr(ctx, start, end)
+			if err != nil {
+				failures++
+				delay = e.backoff(failures)
+				klog.V(1).Infof("Failed to export costs of %s, retrying in %s: %s", start.Format("2006-01-02"), delay, err.Error())
+				continue
+			}
+			klog.V(2).Infof("Exported costs of %s to %s", start.Format("2006-01-02"), strings.Join(urls, ", "))
+			failures = 0
+			delay = e.Interval
+		}
+	}()
+	return done
+}
+
+// backoff returns the delay before retrying after the given number of consecutive failures, jittered so that
+// replicas retry apart
+func (e *CostExporter) backoff(failures int) time.Duration {
+	delay := e.MinBackoff
+	for i := 1; i < failures && delay < e.Interval; i++ {
+		delay *= 2
+	}
+	if delay > e.Interval {
+		delay = e.Interval
+	}
+	return time.Duration(float64(delay) * (0.9 + 0.2*rand.Float64()))
+}
+
+// exportUploaderFromURL returns the uploader to the bucket of the given s3:// or gs:// URL, and the path within
+// it
+func exportUploaderFromURL(value string) (ExportUploader, string, error) {
+	u, err := url.Parse(value)
+	if err != nil || u.Host == "" {
+		return nil, "", fmt.Errorf("Invalid %s '%s'; must be an s3:// or gs:// URL", costExportPathEnvVar, value)
+	}
+	switch u.Scheme {
+	case "s3":
+		s, err := session.NewSession()
+		if err != nil {
+			return nil, "", err
+		}
+		return &s3ExportUploader{bucket: u.Host, uploader: s3manager.NewUploader(s)}, u.Path, nil
+	case "gs":
+		client, err := storage.NewClient(context.Background())
+		if err != nil {
+			return nil, "", err
+		}
+		return &gcsExportUploader{bucket: u.Host, client: client}, u.Path, nil
+	}
+	return nil, "", fmt.Errorf("Invalid %s '%s'; must be an s3:// or gs:// URL", costExportPathEnvVar, value)
+}
+
+// costExporterFromEnv returns the exporter to COST_EXPORT_PATH, e.g. "s3://bucket/costs/{cluster}/{date}", in the
+// COST_EXPORT_FORMAT, parquet by default, every COST_EXPORT_INTERVAL, or nil if COST_EXPORT_PATH isn't set
+func costExporterFromEnv(cp costAnalyzerCloud.Provider, errors prometheus.Counter, costData func(start, end time.Time) (map[string]*CostData, error)) (*CostExporter, error) {
+	value := os.Getenv(costExportPathEnvVar)
+	if value == "" {
+		return nil, nil
+	}
+	format := strings.ToLower(os.Getenv(costExportFormatEnvVar))
+	if format == "" {
+		format = ExportFormatParquet
+	}
+	interval, err := durationFromEnv(costExportIntervalEnvVar, defaultCostExportInterval)
+	if err != nil {
+		return nil, err
+	}
+	uploader, path, err := exportUploaderFromURL(value)
+	if err != nil {
+		return nil, err
+	}
+	return NewCostExporter(cp, uploader, path, format, interval, errors, costData)
+}
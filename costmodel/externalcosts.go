@@ -0,0 +1,143 @@
+package costmodel
+
+import (
+	"sort"
+	"time"
+
+	"github.com/kubecost/cost-model/cloud"
+)
+
+// ExternalUnmatchedAggregationKey is the key of the synthetic aggregation holding out of cluster costs tagged
+// with values that key no aggregation
+const ExternalUnmatchedAggregationKey = "__external_unmatched__"
+
+// externalCostsResult is the out of cluster costs queried alongside cost data, or the error querying them
+type externalCostsResult struct {
+	allocations []*cloud.OutOfClusterAllocation
+	err         error
+}
+
+// queryExternalCosts queries the out of cluster costs of the given provider for the UTC days spanning the given
+// window, grouped by the tag matching the given aggregation field, returning a channel that receives them once
+// queried
+func queryExternalCosts(cp cloud.Provider, field string, subfield string, start time.Time, end time.Time) <-chan *externalCostsResult {
+	result := make(chan *externalCostsResult, 1)
+	go func() {
+		allocations, err := externalCosts(cp, field, subfield, start, end)
+		result <- &externalCostsResult{allocations: allocations, err: err}
+	}()
+	return result
+}
+
+func externalCosts(cp cloud.Provider, field string, subfield string, start time.Time, end time.Time) ([]*cloud.OutOfClusterAllocation, error) {
+	c, err := cp.GetConfig()
+	if err != nil {
+		return nil, err
+	}
+	tag, err := cloud.ExternalTag(c, field, subfield)
+	if err != nil {
+		return nil, err
+	}
+
+	// billing data is queried by day, so the last day is included unless the window ends at midnight
+	layout := "2006-01-02"
+	endDay := end.UTC().Truncate(24 * time.Hour)
+	if endDay.Before(end) {
+		endDay = endDay.Add(24 * time.Hour)
+	}
+	result, err := cp.ExternalAllocations(&cloud.ExternalAllocationsQuery{
+		Start:       start.UTC().Format(layout),
+		End:         endDay.Format(layout),
+		Aggregators: []string{tag},
+		Verbatim:    true,
+	})
+	if err != nil || result == nil {
+		return nil, err
+	}
+	return ProrateExternalCosts(result.Allocations, start, end), nil
+}
+
+// ProrateExternalCosts returns the given out of cluster costs of the UTC days spanning the given window scaled
+// to the part of those days the window covers, as billing data is queried by whole days. Costs are assumed to
+// be spread evenly across the days. The given allocations, which may be cached, are not modified.
+func ProrateExternalCosts(allocations []*cloud.OutOfClusterAllocation, start time.Time, end time.Time) []*cloud.OutOfClusterAllocation {
+	startDay := start.UTC().Truncate(24 * time.Hour)
+	endDay := end.UTC().Truncate(24 * time.Hour)
+	if endDay.Before(end) {
+		endDay = endDay.Add(24 * time.Hour)
+	}
+	days := endDay.Sub(startDay)
+	if days <= 0 || end.Sub(start) >= days {
+		return allocations
+	}
+	fraction := float64(end.Sub(start)) / float64(days)
+	prorated := make([]*cloud.OutOfClusterAllocation, 0, len(allocations))
+	for _, allocation := range allocations {
+		a := *allocation
+		a.Cost = allocation.Cost * fraction
+		prorated = append(prorated, &a)
+	}
+	return prorated
+}
+
+// AddExternalCosts attributes each of the given out of cluster costs to the ExternalCost of the aggregation
+// keyed by the value of its tag. Costs tagged with values keying no aggregation are added to a synthetic
+// aggregation keyed by ExternalUnmatchedAggregationKey, while untagged costs, e.g. of the nodes of the cluster
+// itself, are not attributed to any aggregation.
+func AddExternalCosts(aggregations map[string]*Aggregation, field string, subfield string, allocations []*cloud.OutOfClusterAllocation) {
+	for _, allocation := range allocations {
+		if allocation.Environment == "" {
+			continue
+		}
+		key := allocation.Environment
+		agg, ok := aggregations[key]
+		if !ok {
+			key = ExternalUnmatchedAggregationKey
+			agg, ok = aggregations[key]
+		}
+		if !ok {
+			agg = &Aggregation{
+				Aggregator:         field,
+				AggregatorSubField: subfield,
+				Environment:        key,
+			}
+			aggregations[key] = agg
+		}
+		agg.ExternalCost += allocation.Cost
+		agg.TotalCost += allocation.Cost
+	}
+}
+
+// PageInfo locates a page of a paged response
+type PageInfo struct {
+	Page       int `json:"page"`
+	PageSize   int `json:"pageSize"`
+	TotalItems int `json:"totalItems"`
+}
+
+// PageOutOfClusterAllocations returns the given 1-based page of the given allocations, ordered by aggregator,
+// environment and service so that pages are consistent. The given allocations, which may be cached, are not
+// reordered.
+func PageOutOfClusterAllocations(allocations []*cloud.OutOfClusterAllocation, page int, pageSize int) ([]*cloud.OutOfClusterAllocation, *PageInfo) {
+	sorted := make([]*cloud.OutOfClusterAllocation, len(allocations))
+	copy(sorted, allocations)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].Aggregator != sorted[j].Aggregator {
+			return sorted[i].Aggregator < sorted[j].Aggregator
+		}
+		if sorted[i].Environment != sorted[j].Environment {
+			return sorted[i].Environment < sorted[j].Environment
+		}
+		return sorted[i].Service < sorted[j].Service
+	})
+
+	start := (page - 1) * pageSize
+	if start > len(sorted) {
+		start = len(sorted)
+	}
+	end := start + pageSize
+	if end > len(sorted) {
+		end = len(sorted)
+	}
+	return sorted[start:end], &PageInfo{Page: page, PageSize: pageSize, TotalItems: len(allocations)}
+}
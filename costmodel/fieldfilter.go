@@ -0,0 +1,213 @@
+package costmodel
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// fieldPaths is a set of the fields of a struct, by index, each either whole, when nil, or restricted to some of
+// the fields of the structure nested in it
+type fieldPaths map[int]fieldPaths
+
+// fieldPlan is how a filter copies a struct: the indices of the fields copied whole, and of those whose nested
+// structures are themselves filtered
+type fieldPlan struct {
+	copied []int
+	nested []nestedFieldPlan
+}
+
+type nestedFieldPlan struct {
+	index int
+	plan  *fieldPlan
+}
+
+// fieldIndices caches, by struct type, the indices of its exported fields by their lowercased JSON and Go names
+var fieldIndices sync.Map
+
+// FieldFilter filters the fields of cost data, either omitting the fields it names or keeping only those
+type FieldFilter struct {
+	plan *fieldPlan
+}
+
+// ParseFieldFilter parses the given comma-separated list of the fields of CostData to omit, or with keep, to
+// keep. Fields are named case-insensitively by their JSON or Go names, and the fields of nested structures by
+// dotted paths, e.g. "nodeData.vcpuCost". A field named whole takes precedence over the paths into it. It
+// returns an error listing any names which aren't fields of CostData, so that a typo doesn't silently filter
+// nothing.
+func ParseFieldFilter(fields string, keep bool) (*FieldFilter, error) {
+	param := "filterFields"
+	if keep {
+		param = "keepFields"
+	}
+
+	paths := fieldPaths{}
+	var invalid []string
+	for _, f := range strings.Split(fields, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		if !paths.add(reflect.TypeOf(CostData{}), strings.Split(f, ".")) {
+			invalid = append(invalid, f)
+		}
+	}
+	if len(invalid) > 0 {
+		return nil, NewCodedError(ErrorCodeBadRequest, fmt.Errorf("Invalid %s %s; must be fields of the cost data, e.g. \"cpuUsed,nodeData.vcpuCost\"", param, strings.Join(invalid, ", ")))
+	}
+	return &FieldFilter{plan: paths.plan(reflect.TypeOf(CostData{}), keep)}, nil
+}
+
+// requestFieldFilter returns the field filter of the given request, omitting the fields listed by its
+// filterFields or keeping only those listed by its keepFields, or nil if it sets neither
+func requestFieldFilter(r *http.Request) (*FieldFilter, error) {
+	filterFields := r.URL.Query().Get("filterFields")
+	keepFields := r.URL.Query().Get("keepFields")
+	if filterFields != "" && keepFields != "" {
+		return nil, NewCodedError(ErrorCodeBadRequest, fmt.Errorf("filterFields and keepFields cannot both be set"))
+	}
+	if filterFields != "" {
+		return ParseFieldFilter(filterFields, false)
+	}
+	if keepFields != "" {
+		return ParseFieldFilter(keepFields, true)
+	}
+	return nil, nil
+}
+
+// add adds the field at the given path into the given type, reporting whether it is a field
+func (p fieldPaths) add(t reflect.Type, path []string) bool {
+	t = nestedStruct(t)
+	if t == nil {
+		return false
+	}
+	i, ok := fieldIndex(t, path[0])
+	if !ok {
+		return false
+	}
+	if len(path) == 1 {
+		p[i] = nil
+		return true
+	}
+
+	children, named := p[i]
+	if !named || children != nil {
+		if children == nil {
+			children = fieldPaths{}
+		}
+		if !children.add(t.Field(i).Type, path[1:]) {
+			return false
+		}
+		p[i] = children
+		return true
+	}
+	// the field is already named whole, but the path must still be valid
+	return fieldPaths{}.add(t.Field(i).Type, path[1:])
+}
+
+// nestedStruct returns the struct type of the given type, or of the elements of the pointers and slices it is, or
+// nil if it has none
+func nestedStruct(t reflect.Type) reflect.Type {
+	for t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+	return t
+}
+
+// fieldIndex returns the index of the exported field of the given struct type with the given JSON or Go name,
+// matched case-insensitively
+func fieldIndex(t reflect.Type, name string) (int, bool) {
+	cached, ok := fieldIndices.Load(t)
+	if !ok {
+		// a name is of the first field it names, by either its Go or JSON name
+		indices := make(map[string]int)
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if field.PkgPath != "" {
+				continue
+			}
+			names := []string{field.Name}
+			if tag := strings.Split(field.Tag.Get("json"), ",")[0]; tag != "" && tag != "-" {
+				names = append(names, tag)
+			}
+			for _, name := range names {
+				if _, ok := indices[strings.ToLower(name)]; !ok {
+					indices[strings.ToLower(name)] = i
+				}
+			}
+		}
+		cached, _ = fieldIndices.LoadOrStore(t, indices)
+	}
+	i, ok := cached.(map[string]int)[strings.ToLower(name)]
+	return i, ok
+}
+
+// plan returns the plan by which the given struct type is copied with the fields omitted, or kept
+func (p fieldPaths) plan(t reflect.Type, keep bool) *fieldPlan {
+	plan := &fieldPlan{}
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).PkgPath != "" {
+			continue
+		}
+		children, named := p[i]
+		if named && children != nil {
+			plan.nested = append(plan.nested, nestedFieldPlan{index: i, plan: children.plan(nestedStruct(t.Field(i).Type), keep)})
+		} else if named == keep {
+			plan.copied = append(plan.copied, i)
+		}
+	}
+	return plan
+}
+
+// Apply returns copies of the given cost data filtered by the filter. The original cost data is not modified.
+func (f *FieldFilter) Apply(data map[string]*CostData) map[string]*CostData {
+	filteredData := make(map[string]*CostData, len(data))
+	for cname, costdata := range data {
+		filtered := &CostData{}
+		f.plan.copy(reflect.ValueOf(filtered).Elem(), reflect.ValueOf(costdata).Elem())
+		filteredData[cname] = filtered
+	}
+	return filteredData
+}
+
+// copy copies the fields of the struct src to dst by the plan
+func (p *fieldPlan) copy(dst reflect.Value, src reflect.Value) {
+	for _, i := range p.copied {
+		dst.Field(i).Set(src.Field(i))
+	}
+	for _, n := range p.nested {
+		dst.Field(n.index).Set(n.plan.filter(src.Field(n.index)))
+	}
+}
+
+// filter returns a copy by the plan of the given pointer to, slice of, or struct
+func (p *fieldPlan) filter(v reflect.Value) reflect.Value {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return v
+		}
+		filtered := reflect.New(v.Type().Elem())
+		filtered.Elem().Set(p.filter(v.Elem()))
+		return filtered
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+		filtered := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			filtered.Index(i).Set(p.filter(v.Index(i)))
+		}
+		return filtered
+	case reflect.Struct:
+		filtered := reflect.New(v.Type()).Elem()
+		p.copy(filtered, v)
+		return filtered
+	}
+	return v
+}
@@ -0,0 +1,75 @@
+package costmodel
+
+import (
+	"strings"
+)
+
+// The ways container image references are normalized when costs are aggregated by image, given as the aggregation
+// subfield
+const (
+	// ImageRefTag keeps the repository and tag of a reference, stripping its digest, so that the pulls of a tag
+	// before and after it's pushed again are aggregated as one. It's the default.
+	ImageRefTag = "tag"
+	// ImageRefDigest keeps the repository and digest of a reference, stripping its tag, so that the tags of an
+	// image are aggregated as one. References without a digest keep their tag.
+	ImageRefDigest = "digest"
+	// ImageRefRepository keeps only the repository of a reference
+	ImageRefRepository = "repository"
+	// ImageRefFull keeps a reference as it is given in the pod spec
+	ImageRefFull = "full"
+)
+
+// UnknownImageAggregationKey is the key of the synthetic aggregation holding the costs of containers whose image
+// isn't known, e.g. those of pods deleted before they were cached
+const UnknownImageAggregationKey = "__unknown__"
+
+// imageRefModes are the ways image references can be normalized
+var imageRefModes = []string{ImageRefTag, ImageRefDigest, ImageRefRepository, ImageRefFull}
+
+// splitImageRef splits the given image reference into its repository, tag and digest, either of which may be empty,
+// e.g. "registry:5000/team/app:1.2@sha256:abc" into "registry:5000/team/app", "1.2" and "sha256:abc"
+func splitImageRef(image string) (string, string, string) {
+	repository, digest := image, ""
+	if i := strings.Index(image, "@"); i >= 0 {
+		repository, digest = image[:i], image[i+1:]
+	}
+	tag := ""
+	// a colon before the last slash separates the port of the registry, not a tag
+	if i := strings.LastIndex(repository, ":"); i > strings.LastIndex(repository, "/") {
+		repository, tag = repository[:i], repository[i+1:]
+	}
+	return repository, tag, digest
+}
+
+// NormalizeImage returns the given container image reference normalized by the given mode, by default ImageRefTag.
+// Images of Docker Hub are named as they're pulled, e.g. "docker.io/library/nginx" as "nginx", and references
+// with neither a tag nor a digest are of the "latest" tag, as the kubelet pulls them.
+func NormalizeImage(image string, mode string) string {
+	if image == "" || mode == ImageRefFull {
+		return image
+	}
+	repository, tag, digest := splitImageRef(image)
+	for _, prefix := range []string{"docker.io/", "index.docker.io/"} {
+		if strings.HasPrefix(repository, prefix) {
+			repository = strings.TrimPrefix(strings.TrimPrefix(repository, prefix), "library/")
+		}
+	}
+	if tag == "" && digest == "" {
+		tag = "latest"
+	}
+
+	switch mode {
+	case ImageRefRepository:
+		return repository
+	case ImageRefDigest:
+		if digest != "" {
+			return repository + "@" + digest
+		}
+		return repository + ":" + tag
+	default:
+		if tag != "" {
+			return repository + ":" + tag
+		}
+		return repository + "@" + digest
+	}
+}
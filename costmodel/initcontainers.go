@@ -0,0 +1,220 @@
+package costmodel
+
+import (
+	"math"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// costInterval is the interval of time covered by the samples of cost data at timestamp
+type costInterval struct {
+	timestamp float64
+	start     time.Time
+	end       time.Time
+}
+
+// instantIntervals returns the interval covered by the samples of instant queries over the given window, which
+// are timestamped at now, the time they are evaluated at
+func instantIntervals(window time.Duration, end time.Time, now time.Time) []costInterval {
+	return []costInterval{{timestamp: math.Round(float64(now.Unix())/10) * 10, start: end.Add(-window), end: end}}
+}
+
+// rangeIntervals returns the intervals covered by the samples of range queries from start to end, each of which
+// covers the step up to its timestamp
+func rangeIntervals(start time.Time, end time.Time, step time.Duration) []costInterval {
+	var intervals []costInterval
+	for t := start; !t.After(end) && step > 0; t = t.Add(step) {
+		intervals = append(intervals, costInterval{timestamp: math.Round(float64(t.Unix())/10) * 10, start: t.Add(-step), end: t})
+	}
+	return intervals
+}
+
+// runFraction returns the fraction of the interval for which something running from start to end, either of
+// which may be zero if unknown, ran
+func (i costInterval) runFraction(start time.Time, end time.Time) float64 {
+	if start.IsZero() || start.Before(i.start) {
+		start = i.start
+	}
+	if end.IsZero() || end.After(i.end) {
+		end = i.end
+	}
+	if !end.After(start) || !i.end.After(i.start) {
+		return 0
+	}
+	return float64(end.Sub(start)) / float64(i.end.Sub(i.start))
+}
+
+// podRunTime returns when the given pod started and, if it has completed, finished running
+func podRunTime(pod *v1.Pod) (time.Time, time.Time) {
+	var start, end time.Time
+	if pod.Status.StartTime != nil {
+		start = pod.Status.StartTime.Time
+	}
+	if pod.Status.Phase == v1.PodSucceeded || pod.Status.Phase == v1.PodFailed {
+		for _, status := range pod.Status.ContainerStatuses {
+			if t := status.State.Terminated; t != nil && t.FinishedAt.After(end) {
+				end = t.FinishedAt.Time
+			}
+		}
+	}
+	return start, end
+}
+
+// requestVectors returns the given request weighted, in each interval, by the fraction of it for which its
+// container ran from start to end, omitting intervals in which it didn't run
+func requestVectors(request float64, intervals []costInterval, start time.Time, end time.Time) []*Vector {
+	var vectors []*Vector
+	for _, interval := range intervals {
+		if fraction := interval.runFraction(start, end); fraction > 0 {
+			vectors = append(vectors, &Vector{Timestamp: interval.timestamp, Value: request * fraction})
+		}
+	}
+	return vectors
+}
+
+// addInitContainers adds the cost data of the init containers of the given pods, which Prometheus reports no
+// requests for, allocating each its requests for the time it ran, from its status. The metadata of each is that
+// of a container of its pod, so that init containers aggregate with their pods, and pods without cost data are
+// skipped, e.g. as they are filtered out. Usage reported for init containers, which are otherwise costed as
+// containers of deleted pods, is kept.
+func addInitContainers(costData map[string]*CostData, pods []*v1.Pod, clusterID string, intervals []costInterval) {
+	for _, pod := range pods {
+		if len(pod.Spec.InitContainers) == 0 {
+			continue
+		}
+		podCosts := podContainerCosts(costData, pod, clusterID)
+		if len(podCosts) == 0 {
+			continue
+		}
+		for _, container := range pod.Spec.InitContainers {
+			var start, end time.Time
+			for _, status := range pod.Status.InitContainerStatuses {
+				if status.Name != container.Name {
+					continue
+				}
+				if status.State.Terminated != nil {
+					start, end = status.State.Terminated.StartedAt.Time, status.State.Terminated.FinishedAt.Time
+				} else if status.State.Running != nil {
+					start = status.State.Running.StartedAt.Time
+				}
+			}
+			if start.IsZero() {
+				continue // not yet run
+			}
+
+			cpu := container.Resources.Requests[v1.ResourceCPU]
+			ram := container.Resources.Requests[v1.ResourceMemory]
+			cpuReq := requestVectors(float64(cpu.MilliValue())/1000, intervals, start, end)
+			ramReq := requestVectors(float64(ram.Value()), intervals, start, end)
+			if len(cpuReq) == 0 && len(ramReq) == 0 {
+				continue // ran before the window
+			}
+
+			key := newContainerMetricFromValues(clusterID, pod.GetObjectMeta().GetNamespace(), pod.GetObjectMeta().GetName(), container.Name, pod.Spec.NodeName).Key()
+			costs := *podCosts[0]
+			costs.Name = container.Name
+			costs.Image = container.Image
+			costs.IsInitContainer = true
+			costs.CPUReq = cpuReq
+			costs.RAMReq = ramReq
+			costs.CPUUsed = []*Vector{&Vector{}}
+			costs.RAMUsed = []*Vector{&Vector{}}
+			costs.GPUReq = []*Vector{&Vector{}}
+			if reported, ok := costData[key]; ok {
+				costs.CPUUsed = reported.CPUUsed
+				costs.RAMUsed = reported.RAMUsed
+			}
+			costs.PVCData = nil
+			costs.NetworkData = nil
+			costs.CPUOverhead = nil
+			costs.RAMOverhead = nil
+			costs.CPUAllocation = getContainerAllocation(costs.CPUReq, costs.CPUUsed)
+			costs.RAMAllocation = getContainerAllocation(costs.RAMReq, costs.RAMUsed)
+			costData[key] = &costs
+		}
+	}
+}
+
+// addPodOverhead adds the overhead of running each of the given pods, e.g. of a sandboxed RuntimeClass, to the
+// allocation of its containers, for the time the pod ran. The overhead of each resource is split across the
+// containers of the pod in proportion to their requests of it, or evenly if they request none.
+func addPodOverhead(costData map[string]*CostData, pods []*v1.Pod, clusterID string, intervals []costInterval) {
+	for _, pod := range pods {
+		if len(pod.Spec.Overhead) == 0 {
+			continue
+		}
+		podCosts := podContainerCosts(costData, pod, clusterID)
+		if len(podCosts) == 0 {
+			continue
+		}
+		start, end := podRunTime(pod)
+
+		var cpuRequests, ramRequests []float64
+		for _, costs := range podCosts {
+			var cpu, ram float64
+			for _, container := range pod.Spec.Containers {
+				if container.Name == costs.Name {
+					cpuQuantity := container.Resources.Requests[v1.ResourceCPU]
+					ramQuantity := container.Resources.Requests[v1.ResourceMemory]
+					cpu, ram = float64(cpuQuantity.MilliValue())/1000, float64(ramQuantity.Value())
+				}
+			}
+			cpuRequests = append(cpuRequests, cpu)
+			ramRequests = append(ramRequests, ram)
+		}
+
+		cpuOverhead := pod.Spec.Overhead[v1.ResourceCPU]
+		ramOverhead := pod.Spec.Overhead[v1.ResourceMemory]
+		cpuShares := overheadShares(float64(cpuOverhead.MilliValue())/1000, cpuRequests)
+		ramShares := overheadShares(float64(ramOverhead.Value()), ramRequests)
+		for i, costs := range podCosts {
+			if cpuShares[i] > 0 {
+				costs.CPUOverhead = requestVectors(cpuShares[i], intervals, start, end)
+				costs.CPUAllocation = addVectors(costs.CPUAllocation, copyVectors(costs.CPUOverhead), defaultTimestampBucket)
+			}
+			if ramShares[i] > 0 {
+				costs.RAMOverhead = requestVectors(ramShares[i], intervals, start, end)
+				costs.RAMAllocation = addVectors(costs.RAMAllocation, copyVectors(costs.RAMOverhead), defaultTimestampBucket)
+			}
+		}
+	}
+}
+
+// podContainerCosts returns the cost data of the containers of the given pod, in the order of its spec
+func podContainerCosts(costData map[string]*CostData, pod *v1.Pod, clusterID string) []*CostData {
+	var podCosts []*CostData
+	for _, c := range pod.Spec.Containers {
+		key := newContainerMetricFromValues(clusterID, pod.GetObjectMeta().GetNamespace(), pod.GetObjectMeta().GetName(), c.Name, pod.Spec.NodeName).Key()
+		if costs, ok := costData[key]; ok {
+			podCosts = append(podCosts, costs)
+		}
+	}
+	return podCosts
+}
+
+// overheadShares splits the given overhead in proportion to the given requests, or evenly if they sum to zero
+func overheadShares(overhead float64, requests []float64) []float64 {
+	shares := make([]float64, len(requests))
+	total := 0.0
+	for _, request := range requests {
+		total += request
+	}
+	for i, request := range requests {
+		if total > 0 {
+			shares[i] = overhead * request / total
+		} else {
+			shares[i] = overhead / float64(len(requests))
+		}
+	}
+	return shares
+}
+
+// copyVectors returns a deep copy of the given vectors
+func copyVectors(vectors []*Vector) []*Vector {
+	copied := make([]*Vector, 0, len(vectors))
+	for _, v := range vectors {
+		copied = append(copied, &Vector{Timestamp: v.Timestamp, Value: v.Value})
+	}
+	return copied
+}
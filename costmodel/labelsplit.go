@@ -0,0 +1,132 @@
+package costmodel
+
+import (
+	"strconv"
+	"strings"
+
+	"k8s.io/klog"
+)
+
+// LabelSplitWeightsAnnotation is the pod annotation weighting the split of the pod's cost across the values of
+// a multi-valued label, of the form "VALUE=WEIGHT,...", e.g. "team-a=3,team-b=1"
+const LabelSplitWeightsAnnotation = "kubecost.com/label-split-weights"
+
+// SplitLabelValues returns the given cost data with each datum whose label is multi-valued, i.e. a comma-separated
+// list of values, split into one datum per value, carrying that value alone, with its costs scaled by the weight of
+// that value. Values are weighted evenly, unless LabelSplitWeightsAnnotation gives every value a weight. Data
+// missing the label are kept as they are, and so, as when values are not split, are not attributed to any value.
+// The original cost data is not modified.
+func SplitLabelValues(costData map[string]*CostData, label string) map[string]*CostData {
+	split := make(map[string]*CostData, len(costData))
+	for key, cd := range costData {
+		values := splitLabelValue(cd.Labels[label])
+		if len(values) < 2 {
+			split[key] = cd
+			continue
+		}
+
+		weights := labelSplitWeights(cd, values)
+		for i, value := range values {
+			newCd := *cd
+			newCd.Labels = make(map[string]string, len(cd.Labels))
+			for k, v := range cd.Labels {
+				newCd.Labels[k] = v
+			}
+			newCd.Labels[label] = value
+
+			newCd.RAMReq = scaledVectors(cd.RAMReq, weights[i])
+			newCd.RAMUsed = scaledVectors(cd.RAMUsed, weights[i])
+			newCd.CPUReq = scaledVectors(cd.CPUReq, weights[i])
+			newCd.CPUUsed = scaledVectors(cd.CPUUsed, weights[i])
+			newCd.RAMAllocation = scaledVectors(cd.RAMAllocation, weights[i])
+			newCd.CPUAllocation = scaledVectors(cd.CPUAllocation, weights[i])
+			newCd.GPUReq = scaledVectors(cd.GPUReq, weights[i])
+			newCd.NetworkData = scaledVectors(cd.NetworkData, weights[i])
+			if cd.PVCData != nil {
+				newCd.PVCData = make([]*PersistentVolumeClaimData, 0, len(cd.PVCData))
+				for _, pvc := range cd.PVCData {
+					newPvc := *pvc
+					newPvc.Values = scaledVectors(pvc.Values, weights[i])
+					newCd.PVCData = append(newCd.PVCData, &newPvc)
+				}
+			}
+			split[key+","+value] = &newCd
+		}
+	}
+	return split
+}
+
+// splitLabelValue returns the distinct, non-empty values of a comma-separated label value
+func splitLabelValue(labelValue string) []string {
+	values := []string{}
+	seen := make(map[string]bool)
+	for _, value := range strings.Split(labelValue, ",") {
+		value = strings.TrimSpace(value)
+		if value == "" || seen[value] {
+			continue
+		}
+		seen[value] = true
+		values = append(values, value)
+	}
+	return values
+}
+
+// labelSplitWeights returns the fraction of the cost of the given datum attributed to each of the given values,
+// by LabelSplitWeightsAnnotation if it weights every value, and evenly otherwise
+func labelSplitWeights(cd *CostData, values []string) []float64 {
+	weights := make([]float64, len(values))
+	for i := range weights {
+		weights[i] = 1.0 / float64(len(values))
+	}
+
+	annotation, ok := cd.Annotations[LabelSplitWeightsAnnotation]
+	if !ok {
+		return weights
+	}
+	byValue := make(map[string]float64)
+	for _, pair := range strings.Split(annotation, ",") {
+		kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(kv) != 2 {
+			klog.V(3).Infof("Splitting cost of pod %s/%s evenly: invalid %s annotation '%s'", cd.Namespace, cd.PodName, LabelSplitWeightsAnnotation, annotation)
+			return weights
+		}
+		w, err := strconv.ParseFloat(strings.TrimSpace(kv[1]), 64)
+		if err != nil || w < 0 {
+			klog.V(3).Infof("Splitting cost of pod %s/%s evenly: invalid %s annotation '%s'", cd.Namespace, cd.PodName, LabelSplitWeightsAnnotation, annotation)
+			return weights
+		}
+		byValue[strings.TrimSpace(kv[0])] = w
+	}
+
+	total := 0.0
+	for _, value := range values {
+		w, ok := byValue[value]
+		if !ok {
+			klog.V(3).Infof("Splitting cost of pod %s/%s evenly: %s annotation does not weight '%s'", cd.Namespace, cd.PodName, LabelSplitWeightsAnnotation, value)
+			return weights
+		}
+		total += w
+	}
+	if total == 0 {
+		return weights
+	}
+	for i, value := range values {
+		weights[i] = byValue[value] / total
+	}
+	return weights
+}
+
+// scaledVectors returns a copy of the given vectors with each value multiplied by weight
+func scaledVectors(vectors []*Vector, weight float64) []*Vector {
+	if vectors == nil {
+		return nil
+	}
+	scaled := make([]*Vector, 0, len(vectors))
+	for _, v := range vectors {
+		scaled = append(scaled, &Vector{
+			Timestamp: v.Timestamp,
+			Value:     v.Value * weight,
+		})
+	}
+	return scaled
+}
@@ -0,0 +1,164 @@
+package costmodel
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	costAnalyzerCloud "github.com/kubecost/cost-model/cloud"
+	prometheusClient "github.com/prometheus/client_golang/api"
+	v1 "k8s.io/api/core/v1"
+)
+
+const queryLoadBalancerCost = `avg(avg_over_time(kubecost_load_balancer_cost[%s] %s)) by (namespace, service_name, cluster)`
+
+// ServiceCost is the cost of the cloud resources provisioned for a service, i.e. the load balancer of a
+// LoadBalancer service. Data processed by the load balancer is not measured, so only its hourly cost accrues.
+type ServiceCost struct {
+	Name       string  `json:"name"`
+	Namespace  string  `json:"namespace"`
+	ClusterID  string  `json:"clusterId,omitempty"`
+	IngressIP  string  `json:"ingressIP,omitempty"`
+	HourlyCost float64 `json:"hourlyCost"`
+	TotalCost  float64 `json:"totalCost"`
+}
+
+// ComputeLoadBalancerCosts lists every LoadBalancer service in the cluster cache, priced by the given provider
+func (cm *CostModel) ComputeLoadBalancerCosts(cp costAnalyzerCloud.Provider) ([]*ServiceCost, error) {
+	lb, err := cp.LoadBalancerPricing()
+	if err != nil {
+		return nil, err
+	}
+
+	serviceCosts := []*ServiceCost{}
+	for _, service := range cm.Cache.GetAllServices() {
+		if service.Spec.Type != v1.ServiceTypeLoadBalancer {
+			continue
+		}
+		serviceCost := &ServiceCost{
+			Name:       service.Name,
+			Namespace:  service.Namespace,
+			HourlyCost: lb.HourlyCost,
+		}
+		if ingress := service.Status.LoadBalancer.Ingress; len(ingress) > 0 {
+			serviceCost.IngressIP = ingress[0].IP
+			if serviceCost.IngressIP == "" {
+				serviceCost.IngressIP = ingress[0].Hostname
+			}
+		}
+		serviceCosts = append(serviceCosts, serviceCost)
+	}
+	return serviceCosts, nil
+}
+
+// LoadBalancerCostsOverWindow returns the cost of each load balancer over the given window, from the
+// kubecost_load_balancer_cost metric recorded for it. Offset, if set, must be of the form "offset 1h". Series
+// without a cluster label belong to the local cluster.
+func LoadBalancerCostsOverWindow(cli prometheusClient.Client, windowString, offset string, localClusterID string) ([]*ServiceCost, error) {
+	window, err := time.ParseDuration(windowString)
+	if err != nil {
+		return nil, err
+	}
+
+	qr, err := Query(cli, fmt.Sprintf(queryLoadBalancerCost, windowString, offset))
+	if err != nil {
+		return nil, err
+	}
+	data, ok := qr.(map[string]interface{})["data"]
+	if !ok {
+		e, err := wrapPrometheusError(qr)
+		if err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf(e)
+	}
+	results, ok := data.(map[string]interface{})["result"].([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Improperly formatted results from prometheus, result field is not a slice")
+	}
+
+	serviceCosts := []*ServiceCost{}
+	for _, result := range results {
+		metric, ok := result.(map[string]interface{})["metric"].(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("Improperly formatted results from prometheus, metric is not a field in the vector")
+		}
+		namespace, _ := metric["namespace"].(string)
+		name, _ := metric["service_name"].(string)
+		if namespace == "" || name == "" {
+			continue
+		}
+		clusterID, _ := metric[clusterLabel].(string)
+		if clusterID == "" {
+			clusterID = localClusterID
+		}
+		dataPoint, ok := result.(map[string]interface{})["value"].([]interface{})
+		if !ok || len(dataPoint) != 2 {
+			return nil, fmt.Errorf("Improperly formatted datapoint from Prometheus")
+		}
+		hourlyCost, err := strconv.ParseFloat(dataPoint[1].(string), 64)
+		if err != nil {
+			return nil, err
+		}
+		serviceCosts = append(serviceCosts, &ServiceCost{
+			Name:       name,
+			Namespace:  namespace,
+			ClusterID:  clusterID,
+			HourlyCost: hourlyCost,
+			TotalCost:  hourlyCost * window.Hours(),
+		})
+	}
+	return serviceCosts, nil
+}
+
+// FilterServiceCosts returns the service costs in the given namespace and cluster, either of which matches
+// all if empty, and not in any of the excluded namespaces
+func FilterServiceCosts(serviceCosts []*ServiceCost, namespace string, cluster string, excludeNamespaces []string) []*ServiceCost {
+	excluded := make(map[string]bool, len(excludeNamespaces))
+	for _, ns := range excludeNamespaces {
+		excluded[ns] = true
+	}
+	filtered := []*ServiceCost{}
+	for _, serviceCost := range serviceCosts {
+		if namespace != "" && serviceCost.Namespace != namespace {
+			continue
+		}
+		if cluster != "" && serviceCost.ClusterID != cluster {
+			continue
+		}
+		if excluded[serviceCost.Namespace] {
+			continue
+		}
+		filtered = append(filtered, serviceCost)
+	}
+	return filtered
+}
+
+// AddLoadBalancerCosts attributes the discounted cost of each service to the LBCost of the aggregation
+// owning it, when aggregating by namespace or service. Owners without an aggregation, e.g. a namespace
+// whose only resource is a load balancer, are added.
+func AddLoadBalancerCosts(aggregations map[string]*Aggregation, field string, subfield string, serviceCosts []*ServiceCost, discount float64) {
+	for _, serviceCost := range serviceCosts {
+		var key string
+		if field == "namespace" {
+			key = serviceCost.Namespace
+		} else if field == "service" {
+			key = serviceCost.Name
+		} else {
+			continue
+		}
+
+		agg, ok := aggregations[key]
+		if !ok {
+			agg = &Aggregation{
+				Aggregator:         field,
+				AggregatorSubField: subfield,
+				Environment:        key,
+			}
+			aggregations[key] = agg
+		}
+		cost := serviceCost.TotalCost * (1 - discount)
+		agg.LBCost += cost
+		agg.TotalCost += cost
+	}
+}
@@ -4,10 +4,17 @@ import (
 	"fmt"
 	"math"
 	"strconv"
+	"sync"
 
 	costAnalyzerCloud "github.com/kubecost/cost-model/cloud"
+	prometheusClient "github.com/prometheus/client_golang/api"
+	"k8s.io/klog"
 )
 
+// queryPodNetworkTransmit is the GB transmitted by each pod as reported by cadvisor, whatever its destination,
+// from which egress is estimated for pods the network costs daemonset doesn't measure
+const queryPodNetworkTransmit = `sum(increase(container_network_transmit_bytes_total{pod_name!=""}[%s] %s)) by (namespace,pod_name) / 1024 / 1024 / 1024`
+
 // NetworkUsageVNetworkUsageDataector contains the network usage values for egress network traffic
 type NetworkUsageData struct {
 	PodName               string
@@ -15,6 +22,7 @@ type NetworkUsageData struct {
 	NetworkZoneEgress     []*Vector
 	NetworkRegionEgress   []*Vector
 	NetworkInternetEgress []*Vector
+	Estimated             bool // egress was split by destination by the configured NetworkEgressSplit, rather than measured
 }
 
 // NetworkUsageVector contains a network usage vector for egress network traffic
@@ -141,6 +149,155 @@ func GetNetworkCost(usage *NetworkUsageData, cloud costAnalyzerCloud.Provider) (
 	return results, nil
 }
 
+// networkEgressSplit returns the configured split by which the egress of pods which isn't measured by
+// destination is estimated, or nil if it isn't estimated
+func networkEgressSplit(cp costAnalyzerCloud.Provider) *costAnalyzerCloud.EgressSplit {
+	c, err := cp.GetConfig()
+	if err != nil {
+		return nil
+	}
+	split, err := costAnalyzerCloud.CustomEgressSplit(c)
+	if err != nil {
+		klog.V(1).Infof("Unable to estimate network egress: %s", err.Error())
+		return nil
+	}
+	return split
+}
+
+// estimateNetworkUsageData adds to the given usage data the egress of the pods in the given result of
+// queryPodNetworkTransmit which aren't measured by the network costs daemonset, split by destination by the
+// given split. Egress within a zone is free, so isn't added.
+func estimateNetworkUsageData(usageData map[string]*NetworkUsageData, tr interface{}, split *costAnalyzerCloud.EgressSplit, isRange bool) error {
+	vectorFn := getNetworkUsageVector
+	if isRange {
+		vectorFn = getNetworkUsageVectors
+	}
+	transmitted, err := vectorFn(tr)
+	if err != nil {
+		return err
+	}
+	for k, v := range transmitted {
+		if _, ok := usageData[k]; ok {
+			continue
+		}
+		usageData[k] = &NetworkUsageData{
+			PodName:               v.PodName,
+			Namespace:             v.Namespace,
+			NetworkZoneEgress:     scaledVectors(v.Values, split.CrossZone),
+			NetworkRegionEgress:   scaledVectors(v.Values, split.CrossRegion),
+			NetworkInternetEgress: scaledVectors(v.Values, split.Internet),
+			Estimated:             true,
+		}
+	}
+	return nil
+}
+
+// NetworkCosts is the egress of a pod, or of all pods of a namespace, over a window and its cost by destination.
+// Egress within a zone is free, so isn't reported.
+type NetworkCosts struct {
+	Namespace          string  `json:"namespace"`
+	PodName            string  `json:"pod,omitempty"`
+	ZoneEgressGB       float64 `json:"zoneEgressGB"`
+	RegionEgressGB     float64 `json:"regionEgressGB"`
+	InternetEgressGB   float64 `json:"internetEgressGB"`
+	ZoneEgressCost     float64 `json:"zoneEgressCost"`
+	RegionEgressCost   float64 `json:"regionEgressCost"`
+	InternetEgressCost float64 `json:"internetEgressCost"`
+	TotalCost          float64 `json:"totalCost"`
+	Estimated          bool    `json:"estimated"` // some egress was split by destination by the configured networkEgressSplit, rather than measured
+}
+
+func (n *NetworkCosts) add(o *NetworkCosts) {
+	n.ZoneEgressGB += o.ZoneEgressGB
+	n.RegionEgressGB += o.RegionEgressGB
+	n.InternetEgressGB += o.InternetEgressGB
+	n.ZoneEgressCost += o.ZoneEgressCost
+	n.RegionEgressCost += o.RegionEgressCost
+	n.InternetEgressCost += o.InternetEgressCost
+	n.TotalCost += o.TotalCost
+	n.Estimated = n.Estimated || o.Estimated
+}
+
+// ComputeNetworkCosts returns the egress costs of each pod over the given window, keyed by namespace and pod
+// name. Egress is measured by destination by the network costs daemonset if it is deployed, or else estimated
+// from the bytes transmitted by each pod by the configured networkEgressSplit, if any.
+func ComputeNetworkCosts(cli prometheusClient.Client, cp costAnalyzerCloud.Provider, window string, offset string) (map[string]*NetworkCosts, error) {
+	pricing, err := cp.NetworkPricing()
+	if err != nil {
+		return nil, NewCodedError(ErrorCodePricingMissing, err)
+	}
+	split := networkEgressSplit(cp)
+
+	queries := []string{
+		fmt.Sprintf(queryZoneNetworkUsage, window, offset),
+		fmt.Sprintf(queryRegionNetworkUsage, window, offset),
+		fmt.Sprintf(queryInternetNetworkUsage, window, offset),
+	}
+	if split != nil {
+		queries = append(queries, fmt.Sprintf(queryPodNetworkTransmit, window, offset))
+	}
+	results := make([]interface{}, len(queries))
+	errs := make([]error, len(queries))
+	var wg sync.WaitGroup
+	wg.Add(len(queries))
+	for i, query := range queries {
+		go func(i int, query string) {
+			defer wg.Done()
+			results[i], errs[i] = Query(cli, query)
+		}(i, query)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, NewCodedError(ErrorCodePromUnavailable, fmt.Errorf("Error querying prometheus: %s", err.Error()))
+		}
+	}
+
+	usageData, err := GetNetworkUsageData(results[0], results[1], results[2], false)
+	if err != nil {
+		// the metrics of the network costs daemonset are missing if it isn't deployed
+		klog.V(3).Infof("Unable to get measured network usage: %s", err.Error())
+		usageData = make(map[string]*NetworkUsageData)
+	}
+	if split != nil {
+		if err := estimateNetworkUsageData(usageData, results[3], split, false); err != nil {
+			return nil, err
+		}
+	}
+
+	costs := make(map[string]*NetworkCosts, len(usageData))
+	for key, usage := range usageData {
+		c := &NetworkCosts{
+			Namespace:        usage.Namespace,
+			PodName:          usage.PodName,
+			ZoneEgressGB:     totalVector(usage.NetworkZoneEgress),
+			RegionEgressGB:   totalVector(usage.NetworkRegionEgress),
+			InternetEgressGB: totalVector(usage.NetworkInternetEgress),
+			Estimated:        usage.Estimated,
+		}
+		c.ZoneEgressCost = c.ZoneEgressGB * pricing.ZoneNetworkEgressCost
+		c.RegionEgressCost = c.RegionEgressGB * pricing.RegionNetworkEgressCost
+		c.InternetEgressCost = c.InternetEgressGB * pricing.InternetNetworkEgressCost
+		c.TotalCost = c.ZoneEgressCost + c.RegionEgressCost + c.InternetEgressCost
+		costs[key] = c
+	}
+	return costs, nil
+}
+
+// NamespaceNetworkCosts sums the given network costs of pods by namespace
+func NamespaceNetworkCosts(podCosts map[string]*NetworkCosts) map[string]*NetworkCosts {
+	namespaceCosts := make(map[string]*NetworkCosts)
+	for _, podCost := range podCosts {
+		c, ok := namespaceCosts[podCost.Namespace]
+		if !ok {
+			c = &NetworkCosts{Namespace: podCost.Namespace}
+			namespaceCosts[podCost.Namespace] = c
+		}
+		c.add(podCost)
+	}
+	return namespaceCosts
+}
+
 func getNetworkUsageVector(qr interface{}) (map[string]*NetworkUsageVector, error) {
 	ncdmap := make(map[string]*NetworkUsageVector)
 	data, ok := qr.(map[string]interface{})["data"]
@@ -0,0 +1,75 @@
+package costmodel
+
+import (
+	v1 "k8s.io/api/core/v1"
+)
+
+// resourceNvidiaGPU is the extended resource by which NVIDIA's device plugin advertises the GPUs of a node
+const resourceNvidiaGPU v1.ResourceName = "nvidia.com/gpu"
+
+// NodeCapacity is the capacity of a node and how much of it is requested by the pods scheduled on it
+type NodeCapacity struct {
+	Node              string  `json:"node"`
+	CPUCores          float64 `json:"cpuCores"`
+	RAMBytes          float64 `json:"ramBytes"`
+	GPUCount          float64 `json:"gpuCount"`
+	AllocatedCPUCores float64 `json:"allocatedCpuCores"`
+	AllocatedRAMBytes float64 `json:"allocatedRamBytes"`
+}
+
+// ComputeNodeCapacities returns the capacity of each cached node, by its status, along with the CPU and RAM
+// requested by the pods scheduled on it which have not terminated
+func ComputeNodeCapacities(cache ClusterCache) map[string]*NodeCapacity {
+	capacities := make(map[string]*NodeCapacity)
+	for _, node := range cache.GetAllNodes() {
+		cpu := node.Status.Capacity[v1.ResourceCPU]
+		ram := node.Status.Capacity[v1.ResourceMemory]
+		gpu := node.Status.Capacity[resourceNvidiaGPU]
+		capacities[node.Name] = &NodeCapacity{
+			Node:     node.Name,
+			CPUCores: float64(cpu.MilliValue()) / 1000,
+			RAMBytes: float64(ram.Value()),
+			GPUCount: float64(gpu.Value()),
+		}
+	}
+
+	for _, pod := range cache.GetAllPods() {
+		if pod.Status.Phase == v1.PodSucceeded || pod.Status.Phase == v1.PodFailed {
+			continue
+		}
+		capacity, ok := capacities[pod.Spec.NodeName]
+		if !ok {
+			continue
+		}
+		capacity.AllocatedCPUCores += podRequest(pod, v1.ResourceCPU)
+		capacity.AllocatedRAMBytes += podRequest(pod, v1.ResourceMemory)
+	}
+	return capacities
+}
+
+// podRequest returns the amount of the given resource the scheduler reserves for the pod: the greater of the
+// sum of the requests of its containers and the largest request of its init containers, which run one at a
+// time, plus its overhead. CPU is in cores, and other resources in their units.
+func podRequest(pod *v1.Pod, resource v1.ResourceName) float64 {
+	value := func(resources v1.ResourceList) float64 {
+		quantity, ok := resources[resource]
+		if !ok {
+			return 0
+		}
+		if resource == v1.ResourceCPU {
+			return float64(quantity.MilliValue()) / 1000
+		}
+		return float64(quantity.Value())
+	}
+
+	request := 0.0
+	for _, container := range pod.Spec.Containers {
+		request += value(container.Resources.Requests)
+	}
+	for _, container := range pod.Spec.InitContainers {
+		if init := value(container.Resources.Requests); init > request {
+			request = init
+		}
+	}
+	return request + value(pod.Spec.Overhead)
+}
@@ -0,0 +1,691 @@
+package costmodel
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	costAnalyzerCloud "github.com/kubecost/cost-model/cloud"
+)
+
+// rangeTimeLayout is the layout of the start and end parameters of range queries
+const rangeTimeLayout = "2006-01-02T15:04:05.000Z"
+
+// dateLayout is the layout of dates, e.g. of the start and end of out of cluster costs, which are whole days
+const dateLayout = "2006-01-02"
+
+// timeParamFormats describes the formats of time parameters accepted by ParseTimeParam
+const timeParamFormats = `RFC3339, e.g. "2019-10-01T12:00:00Z" or "2019-10-01T12:00:00.000Z", Unix seconds or milliseconds, e.g. "1569931200", or a date, e.g. "2019-10-01"`
+
+// unixTimeRegex matches Unix times, which are milliseconds if they have more than 11 digits, i.e. after the year 5138
+// in seconds
+var unixTimeRegex = regexp.MustCompile(`^[0-9]{1,16}$`)
+
+// promDurationRegex matches the durations Prometheus accepts in range selectors and offsets, e.g. "1h30m" or "2d"
+var promDurationRegex = regexp.MustCompile(`^([0-9]+(ms|[smhdwy]))+$`)
+
+const (
+	// CostDataSourcePrometheus reads range cost data from Prometheus, or from the remote database if remote writes
+	// are enabled
+	CostDataSourcePrometheus = "prometheus"
+	// CostDataSourceSQL reads range cost data from the remote database alone, never querying Prometheus, so that
+	// historical reports are consistent with archived data
+	CostDataSourceSQL = "sql"
+)
+
+// aggregationFields are the fields costs can be aggregated by
+var aggregationFields = []string{"cluster", "namespace", "service", "deployment", "statefulset", "daemonset", "job", "cronjob", "nodepool", "label", "annotation", "image"}
+
+// ParamError names an invalid request parameter, along with the code and message of the reason it is invalid
+type ParamError struct {
+	Param   string `json:"param"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// ParamErrors are all of the invalid parameters of a request, so that they're reported at once rather than one
+// request at a time. The error code of a request failing validation is that of its first invalid parameter.
+type ParamErrors []ParamError
+
+func (e ParamErrors) Error() string {
+	messages := make([]string, 0, len(e))
+	for _, pe := range e {
+		messages = append(messages, pe.Message)
+	}
+	return strings.Join(messages, "; ")
+}
+
+// add reports the given parameter invalid with the given code
+func (e *ParamErrors) add(param string, code string, format string, args ...interface{}) {
+	*e = append(*e, ParamError{Param: param, Code: code, Message: fmt.Sprintf(format, args...)})
+}
+
+// err returns the errors coded as the first of them, or nil if there are none
+func (e ParamErrors) err() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return &CodedError{Code: e[0].Code, Err: e}
+}
+
+// paramErrors returns the invalid parameters reported by the given error, if it is a validation failure
+func paramErrors(err error) []ParamError {
+	if coded, ok := err.(*CodedError); ok {
+		err = coded.Err
+	}
+	if errs, ok := err.(ParamErrors); ok {
+		return errs
+	}
+	return nil
+}
+
+// ParseTimeParam parses a time parameter given in RFC3339, with or without fractional seconds, in Unix seconds or
+// milliseconds, or as a date, which is midnight UTC. The time is returned in UTC.
+func ParseTimeParam(value string) (time.Time, error) {
+	if unixTimeRegex.MatchString(value) {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err == nil {
+			if len(value) > 11 {
+				return time.Unix(0, n*int64(time.Millisecond)).UTC(), nil
+			}
+			return time.Unix(n, 0).UTC(), nil
+		}
+	}
+	// fractional seconds are accepted when parsing by RFC3339, even though it doesn't format them
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t.UTC(), nil
+	}
+	if t, err := time.Parse(dateLayout, value); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("Invalid time '%s'; must be %s", value, timeParamFormats)
+}
+
+// promDuration validates the given parameter, passed to Prometheus as a duration, returning whether it's set
+func (e *ParamErrors) promDuration(param string, value string, required bool) bool {
+	if value == "" {
+		if required {
+			e.add(param, ErrorCodeBadWindow, "Missing %s parameter", param)
+		}
+		return false
+	}
+	if !promDurationRegex.MatchString(value) {
+		e.add(param, ErrorCodeBadWindow, "Invalid %s '%s'; must be a duration, e.g. \"1h\" or \"7d\"", param, value)
+		return false
+	}
+	return true
+}
+
+// duration validates and parses the given duration parameter, which may be in days, e.g. "7d", returning 0 if
+// it isn't set or is invalid
+func (e *ParamErrors) duration(param string, value string, required bool) time.Duration {
+	if value == "" {
+		if required {
+			e.add(param, ErrorCodeBadWindow, "Missing %s parameter", param)
+		}
+		return 0
+	}
+	normalized, err := normalizeTimeParam(value)
+	var d time.Duration
+	if err == nil {
+		d, err = time.ParseDuration(normalized)
+	}
+	if err != nil || d <= 0 {
+		e.add(param, ErrorCodeBadWindow, "Invalid %s '%s'; must be a positive duration, e.g. \"1h\" or \"7d\"", param, value)
+		return 0
+	}
+	return d
+}
+
+// timeRange validates and parses the required start and end parameters, which must be in order, returning whether
+// they're both valid
+func (e *ParamErrors) timeRange(start string, end string) (time.Time, time.Time, bool) {
+	valid := true
+	var startTime, endTime time.Time
+	for _, p := range []struct {
+		param string
+		value string
+		t     *time.Time
+	}{{"start", start, &startTime}, {"end", end, &endTime}} {
+		if p.value == "" {
+			e.add(p.param, ErrorCodeBadWindow, "Missing %s parameter", p.param)
+			valid = false
+			continue
+		}
+		t, err := ParseTimeParam(p.value)
+		if err != nil {
+			e.add(p.param, ErrorCodeBadWindow, "Invalid %s '%s'; must be %s", p.param, p.value, timeParamFormats)
+			valid = false
+			continue
+		}
+		*p.t = t
+	}
+	if valid && endTime.Before(startTime) {
+		e.add("end", ErrorCodeBadWindow, "Invalid end '%s'; must not be before start '%s'", end, start)
+		valid = false
+	}
+	return startTime, endTime, valid
+}
+
+// location validates and loads the given IANA time zone, returning UTC if it isn't set or is invalid
+func (e *ParamErrors) location(timezone string) *time.Location {
+	if timezone == "" {
+		return time.UTC
+	}
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		e.add("timezone", ErrorCodeBadWindow, "Invalid timezone parameter '%s'; must be an IANA time zone name, e.g. \"America/New_York\"", timezone)
+		return time.UTC
+	}
+	return loc
+}
+
+// aggregation validates the given aggregation field and subfield, which is required for labels and annotations
+func (e *ParamErrors) aggregation(field string, subfield string, required bool) {
+	if field == "" {
+		if required {
+			e.add("aggregation", ErrorCodeBadRequest, "Missing aggregation field parameter")
+		}
+		return
+	}
+	known := false
+	for _, f := range aggregationFields {
+		known = known || f == field
+	}
+	if !known {
+		e.add("aggregation", ErrorCodeBadRequest, "Invalid aggregation '%s'; must be one of %s", field, strings.Join(aggregationFields, ", "))
+		return
+	}
+	if (field == "label" || field == "annotation") && subfield == "" {
+		e.add("aggregationSubfield", ErrorCodeBadRequest, "Missing aggregation subfield parameter for aggregation by %s", field)
+	}
+	if field == "image" && subfield != "" {
+		known = false
+		for _, mode := range imageRefModes {
+			known = known || mode == subfield
+		}
+		if !known {
+			e.add("aggregationSubfield", ErrorCodeBadRequest, "Invalid aggregation subfield '%s' for aggregation by image; must be one of %s", subfield, strings.Join(imageRefModes, ", "))
+		}
+	}
+}
+
+// positiveInt validates and parses the given integer parameter, which must be positive, returning def if it isn't
+// set or is invalid
+func (e *ParamErrors) positiveInt(param string, value string, def int) int {
+	if value == "" {
+		return def
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil || i < 1 {
+		e.add(param, ErrorCodeBadRequest, "Invalid %s '%s'; must be a positive integer", param, value)
+		return def
+	}
+	return i
+}
+
+// fraction validates and parses the given parameter, which must be a number greater than 0 and at most 1,
+// returning def if it isn't set or is invalid
+func (e *ParamErrors) fraction(param string, value string, def float64) float64 {
+	if value == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil || f <= 0 || f > 1 {
+		e.add(param, ErrorCodeBadRequest, "Invalid %s '%s'; must be a number greater than 0 and at most 1, e.g. \"0.8\"", param, value)
+		return def
+	}
+	return f
+}
+
+// podSelector validates and parses the given podSelector parameter, returning nil if it isn't set or is invalid
+func (e *ParamErrors) podSelector(value string) PodSelector {
+	selector, err := ParsePodSelector(value)
+	if err != nil {
+		e.add("podSelector", ErrorCodeBadRequest, "Invalid podSelector '%s'; %s", value, err.Error())
+		return nil
+	}
+	return selector
+}
+
+// CostDataModelParams are the parameters of CostDataModel: the window, e.g. "1h", of the costs, ending at the offset,
+// if set, before now, the selector of the pods to cost, if set, and optionally the field and subfield to aggregate
+// them by
+type CostDataModelParams struct {
+	Window              string
+	Offset              string
+	Namespace           string
+	Cluster             string
+	PodSelector         PodSelector
+	Aggregation         string
+	AggregationSubfield string
+
+	podSelector string
+}
+
+// NewCostDataModelParams reads the parameters of a CostDataModel request
+func NewCostDataModelParams(r *http.Request) *CostDataModelParams {
+	q := r.URL.Query()
+	return &CostDataModelParams{
+		Window:              q.Get("timeWindow"),
+		Offset:              q.Get("offset"),
+		Namespace:           q.Get("namespace"),
+		Cluster:             q.Get("cluster"),
+		Aggregation:         q.Get("aggregation"),
+		AggregationSubfield: q.Get("aggregationSubfield"),
+		podSelector:         q.Get("podSelector"),
+	}
+}
+
+// Validate returns the invalid parameters as ParamErrors, or nil if all are valid. It parses the PodSelector.
+func (p *CostDataModelParams) Validate() error {
+	var errs ParamErrors
+	errs.promDuration("timeWindow", p.Window, true)
+	errs.promDuration("offset", p.Offset, false)
+	p.PodSelector = errs.podSelector(p.podSelector)
+	errs.aggregation(p.Aggregation, p.AggregationSubfield, false)
+	return errs.err()
+}
+
+// CostDataModelRangeParams are the parameters of CostDataModelRange: the start and end of the range, the window,
+// or step, of its points, optionally overridden by the resolution or bounded by the minimum resolution, the time
+// zone whose days daily points are aligned to, the source of the data, the selector of the pods to cost, if set, and
+// optionally the field and subfield to aggregate them by
+type CostDataModelRangeParams struct {
+	Start               string
+	End                 string
+	Window              string
+	Resolution          string
+	MinResolution       time.Duration
+	Timezone            string
+	Location            *time.Location
+	Source              string
+	Namespace           string
+	Cluster             string
+	PodSelector         PodSelector
+	Aggregation         string
+	AggregationSubfield string
+
+	minResolution string
+	podSelector   string
+}
+
+// NewCostDataModelRangeParams reads the parameters of a CostDataModelRange request
+func NewCostDataModelRangeParams(r *http.Request) *CostDataModelRangeParams {
+	q := r.URL.Query()
+	return &CostDataModelRangeParams{
+		Start:               q.Get("start"),
+		End:                 q.Get("end"),
+		Window:              q.Get("window"),
+		Resolution:          q.Get("resolution"),
+		Timezone:            q.Get("timezone"),
+		Source:              q.Get("source"),
+		Namespace:           q.Get("namespace"),
+		Cluster:             q.Get("cluster"),
+		Aggregation:         q.Get("aggregation"),
+		AggregationSubfield: q.Get("aggregationSubfield"),
+		minResolution:       q.Get("minResolution"),
+		podSelector:         q.Get("podSelector"),
+	}
+}
+
+// Validate returns the invalid parameters as ParamErrors, or nil if all are valid. It parses MinResolution and the
+// PodSelector, loads the Location of the Timezone, defaults Source, and formats Start and End in the layout of range
+// queries.
+func (p *CostDataModelRangeParams) Validate() error {
+	var errs ParamErrors
+	if start, end, ok := errs.timeRange(p.Start, p.End); ok {
+		p.Start, p.End = start.Format(rangeTimeLayout), end.Format(rangeTimeLayout)
+	}
+	errs.duration("window", p.Window, true)
+	errs.duration("resolution", p.Resolution, false)
+	p.MinResolution = errs.duration("minResolution", p.minResolution, false)
+	p.Location = errs.location(p.Timezone)
+	if p.Source == "" {
+		p.Source = CostDataSourcePrometheus
+	}
+	if p.Source != CostDataSourcePrometheus && p.Source != CostDataSourceSQL {
+		errs.add("source", ErrorCodeBadRequest, "Invalid source '%s'; must be '%s' or '%s'", p.Source, CostDataSourcePrometheus, CostDataSourceSQL)
+	}
+	p.PodSelector = errs.podSelector(p.podSelector)
+	errs.aggregation(p.Aggregation, p.AggregationSubfield, false)
+	return errs.err()
+}
+
+// AggregateCostModelParams are the parameters of AggregateCostModel by which its window is determined: the window,
+// e.g. "7d", of the costs, ending at the offset, if set, before now, and aligned to whole days of the timezone, if
+// set, along with the selector of the pods to cost, if set, the field and subfield to aggregate them by, how idle
+// costs are reported, and how costs are allocated, shared, converted and rounded
+type AggregateCostModelParams struct {
+	Window              string
+	Offset              string
+	PodSelector         PodSelector
+	Aggregation         string
+	AggregationSubfield string
+	IdleMode            string
+	Timezone            string
+	Location            *time.Location
+	SharedLabelNames    []string
+	SharedLabelValues   []string
+	Currency            string
+	CurrencyRate        float64
+	Precision           int
+	PVBillingMode       string
+	AllocationPolicy    string
+	CostBasis           string
+	Categories          CostCategories
+
+	start             string
+	end               string
+	podSelector       string
+	sharedLabelNames  string
+	sharedLabelValues string
+	precision         string
+	categories        string
+}
+
+// NewAggregateCostModelParams reads the parameters of an AggregateCostModel request. The aggregation field defaults
+// to $DEFAULT_AGGREGATION, if set.
+func NewAggregateCostModelParams(r *http.Request) *AggregateCostModelParams {
+	q := r.URL.Query()
+	aggregation := q.Get("aggregation")
+	if aggregation == "" {
+		aggregation = os.Getenv(defaultAggregationEnvVar)
+	}
+	return &AggregateCostModelParams{
+		Window:              q.Get("window"),
+		Offset:              q.Get("offset"),
+		Aggregation:         aggregation,
+		AggregationSubfield: q.Get("aggregationSubfield"),
+		IdleMode:            q.Get("idleMode"),
+		Timezone:            q.Get("timezone"),
+		Currency:            q.Get("currency"),
+		PVBillingMode:       q.Get("pvBillingMode"),
+		AllocationPolicy:    q.Get("allocationPolicy"),
+		CostBasis:           q.Get("costBasis"),
+		start:               q.Get("start"),
+		end:                 q.Get("end"),
+		podSelector:         q.Get("podSelector"),
+		sharedLabelNames:    q.Get("sharedLabelNames"),
+		sharedLabelValues:   q.Get("sharedLabelValues"),
+		precision:           q.Get("precision"),
+		categories:          q.Get("categories"),
+	}
+}
+
+// Validate returns the invalid parameters as ParamErrors, or nil if all are valid. It defaults IdleMode, parses the
+// PodSelector, loads the Location of the Timezone, pairs the shared labels, looks up the rate of the Currency in the
+// config of the given provider, parses the Precision and Categories, and defaults the PVBillingMode,
+// AllocationPolicy and CostBasis.
+func (p *AggregateCostModelParams) Validate(cp costAnalyzerCloud.Provider) error {
+	var errs ParamErrors
+	errs.aggregation(p.Aggregation, p.AggregationSubfield, true)
+	errs.duration("window", p.Window, true)
+	if p.Offset != "" {
+		if _, err := time.ParseDuration(p.Offset); err != nil {
+			errs.add("offset", ErrorCodeBadWindow, "Invalid offset '%s'; must be a duration, e.g. \"1h\"", p.Offset)
+		}
+	}
+	// aggregations span a window ending at the offset, rather than a range
+	for _, param := range []struct{ name, value string }{{"start", p.start}, {"end", p.end}} {
+		if param.value != "" {
+			errs.add(param.name, ErrorCodeBadWindow, "Invalid %s parameter; aggregations are over a window and offset, not a start and end", param.name)
+		}
+	}
+
+	// idleMode determines how idle cost is reported when allocateIdle is "true": "coefficient" (default)
+	// scales container costs to cover idle, while "category" reports it as a separate aggregation
+	if p.IdleMode == "" {
+		p.IdleMode = IdleModeCoefficient
+	}
+	if p.IdleMode != IdleModeCoefficient && p.IdleMode != IdleModeCategory {
+		errs.add("idleMode", ErrorCodeBadRequest, "Invalid idleMode parameter '%s'; must be '%s' or '%s'", p.IdleMode, IdleModeCoefficient, IdleModeCategory)
+	}
+
+	p.PodSelector = errs.podSelector(p.podSelector)
+	p.Location = errs.location(p.Timezone)
+
+	var err error
+	if p.SharedLabelNames, p.SharedLabelValues, err = parseSharedLabels(p.sharedLabelNames, p.sharedLabelValues); err != nil {
+		errs.add("sharedLabelNames", ErrorCodeBadRequest, "%s", err.Error())
+	}
+	if p.Currency, p.CurrencyRate, err = parseCurrency(p.Currency, cp); err != nil {
+		errs.add("currency", ErrorCodeBadRequest, "%s", err.Error())
+	}
+	if p.Precision, err = parsePrecision(p.precision); err != nil {
+		errs.add("precision", ErrorCodeBadRequest, "%s", err.Error())
+	}
+	if mode, err := ValidatePVBillingMode(p.PVBillingMode); err != nil {
+		errs.add("pvBillingMode", ErrorCodeBadRequest, "%s", err.Error())
+	} else {
+		p.PVBillingMode = mode
+	}
+	if policy, err := ValidateAllocationPolicy(p.AllocationPolicy); err != nil {
+		errs.add("allocationPolicy", ErrorCodeBadRequest, "%s", err.Error())
+	} else {
+		p.AllocationPolicy = policy
+	}
+	if basis, err := ValidateCostBasis(p.CostBasis); err != nil {
+		errs.add("costBasis", ErrorCodeBadRequest, "%s", err.Error())
+	} else {
+		p.CostBasis = basis
+	}
+	if p.Categories, err = ParseCostCategories(p.categories); err != nil {
+		errs.add("categories", ErrorCodeBadRequest, "%s", err.Error())
+	}
+	return errs.err()
+}
+
+// ClusterCostsOverTimeParams are the parameters of ClusterCostsOverTime: the start and end of the range, the
+// window, or step, of its points, and the offset of the queries, if set
+type ClusterCostsOverTimeParams struct {
+	Start  string
+	End    string
+	Window string
+	Offset string
+}
+
+// NewClusterCostsOverTimeParams reads the parameters of a ClusterCostsOverTime request
+func NewClusterCostsOverTimeParams(r *http.Request) *ClusterCostsOverTimeParams {
+	q := r.URL.Query()
+	return &ClusterCostsOverTimeParams{
+		Start:  q.Get("start"),
+		End:    q.Get("end"),
+		Window: q.Get("window"),
+		Offset: q.Get("offset"),
+	}
+}
+
+// Validate returns the invalid parameters as ParamErrors, or nil if all are valid. It formats Start and End in the
+// layout of range queries.
+func (p *ClusterCostsOverTimeParams) Validate() error {
+	var errs ParamErrors
+	if start, end, ok := errs.timeRange(p.Start, p.End); ok {
+		p.Start, p.End = start.Format(rangeTimeLayout), end.Format(rangeTimeLayout)
+	}
+	// the window is both the step of the range and the range selector of the storage query
+	if errs.promDuration("window", p.Window, true) {
+		if d, err := time.ParseDuration(p.Window); err != nil || d <= 0 {
+			errs.add("window", ErrorCodeBadWindow, "Invalid window '%s'; must be a positive duration of hours, minutes or seconds, e.g. \"1h\"", p.Window)
+		}
+	}
+	errs.promDuration("offset", p.Offset, false)
+	return errs.err()
+}
+
+// OutOfClusterCostsParams are the parameters of OutofClusterCosts by which the costs are selected and paged: the
+// days they start and end at, and the 1-based page, defaulting to the first, and the page size, which is 0 if the
+// response isn't paged
+type OutOfClusterCostsParams struct {
+	Start    string
+	End      string
+	Page     int
+	PageSize int
+
+	page     string
+	pageSize string
+}
+
+// NewOutOfClusterCostsParams reads the parameters of an OutofClusterCosts request
+func NewOutOfClusterCostsParams(r *http.Request) *OutOfClusterCostsParams {
+	q := r.URL.Query()
+	return &OutOfClusterCostsParams{
+		Start:    q.Get("start"),
+		End:      q.Get("end"),
+		page:     q.Get("page"),
+		pageSize: q.Get("pageSize"),
+	}
+}
+
+// Validate returns the invalid parameters as ParamErrors, or nil if all are valid. It parses Page and PageSize, and
+// formats Start and End as the dates they fall on.
+func (p *OutOfClusterCostsParams) Validate() error {
+	var errs ParamErrors
+	if start, end, ok := errs.timeRange(p.Start, p.End); ok {
+		p.Start, p.End = start.Format(dateLayout), end.Format(dateLayout)
+	}
+	p.Page = errs.positiveInt("page", p.page, 1)
+	p.PageSize = errs.positiveInt("pageSize", p.pageSize, 0)
+	return errs.err()
+}
+
+// RequestSizingParams are the parameters of RequestSizing: the window, e.g. "7d", of the usage by which requests are
+// sized, ending at the offset, if set, before now, the quantile of that usage and the target utilization of the
+// recommended requests, along with the namespace to recommend requests in, if set, and how recommendations are
+// sorted
+type RequestSizingParams struct {
+	Window            string
+	Offset            string
+	Namespace         string
+	SortBy            string
+	Quantile          float64
+	TargetUtilization float64
+
+	quantile          string
+	targetUtilization string
+}
+
+// NewRequestSizingParams reads the parameters of a RequestSizing request
+func NewRequestSizingParams(r *http.Request) *RequestSizingParams {
+	q := r.URL.Query()
+	return &RequestSizingParams{
+		Window:            q.Get("window"),
+		Offset:            q.Get("offset"),
+		Namespace:         q.Get("namespace"),
+		SortBy:            q.Get("sortBy"),
+		quantile:          q.Get("quantile"),
+		targetUtilization: q.Get("targetUtilization"),
+	}
+}
+
+// Validate returns the invalid parameters as ParamErrors, or nil if all are valid. It defaults Window to a week,
+// Quantile to the 95th percentile, TargetUtilization to 80% and SortBy to savings.
+func (p *RequestSizingParams) Validate() error {
+	var errs ParamErrors
+	if p.Window == "" {
+		p.Window = "7d"
+	}
+	errs.duration("window", p.Window, true)
+	if p.Offset != "" {
+		if _, err := time.ParseDuration(p.Offset); err != nil {
+			errs.add("offset", ErrorCodeBadWindow, "Invalid offset '%s'; must be a duration, e.g. \"1h\"", p.Offset)
+		}
+	}
+	p.Quantile = errs.fraction("quantile", p.quantile, 0.95)
+	p.TargetUtilization = errs.fraction("targetUtilization", p.targetUtilization, 0.8)
+	if p.SortBy == "" {
+		p.SortBy = RequestSizingSortBySavings
+	}
+	if p.SortBy != RequestSizingSortBySavings && p.SortBy != RequestSizingSortByName {
+		errs.add("sortBy", ErrorCodeBadRequest, "Invalid sortBy parameter '%s'; must be '%s' or '%s'", p.SortBy, RequestSizingSortBySavings, RequestSizingSortByName)
+	}
+	return errs.err()
+}
+
+// ClusterSizingParams are the parameters of ClusterSizing: the window, e.g. "7d", of the requests and usage by which
+// the cluster is sized, ending at the offset, if set, before now, the fraction of headroom to leave over them, and the
+// instance types, other than those of the cluster's nodes, to consider
+type ClusterSizingParams struct {
+	Window         string
+	Offset         string
+	Headroom       float64
+	CandidateTypes []string
+
+	headroom string
+}
+
+// NewClusterSizingParams reads the parameters of a ClusterSizing request, whose candidate types are a comma-separated
+// list, e.g. "m5.large,m5.xlarge"
+func NewClusterSizingParams(r *http.Request) *ClusterSizingParams {
+	q := r.URL.Query()
+	p := &ClusterSizingParams{
+		Window:   q.Get("window"),
+		Offset:   q.Get("offset"),
+		headroom: q.Get("headroom"),
+	}
+	for _, t := range strings.Split(q.Get("candidateTypes"), ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			p.CandidateTypes = append(p.CandidateTypes, t)
+		}
+	}
+	return p
+}
+
+// Validate returns the invalid parameters as ParamErrors, or nil if all are valid. It defaults Window to a week and
+// Headroom to 20%.
+func (p *ClusterSizingParams) Validate() error {
+	var errs ParamErrors
+	if p.Window == "" {
+		p.Window = "7d"
+	}
+	errs.duration("window", p.Window, true)
+	if p.Offset != "" {
+		if _, err := time.ParseDuration(p.Offset); err != nil {
+			errs.add("offset", ErrorCodeBadWindow, "Invalid offset '%s'; must be a duration, e.g. \"1h\"", p.Offset)
+		}
+	}
+	p.Headroom = 0.2
+	if p.headroom != "" {
+		h, err := strconv.ParseFloat(p.headroom, 64)
+		if err != nil || h < 0 {
+			errs.add("headroom", ErrorCodeBadRequest, "Invalid headroom '%s'; must be a number of at least 0, e.g. \"0.2\"", p.headroom)
+		} else {
+			p.Headroom = h
+		}
+	}
+	return errs.err()
+}
+
+// StorageSavingsParams are the parameters of a StorageSavings request
+type StorageSavingsParams struct {
+	Window string
+	Offset string
+}
+
+// NewStorageSavingsParams reads the parameters of a StorageSavings request
+func NewStorageSavingsParams(r *http.Request) *StorageSavingsParams {
+	q := r.URL.Query()
+	return &StorageSavingsParams{
+		Window: q.Get("window"),
+		Offset: q.Get("offset"),
+	}
+}
+
+// Validate returns the invalid parameters as ParamErrors, or nil if all are valid. It defaults Window to a week.
+func (p *StorageSavingsParams) Validate() error {
+	var errs ParamErrors
+	if p.Window == "" {
+		p.Window = "7d"
+	}
+	errs.duration("window", p.Window, true)
+	if p.Offset != "" {
+		if _, err := time.ParseDuration(p.Offset); err != nil {
+			errs.add("offset", ErrorCodeBadWindow, "Invalid offset '%s'; must be a duration, e.g. \"1h\"", p.Offset)
+		}
+	}
+	return errs.err()
+}
@@ -0,0 +1,256 @@
+package costmodel
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+)
+
+// The parquet and thrift constants used by writeParquet, as defined by parquet.thrift of the Parquet format
+const (
+	parquetMagic              = "PAR1"
+	parquetTypeInt64          = 2
+	parquetTypeDouble         = 5
+	parquetTypeByteArray      = 6
+	parquetConvertedTypeUTF8  = 0
+	parquetRepetitionRequired = 0
+	parquetEncodingPlain      = 0
+	parquetEncodingRLE        = 3
+	parquetCodecUncompressed  = 0
+	parquetPageTypeData       = 0
+
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// parquetColumn is a column of a parquet file, with its values PLAIN encoded
+type parquetColumn struct {
+	name   string
+	typ    int32
+	values bytes.Buffer
+}
+
+// writeParquet writes the given slice of structs to w as a Parquet file of one row group, with a required column
+// of each field tagged with a csv name, so that the same rows can be exported as either. Fields must be strings,
+// which are stored as UTF8, float64s or int64s. Pages are uncompressed and PLAIN encoded, which every reader
+// supports.
+func writeParquet(w io.Writer, rows interface{}) error {
+	v := reflect.ValueOf(rows)
+	if v.Kind() != reflect.Slice || v.Type().Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("Parquet rows must be a slice of structs, not %s", v.Type())
+	}
+	rowType := v.Type().Elem()
+
+	var columns []*parquetColumn
+	var fields []int
+	for i := 0; i < rowType.NumField(); i++ {
+		field := rowType.Field(i)
+		name := field.Tag.Get("csv")
+		if name == "" || name == "-" {
+			continue
+		}
+		column := &parquetColumn{name: name}
+		switch field.Type.Kind() {
+		case reflect.String:
+			column.typ = parquetTypeByteArray
+		case reflect.Float64:
+			column.typ = parquetTypeDouble
+		case reflect.Int64:
+			column.typ = parquetTypeInt64
+		default:
+			return fmt.Errorf("Unsupported type %s of parquet column %s", field.Type, name)
+		}
+		columns = append(columns, column)
+		fields = append(fields, i)
+	}
+
+	for r := 0; r < v.Len(); r++ {
+		row := v.Index(r)
+		for i, column := range columns {
+			value := row.Field(fields[i])
+			switch column.typ {
+			case parquetTypeByteArray:
+				binary.Write(&column.values, binary.LittleEndian, uint32(len(value.String())))
+				column.values.WriteString(value.String())
+			case parquetTypeDouble:
+				binary.Write(&column.values, binary.LittleEndian, math.Float64bits(value.Float()))
+			case parquetTypeInt64:
+				binary.Write(&column.values, binary.LittleEndian, value.Int())
+			}
+		}
+	}
+
+	var file bytes.Buffer
+	file.WriteString(parquetMagic)
+	numRows := int64(v.Len())
+
+	// each column chunk is a single data page. Required columns which aren't nested have no repetition or
+	// definition levels, so their pages are just their values.
+	var chunks []func(t *thriftWriter)
+	var rowGroupSize int64
+	for _, column := range columns {
+		column := column
+		header := &thriftWriter{}
+		header.beginStruct()
+		header.i32Field(1, parquetPageTypeData)
+		header.i32Field(2, int32(column.values.Len()))
+		header.i32Field(3, int32(column.values.Len()))
+		header.structField(5)
+		header.i32Field(1, int32(numRows))
+		header.i32Field(2, parquetEncodingPlain)
+		header.i32Field(3, parquetEncodingRLE)
+		header.i32Field(4, parquetEncodingRLE)
+		header.endStruct()
+		header.endStruct()
+
+		offset := int64(file.Len())
+		size := int64(header.buf.Len() + column.values.Len())
+		file.Write(header.buf.Bytes())
+		file.Write(column.values.Bytes())
+		rowGroupSize += size
+
+		chunks = append(chunks, func(t *thriftWriter) {
+			t.beginStruct()
+			t.i64Field(2, offset)
+			t.structField(3)
+			t.i32Field(1, column.typ)
+			t.listField(2, thriftI32, 2)
+			t.i32(parquetEncodingPlain)
+			t.i32(parquetEncodingRLE)
+			t.listField(3, thriftBinary, 1)
+			t.binary(column.name)
+			t.i32Field(4, parquetCodecUncompressed)
+			t.i64Field(5, numRows)
+			t.i64Field(6, size)
+			t.i64Field(7, size)
+			t.i64Field(9, offset)
+			t.endStruct()
+			t.endStruct()
+		})
+	}
+
+	meta := &thriftWriter{}
+	meta.beginStruct()
+	meta.i32Field(1, 1)
+	meta.listField(2, thriftStruct, len(columns)+1)
+	meta.beginStruct()
+	meta.binaryField(4, "schema")
+	meta.i32Field(5, int32(len(columns)))
+	meta.endStruct()
+	for _, column := range columns {
+		meta.beginStruct()
+		meta.i32Field(1, column.typ)
+		meta.i32Field(3, parquetRepetitionRequired)
+		meta.binaryField(4, column.name)
+		if column.typ == parquetTypeByteArray {
+			meta.i32Field(6, parquetConvertedTypeUTF8)
+		}
+		meta.endStruct()
+	}
+	meta.i64Field(3, numRows)
+	if numRows > 0 {
+		meta.listField(4, thriftStruct, 1)
+		meta.beginStruct()
+		meta.listField(1, thriftStruct, len(chunks))
+		for _, chunk := range chunks {
+			chunk(meta)
+		}
+		meta.i64Field(2, rowGroupSize)
+		meta.i64Field(3, numRows)
+		meta.endStruct()
+	} else {
+		meta.listField(4, thriftStruct, 0)
+	}
+	meta.binaryField(6, "kubecost cost-model")
+	meta.endStruct()
+
+	file.Write(meta.buf.Bytes())
+	binary.Write(&file, binary.LittleEndian, uint32(meta.buf.Len()))
+	file.WriteString(parquetMagic)
+	_, err := w.Write(file.Bytes())
+	return err
+}
+
+// thriftWriter encodes structs in the thrift compact protocol, in which parquet metadata is serialized
+type thriftWriter struct {
+	buf        bytes.Buffer
+	lastFields []int16 // the id of the last field written of each struct being written
+}
+
+func (t *thriftWriter) beginStruct() {
+	t.lastFields = append(t.lastFields, 0)
+}
+
+func (t *thriftWriter) endStruct() {
+	t.buf.WriteByte(0) // stop
+	t.lastFields = t.lastFields[:len(t.lastFields)-1]
+}
+
+func (t *thriftWriter) fieldHeader(id int16, typ byte) {
+	last := &t.lastFields[len(t.lastFields)-1]
+	if delta := id - *last; delta > 0 && delta <= 15 {
+		t.buf.WriteByte(byte(delta)<<4 | typ)
+	} else {
+		t.buf.WriteByte(typ)
+		t.zigzag(int64(id))
+	}
+	*last = id
+}
+
+func (t *thriftWriter) varint(v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(b[:], v)
+	t.buf.Write(b[:n])
+}
+
+func (t *thriftWriter) zigzag(v int64) {
+	t.varint(uint64((v << 1) ^ (v >> 63)))
+}
+
+func (t *thriftWriter) i32(v int32) {
+	t.zigzag(int64(v))
+}
+
+func (t *thriftWriter) binary(s string) {
+	t.varint(uint64(len(s)))
+	t.buf.WriteString(s)
+}
+
+func (t *thriftWriter) i32Field(id int16, v int32) {
+	t.fieldHeader(id, thriftI32)
+	t.i32(v)
+}
+
+func (t *thriftWriter) i64Field(id int16, v int64) {
+	t.fieldHeader(id, thriftI64)
+	t.zigzag(v)
+}
+
+func (t *thriftWriter) binaryField(id int16, s string) {
+	t.fieldHeader(id, thriftBinary)
+	t.binary(s)
+}
+
+// structField begins a field of a struct, the fields of which follow up to its endStruct
+func (t *thriftWriter) structField(id int16) {
+	t.fieldHeader(id, thriftStruct)
+	t.beginStruct()
+}
+
+// listField begins a field of a list of size elements of the given type, which follow it. Elements which are
+// structs are each written between beginStruct and endStruct.
+func (t *thriftWriter) listField(id int16, elemType byte, size int) {
+	t.fieldHeader(id, thriftList)
+	if size < 15 {
+		t.buf.WriteByte(byte(size)<<4 | elemType)
+	} else {
+		t.buf.WriteByte(0xf0 | elemType)
+		t.varint(uint64(size))
+	}
+}
@@ -0,0 +1,109 @@
+package costmodel
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// normalizationFallbackStr counts the samples of cAdvisor rather than of kube-state-metrics, to normalize usage
+// on clusters without kube-state-metrics
+const normalizationFallbackStr = `max(count_over_time(container_memory_working_set_bytes{}[%s] %s))`
+
+// queryWindowEnd returns the duration of the given prometheus window, e.g. "1d", and the time it ends at, now
+// shifted back by the given offset clause, e.g. "offset 1h", if any
+func queryWindowEnd(window string, offset string, now time.Time) (time.Duration, time.Time, error) {
+	normalized, err := normalizeTimeParam(window)
+	if err != nil {
+		return 0, now, err
+	}
+	d, err := time.ParseDuration(normalized)
+	if err != nil {
+		return 0, now, err
+	}
+	if o := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(offset), "offset")); o != "" {
+		if o, err = normalizeTimeParam(o); err != nil {
+			return 0, now, err
+		}
+		od, err := time.ParseDuration(o)
+		if err != nil {
+			return 0, now, err
+		}
+		now = now.Add(-od)
+	}
+	return d, now, nil
+}
+
+// containerStartTime returns the time the given container of the pod started running, or the pod started if
+// its container status is not known
+func containerStartTime(pod *v1.Pod, container string) time.Time {
+	for _, status := range pod.Status.ContainerStatuses {
+		if status.Name == container && status.State.Running != nil {
+			return status.State.Running.StartedAt.Time
+		}
+	}
+	if pod.Status.StartTime != nil {
+		return pod.Status.StartTime.Time
+	}
+	return time.Time{}
+}
+
+// podRequestVectors returns the CPU cores and RAM bytes requested in the specs of the containers of the given
+// running pods, keyed by ContainerMetric. Like the kube-state-metrics queries they stand in for, each request is
+// weighted by the fraction of the window ending at end for which its container has been running, so that a
+// container started halfway through the window is allocated half its request. Vectors are timestamped at now,
+// as instant queries are.
+func podRequestVectors(pods []*v1.Pod, clusterID string, window time.Duration, end time.Time, now time.Time) (map[string][]*Vector, map[string][]*Vector) {
+	cpu := make(map[string][]*Vector)
+	ram := make(map[string][]*Vector)
+	for _, pod := range pods {
+		if pod.Status.Phase != v1.PodRunning {
+			continue
+		}
+		for _, container := range pod.Spec.Containers {
+			uptime := 1.0
+			if start := containerStartTime(pod, container.Name); !start.IsZero() && window > 0 {
+				if windowStart := end.Add(-window); start.Before(windowStart) {
+					start = windowStart
+				}
+				uptime = float64(end.Sub(start)) / float64(window)
+				if uptime < 0 {
+					uptime = 0
+				} else if uptime > 1 {
+					uptime = 1
+				}
+			}
+
+			key := newContainerMetricFromValues(clusterID, pod.GetObjectMeta().GetNamespace(), pod.GetObjectMeta().GetName(), container.Name, pod.Spec.NodeName).Key()
+			timestamp := float64(now.Unix())
+			if q, ok := container.Resources.Requests[v1.ResourceCPU]; ok {
+				cpu[key] = []*Vector{&Vector{Timestamp: timestamp, Value: float64(q.MilliValue()) / 1000 * uptime}}
+			}
+			if q, ok := container.Resources.Requests[v1.ResourceMemory]; ok {
+				ram[key] = []*Vector{&Vector{Timestamp: timestamp, Value: float64(q.Value()) * uptime}}
+			}
+		}
+	}
+	return cpu, ram
+}
+
+// addAbsentRequests adds the requests estimated from pod specs of the containers which have no requests in the
+// given requests from prometheus, returning the number of containers added
+func addAbsentRequests(requests map[string][]*Vector, specRequests map[string][]*Vector) int {
+	added := 0
+	for key, vectors := range specRequests {
+		if _, ok := requests[key]; !ok {
+			requests[key] = vectors
+			added++
+		}
+	}
+	return added
+}
+
+// specRequestsWarning reports that the allocation of the given resource of the given number of containers is
+// estimated from pod specs, for want of their kube-state-metrics requests in prometheus
+func specRequestsWarning(resource string, containers int) string {
+	return fmt.Sprintf("Degraded allocation: no %s requests found in prometheus for %d running containers, e.g. as kube-state-metrics is not running, so their %s allocation is estimated from the requests in their pod specs", resource, containers, resource)
+}
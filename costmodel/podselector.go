@@ -0,0 +1,251 @@
+package costmodel
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	prometheusClient "github.com/prometheus/client_golang/api"
+	"k8s.io/klog"
+)
+
+// The types of label matchers, as in PromQL
+const (
+	MatchEqual     = "="
+	MatchNotEqual  = "!="
+	MatchRegexp    = "=~"
+	MatchNotRegexp = "!~"
+)
+
+// LabelMatcher matches the value of a pod label, by equality or by a regular expression matching the whole value.
+// Pods without the label match as if its value were empty.
+type LabelMatcher struct {
+	Name  string
+	Type  string
+	Value string
+
+	re *regexp.Regexp
+}
+
+// Matches reports whether the given value of the label matches
+func (m *LabelMatcher) Matches(value string) bool {
+	switch m.Type {
+	case MatchEqual:
+		return value == m.Value
+	case MatchNotEqual:
+		return value != m.Value
+	case MatchRegexp:
+		return m.re.MatchString(value)
+	default:
+		return !m.re.MatchString(value)
+	}
+}
+
+// String returns the matcher in PromQL syntax
+func (m *LabelMatcher) String() string {
+	return m.Name + m.Type + strconv.Quote(m.Value)
+}
+
+// PodSelector selects the pods whose labels match all of its matchers
+type PodSelector []*LabelMatcher
+
+var labelNameRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*`)
+
+// ParsePodSelector parses a selector of pods by their labels in the syntax of PromQL label matchers, optionally
+// enclosed in braces, e.g. `app=~"web.*",env="prod"`. Labels are named as kube-state-metrics exports them, without
+// the "label_" prefix, e.g. "app_kubernetes_io_name" for "app.kubernetes.io/name". Regular expressions must match
+// the whole value, as in PromQL. An empty selector selects every pod, and is returned as nil.
+func ParsePodSelector(selector string) (PodSelector, error) {
+	s := strings.TrimSpace(selector)
+	if strings.HasPrefix(s, "{") {
+		if !strings.HasSuffix(s, "}") {
+			return nil, fmt.Errorf("missing closing '}'")
+		}
+		s = strings.TrimSpace(s[1 : len(s)-1])
+	}
+
+	var matchers PodSelector
+	for s != "" {
+		name := labelNameRegexp.FindString(s)
+		if name == "" {
+			return nil, fmt.Errorf("expected a label name at '%s'", s)
+		}
+		s = strings.TrimSpace(s[len(name):])
+
+		matcher := &LabelMatcher{Name: name}
+		for _, t := range []string{MatchRegexp, MatchNotRegexp, MatchNotEqual, MatchEqual} {
+			if strings.HasPrefix(s, t) {
+				matcher.Type = t
+				break
+			}
+		}
+		if matcher.Type == "" {
+			return nil, fmt.Errorf("expected one of =, !=, =~ or !~ after label %s", name)
+		}
+		s = strings.TrimSpace(s[len(matcher.Type):])
+
+		value, rest, err := parseQuoted(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value of label %s: %s", name, err)
+		}
+		matcher.Value = value
+		if matcher.Type == MatchRegexp || matcher.Type == MatchNotRegexp {
+			matcher.re, err = regexp.Compile("^(?:" + value + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("invalid regular expression for label %s: %s", name, err)
+			}
+		}
+		matchers = append(matchers, matcher)
+
+		s = strings.TrimSpace(rest)
+		if s == "" {
+			break
+		}
+		if s[0] != ',' {
+			return nil, fmt.Errorf("expected ',' at '%s'", s)
+		}
+		s = strings.TrimSpace(s[1:])
+	}
+	return matchers, nil
+}
+
+// parseQuoted parses the string at the start of s, quoted as in PromQL by double or single quotes, which interpret
+// Go escape sequences, or by backticks, which don't, returning it and the rest of s
+func parseQuoted(s string) (string, string, error) {
+	if s == "" {
+		return "", "", fmt.Errorf("expected a quoted string")
+	}
+	quote := s[0]
+	if quote == '`' {
+		end := strings.IndexByte(s[1:], '`')
+		if end < 0 {
+			return "", "", fmt.Errorf("unterminated string %s", s)
+		}
+		return s[1 : end+1], s[end+2:], nil
+	}
+	if quote != '"' && quote != '\'' {
+		return "", "", fmt.Errorf("expected a quoted string at '%s'", s)
+	}
+
+	var value strings.Builder
+	rest := s[1:]
+	for {
+		if rest == "" {
+			return "", "", fmt.Errorf("unterminated string %s", s)
+		}
+		if rest[0] == quote {
+			return value.String(), rest[1:], nil
+		}
+		c, _, tail, err := strconv.UnquoteChar(rest, quote)
+		if err != nil {
+			return "", "", fmt.Errorf("invalid escape in %s", s)
+		}
+		value.WriteRune(c)
+		rest = tail
+	}
+}
+
+// String returns the selector in PromQL syntax, without braces, or "" if it selects every pod
+func (s PodSelector) String() string {
+	matchers := make([]string, 0, len(s))
+	for _, m := range s {
+		matchers = append(matchers, m.String())
+	}
+	return strings.Join(matchers, ",")
+}
+
+// Matches reports whether the given labels of a pod, named either as kube-state-metrics exports them or as they
+// are in Kubernetes, match every matcher of the selector
+func (s PodSelector) Matches(labels map[string]string) bool {
+	for _, m := range s {
+		value := ""
+		for k, v := range labels {
+			if k == m.Name || sanitizeLabelName(k) == m.Name {
+				value = v
+				break
+			}
+		}
+		if !m.Matches(value) {
+			return false
+		}
+	}
+	return true
+}
+
+// kubePodLabelsSelector returns the selector of the series of kube_pod_labels of the pods the selector selects
+func (s PodSelector) kubePodLabelsSelector() string {
+	matchers := make([]string, 0, len(s))
+	for _, m := range s {
+		matchers = append(matchers, "label_"+m.String())
+	}
+	return fmt.Sprintf("kube_pod_labels{%s}", strings.Join(matchers, ","))
+}
+
+// QueryPodSelector returns the query of the pods the selector selects at any time over the given window, e.g. "1d",
+// ending at the given offset, e.g. "offset 1h", if set. Pods are told apart by their cluster as well, as a
+// Prometheus scraping several clusters may have pods of the same name in each.
+func (s PodSelector) QueryPodSelector(window string, offset string) string {
+	return fmt.Sprintf(`max(max_over_time(%s[%s] %s)) by (%s, namespace, pod)`, s.kubePodLabelsSelector(), window, offset, clusterLabel)
+}
+
+// SelectPods queries the pods the selector selects at any time over the given window ending at the given offset,
+// each as "cluster,namespace,pod". Pods without a cluster label are of the local cluster.
+func SelectPods(cli prometheusClient.Client, selector PodSelector, window string, offset string, localClusterID string) (map[string]bool, error) {
+	result, err := Query(cli, selector.QueryPodSelector(window, offset))
+	if err != nil {
+		return nil, err
+	}
+	data, ok := result.(map[string]interface{})["data"]
+	if !ok {
+		e, err := wrapPrometheusError(result)
+		if err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf(e)
+	}
+
+	pods := make(map[string]bool)
+	for _, val := range data.(map[string]interface{})["result"].([]interface{}) {
+		metric, ok := val.(map[string]interface{})["metric"].(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("Metric field does not exist in data result vector")
+		}
+		namespace, _ := metric["namespace"].(string)
+		pod, _ := metric["pod"].(string)
+		if namespace == "" || pod == "" {
+			klog.V(3).Infof("Ignoring pod selected without a namespace and name: %v", metric)
+			continue
+		}
+		cluster, _ := metric[clusterLabel].(string)
+		if cluster == "" {
+			cluster = localClusterID
+		}
+		pods[cluster+","+namespace+","+pod] = true
+	}
+	return pods, nil
+}
+
+// SelectPodCostData returns the cost data of the containers of the pods the selector selects at any time over the
+// given window ending at the given offset, as queried by SelectPods. With no selector, it returns the cost data as
+// it is.
+func SelectPodCostData(cli prometheusClient.Client, costData map[string]*CostData, selector PodSelector, window string, offset string, localClusterID string) (map[string]*CostData, error) {
+	if len(selector) == 0 {
+		return costData, nil
+	}
+	pods, err := SelectPods(cli, selector, window, offset, localClusterID)
+	if err != nil {
+		return nil, err
+	}
+	selected := make(map[string]*CostData)
+	for key, costs := range costData {
+		cluster := costs.ClusterID
+		if cluster == "" {
+			cluster = localClusterID
+		}
+		if pods[cluster+","+costs.Namespace+","+costs.PodName] {
+			selected[key] = costs
+		}
+	}
+	return selected, nil
+}
@@ -0,0 +1,68 @@
+package costmodel
+
+import (
+	"fmt"
+
+	prometheusClient "github.com/prometheus/client_golang/api"
+	"k8s.io/klog"
+)
+
+const queryHistoricalPodUIDs = `max(max_over_time(kube_pod_info{uid!=""}[%s])) by (namespace,pod,node,uid)`
+
+// resolvePodUIDs sets the pod UIDs of the given cost data of containers whose pods aren't in the cluster cache,
+// e.g. of deleted pods, or of pods on the nodes they've since been rescheduled from, by the UIDs kube-state-metrics
+// recorded of the pods on each node over the window. Container data is keyed by node, so a pod's UID and node
+// identify its data on each node, and join it to its historical labels.
+func resolvePodUIDs(cli prometheusClient.Client, historicalContainers map[string]*CostData, window string) {
+	if len(historicalContainers) == 0 {
+		return
+	}
+	result, err := Query(cli, fmt.Sprintf(queryHistoricalPodUIDs, window))
+	var uids map[string]string
+	if err == nil {
+		uids, err = podUIDsFromPrometheusQuery(result)
+	}
+	if err != nil {
+		klog.V(1).Infof("Error fetching historical pod UIDs: %s", err.Error())
+		return
+	}
+	for _, costs := range historicalContainers {
+		if uid, ok := uids[costs.Namespace+","+costs.PodName+","+costs.NodeName]; ok {
+			costs.PodUID = uid
+		}
+	}
+}
+
+// podUIDsFromPrometheusQuery returns the UIDs of the pods in the result of a query of kube_pod_info series, keyed
+// by "namespace,pod,node". Of pods recreated under the same name on the same node within the window, the UID of
+// any one is returned.
+func podUIDsFromPrometheusQuery(qr interface{}) (map[string]string, error) {
+	toReturn := make(map[string]string)
+	data, ok := qr.(map[string]interface{})["data"]
+	if !ok {
+		e, err := wrapPrometheusError(qr)
+		if err != nil {
+			return toReturn, err
+		}
+		return toReturn, fmt.Errorf(e)
+	}
+	for _, val := range data.(map[string]interface{})["result"].([]interface{}) {
+		metricInterface, ok := val.(map[string]interface{})["metric"]
+		if !ok {
+			return toReturn, fmt.Errorf("Metric field does not exist in data result vector")
+		}
+		metricMap, ok := metricInterface.(map[string]interface{})
+		if !ok {
+			return toReturn, fmt.Errorf("Metric field is improperly formatted")
+		}
+		ns, _ := metricMap["namespace"].(string)
+		pod, _ := metricMap["pod"].(string)
+		node, _ := metricMap["node"].(string)
+		uid, _ := metricMap["uid"].(string)
+		if ns == "" || pod == "" || uid == "" {
+			continue
+		}
+		toReturn[ns+","+pod+","+node] = uid
+	}
+	return toReturn, nil
+}
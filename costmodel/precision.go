@@ -0,0 +1,121 @@
+package costmodel
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+// maxPrecision is the most decimals costs can be rounded to, beyond which a float64 holds no more digits
+const maxPrecision = 15
+
+// requestPrecision reads the number of decimals to round costs to from the precision parameter of the request.
+// It returns -1, for costs at full precision, if the parameter isn't set.
+func requestPrecision(r *http.Request) (int, error) {
+	return parsePrecision(r.URL.Query().Get("precision"))
+}
+
+// parsePrecision parses a number of decimals to round costs to, returning -1 if the value is empty
+func parsePrecision(value string) (int, error) {
+	if value == "" {
+		return -1, nil
+	}
+	precision, err := strconv.Atoi(value)
+	if err != nil || precision < 0 || precision > maxPrecision {
+		return 0, fmt.Errorf("Invalid precision '%s'; must be a number of decimals from 0 to %d", value, maxPrecision)
+	}
+	return precision, nil
+}
+
+// roundCost rounds the given cost to precision decimals, unless precision is negative
+func roundCost(cost float64, precision int) float64 {
+	if precision < 0 || math.IsNaN(cost) || math.IsInf(cost, 0) {
+		return cost
+	}
+	scale := math.Pow(10, float64(precision))
+	return math.Round(cost*scale) / scale
+}
+
+func roundVectors(vectors []*Vector, precision int) []*Vector {
+	if vectors == nil {
+		return nil
+	}
+	rounded := make([]*Vector, 0, len(vectors))
+	for _, v := range vectors {
+		rounded = append(rounded, &Vector{Timestamp: v.Timestamp, Value: roundCost(v.Value, precision)})
+	}
+	return rounded
+}
+
+// RoundAggregations returns a copy of the given aggregations with every cost rounded to precision decimals, or
+// the aggregations themselves if precision is negative. The total of each aggregation is the sum of its rounded
+// costs, so that they still add up.
+func RoundAggregations(aggregations map[string]*Aggregation, precision int) map[string]*Aggregation {
+	if precision < 0 {
+		return aggregations
+	}
+	rounded := make(map[string]*Aggregation, len(aggregations))
+	for key, agg := range aggregations {
+		r := *agg
+		r.CPUCost = roundCost(agg.CPUCost, precision)
+		r.RAMCost = roundCost(agg.RAMCost, precision)
+		r.GPUCost = roundCost(agg.GPUCost, precision)
+		r.PVCost = roundCost(agg.PVCost, precision)
+		r.NetworkCost = roundCost(agg.NetworkCost, precision)
+		r.LBCost = roundCost(agg.LBCost, precision)
+		r.SharedCost = roundCost(agg.SharedCost, precision)
+		r.MarkupCost = roundCost(agg.MarkupCost, precision)
+		r.ExternalCost = roundCost(agg.ExternalCost, precision)
+		r.IdleCost = roundCost(agg.IdleCost, precision)
+		r.TotalCost = roundCost(r.CPUCost+r.RAMCost+r.GPUCost+r.PVCost+r.NetworkCost+r.LBCost+r.SharedCost+r.MarkupCost+r.ExternalCost+r.IdleCost, precision)
+		r.CPUCostVector = roundVectors(agg.CPUCostVector, precision)
+		r.RAMCostVector = roundVectors(agg.RAMCostVector, precision)
+		r.PVCostVector = roundVectors(agg.PVCostVector, precision)
+		r.GPUCostVector = roundVectors(agg.GPUCostVector, precision)
+		r.NetworkCostVector = roundVectors(agg.NetworkCostVector, precision)
+		rounded[key] = &r
+	}
+	return rounded
+}
+
+// RoundAggregationMetadata returns a copy of the given metadata with its costs rounded to precision decimals, or
+// the metadata itself if precision is negative
+func RoundAggregationMetadata(metadata *AggregationMetadata, precision int) *AggregationMetadata {
+	if precision < 0 || metadata == nil {
+		return metadata
+	}
+	rounded := *metadata
+	if metadata.IdleCost != nil {
+		idleCost := roundCost(*metadata.IdleCost, precision)
+		rounded.IdleCost = &idleCost
+	}
+	if metadata.TotalClusterCost != nil {
+		totalClusterCost := roundCost(*metadata.TotalClusterCost, precision)
+		rounded.TotalClusterCost = &totalClusterCost
+	}
+	rounded.TotalAllocatedCost = roundCost(metadata.TotalAllocatedCost, precision)
+	rounded.ManagementFee = roundCost(metadata.ManagementFee, precision)
+	return &rounded
+}
+
+// RoundAggregationSummary rounds the costs of the given summary to precision decimals, in place, unless precision
+// is negative. Its total is the sum of its rounded costs.
+func RoundAggregationSummary(summary *AggregationSummary, precision int) *AggregationSummary {
+	if precision < 0 || summary == nil {
+		return summary
+	}
+	summary.CPUCost = roundCost(summary.CPUCost, precision)
+	summary.RAMCost = roundCost(summary.RAMCost, precision)
+	summary.GPUCost = roundCost(summary.GPUCost, precision)
+	summary.PVCost = roundCost(summary.PVCost, precision)
+	summary.NetworkCost = roundCost(summary.NetworkCost, precision)
+	summary.LBCost = roundCost(summary.LBCost, precision)
+	summary.SharedCost = roundCost(summary.SharedCost, precision)
+	summary.MarkupCost = roundCost(summary.MarkupCost, precision)
+	summary.ExternalCost = roundCost(summary.ExternalCost, precision)
+	summary.IdleCost = roundCost(summary.IdleCost, precision)
+	summary.TotalCost = roundCost(summary.CPUCost+summary.RAMCost+summary.GPUCost+summary.PVCost+summary.NetworkCost+
+		summary.LBCost+summary.SharedCost+summary.MarkupCost+summary.ExternalCost+summary.IdleCost, precision)
+	return summary
+}
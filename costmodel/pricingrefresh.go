@@ -0,0 +1,380 @@
+package costmodel
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	costAnalyzerCloud "github.com/kubecost/cost-model/cloud"
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/klog"
+)
+
+const (
+	pricingRefreshIntervalEnvVar  = "PRICING_REFRESH_INTERVAL"
+	pricingCachePathEnvVar        = "PRICING_CACHE_PATH"
+	defaultPricingCacheFile       = "pricing-cache.json" // in the config directory, unless PRICING_CACHE_PATH is set
+	refreshWebhookURLEnvVar       = "REFRESH_WEBHOOK_URL"
+	refreshWebhookTimeout         = 10 * time.Second
+	defaultPricingRefreshInterval = 24 * time.Hour
+	defaultPricingRefreshBackoff  = time.Minute
+	pricingRefreshJitter          = 0.1 // fraction of the interval by which each refresh is randomly advanced or delayed
+)
+
+const (
+	// PricingSourceLive means the pricing data was downloaded from the pricing API of the provider
+	PricingSourceLive = "live"
+	// PricingSourceCached means the pricing data was restored from the pricing cache, and hasn't been
+	// downloaded since
+	PricingSourceCached = "cached"
+	// PricingSourceDefault means no pricing data has been downloaded or restored, so default prices apply
+	PricingSourceDefault = "default"
+)
+
+// PricingSourceStatus reports where the pricing data in use comes from and how old it is
+type PricingSourceStatus struct {
+	Source     string  `json:"source"`
+	AgeSeconds float64 `json:"ageSeconds,omitempty"`
+	UpdatedAt  string  `json:"updatedAt,omitempty"`
+	LastError  string  `json:"lastError,omitempty"`
+	CacheFile  string  `json:"cacheFile,omitempty"`
+	Stale      bool    `json:"stale"` // the cached pricing data is in use as it couldn't be downloaded since
+}
+
+// PricingRefreshEvent is the body POSTed to the refresh webhook once a refresh of the pricing data completes
+type PricingRefreshEvent struct {
+	Success         bool    `json:"success"`
+	Error           string  `json:"error,omitempty"`
+	DurationSeconds float64 `json:"durationSeconds"`
+	CompletedAt     string  `json:"completedAt"`
+}
+
+// PricingRefresher downloads the pricing data of a provider every Interval, jittered so that replicas don't
+// refresh in lockstep, retrying failures with exponential backoff from MinBackoff up to Interval. Refreshes,
+// scheduled or not, are serialized, and each provider swaps in its new pricing data under its own lock, so
+// that in-flight cost computations read either the old or the new prices. If CacheFile is set and the provider
+// is a cloud.PricingCacher, each refresh is saved to CacheFile, to be restored on startup, or whenever a refresh
+// fails, as a failed download may leave the provider without prices. If WebhookURL is set,
+// the outcome of each refresh is POSTed to it as a PricingRefreshEvent.
+type PricingRefresher struct {
+	Cloud      costAnalyzerCloud.Provider
+	Interval   time.Duration
+	MinBackoff time.Duration
+	Errors     prometheus.Counter // counts failed refreshes, if set
+	CacheFile  string
+	WebhookURL string
+
+	refreshLock sync.Mutex
+	stateLock   sync.RWMutex
+	started     time.Time
+	lastRefresh time.Time
+	source      string
+	lastError   error
+	downloaded  chan struct{} // closed once pricing data has first been downloaded
+}
+
+// NewPricingRefresher returns a refresher of the pricing data of the given provider every interval
+func NewPricingRefresher(cp costAnalyzerCloud.Provider, interval time.Duration, errors prometheus.Counter) *PricingRefresher {
+	return &PricingRefresher{
+		Cloud:      cp,
+		Interval:   interval,
+		MinBackoff: defaultPricingRefreshBackoff,
+		Errors:     errors,
+		started:    time.Now(),
+		source:     PricingSourceDefault,
+	}
+}
+
+// Refresh downloads the pricing data of the provider now
+func (r *PricingRefresher) Refresh() error {
+	r.refreshLock.Lock()
+	defer r.refreshLock.Unlock()
+
+	start := time.Now()
+	err := r.Cloud.DownloadPricingData()
+	r.notify(err, time.Since(start))
+	r.stateLock.Lock()
+	r.lastError = err
+	if err == nil {
+		r.markDownloaded()
+	}
+	r.stateLock.Unlock()
+	if err != nil {
+		if r.Errors != nil {
+			r.Errors.Inc()
+		}
+		if loadErr := r.loadCache(); loadErr == nil {
+			klog.V(1).Infof("Failed to download pricing data; falling back to the stale pricing data cached in %s", r.CacheFile)
+		}
+		return err
+	}
+
+	if err := r.saveCache(); err != nil {
+		klog.V(1).Infof("Failed to save pricing cache: %s", err.Error())
+	}
+	return nil
+}
+
+// Reload downloads the pricing data of the given provider and, if that succeeds, refreshes it in place of the
+// current provider from then on, saving its pricing data to CacheFile. The current provider is kept if the download
+// fails.
+func (r *PricingRefresher) Reload(cp costAnalyzerCloud.Provider) error {
+	r.refreshLock.Lock()
+	defer r.refreshLock.Unlock()
+
+	start := time.Now()
+	err := cp.DownloadPricingData()
+	r.notify(err, time.Since(start))
+	if err != nil {
+		if r.Errors != nil {
+			r.Errors.Inc()
+		}
+		return err
+	}
+
+	r.stateLock.Lock()
+	r.Cloud = cp
+	r.lastError = nil
+	r.markDownloaded()
+	r.stateLock.Unlock()
+
+	if err := r.saveCache(); err != nil {
+		klog.V(1).Infof("Failed to save pricing cache: %s", err.Error())
+	}
+	return nil
+}
+
+// markDownloaded records that pricing data was just downloaded. It must be called with stateLock held.
+func (r *PricingRefresher) markDownloaded() {
+	r.lastRefresh = time.Now()
+	r.source = PricingSourceLive
+	if r.downloaded == nil {
+		r.downloaded = make(chan struct{})
+	}
+	select {
+	case <-r.downloaded:
+	default:
+		close(r.downloaded)
+	}
+}
+
+// notify POSTs the outcome of a refresh to WebhookURL, if set, in the background so that a slow or failing
+// webhook doesn't hold up or fail the refresh
+func (r *PricingRefresher) notify(err error, duration time.Duration) {
+	if r.WebhookURL == "" {
+		return
+	}
+	event := &PricingRefreshEvent{
+		Success:         err == nil,
+		DurationSeconds: duration.Seconds(),
+		CompletedAt:     time.Now().UTC().Format(time.RFC3339),
+	}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	body, jsonErr := json.Marshal(event)
+	if jsonErr != nil {
+		klog.V(1).Infof("Failed to serialize pricing refresh event: %s", jsonErr.Error())
+		return
+	}
+	go func() {
+		client := &http.Client{Timeout: refreshWebhookTimeout}
+		resp, err := client.Post(r.WebhookURL, "application/json", bytes.NewReader(body))
+		if err != nil {
+			klog.V(1).Infof("Failed to notify refresh webhook: %s", err.Error())
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			klog.V(1).Infof("Refresh webhook responded with status %d", resp.StatusCode)
+		}
+	}()
+}
+
+// refreshWebhookURLFromEnv returns the URL in REFRESH_WEBHOOK_URL to notify of pricing refreshes, if set
+func refreshWebhookURLFromEnv() (string, error) {
+	value := os.Getenv(refreshWebhookURLEnvVar)
+	if value == "" {
+		return "", nil
+	}
+	u, err := url.Parse(value)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("Invalid %s '%s'; must be an http or https URL", refreshWebhookURLEnvVar, value)
+	}
+	return value, nil
+}
+
+// LoadCache restores the pricing data saved to CacheFile, dating it from when it was saved
+func (r *PricingRefresher) LoadCache() error {
+	r.refreshLock.Lock()
+	defer r.refreshLock.Unlock()
+	return r.loadCache()
+}
+
+func (r *PricingRefresher) loadCache() error {
+	cacher, ok := r.Cloud.(costAnalyzerCloud.PricingCacher)
+	if !ok || r.CacheFile == "" {
+		return fmt.Errorf("Pricing cache is not enabled")
+	}
+
+	f, err := os.Open(r.CacheFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if err := cacher.LoadPricingData(f); err != nil {
+		return fmt.Errorf("Invalid pricing cache %s: %s", r.CacheFile, err.Error())
+	}
+
+	r.stateLock.Lock()
+	r.lastRefresh = info.ModTime()
+	r.source = PricingSourceCached
+	r.stateLock.Unlock()
+	return nil
+}
+
+// saveCache writes the pricing data to CacheFile, through a temporary file so that a crash mid-write doesn't
+// corrupt the previous cache
+func (r *PricingRefresher) saveCache() error {
+	cacher, ok := r.Cloud.(costAnalyzerCloud.PricingCacher)
+	if !ok || r.CacheFile == "" {
+		return nil
+	}
+
+	tmp := r.CacheFile + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	err = cacher.SavePricingData(f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, r.CacheFile)
+}
+
+// Status reports where the pricing data in use comes from and how old it is
+func (r *PricingRefresher) Status() *PricingSourceStatus {
+	r.stateLock.RLock()
+	defer r.stateLock.RUnlock()
+	status := &PricingSourceStatus{
+		Source: r.source,
+	}
+	if r.CacheFile != "" {
+		if _, ok := r.Cloud.(costAnalyzerCloud.PricingCacher); ok {
+			status.CacheFile = r.CacheFile
+		}
+	}
+	if !r.lastRefresh.IsZero() {
+		status.AgeSeconds = time.Since(r.lastRefresh).Seconds()
+		status.UpdatedAt = r.lastRefresh.UTC().Format(time.RFC3339)
+	}
+	if r.lastError != nil {
+		status.LastError = r.lastError.Error()
+		status.Stale = r.source == PricingSourceCached
+	}
+	return status
+}
+
+// Downloaded returns a channel closed once pricing data has first been downloaded, rather than restored from
+// the cache
+func (r *PricingRefresher) Downloaded() <-chan struct{} {
+	r.stateLock.Lock()
+	defer r.stateLock.Unlock()
+	if r.downloaded == nil {
+		r.downloaded = make(chan struct{})
+	}
+	return r.downloaded
+}
+
+// Age returns the time since the pricing data was last refreshed, or since the refresher was created if it
+// never has been
+func (r *PricingRefresher) Age() time.Duration {
+	r.stateLock.RLock()
+	defer r.stateLock.RUnlock()
+	if r.lastRefresh.IsZero() {
+		return time.Since(r.started)
+	}
+	return time.Since(r.lastRefresh)
+}
+
+// Start restores the pricing cache, refreshing the pricing data in the background if it was restored and right
+// away otherwise, then refreshes it on schedule until ctx is done, returning a channel closed once it stops. A
+// failure to download the pricing data at startup is retried with backoff, rather than on schedule.
+func (r *PricingRefresher) Start(ctx context.Context) <-chan struct{} {
+	if err := r.LoadCache(); err == nil {
+		klog.V(1).Infof("Restored pricing data from %s; refreshing it in the background", r.CacheFile)
+		return r.run(ctx, 0, 0)
+	} else if r.CacheFile != "" {
+		klog.V(2).Infof("Unable to restore pricing data: %s", err.Error())
+	}
+	if err := r.Refresh(); err != nil {
+		delay := r.backoff(1)
+		klog.V(1).Infof("Failed to download pricing data, retrying in %s: %s", delay, err.Error())
+		return r.run(ctx, delay, 1)
+	}
+	return r.Run(ctx)
+}
+
+// Run refreshes the pricing data on schedule until ctx is done, returning a channel closed once it stops
+func (r *PricingRefresher) Run(ctx context.Context) <-chan struct{} {
+	return r.run(ctx, r.jittered(r.Interval), 0)
+}
+
+// run refreshes the pricing data after the given delay, following the given number of consecutive failures,
+// and then on schedule until ctx is done
+func (r *PricingRefresher) run(ctx context.Context, delay time.Duration, failures int) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+
+			if err := r.Refresh(); err != nil {
+				failures++
+				delay = r.backoff(failures)
+				klog.V(1).Infof("Failed to refresh pricing data, retrying in %s: %s", delay, err.Error())
+				continue
+			}
+			klog.V(2).Infof("Refreshed pricing data")
+			failures = 0
+			delay = r.jittered(r.Interval)
+		}
+	}()
+	return done
+}
+
+// backoff returns the delay before retrying after the given number of consecutive failures
+func (r *PricingRefresher) backoff(failures int) time.Duration {
+	delay := r.MinBackoff
+	for i := 1; i < failures && delay < r.Interval; i++ {
+		delay *= 2
+	}
+	if delay > r.Interval {
+		delay = r.Interval
+	}
+	return delay
+}
+
+func (r *PricingRefresher) jittered(d time.Duration) time.Duration {
+	return time.Duration(float64(d) * (1 + pricingRefreshJitter*(2*rand.Float64()-1)))
+}
@@ -0,0 +1,485 @@
+package costmodel
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	prometheusClient "github.com/prometheus/client_golang/api"
+	"golang.org/x/sync/semaphore"
+	"k8s.io/klog"
+)
+
+const (
+	maxQueryRangeSpanEnvVar     = "MAX_QUERY_RANGE_SPAN"
+	defaultMaxQueryRangeSpan    = 7 * 24 * time.Hour
+	maxQueryConcurrencyEnvVar   = "MAX_QUERY_CONCURRENCY"
+	defaultMaxQueryConcurrency  = 5
+	maxPrometheusQueriesEnvVar  = "MAX_PROMETHEUS_QUERIES"
+	defaultMaxPrometheusQueries = 20
+
+	// MaxRangePoints is the number of points per series above which range queries are downsampled
+	MaxRangePoints = 500
+
+	thanosEnabledEnvVar         = "THANOS_ENABLED"
+	thanosPartialResponseEnvVar = "THANOS_PARTIAL_RESPONSE"
+	thanosReplicaLabelsEnvVar   = "THANOS_REPLICA_LABELS"
+	defaultThanosReplicaLabels  = "replica,prometheus_replica"
+)
+
+// MaxQueryRangeSpan returns the longest span of time a single range query may cover before it is split
+// into multiple sequential queries, read from MAX_QUERY_RANGE_SPAN and defaulting to 7 days.
+func MaxQueryRangeSpan() time.Duration {
+	spanStr := os.Getenv(maxQueryRangeSpanEnvVar)
+	if spanStr == "" {
+		return defaultMaxQueryRangeSpan
+	}
+	normalized, err := normalizeTimeParam(spanStr)
+	if err != nil {
+		klog.V(1).Infof("Invalid %s '%s', using default of %s", maxQueryRangeSpanEnvVar, spanStr, defaultMaxQueryRangeSpan)
+		return defaultMaxQueryRangeSpan
+	}
+	span, err := time.ParseDuration(normalized)
+	if err != nil || span <= 0 {
+		klog.V(1).Infof("Invalid %s '%s', using default of %s", maxQueryRangeSpanEnvVar, spanStr, defaultMaxQueryRangeSpan)
+		return defaultMaxQueryRangeSpan
+	}
+	return span
+}
+
+// MaxQueryConcurrency returns the number of prometheus queries a single cost data request may have in flight at
+// once, read from MAX_QUERY_CONCURRENCY and defaulting to 5.
+func MaxQueryConcurrency() int {
+	concurrencyStr := os.Getenv(maxQueryConcurrencyEnvVar)
+	if concurrencyStr == "" {
+		return defaultMaxQueryConcurrency
+	}
+	concurrency, err := strconv.Atoi(concurrencyStr)
+	if err != nil || concurrency <= 0 {
+		klog.V(1).Infof("Invalid %s '%s', using default of %d", maxQueryConcurrencyEnvVar, concurrencyStr, defaultMaxQueryConcurrency)
+		return defaultMaxQueryConcurrency
+	}
+	return concurrency
+}
+
+// MaxPrometheusQueries returns the number of prometheus queries the whole service may have in flight at once,
+// across all requests, read from MAX_PROMETHEUS_QUERIES and defaulting to 20.
+func MaxPrometheusQueries() int {
+	queriesStr := os.Getenv(maxPrometheusQueriesEnvVar)
+	if queriesStr == "" {
+		return defaultMaxPrometheusQueries
+	}
+	queries, err := strconv.Atoi(queriesStr)
+	if err != nil || queries <= 0 {
+		klog.V(1).Infof("Invalid %s '%s', using default of %d", maxPrometheusQueriesEnvVar, queriesStr, defaultMaxPrometheusQueries)
+		return defaultMaxPrometheusQueries
+	}
+	return queries
+}
+
+// prometheusQueries bounds the number of prometheus queries of the model in flight to MaxPrometheusQueries, as
+// read at startup, so that concurrent requests queue for prometheus rather than overwhelming it
+var (
+	prometheusQueriesLock sync.RWMutex
+	prometheusQueries     = semaphore.NewWeighted(int64(MaxPrometheusQueries()))
+)
+
+// SetMaxPrometheusQueries bounds the number of prometheus queries in flight to n from then on, in place of the
+// bound read from MAX_PROMETHEUS_QUERIES at startup. Queries already in flight, or waiting, keep the prior bound.
+func SetMaxPrometheusQueries(n int) {
+	prometheusQueriesLock.Lock()
+	defer prometheusQueriesLock.Unlock()
+	prometheusQueries = semaphore.NewWeighted(int64(n))
+}
+
+// acquirePrometheusQuery blocks until fewer than the bound of prometheus queries are in flight, or ctx is done,
+// returning the func releasing the query's slot once it completes
+func acquirePrometheusQuery(ctx context.Context) (func(), error) {
+	prometheusQueriesLock.RLock()
+	sem := prometheusQueries
+	prometheusQueriesLock.RUnlock()
+	if err := sem.Acquire(ctx, 1); err != nil {
+		return nil, err
+	}
+	return func() { sem.Release(1) }, nil
+}
+
+// downsampleResolutions are the steps long range queries are downsampled to, finest first
+var downsampleResolutions = []time.Duration{
+	time.Hour,
+	2 * time.Hour,
+	6 * time.Hour,
+	12 * time.Hour,
+	24 * time.Hour,
+	7 * 24 * time.Hour,
+}
+
+// DownsampledResolution returns step, or, if querying from start to end at step would return more than
+// MaxRangePoints points per series, the finest coarser resolution which doesn't.
+func DownsampledResolution(start, end time.Time, step time.Duration) time.Duration {
+	if step <= 0 || !end.After(start) || end.Sub(start)/step < MaxRangePoints {
+		return step
+	}
+	for _, resolution := range downsampleResolutions {
+		if resolution > step && end.Sub(start)/resolution < MaxRangePoints {
+			return resolution
+		}
+	}
+	return downsampleResolutions[len(downsampleResolutions)-1]
+}
+
+// MinRangeResolution returns the finest resolution, in whole minutes, at which querying from start to end returns
+// fewer than MaxRangePoints points per series
+func MinRangeResolution(start, end time.Time) time.Duration {
+	if !end.After(start) {
+		return 0
+	}
+	return (end.Sub(start)/MaxRangePoints/time.Minute + 1) * time.Minute
+}
+
+// ThanosEnabled returns true if THANOS_ENABLED is set, meaning queries are sent to a Thanos (or Cortex) querier
+// which fans out to several, possibly replicated, Prometheus instances.
+func ThanosEnabled() bool {
+	return os.Getenv(thanosEnabledEnvVar) == "true"
+}
+
+// ThanosPartialResponse returns whether the querier may answer with data from only the stores which are up,
+// read from THANOS_PARTIAL_RESPONSE and defaulting to true, as Thanos does.
+func ThanosPartialResponse() bool {
+	return os.Getenv(thanosPartialResponseEnvVar) != "false"
+}
+
+// ThanosReplicaLabels returns the labels which only distinguish replicas of the same series, read as a comma
+// separated list from THANOS_REPLICA_LABELS.
+func ThanosReplicaLabels() []string {
+	labelsStr := os.Getenv(thanosReplicaLabelsEnvVar)
+	if labelsStr == "" {
+		labelsStr = defaultThanosReplicaLabels
+	}
+	var replicaLabels []string
+	for _, label := range strings.Split(labelsStr, ",") {
+		if label = strings.TrimSpace(label); label != "" {
+			replicaLabels = append(replicaLabels, label)
+		}
+	}
+	return replicaLabels
+}
+
+// setThanosQueryParams adds the Thanos specific deduplication and partial response parameters to a query,
+// which the upstream prometheus API client has no way to express.
+func setThanosQueryParams(q url.Values) {
+	if !ThanosEnabled() {
+		return
+	}
+	q.Set("dedup", "true")
+	q.Set("partial_response", strconv.FormatBool(ThanosPartialResponse()))
+}
+
+// warningSet collects the warnings of concurrent queries, reporting each distinct warning once, as the same
+// failing store is typically reported by every query.
+type warningSet struct {
+	lock     sync.Mutex
+	seen     map[string]bool
+	warnings []string
+}
+
+func (ws *warningSet) add(warnings []string) {
+	ws.lock.Lock()
+	defer ws.lock.Unlock()
+	for _, warning := range warnings {
+		if ws.seen == nil {
+			ws.seen = make(map[string]bool)
+		}
+		if !ws.seen[warning] {
+			ws.seen[warning] = true
+			ws.warnings = append(ws.warnings, warning)
+		}
+	}
+}
+
+func (ws *warningSet) list() []string {
+	ws.lock.Lock()
+	defer ws.lock.Unlock()
+	return ws.warnings
+}
+
+// responseWarnings returns the warnings attached to a query response, which Thanos uses to report that a
+// partial response was served because some stores could not be reached.
+func responseWarnings(result interface{}) []string {
+	m, ok := result.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	ws, ok := m["warnings"].([]interface{})
+	if !ok {
+		return nil
+	}
+	var warnings []string
+	for _, w := range ws {
+		if wStr, ok := w.(string); ok {
+			warnings = append(warnings, fmt.Sprintf("Partial response from prometheus: %s", wStr))
+		}
+	}
+	return warnings
+}
+
+// dedupReplicaSeries removes the replica labels from each series in a query result and drops all but the first
+// series for each remaining label set, so that series scraped by each member of an HA pair aren't counted twice.
+func dedupReplicaSeries(result interface{}, replicaLabels []string) interface{} {
+	m, ok := result.(map[string]interface{})
+	if !ok {
+		return result
+	}
+	data, ok := m["data"].(map[string]interface{})
+	if !ok {
+		return result
+	}
+	rs, ok := data["result"].([]interface{})
+	if !ok {
+		return result
+	}
+
+	isReplicaLabel := make(map[string]bool)
+	for _, label := range replicaLabels {
+		isReplicaLabel[label] = true
+	}
+
+	seen := make(map[string]bool)
+	deduped := make([]interface{}, 0, len(rs))
+	for _, r := range rs {
+		s, ok := r.(map[string]interface{})
+		if !ok {
+			deduped = append(deduped, r)
+			continue
+		}
+		metric, ok := s["metric"].(map[string]interface{})
+		if !ok {
+			deduped = append(deduped, r)
+			continue
+		}
+		identifying := make(map[string]interface{}, len(metric))
+		for label, value := range metric {
+			if !isReplicaLabel[label] {
+				identifying[label] = value
+			}
+		}
+		// json sorts map keys, so this is a stable identifier for the label set
+		key, err := json.Marshal(identifying)
+		if err != nil {
+			deduped = append(deduped, r)
+			continue
+		}
+		if seen[string(key)] {
+			continue
+		}
+		seen[string(key)] = true
+		s["metric"] = identifying
+		deduped = append(deduped, s)
+	}
+	data["result"] = deduped
+
+	return result
+}
+
+// QueryRangeChunked behaves like QueryRange, but splits ranges longer than maxSpan into sequential sub-range
+// queries and stitches the results back together, which keeps each query under Prometheus' sample limits.
+// If allowPartial is true, sub-ranges which fail are skipped and reported in the returned warnings rather
+// than failing the whole query. Warnings attached by the querier to partial responses are returned as well.
+// Once ctx is cancelled, no further sub-ranges are queried.
+func QueryRangeChunked(ctx context.Context, cli prometheusClient.Client, query string, start, end time.Time, step time.Duration, maxSpan time.Duration, allowPartial bool) (interface{}, []string, error) {
+	if maxSpan <= 0 || end.Sub(start) <= maxSpan {
+		result, err := queryRangeWithContext(ctx, cli, query, start, end, step)
+		if err == nil {
+			err = prometheusResultError(result)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		return result, responseWarnings(result), nil
+	}
+
+	// align chunks to the step, so that samples from adjacent chunks line up and the
+	// sample on each boundary can be deduplicated
+	span := maxSpan
+	if step > 0 {
+		span = (maxSpan / step) * step
+		if span < step {
+			span = step
+		}
+	}
+
+	var results []interface{}
+	var warnings []string
+	for chunkStart := start; chunkStart.Before(end); chunkStart = chunkStart.Add(span) {
+		if err := ctx.Err(); err != nil {
+			return nil, warnings, err
+		}
+
+		chunkEnd := chunkStart.Add(span)
+		if chunkEnd.After(end) {
+			chunkEnd = end
+		}
+
+		result, err := queryRangeWithContext(ctx, cli, query, chunkStart, chunkEnd, step)
+		if err == nil {
+			err = prometheusResultError(result)
+		}
+		if err != nil {
+			if !allowPartial {
+				return nil, nil, err
+			}
+			klog.V(1).Infof("Skipping failed range query from %s to %s: %s", chunkStart.Format(time.RFC3339), chunkEnd.Format(time.RFC3339), err.Error())
+			warnings = append(warnings, fmt.Sprintf("Missing data from %s to %s: %s", chunkStart.Format(time.RFC3339), chunkEnd.Format(time.RFC3339), err.Error()))
+			continue
+		}
+		warnings = append(warnings, responseWarnings(result)...)
+		results = append(results, result)
+	}
+
+	if len(results) == 0 {
+		return nil, warnings, fmt.Errorf("All range queries from %s to %s failed for query %s", start.Format(time.RFC3339), end.Format(time.RFC3339), query)
+	}
+
+	merged, err := mergeRangeResults(results)
+	if err != nil {
+		return nil, warnings, err
+	}
+	return merged, warnings, nil
+}
+
+// QueryRangeWithRetention behaves like QueryRangeChunked, but sends the part of the range older than localRetention
+// to the longTerm client, since the local prometheus no longer holds it. Ranges straddling the retention boundary
+// are split in two at a step aligned time and the results merged. If longTerm is nil, all queries go to local.
+func QueryRangeWithRetention(ctx context.Context, local, longTerm prometheusClient.Client, localRetention time.Duration, query string, start, end time.Time, step time.Duration, maxSpan time.Duration, allowPartial bool) (interface{}, []string, error) {
+	if longTerm == nil || localRetention <= 0 {
+		return QueryRangeChunked(ctx, local, query, start, end, step, maxSpan, allowPartial)
+	}
+
+	boundary := time.Now().Add(-localRetention)
+	if !start.Before(boundary) {
+		return QueryRangeChunked(ctx, local, query, start, end, step, maxSpan, allowPartial)
+	}
+
+	// the first step aligned time the local prometheus still retains
+	split := boundary
+	if step > 0 {
+		split = start.Add((boundary.Sub(start)/step + 1) * step)
+	}
+	if !split.Before(end) {
+		return QueryRangeChunked(ctx, longTerm, query, start, end, step, maxSpan, allowPartial)
+	}
+
+	longTermResult, warnings, err := QueryRangeChunked(ctx, longTerm, query, start, split, step, maxSpan, allowPartial)
+	if err != nil {
+		return nil, warnings, fmt.Errorf("Error querying long-term prometheus: %s", err.Error())
+	}
+	localResult, localWarnings, err := QueryRangeChunked(ctx, local, query, split, end, step, maxSpan, allowPartial)
+	warnings = append(warnings, localWarnings...)
+	if err != nil {
+		return nil, warnings, err
+	}
+
+	merged, err := mergeRangeResults([]interface{}{longTermResult, localResult})
+	if err != nil {
+		return nil, warnings, err
+	}
+	return merged, warnings, nil
+}
+
+// prometheusResultError returns the error reported in a prometheus response which carries no data
+func prometheusResultError(result interface{}) error {
+	m, ok := result.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("Unexpected response from Prometheus")
+	}
+	if _, ok := m["data"]; ok {
+		return nil
+	}
+	e, err := wrapPrometheusError(result)
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf(e)
+}
+
+// mergeRangeResults joins the matrices of sequential range query results into a single result, matching series
+// by their labels and dropping samples with timestamps already covered by an earlier result.
+func mergeRangeResults(results []interface{}) (interface{}, error) {
+	var keys []string
+	series := make(map[string]map[string]interface{})
+	lastTimestamps := make(map[string]float64)
+
+	for _, qr := range results {
+		data, ok := qr.(map[string]interface{})["data"].(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("Improperly formatted data from prometheus, data field is missing")
+		}
+		rs, ok := data["result"].([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("Improperly formatted results from prometheus, result field is not a slice")
+		}
+		for _, r := range rs {
+			s, ok := r.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("Improperly formatted series from prometheus")
+			}
+			// json sorts map keys, so this is a stable identifier for the label set
+			metric, err := json.Marshal(s["metric"])
+			if err != nil {
+				return nil, err
+			}
+			key := string(metric)
+			values, ok := s["values"].([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("Improperly formatted results from prometheus, values is not a slice")
+			}
+
+			existing, ok := series[key]
+			if !ok {
+				existing = map[string]interface{}{
+					"metric": s["metric"],
+					"values": []interface{}{},
+				}
+				series[key] = existing
+				keys = append(keys, key)
+			}
+
+			merged := existing["values"].([]interface{})
+			for _, value := range values {
+				dataPoint, ok := value.([]interface{})
+				if !ok || len(dataPoint) != 2 {
+					return nil, fmt.Errorf("Improperly formatted datapoint from Prometheus")
+				}
+				ts, ok := dataPoint[0].(float64)
+				if !ok {
+					return nil, fmt.Errorf("Improperly formatted timestamp from Prometheus")
+				}
+				if last, ok := lastTimestamps[key]; ok && ts <= last {
+					continue
+				}
+				lastTimestamps[key] = ts
+				merged = append(merged, value)
+			}
+			existing["values"] = merged
+		}
+	}
+
+	result := make([]interface{}, 0, len(keys))
+	for _, key := range keys {
+		result = append(result, series[key])
+	}
+
+	return map[string]interface{}{
+		"status": "success",
+		"data": map[string]interface{}{
+			"resultType": "matrix",
+			"result":     result,
+		},
+	}, nil
+}
@@ -0,0 +1,62 @@
+package costmodel
+
+import (
+	"fmt"
+	"strconv"
+)
+
+const (
+	// PVBillingModeUsed prices persistent volumes by the bytes their claims request
+	PVBillingModeUsed = "used"
+	// PVBillingModeProvisioned prices persistent volumes by their provisioned capacity, as cloud providers bill them
+	PVBillingModeProvisioned = "provisioned"
+)
+
+// ValidatePVBillingMode returns the given persistent volume billing mode, defaulting to PVBillingModeUsed,
+// or an error if it is not a known mode
+func ValidatePVBillingMode(mode string) (string, error) {
+	if mode == "" {
+		return PVBillingModeUsed, nil
+	}
+	if mode != PVBillingModeUsed && mode != PVBillingModeProvisioned {
+		return "", fmt.Errorf("Invalid pvBillingMode '%s'; must be '%s' or '%s'", mode, PVBillingModeUsed, PVBillingModeProvisioned)
+	}
+	return mode, nil
+}
+
+// ApplyPVBillingMode returns the given cost data with the bytes of each persistent volume claim set to the
+// capacity of its volume, at every timestamp the claim was allocated, when mode is PVBillingModeProvisioned.
+// Claims whose volume capacity is unknown keep their requested bytes. The original cost data is not modified.
+func ApplyPVBillingMode(costData map[string]*CostData, mode string) map[string]*CostData {
+	if mode != PVBillingModeProvisioned || costData == nil {
+		return costData
+	}
+
+	provisioned := make(map[string]*CostData, len(costData))
+	for key, cd := range costData {
+		if cd.PVCData == nil {
+			provisioned[key] = cd
+			continue
+		}
+		newCd := *cd
+		newCd.PVCData = make([]*PersistentVolumeClaimData, 0, len(cd.PVCData))
+		for _, pvc := range cd.PVCData {
+			newPvc := *pvc
+			if pvc.Volume != nil && pvc.Volume.Size != "" {
+				size, err := strconv.ParseFloat(pvc.Volume.Size, 64)
+				if err == nil {
+					newPvc.Values = make([]*Vector, 0, len(pvc.Values))
+					for _, val := range pvc.Values {
+						newPvc.Values = append(newPvc.Values, &Vector{
+							Timestamp: val.Timestamp,
+							Value:     size,
+						})
+					}
+				}
+			}
+			newCd.PVCData = append(newCd.PVCData, &newPvc)
+		}
+		provisioned[key] = &newCd
+	}
+	return provisioned
+}
@@ -0,0 +1,117 @@
+package costmodel
+
+import (
+	"sort"
+	"strconv"
+
+	costAnalyzerCloud "github.com/kubecost/cost-model/cloud"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog"
+)
+
+// Values of the instance_lifecycle label of node prices
+const (
+	InstanceLifecycleOnDemand = "on-demand"
+	InstanceLifecycleSpot     = "spot"
+	InstanceLifecycleReserved = "reserved"
+)
+
+// InstanceLifecycle returns the instance_lifecycle of the given priced node: spot, reserved if it is fully
+// covered by a reservation, and on-demand otherwise, including when it is only partially covered
+func InstanceLifecycle(cnode *costAnalyzerCloud.Node) string {
+	if cnode.IsSpot() {
+		return InstanceLifecycleSpot
+	}
+	if cnode.PricingRate == costAnalyzerCloud.PricingRateReserved {
+		return InstanceLifecycleReserved
+	}
+	return InstanceLifecycleOnDemand
+}
+
+// applyReservations blends the on-demand prices of the given priced nodes with the effective rates of the
+// reservations covering them, and sets the PricingRate of each. A node is covered by the first reservation
+// matching it; a reservation of a number of nodes covers each matching node in equal part, as its cost is
+// amortized across them on the bill. Spot nodes are never covered.
+func applyReservations(nodes map[string]*costAnalyzerCloud.Node, nodeList []*v1.Node, cfg *costAnalyzerCloud.CustomPricing) {
+	reservations, err := costAnalyzerCloud.Reservations(cfg)
+	if err != nil {
+		klog.V(1).Infof("Ignoring reservations: %s", err.Error())
+		reservations = nil
+	}
+	bytesPerGB := costAnalyzerCloud.RAMBytesPerGB(cfg)
+
+	covered := make([][]*v1.Node, len(reservations))
+	sorted := make([]*v1.Node, len(nodeList))
+	copy(sorted, nodeList)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+	for _, n := range sorted {
+		cnode := nodes[n.Name]
+		if cnode == nil {
+			continue
+		}
+		if cnode.IsSpot() {
+			cnode.PricingRate = costAnalyzerCloud.PricingRateSpot
+			continue
+		}
+		cnode.PricingRate = costAnalyzerCloud.PricingRateOnDemand
+		for i, r := range reservations {
+			if r.Matches(n.Labels[v1.LabelInstanceType], n.Labels[v1.LabelZoneRegion]) {
+				covered[i] = append(covered[i], n)
+				break
+			}
+		}
+	}
+
+	for i, r := range reservations {
+		if len(covered[i]) == 0 {
+			continue
+		}
+		coverage := r.Coverage
+		if r.Count > 0 {
+			coverage = float64(r.Count) / float64(len(covered[i]))
+			if coverage > 1 {
+				coverage = 1
+			}
+		}
+		if coverage == 0 {
+			continue
+		}
+		for _, n := range covered[i] {
+			blendNodePrice(nodes[n.Name], r, coverage, bytesPerGB)
+		}
+	}
+}
+
+// blendNodePrice scales the prices of the given on-demand node to the blend of its on-demand rate and the
+// reserved rate of the given reservation, by the fraction of the node the reservation covers
+func blendNodePrice(cnode *costAnalyzerCloud.Node, r *costAnalyzerCloud.Reservation, coverage float64, bytesPerGB float64) {
+	cpu, _ := strconv.ParseFloat(cnode.VCPU, 64)
+	cpuCost, _ := strconv.ParseFloat(cnode.VCPUCost, 64)
+	ram, _ := strconv.ParseFloat(cnode.RAMBytes, 64)
+	ramCost, _ := strconv.ParseFloat(cnode.RAMCost, 64)
+	gpu, _ := strconv.ParseFloat(cnode.GPU, 64)
+	gpuCost, _ := strconv.ParseFloat(cnode.GPUCost, 64)
+
+	onDemandRate := cpu*cpuCost + ram/bytesPerGB*ramCost + gpu*gpuCost
+	if cost, err := strconv.ParseFloat(cnode.Cost, 64); err == nil && cost > 0 {
+		onDemandRate = cost
+	}
+	if onDemandRate <= 0 {
+		klog.V(3).Infof("Not applying reservation to node without an on-demand rate")
+		return
+	}
+
+	blendedRate := coverage*r.ReservedRate(onDemandRate) + (1-coverage)*onDemandRate
+	factor := blendedRate / onDemandRate
+
+	cnode.VCPUCost = scalePrice(cnode.VCPUCost, factor)
+	cnode.RAMCost = scalePrice(cnode.RAMCost, factor)
+	cnode.GPUCost = scalePrice(cnode.GPUCost, factor)
+	cnode.Cost = scalePrice(cnode.Cost, factor)
+	cnode.ReservedCoverage = strconv.FormatFloat(coverage, 'f', -1, 64)
+	if coverage == 1 {
+		cnode.PricingRate = costAnalyzerCloud.PricingRateReserved
+	} else {
+		cnode.PricingRate = costAnalyzerCloud.PricingRateBlended
+	}
+}
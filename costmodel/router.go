@@ -1,16 +1,23 @@
 package costmodel
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"reflect"
+	"runtime/debug"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"k8s.io/klog"
@@ -30,6 +37,18 @@ import (
 const (
 	prometheusServerEndpointEnvVar = "PROMETHEUS_SERVER_ENDPOINT"
 	prometheusTroubleshootingEp    = "http://docs.kubecost.com/custom-prom#troubleshoot"
+	longTermEndpointEnvVar         = "LONG_TERM_PROMETHEUS_ENDPOINT"
+	localRetentionEnvVar           = "LOCAL_PROMETHEUS_RETENTION"
+	defaultLocalRetention          = 15 * 24 * time.Hour
+	priceRecordWindowEnvVar        = "PRICE_RECORD_WINDOW"
+	priceRecordIntervalEnvVar      = "PRICE_RECORD_INTERVAL"
+	defaultPriceRecordWindow       = 2 * time.Minute
+	defaultPriceRecordInterval     = time.Minute
+	aggregationResolution          = time.Hour
+	instanceLifecycleLabelEnvVar   = "EMIT_INSTANCE_LIFECYCLE_LABEL"
+	defaultAggregationEnvVar       = "DEFAULT_AGGREGATION"
+	cloudProviderAPIKeyEnvVar      = "CLOUD_PROVIDER_API_KEY"
+	allowedPrometheusURLsEnvVar    = "ALLOWED_PROMETHEUS_URLS"
 )
 
 var (
@@ -40,34 +59,135 @@ var (
 var Router = httprouter.New()
 var A Accesses
 
+// longTimeoutRoundTripper is the transport of every prometheus client, with long timeouts as may be necessary for
+// long prometheus queries. TODO: make this configurable
+var longTimeoutRoundTripper http.RoundTripper = &http.Transport{
+	Proxy: http.ProxyFromEnvironment,
+	DialContext: (&net.Dialer{
+		Timeout:   120 * time.Second,
+		KeepAlive: 120 * time.Second,
+	}).DialContext,
+	TLSHandshakeTimeout: 10 * time.Second,
+}
+
+// stopBackground cancels the price recording, pricing refresh and other background work started on init, the
+// price recording closing recordingPricesDone once stopped
+var (
+	stopBackground      context.CancelFunc
+	recordingPricesDone <-chan struct{}
+)
+
 type Accesses struct {
-	PrometheusClient              prometheusClient.Client
-	KubeClientSet                 kubernetes.Interface
-	Cloud                         costAnalyzerCloud.Provider
-	CPUPriceRecorder              *prometheus.GaugeVec
-	RAMPriceRecorder              *prometheus.GaugeVec
-	PersistentVolumePriceRecorder *prometheus.GaugeVec
-	GPUPriceRecorder              *prometheus.GaugeVec
-	NodeTotalPriceRecorder        *prometheus.GaugeVec
-	RAMAllocationRecorder         *prometheus.GaugeVec
-	CPUAllocationRecorder         *prometheus.GaugeVec
-	GPUAllocationRecorder         *prometheus.GaugeVec
-	PVAllocationRecorder          *prometheus.GaugeVec
-	ContainerUptimeRecorder       *prometheus.GaugeVec
-	NetworkZoneEgressRecorder     prometheus.Gauge
-	NetworkRegionEgressRecorder   prometheus.Gauge
-	NetworkInternetEgressRecorder prometheus.Gauge
-	ServiceSelectorRecorder       *prometheus.GaugeVec
-	DeploymentSelectorRecorder    *prometheus.GaugeVec
-	Model                         *CostModel
-	Cache                         *cache.Cache
+	PrometheusClient               prometheusClient.Client
+	KubeClientSet                  kubernetes.Interface
+	Cloud                          costAnalyzerCloud.Provider
+	CPUPriceRecorder               *prometheus.GaugeVec
+	RAMPriceRecorder               *prometheus.GaugeVec
+	PersistentVolumePriceRecorder  *prometheus.GaugeVec
+	GPUPriceRecorder               *prometheus.GaugeVec
+	NodeTotalPriceRecorder         *prometheus.GaugeVec
+	NodeDiscountedPriceRecorder    *prometheus.GaugeVec
+	NodeSpotRecorder               *prometheus.GaugeVec
+	NodeCPUCapacityRecorder        *prometheus.GaugeVec
+	NodeRAMCapacityRecorder        *prometheus.GaugeVec
+	NodeGPUCountRecorder           *prometheus.GaugeVec
+	NodeAllocatedCPURecorder       *prometheus.GaugeVec
+	NodeAllocatedRAMRecorder       *prometheus.GaugeVec
+	RAMAllocationRecorder          *prometheus.GaugeVec
+	CPUAllocationRecorder          *prometheus.GaugeVec
+	GPUAllocationRecorder          *prometheus.GaugeVec
+	PVAllocationRecorder           *prometheus.GaugeVec
+	ContainerUptimeRecorder        *prometheus.GaugeVec
+	NetworkZoneEgressRecorder      prometheus.Gauge
+	NetworkRegionEgressRecorder    prometheus.Gauge
+	NetworkInternetEgressRecorder  prometheus.Gauge
+	NamespaceNetworkEgressRecorder *prometheus.GaugeVec
+	NamespaceNetworkCostRecorder   *prometheus.GaugeVec
+	LoadBalancerCostRecorder       *prometheus.GaugeVec
+	ServiceSelectorRecorder        *prometheus.GaugeVec
+	DeploymentSelectorRecorder     *prometheus.GaugeVec
+	Model                          *CostModel
+	Cache                          *cache.Cache
+	DiskCache                      *DiskCache // persists aggregations across restarts, if DISK_CACHE_DIR is set
+	PriceRecordWindow              string
+	PriceRecordInterval            time.Duration
+	PriceRecordingErrors           prometheus.Counter // counts panics recovered from price recording
+	InstanceLifecycleLabel         bool               // labels node prices by instance_lifecycle, if EMIT_INSTANCE_LIFECYCLE_LABEL is set
+	PricingRefresher               *PricingRefresher
+	ConfigHistory                  *ConfigHistory
+	CostDataStore                  CostDataStore // durably stores recorded cost data, if COST_DATA_POSTGRES_DSN is set
+	CostExporter                   *CostExporter // exports daily cost snapshots to object storage, if COST_EXPORT_PATH is set
+	BudgetEvaluator                *BudgetEvaluator
+	AllowedPrometheusURLs          []string // the addresses the prometheus parameter may select, from ALLOWED_PROMETHEUS_URLS
+
+	// NewCloudProvider constructs a provider with the given API key, by which ReloadCloudProvider replaces Cloud
+	NewCloudProvider func(apiKey string) (costAnalyzerCloud.Provider, error)
+
+	cloudLock  sync.RWMutex // guards Cloud once serving, as ReloadCloudProvider replaces it
+	reloadLock sync.Mutex   // serializes reloads of the provider
+
+	recordingStats     *RecordingStats // of the latest pass of price recording
+	recordingStatsLock sync.RWMutex
+
+	budgetsLock sync.Mutex // serializes updates of the budgets of the config
+}
+
+// CloudProvider returns the provider in use. Requests read it once, so that each is priced by the same provider
+// throughout even if it's reloaded meanwhile.
+func (a *Accesses) CloudProvider() costAnalyzerCloud.Provider {
+	a.cloudLock.RLock()
+	defer a.cloudLock.RUnlock()
+	return a.Cloud
+}
+
+// ReloadCloudProvider constructs a new provider with the given API key and downloads its pricing data, replacing
+// the provider in use, and that of the pricing refresher and cost exporter, only once that succeeds. Requests in
+// flight keep the provider they began with. Reloads are serialized.
+func (a *Accesses) ReloadCloudProvider(apiKey string) error {
+	a.reloadLock.Lock()
+	defer a.reloadLock.Unlock()
+
+	if a.NewCloudProvider == nil {
+		return fmt.Errorf("Reloading the cloud provider is not enabled")
+	}
+	cp, err := a.NewCloudProvider(apiKey)
+	if err != nil {
+		return err
+	}
+	if a.PricingRefresher != nil {
+		err = a.PricingRefresher.Reload(cp)
+	} else {
+		err = cp.DownloadPricingData()
+	}
+	if err != nil {
+		return err
+	}
+	if a.CostExporter != nil {
+		a.CostExporter.SetCloud(cp)
+	}
+
+	a.cloudLock.Lock()
+	a.Cloud = cp
+	a.cloudLock.Unlock()
+	klog.V(1).Infof("Reloaded the cloud provider")
+	return nil
 }
 
 type DataEnvelope struct {
-	Code    int         `json:"code"`
-	Status  string      `json:"status"`
-	Data    interface{} `json:"data"`
-	Message string      `json:"message,omitempty"`
+	Code         int                 `json:"code"`
+	Status       string              `json:"status"`
+	Data         interface{}         `json:"data"`
+	Message      string              `json:"message,omitempty"`
+	ErrorCode    string              `json:"errorCode,omitempty"`
+	Warnings     []string            `json:"warnings,omitempty"`
+	Currency     string              `json:"currency,omitempty"`
+	Resolution   string              `json:"resolution,omitempty"`
+	Start        string              `json:"start,omitempty"` // the start of the range of the data, as resolved
+	End          string              `json:"end,omitempty"`   // the end of the range of the data, as resolved
+	BytesScanned int64               `json:"bytesScanned,omitempty"`
+	Page         *PageInfo           `json:"page,omitempty"`
+	Summary      *AggregationSummary `json:"summary,omitempty"`
+	Errors       []ParamError        `json:"errors,omitempty"` // the invalid parameters of a bad request
 }
 
 func normalizeTimeParam(param string) (string, error) {
@@ -85,16 +205,66 @@ func normalizeTimeParam(param string) (string, error) {
 	return param, nil
 }
 
+// AlignWindowToDays returns the window of the given number of whole days in the given location ending at its
+// latest midnight at or before end, so that the window covers calendar days of that time zone. Days are
+// calendar days, so the window spans an hour more or less across a daylight saving transition.
+func AlignWindowToDays(end time.Time, days int, loc *time.Location) (time.Time, time.Time) {
+	local := end.In(loc)
+	midnight := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, loc)
+	return midnight.AddDate(0, 0, -days), midnight
+}
+
+// AlignRangeToDays returns the range from the latest midnight at or before start to the earliest midnight at or
+// after end in the given location, so that daily steps from its start are calendar days of that time zone
+func AlignRangeToDays(start, end time.Time, loc *time.Location) (time.Time, time.Time) {
+	midnight := func(t time.Time) time.Time {
+		local := t.In(loc)
+		return time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, loc)
+	}
+	alignedEnd := midnight(end)
+	if alignedEnd.Before(end) {
+		alignedEnd = alignedEnd.AddDate(0, 0, 1)
+	}
+	return midnight(start), alignedEnd
+}
+
+// DayRange is a range of points at a fixed step, each of which covers the step before it
+type DayRange struct {
+	Start time.Time
+	End   time.Time
+	Step  time.Duration
+}
+
+// CalendarDayRanges returns the ranges of points every given number of calendar days of the given location from
+// start until end, both midnights of that location, each covering the calendar days before it. Days spanning a
+// daylight saving transition are an hour shorter or longer than others, so points are split into ranges of
+// consecutive points covering the same duration, each of which can be queried at a fixed step.
+func CalendarDayRanges(start, end time.Time, days int, loc *time.Location) []DayRange {
+	var ranges []DayRange
+	start, end = start.In(loc), end.In(loc)
+	for point := start; !point.After(end); point = point.AddDate(0, 0, days) {
+		step := point.Sub(point.AddDate(0, 0, -days))
+		if n := len(ranges); n > 0 && ranges[n-1].Step == step {
+			ranges[n-1].End = point
+			continue
+		}
+		ranges = append(ranges, DayRange{Start: point, End: point, Step: step})
+	}
+	return ranges
+}
+
 func wrapDataWithMessage(data interface{}, err error, message string) []byte {
 	var resp []byte
 
 	if err != nil {
 		klog.V(1).Infof("Error returned to client: %s", err.Error())
 		resp, _ = json.Marshal(&DataEnvelope{
-			Code:    http.StatusInternalServerError,
-			Status:  "error",
-			Message: err.Error(),
-			Data:    data,
+			Code:      http.StatusInternalServerError,
+			Status:    "error",
+			Message:   err.Error(),
+			ErrorCode: ErrorCode(err),
+			Errors:    paramErrors(err),
+			Data:      data,
 		})
 	} else {
 		resp, _ = json.Marshal(&DataEnvelope{
@@ -109,16 +279,107 @@ func wrapDataWithMessage(data interface{}, err error, message string) []byte {
 	return resp
 }
 
+// wrapDataWithWarnings behaves like wrapDataWithMessage, additionally reporting non-fatal problems
+// encountered while computing the data, e.g. partial results.
+func wrapDataWithWarnings(data interface{}, err error, message string, warnings []string) []byte {
+	return wrapDataWithCurrency(data, err, message, warnings, "")
+}
+
+// wrapDataWithCurrency behaves like wrapDataWithWarnings, additionally reporting the currency of the costs in data
+func wrapDataWithCurrency(data interface{}, err error, message string, warnings []string, currency string) []byte {
+	if err != nil || (len(warnings) == 0 && currency == "") {
+		return wrapDataWithMessage(data, err, message)
+	}
+
+	return wrapEnvelope(&DataEnvelope{
+		Data:     data,
+		Message:  message,
+		Warnings: warnings,
+		Currency: currency,
+	}, nil)
+}
+
+// wrapDataWithSummary behaves like wrapDataWithCurrency, additionally reporting the grand totals of the
+// aggregations in data
+func wrapDataWithSummary(data interface{}, summary *AggregationSummary, message string, warnings []string, currency string) []byte {
+	return wrapEnvelope(&DataEnvelope{
+		Data:     data,
+		Message:  message,
+		Warnings: warnings,
+		Currency: currency,
+		Summary:  summary,
+	}, nil)
+}
+
+// wrapEnvelope marks the given envelope, which may carry any metadata about its data, as successful,
+// unless err is set, in which case an error envelope is returned instead
+func wrapEnvelope(envelope *DataEnvelope, err error) []byte {
+	if err != nil {
+		return wrapDataWithMessage(envelope.Data, err, envelope.Message)
+	}
+
+	envelope.Code = http.StatusOK
+	envelope.Status = "success"
+	resp, _ := json.Marshal(envelope)
+
+	return resp
+}
+
+// notModified sets an ETag header identifying the given response data and, if the request's If-None-Match
+// header already names it, responds with 304 Not Modified and returns true
+func notModified(w http.ResponseWriter, r *http.Request, data interface{}, currency string) bool {
+	serialized, err := json.Marshal(data)
+	if err != nil {
+		return false
+	}
+	hash := sha256.New()
+	hash.Write(serialized)
+	hash.Write([]byte(currency))
+	etag := fmt.Sprintf("\"%s\"", hex.EncodeToString(hash.Sum(nil)))
+	w.Header().Set("ETag", etag)
+
+	for _, match := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		match = strings.TrimPrefix(strings.TrimSpace(match), "W/")
+		if match == etag || match == "*" {
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+	return false
+}
+
+// requestCurrency returns the currency requested by the "currency" parameter, or the default currency, along
+// with its conversion rate from USD
+func requestCurrency(r *http.Request, cp costAnalyzerCloud.Provider) (string, float64, error) {
+	return parseCurrency(r.URL.Query().Get("currency"), cp)
+}
+
+// parseCurrency returns the given currency, or the default currency if empty, along with its conversion rate
+// from USD
+func parseCurrency(currency string, cp costAnalyzerCloud.Provider) (string, float64, error) {
+	currency = strings.ToUpper(currency)
+	if currency == "" {
+		currency = DefaultCurrency()
+	}
+	rate, err := CurrencyRate(cp, currency)
+	if err != nil {
+		return "", 0, err
+	}
+	return currency, rate, nil
+}
+
 func wrapData(data interface{}, err error) []byte {
 	var resp []byte
 
 	if err != nil {
 		klog.V(1).Infof("Error returned to client: %s", err.Error())
 		resp, _ = json.Marshal(&DataEnvelope{
-			Code:    http.StatusInternalServerError,
-			Status:  "error",
-			Message: err.Error(),
-			Data:    data,
+			Code:      http.StatusInternalServerError,
+			Status:    "error",
+			Message:   err.Error(),
+			ErrorCode: ErrorCode(err),
+			Errors:    paramErrors(err),
+			Data:      data,
 		})
 	} else {
 		resp, _ = json.Marshal(&DataEnvelope{
@@ -137,73 +398,164 @@ func (a *Accesses) RefreshPricingData(w http.ResponseWriter, r *http.Request, ps
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 
-	err := a.Cloud.DownloadPricingData()
+	var err error
+	if a.PricingRefresher != nil {
+		err = a.PricingRefresher.Refresh()
+	} else {
+		err = a.CloudProvider().DownloadPricingData()
+	}
+
+	w.Write(wrapData(nil, err))
+}
+
+// ReloadProvider reconstructs the cloud provider with the API key re-read from CLOUD_PROVIDER_API_KEY, so that a
+// rotated key is used without restarting, and downloads its pricing data. The provider in use is kept if either
+// fails.
+func (a *Accesses) ReloadProvider(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
 
+	err := a.ReloadCloudProvider(os.Getenv(cloudProviderAPIKeyEnvVar))
 	w.Write(wrapData(nil, err))
 }
 
-func filterFields(fields string, data map[string]*CostData) map[string]CostData {
-	fs := strings.Split(fields, ",")
-	fmap := make(map[string]bool)
-	for _, f := range fs {
-		fieldNameLower := strings.ToLower(f) // convert to go struct name by uppercasing first letter
-		klog.V(1).Infof("to delete: %s", fieldNameLower)
-		fmap[fieldNameLower] = true
-	}
-	filteredData := make(map[string]CostData)
-	for cname, costdata := range data {
-		s := reflect.TypeOf(*costdata)
-		val := reflect.ValueOf(*costdata)
-		costdata2 := CostData{}
-		cd2 := reflect.New(reflect.Indirect(reflect.ValueOf(costdata2)).Type()).Elem()
-		n := s.NumField()
-		for i := 0; i < n; i++ {
-			field := s.Field(i)
-			value := val.Field(i)
-			value2 := cd2.Field(i)
-			if _, ok := fmap[strings.ToLower(field.Name)]; !ok {
-				value2.Set(reflect.Value(value))
-			}
+// filterConfigKeys returns the values of the given config keys, keyed as in the serialized config. Keys are
+// matched case-insensitively against the serialized name or the struct field name of each config value.
+func filterConfigKeys(keys []string, c *costAnalyzerCloud.CustomPricing) (map[string]interface{}, error) {
+	s := reflect.TypeOf(*c)
+	val := reflect.ValueOf(*c)
+	fields := make(map[string]int)
+	for i := 0; i < s.NumField(); i++ {
+		field := s.Field(i)
+		fields[strings.ToLower(field.Name)] = i
+		if name := strings.Split(field.Tag.Get("json"), ",")[0]; name != "" {
+			fields[strings.ToLower(name)] = i
+		}
+	}
+
+	filtered := make(map[string]interface{})
+	unknown := []string{}
+	for _, key := range keys {
+		i, ok := fields[strings.ToLower(key)]
+		if !ok {
+			unknown = append(unknown, key)
+			continue
 		}
-		filteredData[cname] = cd2.Interface().(CostData)
+		name := strings.Split(s.Field(i).Tag.Get("json"), ",")[0]
+		if name == "" {
+			name = s.Field(i).Name
+		}
+		filtered[name] = val.Field(i).Interface()
+	}
+	if len(unknown) > 0 {
+		return nil, fmt.Errorf("Unknown config keys: %s", strings.Join(unknown, ", "))
 	}
-	return filteredData
+	return filtered, nil
 }
 
 func (a *Accesses) CostDataModel(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 
-	window := r.URL.Query().Get("timeWindow")
-	offset := r.URL.Query().Get("offset")
-	fields := r.URL.Query().Get("filterFields")
-	namespace := r.URL.Query().Get("namespace")
-	aggregationField := r.URL.Query().Get("aggregation")
-	aggregationSubField := r.URL.Query().Get("aggregationSubfield")
+	cp := a.CloudProvider()
+
+	params := NewCostDataModelParams(r)
+	if err := params.Validate(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(wrapData(nil, err))
+		return
+	}
+
+	promCli, model, err := a.requestPrometheus(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(wrapData(nil, err))
+		return
+	}
+
+	window := params.Window
+	offset := params.Offset
+	namespace := params.Namespace
+	cluster := params.Cluster
+	aggregationField := params.Aggregation
+	aggregationSubField := params.AggregationSubfield
 
 	if offset != "" {
 		offset = "offset " + offset
 	}
 
-	data, err := a.Model.ComputeCostData(a.PrometheusClient, a.KubeClientSet, a.Cloud, window, offset, namespace)
+	// filterFields, if set, is a comma-separated list of the fields to omit from the cost data, and keepFields of
+	// the only fields to keep; the fields of nested structures are named by dotted paths, e.g. "nodeData.vcpuCost"
+	fieldFilter, err := requestFieldFilter(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(wrapData(nil, err))
+		return
+	}
+
+	currency, rate, err := requestCurrency(r, cp)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(wrapData(nil, NewCodedError(ErrorCodeBadRequest, err)))
+		return
+	}
+
+	// precision, if set, rounds costs to that many decimals
+	precision, err := requestPrecision(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(wrapData(nil, NewCodedError(ErrorCodeBadRequest, err)))
+		return
+	}
+
+	// pvBillingMode determines whether persistent volumes are priced by the bytes requested by their
+	// claims ("used", default) or by their provisioned capacity ("provisioned")
+	pvBillingMode, err := ValidatePVBillingMode(r.URL.Query().Get("pvBillingMode"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(wrapData(nil, NewCodedError(ErrorCodeBadRequest, err)))
+		return
+	}
+
+	data, warnings, err := model.ComputeCostData(promCli, a.KubeClientSet, cp, window, offset, namespace)
+	data = ApplyPVBillingMode(data, pvBillingMode)
+	// degraded allocation, e.g. without kube-state-metrics, is flagged by the message as well as the warnings
+	message := strings.Join(warnings, "; ")
+	if cluster != "" {
+		for key, costs := range data {
+			if !costDataPassesFilters(costs, "", cluster) {
+				delete(data, key)
+			}
+		}
+	}
+	// podSelector, if set, selects the pods to cost by their labels, e.g. `app=~"web.*",env="prod"`
+	if err == nil && len(params.PodSelector) > 0 {
+		data, err = SelectPodCostData(promCli, data, params.PodSelector, window, offset, LocalClusterID(cp))
+		if err != nil {
+			w.Write(wrapData(nil, err))
+			return
+		}
+	}
 	if aggregationField != "" {
-		c, err := a.Cloud.GetConfig()
+		c, err := cp.GetConfig()
 		if err != nil {
 			w.Write(wrapData(nil, err))
 		}
-		discount, err := strconv.ParseFloat(c.Discount[:len(c.Discount)-1], 64)
+		discount, err := parseDiscount(c)
 		if err != nil {
 			w.Write(wrapData(nil, err))
 		}
-		discount = discount * 0.01
-		agg := AggregateCostModel(a.Cloud, data, aggregationField, aggregationSubField, false, discount, 1.0, nil)
-		w.Write(wrapData(agg, nil))
+		agg := AggregateCostModel(cp, data, aggregationField, aggregationSubField, false, discount, 1.0, nil)
+		ConvertAggregationsCurrency(agg, rate)
+		agg = RoundAggregations(agg, precision)
+		w.Write(wrapDataWithCurrency(agg, nil, message, warnings, currency))
 	} else {
-		if fields != "" {
-			filteredData := filterFields(fields, data)
-			w.Write(wrapData(filteredData, err))
+		data = ConvertCostDataCurrency(data, rate)
+		if fieldFilter != nil {
+			filteredData := fieldFilter.Apply(data)
+			w.Write(wrapDataWithCurrency(filteredData, err, message, warnings, currency))
 		} else {
-			w.Write(wrapData(data, err))
+			w.Write(wrapDataWithCurrency(data, err, message, warnings, currency))
 		}
 	}
 }
@@ -212,34 +564,113 @@ func (a *Accesses) ClusterCosts(w http.ResponseWriter, r *http.Request, ps httpr
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 
+	cp := a.CloudProvider()
+
+	promCli, model, err := a.requestPrometheus(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(wrapData(nil, err))
+		return
+	}
+
 	window := r.URL.Query().Get("window")
 	offset := r.URL.Query().Get("offset")
 
+	windowEnd := time.Now()
 	if offset != "" {
+		if normalized, err := normalizeTimeParam(offset); err == nil {
+			if o, err := time.ParseDuration(normalized); err == nil {
+				windowEnd = windowEnd.Add(-o)
+			}
+		}
 		offset = "offset " + offset
 	}
 
-	data, err := ClusterCosts(a.PrometheusClient, a.Cloud, window, offset)
-	w.Write(wrapData(data, err))
+	data, err := ClusterCosts(promCli, cp, window, offset)
+	if err != nil {
+		w.Write(wrapData(nil, err))
+		return
+	}
+
+	// the volumes mounted over the window are recorded by the cost model, so unmounted volume
+	// cost is omitted, rather than failing the request, when they cannot be queried
+	var d time.Duration
+	normalized, err := "", fmt.Errorf("Missing window")
+	if window != "" {
+		normalized, err = normalizeTimeParam(window)
+	}
+	if err == nil {
+		d, err = time.ParseDuration(normalized)
+	}
+	var mounted map[string]bool
+	if err == nil {
+		mounted, err = MountedVolumes(promCli, window, offset, nil)
+	}
+	if err != nil {
+		klog.V(1).Infof("Error computing unmounted volume cost: %s", err.Error())
+	} else {
+		AddUnmountedPVCost(data, UnmountedPVHourlyCost(model.ComputeUnmountedPVCost(cp, mounted, windowEnd.Add(-d), windowEnd)))
+	}
+	w.Write(wrapData(data, nil))
 }
 
 func (a *Accesses) ClusterCostsOverTime(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 
-	start := r.URL.Query().Get("start")
-	end := r.URL.Query().Get("end")
-	window := r.URL.Query().Get("window")
-	offset := r.URL.Query().Get("offset")
+	params := NewClusterCostsOverTimeParams(r)
+	if err := params.Validate(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(wrapData(nil, err))
+		return
+	}
+
+	promCli, _, err := a.requestPrometheus(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(wrapData(nil, err))
+		return
+	}
 
+	offset := params.Offset
 	if offset != "" {
 		offset = "offset " + offset
 	}
 
-	data, err := ClusterCostsOverTime(a.PrometheusClient, a.Cloud, start, end, window, offset)
+	data, err := ClusterCostsOverTime(promCli, a.CloudProvider(), params.Start, params.End, params.Window, offset)
 	w.Write(wrapData(data, err))
 }
 
+// parseSharedLabels splits the comma-separated shared label names and values of a request, which must
+// be equal in number and non-empty
+func parseSharedLabels(names, values string) ([]string, []string, error) {
+	sln := []string{}
+	slv := []string{}
+	if names == "" && values == "" {
+		return sln, slv, nil
+	}
+	if names != "" {
+		sln = strings.Split(names, ",")
+	}
+	if values != "" {
+		slv = strings.Split(values, ",")
+	}
+	if len(sln) != len(slv) {
+		return nil, nil, fmt.Errorf("Supply exactly one label value per label name: received %d sharedLabelNames and %d sharedLabelValues", len(sln), len(slv))
+	}
+	for i := range sln {
+		if sln[i] == "" || slv[i] == "" {
+			return nil, nil, fmt.Errorf("Supply exactly one label value per label name: shared label names and values must not be empty")
+		}
+	}
+	return sln, slv, nil
+}
+
+// clearsCache reports whether the given request flushes the caches of costs, so requires the API auth token, if set
+func clearsCache(r *http.Request) bool {
+	return r.URL.Query().Get("clearCache") == "true"
+}
+
 // AggregateCostModel handles HTTP requests to the aggregated cost model API, which can be parametrized
 // by time period using window and offset, aggregation field using field and subfield (in cases like
 // field=label, subfield=app for grouping by label.app), and filtered by namespace.
@@ -247,18 +678,42 @@ func (a *Accesses) AggregateCostModel(w http.ResponseWriter, r *http.Request, ps
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 
-	window := r.URL.Query().Get("window")
-	offset := r.URL.Query().Get("offset")
+	cp := a.CloudProvider()
+
+	// the parameters are validated together, so that every invalid parameter is reported at once
+	params := NewAggregateCostModelParams(r)
+	if err := params.Validate(cp); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(wrapData(nil, err))
+		return
+	}
+
+	promCli, model, err := a.requestPrometheus(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(wrapData(nil, err))
+		return
+	}
+
+	window := params.Window
+	offset := params.Offset
 	namespace := r.URL.Query().Get("namespace")
 	cluster := r.URL.Query().Get("cluster")
-	field := r.URL.Query().Get("aggregation")
-	subfield := r.URL.Query().Get("aggregationSubfield")
+	field := params.Aggregation
+	subfield := params.AggregationSubfield
 	allocateIdle := r.URL.Query().Get("allocateIdle")
+	idleMode := params.IdleMode
 	sharedNamespaces := r.URL.Query().Get("sharedNamespaces")
-	sharedLabelNames := r.URL.Query().Get("sharedLabelNames")
-	sharedLabelValues := r.URL.Query().Get("sharedLabelValues")
 	remote := r.URL.Query().Get("remote")
 
+	// allowPartial, if set to "true", returns whatever data could be queried when
+	// part of a long range query fails, along with a warning, instead of an error
+	allowPartial := r.URL.Query().Get("allowPartial") == "true"
+
+	// includeManagementFee, if set to "true", shares the cluster management fee, prorated
+	// over the window, evenly across all aggregations
+	includeManagementFee := r.URL.Query().Get("includeManagementFee") == "true"
+
 	// timeSeries == true maintains the time series dimension of the data,
 	// which by default gets summed over the entire interval
 	timeSeries := r.URL.Query().Get("timeSeries") == "true"
@@ -269,21 +724,64 @@ func (a *Accesses) AggregateCostModel(w http.ResponseWriter, r *http.Request, ps
 
 	// clearCache, if set to "true", tells this function to flush the cache,
 	// then recompute and cache the requested data
-	clearCache := r.URL.Query().Get("clearCache") == "true"
+	clearCache := clearsCache(r)
 
-	// aggregation field is required
-	if field == "" {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write(wrapData(nil, fmt.Errorf("Missing aggregation field parameter")))
-		return
+	// shared label names and values are paired by position, so must be equal in number
+	sln, slv := params.SharedLabelNames, params.SharedLabelValues
+
+	// currency defaults to $CURRENCY, or USD; costs are converted using the rates in the pricing config
+	currency, rate := params.Currency, params.CurrencyRate
+
+	// precision, if set, rounds costs to that many decimals
+	precision := params.Precision
+
+	// pvBillingMode determines whether persistent volumes are priced by the bytes requested by their
+	// claims ("used", default) or by their provisioned capacity ("provisioned")
+	pvBillingMode := params.PVBillingMode
+
+	// allocationPolicy determines whether CPU and RAM are allocated by the greater of requests and usage ("max",
+	// default unless overridden by $ALLOCATION_POLICY), by requests alone ("request") or by usage alone ("usage")
+	allocationPolicy := params.AllocationPolicy
+
+	// costBasis determines whether CPU is costed by its allocation ("request", default) or by the cores
+	// actually used ("usage"), falling back to allocation for containers without usage data
+	costBasis := params.CostBasis
+
+	// categories, if set, is a comma-separated list of the cost categories to compute, of cpu, ram, gpu, pv,
+	// network and shared. The costs of other categories are neither computed nor included in total costs.
+	categories := params.Categories
+
+	// splitLabelValues, if set to "true" when aggregating by label, splits the cost of pods whose label is a
+	// comma-separated list of values across those values, evenly or as weighted by LabelSplitWeightsAnnotation
+	splitLabelValues := field == "label" && r.URL.Query().Get("splitLabelValues") == "true"
+
+	// environments, if set, is a comma-separated list of the aggregation keys to respond with. Costs are
+	// still computed, and shared, over all aggregations, so it is not part of the cache key.
+	environments := []string{}
+	for _, environment := range strings.Split(r.URL.Query().Get("environments"), ",") {
+		if environment = strings.TrimSpace(environment); environment != "" {
+			environments = append(environments, environment)
+		}
 	}
 
-	// aggregation subfield is required when aggregation field is "label"
-	if field == "label" && subfield == "" {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write(wrapData(nil, fmt.Errorf("Missing aggregation subfield parameter for aggregation by label")))
-		return
+	// excludeNamespaces, if set, is a comma-separated list of namespaces whose costs are neither aggregated
+	// nor shared. They still count as allocated, so that excluding them doesn't turn their cost into idle.
+	excludeNamespaces := []string{}
+	for _, ns := range strings.Split(r.URL.Query().Get("excludeNamespaces"), ",") {
+		if ns = strings.TrimSpace(ns); ns != "" {
+			excludeNamespaces = append(excludeNamespaces, ns)
+		}
 	}
+	sort.Strings(excludeNamespaces)
+
+	// includeExternal, if set to "true", adds the out of cluster costs of the days spanning the window, e.g. of
+	// tagged databases and buckets, to the aggregations keyed by the values of the tag matching the field
+	includeExternal := r.URL.Query().Get("includeExternal") == "true"
+
+	// timezone, if set to an IANA time zone name, aligns windows of whole days to midnight in that zone, e.g.
+	// to correlate costs with billing periods defined in local time. Times are reported in UTC regardless.
+	timezone := params.Timezone
+	loc := params.Location
 
 	// endTime defaults to the current time, unless an offset is explicity declared,
 	// in which case it shifts endTime back by given duration
@@ -291,7 +789,7 @@ func (a *Accesses) AggregateCostModel(w http.ResponseWriter, r *http.Request, ps
 	if offset != "" {
 		o, err := time.ParseDuration(offset)
 		if err != nil {
-			w.Write(wrapData(nil, err))
+			w.Write(wrapData(nil, NewCodedError(ErrorCodeBadWindow, err)))
 			return
 		}
 
@@ -300,9 +798,9 @@ func (a *Accesses) AggregateCostModel(w http.ResponseWriter, r *http.Request, ps
 
 	// if window is defined in terms of days, convert to hours
 	// e.g. convert "2d" to "48h"
-	window, err := normalizeTimeParam(window)
+	window, err = normalizeTimeParam(window)
 	if err != nil {
-		w.Write(wrapData(nil, err))
+		w.Write(wrapData(nil, NewCodedError(ErrorCodeBadWindow, err)))
 		return
 	}
 
@@ -310,26 +808,84 @@ func (a *Accesses) AggregateCostModel(w http.ResponseWriter, r *http.Request, ps
 	// as ISO datetime strings
 	d, err := time.ParseDuration(window)
 	if err != nil {
-		w.Write(wrapData(nil, err))
+		w.Write(wrapData(nil, NewCodedError(ErrorCodeBadWindow, err)))
 		return
 	}
 
 	startTime := endTime.Add(-1 * d)
+
+	// queryOffset is the offset by which the end of the window precedes the current time, as queried
+	queryOffset := offset
+	if timezone != "" && d%(24*time.Hour) == 0 {
+		startTime, endTime = AlignWindowToDays(endTime, int(d/(24*time.Hour)), loc)
+		d = endTime.Sub(startTime)
+		window = fmt.Sprintf("%dh", int(d.Hours()))
+		queryOffset = ""
+		if o := int64(time.Since(endTime).Seconds()); o > 0 {
+			queryOffset = fmt.Sprintf("%ds", o)
+		}
+	}
+
 	layout := "2006-01-02T15:04:05.000Z"
-	start := startTime.Format(layout)
-	end := endTime.Format(layout)
+	start := startTime.UTC().Format(layout)
+	end := endTime.UTC().Format(layout)
 
 	// clear cache prior to checking the cache so that a clearCache=true
 	// request always returns a freshly computed value
 	if clearCache {
 		a.Cache.Flush()
+		a.DiskCache.Flush()
 	}
 
-	aggKey := fmt.Sprintf("aggregate:%s:%s:%s:%s:%s:%s:%t", window, offset, namespace, cluster, field, subfield, timeSeries)
+	aggKey := fmt.Sprintf("aggregate:%s:%s:%s:%s:%s:%s:%t:%s:%s:%s:%t:%s:%t:%s:%s:%s:%s:%t:%s:%s:%s", window, offset, namespace, cluster, field, subfield, timeSeries, allocateIdle, idleMode, currency, includeManagementFee, pvBillingMode, splitLabelValues, allocationPolicy, costBasis, strings.Join(excludeNamespaces, ","), timezone, includeExternal, categories, params.PodSelector, r.URL.Query().Get("prometheus"))
+
+	// legacy, if set to "true", responds with the bare aggregation map, without metadata. It is
+	// deprecated and will be removed in the next release.
+	legacy := r.URL.Query().Get("legacy") == "true"
+	// costs are cached at full precision, and only rounded as they're responded with
+	responseData := func(response *AggregationResponse) interface{} {
+		aggregations := response.Aggregations
+		if len(environments) > 0 {
+			aggregations = FilterAggregations(aggregations, environments)
+		}
+		if len(environments) > 0 || precision >= 0 {
+			response = &AggregationResponse{
+				Aggregations: RoundAggregations(aggregations, precision),
+				Metadata:     RoundAggregationMetadata(response.Metadata, precision),
+			}
+		}
+		if legacy {
+			return response.Aggregations
+		}
+		return response
+	}
+	// responseSummary sums the aggregations responded with, so that clients don't total them themselves
+	responseSummary := func(response *AggregationResponse) *AggregationSummary {
+		aggregations := response.Aggregations
+		if len(environments) > 0 {
+			aggregations = FilterAggregations(aggregations, environments)
+		}
+		return RoundAggregationSummary(SummarizeAggregations(RoundAggregations(aggregations, precision)), precision)
+	}
 
 	// check the cache for aggregated response; if cache is hit and not disabled, return response
 	if result, found := a.Cache.Get(aggKey); found && !disableCache {
-		w.Write(wrapDataWithMessage(result, nil, fmt.Sprintf("cache hit: %s", aggKey)))
+		response := responseData(result.(*AggregationResponse))
+		if notModified(w, r, response, currency) {
+			return
+		}
+		w.Write(wrapDataWithSummary(response, responseSummary(result.(*AggregationResponse)), fmt.Sprintf("cache hit: %s", aggKey), result.(*AggregationResponse).Warnings, currency))
+		return
+	}
+
+	// after a restart, aggregations computed before it are read back from the disk cache, if any
+	if result, found := a.DiskCache.Get(aggKey); found && !disableCache {
+		a.Cache.Set(aggKey, result, cache.DefaultExpiration)
+		response := responseData(result)
+		if notModified(w, r, response, currency) {
+			return
+		}
+		w.Write(wrapDataWithSummary(response, responseSummary(result), fmt.Sprintf("cache hit: %s", aggKey), result.Warnings, currency))
 		return
 	}
 
@@ -340,114 +896,488 @@ func (a *Accesses) AggregateCostModel(w http.ResponseWriter, r *http.Request, ps
 	}
 	klog.Infof("REMOTE ENABLED: %t", remoteEnabled)
 
-	data, err := a.Model.ComputeCostDataRange(a.PrometheusClient, a.KubeClientSet, a.Cloud, start, end, "1h", namespace, cluster, remoteEnabled)
+	// out of cluster costs are queried from the billing backend while cost data is computed
+	var externalCosts <-chan *externalCostsResult
+	if includeExternal {
+		externalCosts = queryExternalCosts(cp, field, subfield, startTime, endTime)
+	}
+
+	// cost data is computed at hourly resolution, by which the samples of its time series are merged
+	data, warnings, err := model.ComputeCostDataRange(promCli, a.KubeClientSet, cp, start, end, promDuration(aggregationResolution), namespace, cluster, remoteEnabled, allowPartial)
 	if err != nil {
 		w.Write(wrapData(nil, err))
 		return
 	}
+	data = ApplyPVBillingMode(data, pvBillingMode)
+	data = ApplyAllocationPolicy(data, allocationPolicy)
+	data, costBasisWarnings := ApplyCostBasis(data, costBasis)
+	if splitLabelValues {
+		data = SplitLabelValues(data, subfield)
+	}
 
-	c, err := a.Cloud.GetConfig()
+	c, err := cp.GetConfig()
 	if err != nil {
-		w.Write(wrapData(nil, err))
+		w.Write(wrapData(nil, NewCodedError(ErrorCodePricingMissing, err)))
 		return
 	}
-	discount, err := strconv.ParseFloat(c.Discount[:len(c.Discount)-1], 64)
+	discount, err := parseDiscount(c)
 	if err != nil {
-		w.Write(wrapData(nil, err))
+		w.Write(wrapData(nil, NewCodedError(ErrorCodePricingMissing, err)))
 		return
 	}
-	discount = discount * 0.01
+	// container costs are discounted sample by sample, by a discount schedule if set, and the costs of the whole
+	// window by the discount in effect over it, so that idle cost is the difference of like discounted costs
+	totalDiscount, err := windowDiscount(c, discount, startTime, endTime)
+	if err != nil {
+		w.Write(wrapData(nil, NewCodedError(ErrorCodePricingMissing, err)))
+		return
+	}
+
+	// volumes not mounted by any pod are reported as allocated, so that they are not counted as idle. They
+	// are only enumerated if reported or needed to compute idle costs.
+	var unmounted []*UnmountedPV
+	unmountedCost := 0.0
+	if categories.Includes(CostCategoryPV) || allocateIdle == "true" {
+		promOffset := ""
+		if queryOffset != "" {
+			promOffset = "offset " + queryOffset
+		}
+		// volumes mounted by pods filtered out of data, e.g. of other namespaces, are still mounted
+		mounted, err := MountedVolumes(promCli, window, promOffset, data)
+		if err != nil {
+			w.Write(wrapData(nil, err))
+			return
+		}
+		unmounted = model.ComputeUnmountedPVCost(cp, mounted, startTime, endTime)
+		unmountedCost = UnmountedPVCost(unmounted) * (1 - totalDiscount)
+	}
 
-	idleCoefficient := 1.0
+	metadata := &AggregationMetadata{
+		Start:              start,
+		End:                end,
+		Timezone:           timezone,
+		Discount:           totalDiscount,
+		AllocationPolicy:   allocationPolicy,
+		IdleCoefficient:    1.0,
+		TotalAllocatedCost: TotalContainerCost(cp, data, discount) + unmountedCost,
+	}
 	if allocateIdle == "true" {
-		idleCoefficient, err = ComputeIdleCoefficient(data, a.PrometheusClient, a.Cloud, discount, fmt.Sprintf("%dh", int(d.Hours())), offset)
+		idleWindow := fmt.Sprintf("%dh", int(d.Hours()))
+		totalClusterCost, err := ClusterCostOverWindow(promCli, cp, totalDiscount, idleWindow, queryOffset)
 		if err != nil {
 			w.Write(wrapData(nil, err))
+			return
+		}
+		idleCost := totalClusterCost - metadata.TotalAllocatedCost
+		metadata.IdleMode = idleMode
+		metadata.TotalClusterCost = &totalClusterCost
+		metadata.IdleCost = &idleCost
+		if idleMode == IdleModeCoefficient {
+			metadata.IdleCoefficient = IdleCoefficient(metadata.TotalAllocatedCost, totalClusterCost)
 		}
 	}
 
 	sn := []string{}
-	sln := []string{}
-	slv := []string{}
 	if sharedNamespaces != "" {
 		sn = strings.Split(sharedNamespaces, ",")
 	}
-	if sharedLabelNames != "" {
-		sln = strings.Split(sharedLabelNames, ",")
-		slv = strings.Split(sharedLabelValues, ",")
-		if len(sln) != len(slv) || slv[0] == "" {
-			w.Write(wrapData(nil, fmt.Errorf("Supply exacly one label value per label name")))
-			return
-		}
-	}
 	var sr *SharedResourceInfo
 	if len(sn) > 0 || len(sln) > 0 {
 		sr = NewSharedResourceInfo(true, sn, sln, slv)
 	}
 
-	// aggregate cost model data by given fields and cache the result for the default expiration
-	result := AggregateCostModel(a.Cloud, data, field, subfield, timeSeries, discount, idleCoefficient, sr)
-	a.Cache.Set(aggKey, result, cache.DefaultExpiration)
-
-	w.Write(wrapDataWithMessage(result, nil, fmt.Sprintf("cache miss: %s", aggKey)))
-}
+	// excluded namespaces are dropped only once the allocated cost, and so idle cost, is computed
+	data = ExcludeNamespaces(data, excludeNamespaces)
+	unmounted = ExcludeUnmountedNamespaces(unmounted, excludeNamespaces)
+	// podSelector, if set, selects the pods to cost by their labels, e.g. `app=~"web.*",env="prod"`. Like
+	// excluded namespaces, it applies once the idle cost is computed; volumes mounted by no pod are selected
+	// by no selector. Cost data is still computed for all pods, as the idle cost needs it.
+	if len(params.PodSelector) > 0 {
+		selectorOffset := ""
+		if queryOffset != "" {
+			selectorOffset = "offset " + queryOffset
+		}
+		data, err = SelectPodCostData(promCli, data, params.PodSelector, window, selectorOffset, LocalClusterID(cp))
+		if err != nil {
+			w.Write(wrapData(nil, err))
+			return
+		}
+		unmounted = nil
+	}
+	data = FilterCostCategories(data, categories)
+
+	// aggregate cost model data by given fields and cache the result for the default expiration
+	aggregations := AggregateCostModelAtResolution(cp, data, field, subfield, timeSeries, discount, metadata.IdleCoefficient, sr, aggregationResolution)
+	if categories.Includes(CostCategoryPV) {
+		AddUnmountedAggregations(aggregations, field, subfield, unmounted, totalDiscount, metadata.IdleCoefficient)
+	}
+	if allocateIdle == "true" && idleMode == IdleModeCategory {
+		AddIdleAggregation(aggregations, field, subfield, *metadata.IdleCost)
+	}
+	if (field == "namespace" || field == "service") && categories.Includes(CostCategoryNetwork) {
+		promOffset := ""
+		if queryOffset != "" {
+			promOffset = "offset " + queryOffset
+		}
+		loadBalancerCosts, err := LoadBalancerCostsOverWindow(promCli, window, promOffset, LocalClusterID(cp))
+		if err != nil {
+			w.Write(wrapData(nil, err))
+			return
+		}
+		loadBalancerCosts = FilterServiceCosts(loadBalancerCosts, namespace, cluster, excludeNamespaces)
+		AddLoadBalancerCosts(aggregations, field, subfield, loadBalancerCosts, totalDiscount)
+	}
+	if includeManagementFee && categories.Includes(CostCategoryShared) {
+		fee, err := ClusterManagementFee(cp)
+		if err != nil {
+			w.Write(wrapData(nil, err))
+			return
+		}
+		metadata.ManagementFee = ClusterManagementFeeOverWindow(fee, d)
+		AddSharedCost(aggregations, metadata.ManagementFee)
+	}
+	if includeExternal {
+		// failing to query out of cluster costs omits them, with a warning, rather than failing the request
+		external := <-externalCosts
+		if external.err != nil {
+			klog.V(1).Infof("Error querying out of cluster costs: %s", external.err.Error())
+			warnings = append(warnings, fmt.Sprintf("Out of cluster costs are omitted: %s", external.err.Error()))
+		} else {
+			allocations := external.allocations
+			if field == "namespace" && (namespace != "" || len(excludeNamespaces) > 0) {
+				excluded := make(map[string]bool, len(excludeNamespaces))
+				for _, ns := range excludeNamespaces {
+					excluded[ns] = true
+				}
+				allocations = []*costAnalyzerCloud.OutOfClusterAllocation{}
+				for _, allocation := range external.allocations {
+					if (namespace == "" || allocation.Environment == namespace) && !excluded[allocation.Environment] {
+						allocations = append(allocations, allocation)
+					}
+				}
+			}
+			AddExternalCosts(aggregations, field, subfield, allocations)
+		}
+	}
+	ApplyCostCategories(aggregations, categories)
+	ConvertAggregationsCurrency(aggregations, rate)
+	ConvertAggregationMetadataCurrency(metadata, rate)
+	result := &AggregationResponse{
+		Aggregations: aggregations,
+		Metadata:     metadata,
+		Warnings:     costBasisWarnings,
+	}
+
+	// partial results are not cached, so that a subsequent request can retry the missing data
+	if len(warnings) > 0 {
+		w.Write(wrapDataWithSummary(responseData(result), responseSummary(result), fmt.Sprintf("partial result: %s", aggKey), append(warnings, costBasisWarnings...), currency))
+		return
+	}
+	a.Cache.Set(aggKey, result, cache.DefaultExpiration)
+	a.DiskCache.Set(aggKey, result)
+
+	response := responseData(result)
+	if notModified(w, r, response, currency) {
+		return
+	}
+	w.Write(wrapDataWithSummary(response, responseSummary(result), fmt.Sprintf("cache miss: %s", aggKey), result.Warnings, currency))
+}
+
+// AggregateCostModelDiff compares the aggregated costs of windowA, offset by offsetA, to those of windowB, offset by
+// offsetB, reporting the change of each cost category of each aggregation. Both windows are aggregated by
+// AggregateCostModel, with the remaining parameters, e.g. aggregation and currency, applied to each.
+func (a *Accesses) AggregateCostModelDiff(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	query := r.URL.Query()
+	if query.Get("windowA") == "" || query.Get("windowB") == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(wrapData(nil, NewCodedError(ErrorCodeBadWindow, fmt.Errorf("Missing windowA or windowB parameter"))))
+		return
+	}
+
+	type side struct {
+		status   int
+		body     []byte
+		data     map[string]*Aggregation
+		envelope *DataEnvelope
+	}
+	aggregate := func(window string, offset string) (*side, error) {
+		q := url.Values{}
+		for key, values := range query {
+			switch key {
+			case "windowA", "offsetA", "windowB", "offsetB", "legacy":
+			default:
+				q[key] = values
+			}
+		}
+		q.Set("window", window)
+		if offset != "" {
+			q.Set("offset", offset)
+		}
+		// the bare aggregation map, without metadata
+		q.Set("legacy", "true")
+		req, err := http.NewRequest("GET", "/aggregatedCostModel?"+q.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+		bw := &bufferedResponseWriter{header: make(http.Header), status: http.StatusOK}
+		a.AggregateCostModel(bw, req, nil)
+
+		s := &side{status: bw.status, body: bw.body.Bytes(), data: map[string]*Aggregation{}}
+		s.envelope = &DataEnvelope{Data: &s.data}
+		if err := json.Unmarshal(s.body, s.envelope); err != nil {
+			return nil, err
+		}
+		return s, nil
+	}
+
+	sides := make([]*side, 2)
+	for i, window := range [][2]string{{query.Get("windowA"), query.Get("offsetA")}, {query.Get("windowB"), query.Get("offsetB")}} {
+		s, err := aggregate(window[0], window[1])
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write(wrapData(nil, err))
+			return
+		}
+		// errors aggregating either window are responded with as is
+		if s.status != http.StatusOK || s.envelope.Code != http.StatusOK {
+			w.WriteHeader(s.status)
+			w.Write(s.body)
+			return
+		}
+		sides[i] = s
+	}
+
+	warnings := append(sides[0].envelope.Warnings, sides[1].envelope.Warnings...)
+	diffs := DiffAggregations(sides[0].data, sides[1].data)
+	w.Write(wrapDataWithCurrency(diffs, nil, "", warnings, sides[0].envelope.Currency))
+}
 
 func (a *Accesses) CostDataModelRange(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 
-	start := r.URL.Query().Get("start")
-	end := r.URL.Query().Get("end")
-	window := r.URL.Query().Get("window")
-	fields := r.URL.Query().Get("filterFields")
-	namespace := r.URL.Query().Get("namespace")
-	cluster := r.URL.Query().Get("cluster")
-	aggregationField := r.URL.Query().Get("aggregation")
-	aggregationSubField := r.URL.Query().Get("aggregationSubfield")
+	cp := a.CloudProvider()
+
+	params := NewCostDataModelRangeParams(r)
+	if err := params.Validate(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(wrapData(nil, err))
+		return
+	}
+	// source=sql reads from the remote database alone, so it must be configured
+	if params.Source == CostDataSourceSQL && os.Getenv(sqlAddress) == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(wrapData(nil, NewCodedError(ErrorCodeBadRequest, fmt.Errorf("Invalid source '%s'; the remote database is not configured, set %s", CostDataSourceSQL, sqlAddress))))
+		return
+	}
+
+	promCli, model, err := a.requestPrometheus(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(wrapData(nil, err))
+		return
+	}
+
+	start := params.Start
+	end := params.End
+	window := params.Window
+	namespace := params.Namespace
+	cluster := params.Cluster
+	aggregationField := params.Aggregation
+	aggregationSubField := params.AggregationSubfield
 	remote := r.URL.Query().Get("remote")
+	allowPartial := r.URL.Query().Get("allowPartial") == "true"
+
+	// filterFields, if set, is a comma-separated list of the fields to omit from the cost data, and keepFields of
+	// the only fields to keep; the fields of nested structures are named by dotted paths, e.g. "nodeData.vcpuCost"
+	fieldFilter, err := requestFieldFilter(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(wrapData(nil, err))
+		return
+	}
+
+	currency, rate, err := requestCurrency(r, cp)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(wrapData(nil, NewCodedError(ErrorCodeBadRequest, err)))
+		return
+	}
+
+	// precision, if set, rounds costs to that many decimals
+	precision, err := requestPrecision(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(wrapData(nil, NewCodedError(ErrorCodeBadRequest, err)))
+		return
+	}
+
+	// pvBillingMode determines whether persistent volumes are priced by the bytes requested by their
+	// claims ("used", default) or by their provisioned capacity ("provisioned")
+	pvBillingMode, err := ValidatePVBillingMode(r.URL.Query().Get("pvBillingMode"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(wrapData(nil, NewCodedError(ErrorCodeBadRequest, err)))
+		return
+	}
+
+	// minResolution, if set, is the coarsest resolution long ranges are downsampled to, e.g. "15m" to keep
+	// short-lived pods of batch-heavy clusters resolved, at the cost of more points per series, up to MaxRangePoints
+	minResolution := params.MinResolution
+
+	// resolution, if set, overrides the step of the returned data; otherwise long ranges are
+	// downsampled from window so that the number of points per series stays bounded
+	resolution := params.Resolution
+	if resolution != "" {
+		window, err = normalizeTimeParam(resolution)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write(wrapData(nil, NewCodedError(ErrorCodeBadWindow, fmt.Errorf("Invalid resolution '%s'", resolution))))
+			return
+		}
+	} else {
+		startTime, startErr := ParseTimeParam(start)
+		endTime, endErr := ParseTimeParam(end)
+		step, stepErr := time.ParseDuration(window)
+		if startErr == nil && endErr == nil && stepErr == nil {
+			downsampled := DownsampledResolution(startTime, endTime, step)
+			if minResolution > 0 && downsampled > minResolution {
+				downsampled = minResolution
+				if finest := MinRangeResolution(startTime, endTime); downsampled < finest {
+					downsampled = finest
+				}
+				if step > downsampled {
+					downsampled = step
+				}
+			}
+			if downsampled != step {
+				klog.V(3).Infof("Downsampling range %s to %s from %s to %s", start, end, window, promDuration(downsampled))
+				window = promDuration(downsampled)
+			}
+		}
+	}
 
 	remoteAvailable := os.Getenv(remoteEnabled)
 	remoteEnabled := false
 	if remoteAvailable == "true" && remote != "false" {
 		remoteEnabled = true
 	}
-	data, err := a.Model.ComputeCostDataRange(a.PrometheusClient, a.KubeClientSet, a.Cloud, start, end, window, namespace, cluster, remoteEnabled)
+	startTime, _ := ParseTimeParam(start)
+	endTime, _ := ParseTimeParam(end)
+	ranges := []DayRange{{Start: startTime, End: endTime}}
+	// timezone, if set, aligns ranges of daily steps to midnight in that zone, so that each point is a calendar day
+	// of the zone. Prometheus steps are fixed, so the points after a daylight saving transition are queried apart,
+	// at the step of the days they cover.
+	if params.Timezone != "" {
+		normalized, _ := normalizeTimeParam(window)
+		step, err := time.ParseDuration(normalized)
+		if err == nil && step > 0 && step%(24*time.Hour) == 0 {
+			startTime, endTime = AlignRangeToDays(startTime, endTime, params.Location)
+			start, end = startTime.UTC().Format(rangeTimeLayout), endTime.UTC().Format(rangeTimeLayout)
+			ranges = CalendarDayRanges(startTime, endTime, int(step/(24*time.Hour)), params.Location)
+		}
+	}
+
+	var data map[string]*CostData
+	var warnings []string
+	for _, dayRange := range ranges {
+		rangeWindow := window
+		if dayRange.Step > 0 {
+			rangeWindow = promDuration(dayRange.Step)
+		}
+		var rangeData map[string]*CostData
+		var rangeWarnings []string
+		if params.Source == CostDataSourceSQL {
+			rangeData, err = RemoteCostDataRange(dayRange.Start, dayRange.End, rangeWindow, namespace, cluster)
+		} else {
+			rangeStart, rangeEnd := start, end
+			if dayRange.Step > 0 {
+				rangeStart, rangeEnd = dayRange.Start.UTC().Format(rangeTimeLayout), dayRange.End.UTC().Format(rangeTimeLayout)
+			}
+			rangeData, rangeWarnings, err = model.ComputeCostDataRange(promCli, a.KubeClientSet, cp, rangeStart, rangeEnd, rangeWindow, namespace, cluster, remoteEnabled, allowPartial)
+		}
+		if err != nil {
+			break
+		}
+		data = MergeCostDataRanges(data, rangeData)
+		warnings = append(warnings, rangeWarnings...)
+	}
 	if err != nil {
 		w.Write(wrapData(nil, err))
+		return
+	}
+	// podSelector, if set, selects the pods to cost by their labels, which the database records along with costs
+	if len(params.PodSelector) > 0 && params.Source == CostDataSourceSQL {
+		for key, costs := range data {
+			if !params.PodSelector.Matches(costs.Labels) {
+				delete(data, key)
+			}
+		}
+	} else if len(params.PodSelector) > 0 {
+		startTime, _ := ParseTimeParam(start)
+		endTime, _ := ParseTimeParam(end)
+		selectorOffset := ""
+		if o := time.Since(endTime).Truncate(time.Second); o > 0 {
+			selectorOffset = "offset " + promDuration(o)
+		}
+		data, err = SelectPodCostData(promCli, data, params.PodSelector, promDuration(endTime.Sub(startTime)), selectorOffset, LocalClusterID(cp))
+		if err != nil {
+			w.Write(wrapData(nil, err))
+			return
+		}
 	}
+	data = ApplyPVBillingMode(data, pvBillingMode)
 	if aggregationField != "" {
-		c, err := a.Cloud.GetConfig()
+		c, err := cp.GetConfig()
 		if err != nil {
 			w.Write(wrapData(nil, err))
 		}
-		discount, err := strconv.ParseFloat(c.Discount[:len(c.Discount)-1], 64)
+		discount, err := parseDiscount(c)
 		if err != nil {
 			w.Write(wrapData(nil, err))
 		}
-		discount = discount * 0.01
-		agg := AggregateCostModel(a.Cloud, data, aggregationField, aggregationSubField, false, discount, 1.0, nil)
-		w.Write(wrapData(agg, nil))
+		agg := AggregateCostModel(cp, data, aggregationField, aggregationSubField, false, discount, 1.0, nil)
+		ConvertAggregationsCurrency(agg, rate)
+		agg = RoundAggregations(agg, precision)
+		w.Write(wrapEnvelope(&DataEnvelope{Data: agg, Warnings: warnings, Currency: currency, Resolution: window, Start: start, End: end}, nil))
 	} else {
-		if fields != "" {
-			filteredData := filterFields(fields, data)
-			w.Write(wrapData(filteredData, err))
+		data = ConvertCostDataCurrency(data, rate)
+		if fieldFilter != nil {
+			filteredData := fieldFilter.Apply(data)
+			w.Write(wrapEnvelope(&DataEnvelope{Data: filteredData, Warnings: warnings, Currency: currency, Resolution: window, Start: start, End: end}, err))
 		} else {
-			w.Write(wrapData(data, err))
+			w.Write(wrapEnvelope(&DataEnvelope{Data: data, Warnings: warnings, Currency: currency, Resolution: window, Start: start, End: end}, err))
 		}
 	}
 }
 
-// CostDataModelRangeLarge is experimental multi-cluster and long-term data storage in SQL support.
-func (a *Accesses) CostDataModelRangeLarge(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
+// remoteTimeRange reads the start, end and window parameters of a request for data from the remote database,
+// returning start and end formatted for the database. Start defaults to twice the window before end, which
+// defaults to now, and window defaults to 1h.
+func remoteTimeRange(r *http.Request) (string, string, string, error) {
+	start, end, windowString, err := requestTimeRange(r)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	remoteLayout := "2006-01-02T15:04:05Z"
+	remoteStartStr := start.Format(remoteLayout)
+	remoteEndStr := end.Format(remoteLayout)
+	klog.V(1).Infof("Using remote database for query from %s to %s with window %s", remoteStartStr, remoteEndStr, windowString)
+
+	return remoteStartStr, remoteEndStr, windowString, nil
+}
 
+// requestTimeRange reads the start, end and window parameters of a request for data from durable storage. Start
+// defaults to twice the window before end, which defaults to now, and window defaults to 1h.
+func requestTimeRange(r *http.Request) (time.Time, time.Time, string, error) {
 	startString := r.URL.Query().Get("start")
 	endString := r.URL.Query().Get("end")
 	windowString := r.URL.Query().Get("window")
 
-	layout := "2006-01-02T15:04:05.000Z"
-
 	var start time.Time
 	var end time.Time
 	var err error
@@ -456,122 +1386,1203 @@ func (a *Accesses) CostDataModelRangeLarge(w http.ResponseWriter, r *http.Reques
 		windowString = "1h"
 	}
 	if startString != "" {
-		start, err = time.Parse(layout, startString)
+		start, err = ParseTimeParam(startString)
 		if err != nil {
-			klog.V(1).Infof("Error parsing time " + startString + ". Error: " + err.Error())
-			w.Write(wrapData(nil, err))
+			return start, end, "", NewCodedError(ErrorCodeBadWindow, fmt.Errorf("Invalid start '%s'; must be %s", startString, timeParamFormats))
 		}
 	} else {
 		window, err := time.ParseDuration(windowString)
 		if err != nil {
-			w.Write(wrapData(nil, fmt.Errorf("Invalid duration '%s'", windowString)))
-
+			return start, end, "", fmt.Errorf("Invalid duration '%s'", windowString)
 		}
 		start = time.Now().Add(-2 * window)
 	}
 	if endString != "" {
-		end, err = time.Parse(layout, endString)
+		end, err = ParseTimeParam(endString)
 		if err != nil {
-			klog.V(1).Infof("Error parsing time " + endString + ". Error: " + err.Error())
-			w.Write(wrapData(nil, err))
+			return start, end, "", NewCodedError(ErrorCodeBadWindow, fmt.Errorf("Invalid end '%s'; must be %s", endString, timeParamFormats))
 		}
 	} else {
 		end = time.Now()
 	}
 
-	remoteLayout := "2006-01-02T15:04:05Z"
-	remoteStartStr := start.Format(remoteLayout)
-	remoteEndStr := end.Format(remoteLayout)
-	klog.V(1).Infof("Using remote database for query from %s to %s with window %s", startString, endString, windowString)
+	return start, end, windowString, nil
+}
 
-	data, err := CostDataRangeFromSQL("", "", windowString, remoteStartStr, remoteEndStr)
-	w.Write(wrapData(data, err))
+// readCostDataStore reads the cost data of the time range of the request from the durable store
+func (a *Accesses) readCostDataStore(r *http.Request) (map[string]*CostData, error) {
+	start, end, windowString, err := requestTimeRange(r)
+	if err != nil {
+		return nil, err
+	}
+	window, err := time.ParseDuration(windowString)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid duration '%s'", windowString)
+	}
+	return a.CostDataStore.ReadCostDataRange(start, end, window)
 }
 
-func (a *Accesses) OutofClusterCosts(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+// CostDataModelRangeLarge is experimental multi-cluster and long-term data storage in SQL support.
+func (a *Accesses) CostDataModelRangeLarge(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 
-	start := r.URL.Query().Get("start")
-	end := r.URL.Query().Get("end")
-	aggregator := r.URL.Query().Get("aggregator")
+	if a.CostDataStore != nil {
+		data, err := a.readCostDataStore(r)
+		w.Write(wrapData(data, err))
+		return
+	}
+
+	remoteStartStr, remoteEndStr, windowString, err := remoteTimeRange(r)
+	if err != nil {
+		w.Write(wrapData(nil, err))
+		return
+	}
 
-	data, err := a.Cloud.ExternalAllocations(start, end, aggregator)
+	data, err := CostDataRangeFromSQL("", "", windowString, remoteStartStr, remoteEndStr)
 	w.Write(wrapData(data, err))
 }
 
-func (p *Accesses) GetAllNodePricing(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+// AggregateCostModelRangeLarge aggregates the costs of all clusters writing to the remote database by the
+// aggregation field. Fields are grouped by in the database where possible, and otherwise in memory.
+func (a *Accesses) AggregateCostModelRangeLarge(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 
-	data, err := p.Cloud.AllNodePricing()
-	w.Write(wrapData(data, err))
-}
+	cp := a.CloudProvider()
 
-func (p *Accesses) GetConfigs(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	data, err := p.Cloud.GetConfig()
-	w.Write(wrapData(data, err))
-}
+	field := r.URL.Query().Get("aggregation")
+	subfield := r.URL.Query().Get("aggregationSubfield")
+	if field == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(wrapData(nil, NewCodedError(ErrorCodeBadRequest, fmt.Errorf("Missing aggregation field parameter"))))
+		return
+	}
 
-func (p *Accesses) UpdateSpotInfoConfigs(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	data, err := p.Cloud.UpdateConfig(r.Body, costAnalyzerCloud.SpotInfoUpdateType)
+	remoteStartStr, remoteEndStr, windowString, err := remoteTimeRange(r)
 	if err != nil {
-		w.Write(wrapData(data, err))
+		w.Write(wrapData(nil, err))
 		return
 	}
-	w.Write(wrapData(data, err))
-	err = p.Cloud.DownloadPricingData()
+
+	c, err := cp.GetConfig()
 	if err != nil {
-		klog.V(1).Infof("Error redownloading data on config update: %s", err.Error())
+		w.Write(wrapData(nil, err))
+		return
+	}
+	discount, err := parseDiscount(c)
+	if err != nil {
+		w.Write(wrapData(nil, err))
+		return
 	}
-	return
-}
 
-func (p *Accesses) UpdateAthenaInfoConfigs(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	data, err := p.Cloud.UpdateConfig(r.Body, costAnalyzerCloud.AthenaInfoUpdateType)
+	if a.CostDataStore != nil {
+		data, err := a.readCostDataStore(r)
+		if err != nil {
+			w.Write(wrapData(nil, err))
+			return
+		}
+		w.Write(wrapData(AggregateCostModel(cp, data, field, subfield, false, discount, 1.0, nil), nil))
+		return
+	}
+
+	aggregations, err := CostDataAggregateFromSQL(field, subfield, windowString, remoteStartStr, remoteEndStr, costAnalyzerCloud.RAMBytesPerGB(c))
+	if err == nil {
+		// costs aggregated in the database can't be attributed to cost rules or discounted sample by sample, so take
+		// the discount over the whole window
+		start, end, _, err := requestTimeRange(r)
+		if err == nil {
+			discount, err = windowDiscount(c, discount, start, end)
+		}
+		if err != nil {
+			w.Write(wrapData(nil, err))
+			return
+		}
+		scaleAggregations(aggregations, 1-discount)
+		for _, agg := range aggregations {
+			agg.AppliedDiscount = discount
+		}
+		w.Write(wrapData(aggregations, nil))
+		return
+	}
+	if err != ErrSQLAggregationUnsupported {
+		klog.V(1).Infof("Error aggregating in remote database, aggregating in memory: %s", err.Error())
+	}
+
+	data, err := CostDataRangeFromSQL("", "", windowString, remoteStartStr, remoteEndStr)
 	if err != nil {
-		w.Write(wrapData(data, err))
+		w.Write(wrapData(nil, err))
 		return
 	}
-	w.Write(wrapData(data, err))
-	return
+	w.Write(wrapData(AggregateCostModel(cp, data, field, subfield, false, discount, 1.0, nil), nil))
 }
 
-func (p *Accesses) UpdateBigQueryInfoConfigs(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+func (a *Accesses) OutofClusterCosts(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
-	data, err := p.Cloud.UpdateConfig(r.Body, costAnalyzerCloud.BigqueryUpdateType)
+
+	// page and pageSize, if set, return the given 1-based page of the allocations, ordered by aggregator,
+	// environment and service, so that large responses can be fetched in parts
+	params := NewOutOfClusterCostsParams(r)
+	if err := params.Validate(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(wrapData(nil, err))
+		return
+	}
+	page, pageSize := params.Page, params.PageSize
+
+	query, err := externalAllocationsQuery(r)
 	if err != nil {
-		w.Write(wrapData(data, err))
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(wrapData(nil, NewCodedError(ErrorCodeBadRequest, err)))
 		return
 	}
-	w.Write(wrapData(data, err))
-	return
+	query.Start, query.End = params.Start, params.End
+
+	result, err := a.CloudProvider().ExternalAllocations(query)
+	if err != nil || result == nil {
+		w.Write(wrapData(nil, err))
+		return
+	}
+	message := "cache miss"
+	if result.Cached {
+		message = "cache hit"
+	}
+	envelope := &DataEnvelope{Data: result.Allocations, Message: message, BytesScanned: result.BytesScanned}
+	if pageSize > 0 {
+		envelope.Data, envelope.Page = PageOutOfClusterAllocations(result.Allocations, page, pageSize)
+	}
+	w.Write(wrapEnvelope(envelope, nil))
 }
 
-func (p *Accesses) UpdateConfigByKey(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+// externalAllocationsQuery parses the out of cluster costs requested: those from "start" to "end", grouped by
+// the comma-separated tags of "aggregator", e.g. "namespace,team", carrying the comma-separated key=value
+// pairs of "tags", e.g. "team=payments,env=prod", and of the comma-separated services of "services", if any.
+// Cached results are re-queried if "forceRefresh" is "true".
+func externalAllocationsQuery(r *http.Request) (*costAnalyzerCloud.ExternalAllocationsQuery, error) {
+	query := &costAnalyzerCloud.ExternalAllocationsQuery{
+		Start:        r.URL.Query().Get("start"),
+		End:          r.URL.Query().Get("end"),
+		Aggregators:  splitParam(r.URL.Query().Get("aggregator")),
+		TagFilters:   make(map[string]string),
+		Services:     splitParam(r.URL.Query().Get("services")),
+		ForceRefresh: r.URL.Query().Get("forceRefresh") == "true",
+	}
+	for _, tag := range splitParam(r.URL.Query().Get("tags")) {
+		kv := strings.SplitN(tag, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return nil, fmt.Errorf("Invalid tag filter '%s'; expected the form KEY=VALUE", tag)
+		}
+		query.TagFilters[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	return query, nil
+}
+
+// splitParam splits the given comma-separated parameter, dropping empty values
+func splitParam(param string) []string {
+	values := []string{}
+	for _, value := range strings.Split(param, ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+func (p *Accesses) GetAllNodePricing(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
-	data, err := p.Cloud.UpdateConfig(r.Body, "")
-	if err != nil {
-		w.Write(wrapData(data, err))
-		return
-	}
+
+	data, err := p.CloudProvider().AllNodePricing()
+	w.Write(wrapData(data, err))
+}
+
+// GetAssets returns the nodes and persistent volumes currently in the cluster with their hourly pricing
+func (a *Accesses) GetAssets(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	data, err := a.Model.ComputeAssets(a.CloudProvider())
+	w.Write(wrapData(data, err))
+}
+
+// IdleCosts returns the cost of each node over the given window, split into the cost allocated to the
+// containers running on it and the idle remainder
+func (a *Accesses) IdleCosts(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	idleCosts, _, warnings, ok := a.idleByNode(w, r)
+	if !ok {
+		return
+	}
+	w.Write(wrapDataWithWarnings(idleCosts, nil, "", warnings))
+}
+
+// NodePoolCosts reports the cost of the nodes of each node pool over a window, and how much of it was allocated
+// to containers or idle
+func (a *Accesses) NodePoolCosts(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	idleCosts, assets, warnings, ok := a.idleByNode(w, r)
+	if !ok {
+		return
+	}
+	w.Write(wrapDataWithWarnings(ComputeIdleByNodePool(idleCosts, assets.Nodes), nil, "", warnings))
+}
+
+// idleByNode computes the idle cost of each node over the window and offset of the given request, writing an
+// error response and returning false if it cannot
+func (a *Accesses) idleByNode(w http.ResponseWriter, r *http.Request) (map[string]*NodeIdleCost, *Assets, []string, bool) {
+	cp := a.CloudProvider()
+
+	// the idle costs of nodes are measured against the nodes of the local cluster
+	if err := localPrometheusOnly(r); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(wrapData(nil, err))
+		return nil, nil, nil, false
+	}
+	promCli, model := a.PrometheusClient, a.Model
+
+	window := r.URL.Query().Get("window")
+	offset := r.URL.Query().Get("offset")
+
+	if window == "" {
+		window = "1d"
+	}
+	normalized, err := normalizeTimeParam(window)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(wrapData(nil, NewCodedError(ErrorCodeBadWindow, fmt.Errorf("Invalid window '%s'", window))))
+		return nil, nil, nil, false
+	}
+	d, err := time.ParseDuration(normalized)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(wrapData(nil, NewCodedError(ErrorCodeBadWindow, fmt.Errorf("Invalid window '%s'", window))))
+		return nil, nil, nil, false
+	}
+
+	endTime := time.Now()
+	if offset != "" {
+		o, err := time.ParseDuration(offset)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write(wrapData(nil, NewCodedError(ErrorCodeBadWindow, fmt.Errorf("Invalid offset '%s'", offset))))
+			return nil, nil, nil, false
+		}
+		endTime = endTime.Add(-1 * o)
+	}
+	layout := "2006-01-02T15:04:05.000Z"
+	start := endTime.Add(-1 * d).Format(layout)
+	end := endTime.Format(layout)
+
+	data, warnings, err := model.ComputeCostDataRange(promCli, a.KubeClientSet, cp, start, end, "1h", "", "", false, false)
+	if err != nil {
+		w.Write(wrapData(nil, err))
+		return nil, nil, nil, false
+	}
+
+	assets, err := model.ComputeAssets(cp)
+	if err != nil {
+		w.Write(wrapData(nil, err))
+		return nil, nil, nil, false
+	}
+
+	c, err := cp.GetConfig()
+	if err != nil {
+		w.Write(wrapData(nil, err))
+		return nil, nil, nil, false
+	}
+	discount, err := parseDiscount(c)
+	if err != nil {
+		w.Write(wrapData(nil, err))
+		return nil, nil, nil, false
+	}
+	// the node totals are discounted over the window as the samples of the cost data allocated from them are
+	discount, err = windowDiscount(c, discount, endTime.Add(-1*d), endTime)
+	if err != nil {
+		w.Write(wrapData(nil, err))
+		return nil, nil, nil, false
+	}
+
+	return ComputeIdleByNode(cp, data, assets.Nodes, d.Hours(), discount), assets, warnings, true
+}
+
+// NetworkCosts reports the network egress costs of each namespace over the window, which defaults to 1d, by
+// destination. With pods=true, the costs of each pod are reported instead.
+func (a *Accesses) NetworkCosts(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	cp := a.CloudProvider()
+
+	promCli, _, err := a.requestPrometheus(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(wrapData(nil, err))
+		return
+	}
+
+	window := r.URL.Query().Get("window")
+	offset := r.URL.Query().Get("offset")
+	namespace := r.URL.Query().Get("namespace")
+	byPod := r.URL.Query().Get("pods") == "true"
+
+	if window == "" {
+		window = "1d"
+	}
+	normalized, err := normalizeTimeParam(window)
+	if err == nil {
+		_, err = time.ParseDuration(normalized)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(wrapData(nil, NewCodedError(ErrorCodeBadWindow, fmt.Errorf("Invalid window '%s'", window))))
+		return
+	}
+	if offset != "" {
+		if _, err := time.ParseDuration(offset); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write(wrapData(nil, NewCodedError(ErrorCodeBadWindow, fmt.Errorf("Invalid offset '%s'", offset))))
+			return
+		}
+		offset = "offset " + offset
+	}
+
+	currency, rate, err := requestCurrency(r, cp)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(wrapData(nil, NewCodedError(ErrorCodeBadRequest, err)))
+		return
+	}
+
+	podCosts, err := ComputeNetworkCosts(promCli, cp, normalized, offset)
+	if err != nil {
+		w.Write(wrapData(nil, err))
+		return
+	}
+	if namespace != "" {
+		for key, c := range podCosts {
+			if c.Namespace != namespace {
+				delete(podCosts, key)
+			}
+		}
+	}
+
+	networkCosts := podCosts
+	if !byPod {
+		networkCosts = NamespaceNetworkCosts(podCosts)
+	}
+	ConvertNetworkCostsCurrency(networkCosts, rate)
+	w.Write(wrapDataWithCurrency(networkCosts, nil, "", nil, currency))
+}
+
+// SharedResources previews which namespaces and pods the given sharedNamespaces, sharedLabelNames and
+// sharedLabelValues parameters classify as shared, and their total cost over the window, which defaults to 1d
+func (a *Accesses) SharedResources(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	cp := a.CloudProvider()
+
+	promCli, model, err := a.requestPrometheus(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(wrapData(nil, err))
+		return
+	}
+
+	window := r.URL.Query().Get("window")
+	offset := r.URL.Query().Get("offset")
+	sharedNamespaces := r.URL.Query().Get("sharedNamespaces")
+
+	if window == "" {
+		window = "1d"
+	}
+	if offset != "" {
+		offset = "offset " + offset
+	}
+
+	sln, slv, err := parseSharedLabels(r.URL.Query().Get("sharedLabelNames"), r.URL.Query().Get("sharedLabelValues"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(wrapData(nil, NewCodedError(ErrorCodeBadRequest, err)))
+		return
+	}
+	sn := []string{}
+	if sharedNamespaces != "" {
+		sn = strings.Split(sharedNamespaces, ",")
+	}
+
+	c, err := cp.GetConfig()
+	if err != nil {
+		w.Write(wrapData(nil, err))
+		return
+	}
+	discount, err := parseDiscount(c)
+	if err != nil {
+		w.Write(wrapData(nil, err))
+		return
+	}
+
+	data, _, err := model.ComputeCostData(promCli, a.KubeClientSet, cp, window, offset, "")
+	if err != nil {
+		w.Write(wrapData(nil, err))
+		return
+	}
+
+	sr := NewSharedResourceInfo(true, sn, sln, slv)
+	w.Write(wrapData(ComputeSharedResources(cp, data, discount, sr), nil))
+}
+
+// UnitCost returns the cost of each aggregation over the given window, which defaults to 1d, per unit of the
+// business metric given by the metricQuery parameter. metricQuery must return an instant vector labelled by
+// the aggregation field, or by the subfield when aggregating by label, and is evaluated at the
+// current time, so should cover the same window, e.g. sum(increase(http_requests_total[1d])) by (namespace).
+func (a *Accesses) UnitCost(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	cp := a.CloudProvider()
+
+	promCli, model, err := a.requestPrometheus(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(wrapData(nil, err))
+		return
+	}
+
+	window := r.URL.Query().Get("window")
+	offset := r.URL.Query().Get("offset")
+	field := r.URL.Query().Get("aggregation")
+	subfield := r.URL.Query().Get("aggregationSubfield")
+	metricQuery := r.URL.Query().Get("metricQuery")
+
+	if field == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(wrapData(nil, NewCodedError(ErrorCodeBadRequest, fmt.Errorf("Missing aggregation parameter"))))
+		return
+	}
+	if field == "label" && subfield == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(wrapData(nil, NewCodedError(ErrorCodeBadRequest, fmt.Errorf("Missing aggregation subfield parameter for aggregation by label"))))
+		return
+	}
+	if metricQuery == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(wrapData(nil, NewCodedError(ErrorCodeBadRequest, fmt.Errorf("Missing metricQuery parameter"))))
+		return
+	}
+
+	if window == "" {
+		window = "1d"
+	}
+	normalized, err := normalizeTimeParam(window)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(wrapData(nil, NewCodedError(ErrorCodeBadWindow, fmt.Errorf("Invalid window '%s'", window))))
+		return
+	}
+	d, err := time.ParseDuration(normalized)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(wrapData(nil, NewCodedError(ErrorCodeBadWindow, fmt.Errorf("Invalid window '%s'", window))))
+		return
+	}
+
+	endTime := time.Now()
+	if offset != "" {
+		o, err := time.ParseDuration(offset)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write(wrapData(nil, NewCodedError(ErrorCodeBadWindow, fmt.Errorf("Invalid offset '%s'", offset))))
+			return
+		}
+		endTime = endTime.Add(-1 * o)
+	}
+	layout := "2006-01-02T15:04:05.000Z"
+	start := endTime.Add(-1 * d).Format(layout)
+	end := endTime.Format(layout)
+
+	data, warnings, err := model.ComputeCostDataRange(promCli, a.KubeClientSet, cp, start, end, "1h", "", "", false, false)
+	if err != nil {
+		w.Write(wrapData(nil, err))
+		return
+	}
+
+	c, err := cp.GetConfig()
+	if err != nil {
+		w.Write(wrapData(nil, err))
+		return
+	}
+	discount, err := parseDiscount(c)
+	if err != nil {
+		w.Write(wrapData(nil, err))
+		return
+	}
+
+	units, err := QueryUnits(promCli, metricQuery, UnitMetricLabel(field, subfield), endTime)
+	if err != nil {
+		w.Write(wrapData(nil, err))
+		return
+	}
+
+	aggregations := AggregateCostModel(cp, data, field, subfield, false, discount, 1.0, nil)
+	w.Write(wrapDataWithWarnings(ComputeUnitCosts(aggregations, units), nil, "", warnings))
+}
+
+// RequestSizing recommends CPU and RAM requests for each container, sized so that the quantile, by default the
+// 95th percentile, of its usage over the window is the target utilization of its requests, along with the monthly
+// savings of resizing them at the prices of its node, e.g. /savings/requestSizing?window=7d&targetUtilization=0.8
+func (a *Accesses) RequestSizing(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	cp := a.CloudProvider()
+
+	params := NewRequestSizingParams(r)
+	if err := params.Validate(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(wrapData(nil, err))
+		return
+	}
+
+	promCli, model, err := a.requestPrometheus(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(wrapData(nil, err))
+		return
+	}
+
+	normalized, _ := normalizeTimeParam(params.Window)
+	d, _ := time.ParseDuration(normalized)
+	endTime := time.Now()
+	if params.Offset != "" {
+		o, _ := time.ParseDuration(params.Offset)
+		endTime = endTime.Add(-1 * o)
+	}
+	startTime := endTime.Add(-1 * d)
+	// usage is sampled every 5 minutes, or more coarsely over long windows, to bound the points per container
+	step := promDuration(DownsampledResolution(startTime, endTime, 5*time.Minute))
+
+	data, warnings, err := model.ComputeCostDataRange(promCli, a.KubeClientSet, cp, startTime.Format(rangeTimeLayout), endTime.Format(rangeTimeLayout), step, params.Namespace, "", false, false)
+	if err != nil {
+		w.Write(wrapData(nil, err))
+		return
+	}
+
+	c, err := cp.GetConfig()
+	if err != nil {
+		w.Write(wrapData(nil, err))
+		return
+	}
+	discount, err := parseDiscount(c)
+	if err != nil {
+		w.Write(wrapData(nil, err))
+		return
+	}
+
+	sizings := ComputeRequestSizing(cp, data, params.Quantile, params.TargetUtilization, discount, params.SortBy)
+	w.Write(wrapDataWithWarnings(sizings, nil, "", warnings))
+}
+
+// ClusterSizing recommends the cheapest nodes which fit the peak requests and usage of the cluster over a window,
+// with headroom, and the monthly savings of replacing the current nodes with them, e.g.
+// /savings/clusterSizing?window=7d&headroom=0.2&candidateTypes=m5.large,m5.xlarge
+func (a *Accesses) ClusterSizing(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	cp := a.CloudProvider()
+
+	params := NewClusterSizingParams(r)
+	if err := params.Validate(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(wrapData(nil, err))
+		return
+	}
+
+	if err := localPrometheusOnly(r); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(wrapData(nil, err))
+		return
+	}
+	promCli, model := a.PrometheusClient, a.Model
+
+	normalized, _ := normalizeTimeParam(params.Window)
+	d, _ := time.ParseDuration(normalized)
+	endTime := time.Now()
+	if params.Offset != "" {
+		o, _ := time.ParseDuration(params.Offset)
+		endTime = endTime.Add(-1 * o)
+	}
+	startTime := endTime.Add(-1 * d)
+	step := promDuration(DownsampledResolution(startTime, endTime, 5*time.Minute))
+
+	data, warnings, err := model.ComputeCostDataRange(promCli, a.KubeClientSet, cp, startTime.Format(rangeTimeLayout), endTime.Format(rangeTimeLayout), step, "", "", false, false)
+	if err != nil {
+		w.Write(wrapData(nil, err))
+		return
+	}
+
+	c, err := cp.GetConfig()
+	if err != nil {
+		w.Write(wrapData(nil, err))
+		return
+	}
+	discount, err := parseDiscount(c)
+	if err != nil {
+		w.Write(wrapData(nil, err))
+		return
+	}
+
+	sizing, err := ComputeClusterSizing(model.Cache, cp, data, params.Headroom, params.CandidateTypes, discount)
+	if err != nil {
+		w.Write(wrapData(nil, err))
+		return
+	}
+	w.Write(wrapDataWithWarnings(sizing, nil, "", warnings))
+}
+
+// StorageSavings lists the persistent volumes which are released, available, or claimed but mounted by no pod over a
+// window, and, where the provider can list them, the unattached disks of the account backing no volume, with their
+// monthly cost, e.g. /savings/storage?window=7d
+func (a *Accesses) StorageSavings(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	cp := a.CloudProvider()
+
+	params := NewStorageSavingsParams(r)
+	if err := params.Validate(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(wrapData(nil, err))
+		return
+	}
+
+	if err := localPrometheusOnly(r); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(wrapData(nil, err))
+		return
+	}
+	promCli, model := a.PrometheusClient, a.Model
+
+	normalized, _ := normalizeTimeParam(params.Window)
+	d, _ := time.ParseDuration(normalized)
+	endTime := time.Now()
+	if params.Offset != "" {
+		o, _ := time.ParseDuration(params.Offset)
+		endTime = endTime.Add(-1 * o)
+	}
+	startTime := endTime.Add(-1 * d)
+	step := promDuration(DownsampledResolution(startTime, endTime, 5*time.Minute))
+
+	data, warnings, err := model.ComputeCostDataRange(promCli, a.KubeClientSet, cp, startTime.Format(rangeTimeLayout), endTime.Format(rangeTimeLayout), step, "", "", false, false)
+	if err != nil {
+		w.Write(wrapData(nil, err))
+		return
+	}
+	w.Write(wrapDataWithWarnings(model.ComputeStorageSavings(cp, data), nil, "", warnings))
+}
+
+// Budgets responds with the budgets of the config
+func (a *Accesses) Budgets(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	cfg, err := a.CloudProvider().GetConfig()
+	if err != nil {
+		w.Write(wrapData(nil, err))
+		return
+	}
+	budgets, err := costAnalyzerCloud.Budgets(cfg)
+	w.Write(wrapData(budgets, err))
+}
+
+// CreateBudget adds the budget in the request body, a cloud.Budget, to the config, responding with it as saved. There
+// must be no budget of the same aggregation and window already.
+func (a *Accesses) CreateBudget(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	budget, ok := decodeBudget(w, r)
+	if !ok {
+		return
+	}
+	a.budgetsLock.Lock()
+	defer a.budgetsLock.Unlock()
+	budgets, ok := a.configBudgets(w)
+	if !ok {
+		return
+	}
+	for _, b := range budgets {
+		if b.ID == budget.ID {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write(wrapData(nil, NewCodedError(ErrorCodeBadRequest, fmt.Errorf("Budget %s already exists; update it with PUT /budgets/%s", budget.ID, budget.ID))))
+			return
+		}
+	}
+	if !a.saveBudgets(w, r, append(budgets, budget)) {
+		return
+	}
+	w.Write(wrapData(budget, nil))
+}
+
+// UpdateBudget replaces the budget of the given ID with the budget in the request body, a cloud.Budget, responding
+// with it as saved. Its aggregation or window may change, and with them its ID, unless another budget has that ID.
+func (a *Accesses) UpdateBudget(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	budget, ok := decodeBudget(w, r)
+	if !ok {
+		return
+	}
+	a.budgetsLock.Lock()
+	defer a.budgetsLock.Unlock()
+	budgets, ok := a.configBudgets(w)
+	if !ok {
+		return
+	}
+	found := false
+	for i, b := range budgets {
+		if b.ID == ps.ByName("id") {
+			budgets[i] = budget
+			found = true
+		} else if b.ID == budget.ID {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write(wrapData(nil, NewCodedError(ErrorCodeBadRequest, fmt.Errorf("Budget %s already exists", budget.ID))))
+			return
+		}
+	}
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write(wrapData(nil, NewCodedError(ErrorCodeBadRequest, fmt.Errorf("No budget %s", ps.ByName("id")))))
+		return
+	}
+	if !a.saveBudgets(w, r, budgets) {
+		return
+	}
+	w.Write(wrapData(budget, nil))
+}
+
+// DeleteBudget removes the budget of the given ID from the config, responding with the remaining budgets
+func (a *Accesses) DeleteBudget(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	a.budgetsLock.Lock()
+	defer a.budgetsLock.Unlock()
+	budgets, ok := a.configBudgets(w)
+	if !ok {
+		return
+	}
+	remaining := make([]*costAnalyzerCloud.Budget, 0, len(budgets))
+	for _, b := range budgets {
+		if b.ID != ps.ByName("id") {
+			remaining = append(remaining, b)
+		}
+	}
+	if len(remaining) == len(budgets) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write(wrapData(nil, NewCodedError(ErrorCodeBadRequest, fmt.Errorf("No budget %s", ps.ByName("id")))))
+		return
+	}
+	if !a.saveBudgets(w, r, remaining) {
+		return
+	}
+	w.Write(wrapData(remaining, nil))
+}
+
+// BudgetStatuses responds with the spend of each budget over its current period, as of its last evaluation
+func (a *Accesses) BudgetStatuses(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	if a.BudgetEvaluator == nil {
+		w.Write(wrapData(nil, fmt.Errorf("Budget evaluation is not enabled")))
+		return
+	}
+	statuses, err := a.BudgetEvaluator.Statuses()
+	w.Write(wrapData(statuses, err))
+}
+
+// decodeBudget decodes and validates the budget in the request body. Otherwise, it responds with the reason it's
+// invalid and returns false.
+func decodeBudget(w http.ResponseWriter, r *http.Request) (*costAnalyzerCloud.Budget, bool) {
+	budget := &costAnalyzerCloud.Budget{}
+	err := json.NewDecoder(r.Body).Decode(budget)
+	if err == nil {
+		err = budget.Validate()
+	}
+	if err == nil {
+		var errs ParamErrors
+		errs.aggregation(budget.Field, budget.SubField, true)
+		err = errs.err()
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(wrapData(nil, NewCodedError(ErrorCodeBadRequest, err)))
+		return nil, false
+	}
+	return budget, true
+}
+
+// configBudgets returns the budgets of the config. Otherwise, it responds with the error and returns false.
+func (a *Accesses) configBudgets(w http.ResponseWriter) ([]*costAnalyzerCloud.Budget, bool) {
+	cfg, err := a.CloudProvider().GetConfig()
+	if err == nil {
+		var budgets []*costAnalyzerCloud.Budget
+		budgets, err = costAnalyzerCloud.Budgets(cfg)
+		if err == nil {
+			return budgets, true
+		}
+	}
+	w.Write(wrapData(nil, err))
+	return nil, false
+}
+
+// saveBudgets replaces the budgets of the config with the given budgets, recording the change in the config history,
+// and evaluates them in the background. Otherwise, it responds with the error and returns false.
+func (a *Accesses) saveBudgets(w http.ResponseWriter, r *http.Request, budgets []*costAnalyzerCloud.Budget) bool {
+	cp := a.CloudProvider()
+	value, err := json.Marshal(budgets)
+	if err != nil {
+		w.Write(wrapData(nil, err))
+		return false
+	}
+	body, err := json.Marshal(map[string]string{"budgets": string(value)})
+	if err != nil {
+		w.Write(wrapData(nil, err))
+		return false
+	}
+	before, _ := cp.GetConfig()
+	data, err := cp.UpdateConfig(bytes.NewReader(body), "")
+	if err != nil {
+		w.Write(wrapData(nil, err))
+		return false
+	}
+	a.recordConfigRevision(r, before, data)
+
+	if a.BudgetEvaluator != nil {
+		go func() {
+			if err := a.BudgetEvaluator.Evaluate(time.Now()); err != nil {
+				klog.V(1).Infof("Failed to evaluate budgets: %s", err.Error())
+			}
+		}()
+	}
+	return true
+}
+
+// RunExport exports the costs of the window from start until end, by default the previous UTC day, to object
+// storage right away, responding with the URLs of the uploaded files
+func (a *Accesses) RunExport(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	if a.CostExporter == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(wrapData(nil, NewCodedError(ErrorCodeBadRequest, fmt.Errorf("Cost export is not configured; set %s", costExportPathEnvVar))))
+		return
+	}
+
+	start, end := previousDay(time.Now())
+	startString := r.URL.Query().Get("start")
+	endString := r.URL.Query().Get("end")
+	if startString != "" || endString != "" {
+		var startErr, endErr error
+		start, startErr = ParseTimeParam(startString)
+		end, endErr = ParseTimeParam(endString)
+		// costs are exported by the hour, so the window must span at least one
+		if startErr != nil || endErr != nil || end.Sub(start) < time.Hour {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write(wrapData(nil, NewCodedError(ErrorCodeBadWindow, fmt.Errorf("Invalid window from '%s' to '%s'; start and end must both be given, as %s, at least an hour apart", startString, endString, timeParamFormats))))
+			return
+		}
+	}
+
+	urls, err := a.CostExporter.exportErr(r.Context(), start, end)
+	w.Write(wrapData(urls, err))
+}
+
+// PricingSourceStatus reports whether the pricing data in use is live, restored from the pricing cache, or the
+// default prices, and how old it is
+func (a *Accesses) PricingSourceStatus(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	if a.PricingRefresher == nil {
+		w.Write(wrapData(nil, fmt.Errorf("Pricing refresh is not enabled")))
+		return
+	}
+	w.Write(wrapData(a.PricingRefresher.Status(), nil))
+}
+
+// RecordingStats reports the counts of the nodes, pods, containers and persistent volumes priced by the latest pass
+// of price recording, when it completed and how long it took, to correlate gaps in the recorded metrics with
+// slow or failed passes
+func (a *Accesses) RecordingStats(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	stats := a.LastRecordingStats()
+	if stats == nil {
+		w.Write(wrapData(nil, fmt.Errorf("Prices have not been recorded yet")))
+		return
+	}
+	w.Write(wrapData(stats, nil))
+}
+
+func (p *Accesses) GetConfigs(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	data, err := p.CloudProvider().GetConfig()
+	w.Write(wrapData(data, err))
+}
+
+// GetConfig responds with the values of the config keys given by the key parameter, which may be comma
+// separated or repeated, or with the whole config when no key is given
+func (p *Accesses) GetConfig(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	data, err := p.CloudProvider().GetConfig()
+	if err != nil {
+		w.Write(wrapData(nil, err))
+		return
+	}
+
+	keys := []string{}
+	for _, key := range r.URL.Query()["key"] {
+		for _, k := range strings.Split(key, ",") {
+			if k = strings.TrimSpace(k); k != "" {
+				keys = append(keys, k)
+			}
+		}
+	}
+	if len(keys) == 0 {
+		w.Write(wrapData(data, nil))
+		return
+	}
+
+	filtered, err := filterConfigKeys(keys, data)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(wrapData(nil, NewCodedError(ErrorCodeBadRequest, err)))
+		return
+	}
+	w.Write(wrapData(filtered, nil))
+}
+
+func (p *Accesses) UpdateSpotInfoConfigs(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	cp := p.CloudProvider()
+	before, _ := cp.GetConfig()
+	data, err := cp.UpdateConfig(r.Body, costAnalyzerCloud.SpotInfoUpdateType)
+	if err != nil {
+		w.Write(wrapData(data, err))
+		return
+	}
+	p.recordConfigRevision(r, before, data)
+	w.Write(wrapData(data, err))
+	err = cp.DownloadPricingData()
+	if err != nil {
+		klog.V(1).Infof("Error redownloading data on config update: %s", err.Error())
+	}
+	return
+}
+
+func (p *Accesses) UpdateAthenaInfoConfigs(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	cp := p.CloudProvider()
+	before, _ := cp.GetConfig()
+	data, err := cp.UpdateConfig(r.Body, costAnalyzerCloud.AthenaInfoUpdateType)
+	if err != nil {
+		w.Write(wrapData(data, err))
+		return
+	}
+	p.recordConfigRevision(r, before, data)
+	w.Write(wrapData(data, err))
+	return
+}
+
+func (p *Accesses) UpdateBigQueryInfoConfigs(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	cp := p.CloudProvider()
+	before, _ := cp.GetConfig()
+	data, err := cp.UpdateConfig(r.Body, costAnalyzerCloud.BigqueryUpdateType)
+	if err != nil {
+		w.Write(wrapData(data, err))
+		return
+	}
+	p.recordConfigRevision(r, before, data)
 	w.Write(wrapData(data, err))
 	return
 }
 
+// UpdateConfigByKey updates the config keys of the JSON object in the request body, responding with the whole
+// config as updated. Keys and values are validated as by UpdateConfigBulk, so that an invalid update leaves the
+// config unchanged.
+func (p *Accesses) UpdateConfigByKey(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	data, ok := p.updateConfig(w, r)
+	if !ok {
+		return
+	}
+	w.Write(wrapData(data, nil))
+}
+
+// UpdateConfigBulk updates every key of the JSON object in the request body in one call. All keys are
+// validated before any is applied, so that either all keys are updated or, if any key is rejected,
+// none are, and the rejected keys are reported with the reason for rejection.
+func (p *Accesses) UpdateConfigBulk(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	data, ok := p.updateConfig(w, r)
+	if !ok {
+		return
+	}
+	w.Write(wrapData(data, nil))
+	err := p.CloudProvider().DownloadPricingData()
+	if err != nil {
+		klog.V(1).Infof("Error redownloading data on config update: %s", err.Error())
+	}
+}
+
+// updateConfig applies the config updates of the JSON object in the request body if every key is known and
+// every value valid, returning the updated config. Otherwise, it responds with the reason each key was
+// rejected and returns false.
+func (p *Accesses) updateConfig(w http.ResponseWriter, r *http.Request) (*costAnalyzerCloud.CustomPricing, bool) {
+	cp := p.CloudProvider()
+
+	updates := make(map[string]string)
+	err := json.NewDecoder(r.Body).Decode(&updates)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(wrapData(nil, NewCodedError(ErrorCodeBadRequest, err)))
+		return nil, false
+	}
+
+	rejected := make(map[string]string)
+	unknown := false
+	for k, v := range updates {
+		if err := costAnalyzerCloud.ValidateCustomPricingField(strings.Title(k)); err != nil {
+			rejected[k] = err.Error()
+			unknown = true
+		} else if err := costAnalyzerCloud.ValidateCustomPricingValue(strings.Title(k), v); err != nil {
+			rejected[k] = err.Error()
+		}
+	}
+	if len(rejected) > 0 {
+		keys := []string{}
+		for k := range rejected {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		err := fmt.Errorf("Rejected config keys: %s", strings.Join(keys, ", "))
+		if unknown {
+			err = fmt.Errorf("%s; valid keys are: %s", err.Error(), strings.Join(costAnalyzerCloud.CustomPricingKeys(), ", "))
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(wrapData(rejected, NewCodedError(ErrorCodeInvalidConfig, err)))
+		return nil, false
+	}
+
+	body, err := json.Marshal(updates)
+	if err != nil {
+		w.Write(wrapData(nil, err))
+		return nil, false
+	}
+	before, _ := cp.GetConfig()
+	data, err := cp.UpdateConfig(bytes.NewReader(body), "")
+	if err != nil {
+		w.Write(wrapData(data, err))
+		return nil, false
+	}
+	p.recordConfigRevision(r, before, data)
+	return data, true
+}
+
+// recordConfigRevision adds the changes of the config from before to after, by the caller of the request, to
+// the config history
+func (p *Accesses) recordConfigRevision(r *http.Request, before, after *costAnalyzerCloud.CustomPricing) {
+	if p.ConfigHistory == nil || before == nil || after == nil {
+		return
+	}
+	if _, err := p.ConfigHistory.Record(before, after, configUser(r)); err != nil {
+		klog.V(1).Infof("Error saving config history: %s", err.Error())
+	}
+}
+
+// GetConfigHistory responds with the revisions of the config kept in the config history, oldest first
+func (p *Accesses) GetConfigHistory(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	if p.ConfigHistory == nil {
+		w.Write(wrapData(nil, fmt.Errorf("Config history is not enabled")))
+		return
+	}
+	w.Write(wrapData(p.ConfigHistory.Revisions(), nil))
+}
+
+// RollbackConfig restores the config as of the given revision of the config history, recording the rollback
+// as a new revision, and responds with the whole config as restored. Secrets are not rolled back.
+func (p *Accesses) RollbackConfig(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	cp := p.CloudProvider()
+
+	if p.ConfigHistory == nil {
+		w.Write(wrapData(nil, fmt.Errorf("Config history is not enabled")))
+		return
+	}
+	revision, err := strconv.Atoi(ps.ByName("revision"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(wrapData(nil, NewCodedError(ErrorCodeBadRequest, fmt.Errorf("Invalid revision '%s'", ps.ByName("revision")))))
+		return
+	}
+	updates, err := p.ConfigHistory.RollbackUpdates(revision)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(wrapData(nil, NewCodedError(ErrorCodeBadRequest, err)))
+		return
+	}
+
+	body, err := json.Marshal(updates)
+	if err != nil {
+		w.Write(wrapData(nil, err))
+		return
+	}
+	before, _ := cp.GetConfig()
+	data, err := cp.UpdateConfig(bytes.NewReader(body), "")
+	if err != nil {
+		w.Write(wrapData(data, err))
+		return
+	}
+	p.recordConfigRevision(r, before, data)
+	w.Write(wrapData(data, nil))
+	err = cp.DownloadPricingData()
+	if err != nil {
+		klog.V(1).Infof("Error redownloading data on config update: %s", err.Error())
+	}
+}
+
 func (p *Accesses) ManagementPlatform(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 
-	data, err := p.Cloud.GetManagementPlatform()
+	data, err := p.CloudProvider().GetManagementPlatform()
 	if err != nil {
 		w.Write(wrapData(data, err))
 		return
@@ -584,7 +2595,7 @@ func (p *Accesses) ClusterInfo(w http.ResponseWriter, r *http.Request, ps httpro
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 
-	data, err := p.Cloud.ClusterInfo()
+	data, err := p.CloudProvider().ClusterInfo()
 	w.Write(wrapData(data, err))
 
 }
@@ -598,184 +2609,629 @@ func Healthz(w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
 func (p *Accesses) GetPrometheusMetadata(w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Write(wrapData(ValidatePrometheus(p.PrometheusClient)))
+
+	data, err := ValidatePrometheus(p.PrometheusClient)
+	if p.Model.LongTermPrometheusClient != nil {
+		longTerm, ltErr := ValidatePrometheus(p.Model.LongTermPrometheusClient)
+		data.LongTerm = longTerm
+		if err == nil && ltErr != nil {
+			err = fmt.Errorf("Long-term prometheus: %s", ltErr.Error())
+		}
+	}
+	w.Write(wrapData(data, err))
+}
+
+// ScrapeHealth reports the targets of the scrape jobs the model depends on which are down or missing, as costs
+// depending on their metrics, e.g. those of node-exporter, are silently zero without them.
+func (p *Accesses) ScrapeHealth(w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	health, err := ComputeScrapeHealth(p.PrometheusClient, ScrapeHealthJobs())
+	if err != nil {
+		w.Write(wrapData(nil, err))
+		return
+	}
+	var unhealthy []string
+	for _, job := range health.Jobs {
+		if !job.Healthy {
+			unhealthy = append(unhealthy, job.Job)
+		}
+	}
+	message := ""
+	if len(unhealthy) > 0 {
+		message = fmt.Sprintf("Scrape targets of %s are down or missing, so costs depending on their metrics may be zero", strings.Join(unhealthy, ", "))
+	}
+	w.Write(wrapDataWithMessage(health, nil, message))
 }
 
 func (p *Accesses) ContainerUptimes(w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
-	res, err := ComputeUptimes(p.PrometheusClient)
+	res, err := ComputeUptimes(p.PrometheusClient, p.CloudProvider())
 	w.Write(wrapData(res, err))
 }
 
-func (a *Accesses) recordPrices() {
-	go func() {
-		containerSeen := make(map[string]bool)
-		nodeSeen := make(map[string]bool)
-		pvSeen := make(map[string]bool)
-		pvcSeen := make(map[string]bool)
+// requestPrometheus returns the client of the prometheus given by the URL in the prometheus parameter of the
+// request, and a model querying it alone, for requests against a prometheus other than the one bound at startup.
+// Only the addresses in AllowedPrometheusURLs may be selected, so that requests can't make the server query
+// arbitrary hosts. The model of another prometheus reads no pods or nodes from the local cluster, so its cluster
+// is costed from its own metrics alone. Without the parameter, it returns the default client and model.
+func (a *Accesses) requestPrometheus(r *http.Request) (prometheusClient.Client, *CostModel, error) {
+	address := r.URL.Query().Get("prometheus")
+	if address == "" {
+		return a.PrometheusClient, a.Model, nil
+	}
+	u, err := url.Parse(address)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, nil, NewCodedError(ErrorCodeBadRequest, fmt.Errorf("Invalid prometheus '%s'; must be an http or https URL", address))
+	}
+	allowed := false
+	for _, allowedAddress := range a.AllowedPrometheusURLs {
+		allowed = allowed || strings.TrimSuffix(allowedAddress, "/") == strings.TrimSuffix(address, "/")
+	}
+	if !allowed {
+		return nil, nil, NewCodedError(ErrorCodeBadRequest, fmt.Errorf("Prometheus '%s' is not allowed; add it to $%s", address, allowedPrometheusURLsEnvVar))
+	}
+	cli, err := prometheusClient.NewClient(prometheusClient.Config{
+		Address:      address,
+		RoundTripper: longTimeoutRoundTripper,
+	})
+	if err != nil {
+		return nil, nil, NewCodedError(ErrorCodeBadRequest, fmt.Errorf("Invalid prometheus '%s': %s", address, err.Error()))
+	}
+	// the long-term store holds the history of the default prometheus, not of this one
+	model := *a.Model
+	model.LongTermPrometheusClient = nil
+	model.Cache = emptyClusterCache{}
+	return cli, &model, nil
+}
 
-		getKeyFromLabelStrings := func(labels ...string) string {
-			return strings.Join(labels, ",")
+// localPrometheusOnly returns an error if the request selects another prometheus, for the endpoints which report
+// the nodes and volumes of the local cluster
+func localPrometheusOnly(r *http.Request) error {
+	if r.URL.Query().Get("prometheus") != "" {
+		return NewCodedError(ErrorCodeBadRequest, fmt.Errorf("The prometheus parameter is not supported by %s, which reports the nodes and volumes of the local cluster", r.URL.Path))
+	}
+	return nil
+}
+
+// allowedPrometheusURLsFromEnv reads the comma separated addresses the prometheus parameter may select from
+// ALLOWED_PROMETHEUS_URLS. None may be selected if it is unset.
+func allowedPrometheusURLsFromEnv() ([]string, error) {
+	var addresses []string
+	for _, address := range strings.Split(os.Getenv(allowedPrometheusURLsEnvVar), ",") {
+		address = strings.TrimSpace(address)
+		if address == "" {
+			continue
+		}
+		u, err := url.Parse(address)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("Invalid prometheus '%s' in $%s; must be an http or https URL", address, allowedPrometheusURLsEnvVar)
 		}
-		getLabelStringsFromKey := func(key string) []string {
-			return strings.Split(key, ",")
+		addresses = append(addresses, address)
+	}
+	return addresses, nil
+}
+
+// durationFromEnv reads a positive, whole-second duration such as "90s", "5m" or "15d" from the given environment
+// variable, returning def if it is unset
+func durationFromEnv(envVar string, def time.Duration) (time.Duration, error) {
+	value := os.Getenv(envVar)
+	if value == "" {
+		return def, nil
+	}
+	normalized, err := normalizeTimeParam(value)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid duration '%s' in $%s: %s", value, envVar, err.Error())
+	}
+	d, err := time.ParseDuration(normalized)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid duration '%s' in $%s: %s", value, envVar, err.Error())
+	}
+	if d < time.Second || d%time.Second != 0 {
+		return 0, fmt.Errorf("Invalid duration '%s' in $%s: must be a positive whole number of seconds", value, envVar)
+	}
+	return d, nil
+}
+
+// promDuration formats a duration the way prometheus expects range selectors and offsets, e.g. "2m" rather than "2m0s"
+func promDuration(d time.Duration) string {
+	if d%time.Hour == 0 {
+		return fmt.Sprintf("%dh", d/time.Hour)
+	}
+	if d%time.Minute == 0 {
+		return fmt.Sprintf("%dm", d/time.Minute)
+	}
+	return fmt.Sprintf("%ds", d/time.Second)
+}
+
+// maxPriceRecordBackoff bounds the delay before retrying price recording after consecutive failed passes
+const maxPriceRecordBackoff = 30 * time.Minute
+
+// PriceRecording holds the label values of the series recorded by price recording, by whether they were
+// recorded by its latest pass, so that the series of departed nodes, containers, volumes and services are
+// deleted by the next
+type PriceRecording struct {
+	containerSeen        map[string]bool
+	nodeSeen             map[string]bool
+	nodePriceSeen        map[string]bool
+	pvSeen               map[string]bool
+	pvcSeen              map[string]bool
+	lbSeen               map[string]bool
+	namespaceNetworkSeen map[string]bool
+	priced               RecordingStats // the counts of what its latest pass priced
+}
+
+// RecordingStats summarizes a pass of price recording: how many nodes, pods, containers and persistent volumes it
+// priced, when it completed and how long it took, and why it failed, if it did
+type RecordingStats struct {
+	Nodes           int     `json:"nodes"`
+	Pods            int     `json:"pods"`
+	Containers      int     `json:"containers"`
+	PVs             int     `json:"pvs"`
+	DurationSeconds float64 `json:"durationSeconds"`
+	CompletedAt     string  `json:"completedAt"`
+	Error           string  `json:"error,omitempty"`
+}
+
+// Priced returns the counts of the nodes, pods, containers and persistent volumes priced by the latest pass of the
+// recording
+func (r *PriceRecording) Priced() RecordingStats {
+	return r.priced
+}
+
+// countSeen returns the number of the given label values recorded by the latest pass
+func countSeen(seen map[string]bool) int {
+	count := 0
+	for _, s := range seen {
+		if s {
+			count++
 		}
+	}
+	return count
+}
 
-		for {
-			klog.V(4).Info("Recording prices...")
-			podlist := a.Model.Cache.GetAllPods()
-			podStatus := make(map[string]v1.PodPhase)
-			for _, pod := range podlist {
-				podStatus[pod.Name] = pod.Status.Phase
-			}
+// NewPriceRecording returns the state of a price recording which has not recorded any series yet
+func NewPriceRecording() *PriceRecording {
+	return &PriceRecording{
+		containerSeen:        make(map[string]bool),
+		nodeSeen:             make(map[string]bool),
+		nodePriceSeen:        make(map[string]bool),
+		pvSeen:               make(map[string]bool),
+		pvcSeen:              make(map[string]bool),
+		lbSeen:               make(map[string]bool),
+		namespaceNetworkSeen: make(map[string]bool),
+	}
+}
+
+func getKeyFromLabelStrings(labels ...string) string {
+	return strings.Join(labels, ",")
+}
+
+func getLabelStringsFromKey(key string) []string {
+	return strings.Split(key, ",")
+}
 
-			// Record network pricing at global scope
-			networkCosts, err := a.Cloud.NetworkPricing()
-			if err != nil {
-				klog.V(4).Infof("Failed to retrieve network costs: %s", err.Error())
+// RecordPrices records the prices and allocations of the cluster every PriceRecordInterval until ctx is done,
+// returning a channel closed once recording stops. A pass under way when ctx is done runs to completion,
+// cleaning up the series of departed nodes and containers, so that gauges are not left half updated. A pass
+// which panics is counted by PriceRecordingErrors and retried with backoff, rather than stopping the recording.
+func (a *Accesses) RecordPrices(ctx context.Context) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		recording := NewPriceRecording()
+		failures := 0
+		for {
+			delay := a.PriceRecordInterval
+			if err := a.recordPricesPass(recording); err != nil {
+				failures++
+				delay = priceRecordBackoff(a.PriceRecordInterval, failures)
+				klog.V(1).Infof("%s; retrying in %s", err.Error(), delay)
 			} else {
-				a.NetworkZoneEgressRecorder.Set(networkCosts.ZoneNetworkEgressCost)
-				a.NetworkRegionEgressRecorder.Set(networkCosts.RegionNetworkEgressCost)
-				a.NetworkInternetEgressRecorder.Set(networkCosts.InternetNetworkEgressCost)
+				failures = 0
 			}
 
-			data, err := a.Model.ComputeCostData(a.PrometheusClient, a.KubeClientSet, a.Cloud, "2m", "", "")
-			if err != nil {
-				klog.V(1).Info("Error in price recording: " + err.Error())
-				// zero the for loop so the time.Sleep will still work
-				data = map[string]*CostData{}
+			select {
+			case <-ctx.Done():
+				klog.V(1).Info("Stopped recording prices")
+				return
+			case <-time.After(delay):
 			}
+		}
+	}()
+	return done
+}
 
-			for _, costs := range data {
-				nodeName := costs.NodeName
-				node := costs.NodeData
-				if node == nil {
-					klog.V(4).Infof("Skipping Node \"%s\" due to missing Node Data costs", nodeName)
-					continue
-				}
-				cpuCost, _ := strconv.ParseFloat(node.VCPUCost, 64)
-				cpu, _ := strconv.ParseFloat(node.VCPU, 64)
-				ramCost, _ := strconv.ParseFloat(node.RAMCost, 64)
-				ram, _ := strconv.ParseFloat(node.RAMBytes, 64)
-				gpu, _ := strconv.ParseFloat(node.GPU, 64)
-				gpuCost, _ := strconv.ParseFloat(node.GPUCost, 64)
-
-				totalCost := cpu*cpuCost + ramCost*(ram/1024/1024/1024) + gpu*gpuCost
-
-				namespace := costs.Namespace
-				podName := costs.PodName
-				containerName := costs.Name
-
-				if costs.PVCData != nil {
-					for _, pvc := range costs.PVCData {
-						if pvc.Volume != nil {
-							a.PVAllocationRecorder.WithLabelValues(namespace, podName, pvc.Claim, pvc.VolumeName).Set(pvc.Values[0].Value)
-							labelKey := getKeyFromLabelStrings(namespace, podName, pvc.Claim, pvc.VolumeName)
-							pvcSeen[labelKey] = true
-						}
-					}
-				}
+// priceRecordBackoff returns the delay before retrying price recording after the given number of consecutive
+// failed passes, doubling the interval with each up to maxPriceRecordBackoff
+func priceRecordBackoff(interval time.Duration, failures int) time.Duration {
+	delay := interval
+	for i := 0; i < failures && delay < maxPriceRecordBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxPriceRecordBackoff {
+		delay = maxPriceRecordBackoff
+	}
+	if delay < interval {
+		delay = interval
+	}
+	return delay
+}
 
-				a.CPUPriceRecorder.WithLabelValues(nodeName, nodeName).Set(cpuCost)
-				a.RAMPriceRecorder.WithLabelValues(nodeName, nodeName).Set(ramCost)
-				a.GPUPriceRecorder.WithLabelValues(nodeName, nodeName).Set(gpuCost)
-				a.NodeTotalPriceRecorder.WithLabelValues(nodeName, nodeName).Set(totalCost)
-				labelKey := getKeyFromLabelStrings(nodeName, nodeName)
-				nodeSeen[labelKey] = true
+// recordPricesPass computes the cost data of the cluster and records its prices, summarizing the pass in the
+// log and in the stats reported by LastRecordingStats
+func (a *Accesses) recordPricesPass(r *PriceRecording) error {
+	start := time.Now()
+	data, err := a.recordedCostData()
+	if err == nil {
+		err = a.RecordPricesOnce(r, data)
+	}
 
-				if len(costs.RAMAllocation) > 0 {
-					a.RAMAllocationRecorder.WithLabelValues(namespace, podName, containerName, nodeName, nodeName).Set(costs.RAMAllocation[0].Value)
-				}
-				if len(costs.CPUAllocation) > 0 {
-					a.CPUAllocationRecorder.WithLabelValues(namespace, podName, containerName, nodeName, nodeName).Set(costs.CPUAllocation[0].Value)
-				}
-				if len(costs.GPUReq) > 0 {
-					// allocation here is set to the request because shared GPU usage not yet supported.
-					a.GPUAllocationRecorder.WithLabelValues(namespace, podName, containerName, nodeName, nodeName).Set(costs.GPUReq[0].Value)
-				}
-				labelKey = getKeyFromLabelStrings(namespace, podName, containerName, nodeName, nodeName)
-				if podStatus[podName] == v1.PodRunning { // Only report data for current pods
-					containerSeen[labelKey] = true
-				} else {
-					containerSeen[labelKey] = false
-				}
+	stats := r.priced
+	stats.DurationSeconds = time.Since(start).Seconds()
+	stats.CompletedAt = time.Now().UTC().Format(time.RFC3339)
+	if err != nil {
+		stats.Error = err.Error()
+	}
+	klog.V(2).Infof("Recorded prices of %d nodes, %d pods, %d containers and %d PVs in %s", stats.Nodes, stats.Pods, stats.Containers, stats.PVs, time.Since(start).Round(time.Millisecond))
+	a.recordingStatsLock.Lock()
+	a.recordingStats = &stats
+	a.recordingStatsLock.Unlock()
+	return err
+}
 
-				storageClasses := a.Model.Cache.GetAllStorageClasses()
-				storageClassMap := make(map[string]map[string]string)
-				for _, storageClass := range storageClasses {
-					params := storageClass.Parameters
-					storageClassMap[storageClass.ObjectMeta.Name] = params
-					if storageClass.GetAnnotations()["storageclass.kubernetes.io/is-default-class"] == "true" || storageClass.GetAnnotations()["storageclass.beta.kubernetes.io/is-default-class"] == "true" {
-						storageClassMap["default"] = params
-						storageClassMap[""] = params
-					}
-				}
+// LastRecordingStats returns the stats of the latest pass of price recording, or nil if none has completed
+func (a *Accesses) LastRecordingStats() *RecordingStats {
+	a.recordingStatsLock.RLock()
+	defer a.recordingStatsLock.RUnlock()
+	if a.recordingStats == nil {
+		return nil
+	}
+	stats := *a.recordingStats
+	return &stats
+}
 
-				pvs := a.Model.Cache.GetAllPersistentVolumes()
-				for _, pv := range pvs {
-					parameters, ok := storageClassMap[pv.Spec.StorageClassName]
-					if !ok {
-						klog.V(4).Infof("Unable to find parameters for storage class \"%s\". Does pv \"%s\" have a storageClassName?", pv.Spec.StorageClassName, pv.Name)
-					}
-					cacPv := &costAnalyzerCloud.PV{
-						Class:      pv.Spec.StorageClassName,
-						Region:     pv.Labels[v1.LabelZoneRegion],
-						Parameters: parameters,
-					}
-					GetPVCost(cacPv, pv, a.Cloud)
-					c, _ := strconv.ParseFloat(cacPv.Cost, 64)
-					a.PersistentVolumePriceRecorder.WithLabelValues(pv.Name, pv.Name).Set(c)
-					labelKey := getKeyFromLabelStrings(pv.Name, pv.Name)
-					pvSeen[labelKey] = true
-				}
-				containerUptime, _ := ComputeUptimes(a.PrometheusClient)
-				for key, uptime := range containerUptime {
-					container, _ := NewContainerMetricFromKey(key)
-					a.ContainerUptimeRecorder.WithLabelValues(container.Namespace, container.PodName, container.ContainerName).Set(uptime)
+// parseDiscount returns the discount of the given config as a fraction. The discount is a percentage, with or
+// without its "%", and is 0 if it isn't set, as when costs are discounted by a discount schedule instead.
+func parseDiscount(cfg *costAnalyzerCloud.CustomPricing) (float64, error) {
+	if cfg == nil {
+		return 0, nil
+	}
+	discountStr := strings.TrimSuffix(strings.TrimSpace(cfg.Discount), "%")
+	if discountStr == "" {
+		return 0, nil
+	}
+	discount, err := strconv.ParseFloat(discountStr, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid discount '%s': %s", cfg.Discount, err.Error())
+	}
+	return discount * 0.01, nil
+}
+
+// windowDiscount returns the discount of costs incurred evenly from start until end: that of the discount schedule
+// of the given config over the window, if it has one, and otherwise the given discount. Window totals, such as the
+// cost of the cluster, are discounted by it, as the samples of the cost data are discounted by the schedule.
+func windowDiscount(cfg *costAnalyzerCloud.CustomPricing, discount float64, start, end time.Time) (float64, error) {
+	schedule, err := costAnalyzerCloud.DiscountSchedule(cfg)
+	if err != nil {
+		return 0, err
+	}
+	if d, ok := schedule.Over(start, end); ok {
+		return d, nil
+	}
+	return discount, nil
+}
+
+// configDiscount returns the discount of the given config as a fraction, or 0 if it isn't set or is invalid
+func configDiscount(cfg *costAnalyzerCloud.CustomPricing) float64 {
+	discount, err := parseDiscount(cfg)
+	if err != nil {
+		klog.V(1).Infof("Failed to parse discount: %s", err.Error())
+		return 0
+	}
+	return discount
+}
+
+// recordedCostData computes the cost data of the cluster over PriceRecordWindow, writing it to CostDataStore
+// if set. Cost data which cannot be computed is recorded as empty.
+func (a *Accesses) recordedCostData() (data map[string]*CostData, err error) {
+	defer a.recoverPriceRecording(&err)
+
+	data, _, computeErr := a.Model.ComputeCostData(a.PrometheusClient, a.KubeClientSet, a.CloudProvider(), a.PriceRecordWindow, "", "")
+	if computeErr != nil {
+		klog.V(1).Info("Error in price recording: " + computeErr.Error())
+		data = map[string]*CostData{}
+	}
+	if a.CostDataStore != nil {
+		if err := a.CostDataStore.WriteCostData(data, time.Now()); err != nil {
+			klog.V(1).Infof("Error writing cost data to durable storage: %s", err.Error())
+		}
+	}
+	return data, nil
+}
+
+// RecordPricesOnce records the prices and allocations of the given cost data, along with the network, load
+// balancer and node capacity costs of the cluster, deleting the series not recorded since the previous pass of
+// the given recording. A panic is recovered, counted by PriceRecordingErrors and returned as an error.
+func (a *Accesses) RecordPricesOnce(r *PriceRecording, data map[string]*CostData) (err error) {
+	defer a.recoverPriceRecording(&err)
+	cp := a.CloudProvider()
+	r.priced = RecordingStats{}
+
+	klog.V(4).Info("Recording prices...")
+	podlist := a.Model.Cache.GetAllPods()
+	podStatus := make(map[string]v1.PodPhase)
+	for _, pod := range podlist {
+		podStatus[pod.Name] = pod.Status.Phase
+	}
+
+	// Record network pricing at global scope
+	networkCosts, err := cp.NetworkPricing()
+	if err != nil {
+		klog.V(4).Infof("Failed to retrieve network costs: %s", err.Error())
+	} else {
+		a.NetworkZoneEgressRecorder.Set(networkCosts.ZoneNetworkEgressCost)
+		a.NetworkRegionEgressRecorder.Set(networkCosts.RegionNetworkEgressCost)
+		a.NetworkInternetEgressRecorder.Set(networkCosts.InternetNetworkEgressCost)
+	}
+
+	// Record the egress of each namespace over the recording window and its cost
+	podNetworkCosts, err := ComputeNetworkCosts(a.PrometheusClient, cp, a.PriceRecordWindow, "")
+	if err != nil {
+		klog.V(4).Infof("Failed to compute network costs: %s", err.Error())
+	} else {
+		for namespace, nc := range NamespaceNetworkCosts(podNetworkCosts) {
+			egressGB := nc.ZoneEgressGB + nc.RegionEgressGB + nc.InternetEgressGB
+			a.NamespaceNetworkEgressRecorder.WithLabelValues(namespace).Set(egressGB * 1024 * 1024 * 1024)
+			a.NamespaceNetworkCostRecorder.WithLabelValues(namespace).Set(nc.TotalCost)
+			r.namespaceNetworkSeen[namespace] = true
+		}
+	}
+
+	// Record the hourly cost of each load balancer service
+	loadBalancerCosts, err := a.Model.ComputeLoadBalancerCosts(cp)
+	if err != nil {
+		klog.V(4).Infof("Failed to retrieve load balancer costs: %s", err.Error())
+	} else {
+		for _, lb := range loadBalancerCosts {
+			a.LoadBalancerCostRecorder.WithLabelValues(lb.Namespace, lb.Name, lb.IngressIP).Set(lb.HourlyCost)
+			labelKey := getKeyFromLabelStrings(lb.Namespace, lb.Name, lb.IngressIP)
+			r.lbSeen[labelKey] = true
+		}
+	}
+
+	// RAM is priced per binary or decimal GB, as configured
+	cfg, err := cp.GetConfig()
+	if err != nil {
+		klog.V(1).Infof("Failed to load config for price recording: %s", err.Error())
+	}
+	bytesPerGB := costAnalyzerCloud.RAMBytesPerGB(cfg)
+
+	// node_total_hourly_cost is the list price of a node, while node_total_hourly_cost_discounted is discounted as
+	// ComputeIdleByNode discounts the node totals of aggregations, so that it matches them
+	discount := configDiscount(cfg)
+
+	pods := make(map[string]bool)
+	for _, costs := range data {
+		nodeName := costs.NodeName
+		node := costs.NodeData
+		if node == nil {
+			klog.V(4).Infof("Skipping Node \"%s\" due to missing Node Data costs", nodeName)
+			continue
+		}
+		cpuCost, _ := strconv.ParseFloat(node.VCPUCost, 64)
+		cpu, _ := strconv.ParseFloat(node.VCPU, 64)
+		ramCost, _ := strconv.ParseFloat(node.RAMCost, 64)
+		ram, _ := strconv.ParseFloat(node.RAMBytes, 64)
+		gpu, _ := strconv.ParseFloat(node.GPU, 64)
+		gpuCost, _ := strconv.ParseFloat(node.GPUCost, 64)
+
+		totalCost := cpu*cpuCost + ramCost*(ram/bytesPerGB) + gpu*gpuCost
+
+		namespace := costs.Namespace
+		podName := costs.PodName
+		containerName := costs.Name
+		pods[namespace+"/"+podName] = true
+		r.priced.Containers++
+
+		if costs.PVCData != nil {
+			for _, pvc := range costs.PVCData {
+				if pvc.Volume != nil && len(pvc.Values) > 0 {
+					a.PVAllocationRecorder.WithLabelValues(namespace, podName, pvc.Claim, pvc.VolumeName).Set(pvc.Values[0].Value)
+					labelKey := getKeyFromLabelStrings(namespace, podName, pvc.Claim, pvc.VolumeName)
+					r.pvcSeen[labelKey] = true
 				}
 			}
-			for labelString, seen := range nodeSeen {
-				if !seen {
-					labels := getLabelStringsFromKey(labelString)
-					a.NodeTotalPriceRecorder.DeleteLabelValues(labels...)
-					a.CPUPriceRecorder.DeleteLabelValues(labels...)
-					a.GPUPriceRecorder.DeleteLabelValues(labels...)
-					a.RAMPriceRecorder.DeleteLabelValues(labels...)
-					delete(nodeSeen, labelString)
-				}
-				nodeSeen[labelString] = false
+		}
+
+		priceLabels := []string{nodeName, nodeName}
+		if a.InstanceLifecycleLabel {
+			priceLabels = append(priceLabels, InstanceLifecycle(node))
+		}
+		a.CPUPriceRecorder.WithLabelValues(priceLabels...).Set(cpuCost)
+		a.RAMPriceRecorder.WithLabelValues(priceLabels...).Set(ramCost)
+		a.GPUPriceRecorder.WithLabelValues(priceLabels...).Set(gpuCost)
+		a.NodeTotalPriceRecorder.WithLabelValues(priceLabels...).Set(totalCost)
+		a.NodeDiscountedPriceRecorder.WithLabelValues(priceLabels...).Set(totalCost * (1 - discount))
+		r.nodePriceSeen[getKeyFromLabelStrings(priceLabels...)] = true
+		if node.IsSpot() {
+			a.NodeSpotRecorder.WithLabelValues(nodeName, nodeName).Set(1.0)
+		} else {
+			a.NodeSpotRecorder.WithLabelValues(nodeName, nodeName).Set(0.0)
+		}
+		labelKey := getKeyFromLabelStrings(nodeName, nodeName)
+		r.nodeSeen[labelKey] = true
+
+		if len(costs.RAMAllocation) > 0 {
+			a.RAMAllocationRecorder.WithLabelValues(namespace, podName, containerName, nodeName, nodeName).Set(costs.RAMAllocation[0].Value)
+		}
+		if len(costs.CPUAllocation) > 0 {
+			a.CPUAllocationRecorder.WithLabelValues(namespace, podName, containerName, nodeName, nodeName).Set(costs.CPUAllocation[0].Value)
+		}
+		if len(costs.GPUReq) > 0 {
+			// allocation here is set to the request because shared GPU usage not yet supported.
+			a.GPUAllocationRecorder.WithLabelValues(namespace, podName, containerName, nodeName, nodeName).Set(costs.GPUReq[0].Value)
+		}
+		labelKey = getKeyFromLabelStrings(namespace, podName, containerName, nodeName, nodeName)
+		if podStatus[podName] == v1.PodRunning { // Only report data for current pods
+			r.containerSeen[labelKey] = true
+		} else {
+			r.containerSeen[labelKey] = false
+		}
+
+		storageClasses := a.Model.Cache.GetAllStorageClasses()
+		storageClassMap := make(map[string]map[string]string)
+		for _, storageClass := range storageClasses {
+			params := storageClass.Parameters
+			storageClassMap[storageClass.ObjectMeta.Name] = params
+			if storageClass.GetAnnotations()["storageclass.kubernetes.io/is-default-class"] == "true" || storageClass.GetAnnotations()["storageclass.beta.kubernetes.io/is-default-class"] == "true" {
+				storageClassMap["default"] = params
+				storageClassMap[""] = params
 			}
-			for labelString, seen := range containerSeen {
-				if !seen {
-					labels := getLabelStringsFromKey(labelString)
-					a.RAMAllocationRecorder.DeleteLabelValues(labels...)
-					a.CPUAllocationRecorder.DeleteLabelValues(labels...)
-					a.GPUAllocationRecorder.DeleteLabelValues(labels...)
-					a.ContainerUptimeRecorder.DeleteLabelValues(labels...)
-					delete(containerSeen, labelString)
-				}
-				containerSeen[labelString] = false
+		}
+
+		pvs := a.Model.Cache.GetAllPersistentVolumes()
+		for _, pv := range pvs {
+			parameters, ok := storageClassMap[pv.Spec.StorageClassName]
+			if !ok {
+				klog.V(4).Infof("Unable to find parameters for storage class \"%s\". Does pv \"%s\" have a storageClassName?", pv.Spec.StorageClassName, pv.Name)
 			}
-			for labelString, seen := range pvSeen {
-				if !seen {
-					labels := getLabelStringsFromKey(labelString)
-					a.PersistentVolumePriceRecorder.DeleteLabelValues(labels...)
-					delete(pvSeen, labelString)
-				}
-				pvSeen[labelString] = false
+			cacPv := &costAnalyzerCloud.PV{
+				Class:      pv.Spec.StorageClassName,
+				Region:     pv.Labels[v1.LabelZoneRegion],
+				Parameters: parameters,
 			}
-			for labelString, seen := range pvcSeen {
-				if !seen {
-					labels := getLabelStringsFromKey(labelString)
-					a.PVAllocationRecorder.DeleteLabelValues(labels...)
-					delete(pvcSeen, labelString)
-				}
-				pvcSeen[labelString] = false
+			GetPVCost(cacPv, pv, cp)
+			c, _ := strconv.ParseFloat(cacPv.Cost, 64)
+			a.PersistentVolumePriceRecorder.WithLabelValues(pv.Name, pv.Name).Set(c)
+			labelKey := getKeyFromLabelStrings(pv.Name, pv.Name)
+			r.pvSeen[labelKey] = true
+		}
+		// the uptime gauge isn't labelled by cluster, so only the containers of the local cluster are recorded
+		clusterID := LocalClusterID(cp)
+		containerUptime, _ := ComputeUptimes(a.PrometheusClient, cp)
+		for key, uptime := range containerUptime {
+			container, _ := NewContainerMetricFromKey(key)
+			if container.ClusterID != clusterID {
+				continue
 			}
-			time.Sleep(time.Minute)
+			a.ContainerUptimeRecorder.WithLabelValues(container.Namespace, container.PodName, container.ContainerName).Set(uptime)
 		}
-	}()
+	}
+	// Record the capacity of each node and how much of it is requested, labelled like its prices
+	for nodeName, capacity := range ComputeNodeCapacities(a.Model.Cache) {
+		a.NodeCPUCapacityRecorder.WithLabelValues(nodeName, nodeName).Set(capacity.CPUCores)
+		a.NodeRAMCapacityRecorder.WithLabelValues(nodeName, nodeName).Set(capacity.RAMBytes)
+		a.NodeGPUCountRecorder.WithLabelValues(nodeName, nodeName).Set(capacity.GPUCount)
+		a.NodeAllocatedCPURecorder.WithLabelValues(nodeName, nodeName).Set(capacity.AllocatedCPUCores)
+		a.NodeAllocatedRAMRecorder.WithLabelValues(nodeName, nodeName).Set(capacity.AllocatedRAMBytes)
+		labelKey := getKeyFromLabelStrings(nodeName, nodeName)
+		r.nodeSeen[labelKey] = true
+	}
+
+	r.priced.Nodes = countSeen(r.nodePriceSeen)
+	r.priced.Pods = len(pods)
+	r.priced.PVs = countSeen(r.pvSeen)
+
+	// the prices of a node are deleted by their own labels, which include its lifecycle when it is labelled,
+	// so that the series of a node whose lifecycle changes do not linger under the previous one
+	for labelString, seen := range r.nodePriceSeen {
+		if !seen {
+			labels := getLabelStringsFromKey(labelString)
+			a.NodeTotalPriceRecorder.DeleteLabelValues(labels...)
+			a.NodeDiscountedPriceRecorder.DeleteLabelValues(labels...)
+			a.CPUPriceRecorder.DeleteLabelValues(labels...)
+			a.GPUPriceRecorder.DeleteLabelValues(labels...)
+			a.RAMPriceRecorder.DeleteLabelValues(labels...)
+			delete(r.nodePriceSeen, labelString)
+		}
+		r.nodePriceSeen[labelString] = false
+	}
+	for labelString, seen := range r.nodeSeen {
+		if !seen {
+			labels := getLabelStringsFromKey(labelString)
+			a.NodeSpotRecorder.DeleteLabelValues(labels...)
+			a.NodeCPUCapacityRecorder.DeleteLabelValues(labels...)
+			a.NodeRAMCapacityRecorder.DeleteLabelValues(labels...)
+			a.NodeGPUCountRecorder.DeleteLabelValues(labels...)
+			a.NodeAllocatedCPURecorder.DeleteLabelValues(labels...)
+			a.NodeAllocatedRAMRecorder.DeleteLabelValues(labels...)
+			delete(r.nodeSeen, labelString)
+		}
+		r.nodeSeen[labelString] = false
+	}
+	for labelString, seen := range r.containerSeen {
+		if !seen {
+			labels := getLabelStringsFromKey(labelString)
+			a.RAMAllocationRecorder.DeleteLabelValues(labels...)
+			a.CPUAllocationRecorder.DeleteLabelValues(labels...)
+			a.GPUAllocationRecorder.DeleteLabelValues(labels...)
+			a.ContainerUptimeRecorder.DeleteLabelValues(labels...)
+			delete(r.containerSeen, labelString)
+		}
+		r.containerSeen[labelString] = false
+	}
+	for labelString, seen := range r.pvSeen {
+		if !seen {
+			labels := getLabelStringsFromKey(labelString)
+			a.PersistentVolumePriceRecorder.DeleteLabelValues(labels...)
+			delete(r.pvSeen, labelString)
+		}
+		r.pvSeen[labelString] = false
+	}
+	for labelString, seen := range r.pvcSeen {
+		if !seen {
+			labels := getLabelStringsFromKey(labelString)
+			a.PVAllocationRecorder.DeleteLabelValues(labels...)
+			delete(r.pvcSeen, labelString)
+		}
+		r.pvcSeen[labelString] = false
+	}
+	for labelString, seen := range r.lbSeen {
+		if !seen {
+			labels := getLabelStringsFromKey(labelString)
+			a.LoadBalancerCostRecorder.DeleteLabelValues(labels...)
+			delete(r.lbSeen, labelString)
+		}
+		r.lbSeen[labelString] = false
+	}
+	for namespace, seen := range r.namespaceNetworkSeen {
+		if !seen {
+			a.NamespaceNetworkEgressRecorder.DeleteLabelValues(namespace)
+			a.NamespaceNetworkCostRecorder.DeleteLabelValues(namespace)
+			delete(r.namespaceNetworkSeen, namespace)
+		}
+		r.namespaceNetworkSeen[namespace] = false
+	}
+	return nil
+}
+
+// recoverPriceRecording recovers a panic of price recording, counting it and returning it through err
+func (a *Accesses) recoverPriceRecording(err *error) {
+	if p := recover(); p != nil {
+		klog.Errorf("Recovered from panic in price recording: %v\n%s", p, debug.Stack())
+		*err = fmt.Errorf("Price recording failed: %v", p)
+		if a.PriceRecordingErrors != nil {
+			a.PriceRecordingErrors.Inc()
+		}
+	}
+}
+
+// Shutdown stops the price recording, pricing refresh and other background work started on init, waiting for
+// the current pass of the price recording to complete or ctx to be done
+func Shutdown(ctx context.Context) error {
+	if stopBackground == nil {
+		return nil
+	}
+	stopBackground()
+	select {
+	case <-recordingPricesDone:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 func init() {
@@ -789,18 +3245,9 @@ func init() {
 		klog.Fatalf("No address for prometheus set in $%s. Aborting.", prometheusServerEndpointEnvVar)
 	}
 
-	var LongTimeoutRoundTripper http.RoundTripper = &http.Transport{ // may be necessary for long prometheus queries. TODO: make this configurable
-		Proxy: http.ProxyFromEnvironment,
-		DialContext: (&net.Dialer{
-			Timeout:   120 * time.Second,
-			KeepAlive: 120 * time.Second,
-		}).DialContext,
-		TLSHandshakeTimeout: 10 * time.Second,
-	}
-
 	pc := prometheusClient.Config{
 		Address:      address,
-		RoundTripper: LongTimeoutRoundTripper,
+		RoundTripper: longTimeoutRoundTripper,
 	}
 	promCli, _ := prometheusClient.NewClient(pc)
 
@@ -817,6 +3264,33 @@ func init() {
 	}
 	klog.V(1).Info("Success: retrieved the 'up' query against prometheus at: " + address)
 
+	// queries for data older than the local prometheus retains are sent to the long-term store, if configured
+	var longTermCli prometheusClient.Client
+	longTermAddress := os.Getenv(longTermEndpointEnvVar)
+	if longTermAddress != "" {
+		longTermCli, err = prometheusClient.NewClient(prometheusClient.Config{
+			Address:      longTermAddress,
+			RoundTripper: longTimeoutRoundTripper,
+		})
+		if err != nil {
+			klog.Fatalf("Invalid long-term prometheus address %s: %s", longTermAddress, err.Error())
+		}
+		_, err = ValidatePrometheus(longTermCli)
+		if err != nil {
+			klog.V(1).Infof("Failed to query long-term prometheus at %s. Error: %s", longTermAddress, err.Error())
+		} else {
+			klog.V(1).Info("Success: retrieved the 'up' query against long-term prometheus at: " + longTermAddress)
+		}
+	}
+	localRetention, err := durationFromEnv(localRetentionEnvVar, defaultLocalRetention)
+	if err != nil {
+		klog.Fatalf("%s", err.Error())
+	}
+	// requests are validated against the default allocation policy, so an invalid one would fail every request
+	if _, err := ValidateAllocationPolicy(""); err != nil {
+		klog.Fatalf("Invalid $%s: %s", allocationPolicyEnvVar, err.Error())
+	}
+
 	// Kubernetes API setup
 	kc, err := rest.InClusterConfig()
 	if err != nil {
@@ -827,30 +3301,90 @@ func init() {
 		panic(err.Error())
 	}
 
-	cloudProviderKey := os.Getenv("CLOUD_PROVIDER_API_KEY")
-	cloudProvider, err := costAnalyzerCloud.NewProvider(kubeClientset, cloudProviderKey)
+	// match the window and cadence of price recording to the prometheus scrape interval
+	priceRecordWindow, err := durationFromEnv(priceRecordWindowEnvVar, defaultPriceRecordWindow)
+	if err != nil {
+		klog.Fatalf("%s", err.Error())
+	}
+	priceRecordInterval, err := durationFromEnv(priceRecordIntervalEnvVar, defaultPriceRecordInterval)
+	if err != nil {
+		klog.Fatalf("%s", err.Error())
+	}
+	klog.V(1).Infof("Recording prices every %s over a %s window", priceRecordInterval, promDuration(priceRecordWindow))
+
+	pricingRefreshInterval, err := durationFromEnv(pricingRefreshIntervalEnvVar, defaultPricingRefreshInterval)
+	if err != nil {
+		klog.Fatalf("%s", err.Error())
+	}
+
+	newCloudProvider := func(apiKey string) (costAnalyzerCloud.Provider, error) {
+		return costAnalyzerCloud.NewProvider(kubeClientset, apiKey)
+	}
+	cloudProvider, err := newCloudProvider(os.Getenv(cloudProviderAPIKeyEnvVar))
 	if err != nil {
 		panic(err.Error())
 	}
 
+	// the instance_lifecycle label changes the series of the node prices, so it is opt-in for now
+	instanceLifecycleLabel := os.Getenv(instanceLifecycleLabelEnvVar) == "true"
+	nodePriceLabels := []string{"instance", "node"}
+	if instanceLifecycleLabel {
+		nodePriceLabels = append(nodePriceLabels, "instance_lifecycle")
+	}
+
 	cpuGv := prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "node_cpu_hourly_cost",
 		Help: "node_cpu_hourly_cost hourly cost for each cpu on this node",
-	}, []string{"instance", "node"})
+	}, nodePriceLabels)
 
 	ramGv := prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "node_ram_hourly_cost",
 		Help: "node_ram_hourly_cost hourly cost for each gb of ram on this node",
-	}, []string{"instance", "node"})
+	}, nodePriceLabels)
 
 	gpuGv := prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "node_gpu_hourly_cost",
 		Help: "node_gpu_hourly_cost hourly cost for each gpu on this node",
-	}, []string{"instance", "node"})
+	}, nodePriceLabels)
 
 	totalGv := prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "node_total_hourly_cost",
 		Help: "node_total_hourly_cost Total node cost per hour",
+	}, nodePriceLabels)
+
+	discountedTotalGv := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "node_total_hourly_cost_discounted",
+		Help: "node_total_hourly_cost_discounted Total node cost per hour after the configured discount",
+	}, nodePriceLabels)
+
+	spotGv := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "kubecost_node_is_spot",
+		Help: "kubecost_node_is_spot 1 if the node is a spot or preemptible node, 0 otherwise",
+	}, []string{"instance", "node"})
+
+	cpuCapacityGv := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "kubecost_node_cpu_capacity_cores",
+		Help: "kubecost_node_cpu_capacity_cores CPU cores of this node",
+	}, []string{"instance", "node"})
+
+	ramCapacityGv := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "kubecost_node_ram_capacity_bytes",
+		Help: "kubecost_node_ram_capacity_bytes Bytes of RAM of this node",
+	}, []string{"instance", "node"})
+
+	gpuCountGv := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "kubecost_node_gpu_count",
+		Help: "kubecost_node_gpu_count GPUs of this node",
+	}, []string{"instance", "node"})
+
+	allocatedCPUGv := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "kubecost_node_allocated_cpu_cores",
+		Help: "kubecost_node_allocated_cpu_cores CPU cores requested by the pods scheduled on this node",
+	}, []string{"instance", "node"})
+
+	allocatedRAMGv := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "kubecost_node_allocated_ram_bytes",
+		Help: "kubecost_node_allocated_ram_bytes Bytes of RAM requested by the pods scheduled on this node",
 	}, []string{"instance", "node"})
 
 	pvGv := prometheus.NewGaugeVec(prometheus.GaugeOpts{
@@ -895,16 +3429,74 @@ func init() {
 		Help: "kubecost_network_internet_egress_cost Total cost per GB of internet egress.",
 	})
 
+	NamespaceNetworkEgressRecorder := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "kubecost_namespace_network_egress_bytes",
+		Help: "kubecost_namespace_network_egress_bytes Bytes sent by the pods of a namespace out of their zone over the price recording window",
+	}, []string{"namespace"})
+
+	NamespaceNetworkCostRecorder := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "kubecost_namespace_network_cost",
+		Help: "kubecost_namespace_network_cost Cost of the egress of the pods of a namespace over the price recording window",
+	}, []string{"namespace"})
+
+	LoadBalancerCostRecorder := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "kubecost_load_balancer_cost",
+		Help: "kubecost_load_balancer_cost Hourly cost of a load balancer",
+	}, []string{"namespace", "service_name", "ingress_ip"})
+
+	pricingRefreshErrors := prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "kubecost_pricing_refresh_errors_total",
+		Help: "kubecost_pricing_refresh_errors_total Failed refreshes of the cloud pricing data",
+	})
+	priceRecordingErrors := prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "kubecost_price_recording_errors_total",
+		Help: "kubecost_price_recording_errors_total Passes of price recording which panicked",
+	})
+	costExportErrors := prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "kubecost_cost_export_errors_total",
+		Help: "kubecost_cost_export_errors_total Failed exports of cost snapshots to object storage",
+	})
+	pricingRefresher := NewPricingRefresher(cloudProvider, pricingRefreshInterval, pricingRefreshErrors)
+	pricingRefresher.WebhookURL, err = refreshWebhookURLFromEnv()
+	if err != nil {
+		klog.Fatalf("%s", err.Error())
+	}
+
+	configHistorySize, err := configHistorySize()
+	if err != nil {
+		klog.Fatalf("%s", err.Error())
+	}
+	configPath := os.Getenv("CONFIG_PATH")
+	if configPath == "" {
+		configPath = "/models/"
+	}
+	pricingRefresher.CacheFile = os.Getenv(pricingCachePathEnvVar)
+	if pricingRefresher.CacheFile == "" {
+		pricingRefresher.CacheFile = configPath + defaultPricingCacheFile
+	}
+	pricingDataAge := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "kubecost_pricing_data_age_seconds",
+		Help: "kubecost_pricing_data_age_seconds Time since the cloud pricing data was last refreshed",
+	}, func() float64 {
+		return pricingRefresher.Age().Seconds()
+	})
+
 	prometheus.MustRegister(cpuGv)
 	prometheus.MustRegister(ramGv)
 	prometheus.MustRegister(gpuGv)
-	prometheus.MustRegister(totalGv)
+	prometheus.MustRegister(totalGv, discountedTotalGv)
+	prometheus.MustRegister(spotGv)
+	prometheus.MustRegister(cpuCapacityGv, ramCapacityGv, gpuCountGv, allocatedCPUGv, allocatedRAMGv)
 	prometheus.MustRegister(pvGv)
 	prometheus.MustRegister(RAMAllocation)
 	prometheus.MustRegister(CPUAllocation)
 	prometheus.MustRegister(ContainerUptimeRecorder)
 	prometheus.MustRegister(PVAllocation)
 	prometheus.MustRegister(NetworkZoneEgressRecorder, NetworkRegionEgressRecorder, NetworkInternetEgressRecorder)
+	prometheus.MustRegister(NamespaceNetworkEgressRecorder, NamespaceNetworkCostRecorder)
+	prometheus.MustRegister(LoadBalancerCostRecorder)
+	prometheus.MustRegister(costAnalyzerCloud.UnmatchedNodePricingCounter)
+	prometheus.MustRegister(pricingRefreshErrors, pricingDataAge, costExportErrors, priceRecordingErrors)
 	prometheus.MustRegister(ServiceCollector{
 		KubeClientSet: kubeClientset,
 	})
@@ -913,27 +3505,74 @@ func init() {
 	})
 
 	// cache responses from model for a default of 2 minutes; clear expired responses every 10 minutes
-	modelCache := cache.New(time.Minute*2, time.Minute*10)
+	modelCacheExpiration := time.Minute * 2
+	modelCache := cache.New(modelCacheExpiration, time.Minute*10)
+	diskCache, err := diskCacheFromEnv(modelCacheExpiration)
+	if err != nil {
+		klog.Fatalf("%s", err.Error())
+	}
+
+	costDataStore, err := costDataStoreFromEnv()
+	if err != nil {
+		klog.Fatalf("%s", err.Error())
+	}
+	if costDataStore != nil {
+		id, name, err := costDataStore.GetOrCreateClusterMeta(LocalClusterID(cloudProvider), costAnalyzerCloud.ClusterName(cloudProvider))
+		if err != nil {
+			klog.V(1).Infof("Unable to store cluster meta: %s", err.Error())
+		} else {
+			klog.V(1).Infof("Writing cost data of cluster '%s' (%s) to durable storage", name, id)
+		}
+	}
+
+	allowedPrometheusURLs, err := allowedPrometheusURLsFromEnv()
+	if err != nil {
+		klog.Fatalf("%s", err.Error())
+	}
+
+	costModel := NewCostModel(kubeClientset)
+	costModel.LongTermPrometheusClient = longTermCli
+	costModel.LocalRetention = localRetention
 
 	A = Accesses{
-		PrometheusClient:              promCli,
-		KubeClientSet:                 kubeClientset,
-		Cloud:                         cloudProvider,
-		CPUPriceRecorder:              cpuGv,
-		RAMPriceRecorder:              ramGv,
-		GPUPriceRecorder:              gpuGv,
-		NodeTotalPriceRecorder:        totalGv,
-		RAMAllocationRecorder:         RAMAllocation,
-		CPUAllocationRecorder:         CPUAllocation,
-		GPUAllocationRecorder:         GPUAllocation,
-		PVAllocationRecorder:          PVAllocation,
-		ContainerUptimeRecorder:       ContainerUptimeRecorder,
-		NetworkZoneEgressRecorder:     NetworkZoneEgressRecorder,
-		NetworkRegionEgressRecorder:   NetworkRegionEgressRecorder,
-		NetworkInternetEgressRecorder: NetworkInternetEgressRecorder,
-		PersistentVolumePriceRecorder: pvGv,
-		Model:                         NewCostModel(kubeClientset),
-		Cache:                         modelCache,
+		PrometheusClient:               promCli,
+		KubeClientSet:                  kubeClientset,
+		Cloud:                          cloudProvider,
+		NewCloudProvider:               newCloudProvider,
+		CPUPriceRecorder:               cpuGv,
+		RAMPriceRecorder:               ramGv,
+		GPUPriceRecorder:               gpuGv,
+		NodeTotalPriceRecorder:         totalGv,
+		NodeDiscountedPriceRecorder:    discountedTotalGv,
+		NodeSpotRecorder:               spotGv,
+		NodeCPUCapacityRecorder:        cpuCapacityGv,
+		NodeRAMCapacityRecorder:        ramCapacityGv,
+		NodeGPUCountRecorder:           gpuCountGv,
+		NodeAllocatedCPURecorder:       allocatedCPUGv,
+		NodeAllocatedRAMRecorder:       allocatedRAMGv,
+		RAMAllocationRecorder:          RAMAllocation,
+		CPUAllocationRecorder:          CPUAllocation,
+		GPUAllocationRecorder:          GPUAllocation,
+		PVAllocationRecorder:           PVAllocation,
+		ContainerUptimeRecorder:        ContainerUptimeRecorder,
+		NetworkZoneEgressRecorder:      NetworkZoneEgressRecorder,
+		NetworkRegionEgressRecorder:    NetworkRegionEgressRecorder,
+		NetworkInternetEgressRecorder:  NetworkInternetEgressRecorder,
+		NamespaceNetworkEgressRecorder: NamespaceNetworkEgressRecorder,
+		NamespaceNetworkCostRecorder:   NamespaceNetworkCostRecorder,
+		LoadBalancerCostRecorder:       LoadBalancerCostRecorder,
+		PersistentVolumePriceRecorder:  pvGv,
+		Model:                          costModel,
+		Cache:                          modelCache,
+		DiskCache:                      diskCache,
+		PriceRecordWindow:              promDuration(priceRecordWindow),
+		PriceRecordInterval:            priceRecordInterval,
+		PriceRecordingErrors:           priceRecordingErrors,
+		InstanceLifecycleLabel:         instanceLifecycleLabel,
+		PricingRefresher:               pricingRefresher,
+		ConfigHistory:                  NewConfigHistory(configPath+configHistoryFile, configHistorySize),
+		CostDataStore:                  costDataStore,
+		AllowedPrometheusURLs:          allowedPrometheusURLs,
 	}
 
 	remoteEnabled := os.Getenv(remoteEnabled)
@@ -948,31 +3587,104 @@ func init() {
 			klog.Infof("Unable to set cluster id '%s' for cluster '%s', %s", info["id"], info["name"], err.Error())
 		}
 	}
+	backgroundCtx, cancel := context.WithCancel(context.Background())
+	stopBackground = cancel
 
-	err = A.Cloud.DownloadPricingData()
+	sqlRetention, err := sqlRetentionFromEnv()
 	if err != nil {
-		klog.V(1).Info("Failed to download pricing data: " + err.Error())
+		klog.Fatalf("%s", err.Error())
 	}
+	if remoteEnabled == "true" && sqlRetention != nil {
+		klog.V(1).Infof("Rolling up remote metrics after %d days and deleting them after %d days", sqlRetention.RollupAfterDays, sqlRetention.RetentionDays)
+		sqlRetention.Run(backgroundCtx)
+	}
+
+	A.PricingRefresher.Start(backgroundCtx)
 
-	A.recordPrices()
+	// the export queries each hour of the window by its end, so that the hour before the window isn't included
+	A.CostExporter, err = costExporterFromEnv(cloudProvider, costExportErrors, func(start, end time.Time) (map[string]*CostData, error) {
+		layout := "2006-01-02T15:04:05.000Z"
+		data, _, err := A.Model.ComputeCostDataRange(A.PrometheusClient, A.KubeClientSet, A.CloudProvider(), start.Add(time.Hour).UTC().Format(layout), end.UTC().Format(layout), "1h", "", "", false, false)
+		return data, err
+	})
+	if err != nil {
+		klog.Fatalf("%s", err.Error())
+	}
+	if A.CostExporter != nil {
+		go func() {
+			select {
+			case <-A.PricingRefresher.Downloaded():
+				A.CostExporter.Run(backgroundCtx)
+			case <-backgroundCtx.Done():
+			}
+		}()
+	}
+	A.BudgetEvaluator, err = budgetEvaluatorFromEnv(A.CloudProvider, configPath+budgetAlertsFile, func(start, end time.Time) (map[string]*CostData, error) {
+		layout := "2006-01-02T15:04:05.000Z"
+		data, _, err := A.Model.ComputeCostDataRange(A.PrometheusClient, A.KubeClientSet, A.CloudProvider(), start.Add(time.Hour).UTC().Format(layout), end.UTC().Format(layout), "1h", "", "", false, false)
+		return data, err
+	})
+	if err != nil {
+		klog.Fatalf("%s", err.Error())
+	}
+	go func() {
+		select {
+		case <-A.PricingRefresher.Downloaded():
+			A.BudgetEvaluator.Run(backgroundCtx)
+		case <-backgroundCtx.Done():
+		}
+	}()
+	if windows := cacheWarmWindows(); len(windows) > 0 {
+		A.WarmCache(A.PricingRefresher, windows)
+	}
 
-	Router.GET("/costDataModel", A.CostDataModel)
-	Router.GET("/costDataModelRange", A.CostDataModelRange)
-	Router.GET("/costDataModelRangeLarge", A.CostDataModelRangeLarge)
-	Router.GET("/outOfClusterCosts", A.OutofClusterCosts)
-	Router.GET("/allNodePricing", A.GetAllNodePricing)
+	recordingPricesDone = A.RecordPrices(backgroundCtx)
+
+	// routes which mutate state require the bearer token in API_AUTH_TOKEN, if set, and the others too if
+	// API_AUTH_ALL_ROUTES is "true"; the health check never does, so that probes needn't know the token
+	mutating, reading, mutatingWhen := apiAuthFromEnv()
+	Router.GET("/costDataModel", reading(A.CostDataModel))
+	Router.GET("/costDataModelRange", reading(A.CostDataModelRange))
+	Router.GET("/costDataModelRangeLarge", reading(A.CostDataModelRangeLarge))
+	Router.GET("/aggregatedCostModelRangeLarge", reading(A.AggregateCostModelRangeLarge))
+	Router.GET("/outOfClusterCosts", reading(A.OutofClusterCosts))
+	Router.GET("/allNodePricing", reading(A.GetAllNodePricing))
+	Router.GET("/assets", reading(A.GetAssets))
+	Router.GET("/idleCosts", reading(A.IdleCosts))
+	Router.GET("/nodePoolCosts", reading(A.NodePoolCosts))
+	Router.GET("/sharedResources", reading(A.SharedResources))
+	Router.GET("/networkCosts", reading(A.NetworkCosts))
+	Router.GET("/unitCost", reading(A.UnitCost))
+	Router.GET("/savings/requestSizing", reading(A.RequestSizing))
+	Router.GET("/savings/clusterSizing", reading(A.ClusterSizing))
+	Router.GET("/savings/storage", reading(A.StorageSavings))
 	Router.GET("/healthz", Healthz)
-	Router.GET("/getConfigs", A.GetConfigs)
-	Router.POST("/refreshPricing", A.RefreshPricingData)
-	Router.POST("/updateSpotInfoConfigs", A.UpdateSpotInfoConfigs)
-	Router.POST("/updateAthenaInfoConfigs", A.UpdateAthenaInfoConfigs)
-	Router.POST("/updateBigQueryInfoConfigs", A.UpdateBigQueryInfoConfigs)
-	Router.POST("/updateConfigByKey", A.UpdateConfigByKey)
-	Router.GET("/clusterCostsOverTime", A.ClusterCostsOverTime)
-	Router.GET("/clusterCosts", A.ClusterCosts)
-	Router.GET("/validatePrometheus", A.GetPrometheusMetadata)
-	Router.GET("/managementPlatform", A.ManagementPlatform)
-	Router.GET("/clusterInfo", A.ClusterInfo)
-	Router.GET("/containerUptimes", A.ContainerUptimes)
-	Router.GET("/aggregatedCostModel", A.AggregateCostModel)
+	Router.GET("/getConfigs", reading(A.GetConfigs))
+	Router.GET("/getConfig", reading(A.GetConfig))
+	Router.POST("/refreshPricing", mutating(A.RefreshPricingData))
+	Router.POST("/reloadProvider", mutating(A.ReloadProvider))
+	Router.GET("/pricingSourceStatus", reading(A.PricingSourceStatus))
+	Router.GET("/recordingStats", reading(A.RecordingStats))
+	Router.POST("/export/run", mutating(A.RunExport))
+	Router.GET("/budgets", reading(A.Budgets))
+	Router.POST("/budgets", mutating(A.CreateBudget))
+	Router.PUT("/budgets/:id", mutating(A.UpdateBudget))
+	Router.DELETE("/budgets/:id", mutating(A.DeleteBudget))
+	Router.GET("/budgets/status", reading(A.BudgetStatuses))
+	Router.POST("/updateSpotInfoConfigs", mutating(A.UpdateSpotInfoConfigs))
+	Router.POST("/updateAthenaInfoConfigs", mutating(A.UpdateAthenaInfoConfigs))
+	Router.POST("/updateBigQueryInfoConfigs", mutating(A.UpdateBigQueryInfoConfigs))
+	Router.POST("/updateConfigByKey", mutating(A.UpdateConfigByKey))
+	Router.POST("/updateConfigBulk", mutating(A.UpdateConfigBulk))
+	Router.GET("/getConfigs/history", reading(A.GetConfigHistory))
+	Router.POST("/getConfigs/rollback/:revision", mutating(A.RollbackConfig))
+	Router.GET("/clusterCostsOverTime", reading(A.ClusterCostsOverTime))
+	Router.GET("/clusterCosts", reading(A.ClusterCosts))
+	Router.GET("/validatePrometheus", reading(A.GetPrometheusMetadata))
+	Router.GET("/scrapeHealth", reading(A.ScrapeHealth))
+	Router.GET("/managementPlatform", reading(A.ManagementPlatform))
+	Router.GET("/clusterInfo", reading(A.ClusterInfo))
+	Router.GET("/containerUptimes", reading(A.ContainerUptimes))
+	Router.GET("/aggregatedCostModel", mutatingWhen(clearsCache, A.AggregateCostModel))
+	Router.GET("/aggregatedCostModelDiff", reading(A.AggregateCostModelDiff))
 }
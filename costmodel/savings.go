@@ -0,0 +1,161 @@
+package costmodel
+
+import (
+	"math"
+	"sort"
+	"strconv"
+
+	"github.com/kubecost/cost-model/cloud"
+	"k8s.io/klog"
+)
+
+// RequestSizingInsufficientData is the status of containers with too few samples of usage to size their requests
+// by, which are given no recommendation rather than a recommendation of zero
+const RequestSizingInsufficientData = "insufficient data"
+
+// MinRequestSizingDataPoints is the fewest samples of both CPU and RAM usage by which a container's requests are
+// sized
+const MinRequestSizingDataPoints = 3
+
+const (
+	// RequestSizingSortBySavings sorts recommendations by their monthly savings, greatest first
+	RequestSizingSortBySavings = "savings"
+	// RequestSizingSortByName sorts recommendations by their namespace, pod and container
+	RequestSizingSortByName = "name"
+)
+
+// RequestSizing is the recommended CPU and RAM requests of a container, sized so that the given quantile of its
+// usage over the window is the target utilization of its requests, and the monthly savings of resizing them at the
+// prices of its node. Savings are negative for containers requesting less than recommended. The usage,
+// recommendations and savings are null for containers with insufficient data.
+type RequestSizing struct {
+	Namespace             string   `json:"namespace"`
+	Pod                   string   `json:"pod"`
+	Container             string   `json:"container"`
+	Node                  string   `json:"node"`
+	ClusterID             string   `json:"clusterId"`
+	CPURequest            float64  `json:"cpuRequest"` // cores
+	CPUUsage              *float64 `json:"cpuUsage"`   // cores at the quantile
+	RecommendedCPURequest *float64 `json:"recommendedCpuRequest"`
+	RAMRequest            float64  `json:"ramRequest"` // bytes
+	RAMUsage              *float64 `json:"ramUsage"`   // bytes at the quantile
+	RecommendedRAMRequest *float64 `json:"recommendedRamRequest"`
+	MonthlySavings        *float64 `json:"monthlySavings"`
+	DataPoints            int      `json:"dataPoints"` // the fewer of the samples of CPU and RAM usage
+	Status                string   `json:"status,omitempty"`
+}
+
+// VectorQuantile returns the given quantile, from 0 to 1, of the values of the given vectors, interpolating
+// linearly between the closest ranks as Prometheus's quantile_over_time does, or 0 if there are none
+func VectorQuantile(vectors []*Vector, quantile float64) float64 {
+	if len(vectors) == 0 {
+		return 0
+	}
+	values := make([]float64, 0, len(vectors))
+	for _, v := range vectors {
+		values = append(values, v.Value)
+	}
+	sort.Float64s(values)
+
+	rank := quantile * float64(len(values)-1)
+	lower := math.Floor(rank)
+	upper := math.Ceil(rank)
+	weight := rank - lower
+	return values[int(lower)]*(1-weight) + values[int(upper)]*weight
+}
+
+// nodeHourlyPrices returns the hourly price of a core and of a GB of RAM of the given node, which are the custom
+// prices if they're enabled and the node isn't priced by a node pricing rule or a rate override
+func nodeHourlyPrices(cp cloud.Provider, customPricing *cloud.CustomPricing, node *cloud.Node) (float64, float64) {
+	if node == nil {
+		return 0, 0
+	}
+	cpuCostStr, ramCostStr := node.VCPUCost, node.RAMCost
+	if customPricing != nil && cloud.CustomPricesEnabled(cp) && node.PricingRule == "" && node.RateOverride == "" {
+		if node.IsSpot() {
+			cpuCostStr, ramCostStr = customPricing.SpotCPU, customPricing.SpotRAM
+		} else {
+			cpuCostStr, ramCostStr = customPricing.CPU, customPricing.RAM
+		}
+	}
+	cpuCost, err := strconv.ParseFloat(cpuCostStr, 64)
+	if err != nil {
+		klog.V(3).Infof("Could not parse CPU price '%s'", cpuCostStr)
+		cpuCost = 0
+	}
+	ramCost, err := strconv.ParseFloat(ramCostStr, 64)
+	if err != nil {
+		klog.V(3).Infof("Could not parse RAM price '%s'", ramCostStr)
+		ramCost = 0
+	}
+	return cpuCost, ramCost
+}
+
+// ComputeRequestSizing recommends CPU and RAM requests for each of the containers of the given cost data, sized so
+// that the given quantile of their usage is the target utilization of their requests, and estimates the monthly
+// savings of each at the discounted prices of its node, sorted by sortBy. Init containers, which run before the
+// others and have no lasting usage, are skipped.
+func ComputeRequestSizing(cp cloud.Provider, costData map[string]*CostData, quantile float64, targetUtilization float64, discount float64, sortBy string) []*RequestSizing {
+	customPricing, err := cp.GetConfig()
+	if err != nil {
+		klog.Errorf("failed to load custom pricing: %s", err)
+	}
+	bytesPerGB := cloud.RAMBytesPerGB(customPricing)
+
+	sizings := []*RequestSizing{}
+	for _, costDatum := range costData {
+		if costDatum.IsInitContainer {
+			continue
+		}
+		sizing := &RequestSizing{
+			Namespace:  costDatum.Namespace,
+			Pod:        costDatum.PodName,
+			Container:  costDatum.Name,
+			Node:       costDatum.NodeName,
+			ClusterID:  costDatum.ClusterID,
+			CPURequest: lastVectorValue(costDatum.CPUReq),
+			RAMRequest: lastVectorValue(costDatum.RAMReq),
+			DataPoints: len(costDatum.CPUUsed),
+		}
+		if len(costDatum.RAMUsed) < sizing.DataPoints {
+			sizing.DataPoints = len(costDatum.RAMUsed)
+		}
+		sizings = append(sizings, sizing)
+		if sizing.DataPoints < MinRequestSizingDataPoints {
+			sizing.Status = RequestSizingInsufficientData
+			continue
+		}
+
+		cpuUsage := VectorQuantile(costDatum.CPUUsed, quantile)
+		ramUsage := VectorQuantile(costDatum.RAMUsed, quantile)
+		recommendedCPU := cpuUsage / targetUtilization
+		recommendedRAM := ramUsage / targetUtilization
+		sizing.CPUUsage, sizing.RecommendedCPURequest = &cpuUsage, &recommendedCPU
+		sizing.RAMUsage, sizing.RecommendedRAMRequest = &ramUsage, &recommendedRAM
+
+		cpuCost, ramCost := nodeHourlyPrices(cp, customPricing, costDatum.NodeData)
+		hourlySavings := (sizing.CPURequest-recommendedCPU)*cpuCost + (sizing.RAMRequest-recommendedRAM)/bytesPerGB*ramCost
+		savings := hourlySavings * 730 * (1 - discount)
+		sizing.MonthlySavings = &savings
+	}
+
+	sort.SliceStable(sizings, func(i, j int) bool {
+		a, b := sizings[i], sizings[j]
+		if sortBy != RequestSizingSortByName && (a.MonthlySavings == nil) != (b.MonthlySavings == nil) {
+			// containers with insufficient data have no savings, so they come last
+			return b.MonthlySavings == nil
+		}
+		if sortBy != RequestSizingSortByName && a.MonthlySavings != nil && *a.MonthlySavings != *b.MonthlySavings {
+			return *a.MonthlySavings > *b.MonthlySavings
+		}
+		if a.Namespace != b.Namespace {
+			return a.Namespace < b.Namespace
+		}
+		if a.Pod != b.Pod {
+			return a.Pod < b.Pod
+		}
+		return a.Container < b.Container
+	})
+
+	return sizings
+}
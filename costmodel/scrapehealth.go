@@ -0,0 +1,105 @@
+package costmodel
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	prometheusClient "github.com/prometheus/client_golang/api"
+)
+
+const (
+	scrapeHealthJobsEnvVar  = "SCRAPE_HEALTH_JOBS"
+	defaultScrapeHealthJobs = "kube-state-metrics,node-exporter"
+)
+
+// ScrapeHealthJobs returns the scrape jobs the model depends on, read as a comma separated list from
+// SCRAPE_HEALTH_JOBS and defaulting to kube-state-metrics and node-exporter. A job is matched by any job whose
+// name contains it, e.g. "prometheus-node-exporter".
+func ScrapeHealthJobs() []string {
+	jobsStr := os.Getenv(scrapeHealthJobsEnvVar)
+	if jobsStr == "" {
+		jobsStr = defaultScrapeHealthJobs
+	}
+	var jobs []string
+	for _, job := range strings.Split(jobsStr, ",") {
+		if job = strings.TrimSpace(job); job != "" {
+			jobs = append(jobs, job)
+		}
+	}
+	return jobs
+}
+
+// JobScrapeHealth is the health of the targets of a scrape job the model depends on. A job without targets is
+// missing, as when its exporter isn't deployed or isn't discovered, and leaves the costs depending on it at zero.
+type JobScrapeHealth struct {
+	Job     string   `json:"job"`
+	Targets int      `json:"targets"`
+	Down    []string `json:"down"` // instances of the targets which are down
+	Missing bool     `json:"missing"`
+	Healthy bool     `json:"healthy"`
+}
+
+// ScrapeHealth is the health of each of the scrape jobs the model depends on
+type ScrapeHealth struct {
+	Healthy bool               `json:"healthy"`
+	Jobs    []*JobScrapeHealth `json:"jobs"`
+}
+
+// ComputeScrapeHealth queries the up series of the targets of the given scrape jobs, reporting those which are down
+// and the jobs which have no targets at all.
+func ComputeScrapeHealth(cli prometheusClient.Client, jobs []string) (*ScrapeHealth, error) {
+	patterns := make([]string, 0, len(jobs))
+	for _, job := range jobs {
+		patterns = append(patterns, ".*"+regexp.QuoteMeta(job)+".*")
+	}
+	query := fmt.Sprintf("up{job=~%s}", strconv.Quote(strings.Join(patterns, "|")))
+	qr, err := Query(cli, query)
+	if err != nil {
+		return nil, err
+	}
+	if err := prometheusResultError(qr); err != nil {
+		return nil, err
+	}
+	result, ok := qr.(map[string]interface{})["data"].(map[string]interface{})["result"].([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Improperly formatted results from prometheus, result field is not a slice")
+	}
+
+	health := &ScrapeHealth{Healthy: true}
+	for _, job := range jobs {
+		h := &JobScrapeHealth{Job: job, Down: []string{}}
+		for _, val := range result {
+			metric, ok := val.(map[string]interface{})["metric"].(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("Prometheus vector does not have metric labels")
+			}
+			name, _ := metric["job"].(string)
+			if !strings.Contains(name, job) {
+				continue
+			}
+			dataPoint, ok := val.(map[string]interface{})["value"].([]interface{})
+			if !ok || len(dataPoint) != 2 {
+				return nil, fmt.Errorf("Improperly formatted datapoint from Prometheus")
+			}
+			up, err := strconv.ParseFloat(fmt.Sprintf("%v", dataPoint[1]), 64)
+			if err != nil {
+				return nil, err
+			}
+			h.Targets++
+			if up != 1 {
+				instance, _ := metric["instance"].(string)
+				h.Down = append(h.Down, instance)
+			}
+		}
+		sort.Strings(h.Down)
+		h.Missing = h.Targets == 0
+		h.Healthy = !h.Missing && len(h.Down) == 0
+		health.Healthy = health.Healthy && h.Healthy
+		health.Jobs = append(health.Jobs, h)
+	}
+	return health, nil
+}
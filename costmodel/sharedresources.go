@@ -0,0 +1,76 @@
+package costmodel
+
+import (
+	"sort"
+
+	"github.com/kubecost/cost-model/cloud"
+)
+
+// SharedPod is a pod classified as a shared resource, with the cost of its containers
+type SharedPod struct {
+	Namespace string  `json:"namespace"`
+	Pod       string  `json:"pod"`
+	TotalCost float64 `json:"totalCost"`
+}
+
+// SharedResources lists the namespaces and pods classified as shared resources by a SharedResourceInfo,
+// along with their total cost, which AggregateCostModel would share across the other aggregations
+type SharedResources struct {
+	Namespaces []string     `json:"namespaces"`
+	Pods       []*SharedPod `json:"pods"`
+	TotalCost  float64      `json:"totalCost"`
+}
+
+// ComputeSharedResources runs IsSharedResource over the given cost data, collecting the matched
+// namespaces and pods, priced as AggregateCostModel prices them before idle allocation
+func ComputeSharedResources(cp cloud.Provider, costData map[string]*CostData, discount float64, sr *SharedResourceInfo) *SharedResources {
+	shared := &SharedResources{
+		Namespaces: []string{},
+		Pods:       []*SharedPod{},
+	}
+
+	pricing := newPricingConfig(cp)
+	namespaces := make(map[string]bool)
+	pods := make(map[string]*SharedPod)
+	for _, costDatum := range costData {
+		if !sr.IsSharedResource(costDatum) {
+			continue
+		}
+
+		cpuv, ramv, gpuv, pvvs, adjustment := getPriceVectors(pricing, costDatum, discount, 1.0, true, defaultTimestampBucket)
+		cost := adjustment.markupCost
+		cost += totalVector(cpuv)
+		cost += totalVector(ramv)
+		cost += totalVector(gpuv)
+		for _, pv := range pvvs {
+			cost += totalVector(pv)
+		}
+
+		namespaces[costDatum.Namespace] = true
+		key := costDatum.Namespace + "/" + costDatum.PodName
+		pod, ok := pods[key]
+		if !ok {
+			pod = &SharedPod{
+				Namespace: costDatum.Namespace,
+				Pod:       costDatum.PodName,
+			}
+			pods[key] = pod
+			shared.Pods = append(shared.Pods, pod)
+		}
+		pod.TotalCost += cost
+		shared.TotalCost += cost
+	}
+
+	for namespace := range namespaces {
+		shared.Namespaces = append(shared.Namespaces, namespace)
+	}
+	sort.Strings(shared.Namespaces)
+	sort.Slice(shared.Pods, func(i, j int) bool {
+		if shared.Pods[i].Namespace != shared.Pods[j].Namespace {
+			return shared.Pods[i].Namespace < shared.Pods[j].Namespace
+		}
+		return shared.Pods[i].Pod < shared.Pods[j].Pod
+	})
+
+	return shared
+}
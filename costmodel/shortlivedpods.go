@@ -0,0 +1,117 @@
+package costmodel
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// containerRunTime returns when the given container of the pod started and, if it has terminated, finished
+// running, by its status, or else by the run time of the pod
+func containerRunTime(pod *v1.Pod, container string) (time.Time, time.Time) {
+	for _, status := range pod.Status.ContainerStatuses {
+		if status.Name != container {
+			continue
+		}
+		if t := status.State.Terminated; t != nil {
+			return t.StartedAt.Time, t.FinishedAt.Time
+		}
+		if r := status.State.Running; r != nil {
+			return r.StartedAt.Time, time.Time{}
+		}
+	}
+	return podRunTime(pod)
+}
+
+// ranWithin reports whether a container of the given pod is known, by its status, to have run in any of the
+// given intervals
+func ranWithin(pod *v1.Pod, intervals []costInterval) bool {
+	for _, container := range pod.Spec.Containers {
+		start, end := containerRunTime(pod, container.Name)
+		if start.IsZero() {
+			continue
+		}
+		for _, interval := range intervals {
+			if interval.runFraction(start, end) > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// correctPartialIntervals allocates the containers of the given pods, in the intervals they started or finished
+// running in, their requests for the fraction of each interval they actually ran, by their statuses. Prometheus
+// weights the requests and usage of a container in an interval by the number of samples of it, which for
+// containers running for less than a sample or two, e.g. those of CronJobs, either misses them or overstates
+// their run time. The usage in each corrected interval is scaled along with the requests, and containers missed
+// altogether are allocated their requests. Intervals the containers ran throughout are left as they are.
+func correctPartialIntervals(costData map[string]*CostData, pods []*v1.Pod, clusterID string, intervals []costInterval) {
+	for _, pod := range pods {
+		for _, container := range pod.Spec.Containers {
+			start, end := containerRunTime(pod, container.Name)
+			if start.IsZero() {
+				continue
+			}
+			key := newContainerMetricFromValues(clusterID, pod.GetObjectMeta().GetNamespace(), pod.GetObjectMeta().GetName(), container.Name, pod.Spec.NodeName).Key()
+			costs, ok := costData[key]
+			if !ok {
+				continue
+			}
+
+			cpu := container.Resources.Requests[v1.ResourceCPU]
+			ram := container.Resources.Requests[v1.ResourceMemory]
+			corrected := false
+			for _, interval := range intervals {
+				fraction := interval.runFraction(start, end)
+				if fraction <= 0 || fraction >= 1 {
+					continue
+				}
+				costs.CPUReq, costs.CPUUsed = withRunFraction(costs.CPUReq, costs.CPUUsed, interval.timestamp, float64(cpu.MilliValue())/1000*fraction)
+				costs.RAMReq, costs.RAMUsed = withRunFraction(costs.RAMReq, costs.RAMUsed, interval.timestamp, float64(ram.Value())*fraction)
+				corrected = true
+			}
+			if corrected {
+				costs.CPUAllocation = getContainerAllocation(costs.CPUReq, costs.CPUUsed)
+				costs.RAMAllocation = getContainerAllocation(costs.RAMReq, costs.RAMUsed)
+			}
+		}
+	}
+}
+
+// withRunFraction returns the given requests and usage with the request at timestamp set to the given one, and
+// the usage at timestamp scaled by as much as the request was. Without a request at timestamp, the given one is
+// added, and with a zero request, e.g. as the container requests none, the vectors are left as they are.
+func withRunFraction(req []*Vector, used []*Vector, timestamp float64, request float64) ([]*Vector, []*Vector) {
+	if request <= 0 {
+		return req, used
+	}
+	for _, v := range req {
+		if math.Round(v.Timestamp/10)*10 != timestamp {
+			continue
+		}
+		if v.Value > 0 {
+			scale := request / v.Value
+			for _, u := range used {
+				if math.Round(u.Timestamp/10)*10 == timestamp {
+					u.Value *= scale
+				}
+			}
+		}
+		v.Value = request
+		return req, used
+	}
+
+	// a zero vector stands in for missing data
+	var vectors []*Vector
+	for _, v := range req {
+		if v.Timestamp != 0 {
+			vectors = append(vectors, v)
+		}
+	}
+	vectors = append(vectors, &Vector{Timestamp: timestamp, Value: request})
+	sort.Slice(vectors, func(i, j int) bool { return vectors[i].Timestamp < vectors[j].Timestamp })
+	return vectors, used
+}
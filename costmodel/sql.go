@@ -3,6 +3,7 @@ package costmodel
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"time"
@@ -16,13 +17,13 @@ import (
 const remotePW = "REMOTE_WRITE_PASSWORD"
 const sqlAddress = "SQL_ADDRESS"
 
-func getPVCosts(db *sql.DB) (map[string]*costAnalyzerCloud.PV, error) {
+func getPVCosts(db *sql.DB, source string) (map[string]*costAnalyzerCloud.PV, error) {
 	pvs := make(map[string]*costAnalyzerCloud.PV)
 	query := `SELECT name, avg(value),labels->>'volumename' AS volumename, labels->>'cluster_id' AS clusterid
-	FROM metrics
+	FROM %s
 	WHERE (name='pv_hourly_cost')  AND value != 'NaN' AND value != 0
 	GROUP BY volumename,name,clusterid;`
-	rows, err := db.Query(query)
+	rows, err := db.Query(fmt.Sprintf(query, source))
 	if err != nil {
 		return nil, err
 	}
@@ -44,15 +45,15 @@ func getPVCosts(db *sql.DB) (map[string]*costAnalyzerCloud.PV, error) {
 	return pvs, nil
 }
 
-func getNodeCosts(db *sql.DB) (map[string]*costAnalyzerCloud.Node, error) {
+func getNodeCosts(db *sql.DB, source string) (map[string]*costAnalyzerCloud.Node, error) {
 
 	nodes := make(map[string]*costAnalyzerCloud.Node)
 
 	query := `SELECT name, avg(value),labels->>'instance' AS instance, labels->>'cluster_id' AS clusterid
-	FROM metrics
+	FROM %s
 	WHERE (name='node_cpu_hourly_cost' OR name='node_ram_hourly_cost' OR name='node_gpu_hourly_cost')  AND value != 'NaN' AND value != 0
 	GROUP BY instance,name,clusterid`
-	rows, err := db.Query(query)
+	rows, err := db.Query(fmt.Sprintf(query, source))
 	if err != nil {
 		return nil, err
 	}
@@ -92,28 +93,77 @@ func getNodeCosts(db *sql.DB) (map[string]*costAnalyzerCloud.Node, error) {
 	return nodes, nil
 }
 
-func CostDataRangeFromSQL(field string, value string, window string, start string, end string) (map[string]*CostData, error) {
+// openRemoteDB opens the database to which clusters remote write their metrics
+func openRemoteDB() (*sql.DB, error) {
 	pw := os.Getenv(remotePW)
 	address := os.Getenv(sqlAddress)
 	connStr := fmt.Sprintf("postgres://postgres:%s@%s:5432?sslmode=disable", pw, address)
-	db, err := sql.Open("postgres", connStr)
+	return sql.Open("postgres", connStr)
+}
+
+// sqlDailyMetrics formats a source of metrics in the shape of the metrics view with each series averaged over each
+// day: their daily rollups, followed by the metrics not yet rolled up, restricted by the given condition
+const sqlDailyMetrics = `(SELECT time, name, value, labels FROM metrics_daily
+	UNION ALL
+	SELECT time_bucket('1 day', time) AS time, name, avg(value) AS value, labels
+	FROM metrics
+	WHERE time >= (` + sqlRollupWatermark + `) AND value != 'NaN'%s
+	GROUP BY 1, name, labels) AS metrics`
+
+// isDailyWindow returns whether the given window is a whole number of days, by which daily averages can be bucketed
+func isDailyWindow(window string) bool {
+	normalized, err := normalizeTimeParam(window)
+	if err != nil {
+		return false
+	}
+	d, err := time.ParseDuration(normalized)
+	if err != nil {
+		return false
+	}
+	return d >= 24*time.Hour && d%(24*time.Hour) == 0
+}
+
+// remoteMetricsSources returns the sources from which to read the allocations bucketed by the given window from
+// $2 until $3, and the prices averaged over all time. Windows of whole days read the daily averages, which outlive
+// the metrics deleted by SQLRetention, once metrics have been rolled up; other windows read the metrics view.
+func remoteMetricsSources(db *sql.DB, window string) (string, string, error) {
+	if !isDailyWindow(window) {
+		return "metrics", "metrics", nil
+	}
+	var rolledUp bool
+	if err := db.QueryRow(`SELECT to_regclass('metrics_daily') IS NOT NULL`).Scan(&rolledUp); err != nil {
+		return "", "", err
+	}
+	if !rolledUp {
+		return "metrics", "metrics", nil
+	}
+	allocations := fmt.Sprintf(sqlDailyMetrics, " AND time >= time_bucket('1 day', $2::timestamptz) AND time < $3")
+	return allocations, fmt.Sprintf(sqlDailyMetrics, ""), nil
+}
+
+func CostDataRangeFromSQL(field string, value string, window string, start string, end string) (map[string]*CostData, error) {
+	db, err := openRemoteDB()
+	if err != nil {
+		return nil, err
+	}
 	defer db.Close()
+	source, priceSource, err := remoteMetricsSources(db, window)
 	if err != nil {
 		return nil, err
 	}
-	nodes, err := getNodeCosts(db)
+	nodes, err := getNodeCosts(db, priceSource)
 	if err != nil {
 		return nil, err
 	}
 	model := make(map[string]*CostData)
 	query := `SELECT time_bucket($1, time) AS bucket, name, avg(value),labels->>'container' AS container,labels->>'pod' AS pod,labels->>'namespace' AS namespace, labels->>'instance' AS instance, labels->>'cluster_id' AS clusterid
-	FROM metrics
+	FROM %s
 	WHERE (name='container_cpu_allocation') AND
-	  time > $2 AND time < $3 AND value != 'NaN'
+	  time >= $2 AND time < $3 AND value != 'NaN'
 	GROUP BY container,pod,bucket,namespace,instance,clusterid,name
 	ORDER BY container,bucket;
 	`
-	rows, err := db.Query(query, window, start, end)
+	rows, err := db.Query(fmt.Sprintf(query, source), window, start, end)
 	if err != nil {
 		return nil, err
 	}
@@ -139,7 +189,7 @@ func CostDataRangeFromSQL(field string, value string, window string, start strin
 			return nil, err
 		}
 
-		k := newContainerMetricFromValues(namespace, pod, container, instance)
+		k := newContainerMetricFromValues(clusterid, namespace, pod, container, instance)
 		key := k.Key()
 		allocationVector := &Vector{
 			Timestamp: float64(t.Unix()),
@@ -180,13 +230,13 @@ func CostDataRangeFromSQL(field string, value string, window string, start strin
 		}
 	}
 	query = `SELECT time_bucket($1, time) AS bucket, name, avg(value),labels->>'container' AS container,labels->>'pod' AS pod,labels->>'namespace' AS namespace, labels->>'instance' AS instance, labels->>'cluster_id' AS clusterid
-	FROM metrics
+	FROM %s
 	WHERE (name='container_memory_allocation_bytes') AND
-		time > $2 AND time < $3 AND value != 'NaN'
+		time >= $2 AND time < $3 AND value != 'NaN'
 	GROUP BY container,pod,bucket,namespace,instance,clusterid,name
 	ORDER BY container,bucket;
 	`
-	rows, err = db.Query(query, window, start, end)
+	rows, err = db.Query(fmt.Sprintf(query, source), window, start, end)
 	if err != nil {
 		return nil, err
 	}
@@ -210,7 +260,7 @@ func CostDataRangeFromSQL(field string, value string, window string, start strin
 			return nil, err
 		}
 
-		k := newContainerMetricFromValues(namespace, pod, container, instance)
+		k := newContainerMetricFromValues(clusterid, namespace, pod, container, instance)
 		key := k.Key()
 		allocationVector := &Vector{
 			Timestamp: float64(t.Unix()),
@@ -301,18 +351,18 @@ func CostDataRangeFromSQL(field string, value string, window string, start strin
 		}
 	}
 
-	volumes, err := getPVCosts(db)
+	volumes, err := getPVCosts(db, priceSource)
 	if err != nil {
 		klog.Infof("Error fetching pv data from sql: %s. Skipping PVData", err.Error())
 	} else {
 		query = `SELECT time_bucket($1, time) AS bucket, name, avg(value), labels->>'persistentvolumeclaim' AS claim, labels->>'pod' AS pod,labels->>'namespace' AS namespace, labels->>'persistentvolume' AS volumename, labels->>'cluster_id' AS clusterid
-		FROM metrics
+		FROM %s
 		WHERE (name='pod_pvc_allocation') AND
-			time > $2 AND time < $3 AND value != 'NaN'
+			time >= $2 AND time < $3 AND value != 'NaN'
 		GROUP BY claim,pod,bucket,namespace,volumename,clusterid,name
 		ORDER BY pod,bucket;`
 
-		rows, err = db.Query(query, window, start, end)
+		rows, err = db.Query(fmt.Sprintf(query, source), window, start, end)
 		if err != nil {
 			return nil, err
 		}
@@ -374,3 +424,110 @@ func CostDataRangeFromSQL(field string, value string, window string, start strin
 
 	return model, nil
 }
+
+// ErrSQLAggregationUnsupported is returned by CostDataAggregateFromSQL for aggregation fields which cannot be
+// grouped by in the database
+var ErrSQLAggregationUnsupported = errors.New("Aggregation is not supported by the remote database")
+
+// sqlAggregationColumns are the metric labels by which CostDataAggregateFromSQL groups each aggregation field
+var sqlAggregationColumns = map[string]string{
+	"namespace": "namespace",
+	"cluster":   "cluster_id",
+}
+
+// queryAggregateCosts sums the cost of every container and volume allocation in each time bucket, priced at the
+// average recorded hourly price of its node or volume for the hours of the bucket, grouped by the label given as
+// the first format argument. The prices and allocations are read from the sources given as the second and third.
+// RAM is priced per the number of bytes in a GB given as the fourth query argument.
+const queryAggregateCosts = `WITH prices AS (
+		SELECT name, avg(value) AS price, (CASE WHEN name='pv_hourly_cost' THEN labels->>'volumename' ELSE labels->>'instance' END) AS resource, labels->>'cluster_id' AS clusterid
+		FROM %[2]s
+		WHERE (name='node_cpu_hourly_cost' OR name='node_ram_hourly_cost' OR name='node_gpu_hourly_cost' OR name='pv_hourly_cost') AND value != 'NaN' AND value != 0
+		GROUP BY resource,name,clusterid
+	), allocations AS (
+		SELECT time_bucket($1, time) AS bucket, name, avg(value) AS value, (CASE WHEN name='pod_pvc_allocation' THEN labels->>'persistentvolume' ELSE labels->>'instance' END) AS resource, labels->>'cluster_id' AS clusterid, labels->>'%[1]s' AS aggregate,
+			labels->>'namespace' AS namespace, labels->>'pod' AS pod, labels->>'container' AS container, labels->>'persistentvolumeclaim' AS claim
+		FROM %[3]s
+		WHERE (name='container_cpu_allocation' OR name='container_memory_allocation_bytes' OR name='container_gpu_allocation' OR name='pod_pvc_allocation') AND
+			time >= $2 AND time < $3 AND value != 'NaN'
+		GROUP BY bucket,name,resource,clusterid,aggregate,namespace,pod,container,claim
+	)
+	SELECT allocations.aggregate,
+		sum(CASE WHEN allocations.name='container_cpu_allocation' THEN allocations.value * prices.price ELSE 0 END) * EXTRACT(EPOCH FROM $1::interval) / 3600 AS cpucost,
+		sum(CASE WHEN allocations.name='container_memory_allocation_bytes' THEN allocations.value / $4 * prices.price ELSE 0 END) * EXTRACT(EPOCH FROM $1::interval) / 3600 AS ramcost,
+		sum(CASE WHEN allocations.name='container_gpu_allocation' THEN allocations.value * prices.price ELSE 0 END) * EXTRACT(EPOCH FROM $1::interval) / 3600 AS gpucost,
+		sum(CASE WHEN allocations.name='pod_pvc_allocation' THEN allocations.value / 1024 / 1024 / 1024 * prices.price ELSE 0 END) * EXTRACT(EPOCH FROM $1::interval) / 3600 AS pvcost
+	FROM allocations JOIN prices ON allocations.resource = prices.resource AND allocations.clusterid = prices.clusterid AND prices.name = (CASE allocations.name
+		WHEN 'container_cpu_allocation' THEN 'node_cpu_hourly_cost'
+		WHEN 'container_memory_allocation_bytes' THEN 'node_ram_hourly_cost'
+		WHEN 'container_gpu_allocation' THEN 'node_gpu_hourly_cost'
+		ELSE 'pv_hourly_cost' END)
+	WHERE allocations.aggregate IS NOT NULL
+	GROUP BY allocations.aggregate;`
+
+// CostDataAggregateFromSQL computes the undiscounted cost of each value of the given aggregation field, across
+// all clusters writing to the remote database, without fetching the underlying cost data, with RAM priced per
+// the given number of bytes in a GB. Fields which cannot be grouped by in the database return
+// ErrSQLAggregationUnsupported.
+func CostDataAggregateFromSQL(field string, subfield string, window string, start string, end string, ramBytesPerGB float64) (map[string]*Aggregation, error) {
+	if _, ok := sqlAggregationColumns[field]; !ok {
+		return nil, ErrSQLAggregationUnsupported
+	}
+
+	db, err := openRemoteDB()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	return CostDataAggregateFromDB(db, field, subfield, window, start, end, ramBytesPerGB)
+}
+
+// CostDataAggregateFromDB is CostDataAggregateFromSQL against the given database
+func CostDataAggregateFromDB(db *sql.DB, field string, subfield string, window string, start string, end string, ramBytesPerGB float64) (map[string]*Aggregation, error) {
+	column, ok := sqlAggregationColumns[field]
+	if !ok {
+		return nil, ErrSQLAggregationUnsupported
+	}
+
+	source, priceSource, err := remoteMetricsSources(db, window)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.Query(fmt.Sprintf(queryAggregateCosts, column, priceSource, source), window, start, end, ramBytesPerGB)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	aggregations := make(map[string]*Aggregation)
+	for rows.Next() {
+		var (
+			key     string
+			cpuCost float64
+			ramCost float64
+			gpuCost float64
+			pvCost  float64
+		)
+		if err := rows.Scan(&key, &cpuCost, &ramCost, &gpuCost, &pvCost); err != nil {
+			return nil, err
+		}
+		agg := &Aggregation{
+			Aggregator:         field,
+			AggregatorSubField: subfield,
+			Environment:        key,
+			CPUCost:            cpuCost,
+			RAMCost:            ramCost,
+			GPUCost:            gpuCost,
+			PVCost:             pvCost,
+			TotalCost:          cpuCost + ramCost + gpuCost + pvCost,
+		}
+		if field == "cluster" {
+			agg.Cluster = key
+		}
+		aggregations[key] = agg
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return aggregations, nil
+}
@@ -0,0 +1,175 @@
+package costmodel
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"k8s.io/klog"
+)
+
+const (
+	sqlRollupAfterDaysEnvVar    = "SQL_ROLLUP_AFTER_DAYS"
+	sqlRetentionDaysEnvVar      = "SQL_RETENTION_DAYS"
+	sqlRetentionIntervalEnvVar  = "SQL_RETENTION_INTERVAL"
+	defaultSQLRollupAfterDays   = 7
+	defaultSQLRetentionInterval = time.Hour
+	// sqlRetentionLock is the key of the advisory lock held while the retention job runs, so that only one
+	// replica rolls up and deletes metrics at a time
+	sqlRetentionLock = 8271721
+)
+
+// sqlRollupMetrics are the metrics read by CostDataRangeFromSQL and CostDataAggregateFromSQL, which are rolled up
+// into daily averages before they are deleted
+const sqlRollupMetrics = `'container_cpu_allocation','container_memory_allocation_bytes','container_gpu_allocation','pod_pvc_allocation',
+	'node_cpu_hourly_cost','node_ram_hourly_cost','node_gpu_hourly_cost','pv_hourly_cost'`
+
+// createMetricsDaily creates the table of the average value of each series over each day, in the shape of the
+// metrics view. Series are identified by all of their labels, so the daily averages can be grouped by cluster,
+// namespace, pod or container as the raw metrics are.
+const createMetricsDaily = `CREATE TABLE IF NOT EXISTS metrics_daily (
+		time timestamptz NOT NULL,
+		name text NOT NULL,
+		labels jsonb NOT NULL,
+		value double precision NOT NULL,
+		PRIMARY KEY (name, labels, time)
+	);
+	CREATE INDEX IF NOT EXISTS metrics_daily_time_idx ON metrics_daily (time);`
+
+// sqlRollupWatermark is the start of the first day not yet rolled up
+const sqlRollupWatermark = `SELECT coalesce(max(time) + interval '1 day', '-infinity') FROM metrics_daily`
+
+// rollupMetrics averages each series over each whole day, from the first day not yet rolled up until $1
+const rollupMetrics = `INSERT INTO metrics_daily (time, name, labels, value)
+	SELECT time_bucket('1 day', time) AS day, name, labels, avg(value)
+	FROM metrics
+	WHERE name IN (` + sqlRollupMetrics + `) AND value != 'NaN' AND
+		time >= (` + sqlRollupWatermark + `) AND time < $1
+	GROUP BY day, name, labels
+	ON CONFLICT DO NOTHING`
+
+// deleteMetrics deletes the samples older than $1 from the tables underlying the metrics view, but for the
+// latest labels of each namespace, which CostDataRangeFromSQL reads regardless of their age
+const deleteMetrics = `DELETE FROM metrics_values v
+	USING metrics_labels l
+	WHERE v.labels_id = l.id AND v.time < $1 AND
+		(l.metric_name != 'kube_namespace_labels' OR v.time < (SELECT max(time) FROM metrics_values WHERE labels_id = v.labels_id))`
+
+// SQLRetention rolls the metrics remote written to the SQL database up into the daily average of each series
+// once they are RollupAfterDays old, and deletes them once they are RetentionDays old, every Interval. Cost data
+// read by the day or coarser windows is read from the daily averages, so it outlives the raw metrics. Replicas
+// may each run it; only one at a time does the work.
+type SQLRetention struct {
+	RollupAfterDays int
+	RetentionDays   int
+	Interval        time.Duration
+}
+
+// NewSQLRetention returns a retention job rolling up metrics after rollupAfterDays and deleting them after
+// retentionDays, which must be later so that metrics are rolled up before they are deleted
+func NewSQLRetention(rollupAfterDays, retentionDays int, interval time.Duration) (*SQLRetention, error) {
+	if rollupAfterDays < 1 {
+		return nil, fmt.Errorf("Invalid rollup age of %d days; must be at least a day", rollupAfterDays)
+	}
+	if retentionDays <= rollupAfterDays {
+		return nil, fmt.Errorf("Invalid retention of %d days; must be longer than the rollup age of %d days", retentionDays, rollupAfterDays)
+	}
+	if interval <= 0 {
+		return nil, fmt.Errorf("Invalid retention interval %s; must be positive", interval)
+	}
+	return &SQLRetention{
+		RollupAfterDays: rollupAfterDays,
+		RetentionDays:   retentionDays,
+		Interval:        interval,
+	}, nil
+}
+
+// Apply rolls up the whole days of metrics older than RollupAfterDays before now which haven't been yet, then
+// deletes the metrics older than RetentionDays, in one transaction. It returns false without doing either if
+// another replica holds the retention lock.
+func (r *SQLRetention) Apply(db *sql.DB, now time.Time) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var locked bool
+	if err := tx.QueryRow(`SELECT pg_try_advisory_xact_lock($1)`, sqlRetentionLock).Scan(&locked); err != nil {
+		return false, err
+	}
+	if !locked {
+		return false, nil
+	}
+	if _, err := tx.Exec(createMetricsDaily); err != nil {
+		return false, err
+	}
+	day := 24 * time.Hour
+	rollupBefore := now.UTC().AddDate(0, 0, -r.RollupAfterDays).Truncate(day)
+	if _, err := tx.Exec(rollupMetrics, rollupBefore); err != nil {
+		return false, fmt.Errorf("Unable to roll up metrics: %s", err.Error())
+	}
+	deleteBefore := now.UTC().AddDate(0, 0, -r.RetentionDays).Truncate(day)
+	if _, err := tx.Exec(deleteMetrics, deleteBefore); err != nil {
+		return false, fmt.Errorf("Unable to delete metrics: %s", err.Error())
+	}
+	return true, tx.Commit()
+}
+
+// Run applies the retention to the remote database every Interval until ctx is done, returning a channel
+// closed once it stops
+func (r *SQLRetention) Run(ctx context.Context) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(r.Interval):
+			}
+
+			db, err := openRemoteDB()
+			if err != nil {
+				klog.V(1).Infof("Unable to open remote database for retention: %s", err.Error())
+				continue
+			}
+			applied, err := r.Apply(db, time.Now())
+			db.Close()
+			if err != nil {
+				klog.V(1).Infof("Failed to apply retention to remote database: %s", err.Error())
+			} else if applied {
+				klog.V(2).Infof("Applied retention to remote database")
+			}
+		}
+	}()
+	return done
+}
+
+// sqlRetentionFromEnv returns the retention job configured by SQL_RETENTION_DAYS, SQL_ROLLUP_AFTER_DAYS and
+// SQL_RETENTION_INTERVAL, or nil if SQL_RETENTION_DAYS isn't set, so that metrics are only deleted if asked to
+func sqlRetentionFromEnv() (*SQLRetention, error) {
+	retention := os.Getenv(sqlRetentionDaysEnvVar)
+	if retention == "" {
+		return nil, nil
+	}
+	retentionDays, err := strconv.Atoi(retention)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid %s '%s'; must be a number of days", sqlRetentionDaysEnvVar, retention)
+	}
+	rollupAfterDays := defaultSQLRollupAfterDays
+	if rollup := os.Getenv(sqlRollupAfterDaysEnvVar); rollup != "" {
+		rollupAfterDays, err = strconv.Atoi(rollup)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %s '%s'; must be a number of days", sqlRollupAfterDaysEnvVar, rollup)
+		}
+	}
+	interval, err := durationFromEnv(sqlRetentionIntervalEnvVar, defaultSQLRetentionInterval)
+	if err != nil {
+		return nil, err
+	}
+	return NewSQLRetention(rollupAfterDays, retentionDays, interval)
+}
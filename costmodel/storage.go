@@ -0,0 +1,44 @@
+package costmodel
+
+import (
+	"os"
+	"time"
+)
+
+const costDataStoreDSNEnvVar = "COST_DATA_POSTGRES_DSN"
+
+// CostDataStore is durable storage of the cost data of one or more clusters, from which the cost data of
+// windows longer than Prometheus retains can be read back
+type CostDataStore interface {
+	// WriteCostData stores the allocations and prices of the given cost data, as recorded at the given time
+	WriteCostData(costData map[string]*CostData, t time.Time) error
+	// ReadCostDataRange reads the cost data recorded from start until end, averaging allocations over each window
+	ReadCostDataRange(start, end time.Time, window time.Duration) (map[string]*CostData, error)
+	// GetOrCreateClusterMeta returns the ID and name of the given cluster, storing it under the given name if it
+	// isn't known yet
+	GetOrCreateClusterMeta(clusterID, clusterName string) (string, string, error)
+	Close() error
+}
+
+// costDataStoreFromEnv returns the Postgres store at COST_DATA_POSTGRES_DSN, creating or migrating its schema,
+// or nil if COST_DATA_POSTGRES_DSN isn't set
+func costDataStoreFromEnv() (CostDataStore, error) {
+	dsn := os.Getenv(costDataStoreDSNEnvVar)
+	if dsn == "" {
+		return nil, nil
+	}
+	return NewPostgresStore(dsn)
+}
+
+// lastVectorValue returns the value of the latest of the given vectors, or 0 if there are none
+func lastVectorValue(vectors []*Vector) float64 {
+	value := 0.0
+	latest := 0.0
+	for _, v := range vectors {
+		if v != nil && v.Timestamp >= latest {
+			latest = v.Timestamp
+			value = v.Value
+		}
+	}
+	return value
+}
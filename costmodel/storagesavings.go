@@ -0,0 +1,147 @@
+package costmodel
+
+import (
+	"sort"
+	"strconv"
+
+	costAnalyzerCloud "github.com/kubecost/cost-model/cloud"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog"
+)
+
+// UnusedVolume is a persistent volume which no pod used over the window of a StorageSavings, with its monthly cost
+type UnusedVolume struct {
+	*UnmountedPV
+	MonthlyCost float64 `json:"monthlyCost"`
+}
+
+// OrphanedDisk is a disk of the cloud account which is attached to no instance and backs no persistent volume of
+// the cluster, priced as a volume of its type
+type OrphanedDisk struct {
+	*costAnalyzerCloud.Disk
+	GBHourlyCost    float64 `json:"gbHourlyCost"`
+	TotalHourlyCost float64 `json:"totalHourlyCost"`
+	MonthlyCost     float64 `json:"monthlyCost"`
+}
+
+// StorageSavings is the storage which is paid for but wasn't used over a window, and its monthly cost, at list
+// price. OrphanedDisks is omitted when the provider can't list the disks of the account.
+type StorageSavings struct {
+	// ReleasedVolumes are the volumes whose claim was deleted, kept by a Retain reclaim policy
+	ReleasedVolumes []*UnusedVolume `json:"releasedVolumes"`
+	// AvailableVolumes are the volumes which were never bound to a claim
+	AvailableVolumes []*UnusedVolume `json:"availableVolumes"`
+	// UnusedClaims are the volumes bound to a claim which no pod mounted over the window
+	UnusedClaims  []*UnusedVolume `json:"unusedClaims"`
+	OrphanedDisks []*OrphanedDisk `json:"orphanedDisks,omitempty"`
+	MonthlyCost   float64         `json:"monthlyCost"`
+}
+
+// ComputeStorageSavings lists the persistent volumes in the cluster cache which are released, available, or bound
+// to a claim no pod in the given cost data mounted, and, where the provider is a cloud.OrphanedDiskLister, the disks
+// of the account backing none of them, each priced by the given provider and sorted by decreasing cost
+func (cm *CostModel) ComputeStorageSavings(cp costAnalyzerCloud.Provider, costData map[string]*CostData) *StorageSavings {
+	mounted := make(map[string]bool)
+	for _, costDatum := range costData {
+		for _, pvc := range costDatum.PVCData {
+			mounted[pvc.VolumeName] = true
+		}
+	}
+
+	savings := &StorageSavings{
+		ReleasedVolumes:  []*UnusedVolume{},
+		AvailableVolumes: []*UnusedVolume{},
+		UnusedClaims:     []*UnusedVolume{},
+	}
+	backing := make(map[string]bool)
+	storageClassMap := getStorageClassParameters(cm.Cache)
+	for _, pv := range cm.Cache.GetAllPersistentVolumes() {
+		if id := costAnalyzerCloud.DiskID(pv); id != "" {
+			backing[id] = true
+		}
+
+		var unused *[]*UnusedVolume
+		switch pv.Status.Phase {
+		case v1.VolumeReleased:
+			unused = &savings.ReleasedVolumes
+		case v1.VolumeAvailable:
+			unused = &savings.AvailableVolumes
+		case v1.VolumeBound:
+			if mounted[pv.Name] {
+				continue
+			}
+			unused = &savings.UnusedClaims
+		default:
+			continue
+		}
+
+		upv := &UnmountedPV{
+			PVAsset: priceVolume(storageClassMap, cp, pv),
+		}
+		if pv.Spec.ClaimRef != nil {
+			upv.Namespace = pv.Spec.ClaimRef.Namespace
+			upv.Claim = pv.Spec.ClaimRef.Name
+		}
+		*unused = append(*unused, &UnusedVolume{UnmountedPV: upv, MonthlyCost: upv.TotalHourlyCost * 730})
+		savings.MonthlyCost += upv.TotalHourlyCost * 730
+	}
+
+	if lister, ok := cp.(costAnalyzerCloud.OrphanedDiskLister); ok {
+		disks, err := lister.ListOrphanedDisks(backing)
+		if err != nil {
+			klog.V(1).Infof("Error listing orphaned disks: %s", err.Error())
+		} else {
+			savings.OrphanedDisks = []*OrphanedDisk{}
+			for _, disk := range disks {
+				orphaned := priceDisk(cp, disk)
+				savings.OrphanedDisks = append(savings.OrphanedDisks, orphaned)
+				savings.MonthlyCost += orphaned.MonthlyCost
+			}
+			sort.SliceStable(savings.OrphanedDisks, func(i, j int) bool {
+				return savings.OrphanedDisks[i].MonthlyCost > savings.OrphanedDisks[j].MonthlyCost
+			})
+		}
+	}
+
+	for _, unused := range [][]*UnusedVolume{savings.ReleasedVolumes, savings.AvailableVolumes, savings.UnusedClaims} {
+		sort.SliceStable(unused, func(i, j int) bool {
+			return unused[i].MonthlyCost > unused[j].MonthlyCost
+		})
+	}
+	return savings
+}
+
+// priceDisk prices the given disk as a persistent volume of its type, size and performance in its region would be
+func priceDisk(cp costAnalyzerCloud.Provider, disk *costAnalyzerCloud.Disk) *OrphanedDisk {
+	pv := &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: disk.ID,
+			Labels: map[string]string{
+				v1.LabelZoneRegion:        disk.Region,
+				v1.LabelZoneFailureDomain: disk.Zone,
+			},
+		},
+		Spec: v1.PersistentVolumeSpec{
+			Capacity: v1.ResourceList{
+				v1.ResourceStorage: *resource.NewQuantity(int64(disk.Bytes), resource.BinarySI),
+			},
+		},
+	}
+	parameters := map[string]string{"type": disk.Type}
+	if disk.IOPS > 0 {
+		parameters["iops"] = strconv.FormatFloat(disk.IOPS, 'f', -1, 64)
+	}
+	if disk.Throughput > 0 {
+		parameters["throughput"] = strconv.FormatFloat(disk.Throughput, 'f', -1, 64)
+	}
+
+	asset := priceVolume(map[string]map[string]string{"": parameters}, cp, pv)
+	return &OrphanedDisk{
+		Disk:            disk,
+		GBHourlyCost:    asset.GBHourlyCost,
+		TotalHourlyCost: asset.TotalHourlyCost,
+		MonthlyCost:     asset.TotalHourlyCost * 730,
+	}
+}
@@ -0,0 +1,89 @@
+package costmodel
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	prometheusClient "github.com/prometheus/client_golang/api"
+)
+
+// UnitCost is the cost of an aggregation per unit of a business metric, such as requests served. CostPerUnit is
+// null, reported as N/A, when the aggregation served no units.
+type UnitCost struct {
+	TotalCost   float64  `json:"totalCost"`
+	Units       float64  `json:"units"`
+	CostPerUnit *float64 `json:"costPerUnit"`
+}
+
+// UnitMetricLabel returns the label by which the series of a unit metric are matched to the aggregations of the
+// given field: the subfield when aggregating by label, or else the field itself
+func UnitMetricLabel(field, subfield string) string {
+	if field == "label" {
+		return subfield
+	}
+	return field
+}
+
+// QueryUnits evaluates the given PromQL expression at the given time, the end of the window costs are compared
+// over, summing its values by the given label. The expression must return an instant vector. Series without the
+// label are ignored.
+func QueryUnits(cli prometheusClient.Client, query, label string, at time.Time) (map[string]float64, error) {
+	qr, err := queryAtWithContext(context.Background(), cli, query, at)
+	if err != nil {
+		return nil, err
+	}
+	data, ok := qr.(map[string]interface{})["data"]
+	if !ok {
+		e, err := wrapPrometheusError(qr)
+		if err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf(e)
+	}
+	results, ok := data.(map[string]interface{})["result"].([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Improperly formatted results from prometheus, result field is not a slice")
+	}
+
+	units := make(map[string]float64)
+	for _, result := range results {
+		metric, ok := result.(map[string]interface{})["metric"].(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("Improperly formatted results from prometheus, metric is not a field in the vector")
+		}
+		key, _ := metric[label].(string)
+		if key == "" {
+			continue
+		}
+		dataPoint, ok := result.(map[string]interface{})["value"].([]interface{})
+		if !ok || len(dataPoint) != 2 {
+			return nil, fmt.Errorf("Improperly formatted datapoint from Prometheus; metricQuery must return an instant vector")
+		}
+		value, err := strconv.ParseFloat(dataPoint[1].(string), 64)
+		if err != nil {
+			return nil, err
+		}
+		units[key] += value
+	}
+	return units, nil
+}
+
+// ComputeUnitCosts divides the total cost of each aggregation by its units. Aggregations with no units keep a
+// null cost per unit rather than an infinite one; units of groups without cost are ignored.
+func ComputeUnitCosts(aggregations map[string]*Aggregation, units map[string]float64) map[string]*UnitCost {
+	unitCosts := make(map[string]*UnitCost, len(aggregations))
+	for key, agg := range aggregations {
+		uc := &UnitCost{
+			TotalCost: agg.TotalCost,
+			Units:     units[key],
+		}
+		if uc.Units != 0 {
+			costPerUnit := uc.TotalCost / uc.Units
+			uc.CostPerUnit = &costPerUnit
+		}
+		unitCosts[key] = uc
+	}
+	return unitCosts
+}
@@ -0,0 +1,159 @@
+package costmodel
+
+import (
+	"fmt"
+	"time"
+
+	costAnalyzerCloud "github.com/kubecost/cost-model/cloud"
+	prometheusClient "github.com/prometheus/client_golang/api"
+)
+
+// UnmountedAggregationKey is the key of the synthetic aggregation holding the cost of persistent volumes
+// which are not mounted by any pod. When aggregating by namespace, volumes whose claim is in a namespace
+// are reported under "<namespace>/__unmounted__" instead.
+const UnmountedAggregationKey = "__unmounted__"
+
+// queryMountedVolumes lists the volumes mounted by any pod of the cluster over a window, as recorded by the cost model
+const queryMountedVolumes = `count(max_over_time(pod_pvc_allocation{persistentvolume!=""}[%s] %s)) by (persistentvolume)`
+
+// UnmountedPV is a persistent volume which is not mounted by any pod, along with its resolved hourly pricing.
+// Namespace and Claim are set when the volume is, or was, bound to a claim. Hours is the part of the window
+// the volume existed for, by which its cost over the window is prorated.
+type UnmountedPV struct {
+	*PVAsset
+	Namespace string  `json:"namespace,omitempty"`
+	Claim     string  `json:"claim,omitempty"`
+	Hours     float64 `json:"hours,omitempty"`
+}
+
+// MountedVolumes returns the names of the volumes mounted by any pod of the cluster over the given window, as
+// recorded in pod_pvc_allocation, along with those mounted by the pods of the given cost data. Filters applied to
+// the cost data, e.g. by namespace, therefore don't make the volumes of the pods they exclude unmounted.
+func MountedVolumes(cli prometheusClient.Client, window string, offset string, costData map[string]*CostData) (map[string]bool, error) {
+	mounted := make(map[string]bool)
+	for _, costDatum := range costData {
+		for _, pvc := range costDatum.PVCData {
+			mounted[pvc.VolumeName] = true
+		}
+	}
+
+	qr, err := Query(cli, fmt.Sprintf(queryMountedVolumes, window, offset))
+	if err != nil {
+		return nil, err
+	}
+	data, ok := qr.(map[string]interface{})["data"]
+	if !ok {
+		e, err := wrapPrometheusError(qr)
+		if err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf(e)
+	}
+	results, ok := data.(map[string]interface{})["result"].([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Improperly formatted results from prometheus, result field is not a slice")
+	}
+	for _, result := range results {
+		metric, ok := result.(map[string]interface{})["metric"].(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("Improperly formatted results from prometheus, metric is not a field in the vector")
+		}
+		if volume, ok := metric["persistentvolume"].(string); ok {
+			mounted[volume] = true
+		}
+	}
+	return mounted, nil
+}
+
+// ComputeUnmountedPVCost lists every persistent volume in the cluster cache which existed between start and end
+// and is not in the given set of mounted volumes, priced by the given provider, with the hours of the window
+// it existed for
+func (cm *CostModel) ComputeUnmountedPVCost(cp costAnalyzerCloud.Provider, mounted map[string]bool, start time.Time, end time.Time) []*UnmountedPV {
+	unmounted := []*UnmountedPV{}
+	storageClassMap := getStorageClassParameters(cm.Cache)
+	for _, pv := range cm.Cache.GetAllPersistentVolumes() {
+		if mounted[pv.Name] {
+			continue
+		}
+		created := pv.CreationTimestamp.Time
+		if created.Before(start) {
+			created = start
+		}
+		if !created.Before(end) {
+			continue
+		}
+		upv := &UnmountedPV{
+			PVAsset: priceVolume(storageClassMap, cp, pv),
+			Hours:   end.Sub(created).Hours(),
+		}
+		if pv.Spec.ClaimRef != nil {
+			upv.Namespace = pv.Spec.ClaimRef.Namespace
+			upv.Claim = pv.Spec.ClaimRef.Name
+		}
+		unmounted = append(unmounted, upv)
+	}
+	return unmounted
+}
+
+// ExcludeUnmountedNamespaces returns the given unmounted persistent volumes without those claimed from the
+// given namespaces
+func ExcludeUnmountedNamespaces(unmounted []*UnmountedPV, namespaces []string) []*UnmountedPV {
+	if len(namespaces) == 0 {
+		return unmounted
+	}
+	excluded := make(map[string]bool, len(namespaces))
+	for _, ns := range namespaces {
+		excluded[ns] = true
+	}
+
+	included := make([]*UnmountedPV, 0, len(unmounted))
+	for _, upv := range unmounted {
+		if upv.Namespace == "" || !excluded[upv.Namespace] {
+			included = append(included, upv)
+		}
+	}
+	return included
+}
+
+// UnmountedPVHourlyCost sums the hourly cost of the given unmounted persistent volumes
+func UnmountedPVHourlyCost(unmounted []*UnmountedPV) float64 {
+	total := 0.0
+	for _, upv := range unmounted {
+		total += upv.TotalHourlyCost
+	}
+	return total
+}
+
+// UnmountedPVCost sums the cost of the given unmounted persistent volumes over the hours of the window each existed
+func UnmountedPVCost(unmounted []*UnmountedPV) float64 {
+	total := 0.0
+	for _, upv := range unmounted {
+		total += upv.TotalHourlyCost * upv.Hours
+	}
+	return total
+}
+
+// AddUnmountedAggregations adds the discounted cost of the given unmounted persistent volumes over the hours of
+// the window each existed to the results of AggregateCostModel, as UnmountedAggregationKey aggregations, scaled by
+// the same idle coefficient as the other aggregations.
+func AddUnmountedAggregations(aggregations map[string]*Aggregation, field string, subfield string, unmounted []*UnmountedPV, discount float64, idleCoefficient float64) {
+	for _, upv := range unmounted {
+		key := UnmountedAggregationKey
+		if field == "namespace" && upv.Namespace != "" {
+			key = fmt.Sprintf("%s/%s", upv.Namespace, UnmountedAggregationKey)
+		}
+
+		agg, ok := aggregations[key]
+		if !ok {
+			agg = &Aggregation{
+				Aggregator:         field,
+				AggregatorSubField: subfield,
+				Environment:        key,
+			}
+			aggregations[key] = agg
+		}
+		cost := upv.TotalHourlyCost * upv.Hours * (1 - discount) / idleCoefficient
+		agg.PVCost += cost
+		agg.TotalCost += cost
+	}
+}
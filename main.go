@@ -1,16 +1,52 @@
 package main
 
 import (
+	"context"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/kubecost/cost-model/costmodel"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"k8s.io/klog"
 )
 
+// shutdownTimeout bounds the draining of in-flight requests and price recording on shutdown, within the
+// default termination grace period of a pod
+const shutdownTimeout = 25 * time.Second
+
 func main() {
 	rootMux := http.NewServeMux()
 	rootMux.Handle("/", costmodel.Router)
 	rootMux.Handle("/metrics", promhttp.Handler())
-	klog.Fatal(http.ListenAndServe(":9003", rootMux))
+	server := &http.Server{
+		Addr:    ":9003",
+		Handler: rootMux,
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+		sig := <-signals
+		klog.V(1).Infof("Received %s, shutting down", sig)
+
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			klog.V(1).Infof("Error draining requests: %s", err.Error())
+		}
+		if err := costmodel.Shutdown(ctx); err != nil {
+			klog.V(1).Infof("Error stopping background work: %s", err.Error())
+		}
+	}()
+
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		klog.Fatal(err)
+	}
+	<-stopped
+	klog.Flush()
 }
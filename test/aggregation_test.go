@@ -1,8 +1,15 @@
 package costmodel_test
 
 import (
+	"io/ioutil"
 	"log"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"gotest.tools/assert"
 
@@ -10,7 +17,17 @@ import (
 	costModel "github.com/kubecost/cost-model/costmodel"
 )
 
-func TestAggregation(t *testing.T) {
+// newTestProvider returns a custom provider whose default pricing config is written to a temporary directory
+func newTestProvider(t testing.TB) cloud.Provider {
+	dir, err := ioutil.TempDir("", "cost-model-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("CONFIG_PATH", dir+"/")
+	return &cloud.CustomProvider{}
+}
+
+func newTestCostData() map[string]*costModel.CostData {
 	cd1 := &costModel.CostData{
 		Namespace: "test1",
 		NodeName:  "testnode",
@@ -101,7 +118,553 @@ func TestAggregation(t *testing.T) {
 	costData := make(map[string]*costModel.CostData)
 	costData["test1,foo,nginx,testnode"] = cd1
 	costData["test1,bar,nginx,testnode"] = cd2
-	agg := costModel.AggregateCostModel(costData, "namespace", "", false, 0.0, 1.0, nil)
+	return costData
+}
+
+func totalAggregationCost(aggs map[string]*costModel.Aggregation) float64 {
+	total := 0.0
+	for _, agg := range aggs {
+		total += agg.TotalCost
+	}
+	return total
+}
+
+func TestAggregation(t *testing.T) {
+	cp := newTestProvider(t)
+	agg := costModel.AggregateCostModel(cp, newTestCostData(), "namespace", "", false, 0.0, 1.0, nil)
 	log.Printf("agg: %+v", agg["test1"])
 	assert.Equal(t, agg["test1"].TotalCost, 8.0)
 }
+
+func TestIdleModesSumToClusterTotal(t *testing.T) {
+	cp := newTestProvider(t)
+	clusterTotal := 10.0
+
+	allocated := costModel.TotalContainerCost(cp, newTestCostData(), 0.0)
+	assert.Equal(t, allocated, 8.0)
+
+	// coefficient mode scales each container's cost up to cover idle
+	coefficient := allocated / clusterTotal
+	coefficientAggs := costModel.AggregateCostModel(cp, newTestCostData(), "namespace", "", false, 0.0, coefficient, nil)
+	_, ok := coefficientAggs[costModel.IdleAggregationKey]
+	assert.Assert(t, !ok)
+	assert.Assert(t, math.Abs(totalAggregationCost(coefficientAggs)-clusterTotal) < 1e-9)
+
+	// category mode leaves container costs untouched and reports idle separately
+	categoryAggs := costModel.AggregateCostModel(cp, newTestCostData(), "namespace", "", false, 0.0, 1.0, nil)
+	costModel.AddIdleAggregation(categoryAggs, "namespace", "", clusterTotal-allocated)
+	assert.Equal(t, categoryAggs["test1"].TotalCost, 8.0)
+	assert.Equal(t, categoryAggs[costModel.IdleAggregationKey].TotalCost, 2.0)
+	assert.Assert(t, math.Abs(totalAggregationCost(categoryAggs)-clusterTotal) < 1e-9)
+}
+
+func TestAggregateCostModelResponseMetadata(t *testing.T) {
+	server, _ := newSlowPrometheus(t, 0, false)
+	defer server.Close()
+	a := newTestAccesses(t, server.URL, "")
+
+	envelope := getAggregatedCostModel(t, a, "aggregation=namespace&window=1h")
+	response, ok := envelope.Data.(map[string]interface{})
+	assert.Assert(t, ok)
+	_, ok = response["aggregations"]
+	assert.Assert(t, ok)
+	metadata, ok := response["metadata"].(map[string]interface{})
+	assert.Assert(t, ok)
+	assert.Equal(t, metadata["idleCoefficient"], 1.0)
+	assert.Equal(t, metadata["discount"], 0.0)
+	assert.Assert(t, metadata["start"] != "")
+	assert.Assert(t, metadata["end"] != "")
+	// the cluster and idle costs are only computed, and so reported, if idle cost is allocated
+	_, ok = metadata["totalClusterCost"]
+	assert.Assert(t, !ok)
+	_, ok = metadata["idleCost"]
+	assert.Assert(t, !ok)
+
+	// the legacy response is the bare aggregation map, including when served from the cache
+	for i := 0; i < 2; i++ {
+		envelope = getAggregatedCostModel(t, a, "aggregation=namespace&window=1h&legacy=true")
+		response, ok = envelope.Data.(map[string]interface{})
+		assert.Assert(t, ok)
+		_, ok = response["metadata"]
+		assert.Assert(t, !ok)
+	}
+}
+
+func TestAggregateCostModelETag(t *testing.T) {
+	server, _ := newSlowPrometheus(t, 0, false)
+	defer server.Close()
+	a := newTestAccesses(t, server.URL, "")
+
+	w := httptest.NewRecorder()
+	a.AggregateCostModel(w, httptest.NewRequest("GET", "/aggregatedCostModel?aggregation=namespace&window=1h", nil), nil)
+	assert.Equal(t, w.Code, http.StatusOK)
+	etag := w.Header().Get("ETag")
+	assert.Assert(t, etag != "")
+
+	r := httptest.NewRequest("GET", "/aggregatedCostModel?aggregation=namespace&window=1h", nil)
+	r.Header.Set("If-None-Match", etag)
+	w = httptest.NewRecorder()
+	a.AggregateCostModel(w, r, nil)
+	assert.Equal(t, w.Code, http.StatusNotModified)
+	assert.Equal(t, w.Header().Get("ETag"), etag)
+	assert.Equal(t, w.Body.Len(), 0)
+
+	// a different response shape has a different ETag
+	r = httptest.NewRequest("GET", "/aggregatedCostModel?aggregation=namespace&window=1h&legacy=true", nil)
+	r.Header.Set("If-None-Match", etag)
+	w = httptest.NewRecorder()
+	a.AggregateCostModel(w, r, nil)
+	assert.Equal(t, w.Code, http.StatusOK)
+	assert.Assert(t, w.Header().Get("ETag") != etag)
+}
+
+func TestAggregateCostModelSharedLabelArity(t *testing.T) {
+	server, _ := newSlowPrometheus(t, 0, false)
+	defer server.Close()
+	a := newTestAccesses(t, server.URL, "")
+
+	for _, query := range []string{
+		"sharedLabelNames=app",
+		"sharedLabelNames=app,team&sharedLabelValues=kubecost",
+		"sharedLabelValues=kubecost",
+		"sharedLabelNames=app,&sharedLabelValues=kubecost,",
+	} {
+		w := httptest.NewRecorder()
+		a.AggregateCostModel(w, httptest.NewRequest("GET", "/aggregatedCostModel?aggregation=namespace&window=1h&"+query, nil), nil)
+		assert.Equal(t, w.Code, http.StatusBadRequest, query)
+		assert.Assert(t, strings.Contains(w.Body.String(), "one label value per label name"), query)
+	}
+}
+
+func TestComputeIdleByNode(t *testing.T) {
+	cp := newTestProvider(t)
+	nodes := []*costModel.NodeAsset{
+		&costModel.NodeAsset{Name: "testnode", TotalHourlyCost: 10.0},
+		&costModel.NodeAsset{Name: "emptynode", TotalHourlyCost: 5.0},
+	}
+
+	idle := costModel.ComputeIdleByNode(cp, newTestCostData(), nodes, 1.0, 0.0)
+	assert.Equal(t, len(idle), 2)
+
+	assert.Equal(t, idle["testnode"].TotalCost, 10.0)
+	assert.Equal(t, idle["testnode"].AllocatedCost, 8.0)
+	assert.Equal(t, idle["testnode"].IdleCost, 2.0)
+	assert.Assert(t, math.Abs(idle["testnode"].IdlePercentage-20.0) < 1e-9)
+
+	// a node without pods is entirely idle
+	assert.Equal(t, idle["emptynode"].TotalCost, 5.0)
+	assert.Equal(t, idle["emptynode"].AllocatedCost, 0.0)
+	assert.Equal(t, idle["emptynode"].IdleCost, 5.0)
+	assert.Equal(t, idle["emptynode"].IdlePercentage, 100.0)
+
+	// discounts apply to both node and container cost
+	idle = costModel.ComputeIdleByNode(cp, newTestCostData(), nodes, 2.0, 0.5)
+	assert.Equal(t, idle["testnode"].TotalCost, 10.0)
+	assert.Equal(t, idle["testnode"].AllocatedCost, 4.0)
+}
+
+func TestClusterManagementFee(t *testing.T) {
+	cp := newTestProvider(t)
+	fee, err := costModel.ClusterManagementFee(cp)
+	assert.NilError(t, err)
+	assert.Equal(t, fee, 0.0)
+
+	_, err = cp.UpdateConfig(strings.NewReader(`{"clusterManagementFee":"0.10"}`), "")
+	assert.NilError(t, err)
+	fee, err = costModel.ClusterManagementFee(cp)
+	assert.NilError(t, err)
+	assert.Equal(t, fee, 0.10)
+
+	// the fee prorates over windows shorter than an hour
+	assert.Assert(t, math.Abs(costModel.ClusterManagementFeeOverWindow(fee, 30*time.Minute)-0.05) < 1e-9)
+
+	aggs := costModel.AggregateCostModel(cp, newTestCostData(), "namespace", "", false, 0.0, 1.0, nil)
+	costModel.AddSharedCost(aggs, 2.0)
+	assert.Equal(t, aggs["test1"].SharedCost, 2.0)
+	assert.Equal(t, aggs["test1"].TotalCost, 10.0)
+
+	// idle and unmounted volume costs are not shared into
+	costModel.AddIdleAggregation(aggs, "namespace", "", 1.0)
+	aggs["test2/"+costModel.UnmountedAggregationKey] = &costModel.Aggregation{Environment: "test2/" + costModel.UnmountedAggregationKey}
+	costModel.AddSharedCost(aggs, 2.0)
+	assert.Equal(t, aggs["test1"].SharedCost, 4.0)
+	assert.Equal(t, aggs[costModel.IdleAggregationKey].SharedCost, 0.0)
+	assert.Equal(t, aggs["test2/"+costModel.UnmountedAggregationKey].SharedCost, 0.0)
+}
+
+func TestAggregateCostModelManagementFee(t *testing.T) {
+	server, _ := newSlowPrometheus(t, 0, false)
+	defer server.Close()
+	a := newTestAccesses(t, server.URL, "")
+	_, err := a.Cloud.UpdateConfig(strings.NewReader(`{"clusterManagementFee":"0.10"}`), "")
+	assert.NilError(t, err)
+
+	envelope := getAggregatedCostModel(t, a, "aggregation=namespace&window=30m&includeManagementFee=true")
+	response, ok := envelope.Data.(map[string]interface{})
+	assert.Assert(t, ok)
+	metadata, ok := response["metadata"].(map[string]interface{})
+	assert.Assert(t, ok)
+	assert.Assert(t, math.Abs(metadata["managementFee"].(float64)-0.05) < 1e-9)
+
+	// the fee is only included on request
+	envelope = getAggregatedCostModel(t, a, "aggregation=namespace&window=30m")
+	metadata = envelope.Data.(map[string]interface{})["metadata"].(map[string]interface{})
+	_, ok = metadata["managementFee"]
+	assert.Assert(t, !ok)
+}
+
+func TestPVBillingModeProvisioned(t *testing.T) {
+	cp := newTestProvider(t)
+	costData := newTestCostData()
+	for _, cd := range costData {
+		for _, pvc := range cd.PVCData {
+			pvc.Volume.Size = "107374182400"
+		}
+	}
+
+	used := costModel.AggregateCostModel(cp, costModel.ApplyPVBillingMode(costData, costModel.PVBillingModeUsed), "namespace", "", false, 0.0, 1.0, nil)
+	provisioned := costModel.AggregateCostModel(cp, costModel.ApplyPVBillingMode(costData, costModel.PVBillingModeProvisioned), "namespace", "", false, 0.0, 1.0, nil)
+	assert.Equal(t, used["test1"].PVCost, 4.0)
+	assert.Equal(t, provisioned["test1"].PVCost, 400.0)
+	assert.Assert(t, provisioned["test1"].TotalCost > used["test1"].TotalCost)
+
+	// the original cost data is not modified
+	for _, cd := range costData {
+		assert.Equal(t, cd.PVCData[0].Values[0].Value, 1073741824.0)
+	}
+
+	_, err := costModel.ValidatePVBillingMode("allocated")
+	assert.Assert(t, err != nil)
+}
+
+func TestCostBasisUsage(t *testing.T) {
+	cp := newTestProvider(t)
+	costData := newTestCostData()
+	// foo requests a core but uses a quarter of one; bar has no usage data
+	costData["test1,foo,nginx,testnode"].CPUUsed = []*costModel.Vector{&costModel.Vector{
+		Timestamp: 10,
+		Value:     0.25,
+	}}
+	costData["test1,bar,nginx,testnode"].CPUUsed = []*costModel.Vector{&costModel.Vector{}}
+
+	requestData, warnings := costModel.ApplyCostBasis(costData, costModel.CostBasisRequest)
+	assert.Equal(t, len(warnings), 0)
+	usageData, warnings := costModel.ApplyCostBasis(costData, costModel.CostBasisUsage)
+	assert.Equal(t, len(warnings), 1)
+	assert.Assert(t, strings.Contains(warnings[0], "test1,bar,nginx,testnode"))
+	assert.Assert(t, !strings.Contains(warnings[0], "test1,foo,nginx,testnode"))
+
+	request := costModel.AggregateCostModel(cp, requestData, "namespace", "", false, 0.0, 1.0, nil)
+	usage := costModel.AggregateCostModel(cp, usageData, "namespace", "", false, 0.0, 1.0, nil)
+	assert.Equal(t, request["test1"].CPUCost, 2.0)
+	assert.Equal(t, usage["test1"].CPUCost, 1.25)
+	assert.Equal(t, usage["test1"].RAMCost, request["test1"].RAMCost)
+
+	// the original cost data is not modified
+	assert.Equal(t, costData["test1,foo,nginx,testnode"].CPUAllocation[0].Value, 1.0)
+
+	_, err := costModel.ValidateCostBasis("limit")
+	assert.Assert(t, err != nil)
+}
+
+func TestMarkup(t *testing.T) {
+	cp := newTestProvider(t)
+	unmarked := costModel.AggregateCostModel(cp, newTestCostData(), "namespace", "", false, 0.5, 1.0, nil)
+	assert.Equal(t, unmarked["test1"].MarkupCost, 0.0)
+
+	_, err := cp.UpdateConfig(strings.NewReader(`{"cpuMarkup":"25%","overallMarkup":"50%"}`), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	marked := costModel.AggregateCostModel(cp, newTestCostData(), "namespace", "", false, 0.5, 1.0, nil)
+
+	// the markup applies to discounted costs, and is reported apart from them
+	agg := marked["test1"]
+	assert.Equal(t, agg.CPUCost, unmarked["test1"].CPUCost)
+	assert.Equal(t, agg.RAMCost, unmarked["test1"].RAMCost)
+	assert.Equal(t, agg.MarkupCost, agg.CPUCost*0.25+(agg.RAMCost+agg.PVCost)*0.5)
+	assert.Equal(t, agg.TotalCost, unmarked["test1"].TotalCost+agg.MarkupCost)
+
+	assert.Assert(t, cloud.ValidateCustomPricingValue("RamMarkup", "-5%") != nil)
+}
+
+func TestCostRules(t *testing.T) {
+	cp := newTestProvider(t)
+	_, err := cp.UpdateConfig(strings.NewReader(`{"costRules":"namespace=tenant-*,,50%;namespace=test1,50%,;label.team=ml,10%,"}`), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	costData := newTestCostData()
+	costData["test1,foo,nginx,testnode"].Labels = map[string]string{"team": "ml"}
+	costData["test1,bar,nginx,testnode"].Namespace = "tenant-b"
+
+	aggs := costModel.AggregateCostModel(cp, costData, "namespace", "", false, 0.25, 1.0, nil)
+
+	// the rule naming test1 is more specific than that selecting its label
+	assert.Equal(t, aggs["test1"].AppliedDiscount, 0.5)
+	assert.Equal(t, aggs["test1"].AppliedMarkup, 0.0)
+	assert.Equal(t, aggs["test1"].TotalCost, 2.0)
+
+	// tenant-b keeps the global discount, and is marked up
+	assert.Equal(t, aggs["tenant-b"].AppliedDiscount, 0.25)
+	assert.Equal(t, aggs["tenant-b"].AppliedMarkup, 0.5)
+	assert.Equal(t, aggs["tenant-b"].MarkupCost, 1.5)
+	assert.Equal(t, aggs["tenant-b"].TotalCost, 4.5)
+
+	c, err := cp.GetConfig()
+	assert.NilError(t, err)
+	rules, err := cloud.CostRules(c)
+	assert.NilError(t, err)
+	assert.Equal(t, cloud.MatchCostRule(rules, "tenant-b", map[string]string{"team": "ml"}).Rule, "label.team=ml,10%,")
+	assert.Assert(t, cloud.MatchCostRule(rules, "default", nil) == nil)
+
+	assert.Assert(t, cloud.ValidateCustomPricingValue("CostRules", "namespace=test1,,") != nil)
+	assert.Assert(t, cloud.ValidateCustomPricingValue("CostRules", "node=test1,10%,") != nil)
+}
+
+func TestRAMUnitDecimal(t *testing.T) {
+	cp := newTestProvider(t)
+	binary := costModel.AggregateCostModel(cp, newTestCostData(), "namespace", "", false, 0.0, 1.0, nil)
+
+	_, err := cp.UpdateConfig(strings.NewReader(`{"ramUnit":"decimal"}`), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	decimal := costModel.AggregateCostModel(cp, newTestCostData(), "namespace", "", false, 0.0, 1.0, nil)
+
+	// each container allocates one binary GB of RAM, which is 1.073741824 decimal GB
+	assert.Equal(t, binary["test1"].RAMCost, 2.0)
+	assert.Assert(t, math.Abs(decimal["test1"].RAMCost/binary["test1"].RAMCost-1.073741824) < 1e-9)
+	assert.Equal(t, decimal["test1"].CPUCost, binary["test1"].CPUCost)
+	assert.Equal(t, cloud.RAMBytesPerGB(&cloud.CustomPricing{}), 1073741824.0)
+}
+
+func TestFilterAggregationsKeepsFullSharedDenominator(t *testing.T) {
+	cp := newTestProvider(t)
+	sr := costModel.NewSharedResourceInfo(true, []string{"monitoring"}, []string{}, []string{})
+	aggregations := costModel.AggregateCostModel(cp, newTestSharedCostData(), "pod", "", false, 0.0, 1.0, sr)
+	costModel.AddSharedCost(aggregations, 1.0)
+
+	filtered := costModel.FilterAggregations(aggregations, []string{"web", "missing"})
+	assert.Equal(t, len(filtered), 1)
+
+	// the 4.0 cost of the shared prometheus pod, and the 1.0 fee, are shared by both ingress and web,
+	// even though only web is reported
+	assert.Equal(t, filtered["web"].SharedCost, 2.5)
+	assert.Equal(t, filtered["web"].TotalCost, 4.5)
+	assert.Equal(t, filtered["web"].SharedCost, aggregations["web"].SharedCost)
+	assert.Equal(t, len(aggregations), 2)
+}
+
+func TestAlignWindowToDays(t *testing.T) {
+	end := time.Date(2020, 3, 10, 3, 0, 0, 0, time.UTC)
+
+	// 03:00 UTC is noon in Tokyo, whose 10th of March began at 15:00 UTC on the 9th
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	assert.NilError(t, err)
+	start, aligned := costModel.AlignWindowToDays(end, 2, tokyo)
+	assert.Assert(t, start.Equal(time.Date(2020, 3, 8, 15, 0, 0, 0, time.UTC)))
+	assert.Assert(t, aligned.Equal(time.Date(2020, 3, 9, 15, 0, 0, 0, time.UTC)))
+
+	// 03:00 UTC is still the 9th in New York, where the window spans the start of daylight saving time
+	newYork, err := time.LoadLocation("America/New_York")
+	assert.NilError(t, err)
+	start, aligned = costModel.AlignWindowToDays(end, 2, newYork)
+	assert.Assert(t, start.Equal(time.Date(2020, 3, 7, 5, 0, 0, 0, time.UTC)))
+	assert.Assert(t, aligned.Equal(time.Date(2020, 3, 9, 4, 0, 0, 0, time.UTC)))
+	assert.Equal(t, aligned.Sub(start), 47*time.Hour)
+}
+
+func TestAlignRangeToDays(t *testing.T) {
+	// 10:00 in Sydney on the 1st through 10:00 on the 2nd covers two of its days, from 14:00 UTC on the 31st
+	sydney, err := time.LoadLocation("Australia/Sydney")
+	assert.NilError(t, err)
+	start, end := costModel.AlignRangeToDays(time.Date(2019, 9, 1, 0, 0, 0, 0, time.UTC), time.Date(2019, 9, 2, 0, 0, 0, 0, time.UTC), sydney)
+	assert.Assert(t, start.Equal(time.Date(2019, 8, 31, 14, 0, 0, 0, time.UTC)))
+	assert.Assert(t, end.Equal(time.Date(2019, 9, 2, 14, 0, 0, 0, time.UTC)))
+
+	// boundaries already at midnight are kept
+	start, end = costModel.AlignRangeToDays(start, end, sydney)
+	assert.Assert(t, start.Equal(time.Date(2019, 8, 31, 14, 0, 0, 0, time.UTC)))
+	assert.Assert(t, end.Equal(time.Date(2019, 9, 2, 14, 0, 0, 0, time.UTC)))
+}
+
+func TestCalendarDayRanges(t *testing.T) {
+	// the 8th of March 2020 is 23 hours long in New York, so the point covering it is queried apart
+	newYork, err := time.LoadLocation("America/New_York")
+	assert.NilError(t, err)
+	day := func(d int) time.Time {
+		return time.Date(2020, 3, d, 0, 0, 0, 0, newYork)
+	}
+	ranges := costModel.CalendarDayRanges(day(6), day(10), 1, newYork)
+	assert.Equal(t, len(ranges), 3)
+	assert.Assert(t, ranges[0].Start.Equal(day(6)) && ranges[0].End.Equal(day(8)))
+	assert.Equal(t, ranges[0].Step, 24*time.Hour)
+	assert.Assert(t, ranges[1].Start.Equal(day(9)) && ranges[1].End.Equal(day(9)))
+	assert.Equal(t, ranges[1].Step, 23*time.Hour)
+	assert.Assert(t, ranges[2].Start.Equal(day(10)) && ranges[2].End.Equal(day(10)))
+	assert.Equal(t, ranges[2].Step, 24*time.Hour)
+
+	// each point is a calendar day of the zone
+	for _, r := range ranges {
+		for point := r.Start; !point.After(r.End); point = point.Add(r.Step) {
+			local := point.In(newYork)
+			assert.Equal(t, local.Hour(), 0, point)
+		}
+	}
+}
+
+func TestMergeCostDataRanges(t *testing.T) {
+	earlier := newTestCostData()
+	later := newTestCostData()
+	for _, cd := range later {
+		for _, v := range cd.CPUAllocation {
+			v.Timestamp += 86400
+		}
+	}
+	later["test2,baz,nginx,testnode"] = &costModel.CostData{Namespace: "test2", PodName: "baz"}
+
+	key := "test1,foo,nginx,testnode"
+	n := len(earlier[key].CPUAllocation)
+	claims := len(earlier[key].PVCData)
+	merged := costModel.MergeCostDataRanges(earlier, later)
+	assert.Equal(t, len(merged), len(later))
+	assert.Equal(t, len(merged[key].CPUAllocation), 2*n)
+	assert.Equal(t, len(merged[key].PVCData), claims)
+	assert.Assert(t, merged[key].CPUAllocation[n].Timestamp > merged[key].CPUAllocation[0].Timestamp)
+	assert.Assert(t, costModel.MergeCostDataRanges(nil, later)["test2,baz,nginx,testnode"] != nil)
+}
+
+func TestAllocationPolicy(t *testing.T) {
+	cp := newTestProvider(t)
+	costData := newTestCostData()
+	// foo requests a core and 1GiB but uses two cores and half that; bar requests nothing but uses a core
+	foo := costData["test1,foo,nginx,testnode"]
+	foo.CPUReq = []*costModel.Vector{&costModel.Vector{Timestamp: 10, Value: 1.0}}
+	foo.CPUUsed = []*costModel.Vector{&costModel.Vector{Timestamp: 10, Value: 2.0}}
+	foo.RAMReq = []*costModel.Vector{&costModel.Vector{Timestamp: 10, Value: 1073741824}}
+	foo.RAMUsed = []*costModel.Vector{&costModel.Vector{Timestamp: 10, Value: 536870912}}
+	foo.CPUAllocation = []*costModel.Vector{&costModel.Vector{Timestamp: 10, Value: 2.0}}
+	bar := costData["test1,bar,nginx,testnode"]
+	bar.CPUReq = []*costModel.Vector{&costModel.Vector{}}
+	bar.CPUUsed = []*costModel.Vector{&costModel.Vector{Timestamp: 10, Value: 1.0}}
+
+	cpuCost := func(policy string) float64 {
+		data := costModel.ApplyAllocationPolicy(costData, policy)
+		return costModel.AggregateCostModel(cp, data, "namespace", "", false, 0.0, 1.0, nil)["test1"].CPUCost
+	}
+	assert.Equal(t, cpuCost(costModel.AllocationPolicyMax), 3.0)
+	assert.Equal(t, cpuCost(costModel.AllocationPolicyRequest), 1.0)
+	assert.Equal(t, cpuCost(costModel.AllocationPolicyUsage), 3.0)
+
+	usage := costModel.ApplyAllocationPolicy(costData, costModel.AllocationPolicyUsage)
+	assert.Equal(t, usage["test1,foo,nginx,testnode"].RAMAllocation[0].Value, 536870912.0)
+	// bar reports no RAM requests or usage, so keeps its allocation
+	assert.Equal(t, usage["test1,bar,nginx,testnode"].RAMAllocation[0].Value, 1073741824.0)
+	// the original cost data is not modified
+	assert.Equal(t, foo.RAMAllocation[0].Value, 1073741824.0)
+
+	policy, err := costModel.ValidateAllocationPolicy("")
+	assert.NilError(t, err)
+	assert.Equal(t, policy, costModel.AllocationPolicyMax)
+	_, err = costModel.ValidateAllocationPolicy("limit")
+	assert.Assert(t, err != nil)
+}
+
+func TestAggregateCostModelAllocationPolicy(t *testing.T) {
+	server, _ := newSlowPrometheus(t, 0, false)
+	defer server.Close()
+	a := newTestAccesses(t, server.URL, "")
+
+	metadata := func(query string) map[string]interface{} {
+		envelope := getAggregatedCostModel(t, a, query)
+		response, ok := envelope.Data.(map[string]interface{})
+		assert.Assert(t, ok, envelope.Message)
+		return response["metadata"].(map[string]interface{})
+	}
+	assert.Equal(t, metadata("aggregation=namespace&window=1h")["allocationPolicy"], costModel.AllocationPolicyMax)
+	// the policy is part of the cache key, so a response cached for one policy isn't served for another
+	envelope := getAggregatedCostModel(t, a, "aggregation=namespace&window=1h&allocationPolicy=request")
+	assert.Assert(t, strings.HasPrefix(envelope.Message, "cache miss"), envelope.Message)
+	assert.Equal(t, metadata("aggregation=namespace&window=1h&allocationPolicy=request")["allocationPolicy"], costModel.AllocationPolicyRequest)
+
+	envelope = getAggregatedCostModel(t, a, "aggregation=namespace&window=1h&allocationPolicy=limit")
+	assert.Equal(t, envelope.ErrorCode, costModel.ErrorCodeBadRequest)
+}
+
+// newTestImageCostData returns the cost data of a pod of two containers of different images, and of another pod
+// of a later tag of one of them, each container costing 2.0
+func newTestImageCostData() map[string]*costModel.CostData {
+	newDatum := func(pod, container, image string) *costModel.CostData {
+		return &costModel.CostData{
+			Name:      container,
+			Namespace: "shop",
+			PodName:   pod,
+			NodeName:  "testnode",
+			Image:     image,
+			NodeData: &cloud.Node{
+				VCPUCost: "1.0",
+				RAMCost:  "1.0",
+			},
+			RAMAllocation: []*costModel.Vector{&costModel.Vector{Timestamp: 10, Value: 1073741824}},
+			CPUAllocation: []*costModel.Vector{&costModel.Vector{Timestamp: 10, Value: 1.0}},
+			GPUReq:        []*costModel.Vector{&costModel.Vector{}},
+		}
+	}
+	return map[string]*costModel.CostData{
+		"shop,web,app,testnode":     newDatum("web", "app", "registry.example.com:5000/shop/web:1.2@sha256:aaa"),
+		"shop,web,proxy,testnode":   newDatum("web", "proxy", "docker.io/library/envoy:1.14"),
+		"shop,batch,app,testnode":   newDatum("batch", "app", "registry.example.com:5000/shop/web:1.3"),
+		"shop,batch,debug,testnode": newDatum("batch", "debug", ""),
+	}
+}
+
+func TestAggregateCostModelByImage(t *testing.T) {
+	cp := newTestProvider(t)
+	costs := func(mode string) map[string]float64 {
+		aggs := costModel.AggregateCostModel(cp, newTestImageCostData(), "image", mode, false, 0.0, 1.0, nil)
+		costs := map[string]float64{}
+		for key, agg := range aggs {
+			costs[key] = agg.TotalCost
+		}
+		return costs
+	}
+
+	// each container of the pod counts towards its own image, and containers without a known image towards
+	// their own aggregation
+	assert.DeepEqual(t, costs(""), map[string]float64{
+		"registry.example.com:5000/shop/web:1.2": 2.0,
+		"registry.example.com:5000/shop/web:1.3": 2.0,
+		"envoy:1.14":                             2.0,
+		costModel.UnknownImageAggregationKey:     2.0,
+	})
+	assert.DeepEqual(t, costs(costModel.ImageRefRepository), map[string]float64{
+		"registry.example.com:5000/shop/web": 4.0,
+		"envoy":                              2.0,
+		costModel.UnknownImageAggregationKey: 2.0,
+	})
+	assert.DeepEqual(t, costs(costModel.ImageRefDigest), map[string]float64{
+		"registry.example.com:5000/shop/web@sha256:aaa": 2.0,
+		"registry.example.com:5000/shop/web:1.3":        2.0,
+		"envoy:1.14":                                    2.0,
+		costModel.UnknownImageAggregationKey:            2.0,
+	})
+}
+
+func TestNormalizeImage(t *testing.T) {
+	cases := []struct {
+		image    string
+		mode     string
+		expected string
+	}{
+		{"nginx", "", "nginx:latest"},
+		{"docker.io/library/nginx:1.17", costModel.ImageRefTag, "nginx:1.17"},
+		{"index.docker.io/team/app@sha256:abc", "", "team/app@sha256:abc"},
+		{"localhost:5000/app", costModel.ImageRefRepository, "localhost:5000/app"},
+		{"localhost:5000/app:2@sha256:abc", costModel.ImageRefDigest, "localhost:5000/app@sha256:abc"},
+		{"docker.io/library/nginx:1.17", costModel.ImageRefFull, "docker.io/library/nginx:1.17"},
+	}
+	for _, c := range cases {
+		assert.Equal(t, costModel.NormalizeImage(c.image, c.mode), c.expected, c.image)
+	}
+}
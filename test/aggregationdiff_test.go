@@ -0,0 +1,79 @@
+package costmodel_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"gotest.tools/assert"
+
+	costModel "github.com/kubecost/cost-model/costmodel"
+)
+
+func TestDiffAggregations(t *testing.T) {
+	a := map[string]*costModel.Aggregation{
+		"kube-system": {CPUCost: 2, RAMCost: 1, TotalCost: 3},
+		"old":         {CPUCost: 1, TotalCost: 1},
+	}
+	b := map[string]*costModel.Aggregation{
+		"kube-system": {CPUCost: 3, RAMCost: 1, TotalCost: 4},
+		"new":         {RAMCost: 2, TotalCost: 2},
+	}
+
+	diffs := costModel.DiffAggregations(a, b)
+	assert.Equal(t, len(diffs), 3)
+
+	changed := diffs["kube-system"]
+	assert.Equal(t, changed.Change, costModel.AggregationChanged)
+	assert.Equal(t, changed.CPUCost.Delta, 1.0)
+	assert.Equal(t, *changed.CPUCost.PercentChange, 50.0)
+	assert.Equal(t, changed.RAMCost.Delta, 0.0)
+	assert.Equal(t, *changed.RAMCost.PercentChange, 0.0)
+	assert.Equal(t, *changed.TotalCost.PercentChange, 100.0/3)
+	// a change from zero has no percentage
+	assert.Assert(t, changed.GPUCost.PercentChange == nil)
+
+	// a namespace appearing in window B grows from nothing
+	added := diffs["new"]
+	assert.Equal(t, added.Change, costModel.AggregationAdded)
+	assert.Equal(t, added.TotalCost.A, 0.0)
+	assert.Equal(t, added.TotalCost.B, 2.0)
+	assert.Equal(t, added.TotalCost.Delta, 2.0)
+	assert.Assert(t, added.TotalCost.PercentChange == nil)
+
+	// a namespace disappearing in window B shrinks to nothing
+	removed := diffs["old"]
+	assert.Equal(t, removed.Change, costModel.AggregationRemoved)
+	assert.Equal(t, removed.TotalCost.Delta, -1.0)
+	assert.Equal(t, *removed.TotalCost.PercentChange, -100.0)
+}
+
+func TestAggregateCostModelDiff(t *testing.T) {
+	server, _ := newSlowPrometheus(t, 0, false)
+	defer server.Close()
+	a := newTestAccesses(t, server.URL, "EUR:0.5")
+
+	request := func(query string) (int, *costModel.DataEnvelope) {
+		w := httptest.NewRecorder()
+		a.AggregateCostModelDiff(w, httptest.NewRequest("GET", "/aggregatedCostModelDiff?"+query, nil), nil)
+		var envelope costModel.DataEnvelope
+		assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &envelope))
+		return w.Code, &envelope
+	}
+
+	code, envelope := request("aggregation=namespace&windowA=1h&offsetA=1h&windowB=1h&currency=EUR")
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, envelope.Code, http.StatusOK, envelope.Message)
+	assert.Equal(t, envelope.Currency, "EUR")
+	assert.DeepEqual(t, envelope.Data, map[string]interface{}{})
+
+	code, envelope = request("aggregation=namespace&windowA=1h")
+	assert.Equal(t, code, http.StatusBadRequest)
+	assert.Equal(t, envelope.ErrorCode, costModel.ErrorCodeBadWindow)
+
+	// errors aggregating either window are passed on
+	code, envelope = request("windowA=1h&windowB=1h")
+	assert.Equal(t, code, http.StatusBadRequest)
+	assert.Equal(t, envelope.ErrorCode, costModel.ErrorCodeBadRequest)
+}
@@ -0,0 +1,129 @@
+package costmodel_test
+
+import (
+	"fmt"
+	"math"
+	"testing"
+
+	"gotest.tools/assert"
+
+	"github.com/kubecost/cost-model/cloud"
+	costModel "github.com/kubecost/cost-model/costmodel"
+)
+
+// newLargeCostData returns cost data of the given number of pods spread over 20 namespaces, each with hourly
+// samples of its allocations, a volume and network egress over the given number of hours
+func newLargeCostData(pods int, hours int) map[string]*costModel.CostData {
+	vectors := func(pod int, value float64) []*costModel.Vector {
+		vs := make([]*costModel.Vector, 0, hours)
+		for h := 0; h < hours; h++ {
+			vs = append(vs, &costModel.Vector{Timestamp: float64(1569888000 + 3600*h), Value: value * float64(1+(pod+h)%3)})
+		}
+		return vs
+	}
+	costData := make(map[string]*costModel.CostData, pods)
+	for i := 0; i < pods; i++ {
+		ns := fmt.Sprintf("ns-%d", i%20)
+		costData[fmt.Sprintf("cluster,%s,pod-%d,main,node", ns, i)] = &costModel.CostData{
+			Namespace: ns,
+			NodeData: &cloud.Node{
+				VCPUCost: "0.031611",
+				RAMCost:  "0.004237",
+				GPUCost:  "0.95",
+			},
+			CPUAllocation: vectors(i, 0.25),
+			RAMAllocation: vectors(i, 512*1024*1024),
+			GPUReq:        vectors(i, float64(i%2)),
+			NetworkData:   vectors(i, 0.001),
+			PVCData: []*costModel.PersistentVolumeClaimData{
+				&costModel.PersistentVolumeClaimData{
+					Namespace:  ns,
+					VolumeName: fmt.Sprintf("pv-%d", i),
+					Volume:     &cloud.PV{Cost: "0.0000548", Size: "10737418240"},
+					Values:     vectors(i, 10737418240),
+				},
+			},
+		}
+	}
+	return costData
+}
+
+func TestAggregateCostModelTotals(t *testing.T) {
+	cp := newTestProvider(t)
+
+	vectors := costModel.AggregateCostModel(cp, newLargeCostData(200, 48), "namespace", "", true, 0.1, 1.0, nil)
+	totals := costModel.AggregateCostModel(cp, newLargeCostData(200, 48), "namespace", "", false, 0.1, 1.0, nil)
+	assert.Equal(t, len(totals), len(vectors))
+
+	equal := func(a, b float64) bool {
+		return math.Abs(a-b) <= 1e-9*math.Max(1, math.Abs(a))
+	}
+	for key, v := range vectors {
+		agg, ok := totals[key]
+		assert.Assert(t, ok, key)
+		assert.Assert(t, v.CPUCost > 0 && v.RAMCost > 0 && v.GPUCost > 0 && v.PVCost > 0 && v.NetworkCost > 0, key)
+		assert.Assert(t, equal(agg.CPUCost, v.CPUCost), "%s: %f != %f", key, agg.CPUCost, v.CPUCost)
+		assert.Assert(t, equal(agg.RAMCost, v.RAMCost), "%s: %f != %f", key, agg.RAMCost, v.RAMCost)
+		assert.Assert(t, equal(agg.GPUCost, v.GPUCost), "%s: %f != %f", key, agg.GPUCost, v.GPUCost)
+		assert.Assert(t, equal(agg.PVCost, v.PVCost), "%s: %f != %f", key, agg.PVCost, v.PVCost)
+		assert.Assert(t, equal(agg.NetworkCost, v.NetworkCost), "%s: %f != %f", key, agg.NetworkCost, v.NetworkCost)
+		assert.Assert(t, equal(agg.TotalCost, v.TotalCost), "%s: %f != %f", key, agg.TotalCost, v.TotalCost)
+		assert.Assert(t, equal(agg.AppliedDiscount, v.AppliedDiscount), "%s: %f != %f", key, agg.AppliedDiscount, v.AppliedDiscount)
+
+		// without time series, no vectors are kept
+		assert.Assert(t, agg.CPUCostVector == nil && agg.RAMCostVector == nil && agg.GPUCostVector == nil)
+		assert.Assert(t, agg.PVCostVector == nil && agg.NetworkCostVector == nil)
+	}
+}
+
+func TestAggregationAllocationTotals(t *testing.T) {
+	cp := newTestProvider(t)
+	config, err := cp.GetConfig()
+	assert.NilError(t, err)
+	bytesPerGB := cloud.RAMBytesPerGB(config)
+
+	// the allocations of each namespace, summed from its cost data
+	costData := newLargeCostData(40, 24)
+	sum := func(vectors []*costModel.Vector) float64 {
+		total := 0.0
+		for _, v := range vectors {
+			total += v.Value
+		}
+		return total
+	}
+	cpu, ram, gpu := map[string]float64{}, map[string]float64{}, map[string]float64{}
+	for _, cd := range costData {
+		cpu[cd.Namespace] += sum(cd.CPUAllocation)
+		ram[cd.Namespace] += sum(cd.RAMAllocation) / bytesPerGB
+		gpu[cd.Namespace] += sum(cd.GPUReq)
+	}
+
+	equal := func(a, b float64) bool {
+		return math.Abs(a-b) <= 1e-9*math.Max(1, math.Abs(a))
+	}
+	for _, timeSeries := range []bool{true, false} {
+		aggregations := costModel.AggregateCostModel(cp, newLargeCostData(40, 24), "namespace", "", timeSeries, 0.1, 1.0, nil)
+		assert.Equal(t, len(aggregations), len(cpu))
+		for key, agg := range aggregations {
+			assert.Assert(t, agg.CPUAllocationTotal > 0 && agg.RAMAllocationTotal > 0, key)
+			assert.Assert(t, equal(agg.CPUAllocationTotal, cpu[key]), "%s: %f != %f", key, agg.CPUAllocationTotal, cpu[key])
+			assert.Assert(t, equal(agg.RAMAllocationTotal, ram[key]), "%s: %f != %f", key, agg.RAMAllocationTotal, ram[key])
+			assert.Assert(t, equal(agg.GPUAllocationTotal, gpu[key]), "%s: %f != %f", key, agg.GPUAllocationTotal, gpu[key])
+		}
+	}
+}
+
+func BenchmarkAggregateCostModel(b *testing.B) {
+	cp := newTestProvider(b)
+	for _, timeSeries := range []bool{true, false} {
+		b.Run(fmt.Sprintf("timeSeries=%t", timeSeries), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				costData := newLargeCostData(2000, 24*7)
+				b.StartTimer()
+				costModel.AggregateCostModel(cp, costData, "namespace", "", timeSeries, 0, 1.0, nil)
+			}
+		})
+	}
+}
@@ -0,0 +1,56 @@
+package costmodel_test
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"gotest.tools/assert"
+
+	costModel "github.com/kubecost/cost-model/costmodel"
+	v1 "k8s.io/api/core/v1"
+)
+
+const costCenterAnnotation = "finance.example.com/cost-center"
+
+// newAnnotatedJobPod returns a pod of the given Job annotated with the given annotations
+func newAnnotatedJobPod(name string, job string, annotations map[string]string) *v1.Pod {
+	pod := newJobPod(name, job)
+	pod.Annotations = annotations
+	return pod
+}
+
+func TestAggregateCostModelByAnnotation(t *testing.T) {
+	server := newReindexPrometheus(t)
+	defer server.Close()
+	cp := newTestProvider(t)
+
+	cm := &costModel.CostModel{Cache: fakeClusterCache{
+		pods: []*v1.Pod{
+			newAnnotatedJobPod("reindex-28472815-xk2lp", "reindex-28472815", map[string]string{
+				costCenterAnnotation: "cc-1001",
+				"kubectl.kubernetes.io/last-applied-configuration": `{"kind":"Pod"}`,
+			}),
+			newAnnotatedJobPod("reindex-28472875-q8w4n", "reindex-28472875", map[string]string{costCenterAnnotation: "cc-1001"}),
+			newAnnotatedJobPod("migrate-7x2kd", "migrate", map[string]string{costCenterAnnotation: "cc-2002"}),
+		},
+	}}
+
+	data, _, err := cm.ComputeCostDataRange(newFakePrometheusClient(t, server.URL), nil, cp, "2019-10-01T12:00:00.000Z", "2019-10-01T13:00:00.000Z", "1h", "", "", false, false)
+	assert.NilError(t, err)
+
+	clusterID := costModel.LocalClusterID(cp)
+	assert.DeepEqual(t, data[clusterID+",batch,reindex-28472815-xk2lp,main,node-1"].Annotations, map[string]string{costCenterAnnotation: "cc-1001"})
+
+	// annotations are aggregated by, but not returned
+	serialized, err := json.Marshal(data)
+	assert.NilError(t, err)
+	assert.Assert(t, !strings.Contains(string(serialized), costCenterAnnotation))
+
+	// the deleted pod, without annotations, is not aggregated
+	aggs := costModel.AggregateCostModel(cp, data, "annotation", costCenterAnnotation, false, 0, 1.0, nil)
+	assert.Equal(t, len(aggs), 2)
+	assert.Assert(t, aggs["cc-1001"].TotalCost > 0)
+	assert.Assert(t, aggs["cc-2002"].TotalCost > 0)
+	assert.Assert(t, aggs["cc-1001"].TotalCost > aggs["cc-2002"].TotalCost)
+}
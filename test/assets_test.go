@@ -0,0 +1,98 @@
+package costmodel_test
+
+import (
+	"math"
+	"testing"
+
+	"gotest.tools/assert"
+
+	costModel "github.com/kubecost/cost-model/costmodel"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	v1 "k8s.io/api/core/v1"
+	stv1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// fakeClusterCache is a ClusterCache serving a fixed set of resources
+type fakeClusterCache struct {
+	nodes    []*v1.Node
+	pods     []*v1.Pod
+	pvs      []*v1.PersistentVolume
+	services []*v1.Service
+	jobs     []*batchv1.Job
+}
+
+func (fakeClusterCache) Run(stopCh chan struct{})                          {}
+func (fakeClusterCache) GetAllNamespaces() []*v1.Namespace                 { return nil }
+func (c fakeClusterCache) GetAllNodes() []*v1.Node                         { return c.nodes }
+func (c fakeClusterCache) GetAllPods() []*v1.Pod                           { return c.pods }
+func (c fakeClusterCache) GetAllServices() []*v1.Service                   { return c.services }
+func (fakeClusterCache) GetAllDeployments() []*appsv1.Deployment           { return nil }
+func (c fakeClusterCache) GetAllJobs() []*batchv1.Job                      { return c.jobs }
+func (c fakeClusterCache) GetAllPersistentVolumes() []*v1.PersistentVolume { return c.pvs }
+func (fakeClusterCache) GetAllStorageClasses() []*stv1.StorageClass        { return nil }
+
+func TestComputeAssets(t *testing.T) {
+	cp := newTestProvider(t)
+	err := cp.DownloadPricingData()
+	assert.NilError(t, err)
+
+	cache := fakeClusterCache{
+		nodes: []*v1.Node{
+			&v1.Node{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: "node1",
+					Labels: map[string]string{
+						v1.LabelInstanceType: "n1-standard-2",
+						v1.LabelZoneRegion:   "us-central1",
+					},
+				},
+				Status: v1.NodeStatus{
+					Capacity: v1.ResourceList{
+						v1.ResourceCPU:    resource.MustParse("2"),
+						v1.ResourceMemory: resource.MustParse("4Gi"),
+					},
+				},
+			},
+		},
+		pvs: []*v1.PersistentVolume{
+			&v1.PersistentVolume{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:   "pv1",
+					Labels: map[string]string{v1.LabelZoneRegion: "us-central1"},
+				},
+				Spec: v1.PersistentVolumeSpec{
+					StorageClassName: "standard",
+					Capacity: v1.ResourceList{
+						v1.ResourceStorage: resource.MustParse("10Gi"),
+					},
+				},
+			},
+		},
+	}
+	cm := &costModel.CostModel{Cache: cache}
+
+	assets, err := cm.ComputeAssets(cp)
+	assert.NilError(t, err)
+	assert.Equal(t, len(assets.Nodes), 1)
+	assert.Equal(t, len(assets.PersistentVolumes), 1)
+
+	// priced with the custom provider defaults: 0.031611/core, 0.004237/GB and 0.00005479452/GB of storage
+	node := assets.Nodes[0]
+	assert.Equal(t, node.Name, "node1")
+	assert.Equal(t, node.InstanceType, "n1-standard-2")
+	assert.Equal(t, node.Region, "us-central1")
+	assert.Equal(t, node.Spot, false)
+	assert.Equal(t, node.CPUCores, 2.0)
+	assert.Assert(t, math.Abs(node.CPUHourlyCost-2*0.031611) < 1e-9)
+	assert.Assert(t, math.Abs(node.RAMHourlyCost-4*0.004237) < 1e-9)
+	assert.Assert(t, math.Abs(node.TotalHourlyCost-(2*0.031611+4*0.004237)) < 1e-9)
+
+	pv := assets.PersistentVolumes[0]
+	assert.Equal(t, pv.Name, "pv1")
+	assert.Equal(t, pv.StorageClass, "standard")
+	assert.Equal(t, pv.Region, "us-central1")
+	assert.Assert(t, math.Abs(pv.TotalHourlyCost-10*0.00005479452) < 1e-12)
+}
@@ -0,0 +1,58 @@
+package costmodel_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/athena"
+	"github.com/aws/aws-sdk-go/service/athena/athenaiface"
+	"gotest.tools/assert"
+
+	"github.com/kubecost/cost-model/cloud"
+)
+
+// fakeAthena reports the given states of a query execution in turn, repeating the last
+type fakeAthena struct {
+	athenaiface.AthenaAPI
+	states  []string
+	polls   int
+	stopped bool
+}
+
+func (f *fakeAthena) GetQueryExecution(*athena.GetQueryExecutionInput) (*athena.GetQueryExecutionOutput, error) {
+	state := f.states[len(f.states)-1]
+	if f.polls < len(f.states) {
+		state = f.states[f.polls]
+	}
+	f.polls++
+	return &athena.GetQueryExecutionOutput{QueryExecution: &athena.QueryExecution{
+		Status: &athena.QueryExecutionStatus{State: aws.String(state), StateChangeReason: aws.String("SYNTAX_ERROR")},
+	}}, nil
+}
+
+func (f *fakeAthena) StopQueryExecution(*athena.StopQueryExecutionInput) (*athena.StopQueryExecutionOutput, error) {
+	f.stopped = true
+	return &athena.StopQueryExecutionOutput{}, nil
+}
+
+func TestWaitForAthenaQuery(t *testing.T) {
+	svc := &fakeAthena{states: []string{"QUEUED", "RUNNING", "SUCCEEDED"}}
+	_, err := cloud.WaitForAthenaQuery(svc, "q1", time.Minute)
+	assert.NilError(t, err)
+	assert.Equal(t, svc.polls, 3)
+
+	svc = &fakeAthena{states: []string{"RUNNING", "FAILED"}}
+	_, err = cloud.WaitForAthenaQuery(svc, "q2", time.Minute)
+	assert.ErrorContains(t, err, "SYNTAX_ERROR")
+
+	// queries outlasting the timeout are stopped, reporting their state
+	svc = &fakeAthena{states: []string{"QUEUED"}}
+	start := time.Now()
+	_, err = cloud.WaitForAthenaQuery(svc, "q3", 10*time.Millisecond)
+	assert.ErrorContains(t, err, "QUEUED")
+	assert.Assert(t, strings.Contains(err.Error(), "timed out"))
+	assert.Assert(t, svc.stopped)
+	assert.Assert(t, time.Since(start) < time.Second)
+}
@@ -0,0 +1,96 @@
+package costmodel_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"gotest.tools/assert"
+
+	costModel "github.com/kubecost/cost-model/costmodel"
+)
+
+func TestRequireBearerToken(t *testing.T) {
+	handled := 0
+	handle := func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		handled++
+		w.Write([]byte("ok"))
+	}
+
+	cases := []struct {
+		name          string
+		token         string
+		authorization string
+		code          int
+	}{
+		{"auth off", "", "", http.StatusOK},
+		{"auth off ignores the header", "", "Bearer anything", http.StatusOK},
+		{"valid token", "s3cret", "Bearer s3cret", http.StatusOK},
+		{"case-insensitive scheme", "s3cret", "bearer s3cret", http.StatusOK},
+		{"missing header", "s3cret", "", http.StatusUnauthorized},
+		{"wrong token", "s3cret", "Bearer guess", http.StatusUnauthorized},
+		{"token prefix", "s3cret", "Bearer s3c", http.StatusUnauthorized},
+		{"other scheme", "s3cret", "Basic s3cret", http.StatusUnauthorized},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			handled = 0
+			r := httptest.NewRequest("POST", "/updateConfigByKey", nil)
+			if c.authorization != "" {
+				r.Header.Set("Authorization", c.authorization)
+			}
+			w := httptest.NewRecorder()
+			costModel.RequireBearerToken(c.token, handle)(w, r, nil)
+			assert.Equal(t, w.Code, c.code)
+			if c.code == http.StatusOK {
+				assert.Equal(t, handled, 1)
+				return
+			}
+
+			// denied requests are not handled, and are answered with an error envelope
+			assert.Equal(t, handled, 0)
+			var envelope map[string]interface{}
+			assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &envelope))
+			assert.Equal(t, envelope["status"], "error")
+			assert.Equal(t, envelope["errorCode"], costModel.ErrorCodeUnauthorized)
+			assert.Equal(t, w.Header().Get("WWW-Authenticate"), `Bearer realm="cost-model"`)
+		})
+	}
+}
+
+func TestRequireBearerTokenWhen(t *testing.T) {
+	handle := func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		w.Write([]byte("ok"))
+	}
+	clearsCache := func(r *http.Request) bool { return r.URL.Query().Get("clearCache") == "true" }
+
+	cases := []struct {
+		name          string
+		query         string
+		authorization string
+		code          int
+	}{
+		{"reading", "window=1d", "", http.StatusOK},
+		{"clearing the cache", "window=1d&clearCache=true", "", http.StatusUnauthorized},
+		{"clearing the cache with a wrong token", "window=1d&clearCache=true", "Bearer guess", http.StatusUnauthorized},
+		{"clearing the cache with the token", "window=1d&clearCache=true", "Bearer s3cret", http.StatusOK},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/aggregatedCostModel?"+c.query, nil)
+			if c.authorization != "" {
+				r.Header.Set("Authorization", c.authorization)
+			}
+			w := httptest.NewRecorder()
+			costModel.RequireBearerTokenWhen("s3cret", clearsCache, handle)(w, r, nil)
+			assert.Equal(t, w.Code, c.code)
+		})
+	}
+
+	// with auth off, nothing requires the token
+	w := httptest.NewRecorder()
+	costModel.RequireBearerTokenWhen("", clearsCache, handle)(w, httptest.NewRequest("GET", "/aggregatedCostModel?clearCache=true", nil), nil)
+	assert.Equal(t, w.Code, http.StatusOK)
+}
@@ -0,0 +1,91 @@
+package costmodel_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"gotest.tools/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/kubecost/cost-model/cloud"
+)
+
+func newTestRetailPricesServer(t *testing.T) *httptest.Server {
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		filter := r.URL.Query().Get("$filter")
+		var page map[string]interface{}
+		switch {
+		case strings.Contains(filter, "Virtual Machines") && r.URL.Query().Get("page") == "":
+			page = map[string]interface{}{
+				"Items": []map[string]interface{}{
+					{"armRegionName": "eastus", "armSkuName": "Standard_D2s_v3", "meterName": "D2s v3", "productName": "Virtual Machines DSv3 Series", "skuName": "D2s v3", "unitOfMeasure": "1 Hour", "retailPrice": 0.096},
+					{"armRegionName": "eastus", "armSkuName": "Standard_D2s_v3", "meterName": "D2s v3", "productName": "Virtual Machines DSv3 Series Windows", "skuName": "D2s v3", "unitOfMeasure": "1 Hour", "retailPrice": 0.188},
+				},
+				"NextPageLink": srv.URL + "?page=2&" + url.Values{"$filter": {filter}}.Encode(),
+			}
+		case strings.Contains(filter, "Virtual Machines"):
+			page = map[string]interface{}{
+				"Items": []map[string]interface{}{
+					{"armRegionName": "eastus", "armSkuName": "Standard_D2s_v3", "meterName": "D2s v3 Spot", "productName": "Virtual Machines DSv3 Series", "skuName": "D2s v3 Spot", "unitOfMeasure": "1 Hour", "retailPrice": 0.0192},
+					{"armRegionName": "eastus", "armSkuName": "Standard_D2s_v3", "meterName": "D2s v3 Low Priority", "productName": "Virtual Machines DSv3 Series", "skuName": "D2s v3 Low Priority", "unitOfMeasure": "1 Hour", "retailPrice": 0.0192},
+				},
+			}
+		default:
+			page = map[string]interface{}{
+				"Items": []map[string]interface{}{
+					{"armRegionName": "eastus", "meterName": "P30 LRS Disk", "productName": "Premium SSD Managed Disks", "skuName": "P30 LRS", "unitOfMeasure": "1/Month", "retailPrice": 135.17},
+					{"armRegionName": "eastus", "meterName": "P10 LRS Disk", "productName": "Premium SSD Managed Disks", "skuName": "P10 LRS", "unitOfMeasure": "1/Month", "retailPrice": 19.71},
+					{"armRegionName": "eastus", "meterName": "Disk Operations", "productName": "Standard SSD Managed Disks", "skuName": "E30 LRS", "unitOfMeasure": "10K", "retailPrice": 0.002},
+				},
+			}
+		}
+		if err := json.NewEncoder(w).Encode(page); err != nil {
+			t.Fatal(err)
+		}
+	}))
+	return srv
+}
+
+func TestAzureRetailPricing(t *testing.T) {
+	newTestProvider(t) // isolates the config directory
+	srv := newTestRetailPricesServer(t)
+	defer srv.Close()
+
+	az := &cloud.Azure{RetailPricesURL: srv.URL}
+	assert.NilError(t, az.DownloadPricingData())
+
+	labels := map[string]string{
+		v1.LabelZoneRegion:   "eastus",
+		v1.LabelInstanceType: "Standard_D2s_v3",
+	}
+	node, err := az.NodePricing(az.GetKey(labels))
+	assert.NilError(t, err)
+	assert.Equal(t, node.Cost, "0.096")
+	assert.Assert(t, !node.IsSpot())
+
+	labels["kubernetes.azure.com/scalesetpriority"] = "spot"
+	node, err = az.NodePricing(az.GetKey(labels))
+	assert.NilError(t, err)
+	assert.Equal(t, node.Cost, "0.0192")
+	assert.Assert(t, node.IsSpot())
+
+	pv := &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   "pv-premium",
+			Labels: map[string]string{v1.LabelZoneRegion: "eastus"},
+		},
+	}
+	priced, err := az.PVPricing(az.GetPVKey(pv, map[string]string{"skuName": "Premium_LRS"}))
+	assert.NilError(t, err)
+	assert.Equal(t, priced.Cost, "0.0001808245933219178")
+
+	priced, err = az.PVPricing(az.GetPVKey(pv, map[string]string{"skuName": "StandardSSD_LRS"}))
+	assert.NilError(t, err)
+	assert.Equal(t, priced.Cost, "")
+}
@@ -0,0 +1,268 @@
+package costmodel_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"gotest.tools/assert"
+
+	"github.com/kubecost/cost-model/cloud"
+	costModel "github.com/kubecost/cost-model/costmodel"
+)
+
+// newBudgetWebhook returns a webhook recording the bodies POSTed to it
+func newBudgetWebhook(bodies *[]string, lock *sync.Mutex) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		lock.Lock()
+		*bodies = append(*bodies, string(body))
+		lock.Unlock()
+	}))
+}
+
+// newSpendCostData returns the cost data of a container in the given namespace costing spend in total
+func newSpendCostData(namespace string, spend float64) map[string]*costModel.CostData {
+	datum := newTestContainer(namespace, "app", "main")
+	datum.RAMAllocation = nil
+	datum.CPUAllocation[0].Value = spend
+	return map[string]*costModel.CostData{namespace + ",app,main,testnode": datum}
+}
+
+func TestBudgetValidate(t *testing.T) {
+	budget := &cloud.Budget{Field: "label", SubField: "team", Value: "ml", Window: "Weekly", Amount: 500}
+	assert.NilError(t, budget.Validate())
+	assert.Equal(t, budget.ID, "label:team:ml:weekly")
+	assert.DeepEqual(t, budget.Thresholds, cloud.DefaultBudgetThresholds)
+	assert.Equal(t, budget.WebhookFormat, cloud.BudgetWebhookGeneric)
+
+	for _, invalid := range []*cloud.Budget{
+		{Field: "namespace", Window: "monthly", Amount: 2000},
+		{Field: "namespace", Value: "team-a", Window: "daily", Amount: 2000},
+		{Field: "namespace", Value: "team-a", Window: "monthly"},
+		{Field: "namespace", Value: "team-a", Window: "monthly", Amount: 2000, Thresholds: []float64{0.5, -1}},
+		{Field: "namespace", Value: "team-a", Window: "monthly", Amount: 2000, WebhookURL: "hooks.example.com"},
+		{Field: "namespace", Value: "team-a", Window: "monthly", Amount: 2000, WebhookFormat: "teams"},
+	} {
+		assert.Assert(t, invalid.Validate() != nil, "%+v", invalid)
+	}
+
+	// budgets are stored in the config, keyed by their aggregation and window
+	assert.NilError(t, cloud.ValidateCustomPricingValue("Budgets", `[{"field":"namespace","value":"team-a","window":"monthly","amount":2000}]`))
+	err := cloud.ValidateCustomPricingValue("Budgets", `[{"field":"namespace","value":"team-a","window":"monthly","amount":2000},{"field":"namespace","value":"team-a","window":"monthly","amount":100}]`)
+	assert.ErrorContains(t, err, "namespace:team-a:monthly")
+}
+
+func TestBudgetPeriod(t *testing.T) {
+	now := time.Date(2020, 2, 13, 15, 4, 5, 0, time.UTC) // a Thursday
+	start, end := costModel.BudgetPeriod(cloud.BudgetMonthly, now)
+	assert.Equal(t, start, time.Date(2020, 2, 1, 0, 0, 0, 0, time.UTC))
+	assert.Equal(t, end, time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC))
+
+	start, end = costModel.BudgetPeriod(cloud.BudgetWeekly, now)
+	assert.Equal(t, start, time.Date(2020, 2, 10, 0, 0, 0, 0, time.UTC))
+	assert.Equal(t, end, time.Date(2020, 2, 17, 0, 0, 0, 0, time.UTC))
+
+	// weeks start on Monday, so Sunday is the last day of its week
+	start, _ = costModel.BudgetPeriod(cloud.BudgetWeekly, time.Date(2020, 2, 16, 23, 0, 0, 0, time.UTC))
+	assert.Equal(t, start, time.Date(2020, 2, 10, 0, 0, 0, 0, time.UTC))
+}
+
+func TestBudgetEvaluatorAlertsEachThresholdOnce(t *testing.T) {
+	var bodies []string
+	var lock sync.Mutex
+	webhook := newBudgetWebhook(&bodies, &lock)
+	defer webhook.Close()
+
+	cp := newTestProvider(t)
+	_, err := cp.UpdateConfig(strings.NewReader(`{"budgets":"[{\"field\":\"namespace\",\"value\":\"team-a\",\"window\":\"monthly\",\"amount\":2000},{\"field\":\"namespace\",\"value\":\"team-b\",\"window\":\"monthly\",\"amount\":1000,\"webhookFormat\":\"slack\"}]"}`), "")
+	assert.NilError(t, err)
+
+	// the spend of each namespace is reported once, by the first range queried after it's spent
+	spend := map[string]float64{"team-a": 1700, "team-b": 100}
+	spent := map[string]float64{}
+	var queried []time.Time
+	costData := func(start, end time.Time) (map[string]*costModel.CostData, error) {
+		queried = append(queried, start, end)
+		data := map[string]*costModel.CostData{}
+		for _, namespace := range []string{"team-a", "team-b"} {
+			for k, v := range newSpendCostData(namespace, spend[namespace]-spent[namespace]) {
+				data[k] = v
+			}
+			spent[namespace] = spend[namespace]
+		}
+		return data, nil
+	}
+	stateFile, err := ioutil.TempFile("", "budget-alerts")
+	assert.NilError(t, err)
+	stateFile.Close()
+	os.Remove(stateFile.Name())
+	defer os.Remove(stateFile.Name())
+
+	e := costModel.NewBudgetEvaluator(func() cloud.Provider { return cp }, time.Hour, webhook.URL, stateFile.Name(), costData)
+	now := time.Date(2020, 2, 15, 12, 30, 0, 0, time.UTC)
+	assert.NilError(t, e.Evaluate(now))
+
+	// both budgets of the month are evaluated by one query until the last whole hour
+	assert.DeepEqual(t, queried, []time.Time{time.Date(2020, 2, 1, 0, 0, 0, 0, time.UTC), time.Date(2020, 2, 15, 12, 0, 0, 0, time.UTC)})
+	statuses, err := e.Statuses()
+	assert.NilError(t, err)
+	assert.Equal(t, len(statuses), 2)
+	assert.Equal(t, statuses[0].Budget.ID, "namespace:team-a:monthly")
+	assert.Equal(t, statuses[0].Spend, 1700.0)
+	assert.Equal(t, statuses[0].SpendFraction, 0.85)
+	assert.Equal(t, statuses[0].AlertedThreshold, 0.8)
+	assert.Equal(t, statuses[0].PeriodStart, "2020-02-01T00:00:00Z")
+	assert.Equal(t, statuses[0].Currency, "USD")
+	assert.Equal(t, statuses[1].AlertedThreshold, 0.0)
+
+	assert.Equal(t, len(bodies), 1)
+	var alert costModel.BudgetAlert
+	assert.NilError(t, json.Unmarshal([]byte(bodies[0]), &alert))
+	assert.Equal(t, alert.Budget.ID, "namespace:team-a:monthly")
+	assert.Equal(t, alert.Threshold, 0.8)
+	assert.Equal(t, alert.Spend, 1700.0)
+
+	// a new evaluator only adds the spend since the last evaluation, and a threshold alerted in the period isn't
+	// alerted again
+	e = costModel.NewBudgetEvaluator(func() cloud.Provider { return cp }, time.Hour, webhook.URL, stateFile.Name(), costData)
+	assert.NilError(t, e.Evaluate(now.Add(time.Hour)))
+	assert.DeepEqual(t, queried[2:], []time.Time{time.Date(2020, 2, 15, 12, 0, 0, 0, time.UTC), time.Date(2020, 2, 15, 13, 0, 0, 0, time.UTC)})
+	statuses, err = e.Statuses()
+	assert.NilError(t, err)
+	assert.Equal(t, statuses[0].Spend, 1700.0)
+	assert.Equal(t, len(bodies), 1)
+
+	// evaluating again within the same hour queries nothing
+	assert.NilError(t, e.Evaluate(now.Add(time.Hour+time.Minute)))
+	assert.Equal(t, len(queried), 4)
+
+	// crossing more than one threshold at once alerts the highest, in the format of the budget
+	spend["team-a"], spend["team-b"] = 2100, 1200
+	assert.NilError(t, e.Evaluate(now.Add(2*time.Hour)))
+	assert.Equal(t, queried[len(queried)-2], time.Date(2020, 2, 15, 13, 0, 0, 0, time.UTC))
+	assert.Equal(t, len(bodies), 3)
+	for _, body := range bodies[1:] {
+		if strings.Contains(body, `"text"`) {
+			assert.Assert(t, strings.Contains(body, "namespace team-b has spent 1200.00 of its monthly budget of 1000.00 (120%) since 2020-02-01"), body)
+		} else {
+			assert.NilError(t, json.Unmarshal([]byte(body), &alert))
+			assert.Equal(t, alert.Threshold, 1.0)
+		}
+	}
+
+	// spend and thresholds start over in the next period
+	spend["team-b"] = 0
+	spent = map[string]float64{}
+	assert.NilError(t, e.Evaluate(time.Date(2020, 3, 2, 0, 0, 0, 0, time.UTC)))
+	assert.Equal(t, len(bodies), 4)
+	assert.Equal(t, queried[len(queried)-2], time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC))
+	statuses, err = e.Statuses()
+	assert.NilError(t, err)
+	assert.Equal(t, statuses[0].Spend, 2100.0)
+	assert.Equal(t, statuses[1].Spend, 0.0)
+}
+
+func TestBudgetEvaluatorConvertsSpend(t *testing.T) {
+	os.Setenv("CURRENCY", "EUR")
+	defer os.Unsetenv("CURRENCY")
+	cp := newTestProvider(t)
+	_, err := cp.UpdateConfig(strings.NewReader(`{"currencyRates":"EUR:0.5","budgets":"[{\"field\":\"namespace\",\"value\":\"team-a\",\"window\":\"monthly\",\"amount\":100}]"}`), "")
+	assert.NilError(t, err)
+	e := costModel.NewBudgetEvaluator(func() cloud.Provider { return cp }, time.Hour, "", "", func(start, end time.Time) (map[string]*costModel.CostData, error) {
+		return newSpendCostData("team-a", 150), nil
+	})
+
+	// the budget amount is in the default currency, so the spend is converted to it
+	assert.NilError(t, e.Evaluate(time.Date(2020, 2, 13, 15, 0, 0, 0, time.UTC)))
+	statuses, err := e.Statuses()
+	assert.NilError(t, err)
+	assert.Equal(t, statuses[0].Currency, "EUR")
+	assert.Equal(t, statuses[0].Spend, 75.0)
+	assert.Equal(t, statuses[0].SpendFraction, 0.75)
+}
+
+func TestBudgetEvaluatorRetriesFailedAlerts(t *testing.T) {
+	var lock sync.Mutex
+	failing := true
+	calls := 0
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		calls++
+		if failing {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	callCount := func() int {
+		lock.Lock()
+		defer lock.Unlock()
+		return calls
+	}
+	defer webhook.Close()
+
+	cp := newTestProvider(t)
+	_, err := cp.UpdateConfig(strings.NewReader(`{"budgets":"[{\"field\":\"namespace\",\"value\":\"team-a\",\"window\":\"weekly\",\"amount\":100,\"webhookURL\":\"`+webhook.URL+`\"}]"}`), "")
+	assert.NilError(t, err)
+	e := costModel.NewBudgetEvaluator(func() cloud.Provider { return cp }, time.Hour, "", "", func(start, end time.Time) (map[string]*costModel.CostData, error) {
+		return newSpendCostData("team-a", 150), nil
+	})
+
+	now := time.Date(2020, 2, 13, 15, 0, 0, 0, time.UTC)
+	assert.NilError(t, e.Evaluate(now))
+	assert.Equal(t, callCount(), 1)
+	statuses, err := e.Statuses()
+	assert.NilError(t, err)
+	assert.Equal(t, statuses[0].AlertedThreshold, 0.0)
+
+	lock.Lock()
+	failing = false
+	lock.Unlock()
+	assert.NilError(t, e.Evaluate(now.Add(time.Hour)))
+	assert.NilError(t, e.Evaluate(now.Add(2*time.Hour)))
+	assert.Equal(t, callCount(), 2)
+}
+
+func TestBudgetEndpoints(t *testing.T) {
+	a := &costModel.Accesses{Cloud: newTestProvider(t)}
+	request := func(handler func(http.ResponseWriter, *http.Request, httprouter.Params), method, path, body string, params httprouter.Params) (int, *costModel.DataEnvelope) {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(method, path, strings.NewReader(body)), params)
+		var envelope costModel.DataEnvelope
+		assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &envelope))
+		return w.Code, &envelope
+	}
+
+	code, envelope := request(a.CreateBudget, "POST", "/budgets", `{"field":"namespace","value":"team-a","window":"monthly","amount":2000}`, nil)
+	assert.Equal(t, code, http.StatusOK, envelope.Message)
+	assert.Equal(t, envelope.Data.(map[string]interface{})["id"], "namespace:team-a:monthly")
+
+	code, _ = request(a.CreateBudget, "POST", "/budgets", `{"field":"namespace","value":"team-a","window":"monthly","amount":3000}`, nil)
+	assert.Equal(t, code, http.StatusBadRequest)
+	code, envelope = request(a.CreateBudget, "POST", "/budgets", `{"field":"pods","value":"web","window":"monthly","amount":3000}`, nil)
+	assert.Equal(t, code, http.StatusBadRequest)
+	assert.Equal(t, envelope.Errors[0].Param, "aggregation")
+
+	id := httprouter.Params{{Key: "id", Value: "namespace:team-a:monthly"}}
+	code, _ = request(a.UpdateBudget, "PUT", "/budgets/namespace:team-a:monthly", `{"field":"namespace","value":"team-a","window":"weekly","amount":500}`, id)
+	assert.Equal(t, code, http.StatusOK)
+	code, _ = request(a.DeleteBudget, "DELETE", "/budgets/namespace:team-a:monthly", "", id)
+	assert.Equal(t, code, http.StatusNotFound)
+
+	code, envelope = request(a.Budgets, "GET", "/budgets", "", nil)
+	assert.Equal(t, code, http.StatusOK)
+	budgets := envelope.Data.([]interface{})
+	assert.Equal(t, len(budgets), 1)
+	assert.Equal(t, budgets[0].(map[string]interface{})["id"], "namespace:team-a:weekly")
+
+	code, envelope = request(a.DeleteBudget, "DELETE", "/budgets/namespace:team-a:weekly", "", httprouter.Params{{Key: "id", Value: "namespace:team-a:weekly"}})
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, len(envelope.Data.([]interface{})), 0)
+}
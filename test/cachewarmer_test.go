@@ -0,0 +1,41 @@
+package costmodel_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+
+	costModel "github.com/kubecost/cost-model/costmodel"
+)
+
+func TestWarmCache(t *testing.T) {
+	server, _ := newSlowPrometheus(t, 0, false)
+	defer server.Close()
+	a := newTestAccesses(t, server.URL, "")
+	refresher := costModel.NewPricingRefresher(&flakyProvider{Provider: a.Cloud, failures: 1}, time.Hour, nil)
+
+	done := a.WarmCache(refresher, []string{"1h", "1d"})
+
+	// warming waits for pricing data to be downloaded
+	assert.ErrorContains(t, refresher.Refresh(), "pricing API unavailable")
+	select {
+	case <-done:
+		t.Fatal("expected warming to wait for pricing data")
+	case <-time.After(50 * time.Millisecond):
+	}
+	assert.Equal(t, a.Cache.ItemCount(), 0)
+
+	assert.NilError(t, refresher.Refresh())
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("cache warming did not complete")
+	}
+	assert.Equal(t, a.Cache.ItemCount(), 2)
+
+	// requests for the warmed windows hit the cache
+	envelope := getAggregatedCostModel(t, a, "aggregation=namespace&window=1d")
+	assert.Assert(t, strings.HasPrefix(envelope.Message, "cache hit"), envelope.Message)
+}
@@ -0,0 +1,62 @@
+package costmodel_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"gotest.tools/assert"
+
+	costModel "github.com/kubecost/cost-model/costmodel"
+)
+
+func TestCostCategories(t *testing.T) {
+	cp := newTestProvider(t)
+
+	all := costModel.AggregateCostModel(cp, newTestCostData(), "namespace", "", true, 0, 1.0, nil)["test1"]
+	assert.Assert(t, all.CPUCost > 0 && all.RAMCost > 0 && all.PVCost > 0)
+
+	categories, err := costModel.ParseCostCategories("cpu, RAM")
+	assert.NilError(t, err)
+	assert.Equal(t, categories.String(), "cpu,ram")
+	aggs := costModel.AggregateCostModel(cp, costModel.FilterCostCategories(newTestCostData(), categories), "namespace", "", true, 0, 1.0, nil)
+	costModel.AddSharedCost(aggs, 3.0)
+	costModel.ApplyCostCategories(aggs, categories)
+
+	agg := aggs["test1"]
+	assert.Equal(t, agg.CPUCost, all.CPUCost)
+	assert.Equal(t, agg.RAMCost, all.RAMCost)
+	assert.Equal(t, agg.PVCost, 0.0)
+	assert.Equal(t, agg.SharedCost, 0.0)
+	assert.Equal(t, agg.TotalCost, agg.CPUCost+agg.RAMCost)
+
+	// the vectors of excluded categories are omitted
+	resp, err := json.Marshal(agg)
+	assert.NilError(t, err)
+	assert.Assert(t, strings.Contains(string(resp), "cpuCostVector"))
+	assert.Assert(t, !strings.Contains(string(resp), "pvCostVector"), string(resp))
+
+	// no categories include every category
+	categories, err = costModel.ParseCostCategories("")
+	assert.NilError(t, err)
+	assert.Assert(t, categories.Includes(costModel.CostCategoryPV))
+	aggs = costModel.AggregateCostModel(cp, costModel.FilterCostCategories(newTestCostData(), categories), "namespace", "", true, 0, 1.0, nil)
+	costModel.ApplyCostCategories(aggs, categories)
+	assert.Equal(t, aggs["test1"].TotalCost, all.TotalCost)
+
+	_, err = costModel.ParseCostCategories("cpu,storage")
+	assert.ErrorContains(t, err, "storage")
+}
+
+func TestAggregateCostModelInvalidCategories(t *testing.T) {
+	server, _ := newSlowPrometheus(t, 0, false)
+	defer server.Close()
+	a := newTestAccesses(t, server.URL, "")
+
+	w := httptest.NewRecorder()
+	a.AggregateCostModel(w, httptest.NewRequest("GET", "/aggregatedCostModel?window=1d&aggregation=namespace&categories=cpu,disk", nil), nil)
+	assert.Equal(t, w.Code, http.StatusBadRequest)
+	assert.Assert(t, strings.Contains(w.Body.String(), "disk"), w.Body.String())
+}
@@ -0,0 +1,138 @@
+package costmodel_test
+
+import (
+	"fmt"
+	"math"
+	"testing"
+
+	"gotest.tools/assert"
+
+	"github.com/kubecost/cost-model/cloud"
+	costModel "github.com/kubecost/cost-model/costmodel"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// catalogKey is the key of a node priced by a catalogProvider
+type catalogKey struct {
+	labels map[string]string
+}
+
+func (k *catalogKey) ID() string       { return "" }
+func (k *catalogKey) Features() string { return k.labels[v1.LabelInstanceType] }
+func (k *catalogKey) GPUType() string  { return "" }
+
+// catalogProvider prices nodes by their instance type from a catalog, as providers with a price list do
+type catalogProvider struct {
+	cloud.Provider
+	catalog map[string]cloud.Node
+}
+
+func (p *catalogProvider) GetKey(labels map[string]string) cloud.Key {
+	return &catalogKey{labels: labels}
+}
+
+func (p *catalogProvider) NodePricing(key cloud.Key) (*cloud.Node, error) {
+	node, ok := p.catalog[key.Features()]
+	if !ok {
+		return nil, fmt.Errorf("no pricing for %s", key.Features())
+	}
+	return &node, nil
+}
+
+func newSizedNode(name, instanceType, cpu, ram string) *v1.Node {
+	node := newTestNode(name, instanceType)
+	node.Status.Capacity = v1.ResourceList{
+		v1.ResourceCPU:    resource.MustParse(cpu),
+		v1.ResourceMemory: resource.MustParse(ram),
+	}
+	return node
+}
+
+func TestComputeClusterSizing(t *testing.T) {
+	base := newTestProvider(t)
+	assert.NilError(t, base.DownloadPricingData())
+	cp := &catalogProvider{Provider: base, catalog: map[string]cloud.Node{
+		"m5.large":   {VCPU: "2", RAM: "8 GiB", Cost: "0.096"},
+		"m5.xlarge":  {VCPU: "4", RAM: "16 GiB", Cost: "0.192"},
+		"m5.2xlarge": {VCPU: "8", RAM: "32 GiB", Cost: "0.384"},
+		"t3.small":   {VCPU: "2", RAM: "2 GiB", Cost: "0.02"},
+		"x1.mystery": {Cost: "1.0"},
+	}}
+
+	gib := 1073741824.0
+	costData := map[string]*costModel.CostData{
+		"default,web,nginx,node-1": {
+			CPUReq: newVectors(2, 3), RAMReq: newVectors(4*gib, 6*gib),
+			CPUUsed: newVectors(1, 1), RAMUsed: newVectors(gib, gib),
+		},
+		"default,batch,worker,node-2": {
+			CPUReq: newVectors(1, 2), RAMReq: newVectors(2*gib, 4*gib),
+			CPUUsed: newVectors(1, 1), RAMUsed: newVectors(gib, gib),
+		},
+	}
+	// newer kubelets may only set the stable instance type label
+	stable := newSizedNode("node-3", "", "4", "16Gi")
+	delete(stable.Labels, v1.LabelInstanceType)
+	stable.Labels["node.kubernetes.io/instance-type"] = "m5.xlarge"
+	cache := fakeClusterCache{
+		nodes: []*v1.Node{
+			newSizedNode("node-1", "m5.xlarge", "4", "16Gi"),
+			newSizedNode("node-2", "m5.xlarge", "4", "16Gi"),
+			stable,
+		},
+		pods: []*v1.Pod{
+			newRequestsPod("big", "node-1", v1.PodRunning, "3"),
+			newRequestsPod("small", "node-2", v1.PodRunning, "500m"),
+			// terminated pods neither count nor need to fit
+			newRequestsPod("done", "node-3", v1.PodSucceeded, "8"),
+		},
+	}
+
+	sizing, err := costModel.ComputeClusterSizing(cache, cp, costData, 0.2, []string{"m5.large", "m5.2xlarge", "t3.small", "x1.mystery", "x1.unpriced"}, 0)
+	assert.NilError(t, err)
+	assert.Equal(t, sizing.Nodes, 3)
+	assert.Equal(t, sizing.CPUAllocatable, 12.0)
+	assert.Equal(t, sizing.CPURequests.Peak, 5.0)
+	assert.Equal(t, sizing.RAMRequests.Peak, 10*gib)
+	assert.Equal(t, sizing.CPUUsage.P95, 2.0)
+	assert.Equal(t, sizing.Pods, 2)
+	assert.Equal(t, sizing.PodsRequired, 3)
+	assert.Equal(t, sizing.LargestPodCPU, 3.0)
+	assert.Assert(t, math.Abs(sizing.CPURequired-6) < 1e-9, sizing.CPURequired)
+	assert.Assert(t, math.Abs(sizing.RAMRequired-12*gib) < 1e-3, sizing.RAMRequired)
+
+	statuses := map[string]string{}
+	cores := map[string]float64{}
+	for _, nodeType := range sizing.NodeTypes {
+		statuses[nodeType.InstanceType] = nodeType.Status
+		cores[nodeType.InstanceType] = nodeType.CPUCores
+	}
+	assert.DeepEqual(t, statuses, map[string]string{
+		"m5.large":    costModel.ClusterSizingTooSmall,
+		"m5.xlarge":   "",
+		"m5.2xlarge":  "",
+		"t3.small":    costModel.ClusterSizingTooSmall,
+		"x1.mystery":  costModel.ClusterSizingUnknownCapacity,
+		"x1.unpriced": costModel.ClusterSizingNotPriced,
+	})
+
+	// candidates are compared by their capacity less what the kubelet is estimated to reserve, as the current
+	// nodes are by what they report allocatable
+	assert.Assert(t, math.Abs(cores["m5.large"]-1.93) < 1e-9, cores["m5.large"])
+	assert.Equal(t, cores["m5.xlarge"], 4.0)
+
+	// one m5.xlarge fits the largest pod, but no smaller node the remaining 2 cores, so one m5.2xlarge is cheapest
+	assert.DeepEqual(t, sizing.Recommendation, []*costModel.NodeTypeCount{{InstanceType: "m5.2xlarge", Count: 1, HourlyCost: 0.384}})
+	assert.Assert(t, math.Abs(sizing.CurrentMonthlyCost-0.576*730) < 1e-9, sizing.CurrentMonthlyCost)
+	assert.Assert(t, math.Abs(sizing.MonthlySavings-0.192*730) < 1e-9, sizing.MonthlySavings)
+
+	// without candidates, the recommendation is of the present type, and no type fits a pod larger than any node
+	sizing, err = costModel.ComputeClusterSizing(cache, cp, costData, 0.2, nil, 0)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, sizing.Recommendation, []*costModel.NodeTypeCount{{InstanceType: "m5.xlarge", Count: 2, HourlyCost: 0.192}})
+
+	cache.pods = append(cache.pods, newRequestsPod("huge", "node-3", v1.PodPending, "6"))
+	_, err = costModel.ComputeClusterSizing(cache, cp, costData, 0.2, nil, 0)
+	assert.ErrorContains(t, err, "largest pod")
+}
@@ -0,0 +1,175 @@
+package costmodel_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"gotest.tools/assert"
+
+	costModel "github.com/kubecost/cost-model/costmodel"
+)
+
+func postConfigBulk(t *testing.T, a *costModel.Accesses, body string) (int, *costModel.DataEnvelope) {
+	w := httptest.NewRecorder()
+	a.UpdateConfigBulk(w, httptest.NewRequest("POST", "/updateConfigBulk", strings.NewReader(body)), nil)
+	envelope := &costModel.DataEnvelope{}
+	err := json.Unmarshal(w.Body.Bytes(), envelope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w.Code, envelope
+}
+
+func TestUpdateConfigBulk(t *testing.T) {
+	a := &costModel.Accesses{Cloud: newTestProvider(t)}
+
+	code, envelope := postConfigBulk(t, a, `{"discount":"10%","clusterName":"test-cluster"}`)
+	assert.Equal(t, code, http.StatusOK)
+	config, ok := envelope.Data.(map[string]interface{})
+	assert.Assert(t, ok)
+	assert.Equal(t, config["discount"], "10%")
+	assert.Equal(t, config["clusterName"], "test-cluster")
+
+	c, err := a.Cloud.GetConfig()
+	assert.NilError(t, err)
+	assert.Equal(t, c.Discount, "10%")
+	assert.Equal(t, c.ClusterName, "test-cluster")
+}
+
+func TestUpdateConfigBulkRejectsInvalidKeys(t *testing.T) {
+	a := &costModel.Accesses{Cloud: newTestProvider(t)}
+
+	code, envelope := postConfigBulk(t, a, `{"discount":"10%","notAKey":"foo","alsoNotAKey":"bar"}`)
+	assert.Equal(t, code, http.StatusBadRequest)
+	assert.Equal(t, envelope.Status, "error")
+	rejected, ok := envelope.Data.(map[string]interface{})
+	assert.Assert(t, ok)
+	assert.Equal(t, len(rejected), 2)
+	_, ok = rejected["notAKey"]
+	assert.Assert(t, ok)
+	_, ok = rejected["alsoNotAKey"]
+	assert.Assert(t, ok)
+
+	// valid keys of a rejected update are not applied
+	c, err := a.Cloud.GetConfig()
+	assert.NilError(t, err)
+	assert.Assert(t, c.Discount != "10%")
+}
+
+func getConfig(t *testing.T, a *costModel.Accesses, query string) (int, *costModel.DataEnvelope) {
+	w := httptest.NewRecorder()
+	a.GetConfig(w, httptest.NewRequest("GET", "/getConfig?"+query, nil), nil)
+	envelope := &costModel.DataEnvelope{}
+	err := json.Unmarshal(w.Body.Bytes(), envelope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w.Code, envelope
+}
+
+func TestGetConfigByKey(t *testing.T) {
+	a := &costModel.Accesses{Cloud: newTestProvider(t)}
+	_, err := a.Cloud.UpdateConfig(strings.NewReader(`{"discount":"10%","clusterName":"test-cluster"}`), "")
+	assert.NilError(t, err)
+
+	code, envelope := getConfig(t, a, "key=discount")
+	assert.Equal(t, code, http.StatusOK)
+	config, ok := envelope.Data.(map[string]interface{})
+	assert.Assert(t, ok)
+	assert.Equal(t, len(config), 1)
+	assert.Equal(t, config["discount"], "10%")
+
+	code, envelope = getConfig(t, a, "key=discount,ClusterName")
+	assert.Equal(t, code, http.StatusOK)
+	config = envelope.Data.(map[string]interface{})
+	assert.Equal(t, len(config), 2)
+	assert.Equal(t, config["clusterName"], "test-cluster")
+}
+
+func TestGetConfigUnknownKey(t *testing.T) {
+	a := &costModel.Accesses{Cloud: newTestProvider(t)}
+
+	code, envelope := getConfig(t, a, "key=discount&key=notAKey")
+	assert.Equal(t, code, http.StatusBadRequest)
+	assert.Equal(t, envelope.Status, "error")
+	assert.Assert(t, strings.Contains(envelope.Message, "notAKey"))
+}
+
+func TestGetConfigWithoutKey(t *testing.T) {
+	a := &costModel.Accesses{Cloud: newTestProvider(t)}
+
+	code, envelope := getConfig(t, a, "")
+	assert.Equal(t, code, http.StatusOK)
+	config, ok := envelope.Data.(map[string]interface{})
+	assert.Assert(t, ok)
+	assert.Equal(t, config["provider"], "custom")
+	_, ok = config["CPU"]
+	assert.Assert(t, ok)
+}
+
+func postConfigByKey(t *testing.T, a *costModel.Accesses, body string) (int, *costModel.DataEnvelope) {
+	w := httptest.NewRecorder()
+	a.UpdateConfigByKey(w, httptest.NewRequest("POST", "/updateConfigByKey", strings.NewReader(body)), nil)
+	envelope := &costModel.DataEnvelope{}
+	err := json.Unmarshal(w.Body.Bytes(), envelope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w.Code, envelope
+}
+
+func TestUpdateConfigByKeyReturnsFullConfig(t *testing.T) {
+	a := &costModel.Accesses{Cloud: newTestProvider(t)}
+
+	code, envelope := postConfigByKey(t, a, `{"CPU":"0.04","discount":"15%","currencyCode":"eur"}`)
+	assert.Equal(t, code, http.StatusOK)
+	config, ok := envelope.Data.(map[string]interface{})
+	assert.Assert(t, ok)
+	assert.Equal(t, config["CPU"], "0.04")
+	assert.Equal(t, config["discount"], "15%")
+	assert.Equal(t, config["provider"], "custom")
+	_, ok = config["RAM"]
+	assert.Assert(t, ok)
+}
+
+func TestUpdateConfigByKeyRejectsInvalidValues(t *testing.T) {
+	a := &costModel.Accesses{Cloud: newTestProvider(t)}
+
+	for _, body := range []string{
+		`{"CPU":"0,031"}`,
+		`{"RAM":"-0.004"}`,
+		`{"discount":"-5%"}`,
+		`{"discount":"150%"}`,
+		`{"discount":"10"}`,
+		`{"currencyCode":"DOLLARS"}`,
+		`{"CPU":"0.04","ramUnit":"mebibytes"}`,
+	} {
+		code, envelope := postConfigByKey(t, a, body)
+		assert.Equal(t, code, http.StatusBadRequest, body)
+		assert.Equal(t, envelope.Status, "error", body)
+		assert.Equal(t, envelope.ErrorCode, costModel.ErrorCodeInvalidConfig, body)
+	}
+
+	// the previous config is retained, including the valid keys of a rejected update
+	c, err := a.Cloud.GetConfig()
+	assert.NilError(t, err)
+	assert.Equal(t, c.CPU, "0.031611")
+	assert.Assert(t, c.Discount != "-5%")
+}
+
+func TestUpdateConfigByKeyRejectsUnknownKeys(t *testing.T) {
+	a := &costModel.Accesses{Cloud: newTestProvider(t)}
+
+	code, envelope := postConfigByKey(t, a, `{"cpuPrice":"0.04"}`)
+	assert.Equal(t, code, http.StatusBadRequest)
+	rejected, ok := envelope.Data.(map[string]interface{})
+	assert.Assert(t, ok)
+	_, ok = rejected["cpuPrice"]
+	assert.Assert(t, ok)
+	assert.Assert(t, strings.Contains(envelope.Message, "valid keys are: "))
+	assert.Assert(t, strings.Contains(envelope.Message, "discount"))
+	assert.Equal(t, envelope.ErrorCode, costModel.ErrorCodeInvalidConfig)
+}
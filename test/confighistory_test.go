@@ -0,0 +1,103 @@
+package costmodel_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"gotest.tools/assert"
+
+	costModel "github.com/kubecost/cost-model/costmodel"
+)
+
+func rollbackConfig(t *testing.T, a *costModel.Accesses, revision string) (int, *costModel.DataEnvelope) {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/getConfigs/rollback/"+revision, nil)
+	r.Header.Set("X-User", "carol")
+	a.RollbackConfig(w, r, httprouter.Params{httprouter.Param{Key: "revision", Value: revision}})
+	envelope := &costModel.DataEnvelope{}
+	err := json.Unmarshal(w.Body.Bytes(), envelope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w.Code, envelope
+}
+
+func TestConfigHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config-history")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "history.json")
+	a := &costModel.Accesses{Cloud: newTestProvider(t), ConfigHistory: costModel.NewConfigHistory(path, 2)}
+
+	for _, update := range []struct{ user, body string }{
+		{"alice", `{"discount":"20%"}`},
+		{"bob", `{"discount":"5%","clusterName":"prod"}`},
+	} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/updateConfigByKey", strings.NewReader(update.body))
+		r.Header.Set("X-User", update.user)
+		a.UpdateConfigByKey(w, r, nil)
+		assert.Equal(t, w.Code, http.StatusOK)
+	}
+
+	revisions := a.ConfigHistory.Revisions()
+	assert.Equal(t, len(revisions), 2)
+	assert.Equal(t, revisions[1].User, "bob")
+	assert.Equal(t, len(revisions[1].Changes), 2)
+	assert.DeepEqual(t, revisions[1].Changes[0], &costModel.ConfigChange{Key: "discount", Old: "20%", New: "5%"})
+
+	code, envelope := rollbackConfig(t, a, "1")
+	assert.Equal(t, code, http.StatusOK)
+	config := envelope.Data.(map[string]interface{})
+	assert.Equal(t, config["discount"], "20%")
+	assert.Equal(t, config["clusterName"], "")
+
+	// the rollback is itself a revision, and the history is capped at 2 revisions
+	revisions = a.ConfigHistory.Revisions()
+	assert.Equal(t, len(revisions), 2)
+	assert.Equal(t, revisions[0].Revision, 2)
+	assert.Equal(t, revisions[1].Revision, 3)
+	assert.Equal(t, revisions[1].User, "carol")
+
+	// the history survives restarts, and rolling back past its start is rejected
+	restored := costModel.NewConfigHistory(path, 2)
+	assert.DeepEqual(t, restored.Revisions(), revisions)
+	a.ConfigHistory = restored
+	code, _ = rollbackConfig(t, a, "1")
+	assert.Equal(t, code, http.StatusBadRequest)
+}
+
+func TestConfigHistoryRedactsSecrets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config-history")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+	h := costModel.NewConfigHistory(filepath.Join(dir, "history.json"), 10)
+
+	cp := newTestProvider(t)
+	for _, update := range []string{`{"clusterName":"prod"}`, `{"azureClientSecret":"hunter2"}`} {
+		before, err := cp.GetConfig()
+		assert.NilError(t, err)
+		after, err := cp.UpdateConfig(strings.NewReader(update), "")
+		assert.NilError(t, err)
+		_, err = h.Record(before, after, "")
+		assert.NilError(t, err)
+	}
+
+	revisions := h.Revisions()
+	assert.Equal(t, len(revisions), 2)
+	assert.Equal(t, len(revisions[1].Changes), 1)
+	assert.Equal(t, revisions[1].Changes[0].Key, "azureClientSecret")
+	assert.Assert(t, revisions[1].Changes[0].New != "hunter2")
+
+	// secrets can't be restored from the history, so aren't rolled back
+	updates, err := h.RollbackUpdates(1)
+	assert.NilError(t, err)
+	assert.Equal(t, len(updates), 0)
+}
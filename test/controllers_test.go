@@ -0,0 +1,57 @@
+package costmodel_test
+
+import (
+	"testing"
+
+	"gotest.tools/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	costModel "github.com/kubecost/cost-model/costmodel"
+)
+
+// newTestControllerCostData returns the test cost data with the foo container owned by controllers of each kind,
+// and the bar container by none
+func newTestControllerCostData() map[string]*costModel.CostData {
+	costData := newTestCostData()
+	foo := costData["test1,foo,nginx,testnode"]
+	foo.Deployments = []string{"web"}
+	foo.Statefulsets = []string{"db"}
+	foo.Daemonsets = []string{"agent"}
+	foo.Jobs = []string{"backup", "migrate"}
+	return costData
+}
+
+func TestAggregateByControllerKind(t *testing.T) {
+	cp := newTestProvider(t)
+	total := totalAggregationCost(costModel.AggregateCostModel(cp, newTestCostData(), "namespace", "", false, 0, 1.0, nil))
+
+	for field, key := range map[string]string{
+		"deployment":  "web",
+		"statefulset": "db",
+		"daemonset":   "agent",
+		"job":         "backup",
+	} {
+		aggs := costModel.AggregateCostModel(cp, newTestControllerCostData(), field, "", false, 0, 1.0, nil)
+		assert.Equal(t, len(aggs), 1, field)
+		agg, ok := aggs[key]
+		assert.Assert(t, ok, field)
+		assert.Equal(t, agg.Aggregator, field)
+		assert.Equal(t, agg.TotalCost, total/2, field)
+	}
+}
+
+func TestPodControllers(t *testing.T) {
+	controller := true
+	pod := v1.Pod{ObjectMeta: metav1.ObjectMeta{OwnerReferences: []metav1.OwnerReference{
+		{Kind: "Job", Name: "b"},
+		{Kind: "StatefulSet", Name: "db"},
+		{Kind: "Job", Name: "c", Controller: &controller},
+		{Kind: "Job", Name: "a"},
+	}}}
+
+	// the managing controller comes first, then other owners by name
+	assert.DeepEqual(t, costModel.PodControllers(pod, "Job"), []string{"c", "a", "b"})
+	assert.DeepEqual(t, costModel.PodControllers(pod, "StatefulSet"), []string{"db"})
+	assert.DeepEqual(t, costModel.PodControllers(pod, "DaemonSet"), []string{})
+}
@@ -0,0 +1,103 @@
+package costmodel_test
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+
+	costModel "github.com/kubecost/cost-model/costmodel"
+	batchv1 "k8s.io/api/batch/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// newReindexPrometheus returns a fake Prometheus with samples over the hour to 13:00 of three runs of the CronJob
+// reindex, one of whose pod and Job are since deleted, and of the pod of the Job migrate. kube-state-metrics
+// recorded the owners of the deleted pod and of the Jobs of the CronJob.
+func newReindexPrometheus(t *testing.T) *httptest.Server {
+	pods := []string{"reindex-28472755-b2m9s", "reindex-28472815-xk2lp", "reindex-28472875-q8w4n", "migrate-7x2kd"}
+	series := func(value string) []interface{} {
+		var result []interface{}
+		for _, pod := range pods {
+			metric := map[string]string{"namespace": "batch", "pod_name": pod, "container_name": "main", "node": "node-1"}
+			result = append(result, promSeries(metric, time.Date(2019, 10, 1, 13, 0, 0, 0, time.UTC), value))
+		}
+		return result
+	}
+	owners := func(objectLabel string, owners map[string]string) []interface{} {
+		var result []interface{}
+		for name, owner := range owners {
+			result = append(result, promSample(map[string]string{"namespace": "batch", objectLabel: name, "owner_name": owner}, "1"))
+		}
+		return result
+	}
+	return newStubPrometheus(t, func(query string, instant bool) []interface{} {
+		if strings.HasPrefix(query, "max(max_over_time(kube_pod_owner") {
+			return owners("pod", map[string]string{"reindex-28472755-b2m9s": "reindex-28472755"})
+		} else if strings.HasPrefix(query, "max(max_over_time(kube_job_owner") {
+			return owners("job_name", map[string]string{"reindex-28472755": "reindex", "reindex-28472875": "reindex"})
+		} else if instant {
+			return []interface{}{promSample(nil, "60")}
+		} else if strings.Contains(query, "kube_pod_container_resource_requests_cpu_cores") {
+			return series("30")
+		} else if strings.Contains(query, "container_cpu_usage_seconds_total") {
+			return series("15")
+		}
+		return nil
+	})
+}
+
+// newJobPod returns a pod of the given Job which ran throughout the hour to 13:00
+func newJobPod(name string, job string) *v1.Pod {
+	return newTestPod(name, "batch", "main", v1.PodSucceeded, ownedBy("Job", job),
+		ranBetween(time.Date(2019, 10, 1, 12, 0, 0, 0, time.UTC), time.Date(2019, 10, 1, 13, 0, 0, 0, time.UTC)))
+}
+
+func TestComputeCostDataRangeCronJobs(t *testing.T) {
+	server := newReindexPrometheus(t)
+	defer server.Close()
+	cp := newTestProvider(t)
+
+	isController := true
+	cm := &costModel.CostModel{Cache: fakeClusterCache{
+		pods: []*v1.Pod{
+			newJobPod("reindex-28472815-xk2lp", "reindex-28472815"),
+			// the Job of which was deleted by the history limit of the CronJob
+			newJobPod("reindex-28472875-q8w4n", "reindex-28472875"),
+			newJobPod("migrate-7x2kd", "migrate"),
+		},
+		jobs: []*batchv1.Job{
+			&batchv1.Job{ObjectMeta: metav1.ObjectMeta{
+				Name:            "reindex-28472815",
+				Namespace:       "batch",
+				OwnerReferences: []metav1.OwnerReference{{Kind: "CronJob", Name: "reindex", Controller: &isController}},
+			}},
+			&batchv1.Job{ObjectMeta: metav1.ObjectMeta{Name: "migrate", Namespace: "batch"}},
+		},
+	}}
+
+	data, _, err := cm.ComputeCostDataRange(newFakePrometheusClient(t, server.URL), nil, cp, "2019-10-01T12:00:00.000Z", "2019-10-01T13:00:00.000Z", "1h", "", "", false, false)
+	assert.NilError(t, err)
+	assert.Equal(t, len(data), 4)
+
+	clusterID := costModel.LocalClusterID(cp)
+	assert.DeepEqual(t, data[clusterID+",batch,reindex-28472815-xk2lp,main,node-1"].CronJobs, []string{"reindex"})
+	assert.DeepEqual(t, data[clusterID+",batch,reindex-28472875-q8w4n,main,node-1"].CronJobs, []string{"reindex"})
+	deleted := data[clusterID+",batch,reindex-28472755-b2m9s,main,node-1"]
+	assert.Assert(t, deleted != nil)
+	assert.DeepEqual(t, deleted.Jobs, []string{"reindex-28472755"})
+	assert.DeepEqual(t, deleted.CronJobs, []string{"reindex"})
+	assert.Equal(t, len(data[clusterID+",batch,migrate-7x2kd,main,node-1"].CronJobs), 0)
+
+	// all the runs of the CronJob aggregate as one
+	cronJobs := costModel.AggregateCostModel(cp, data, "cronjob", "", false, 0, 1.0, nil)
+	assert.Equal(t, len(cronJobs), 1)
+	assert.Assert(t, cronJobs["reindex"] != nil)
+
+	jobs := costModel.AggregateCostModel(cp, data, "job", "", false, 0, 1.0, nil)
+	assert.Equal(t, len(jobs), 2)
+	assert.Assert(t, jobs["migrate"] != nil)
+}
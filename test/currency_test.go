@@ -0,0 +1,115 @@
+package costmodel_test
+
+import (
+	"encoding/json"
+	"math"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	"gotest.tools/assert"
+
+	"github.com/kubecost/cost-model/cloud"
+	costModel "github.com/kubecost/cost-model/costmodel"
+)
+
+func newTestProviderWithRates(t *testing.T, rates string) cloud.Provider {
+	cp := newTestProvider(t)
+	_, err := cp.UpdateConfig(strings.NewReader(`{"discount":"0%","currencyRates":"`+rates+`"}`), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cp
+}
+
+func TestCurrencyRate(t *testing.T) {
+	cp := newTestProviderWithRates(t, "EUR:0.5, gbp:0.25")
+
+	rate, err := costModel.CurrencyRate(cp, "USD")
+	assert.NilError(t, err)
+	assert.Equal(t, rate, 1.0)
+
+	rate, err = costModel.CurrencyRate(cp, "eur")
+	assert.NilError(t, err)
+	assert.Equal(t, rate, 0.5)
+
+	rate, err = costModel.CurrencyRate(cp, "GBP")
+	assert.NilError(t, err)
+	assert.Equal(t, rate, 0.25)
+
+	_, err = costModel.CurrencyRate(cp, "JPY")
+	assert.Assert(t, err != nil)
+}
+
+func TestConvertCurrency(t *testing.T) {
+	cp := newTestProvider(t)
+
+	aggs := costModel.AggregateCostModel(cp, newTestCostData(), "namespace", "", false, 0.0, 1.0, nil)
+	costModel.ConvertAggregationsCurrency(aggs, 0.5)
+	assert.Equal(t, aggs["test1"].TotalCost, 4.0)
+	assert.Equal(t, aggs["test1"].CPUCost+aggs["test1"].RAMCost+aggs["test1"].PVCost, 4.0)
+
+	// converting cost data must not modify the shared node and volume pricing of the original
+	costData := newTestCostData()
+	converted := costModel.ConvertCostDataCurrency(costData, 0.5)
+	for key, cd := range converted {
+		assert.Equal(t, cd.NodeData.VCPUCost, "0.5")
+		assert.Equal(t, cd.PVCData[0].Volume.Cost, "0.5")
+		assert.Equal(t, costData[key].NodeData.VCPUCost, "1.0")
+		assert.Equal(t, costData[key].PVCData[0].Volume.Cost, "1.0")
+	}
+	convertedAggs := costModel.AggregateCostModel(cp, converted, "namespace", "", false, 0.0, 1.0, nil)
+	assert.Assert(t, math.Abs(convertedAggs["test1"].TotalCost-4.0) < 1e-9)
+}
+
+// newTestAccesses returns API handlers backed by a prometheus serving empty results and an empty cluster
+func newTestAccesses(t *testing.T, prometheusAddress string, rates string) *costModel.Accesses {
+	return &costModel.Accesses{
+		PrometheusClient: newFakePrometheusClient(t, prometheusAddress),
+		Cloud:            newTestProviderWithRates(t, rates),
+		Model:            &costModel.CostModel{Cache: fakeClusterCache{}},
+		Cache:            cache.New(time.Minute, time.Minute),
+	}
+}
+
+func getAggregatedCostModel(t *testing.T, a *costModel.Accesses, query string) *costModel.DataEnvelope {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/aggregatedCostModel?"+query, nil)
+	a.AggregateCostModel(w, r, nil)
+	var envelope costModel.DataEnvelope
+	err := json.Unmarshal(w.Body.Bytes(), &envelope)
+	assert.NilError(t, err)
+	return &envelope
+}
+
+func TestAggregateCostModelCacheKeyIncludesCurrency(t *testing.T) {
+	server, _ := newSlowPrometheus(t, 0, false)
+	defer server.Close()
+	a := newTestAccesses(t, server.URL, "EUR:0.5")
+
+	request := func(currency string) *costModel.DataEnvelope {
+		return getAggregatedCostModel(t, a, "aggregation=namespace&window=1h&currency="+currency)
+	}
+
+	usd := request("USD")
+	assert.Equal(t, usd.Currency, "USD")
+	assert.Assert(t, strings.HasPrefix(usd.Message, "cache miss"), usd.Message)
+
+	// a cached USD result must not be served for EUR
+	eur := request("EUR")
+	assert.Equal(t, eur.Currency, "EUR")
+	assert.Assert(t, strings.HasPrefix(eur.Message, "cache miss"), eur.Message)
+
+	usd = request("USD")
+	assert.Equal(t, usd.Currency, "USD")
+	assert.Assert(t, strings.HasPrefix(usd.Message, "cache hit"), usd.Message)
+
+	eur = request("EUR")
+	assert.Equal(t, eur.Currency, "EUR")
+	assert.Assert(t, strings.HasPrefix(eur.Message, "cache hit"), eur.Message)
+
+	unknown := request("JPY")
+	assert.Equal(t, unknown.Status, "error")
+}
@@ -0,0 +1,79 @@
+package costmodel_test
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+	v1 "k8s.io/api/core/v1"
+
+	"github.com/kubecost/cost-model/cloud"
+	costModel "github.com/kubecost/cost-model/costmodel"
+)
+
+func TestCustomPricesByLabel(t *testing.T) {
+	cp := newTestProvider(t)
+	_, err := cp.UpdateConfig(strings.NewReader(`{"customPricesEnabled":"true","CPU":"0.03","RAM":"0.004","customPricesByLabel":"node-pool=general:cpu=0.02,ram=0.002; node-pool=highmem,team=data:cpu=0.01,ram=0.005,gpu=1.5"}`), "")
+	assert.NilError(t, err)
+
+	newCostData := func(labels map[string]string) map[string]*costModel.CostData {
+		return map[string]*costModel.CostData{
+			"cluster,default,pod,container,node": &costModel.CostData{
+				Namespace:     "default",
+				NodeData:      &cloud.Node{VCPUCost: "1.0", RAMCost: "1.0", Labels: labels},
+				CPUAllocation: []*costModel.Vector{&costModel.Vector{Timestamp: 1570000000, Value: 1}},
+				RAMAllocation: []*costModel.Vector{&costModel.Vector{Timestamp: 1570000000, Value: 1024 * 1024 * 1024}},
+			},
+		}
+	}
+
+	for _, test := range []struct {
+		labels   map[string]string
+		cpu, ram float64
+	}{
+		{labels: map[string]string{"node-pool": "general"}, cpu: 0.02, ram: 0.002},
+		{labels: map[string]string{"node-pool": "highmem", "team": "data"}, cpu: 0.01, ram: 0.005},
+		// nodes matching no selector, or only some labels of one, have the global custom prices
+		{labels: map[string]string{"node-pool": "highmem"}, cpu: 0.03, ram: 0.004},
+		{labels: nil, cpu: 0.03, ram: 0.004},
+	} {
+		aggs := costModel.AggregateCostModel(cp, newCostData(test.labels), "namespace", "", false, 0, 1.0, nil)
+		assert.Assert(t, math.Abs(aggs["default"].CPUCost-test.cpu) < 1e-9, "%v: %f", test.labels, aggs["default"].CPUCost)
+		assert.Assert(t, math.Abs(aggs["default"].RAMCost-test.ram) < 1e-9, "%v: %f", test.labels, aggs["default"].RAMCost)
+	}
+
+	selectors, err := cloud.CustomPriceSelectors(&cloud.CustomPricing{CustomPricesByLabel: "a=1:cpu=1,ram=2;a=1,b=2:cpu=3,ram=4"})
+	assert.NilError(t, err)
+	// the first matching selector applies
+	assert.Equal(t, cloud.MatchCustomPriceSelector(selectors, map[string]string{"a": "1", "b": "2"}).CPU, "1")
+
+	for _, value := range []string{"node-pool=general", "node-pool:cpu=0.02,ram=0.002", "node-pool=general:cpu=0.02", "node-pool=general:cpu=-1,ram=0.002", "node-pool=general:cpu=0.02,ram=0.002,disk=1"} {
+		assert.Assert(t, cloud.ValidateCustomPricingValue("CustomPricesByLabel", value) != nil, value)
+	}
+}
+
+func TestNodeDataCarriesSelectedLabels(t *testing.T) {
+	server := newNoKSMPrometheus(t)
+	defer server.Close()
+	cp := newTestProvider(t)
+	_, err := cp.UpdateConfig(strings.NewReader(`{"customPricesEnabled":"true","customPricesByLabel":"node-pool=general:cpu=0.02,ram=0.002"}`), "")
+	assert.NilError(t, err)
+
+	node := newTestNode("node-1", "n1-standard-2")
+	node.Labels["node-pool"] = "general"
+	node.Labels["eks.amazonaws.com/nodegroup"] = "ng-1"
+	node.Labels[v1.LabelHostname] = "node-1"
+	cm := &costModel.CostModel{Cache: fakeClusterCache{
+		nodes: []*v1.Node{node},
+		pods:  []*v1.Pod{newRequestingPod("web-1", "web", 2*time.Hour)},
+	}}
+	data, _, err := cm.ComputeCostData(newFakePrometheusClient(t, server.URL), nil, cp, "1h", "", "")
+	assert.NilError(t, err)
+
+	// only the labels naming the node pool or selected by custom prices are carried on the node data
+	web1 := data[costModel.LocalClusterID(cp)+",web,web-1,app,node-1"]
+	assert.Assert(t, web1 != nil)
+	assert.DeepEqual(t, web1.NodeData.Labels, map[string]string{"node-pool": "general", "eks.amazonaws.com/nodegroup": "ng-1"})
+}
@@ -0,0 +1,110 @@
+package costmodel_test
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+
+	"github.com/kubecost/cost-model/cloud"
+	costModel "github.com/kubecost/cost-model/costmodel"
+)
+
+func TestDiscountSchedule(t *testing.T) {
+	before := float64(time.Date(2019, 10, 1, 11, 0, 0, 0, time.UTC).Unix())
+	after := float64(time.Date(2019, 10, 1, 13, 0, 0, 0, time.UTC).Unix())
+	costData := func() map[string]*costModel.CostData {
+		return map[string]*costModel.CostData{
+			"cluster,default,pod,container,node": &costModel.CostData{
+				Namespace: "default",
+				NodeData:  &cloud.Node{VCPUCost: "1.0", RAMCost: "0"},
+				CPUAllocation: []*costModel.Vector{
+					&costModel.Vector{Timestamp: before, Value: 1},
+					&costModel.Vector{Timestamp: after, Value: 1},
+				},
+			},
+		}
+	}
+	cpuCosts := func(config string) (float64, []*costModel.Vector) {
+		cp := newTestProvider(t)
+		_, err := cp.UpdateConfig(strings.NewReader(config), "")
+		assert.NilError(t, err)
+		aggs := costModel.AggregateCostModel(cp, costData(), "namespace", "", true, 0.2, 1.0, nil)
+		return aggs["default"].CPUCost, aggs["default"].CPUCostVector
+	}
+
+	// the contract changed at noon, between the samples
+	total, vectors := cpuCosts(`{"discountSchedule":"2019-09-01=10%; 2019-10-01T12:00:00Z=50%"}`)
+	assert.Assert(t, math.Abs(total-1.4) < 1e-9, "%f", total)
+	assert.Equal(t, len(vectors), 2)
+	assert.Assert(t, math.Abs(vectors[0].Value-0.9) < 1e-9)
+	assert.Assert(t, math.Abs(vectors[1].Value-0.5) < 1e-9)
+
+	// a single segment discounts every sample alike, as does the discount without a schedule
+	total, _ = cpuCosts(`{"discountSchedule":"2019-10-01T12:00:00Z=50%"}`)
+	assert.Assert(t, math.Abs(total-1.0) < 1e-9, "%f", total)
+	total, _ = cpuCosts(`{"discountSchedule":""}`)
+	assert.Assert(t, math.Abs(total-1.6) < 1e-9, "%f", total)
+
+	// cost rules discounting a namespace take precedence over the schedule
+	total, _ = cpuCosts(`{"discountSchedule":"2019-09-01=10%;2019-10-01T12:00:00Z=50%","costRules":"namespace=default,25%,"}`)
+	assert.Assert(t, math.Abs(total-1.5) < 1e-9, "%f", total)
+
+	for _, value := range []string{"2019-09-01", "yesterday=10%", "2019-09-01=110%", "2019-09-01=10"} {
+		assert.Assert(t, cloud.ValidateCustomPricingValue("DiscountSchedule", value) != nil, value)
+	}
+}
+
+func TestAggregateCostModelDiscountFormats(t *testing.T) {
+	server, _ := newSlowPrometheus(t, 0, false)
+	defer server.Close()
+
+	// an empty discount, as when discounting by a schedule, is no discount, and one without its "%" is still a
+	// percentage
+	for config, discount := range map[string]float64{`{"discount":""}`: 0, `{"discount":"10"}`: 0.1} {
+		a := newTestAccesses(t, server.URL, "")
+		_, err := a.Cloud.UpdateConfig(strings.NewReader(config), "")
+		assert.NilError(t, err)
+		envelope := getAggregatedCostModel(t, a, "aggregation=namespace&window=1h")
+		assert.Equal(t, envelope.Status, "success", config)
+		metadata := envelope.Data.(map[string]interface{})["metadata"].(map[string]interface{})
+		assert.Equal(t, metadata["discount"], discount, config)
+	}
+	assert.NilError(t, cloud.ValidateCustomPricingValue("Discount", ""))
+}
+
+func TestDiscountScheduleOver(t *testing.T) {
+	schedule, err := cloud.DiscountSchedule(&cloud.CustomPricing{DiscountSchedule: "2019-10-01T12:00:00Z=50%;2019-09-01=10%"})
+	assert.NilError(t, err)
+	at := func(hour int) time.Time { return time.Date(2019, 10, 1, hour, 0, 0, 0, time.UTC) }
+
+	// a quarter of the window is discounted by 10% and the rest by 50%
+	discount, ok := schedule.Over(at(9), at(13))
+	assert.Assert(t, ok)
+	assert.Assert(t, math.Abs(discount-0.4) < 1e-9, "%f", discount)
+
+	// windows within a segment are discounted by it, including those before the first takes effect
+	discount, _ = schedule.Over(at(13), at(14))
+	assert.Assert(t, math.Abs(discount-0.5) < 1e-9, "%f", discount)
+	discount, _ = schedule.Over(time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2019, 1, 2, 0, 0, 0, 0, time.UTC))
+	assert.Assert(t, math.Abs(discount-0.1) < 1e-9, "%f", discount)
+
+	_, ok = cloud.DiscountSegments{}.Over(at(9), at(13))
+	assert.Assert(t, !ok)
+}
+
+func TestAggregateCostModelDiscountsWindowBySchedule(t *testing.T) {
+	server, _ := newSlowPrometheus(t, 0, false)
+	defer server.Close()
+	a := newTestAccesses(t, server.URL, "")
+	_, err := a.Cloud.UpdateConfig(strings.NewReader(`{"discount":"","discountSchedule":"2019-01-01=10%;2020-01-01=20%"}`), "")
+	assert.NilError(t, err)
+
+	// the costs of the whole window, such as that of the cluster, are discounted by the schedule, not the discount
+	envelope := getAggregatedCostModel(t, a, "aggregation=namespace&window=1h")
+	assert.Equal(t, envelope.Status, "success")
+	metadata := envelope.Data.(map[string]interface{})["metadata"].(map[string]interface{})
+	assert.Assert(t, math.Abs(metadata["discount"].(float64)-0.2) < 1e-9, "%v", metadata["discount"])
+}
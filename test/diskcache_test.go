@@ -0,0 +1,95 @@
+package costmodel_test
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	"gotest.tools/assert"
+
+	costModel "github.com/kubecost/cost-model/costmodel"
+)
+
+func newTestDiskCache(t *testing.T, maxBytes int64) *costModel.DiskCache {
+	dir, err := ioutil.TempDir("", "cost-model-disk-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := costModel.NewDiskCache(dir, maxBytes, time.Hour)
+	assert.NilError(t, err)
+	return c
+}
+
+func TestDiskCacheReadBack(t *testing.T) {
+	c := newTestDiskCache(t, 1024*1024)
+	defer os.RemoveAll(c.Dir)
+
+	cp := newTestProvider(t)
+	totalClusterCost := 10.0
+	c.Set("aggregate:1d", &costModel.AggregationResponse{
+		Aggregations: costModel.AggregateCostModel(cp, newTestCostData(), "namespace", "", false, 0, 1.0, nil),
+		Metadata:     &costModel.AggregationMetadata{Start: "2019-10-01T00:00:00.000Z", TotalClusterCost: &totalClusterCost},
+		Warnings:     []string{"no discount"},
+	})
+
+	// a cache in the same directory, as after a restart, reads back the response
+	restarted, err := costModel.NewDiskCache(c.Dir, c.MaxBytes, c.TTL)
+	assert.NilError(t, err)
+	response, ok := restarted.Get("aggregate:1d")
+	assert.Assert(t, ok)
+	assert.Equal(t, response.Aggregations["test1"].Environment, "test1")
+	assert.Equal(t, *response.Metadata.TotalClusterCost, 10.0)
+	assert.DeepEqual(t, response.Warnings, []string{"no discount"})
+
+	_, ok = restarted.Get("aggregate:7d")
+	assert.Assert(t, !ok)
+
+	restarted.Flush()
+	_, ok = restarted.Get("aggregate:1d")
+	assert.Assert(t, !ok)
+}
+
+func TestDiskCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	response := &costModel.AggregationResponse{Metadata: &costModel.AggregationMetadata{}}
+	c := newTestDiskCache(t, 1024*1024)
+	defer os.RemoveAll(c.Dir)
+	c.Set("a", response)
+	files, err := ioutil.ReadDir(c.Dir)
+	assert.NilError(t, err)
+
+	// room for two responses; uses are ordered without relying on file times
+	c.MaxBytes = 2*files[0].Size() + 16
+	c.Set("b", response)
+	_, ok := c.Get("a")
+	assert.Assert(t, ok)
+	c.Set("c", response)
+
+	assert.Equal(t, c.Size(), 2)
+	_, ok = c.Get("b")
+	assert.Assert(t, !ok, "the least recently used response wasn't evicted")
+	_, ok = c.Get("a")
+	assert.Assert(t, ok)
+}
+
+func TestAggregateCostModelDiskCache(t *testing.T) {
+	server, _ := newSlowPrometheus(t, 0, false)
+	defer server.Close()
+	a := newTestAccesses(t, server.URL, "")
+	a.DiskCache = newTestDiskCache(t, 1024*1024)
+	defer os.RemoveAll(a.DiskCache.Dir)
+
+	envelope := getAggregatedCostModel(t, a, "aggregation=namespace&window=1h")
+	assert.Assert(t, strings.HasPrefix(envelope.Message, "cache miss"), envelope.Message)
+	assert.Equal(t, a.DiskCache.Size(), 1)
+
+	// a restart empties the in-memory cache, but not the disk cache
+	a.Cache = cache.New(time.Minute, time.Minute)
+	envelope = getAggregatedCostModel(t, a, "aggregation=namespace&window=1h")
+	assert.Assert(t, strings.HasPrefix(envelope.Message, "cache hit"), envelope.Message)
+
+	envelope = getAggregatedCostModel(t, a, "aggregation=namespace&window=1h&clearCache=true")
+	assert.Assert(t, strings.HasPrefix(envelope.Message, "cache miss"), envelope.Message)
+}
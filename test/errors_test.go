@@ -0,0 +1,54 @@
+package costmodel_test
+
+import (
+	"fmt"
+	"testing"
+
+	"gotest.tools/assert"
+
+	costModel "github.com/kubecost/cost-model/costmodel"
+)
+
+func TestErrorCode(t *testing.T) {
+	assert.Equal(t, costModel.ErrorCode(nil), "")
+	assert.Equal(t, costModel.ErrorCode(fmt.Errorf("boom")), costModel.ErrorCodeInternal)
+
+	// errors keep the code they're first marked with
+	err := costModel.NewCodedError(costModel.ErrorCodeBadWindow, fmt.Errorf("Invalid window '1x'"))
+	err = costModel.NewCodedError(costModel.ErrorCodeBadRequest, err)
+	assert.Equal(t, costModel.ErrorCode(err), costModel.ErrorCodeBadWindow)
+	assert.Equal(t, err.Error(), "Invalid window '1x'")
+	assert.Assert(t, costModel.NewCodedError(costModel.ErrorCodeBadRequest, nil) == nil)
+}
+
+func TestAggregateCostModelErrorCodes(t *testing.T) {
+	server, _ := newSlowPrometheus(t, 0, false)
+	defer server.Close()
+	a := newTestAccesses(t, server.URL, "")
+
+	for query, code := range map[string]string{
+		"window=1h": costModel.ErrorCodeBadRequest,
+		"aggregation=namespace&window=1h&idleMode=x":                 costModel.ErrorCodeBadRequest,
+		"aggregation=namespace&window=yesterday":                     costModel.ErrorCodeBadWindow,
+		"aggregation=namespace&window=1h&offset=2x":                  costModel.ErrorCodeBadWindow,
+		"aggregation=namespace&window=1d&timezone=Mars/Olympus_Mons": costModel.ErrorCodeBadWindow,
+	} {
+		envelope := getAggregatedCostModel(t, a, query)
+		assert.Equal(t, envelope.Status, "error", query)
+		assert.Equal(t, envelope.ErrorCode, code, query)
+	}
+
+	envelope := getAggregatedCostModel(t, a, "aggregation=namespace&window=1h")
+	assert.Equal(t, envelope.Status, "success")
+	assert.Equal(t, envelope.ErrorCode, "")
+}
+
+func TestAggregateCostModelPromUnavailable(t *testing.T) {
+	server, _ := newSlowPrometheus(t, 0, false)
+	a := newTestAccesses(t, server.URL, "")
+	server.Close()
+
+	envelope := getAggregatedCostModel(t, a, "aggregation=namespace&window=1h")
+	assert.Equal(t, envelope.Status, "error")
+	assert.Equal(t, envelope.ErrorCode, costModel.ErrorCodePromUnavailable)
+}
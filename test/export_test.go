@@ -0,0 +1,247 @@
+package costmodel_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gotest.tools/assert"
+
+	costModel "github.com/kubecost/cost-model/costmodel"
+)
+
+// fakeUploader is an ExportUploader keeping the files uploaded to it in memory
+type fakeUploader struct {
+	lock  sync.Mutex
+	files map[string][]byte
+}
+
+func (u *fakeUploader) Upload(ctx context.Context, path string, body []byte) error {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if u.files == nil {
+		u.files = make(map[string][]byte)
+	}
+	u.files[path] = body
+	return nil
+}
+
+func (u *fakeUploader) URL(path string) string {
+	return "mem://bucket/" + path
+}
+
+func (u *fakeUploader) file(path string) []byte {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	return u.files[path]
+}
+
+func newTestExporter(t *testing.T, format string, costData func(start, end time.Time) (map[string]*costModel.CostData, error)) (*costModel.CostExporter, *fakeUploader, prometheus.Counter) {
+	uploader := &fakeUploader{}
+	errors := prometheus.NewCounter(prometheus.CounterOpts{Name: "kubecost_cost_export_errors_total"})
+	e, err := costModel.NewCostExporter(newTestProvider(t), uploader, "/costs/{cluster}/{date}/", format, time.Hour, errors, costData)
+	assert.NilError(t, err)
+	return e, uploader, errors
+}
+
+func TestCostExporterCSV(t *testing.T) {
+	e, uploader, _ := newTestExporter(t, costModel.ExportFormatCSV, func(start, end time.Time) (map[string]*costModel.CostData, error) {
+		return newTestCostData(), nil
+	})
+
+	start := time.Date(2019, 10, 1, 0, 0, 0, 0, time.UTC)
+	urls, err := e.Export(context.Background(), start, start.Add(24*time.Hour))
+	assert.NilError(t, err)
+
+	dir := "costs/" + costModel.LocalClusterID(e.Cloud) + "/2019-10-01/"
+	assert.DeepEqual(t, urls, []string{"mem://bucket/" + dir + "containers.csv", "mem://bucket/" + dir + "namespaces.csv"})
+
+	namespaces := strings.Split(strings.TrimSpace(string(uploader.file(dir+"namespaces.csv"))), "\n")
+	assert.Equal(t, namespaces[0], "window_start,window_end,cluster_id,namespace,cpu_cost,ram_cost,gpu_cost,pv_cost,network_cost,total_cost")
+	assert.Equal(t, len(namespaces), 2)
+	assert.Assert(t, strings.HasPrefix(namespaces[1], "2019-10-01T00:00:00Z,2019-10-02T00:00:00Z,"))
+
+	// a row for each container
+	containers := strings.Split(strings.TrimSpace(string(uploader.file(dir+"containers.csv"))), "\n")
+	assert.Equal(t, len(containers), 3)
+	assert.Assert(t, strings.HasPrefix(containers[0], "window_start,window_end,cluster_id,namespace,pod,container,node,cpu_core_hours"))
+}
+
+func TestCostExporterUnknownNode(t *testing.T) {
+	// the cost data is returned as is each time, as it would be from a cache
+	costData := newTestCostData()
+	costData["test1,bar,nginx,testnode"].NodeData = nil
+	e, uploader, _ := newTestExporter(t, costModel.ExportFormatCSV, func(start, end time.Time) (map[string]*costModel.CostData, error) {
+		return costData, nil
+	})
+
+	start := time.Date(2019, 10, 1, 0, 0, 0, 0, time.UTC)
+	_, err := e.Export(context.Background(), start, start.Add(24*time.Hour))
+	assert.NilError(t, err)
+
+	containers := strings.Split(strings.TrimSpace(string(uploader.file("costs/"+costModel.LocalClusterID(e.Cloud)+"/2019-10-01/containers.csv"))), "\n")
+	assert.Equal(t, len(containers), 3)
+	assert.Assert(t, costData["test1,bar,nginx,testnode"].NodeData == nil)
+}
+
+func TestCostExporterParquet(t *testing.T) {
+	e, uploader, _ := newTestExporter(t, costModel.ExportFormatParquet, func(start, end time.Time) (map[string]*costModel.CostData, error) {
+		return newTestCostData(), nil
+	})
+
+	start := time.Date(2019, 10, 1, 0, 0, 0, 0, time.UTC)
+	_, err := e.Export(context.Background(), start, start.Add(24*time.Hour))
+	assert.NilError(t, err)
+
+	file := uploader.file("costs/" + costModel.LocalClusterID(e.Cloud) + "/2019-10-01/namespaces.parquet")
+	assert.Assert(t, bytes.HasPrefix(file, []byte("PAR1")))
+	assert.Assert(t, bytes.HasSuffix(file, []byte("PAR1")))
+	assert.Assert(t, bytes.Contains(file, []byte("total_cost")))
+	assert.Assert(t, bytes.Contains(file, []byte("test1")))
+}
+
+// readParquet reads the rows of the given parquet file with pyarrow, skipping the test if it isn't installed
+func readParquet(t *testing.T, file []byte) []map[string]interface{} {
+	python, err := exec.LookPath("python3")
+	if err != nil || exec.Command(python, "-c", "import pyarrow").Run() != nil {
+		t.Skip("pyarrow is not installed")
+	}
+	f, err := ioutil.TempFile("", "cost-model-export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(file)
+	assert.NilError(t, err)
+	assert.NilError(t, f.Close())
+
+	out, err := exec.Command(python, "-c", "import json, sys, pyarrow.parquet as pq; print(json.dumps(pq.read_table(sys.argv[1]).to_pylist()))", f.Name()).Output()
+	assert.NilError(t, err)
+	var rows []map[string]interface{}
+	assert.NilError(t, json.Unmarshal(out, &rows))
+	return rows
+}
+
+func TestCostExporterParquetRoundTrip(t *testing.T) {
+	start := time.Date(2019, 10, 1, 0, 0, 0, 0, time.UTC)
+	exports := make(map[string]*fakeUploader)
+	for _, format := range []string{costModel.ExportFormatParquet, costModel.ExportFormatCSV} {
+		e, uploader, _ := newTestExporter(t, format, func(start, end time.Time) (map[string]*costModel.CostData, error) {
+			return newTestCostData(), nil
+		})
+		_, err := e.Export(context.Background(), start, start.Add(24*time.Hour))
+		assert.NilError(t, err)
+		exports[format] = uploader
+	}
+	dir := "costs/" + costModel.LocalClusterID(newTestProvider(t)) + "/2019-10-01/"
+
+	// a parquet reader reads back the rows of the CSV export
+	for _, name := range []string{"namespaces", "containers"} {
+		rows := readParquet(t, exports[costModel.ExportFormatParquet].file(dir+name+".parquet"))
+		records, err := csv.NewReader(bytes.NewReader(exports[costModel.ExportFormatCSV].file(dir + name + ".csv"))).ReadAll()
+		assert.NilError(t, err)
+		assert.Equal(t, len(rows), len(records)-1, name)
+		for i, record := range records[1:] {
+			assert.Equal(t, len(rows[i]), len(record), name)
+			for j, column := range records[0] {
+				switch value := rows[i][column].(type) {
+				case string:
+					assert.Equal(t, value, record[j], column)
+				case float64:
+					expected, err := strconv.ParseFloat(record[j], 64)
+					assert.NilError(t, err)
+					assert.Equal(t, value, expected, column)
+				default:
+					t.Fatalf("unexpected value %v of column %s", value, column)
+				}
+			}
+		}
+	}
+}
+
+func TestNewCostExporterFormat(t *testing.T) {
+	_, err := costModel.NewCostExporter(newTestProvider(t), &fakeUploader{}, "costs", "json", time.Hour, nil, nil)
+	assert.ErrorContains(t, err, "Invalid export format")
+}
+
+func TestCostExporterRetries(t *testing.T) {
+	var lock sync.Mutex
+	calls := 0
+	e, uploader, errors := newTestExporter(t, costModel.ExportFormatCSV, func(start, end time.Time) (map[string]*costModel.CostData, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		calls++
+		if calls <= 2 {
+			return nil, fmt.Errorf("prometheus is unavailable")
+		}
+		return newTestCostData(), nil
+	})
+	e.MinBackoff = time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := e.Run(ctx)
+	start := time.Now().UTC().Truncate(24 * time.Hour).Add(-24 * time.Hour)
+	path := "costs/" + costModel.LocalClusterID(e.Cloud) + "/" + start.Format("2006-01-02") + "/containers.csv"
+	for deadline := time.Now().Add(5 * time.Second); uploader.file(path) == nil && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	// the previous day is exported once the failures are retried
+	assert.Assert(t, uploader.file(path) != nil)
+	assert.Equal(t, counterValue(t, errors), 2.0)
+}
+
+func TestRunExport(t *testing.T) {
+	e, uploader, errors := newTestExporter(t, costModel.ExportFormatCSV, func(start, end time.Time) (map[string]*costModel.CostData, error) {
+		if end.Sub(start) != 6*time.Hour {
+			return nil, fmt.Errorf("unexpected window from %s to %s", start, end)
+		}
+		return newTestCostData(), nil
+	})
+	a := &costModel.Accesses{CostExporter: e}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/export/run?start=2019-10-01T06:00:00.000Z&end=2019-10-01T12:00:00.000Z", nil)
+	a.RunExport(w, r, nil)
+	assert.Equal(t, w.Code, http.StatusOK)
+	var envelope struct {
+		Code int      `json:"code"`
+		Data []string `json:"data"`
+	}
+	assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &envelope))
+	assert.Equal(t, envelope.Code, http.StatusOK)
+	assert.Equal(t, len(envelope.Data), 2)
+	// partial days are exported apart from the export of the whole day
+	assert.Assert(t, uploader.file("costs/"+costModel.LocalClusterID(e.Cloud)+"/2019-10-01T0600Z-2019-10-01T1200Z/namespaces.csv") != nil)
+	assert.Assert(t, uploader.file("costs/"+costModel.LocalClusterID(e.Cloud)+"/2019-10-01/namespaces.csv") == nil)
+	assert.Equal(t, counterValue(t, errors), 0.0)
+
+	for _, query := range []string{"start=2019-10-01T06:00:00.000Z", "start=2019-10-01T06:00:00.000Z&end=2019-10-01T06:30:00.000Z"} {
+		w := httptest.NewRecorder()
+		a.RunExport(w, httptest.NewRequest("POST", "/export/run?"+query, nil), nil)
+		assert.Equal(t, w.Code, http.StatusBadRequest, query)
+		var envelope costModel.DataEnvelope
+		assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &envelope))
+		assert.Equal(t, envelope.ErrorCode, costModel.ErrorCodeBadWindow, query)
+	}
+
+	// exports are only run if configured
+	w = httptest.NewRecorder()
+	(&costModel.Accesses{}).RunExport(w, httptest.NewRequest("POST", "/export/run", nil), nil)
+	assert.Equal(t, w.Code, http.StatusBadRequest)
+}
@@ -0,0 +1,116 @@
+package costmodel_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"gotest.tools/assert"
+
+	"github.com/kubecost/cost-model/cloud"
+	costModel "github.com/kubecost/cost-model/costmodel"
+)
+
+func TestExternalAllocationsSQL(t *testing.T) {
+	q := &cloud.ExternalAllocationsQuery{
+		Start:       "2019-04-20",
+		End:         "2019-04-27",
+		Aggregators: []string{"namespace", "team"},
+		TagFilters:  map[string]string{"owner": "o'brien", "env": "prod"},
+		Services:    []string{"AmazonRDS", "AmazonS3"},
+	}
+
+	athena, err := cloud.AthenaExternalAllocationsSQL("cur", q)
+	assert.NilError(t, err)
+	assert.Assert(t, strings.Contains(athena, "resource_tags_user_kubernetes_namespace,\n\t\tresource_tags_user_kubernetes_team,"))
+	assert.Assert(t, strings.Contains(athena, "AND resource_tags_user_env = 'prod'\n\t\tAND resource_tags_user_owner = 'o''brien'"))
+	assert.Assert(t, strings.Contains(athena, "line_item_product_code IN ('AmazonRDS', 'AmazonS3')"))
+	assert.Assert(t, strings.Contains(athena, "GROUP BY 1,2,3,4"))
+
+	_, err = cloud.AthenaExternalAllocationsSQL("cur", &cloud.ExternalAllocationsQuery{Start: "2019-04-20", End: "2019-04-27"})
+	assert.ErrorContains(t, err, "aggregator")
+
+	// values are passed to BigQuery as parameters rather than in the query
+	bq, params := cloud.BigQueryExternalAllocationsSQL("billing", q)
+	assert.Assert(t, !strings.Contains(bq, "o'brien"))
+	assert.Assert(t, strings.Contains(bq, "service.description IN UNNEST(@services)"))
+	assert.Assert(t, strings.Contains(bq, "GROUP BY service, aggregator0, aggregator1;"))
+	values := make(map[string]interface{})
+	for _, p := range params {
+		values[p.Name] = p.Value
+	}
+	assert.Equal(t, values["aggregator1"], "kubernetes_team")
+	assert.Equal(t, values["tagKey1"], "owner")
+	assert.Equal(t, values["tagValue1"], "o'brien")
+
+	// verbatim aggregators are tags as named in the billing data, e.g. as mapped by externalTagMappings
+	q.Verbatim = true
+	athena, err = cloud.AthenaExternalAllocationsSQL("cur", q)
+	assert.NilError(t, err)
+	assert.Assert(t, strings.Contains(athena, "resource_tags_user_namespace,\n\t\tresource_tags_user_team,"))
+	_, params = cloud.BigQueryExternalAllocationsSQL("billing", q)
+	for _, p := range params {
+		values[p.Name] = p.Value
+	}
+	assert.Equal(t, values["aggregator1"], "team")
+}
+
+func TestOutOfClusterCostsInvalidTags(t *testing.T) {
+	a := &costModel.Accesses{}
+	w := httptest.NewRecorder()
+	a.OutofClusterCosts(w, httptest.NewRequest("GET", "/outOfClusterCosts?start=2019-04-20&end=2019-04-27&aggregator=namespace&tags=team", nil), nil)
+	assert.Equal(t, w.Code, http.StatusBadRequest)
+}
+
+// fakeExternalProvider returns the given out of cluster costs, recording the queries for them
+type fakeExternalProvider struct {
+	cloud.Provider
+	allocations []*cloud.OutOfClusterAllocation
+	queries     []*cloud.ExternalAllocationsQuery
+}
+
+func (p *fakeExternalProvider) ExternalAllocations(q *cloud.ExternalAllocationsQuery) (*cloud.ExternalAllocationsResult, error) {
+	p.queries = append(p.queries, q)
+	return &cloud.ExternalAllocationsResult{Allocations: p.allocations}, nil
+}
+
+func getOutOfClusterCosts(t *testing.T, a *costModel.Accesses, query string) (int, []*cloud.OutOfClusterAllocation, *costModel.PageInfo) {
+	w := httptest.NewRecorder()
+	a.OutofClusterCosts(w, httptest.NewRequest("GET", "/outOfClusterCosts?start=2019-04-20&end=2019-04-27&aggregator=namespace&"+query, nil), nil)
+	var envelope struct {
+		Data []*cloud.OutOfClusterAllocation `json:"data"`
+		Page *costModel.PageInfo             `json:"page"`
+	}
+	assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &envelope))
+	return w.Code, envelope.Data, envelope.Page
+}
+
+func TestOutOfClusterCostsPaging(t *testing.T) {
+	cp := &fakeExternalProvider{Provider: newTestProvider(t), allocations: []*cloud.OutOfClusterAllocation{
+		{Aggregator: "namespace", Environment: "c", Service: "AmazonRDS", Cost: 3},
+		{Aggregator: "namespace", Environment: "a", Service: "AmazonS3", Cost: 1},
+		{Aggregator: "namespace", Environment: "b", Service: "AmazonS3", Cost: 2},
+	}}
+	a := &costModel.Accesses{Cloud: cp}
+
+	_, all, page := getOutOfClusterCosts(t, a, "")
+	assert.Equal(t, len(all), 3)
+	assert.Assert(t, page == nil)
+	assert.Assert(t, !cp.queries[0].ForceRefresh)
+
+	// pages are ordered by environment, without reordering the provider's allocations
+	_, second, page := getOutOfClusterCosts(t, a, "page=2&pageSize=2&forceRefresh=true")
+	assert.Equal(t, len(second), 1)
+	assert.Equal(t, second[0].Environment, "c")
+	assert.DeepEqual(t, *page, costModel.PageInfo{Page: 2, PageSize: 2, TotalItems: 3})
+	assert.Equal(t, cp.allocations[0].Environment, "c")
+	assert.Assert(t, cp.queries[1].ForceRefresh)
+
+	_, past, _ := getOutOfClusterCosts(t, a, "page=3&pageSize=2")
+	assert.Equal(t, len(past), 0)
+
+	code, _, _ := getOutOfClusterCosts(t, a, "pageSize=0")
+	assert.Equal(t, code, http.StatusBadRequest)
+}
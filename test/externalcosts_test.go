@@ -0,0 +1,85 @@
+package costmodel_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+
+	"github.com/kubecost/cost-model/cloud"
+	costModel "github.com/kubecost/cost-model/costmodel"
+)
+
+// failingExternalProvider fails to query out of cluster costs
+type failingExternalProvider struct {
+	cloud.Provider
+}
+
+func (p *failingExternalProvider) ExternalAllocations(*cloud.ExternalAllocationsQuery) (*cloud.ExternalAllocationsResult, error) {
+	return nil, fmt.Errorf("athena unavailable")
+}
+
+func TestAddExternalCosts(t *testing.T) {
+	cp := newTestProvider(t)
+	aggs := costModel.AggregateCostModel(cp, newTestCostData(), "namespace", "", false, 0, 1.0, nil)
+	total := aggs["test1"].TotalCost
+
+	costModel.AddExternalCosts(aggs, "namespace", "", []*cloud.OutOfClusterAllocation{
+		{Aggregator: "namespace", Environment: "test1", Service: "AmazonRDS", Cost: 3},
+		{Aggregator: "namespace", Environment: "test1", Service: "AmazonS3", Cost: 1},
+		{Aggregator: "namespace", Environment: "retired", Service: "AmazonS3", Cost: 2},
+		{Aggregator: "namespace", Environment: "", Service: "AmazonEC2", Cost: 100},
+	})
+	assert.Equal(t, aggs["test1"].ExternalCost, 4.0)
+	assert.Equal(t, aggs["test1"].TotalCost, total+4.0)
+
+	// costs tagged for unknown keys are reported apart, while untagged costs are ignored
+	assert.Equal(t, aggs[costModel.ExternalUnmatchedAggregationKey].ExternalCost, 2.0)
+	assert.Equal(t, len(aggs), 2)
+}
+
+func TestExternalTag(t *testing.T) {
+	c := &cloud.CustomPricing{ExternalTagMappings: "label.team=owning_team;namespace=ns"}
+	for _, test := range []struct{ field, subfield, tag string }{
+		{"label", "team", "owning_team"},
+		{"label", "app", "kubernetes_app"},
+		{"namespace", "", "ns"},
+		{"deployment", "", "kubernetes_deployment"},
+	} {
+		tag, err := cloud.ExternalTag(c, test.field, test.subfield)
+		assert.NilError(t, err)
+		assert.Equal(t, tag, test.tag)
+	}
+	assert.Assert(t, cloud.ValidateCustomPricingValue("ExternalTagMappings", "label.team") != nil)
+}
+
+func TestProrateExternalCosts(t *testing.T) {
+	allocations := []*cloud.OutOfClusterAllocation{{Aggregator: "team", Environment: "payments", Cost: 48}}
+
+	// six hours of the two days spanned are an eighth of their cost
+	start := time.Date(2019, 4, 20, 21, 0, 0, 0, time.UTC)
+	prorated := costModel.ProrateExternalCosts(allocations, start, start.Add(6*time.Hour))
+	assert.Equal(t, prorated[0].Cost, 6.0)
+	assert.Equal(t, allocations[0].Cost, 48.0)
+
+	// whole days are not prorated
+	day := time.Date(2019, 4, 20, 0, 0, 0, 0, time.UTC)
+	prorated = costModel.ProrateExternalCosts(allocations, day, day.Add(48*time.Hour))
+	assert.Equal(t, prorated[0].Cost, 48.0)
+}
+
+func TestAggregateCostModelExternalFailure(t *testing.T) {
+	server, _ := newSlowPrometheus(t, 0, false)
+	defer server.Close()
+	a := newTestAccesses(t, server.URL, "")
+	a.Cloud = &failingExternalProvider{Provider: a.Cloud}
+
+	// the aggregation is returned without out of cluster costs, and isn't cached
+	envelope := getAggregatedCostModel(t, a, "aggregation=namespace&window=1h&includeExternal=true")
+	assert.Equal(t, envelope.Code, 200)
+	assert.Assert(t, strings.HasPrefix(envelope.Message, "partial result"), envelope.Message)
+	assert.Equal(t, len(envelope.Warnings), 1)
+	assert.Assert(t, strings.Contains(envelope.Warnings[0], "athena unavailable"))
+}
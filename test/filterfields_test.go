@@ -0,0 +1,418 @@
+package costmodel_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+
+	"github.com/kubecost/cost-model/cloud"
+	costModel "github.com/kubecost/cost-model/costmodel"
+	v1 "k8s.io/api/core/v1"
+)
+
+func getCostDataModel(t *testing.T, a *costModel.Accesses, query string) (int, map[string]interface{}) {
+	w := httptest.NewRecorder()
+	a.CostDataModel(w, httptest.NewRequest("GET", "/costDataModel?"+query, nil), nil)
+	var envelope map[string]interface{}
+	assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &envelope))
+	return w.Code, envelope
+}
+
+func TestFilterFields(t *testing.T) {
+	server := newNoKSMPrometheus(t)
+	defer server.Close()
+	a := newTestAccesses(t, server.URL, "")
+	a.Model = &costModel.CostModel{Cache: fakeClusterCache{pods: []*v1.Pod{newRequestingPod("web-1", "web", 2*time.Hour)}}}
+
+	// fields are named by their Go or JSON names, in any case
+	code, envelope := getCostDataModel(t, a, "timeWindow=1h&filterFields=RAMAllocation,%20cpuAllocated,LABELS")
+	assert.Equal(t, code, http.StatusOK)
+	data := envelope["data"].(map[string]interface{})
+	assert.Equal(t, len(data), 1)
+	for _, costs := range data {
+		costs := costs.(map[string]interface{})
+		_, ok := costs["ramallocated"]
+		assert.Assert(t, !ok)
+		_, ok = costs["cpuallocated"]
+		assert.Assert(t, !ok)
+		_, ok = costs["cpureq"]
+		assert.Assert(t, ok)
+	}
+
+	// a typo is rejected, rather than filtering nothing
+	code, envelope = getCostDataModel(t, a, "timeWindow=1h&filterFields=ramalocation")
+	assert.Equal(t, code, http.StatusBadRequest)
+	assert.Equal(t, envelope["errorCode"], costModel.ErrorCodeBadRequest)
+	assert.Assert(t, strings.Contains(envelope["message"].(string), "ramalocation"))
+
+	// every invalid field of a mixed list is named, and none of the valid ones
+	code, envelope = getCostDataModel(t, a, "timeWindow=1h&filterFields=cpuUsed,cpuUsd,labels,nodes")
+	assert.Equal(t, code, http.StatusBadRequest)
+	message := envelope["message"].(string)
+	assert.Assert(t, strings.Contains(message, "cpuUsd, nodes"), message)
+	assert.Assert(t, !strings.Contains(message, "labels"), message)
+}
+
+func newFieldFilterCostData() map[string]*costModel.CostData {
+	return map[string]*costModel.CostData{
+		"web": &costModel.CostData{
+			Name:      "web",
+			Namespace: "default",
+			NodeData:  &cloud.Node{VCPU: "2", VCPUCost: "0.03", RAMCost: "0.004"},
+			CPUReq:    []*costModel.Vector{&costModel.Vector{Timestamp: 10, Value: 1}},
+			PVCData: []*costModel.PersistentVolumeClaimData{
+				&costModel.PersistentVolumeClaimData{Claim: "data", Volume: &cloud.PV{Cost: "0.1"}},
+			},
+			Labels: map[string]string{"app": "web"},
+		},
+	}
+}
+
+func TestParseFieldFilter(t *testing.T) {
+	cases := []struct {
+		name   string
+		fields string
+		keep   bool
+		check  func(t *testing.T, cd *costModel.CostData)
+	}{
+		{"drop by JSON name", "namespace, labels", false, func(t *testing.T, cd *costModel.CostData) {
+			assert.Equal(t, cd.Namespace, "")
+			assert.Assert(t, cd.Labels == nil)
+			assert.Equal(t, cd.Name, "web")
+			assert.Equal(t, cd.NodeData.VCPUCost, "0.03")
+		}},
+		{"drop nested by Go name", "nodeData.vcpuCost", false, func(t *testing.T, cd *costModel.CostData) {
+			assert.Equal(t, cd.NodeData.VCPUCost, "")
+			assert.Equal(t, cd.NodeData.RAMCost, "0.004")
+			assert.Equal(t, cd.Name, "web")
+		}},
+		{"drop nested by JSON name", "node.CPUHourlyCost,pvcData.persistentVolume", false, func(t *testing.T, cd *costModel.CostData) {
+			assert.Equal(t, cd.NodeData.VCPUCost, "")
+			assert.Equal(t, cd.NodeData.VCPU, "2")
+			assert.Equal(t, cd.PVCData[0].Claim, "data")
+			assert.Assert(t, cd.PVCData[0].Volume == nil)
+		}},
+		{"keep", "name,cpureq", true, func(t *testing.T, cd *costModel.CostData) {
+			assert.Equal(t, cd.Name, "web")
+			assert.Equal(t, len(cd.CPUReq), 1)
+			assert.Equal(t, cd.Namespace, "")
+			assert.Assert(t, cd.NodeData == nil)
+		}},
+		{"keep nested", "name,nodeData.vcpuCost", true, func(t *testing.T, cd *costModel.CostData) {
+			assert.Equal(t, cd.Name, "web")
+			assert.Equal(t, cd.NodeData.VCPUCost, "0.03")
+			assert.Equal(t, cd.NodeData.RAMCost, "")
+			assert.Assert(t, cd.PVCData == nil)
+		}},
+		{"whole field takes precedence", "node,node.CPUHourlyCost", true, func(t *testing.T, cd *costModel.CostData) {
+			assert.Equal(t, cd.NodeData.VCPUCost, "0.03")
+			assert.Equal(t, cd.NodeData.RAMCost, "0.004")
+			assert.Equal(t, cd.Name, "")
+		}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			data := newFieldFilterCostData()
+			filter, err := costModel.ParseFieldFilter(c.fields, c.keep)
+			assert.NilError(t, err)
+			filtered := filter.Apply(data)
+			c.check(t, filtered["web"])
+
+			// the original cost data is not modified
+			assert.Equal(t, data["web"].NodeData.VCPUCost, "0.03")
+			assert.Equal(t, data["web"].Namespace, "default")
+		})
+	}
+
+	for _, fields := range []string{"nodes", "node.cpuCost", "labels.app", "name.first"} {
+		_, err := costModel.ParseFieldFilter(fields, false)
+		assert.ErrorContains(t, err, fields)
+	}
+	_, err := costModel.ParseFieldFilter("name,node.cost,cpuUsd", true)
+	assert.ErrorContains(t, err, "Invalid keepFields cpuUsd;")
+}
+
+func TestKeepFields(t *testing.T) {
+	server := newNoKSMPrometheus(t)
+	defer server.Close()
+	a := newTestAccesses(t, server.URL, "")
+	a.Model = &costModel.CostModel{Cache: fakeClusterCache{pods: []*v1.Pod{newRequestingPod("web-1", "web", 2*time.Hour)}}}
+
+	code, envelope := getCostDataModel(t, a, "timeWindow=1h&keepFields=namespace,podName")
+	assert.Equal(t, code, http.StatusOK)
+	data := envelope["data"].(map[string]interface{})
+	assert.Equal(t, len(data), 1)
+	for _, costs := range data {
+		costs := costs.(map[string]interface{})
+		assert.Equal(t, costs["namespace"], "web")
+		_, ok := costs["cpureq"]
+		assert.Assert(t, !ok)
+	}
+
+	code, envelope = getCostDataModel(t, a, "timeWindow=1h&keepFields=namespace&filterFields=labels")
+	assert.Equal(t, code, http.StatusBadRequest)
+	assert.Equal(t, envelope["errorCode"], costModel.ErrorCodeBadRequest)
+}
+
+// fillValue sets every exported field reachable from the given settable value to a non-zero value
+func fillValue(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString("x")
+	case reflect.Bool:
+		v.SetBool(true)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		v.SetInt(1)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		v.SetUint(1)
+	case reflect.Float32, reflect.Float64:
+		v.SetFloat(1)
+	case reflect.Ptr:
+		v.Set(reflect.New(v.Type().Elem()))
+		fillValue(v.Elem())
+	case reflect.Slice:
+		v.Set(reflect.MakeSlice(v.Type(), 1, 1))
+		fillValue(v.Index(0))
+	case reflect.Map:
+		key := reflect.New(v.Type().Key()).Elem()
+		fillValue(key)
+		elem := reflect.New(v.Type().Elem()).Elem()
+		fillValue(elem)
+		v.Set(reflect.MakeMap(v.Type()))
+		v.SetMapIndex(key, elem)
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if v.Field(i).CanSet() {
+				fillValue(v.Field(i))
+			}
+		}
+	}
+}
+
+// referenceFieldFilter filters cost data as the field filter did before it cached its field indices and copy
+// plans, by reflecting on every field of every value it copies
+type referenceFieldFilter struct {
+	paths referenceFieldPaths
+	keep  bool
+}
+
+type referenceFieldPaths map[int]referenceFieldPaths
+
+func parseReferenceFieldFilter(fields string, keep bool) (*referenceFieldFilter, bool) {
+	paths := referenceFieldPaths{}
+	for _, f := range strings.Split(fields, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		if !paths.add(reflect.TypeOf(costModel.CostData{}), strings.Split(f, ".")) {
+			return nil, false
+		}
+	}
+	return &referenceFieldFilter{paths: paths, keep: keep}, true
+}
+
+func (p referenceFieldPaths) add(t reflect.Type, path []string) bool {
+	t = referenceNestedStruct(t)
+	if t == nil {
+		return false
+	}
+	i, ok := referenceFieldIndex(t, path[0])
+	if !ok {
+		return false
+	}
+	if len(path) == 1 {
+		p[i] = nil
+		return true
+	}
+
+	children, named := p[i]
+	if !named || children != nil {
+		if children == nil {
+			children = referenceFieldPaths{}
+		}
+		if !children.add(t.Field(i).Type, path[1:]) {
+			return false
+		}
+		p[i] = children
+		return true
+	}
+	return referenceFieldPaths{}.add(t.Field(i).Type, path[1:])
+}
+
+func referenceNestedStruct(t reflect.Type) reflect.Type {
+	for t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+	return t
+}
+
+func referenceFieldIndex(t reflect.Type, name string) (int, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		if strings.EqualFold(field.Name, name) {
+			return i, true
+		}
+		if tag := strings.Split(field.Tag.Get("json"), ",")[0]; tag != "" && tag != "-" && strings.EqualFold(tag, name) {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+func (f *referenceFieldFilter) Apply(data map[string]*costModel.CostData) map[string]costModel.CostData {
+	filteredData := make(map[string]costModel.CostData, len(data))
+	for cname, costdata := range data {
+		filteredData[cname] = f.filter(reflect.ValueOf(*costdata), f.paths).Interface().(costModel.CostData)
+	}
+	return filteredData
+}
+
+func (f *referenceFieldFilter) filter(v reflect.Value, paths referenceFieldPaths) reflect.Value {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return v
+		}
+		filtered := reflect.New(v.Type().Elem())
+		filtered.Elem().Set(f.filter(v.Elem(), paths))
+		return filtered
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+		filtered := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			filtered.Index(i).Set(f.filter(v.Index(i), paths))
+		}
+		return filtered
+	case reflect.Struct:
+		filtered := reflect.New(v.Type()).Elem()
+		for i := 0; i < v.NumField(); i++ {
+			if !filtered.Field(i).CanSet() {
+				continue
+			}
+			children, named := paths[i]
+			if named && children != nil {
+				filtered.Field(i).Set(f.filter(v.Field(i), children))
+			} else if named == f.keep {
+				filtered.Field(i).Set(v.Field(i))
+			}
+		}
+		return filtered
+	}
+	return v
+}
+
+// fieldNames returns the Go and JSON names of the exported fields of the given struct type, and the dotted paths
+// into the structures nested in them, up to the given depth
+func fieldNames(t reflect.Type, depth int) []string {
+	var names []string
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		aliases := []string{field.Name}
+		if tag := strings.Split(field.Tag.Get("json"), ",")[0]; tag != "" && tag != "-" {
+			aliases = append(aliases, tag)
+		}
+		for _, name := range aliases {
+			names = append(names, name)
+			if nested := referenceNestedStruct(field.Type); nested != nil && depth > 1 {
+				for _, child := range fieldNames(nested, depth-1) {
+					names = append(names, name+"."+child)
+				}
+			}
+		}
+	}
+	return names
+}
+
+func TestFieldFilterMatchesReference(t *testing.T) {
+	filled := &costModel.CostData{}
+	fillValue(reflect.ValueOf(filled).Elem())
+	fixtures := []map[string]*costModel.CostData{
+		newFieldFilterCostData(),
+		newTestCostData(),
+		{"filled": filled},
+	}
+
+	var goNames []string
+	typ := reflect.TypeOf(costModel.CostData{})
+	for i := 0; i < typ.NumField(); i++ {
+		if typ.Field(i).PkgPath == "" {
+			goNames = append(goNames, typ.Field(i).Name)
+		}
+	}
+	filters := append(fieldNames(typ, 3),
+		strings.Join(goNames, ","),
+		"node,node.CPUHourlyCost",
+		"node.CPUHourlyCost,node",
+		"nodeData.vcpuCost,NODEDATA.ramCost,pvcData.persistentVolume.cost",
+		"labels,annotations,node.labels,pvcData.values",
+	)
+
+	for _, fields := range filters {
+		for _, keep := range []bool{false, true} {
+			reference, ok := parseReferenceFieldFilter(fields, keep)
+			filter, err := costModel.ParseFieldFilter(fields, keep)
+			assert.Equal(t, err == nil, ok, "fields %s", fields)
+			if !ok {
+				continue
+			}
+			for _, data := range fixtures {
+				filtered := filter.Apply(data)
+				expected := reference.Apply(data)
+				assert.Equal(t, len(filtered), len(expected))
+				for key, cd := range expected {
+					cd := cd
+					assert.Assert(t, reflect.DeepEqual(filtered[key], &cd), "fields %s, keep %t, key %s", fields, keep, key)
+				}
+			}
+		}
+	}
+}
+
+func BenchmarkFieldFilterApply(b *testing.B) {
+	data := make(map[string]*costModel.CostData, 10000)
+	for i := 0; i < 10000; i++ {
+		cd := &costModel.CostData{}
+		fillValue(reflect.ValueOf(cd).Elem())
+		data[strconv.Itoa(i)] = cd
+	}
+	fields := "labels,annotations,node.labels,pvcData.values"
+
+	// each request parses its filter before applying it
+	b.Run("reference", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			filter, ok := parseReferenceFieldFilter(fields, false)
+			if !ok {
+				b.Fatal(fields)
+			}
+			filter.Apply(data)
+		}
+	})
+	b.Run("cached", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			filter, err := costModel.ParseFieldFilter(fields, false)
+			if err != nil {
+				b.Fatal(err)
+			}
+			filter.Apply(data)
+		}
+	})
+}
@@ -0,0 +1,139 @@
+package costmodel_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/kubecost/cost-model/cloud"
+	costModel "github.com/kubecost/cost-model/costmodel"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// newStubPrometheus returns a fake Prometheus which answers each query with the series the given function returns
+// for it, as an instant vector for instant queries and as a range matrix for range queries
+func newStubPrometheus(t *testing.T, answer func(query string, instant bool) []interface{}) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		instant := r.URL.Path == "/api/v1/query"
+		resultType := "matrix"
+		if instant {
+			resultType = "vector"
+		}
+		result := answer(r.Form.Get("query"), instant)
+		if result == nil {
+			result = []interface{}{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		resp, _ := json.Marshal(map[string]interface{}{"status": "success", "data": map[string]interface{}{"resultType": resultType, "result": result}})
+		w.Write(resp)
+	}))
+}
+
+// promSample returns the sample of an instant vector of the series of the given labels, taken now
+func promSample(metric map[string]string, value string) map[string]interface{} {
+	if metric == nil {
+		metric = map[string]string{}
+	}
+	return map[string]interface{}{
+		"metric": metric,
+		"value":  []interface{}{float64(time.Now().Unix()), value},
+	}
+}
+
+// promSeries returns the series of the given labels of a range matrix, with a single sample taken at the given time
+func promSeries(metric map[string]string, at time.Time, value string) map[string]interface{} {
+	return map[string]interface{}{
+		"metric": metric,
+		"values": []interface{}{[]interface{}{float64(at.Unix()), value}},
+	}
+}
+
+// podOption sets up a pod built by newTestPod
+type podOption func(*v1.Pod)
+
+// newTestPod returns a pod in the given phase of a single container on node-1, set up by the given options
+func newTestPod(name string, namespace string, container string, phase v1.PodPhase, options ...podOption) *v1.Pod {
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+		Spec: v1.PodSpec{
+			NodeName:   "node-1",
+			Containers: []v1.Container{{Name: container}},
+		},
+		Status: v1.PodStatus{Phase: phase},
+	}
+	for _, option := range options {
+		option(pod)
+	}
+	return pod
+}
+
+// ownedBy makes the pod managed by the controller of the given kind and name
+func ownedBy(kind string, name string) podOption {
+	return func(pod *v1.Pod) {
+		isController := true
+		pod.ObjectMeta.OwnerReferences = []metav1.OwnerReference{{Kind: kind, Name: name, Controller: &isController}}
+	}
+}
+
+// onNode schedules the pod onto the given node
+func onNode(node string) podOption {
+	return func(pod *v1.Pod) {
+		pod.Spec.NodeName = node
+	}
+}
+
+// requesting sets the CPU and RAM requests of the container of the pod
+func requesting(cpu string, ram string) podOption {
+	return func(pod *v1.Pod) {
+		pod.Spec.Containers[0].Resources.Requests = v1.ResourceList{
+			v1.ResourceCPU:    resource.MustParse(cpu),
+			v1.ResourceMemory: resource.MustParse(ram),
+		}
+	}
+}
+
+// runningSince reports the container of the pod running since the given time
+func runningSince(started time.Time) podOption {
+	return func(pod *v1.Pod) {
+		pod.Status.ContainerStatuses = []v1.ContainerStatus{{
+			Name:  pod.Spec.Containers[0].Name,
+			State: v1.ContainerState{Running: &v1.ContainerStateRunning{StartedAt: metav1.NewTime(started)}},
+		}}
+	}
+}
+
+// ranBetween reports the container of the pod terminated, having run from started until finished
+func ranBetween(started time.Time, finished time.Time) podOption {
+	return func(pod *v1.Pod) {
+		pod.Status.ContainerStatuses = []v1.ContainerStatus{{
+			Name: pod.Spec.Containers[0].Name,
+			State: v1.ContainerState{Terminated: &v1.ContainerStateTerminated{
+				StartedAt:  metav1.NewTime(started),
+				FinishedAt: metav1.NewTime(finished),
+			}},
+		}}
+	}
+}
+
+// newTestContainer returns the cost data of a container on testnode, priced at 1.0 per CPU and per GB of RAM,
+// which was allocated a CPU and 1GB of RAM at a single timestamp
+func newTestContainer(namespace string, pod string, container string) *costModel.CostData {
+	return &costModel.CostData{
+		Name:      container,
+		Namespace: namespace,
+		PodName:   pod,
+		NodeName:  "testnode",
+		NodeData: &cloud.Node{
+			VCPUCost: "1.0",
+			RAMCost:  "1.0",
+		},
+		RAMAllocation: []*costModel.Vector{{Timestamp: 10, Value: 1073741824}},
+		CPUAllocation: []*costModel.Vector{{Timestamp: 10, Value: 1.0}},
+		GPUReq:        []*costModel.Vector{{}},
+	}
+}
@@ -0,0 +1,81 @@
+package costmodel_test
+
+import (
+	"testing"
+
+	"gotest.tools/assert"
+
+	"github.com/kubecost/cost-model/cloud"
+)
+
+func TestGPUModel(t *testing.T) {
+	assert.Equal(t, cloud.GPUModel(map[string]string{"nvidia.com/gpu.product": "Tesla-T4"}), "tesla-t4")
+	assert.Equal(t, cloud.GPUModel(map[string]string{"cloud.google.com/gke-accelerator": "nvidia-tesla-a100"}), "nvidia-tesla-a100")
+	assert.Equal(t, cloud.GPUModel(map[string]string{
+		"nvidia.com/gpu.product":           "NVIDIA A100-SXM4-40GB",
+		"cloud.google.com/gke-accelerator": "nvidia-tesla-a100",
+	}), "nvidia-a100-sxm4-40gb")
+	assert.Equal(t, cloud.GPUModel(map[string]string{}), "")
+}
+
+func TestCustomGPUPricing(t *testing.T) {
+	gpuPricing, err := cloud.CustomGPUPricing(&cloud.CustomPricing{
+		GpuPricing:     "A100:2.93, t4:0.35, nvidia-tesla-t4:0.4",
+		SpotGPUPricing: "t4:0.11",
+	})
+	assert.NilError(t, err)
+
+	cost, ok := gpuPricing.Cost("nvidia-a100-sxm4-40gb", false)
+	assert.Assert(t, ok)
+	assert.Equal(t, cost, 2.93)
+
+	// The most specific key pricing the model wins
+	cost, ok = gpuPricing.Cost("nvidia-tesla-t4", false)
+	assert.Assert(t, ok)
+	assert.Equal(t, cost, 0.4)
+	cost, ok = gpuPricing.Cost("Tesla T4", false)
+	assert.Assert(t, ok)
+	assert.Equal(t, cost, 0.35)
+
+	cost, ok = gpuPricing.Cost("tesla-t4", true)
+	assert.Assert(t, ok)
+	assert.Equal(t, cost, 0.11)
+
+	_, ok = gpuPricing.Cost("nvidia-a100", true)
+	assert.Assert(t, !ok)
+	_, ok = gpuPricing.Cost("nvidia-a10g", false)
+	assert.Assert(t, !ok)
+	_, ok = gpuPricing.Cost("", false)
+	assert.Assert(t, !ok)
+
+	_, err = cloud.CustomGPUPricing(&cloud.CustomPricing{GpuPricing: "a100"})
+	assert.ErrorContains(t, err, "Invalid GPU price")
+	_, err = cloud.CustomGPUPricing(&cloud.CustomPricing{SpotGPUPricing: "a100:cheap"})
+	assert.ErrorContains(t, err, "Invalid GPU price")
+}
+
+func TestProviderGPUPricingDefaults(t *testing.T) {
+	provider := newTestProvider(t)
+
+	gpuPricing, err := provider.GPUPricing()
+	assert.NilError(t, err)
+	_, ok := gpuPricing.Cost("nvidia-tesla-t4", false)
+	assert.Assert(t, !ok, "expected the custom provider to price only configured GPU models")
+
+	// AWS and Azure price GPUs only as part of their instances, so have no list prices of their own
+	for name, p := range map[string]cloud.Provider{"aws": &cloud.AWS{}, "azure": &cloud.Azure{}} {
+		gpuPricing, err = p.GPUPricing()
+		assert.NilError(t, err)
+		_, ok = gpuPricing.Cost("nvidia-tesla-t4", false)
+		assert.Assert(t, !ok, "expected %s to price only configured GPU models", name)
+	}
+
+	gcp := &cloud.GCP{}
+	gpuPricing, err = gcp.GPUPricing()
+	assert.NilError(t, err)
+	onDemand, ok := gpuPricing.Cost("nvidia-tesla-t4", false)
+	assert.Assert(t, ok)
+	spot, ok := gpuPricing.Cost("nvidia-tesla-t4", true)
+	assert.Assert(t, ok)
+	assert.Assert(t, spot < onDemand)
+}
@@ -0,0 +1,73 @@
+package costmodel_test
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+
+	costModel "github.com/kubecost/cost-model/costmodel"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestComputeCostDataInitContainersAndOverhead(t *testing.T) {
+	server := newNoKSMPrometheus(t)
+	defer server.Close()
+	cp := newTestProvider(t)
+
+	// web-1 ran an init container requesting a core for 20 minutes of the hour, and runs two containers
+	// requesting half and one and a half cores under a RuntimeClass with a quarter core of overhead
+	pod := newRequestingPod("web-1", "web", 2*time.Hour)
+	pod.ObjectMeta.Labels = map[string]string{"app": "web"}
+	pod.Spec.Containers = append(pod.Spec.Containers, v1.Container{
+		Name: "sidecar",
+		Resources: v1.ResourceRequirements{Requests: v1.ResourceList{
+			v1.ResourceCPU: resource.MustParse("1500m"),
+		}},
+	})
+	pod.Spec.InitContainers = []v1.Container{{
+		Name: "fetch",
+		Resources: v1.ResourceRequirements{Requests: v1.ResourceList{
+			v1.ResourceCPU:    resource.MustParse("1"),
+			v1.ResourceMemory: resource.MustParse("1Gi"),
+		}},
+	}}
+	pod.Status.InitContainerStatuses = []v1.ContainerStatus{{
+		Name: "fetch",
+		State: v1.ContainerState{Terminated: &v1.ContainerStateTerminated{
+			StartedAt:  metav1.NewTime(time.Now().Add(-50 * time.Minute)),
+			FinishedAt: metav1.NewTime(time.Now().Add(-30 * time.Minute)),
+		}},
+	}}
+	pod.Spec.Overhead = v1.ResourceList{v1.ResourceCPU: resource.MustParse("250m")}
+	cm := &costModel.CostModel{Cache: fakeClusterCache{pods: []*v1.Pod{pod}}}
+
+	data, _, err := cm.ComputeCostData(newFakePrometheusClient(t, server.URL), nil, cp, "1h", "", "")
+	assert.NilError(t, err)
+	assert.Equal(t, len(data), 3)
+
+	clusterID := costModel.LocalClusterID(cp)
+	fetch := data[clusterID+",web,web-1,fetch,node-1"]
+	assert.Assert(t, fetch != nil)
+	assert.Assert(t, fetch.IsInitContainer)
+	// the init container aggregates with its pod
+	assert.DeepEqual(t, fetch.Labels, map[string]string{"app": "web"})
+	assert.Assert(t, math.Abs(fetch.CPUAllocation[0].Value-1.0/3) < 0.01, "%f", fetch.CPUAllocation[0].Value)
+	assert.Assert(t, math.Abs(fetch.RAMAllocation[0].Value-float64(1<<30)/3) < float64(1<<20), "%f", fetch.RAMAllocation[0].Value)
+
+	// the overhead is split across the containers in proportion to their requests
+	app := data[clusterID+",web,web-1,app,node-1"]
+	assert.Assert(t, !app.IsInitContainer)
+	assert.Equal(t, app.CPUOverhead[0].Value, 0.0625)
+	assert.Equal(t, app.CPUAllocation[0].Value, 0.5625)
+	sidecar := data[clusterID+",web,web-1,sidecar,node-1"]
+	assert.Equal(t, sidecar.CPUOverhead[0].Value, 0.1875)
+	assert.Equal(t, sidecar.CPUAllocation[0].Value, 1.6875)
+
+	// overhead is allocated on top of requests alone, too
+	requests := costModel.ApplyAllocationPolicy(data, costModel.AllocationPolicyRequest)
+	assert.Equal(t, requests[clusterID+",web,web-1,app,node-1"].CPUAllocation[0].Value, 0.5625)
+}
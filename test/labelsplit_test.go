@@ -0,0 +1,51 @@
+package costmodel_test
+
+import (
+	"math"
+	"testing"
+
+	"gotest.tools/assert"
+
+	costModel "github.com/kubecost/cost-model/costmodel"
+)
+
+func TestSplitLabelValuesSingleValue(t *testing.T) {
+	cp := newTestProvider(t)
+	costData := newTestSharedCostData()
+
+	split := costModel.SplitLabelValues(costData, "team")
+	assert.Equal(t, len(split), len(costData))
+	aggs := costModel.AggregateCostModel(cp, split, "label", "team", false, 0.0, 1.0, nil)
+	assert.Equal(t, aggs["platform"].TotalCost, 2.0)
+	assert.Equal(t, aggs["web"].TotalCost, 2.0)
+	// data without the label are not attributed to any value
+	assert.Equal(t, len(aggs), 2)
+}
+
+func TestSplitLabelValuesMultiValue(t *testing.T) {
+	cp := newTestProvider(t)
+	costData := newTestSharedCostData()
+	costData["default,ingress,nginx,testnode"].Labels["team"] = "platform,web"
+
+	aggs := costModel.AggregateCostModel(cp, costModel.SplitLabelValues(costData, "team"), "label", "team", false, 0.0, 1.0, nil)
+	assert.Equal(t, aggs["platform"].TotalCost, 1.0)
+	assert.Equal(t, aggs["web"].TotalCost, 3.0)
+	_, ok := aggs["platform,web"]
+	assert.Assert(t, !ok)
+
+	// the original cost data is not modified
+	assert.Equal(t, costData["default,ingress,nginx,testnode"].Labels["team"], "platform,web")
+	assert.Equal(t, costData["default,ingress,nginx,testnode"].CPUAllocation[0].Value, 1.0)
+
+	costData["default,ingress,nginx,testnode"].Annotations = map[string]string{
+		costModel.LabelSplitWeightsAnnotation: "platform=3,web=1",
+	}
+	aggs = costModel.AggregateCostModel(cp, costModel.SplitLabelValues(costData, "team"), "label", "team", false, 0.0, 1.0, nil)
+	assert.Assert(t, math.Abs(aggs["platform"].TotalCost-1.5) < 1e-9)
+	assert.Assert(t, math.Abs(aggs["web"].TotalCost-2.5) < 1e-9)
+
+	// weights which do not cover every value are ignored
+	costData["default,ingress,nginx,testnode"].Annotations[costModel.LabelSplitWeightsAnnotation] = "platform=3"
+	aggs = costModel.AggregateCostModel(cp, costModel.SplitLabelValues(costData, "team"), "label", "team", false, 0.0, 1.0, nil)
+	assert.Equal(t, aggs["platform"].TotalCost, 1.0)
+}
@@ -0,0 +1,101 @@
+package costmodel_test
+
+import (
+	"strings"
+	"testing"
+
+	"gotest.tools/assert"
+
+	costModel "github.com/kubecost/cost-model/costmodel"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func newTestService(namespace, name string, serviceType v1.ServiceType) *v1.Service {
+	return &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: namespace,
+			Name:      name,
+		},
+		Spec: v1.ServiceSpec{
+			Type: serviceType,
+		},
+	}
+}
+
+func TestComputeLoadBalancerCosts(t *testing.T) {
+	cp := newTestProvider(t)
+	lb := newTestService("test1", "frontend", v1.ServiceTypeLoadBalancer)
+	lb.Status.LoadBalancer.Ingress = []v1.LoadBalancerIngress{v1.LoadBalancerIngress{IP: "10.0.0.1"}}
+	cm := &costModel.CostModel{
+		Cache: fakeClusterCache{
+			services: []*v1.Service{
+				lb,
+				newTestService("test1", "backend", v1.ServiceTypeClusterIP),
+			},
+		},
+	}
+
+	serviceCosts, err := cm.ComputeLoadBalancerCosts(cp)
+	assert.NilError(t, err)
+	assert.Equal(t, len(serviceCosts), 1)
+	assert.Equal(t, serviceCosts[0].Namespace, "test1")
+	assert.Equal(t, serviceCosts[0].Name, "frontend")
+	assert.Equal(t, serviceCosts[0].IngressIP, "10.0.0.1")
+	assert.Equal(t, serviceCosts[0].HourlyCost, 0.025)
+
+	// custom pricing overrides the provider default
+	_, err = cp.UpdateConfig(strings.NewReader(`{"loadBalancerCost":"0.5"}`), "")
+	assert.NilError(t, err)
+	serviceCosts, err = cm.ComputeLoadBalancerCosts(cp)
+	assert.NilError(t, err)
+	assert.Equal(t, serviceCosts[0].HourlyCost, 0.5)
+}
+
+func TestAddLoadBalancerCosts(t *testing.T) {
+	cp := newTestProvider(t)
+	serviceCosts := []*costModel.ServiceCost{
+		&costModel.ServiceCost{Namespace: "test1", Name: "frontend", TotalCost: 2.0},
+		&costModel.ServiceCost{Namespace: "test2", Name: "ingress", TotalCost: 1.0},
+	}
+
+	aggs := costModel.AggregateCostModel(cp, newTestCostData(), "namespace", "", false, 0.0, 1.0, nil)
+	costModel.AddLoadBalancerCosts(aggs, "namespace", "", serviceCosts, 0.0)
+	assert.Equal(t, aggs["test1"].LBCost, 2.0)
+	assert.Equal(t, aggs["test1"].TotalCost, 10.0)
+
+	// a namespace with only a load balancer is reported on its own
+	assert.Equal(t, aggs["test2"].LBCost, 1.0)
+	assert.Equal(t, aggs["test2"].TotalCost, 1.0)
+
+	// load balancers are discounted as the rest of the cluster is
+	aggs = costModel.AggregateCostModel(cp, newTestCostData(), "namespace", "", false, 0.0, 1.0, nil)
+	costModel.AddLoadBalancerCosts(aggs, "namespace", "", serviceCosts, 0.5)
+	assert.Equal(t, aggs["test2"].LBCost, 0.5)
+	assert.Equal(t, aggs["test2"].TotalCost, 0.5)
+
+	// load balancers are not attributed to other aggregations
+	aggs = costModel.AggregateCostModel(cp, newTestCostData(), "label", "app", false, 0.0, 1.0, nil)
+	costModel.AddLoadBalancerCosts(aggs, "label", "app", serviceCosts, 0.0)
+	assert.Equal(t, len(aggs), 0)
+}
+
+func TestFilterServiceCosts(t *testing.T) {
+	serviceCosts := []*costModel.ServiceCost{
+		&costModel.ServiceCost{Namespace: "test1", Name: "frontend", ClusterID: "cluster-one"},
+		&costModel.ServiceCost{Namespace: "test2", Name: "ingress", ClusterID: "cluster-one"},
+		&costModel.ServiceCost{Namespace: "test1", Name: "frontend", ClusterID: "cluster-two"},
+	}
+	names := func(serviceCosts []*costModel.ServiceCost) []string {
+		ns := []string{}
+		for _, serviceCost := range serviceCosts {
+			ns = append(ns, serviceCost.ClusterID+"/"+serviceCost.Namespace+"/"+serviceCost.Name)
+		}
+		return ns
+	}
+
+	assert.Equal(t, len(costModel.FilterServiceCosts(serviceCosts, "", "", nil)), 3)
+	assert.DeepEqual(t, names(costModel.FilterServiceCosts(serviceCosts, "", "cluster-two", nil)), []string{"cluster-two/test1/frontend"})
+	assert.DeepEqual(t, names(costModel.FilterServiceCosts(serviceCosts, "test1", "cluster-one", nil)), []string{"cluster-one/test1/frontend"})
+	assert.DeepEqual(t, names(costModel.FilterServiceCosts(serviceCosts, "", "cluster-one", []string{"test1"})), []string{"cluster-one/test2/ingress"})
+}
@@ -0,0 +1,122 @@
+package costmodel_test
+
+import (
+	"math"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+
+	costModel "github.com/kubecost/cost-model/costmodel"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// newFederatedPrometheus returns a fake Prometheus scraping two clusters, on which a pod of the same name
+// requests a CPU in each of cluster-a and cluster-b, and a pod without a cluster label, scraped locally,
+// requests two. Each cluster has a node-1, which cost 2 per CPU in cluster-b. The node price queries it
+// receives are sent to the given channel.
+func newFederatedPrometheus(t *testing.T, nodeQueries chan<- string) *httptest.Server {
+	series := func(cluster string, pod string, value string) map[string]interface{} {
+		metric := map[string]string{"namespace": "web", "pod_name": pod, "container_name": "api", "node": "node-1"}
+		if cluster != "" {
+			metric["cluster"] = cluster
+		}
+		return promSeries(metric, time.Date(2019, 10, 1, 12, 0, 0, 0, time.UTC), value)
+	}
+	return newStubPrometheus(t, func(query string, instant bool) []interface{} {
+		if strings.Contains(query, "node_cpu_hourly_cost") {
+			nodeQueries <- query
+			if strings.Contains(query, `cluster="cluster-b"`) {
+				return []interface{}{promSample(map[string]string{"instance": "node-1", "cluster": "cluster-b"}, "2")}
+			}
+		} else if strings.Contains(query, "node_ram_hourly_cost") || strings.Contains(query, "node_gpu_hourly_cost") {
+			return nil
+		} else if instant {
+			return []interface{}{promSample(nil, "1")}
+		} else if strings.Contains(query, "kube_pod_container_resource_requests_cpu_cores") {
+			return []interface{}{
+				series("cluster-a", "api-1", "1"),
+				series("cluster-b", "api-1", "1"),
+				series("", "api-2", "2"),
+			}
+		}
+		return nil
+	})
+}
+
+func TestComputeCostDataRangeMultiCluster(t *testing.T) {
+	os.Setenv("CLUSTER_ID", "cluster-a")
+	defer os.Unsetenv("CLUSTER_ID")
+
+	nodeQueries := make(chan string, 10)
+	server := newFederatedPrometheus(t, nodeQueries)
+	defer server.Close()
+	cli := newFakePrometheusClient(t, server.URL)
+	cp := newTestProvider(t)
+	assert.NilError(t, cp.DownloadPricingData())
+	// the local cluster, cluster-a, has a node-1 of its own, priced at the custom provider default of 0.031611/core
+	cm := &costModel.CostModel{Cache: fakeClusterCache{nodes: []*v1.Node{
+		&v1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: "node-1", Labels: map[string]string{}},
+			Status: v1.NodeStatus{
+				Capacity: v1.ResourceList{
+					v1.ResourceCPU:    resource.MustParse("4"),
+					v1.ResourceMemory: resource.MustParse("16Gi"),
+				},
+			},
+		},
+	}}}
+
+	data, _, err := cm.ComputeCostDataRange(cli, nil, cp, "2019-10-01T00:00:00.000Z", "2019-10-02T00:00:00.000Z", "1h", "", "", false, false)
+	assert.NilError(t, err)
+	assert.Equal(t, len(data), 3)
+
+	// pods of the same name in different clusters aren't merged, and unlabelled series belong to the local cluster
+	assert.Equal(t, data["cluster-a,web,api-1,api,node-1"].ClusterID, "cluster-a")
+	assert.Equal(t, data["cluster-b,web,api-1,api,node-1"].ClusterID, "cluster-b")
+	assert.Equal(t, data["cluster-a,web,api-2,api,node-1"].ClusterID, "cluster-a")
+
+	// the node-1 of cluster-b is priced by its own history rather than as the local node-1
+	localCPUCost, err := strconv.ParseFloat(data["cluster-a,web,api-1,api,node-1"].NodeData.VCPUCost, 64)
+	assert.NilError(t, err)
+	assert.Assert(t, math.Abs(localCPUCost-0.031611) < 1e-9)
+	assert.Equal(t, data["cluster-b,web,api-1,api,node-1"].NodeData.VCPUCost, "2.000000")
+	assert.Equal(t, len(nodeQueries), 1)
+	query := <-nodeQueries
+	assert.Assert(t, strings.Contains(query, `instance=~"node-1",cluster="cluster-b"`), query)
+
+	aggs := costModel.AggregateCostModel(cp, data, "cluster", "", false, 0, 1.0, nil)
+	assert.Equal(t, len(aggs), 2)
+	// cluster-a requests three CPUs at its price to cluster-b's one at 2
+	assert.Assert(t, aggs["cluster-b"].CPUCost > 0)
+	assert.Assert(t, math.Abs(aggs["cluster-a"].CPUCost-3*localCPUCost/2*aggs["cluster-b"].CPUCost) < 1e-9)
+
+	filtered, _, err := cm.ComputeCostDataRange(cli, nil, cp, "2019-10-01T00:00:00.000Z", "2019-10-02T00:00:00.000Z", "1h", "", "cluster-b", false, false)
+	assert.NilError(t, err)
+	assert.Equal(t, len(filtered), 1)
+	_, ok := filtered["cluster-b,web,api-1,api,node-1"]
+	assert.Assert(t, ok)
+}
+
+func TestNewContainerMetricFromKey(t *testing.T) {
+	c, err := costModel.NewContainerMetricFromKey("cluster-a,web,api-1,api,node-1")
+	assert.NilError(t, err)
+	assert.Equal(t, c.ClusterID, "cluster-a")
+	assert.Equal(t, c.NodeName, "node-1")
+
+	// keys stored before containers were identified by their cluster have none
+	c, err = costModel.NewContainerMetricFromKey("web,api-1,api,node-1")
+	assert.NilError(t, err)
+	assert.Equal(t, c.ClusterID, "")
+	assert.Equal(t, c.Namespace, "web")
+	assert.Equal(t, c.NodeName, "node-1")
+
+	_, err = costModel.NewContainerMetricFromKey("web,api-1")
+	assert.Assert(t, err != nil)
+}
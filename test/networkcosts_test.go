@@ -0,0 +1,99 @@
+package costmodel_test
+
+import (
+	"math"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"gotest.tools/assert"
+
+	"github.com/kubecost/cost-model/cloud"
+	costModel "github.com/kubecost/cost-model/costmodel"
+)
+
+// newNetworkPrometheus returns a fake Prometheus on which api-2 is measured by the network costs daemonset to
+// send 10GB to the internet, while cadvisor reports api-1 and api-2 transmitting 100GB and 1000GB
+func newNetworkPrometheus(t *testing.T) *httptest.Server {
+	sample := func(pod string, value string) map[string]interface{} {
+		return promSample(map[string]string{"namespace": "web", "pod_name": pod}, value)
+	}
+	return newStubPrometheus(t, func(query string, instant bool) []interface{} {
+		if strings.Contains(query, "container_network_transmit_bytes_total") {
+			return []interface{}{sample("api-1", "100"), sample("api-2", "1000")}
+		} else if strings.Contains(query, `internet="true"`) {
+			return []interface{}{sample("api-2", "10")}
+		}
+		return nil
+	})
+}
+
+func TestComputeNetworkCosts(t *testing.T) {
+	server := newNetworkPrometheus(t)
+	defer server.Close()
+	cli := newFakePrometheusClient(t, server.URL)
+
+	cp := newTestProvider(t)
+	_, err := cp.UpdateConfig(strings.NewReader(`{"zoneNetworkEgress":"0.01","regionNetworkEgress":"0.02","internetNetworkEgress":"0.1","networkEgressSplit":"70%,20%,5%,5%"}`), "")
+	assert.NilError(t, err)
+
+	costs, err := costModel.ComputeNetworkCosts(cli, cp, "1d", "")
+	assert.NilError(t, err)
+	assert.Equal(t, len(costs), 2)
+
+	// api-1 isn't measured, so its egress is split by the configured percentages
+	estimated := costs["web,api-1"]
+	assert.Assert(t, estimated.Estimated)
+	assert.Assert(t, math.Abs(estimated.ZoneEgressGB-20) < 1e-9)
+	assert.Assert(t, math.Abs(estimated.RegionEgressGB-5) < 1e-9)
+	assert.Assert(t, math.Abs(estimated.InternetEgressGB-5) < 1e-9)
+	assert.Assert(t, math.Abs(estimated.TotalCost-(0.2+0.1+0.5)) < 1e-9)
+
+	measured := costs["web,api-2"]
+	assert.Assert(t, !measured.Estimated)
+	assert.Equal(t, measured.ZoneEgressGB, 0.0)
+	assert.Assert(t, math.Abs(measured.TotalCost-1.0) < 1e-9)
+
+	namespaces := costModel.NamespaceNetworkCosts(costs)
+	assert.Equal(t, len(namespaces), 1)
+	assert.Assert(t, namespaces["web"].Estimated)
+	assert.Assert(t, math.Abs(namespaces["web"].TotalCost-1.8) < 1e-9)
+}
+
+func TestComputeNetworkCostsUnestimated(t *testing.T) {
+	server := newNetworkPrometheus(t)
+	defer server.Close()
+	cli := newFakePrometheusClient(t, server.URL)
+
+	// without a split, only measured egress is priced
+	costs, err := costModel.ComputeNetworkCosts(cli, newTestProvider(t), "1d", "")
+	assert.NilError(t, err)
+	assert.Equal(t, len(costs), 1)
+	_, ok := costs["web,api-2"]
+	assert.Assert(t, ok)
+}
+
+func TestAggregateNetworkCost(t *testing.T) {
+	cp := newTestProvider(t)
+	costData := newTestCostData()
+	total := totalAggregationCost(costModel.AggregateCostModel(cp, costData, "namespace", "", false, 0, 1.0, nil))
+
+	costData["test1,foo,nginx,testnode"].NetworkData = []*costModel.Vector{{Timestamp: 10, Value: 0.5}}
+	aggs := costModel.AggregateCostModel(cp, costData, "namespace", "", false, 0, 1.0, nil)
+	assert.Equal(t, aggs["test1"].NetworkCost, 0.5)
+	assert.Equal(t, aggs["test1"].TotalCost, total+0.5)
+}
+
+func TestEgressSplitValidation(t *testing.T) {
+	split, err := cloud.CustomEgressSplit(&cloud.CustomPricing{NetworkEgressSplit: "70%, 20%, 5%, 5%"})
+	assert.NilError(t, err)
+	assert.Equal(t, split.CrossZone, 0.2)
+
+	split, err = cloud.CustomEgressSplit(&cloud.CustomPricing{})
+	assert.NilError(t, err)
+	assert.Assert(t, split == nil)
+
+	for _, value := range []string{"70%,20%,5%", "70%,20%,5%,10%", "70,20,5,5", "-10%,100%,5%,5%"} {
+		assert.Assert(t, cloud.ValidateCustomPricingValue("NetworkEgressSplit", value) != nil, value)
+	}
+}
@@ -0,0 +1,86 @@
+package costmodel_test
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"gotest.tools/assert"
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	costModel "github.com/kubecost/cost-model/costmodel"
+	v1 "k8s.io/api/core/v1"
+)
+
+func newRequestsPod(name string, node string, phase v1.PodPhase, cpu ...string) *v1.Pod {
+	pod := newTestPod(name, "default", "main", phase, onNode(node))
+	pod.Spec.Containers = nil
+	for _, c := range cpu {
+		pod.Spec.Containers = append(pod.Spec.Containers, v1.Container{Resources: v1.ResourceRequirements{Requests: v1.ResourceList{
+			v1.ResourceCPU:    resource.MustParse(c),
+			v1.ResourceMemory: resource.MustParse("1Gi"),
+		}}})
+	}
+	return pod
+}
+
+func TestComputeNodeCapacities(t *testing.T) {
+	gpuNode := newTestNode("gpu-1", "n1-standard-2")
+	gpuNode.Status.Capacity["nvidia.com/gpu"] = resource.MustParse("2")
+
+	// the init container requests more CPU than the containers together, and the pod has an overhead
+	initPod := newRequestsPod("init", "node-1", v1.PodRunning, "500m", "250m")
+	initPod.Spec.InitContainers = []v1.Container{{Resources: v1.ResourceRequirements{Requests: v1.ResourceList{
+		v1.ResourceCPU: resource.MustParse("1"),
+	}}}}
+	initPod.Spec.Overhead = v1.ResourceList{v1.ResourceCPU: resource.MustParse("100m")}
+
+	cache := fakeClusterCache{
+		nodes: []*v1.Node{newTestNode("node-1", "n1-standard-2"), gpuNode},
+		pods: []*v1.Pod{
+			initPod,
+			newRequestsPod("pending", "node-1", v1.PodPending, "250m"),
+			newRequestsPod("done", "node-1", v1.PodSucceeded, "1"),
+			newRequestsPod("gone", "node-0", v1.PodRunning, "1"),
+		},
+	}
+
+	capacities := costModel.ComputeNodeCapacities(cache)
+	assert.Equal(t, len(capacities), 2)
+	node := capacities["node-1"]
+	assert.Equal(t, node.CPUCores, 2.0)
+	assert.Equal(t, node.RAMBytes, float64(4*1024*1024*1024))
+	assert.Equal(t, node.GPUCount, 0.0)
+	assert.Assert(t, math.Abs(node.AllocatedCPUCores-1.35) < 1e-9, "%f", node.AllocatedCPUCores)
+	assert.Equal(t, node.AllocatedRAMBytes, float64(3*1024*1024*1024))
+	assert.Equal(t, capacities["gpu-1"].GPUCount, 2.0)
+	assert.Equal(t, capacities["gpu-1"].AllocatedCPUCores, 0.0)
+}
+
+func TestRecordPricesRecordsNodeCapacity(t *testing.T) {
+	server, _ := newSlowPrometheus(t, 0, false)
+	defer server.Close()
+	a := newTestRecordingAccesses(t, server.URL, time.Hour)
+	a.Model = &costModel.CostModel{Cache: fakeClusterCache{
+		nodes: []*v1.Node{newTestNode("node-1", "n1-standard-2")},
+		pods:  []*v1.Pod{newRequestsPod("web", "node-1", v1.PodRunning, "500m")},
+	}}
+
+	// a cancelled recording completes its first pass
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	<-a.RecordPrices(ctx)
+
+	value := func(gauge prometheus.Gauge) float64 {
+		m := &dto.Metric{}
+		assert.NilError(t, gauge.Write(m))
+		return m.GetGauge().GetValue()
+	}
+	assert.Equal(t, value(a.NodeCPUCapacityRecorder.WithLabelValues("node-1", "node-1")), 2.0)
+	assert.Equal(t, value(a.NodeRAMCapacityRecorder.WithLabelValues("node-1", "node-1")), float64(4*1024*1024*1024))
+	assert.Equal(t, value(a.NodeAllocatedCPURecorder.WithLabelValues("node-1", "node-1")), 0.5)
+	assert.Equal(t, value(a.NodeAllocatedRAMRecorder.WithLabelValues("node-1", "node-1")), float64(1024*1024*1024))
+}
@@ -0,0 +1,63 @@
+package costmodel_test
+
+import (
+	"math"
+	"testing"
+
+	"gotest.tools/assert"
+
+	"github.com/kubecost/cost-model/cloud"
+	costModel "github.com/kubecost/cost-model/costmodel"
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestNodePools(t *testing.T) {
+	cp := newTestProvider(t)
+
+	gke := newTestNode("gke-1", "n1-standard-2")
+	gke.Labels["cloud.google.com/gke-nodepool"] = "default-pool"
+	eks := newTestNode("eks-1", "m5.large")
+	eks.Labels["eks.amazonaws.com/nodegroup"] = "batch"
+	cm := &costModel.CostModel{Cache: fakeClusterCache{nodes: []*v1.Node{gke, eks, newTestNode("bare-1", "m5.large")}}}
+
+	assets, err := cm.ComputeAssets(cp)
+	assert.NilError(t, err)
+	pools := make(map[string]string)
+	for _, node := range assets.Nodes {
+		pools[node.Name] = node.NodePool
+	}
+	assert.DeepEqual(t, pools, map[string]string{"gke-1": "default-pool", "eks-1": "batch", "bare-1": cloud.UnknownNodePool})
+
+	nodes := []*costModel.NodeAsset{
+		&costModel.NodeAsset{Name: "batch-1", NodePool: "batch"},
+		&costModel.NodeAsset{Name: "batch-2", NodePool: "batch"},
+		&costModel.NodeAsset{Name: "bare-1"},
+	}
+	idle := costModel.ComputeIdleByNodePool(map[string]*costModel.NodeIdleCost{
+		"batch-1": &costModel.NodeIdleCost{Node: "batch-1", HourlyCost: 1, TotalCost: 24, AllocatedCost: 18, IdleCost: 6},
+		"batch-2": &costModel.NodeIdleCost{Node: "batch-2", HourlyCost: 1, TotalCost: 24, AllocatedCost: 6, IdleCost: 18},
+		"bare-1":  &costModel.NodeIdleCost{Node: "bare-1", HourlyCost: 0.5, TotalCost: 12, IdleCost: 12},
+	}, nodes)
+	assert.Equal(t, len(idle), 2)
+	assert.Equal(t, idle["batch"].Nodes, 2)
+	assert.Equal(t, idle["batch"].TotalCost, 48.0)
+	assert.Equal(t, idle["batch"].AllocatedCost, 24.0)
+	assert.Equal(t, idle["batch"].IdleCost, 24.0)
+	assert.Assert(t, math.Abs(idle["batch"].IdlePercentage-50.0) < 1e-9)
+	assert.Equal(t, idle[cloud.UnknownNodePool].IdlePercentage, 100.0)
+
+	// containers aggregate by the pools of their nodes
+	costData := newTestCostData()
+	for _, costDatum := range costData {
+		costDatum.NodeData.Labels = map[string]string{"karpenter.sh/provisioner-name": "general"}
+	}
+	costData["unpooled"] = &costModel.CostData{
+		Namespace:     "test3",
+		NodeData:      &cloud.Node{VCPUCost: "1.0", RAMCost: "1.0"},
+		CPUAllocation: []*costModel.Vector{&costModel.Vector{Timestamp: 10, Value: 1.0}},
+	}
+	aggs := costModel.AggregateCostModel(cp, costData, "nodepool", "", false, 0, 1.0, nil)
+	assert.Equal(t, len(aggs), 2)
+	assert.Assert(t, aggs["general"].TotalCost > 0)
+	assert.Assert(t, aggs[cloud.UnknownNodePool].CPUCost > 0)
+}
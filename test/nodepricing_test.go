@@ -0,0 +1,117 @@
+package costmodel_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"gotest.tools/assert"
+	v1 "k8s.io/api/core/v1"
+
+	"github.com/kubecost/cost-model/cloud"
+	costModel "github.com/kubecost/cost-model/costmodel"
+)
+
+const testNodePricingCSV = `name,node,selector,cpu,ram,gpu,storage
+highmem,,node-type=highmem,0.02,0.008,,
+,metal-7,,0.05,,,0.0001
+`
+
+func writeNodePricingFile(t *testing.T, dir, name, contents string, modTime time.Time) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestCustomProviderNodePricingRules(t *testing.T) {
+	cp := newTestProvider(t)
+	dir, err := ioutil.TempDir("", "node-pricing")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+	path := writeNodePricingFile(t, dir, "pricing.csv", testNodePricingCSV, time.Now().Add(-time.Hour))
+
+	_, err = cp.UpdateConfig(strings.NewReader(`{"nodePricingFile":"`+path+`"}`), "")
+	assert.NilError(t, err)
+	assert.NilError(t, cp.DownloadPricingData())
+
+	highmem, err := cp.NodePricing(cp.GetKey(map[string]string{v1.LabelHostname: "metal-1", "node-type": "highmem"}))
+	assert.NilError(t, err)
+	assert.Equal(t, highmem.VCPUCost, "0.02")
+	assert.Equal(t, highmem.RAMCost, "0.008")
+	assert.Equal(t, highmem.PricingRule, "highmem")
+
+	// rules naming a node take precedence over selectors, and unset prices fall back to the custom prices
+	named, err := cp.NodePricing(cp.GetKey(map[string]string{v1.LabelHostname: "metal-7", "node-type": "highmem"}))
+	assert.NilError(t, err)
+	assert.Equal(t, named.VCPUCost, "0.05")
+	assert.Equal(t, named.RAMCost, "0.004237")
+	assert.Equal(t, named.StorageCost, "0.0001")
+	assert.Equal(t, named.PricingRule, "node=metal-7")
+
+	unmatched, err := cp.NodePricing(cp.GetKey(map[string]string{v1.LabelHostname: "metal-2", "node-type": "standard"}))
+	assert.NilError(t, err)
+	assert.Equal(t, unmatched.VCPUCost, "0.031611")
+	assert.Equal(t, unmatched.PricingRule, "")
+
+	// unmatched nodes are counted once, rather than each time they are priced
+	_, err = cp.NodePricing(cp.GetKey(map[string]string{v1.LabelHostname: "metal-2", "node-type": "standard"}))
+	assert.NilError(t, err)
+	assert.Equal(t, testutil.ToFloat64(cloud.UnmatchedNodePricingCounter.WithLabelValues("metal-2")), 1.0)
+
+	all, err := cp.AllNodePricing()
+	assert.NilError(t, err)
+	pricing := all.(map[string]*cloud.NodePrice)
+	assert.Equal(t, pricing["node,metal-1"].Rule, "highmem")
+	assert.Equal(t, pricing["node,metal-7"].Rule, "node=metal-7")
+	assert.Equal(t, pricing["node,metal-2"].Rule, "")
+	assert.Equal(t, pricing["default"].CPU, "0.031611")
+
+	// the file is reloaded once it changes
+	writeNodePricingFile(t, dir, "pricing.csv", "name,selector,cpu\nhighmem,node-type=highmem,0.03\n", time.Now())
+	assert.NilError(t, cp.DownloadPricingData())
+	highmem, err = cp.NodePricing(cp.GetKey(map[string]string{v1.LabelHostname: "metal-1", "node-type": "highmem"}))
+	assert.NilError(t, err)
+	assert.Equal(t, highmem.VCPUCost, "0.03")
+	assert.Equal(t, highmem.RAMCost, "0.004237")
+}
+
+func TestNodePricingRuleStoragePrice(t *testing.T) {
+	cp := newTestProvider(t)
+	_, err := cp.UpdateConfig(strings.NewReader(`{"customPricesEnabled":"true","storage":"0.25"}`), "")
+	assert.NilError(t, err)
+
+	// the volumes of nodes priced by a rule are priced at its storage price, or else at the custom storage price
+	costData := newTestCostData()
+	costData["test1,foo,nginx,testnode"].NodeData.PricingRule = "highmem"
+	costData["test1,foo,nginx,testnode"].NodeData.StorageCost = "0.5"
+	costData["test1,bar,nginx,testnode"].NodeData.PricingRule = "highmem"
+	agg := costModel.AggregateCostModel(cp, costData, "namespace", "", false, 0.0, 1.0, nil)
+	assert.Equal(t, agg["test1"].PVCost, 2*0.5+2*0.25)
+}
+
+func TestLoadNodePricingRulesJSON(t *testing.T) {
+	dir, err := ioutil.TempDir("", "node-pricing")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := writeNodePricingFile(t, dir, "pricing.json", `[{"selector":{"node-type":"gpu","zone":"a"},"gpu":"0.9"}]`, time.Now())
+	rules, err := cloud.LoadNodePricingRules(path)
+	assert.NilError(t, err)
+	assert.Equal(t, len(rules), 1)
+	assert.Equal(t, rules[0].ID(), "node-type=gpu,zone=a")
+	assert.Assert(t, cloud.MatchNodePricingRule(rules, "n", map[string]string{"node-type": "gpu", "zone": "a"}) != nil)
+	assert.Assert(t, cloud.MatchNodePricingRule(rules, "n", map[string]string{"node-type": "gpu"}) == nil)
+
+	path = writeNodePricingFile(t, dir, "invalid.csv", "name,cpu\nall,0.01\n", time.Now())
+	_, err = cloud.LoadNodePricingRules(path)
+	assert.ErrorContains(t, err, "matches neither a node nor a selector")
+}
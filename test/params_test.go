@@ -0,0 +1,220 @@
+package costmodel_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+
+	costModel "github.com/kubecost/cost-model/costmodel"
+)
+
+// invalidParams returns the names of the invalid parameters reported by the given validation error
+func invalidParams(t *testing.T, err error) []string {
+	if err == nil {
+		return nil
+	}
+	coded, ok := err.(*costModel.CodedError)
+	assert.Assert(t, ok, err)
+	errs, ok := coded.Err.(costModel.ParamErrors)
+	assert.Assert(t, ok, err)
+	params := []string{}
+	for _, pe := range errs {
+		params = append(params, pe.Param)
+	}
+	return params
+}
+
+func TestValidateParams(t *testing.T) {
+	request := func(query string) *http.Request {
+		return httptest.NewRequest("GET", "/?"+query, nil)
+	}
+	cp := newTestProvider(t)
+	validate := map[string]func(r *http.Request) error{
+		"costDataModel": func(r *http.Request) error { return costModel.NewCostDataModelParams(r).Validate() },
+		"costDataModelRange": func(r *http.Request) error {
+			return costModel.NewCostDataModelRangeParams(r).Validate()
+		},
+		"aggregatedCostModel": func(r *http.Request) error { return costModel.NewAggregateCostModelParams(r).Validate(cp) },
+		"clusterCostsOverTime": func(r *http.Request) error {
+			return costModel.NewClusterCostsOverTimeParams(r).Validate()
+		},
+		"outOfClusterCosts": func(r *http.Request) error { return costModel.NewOutOfClusterCostsParams(r).Validate() },
+		"requestSizing":     func(r *http.Request) error { return costModel.NewRequestSizingParams(r).Validate() },
+		"clusterSizing":     func(r *http.Request) error { return costModel.NewClusterSizingParams(r).Validate() },
+		"storageSavings":    func(r *http.Request) error { return costModel.NewStorageSavingsParams(r).Validate() },
+	}
+
+	cases := []struct {
+		endpoint string
+		query    string
+		invalid  []string
+	}{
+		{"costDataModel", "timeWindow=1d&offset=1h30m", nil},
+		{"costDataModel", "timeWindow=1.5h&offset=yesterday&aggregation=label", []string{"timeWindow", "offset", "aggregationSubfield"}},
+		{"costDataModel", "aggregation=team", []string{"timeWindow", "aggregation"}},
+		{"costDataModelRange", "start=2019-09-01T00:00:00.000Z&end=2019-09-02T00:00:00.000Z&window=1h&minResolution=15m", nil},
+		{"costDataModelRange", "start=2019-09-02T00:00:00.000Z&end=2019-09-01T00:00:00.000Z&window=-1h", []string{"end", "window"}},
+		{"costDataModelRange", "start=yesterday&window=1h&resolution=soon", []string{"start", "end", "resolution"}},
+		{"aggregatedCostModel", "aggregation=namespace&window=7d&timezone=America/New_York", nil},
+		{"aggregatedCostModel", "aggregation=pods&window=1h&start=2019-09-01T00:00:00.000Z", []string{"aggregation", "start"}},
+		{"aggregatedCostModel", "aggregation=annotation&idleMode=x&timezone=Mars/Olympus_Mons", []string{"aggregationSubfield", "window", "idleMode", "timezone"}},
+		{"aggregatedCostModel", "aggregation=image&aggregationSubfield=digest&window=1d", nil},
+		{"aggregatedCostModel", "aggregation=image&aggregationSubfield=sha&window=1d", []string{"aggregationSubfield"}},
+		{"aggregatedCostModel", "aggregation=namespace&window=1d&currency=usd&precision=2&pvBillingMode=provisioned&allocationPolicy=usage&costBasis=usage&categories=cpu,ram&sharedLabelNames=team&sharedLabelValues=infra", nil},
+		{"aggregatedCostModel", "aggregation=namespace&window=1d&sharedLabelNames=team&currency=XYZ&precision=-1&pvBillingMode=x&allocationPolicy=x&costBasis=x&categories=disk", []string{"sharedLabelNames", "currency", "precision", "pvBillingMode", "allocationPolicy", "costBasis", "categories"}},
+		{"clusterCostsOverTime", "start=2019-09-01T00:00:00.000Z&end=2019-09-02T00:00:00.000Z&window=1h&offset=1m", nil},
+		{"clusterCostsOverTime", "start=yesterday&end=2019-09-02T00:00:00.000Z&window=1d", []string{"start", "window"}},
+		{"outOfClusterCosts", "start=2019-04-20&end=2019-04-20&page=2&pageSize=10", nil},
+		{"outOfClusterCosts", "end=2019-04-27&page=0&pageSize=ten", []string{"start", "page", "pageSize"}},
+		{"requestSizing", "", nil},
+		{"requestSizing", "window=7d&quantile=0.99&targetUtilization=1&sortBy=name&namespace=default", nil},
+		{"requestSizing", "window=0h&quantile=95&targetUtilization=0&sortBy=cost", []string{"window", "quantile", "targetUtilization", "sortBy"}},
+		{"clusterSizing", "window=1d&headroom=0&candidateTypes=m5.large,m5.xlarge", nil},
+		{"clusterSizing", "window=soon&offset=1d&headroom=-0.1", []string{"window", "offset", "headroom"}},
+		{"storageSavings", "", nil},
+		{"storageSavings", "window=soon&offset=1d", []string{"window", "offset"}},
+	}
+	for _, c := range cases {
+		t.Run(c.endpoint+"?"+c.query, func(t *testing.T) {
+			err := validate[c.endpoint](request(c.query))
+			assert.DeepEqual(t, invalidParams(t, err), c.invalid)
+		})
+	}
+}
+
+func TestValidateParamsParses(t *testing.T) {
+	rangeParams := costModel.NewCostDataModelRangeParams(httptest.NewRequest("GET", "/?start=2019-09-01T00:00:00.000Z&end=2019-09-02T00:00:00.000Z&window=1h&minResolution=1d", nil))
+	assert.NilError(t, rangeParams.Validate())
+	assert.Equal(t, rangeParams.MinResolution, 24*time.Hour)
+
+	aggParams := costModel.NewAggregateCostModelParams(httptest.NewRequest("GET", "/?aggregation=namespace&window=1h", nil))
+	assert.NilError(t, aggParams.Validate(newTestProvider(t)))
+	assert.Equal(t, aggParams.IdleMode, costModel.IdleModeCoefficient)
+	assert.Equal(t, aggParams.Location, time.UTC)
+
+	pageParams := costModel.NewOutOfClusterCostsParams(httptest.NewRequest("GET", "/?start=2019-04-20&end=2019-04-27T12:00:00Z", nil))
+	assert.NilError(t, pageParams.Validate())
+	assert.Equal(t, pageParams.Page, 1)
+	assert.Equal(t, pageParams.PageSize, 0)
+	assert.Equal(t, pageParams.End, "2019-04-27")
+
+	// start and end are passed on in the layout of range queries, whatever format they're given in
+	overTime := costModel.NewClusterCostsOverTimeParams(httptest.NewRequest("GET", "/?start=1567296000&end=2019-09-02T00:00:00Z&window=1h", nil))
+	assert.NilError(t, overTime.Validate())
+	assert.Equal(t, overTime.Start, "2019-09-01T00:00:00.000Z")
+	assert.Equal(t, overTime.End, "2019-09-02T00:00:00.000Z")
+}
+
+func TestParseTimeParam(t *testing.T) {
+	expected := time.Date(2019, 10, 1, 12, 0, 0, 0, time.UTC)
+	for _, value := range []string{
+		"2019-10-01T12:00:00Z",
+		"2019-10-01T12:00:00.000Z",
+		"2019-10-01T14:00:00+02:00",
+		"1569931200",
+		"1569931200000",
+	} {
+		parsed, err := costModel.ParseTimeParam(value)
+		assert.NilError(t, err, value)
+		assert.Assert(t, parsed.Equal(expected), "%s: %s", value, parsed)
+		assert.Equal(t, parsed.Location(), time.UTC, value)
+	}
+
+	// dates are midnight UTC
+	parsed, err := costModel.ParseTimeParam("2019-10-01")
+	assert.NilError(t, err)
+	assert.Assert(t, parsed.Equal(time.Date(2019, 10, 1, 0, 0, 0, 0, time.UTC)))
+
+	for _, value := range []string{"", "yesterday", "2019-10-01 12:00:00", "10/01/2019", "1569931200.5"} {
+		_, err := costModel.ParseTimeParam(value)
+		assert.ErrorContains(t, err, "Unix seconds or milliseconds", value)
+	}
+}
+
+func TestAggregateCostModelReportsInvalidParams(t *testing.T) {
+	a := &costModel.Accesses{}
+	w := httptest.NewRecorder()
+	a.AggregateCostModel(w, httptest.NewRequest("GET", "/aggregatedCostModel?aggregation=label&window=yesterday", nil), nil)
+	assert.Equal(t, w.Code, http.StatusBadRequest)
+
+	var envelope costModel.DataEnvelope
+	assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &envelope))
+	assert.Equal(t, envelope.ErrorCode, costModel.ErrorCodeBadRequest)
+	assert.Equal(t, len(envelope.Errors), 2)
+	assert.Equal(t, envelope.Errors[0].Param, "aggregationSubfield")
+	assert.Equal(t, envelope.Errors[0].Code, costModel.ErrorCodeBadRequest)
+	assert.Equal(t, envelope.Errors[1].Param, "window")
+	assert.Equal(t, envelope.Errors[1].Code, costModel.ErrorCodeBadWindow)
+}
+
+func TestDefaultAggregation(t *testing.T) {
+	cp := newTestProvider(t)
+	request := func(query string) *costModel.AggregateCostModelParams {
+		return costModel.NewAggregateCostModelParams(httptest.NewRequest("GET", "/aggregatedCostModel?"+query, nil))
+	}
+
+	// without the default, the aggregation is still required
+	assert.DeepEqual(t, invalidParams(t, request("window=1h").Validate(cp)), []string{"aggregation"})
+
+	os.Setenv("DEFAULT_AGGREGATION", "namespace")
+	defer os.Unsetenv("DEFAULT_AGGREGATION")
+	params := request("window=1h")
+	assert.NilError(t, params.Validate(cp))
+	assert.Equal(t, params.Aggregation, "namespace")
+
+	// the aggregation of the request takes precedence over the default
+	params = request("window=1h&aggregation=cluster")
+	assert.NilError(t, params.Validate(cp))
+	assert.Equal(t, params.Aggregation, "cluster")
+
+	// a default label aggregation still requires the label to aggregate by
+	os.Setenv("DEFAULT_AGGREGATION", "label")
+	assert.DeepEqual(t, invalidParams(t, request("window=1h").Validate(cp)), []string{"aggregationSubfield"})
+	assert.NilError(t, request("window=1h&aggregationSubfield=app").Validate(cp))
+}
+
+func TestAggregateCostModelDefaultAggregation(t *testing.T) {
+	server, _ := newSlowPrometheus(t, 0, false)
+	defer server.Close()
+	a := newTestAccesses(t, server.URL, "")
+
+	os.Setenv("DEFAULT_AGGREGATION", "namespace")
+	defer os.Unsetenv("DEFAULT_AGGREGATION")
+	envelope := getAggregatedCostModel(t, a, "window=1h")
+	assert.Equal(t, envelope.Status, "success")
+}
+
+func TestCostDataModelRangeTimezone(t *testing.T) {
+	server, _ := newSlowPrometheus(t, 0, false)
+	defer server.Close()
+	a := newTestAccesses(t, server.URL, "")
+
+	getRange := func(query string) (int, *costModel.DataEnvelope) {
+		w := httptest.NewRecorder()
+		a.CostDataModelRange(w, httptest.NewRequest("GET", "/costDataModelRange?start=2019-09-01T00:00:00Z&end=2019-09-02T00:00:00Z&"+query, nil), nil)
+		var envelope costModel.DataEnvelope
+		assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &envelope))
+		return w.Code, &envelope
+	}
+
+	// daily points are days of the time zone, and the range is extended to their boundaries
+	code, envelope := getRange("window=1h&resolution=1d&timezone=Australia/Sydney")
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, envelope.Start, "2019-08-31T14:00:00.000Z")
+	assert.Equal(t, envelope.End, "2019-09-02T14:00:00.000Z")
+
+	// steps of less than a day aren't aligned
+	code, envelope = getRange("window=1h&timezone=Australia/Sydney")
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, envelope.Start, "2019-09-01T00:00:00.000Z")
+	assert.Equal(t, envelope.End, "2019-09-02T00:00:00.000Z")
+
+	code, envelope = getRange("window=1d&timezone=Mars/Olympus_Mons")
+	assert.Equal(t, code, http.StatusBadRequest)
+	assert.Equal(t, envelope.Errors[0].Param, "timezone")
+}
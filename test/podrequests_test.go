@@ -0,0 +1,123 @@
+package costmodel_test
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+
+	costModel "github.com/kubecost/cost-model/costmodel"
+	v1 "k8s.io/api/core/v1"
+)
+
+// newNoKSMPrometheus returns a fake Prometheus without kube-state-metrics, so without requests, which has
+// scraped cAdvisor 60 times over the window
+func newNoKSMPrometheus(t *testing.T) *httptest.Server {
+	return newStubPrometheus(t, func(query string, instant bool) []interface{} {
+		if strings.Contains(query, "count_over_time(container_memory_working_set_bytes{}") {
+			return []interface{}{promSample(nil, "60")}
+		}
+		return nil
+	})
+}
+
+// newPartialKSMPrometheus returns a fake Prometheus which has scraped kube-state-metrics 60 times over the window,
+// but has CPU requests of 0.75 cores for web-1 only, and no RAM requests
+func newPartialKSMPrometheus(t *testing.T) *httptest.Server {
+	return newStubPrometheus(t, func(query string, instant bool) []interface{} {
+		if strings.HasPrefix(query, "max(count_over_time(kube_pod_container_resource_requests_memory_bytes{}") {
+			return []interface{}{promSample(nil, "60")}
+		} else if strings.Contains(query, "kube_pod_container_resource_requests_cpu_cores") {
+			return []interface{}{promSample(map[string]string{"namespace": "web", "pod_name": "web-1", "container_name": "app", "node": "node-1"}, "45")}
+		}
+		return nil
+	})
+}
+
+// newRequestingPod returns a running pod, the container of which requests half a CPU and 1Gi of RAM and
+// started the given time ago
+func newRequestingPod(name string, namespace string, started time.Duration) *v1.Pod {
+	return newTestPod(name, namespace, "app", v1.PodRunning, requesting("500m", "1Gi"), runningSince(time.Now().Add(-started)))
+}
+
+func TestComputeCostDataWithoutKubeStateMetrics(t *testing.T) {
+	server := newNoKSMPrometheus(t)
+	defer server.Close()
+	cp := newTestProvider(t)
+	cm := &costModel.CostModel{Cache: fakeClusterCache{
+		pods: []*v1.Pod{
+			newRequestingPod("web-1", "web", 2*time.Hour),
+			newRequestingPod("web-2", "web", 30*time.Minute),
+		},
+	}}
+
+	data, warnings, err := cm.ComputeCostData(newFakePrometheusClient(t, server.URL), nil, cp, "1h", "", "")
+	assert.NilError(t, err)
+	assert.Equal(t, len(data), 2)
+	assert.Equal(t, len(warnings), 2)
+	assert.Assert(t, strings.Contains(warnings[0], "kube-state-metrics"), warnings[0])
+
+	clusterID := costModel.LocalClusterID(cp)
+	web1 := data[clusterID+",web,web-1,app,node-1"]
+	assert.Assert(t, web1 != nil)
+	assert.Equal(t, web1.CPUReq[0].Value, 0.5)
+	assert.Equal(t, web1.RAMReq[0].Value, float64(1<<30))
+
+	// the container which started halfway through the window is allocated half its request
+	web2 := data[clusterID+",web,web-2,app,node-1"]
+	assert.Assert(t, web2 != nil)
+	assert.Assert(t, math.Abs(web2.CPUReq[0].Value-0.25) < 0.01, "%f", web2.CPUReq[0].Value)
+	assert.Assert(t, math.Abs(web2.CPUAllocation[0].Value-0.25) < 0.01, "%f", web2.CPUAllocation[0].Value)
+}
+
+func TestComputeCostDataEstimatesAbsentRequests(t *testing.T) {
+	server := newPartialKSMPrometheus(t)
+	defer server.Close()
+	cp := newTestProvider(t)
+	cm := &costModel.CostModel{Cache: fakeClusterCache{
+		pods: []*v1.Pod{
+			newRequestingPod("web-1", "web", 2*time.Hour),
+			newRequestingPod("web-2", "web", 2*time.Hour),
+		},
+	}}
+
+	// only the requests prometheus has no series of are estimated from the pod specs
+	data, warnings, err := cm.ComputeCostData(newFakePrometheusClient(t, server.URL), nil, cp, "1h", "", "")
+	assert.NilError(t, err)
+	assert.Equal(t, len(warnings), 2)
+	clusterID := costModel.LocalClusterID(cp)
+	web1 := data[clusterID+",web,web-1,app,node-1"]
+	assert.Assert(t, web1 != nil)
+	assert.Equal(t, web1.CPUReq[0].Value, 0.75)
+	assert.Equal(t, web1.RAMReq[0].Value, float64(1<<30))
+	web2 := data[clusterID+",web,web-2,app,node-1"]
+	assert.Assert(t, web2 != nil)
+	assert.Equal(t, web2.CPUReq[0].Value, 0.5)
+
+	// the specs of the pods running now don't stand in for the requests of past windows
+	data, warnings, err = cm.ComputeCostData(newFakePrometheusClient(t, server.URL), nil, cp, "1h", "offset 1d", "")
+	assert.NilError(t, err)
+	assert.Equal(t, len(warnings), 0)
+	web2 = data[clusterID+",web,web-2,app,node-1"]
+	assert.Assert(t, web2 == nil || web2.CPUReq[0].Value == 0)
+}
+
+func TestCostDataModelFlagsDegradedAllocation(t *testing.T) {
+	server := newNoKSMPrometheus(t)
+	defer server.Close()
+	a := newTestAccesses(t, server.URL, "")
+	a.Model = &costModel.CostModel{Cache: fakeClusterCache{pods: []*v1.Pod{newRequestingPod("web-1", "web", 2*time.Hour)}}}
+
+	w := httptest.NewRecorder()
+	a.CostDataModel(w, httptest.NewRequest("GET", "/costDataModel?timeWindow=1h", nil), nil)
+	var envelope costModel.DataEnvelope
+	assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &envelope))
+	assert.Equal(t, envelope.Code, http.StatusOK, envelope.Message)
+	assert.Assert(t, strings.Contains(envelope.Message, "Degraded allocation"), envelope.Message)
+	assert.Equal(t, len(envelope.Warnings), 2)
+}
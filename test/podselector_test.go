@@ -0,0 +1,124 @@
+package costmodel_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"gotest.tools/assert"
+
+	costModel "github.com/kubecost/cost-model/costmodel"
+)
+
+// newPodLabelsPrometheus returns a fake Prometheus which selects the given pods, as "cluster,namespace,pod", by
+// kube_pod_labels, and records the queries it's sent. Pods of an empty cluster have no cluster label.
+func newPodLabelsPrometheus(t *testing.T, pods []string, queries *[]string) *httptest.Server {
+	return newStubPrometheus(t, func(query string, instant bool) []interface{} {
+		*queries = append(*queries, query)
+		var result []interface{}
+		for _, pod := range pods {
+			ids := strings.Split(pod, ",")
+			metric := map[string]string{"namespace": ids[1], "pod": ids[2]}
+			if ids[0] != "" {
+				metric["cluster"] = ids[0]
+			}
+			result = append(result, promSample(metric, "1"))
+		}
+		return result
+	})
+}
+
+func TestParsePodSelector(t *testing.T) {
+	selector, err := costModel.ParsePodSelector(`{app=~"web.*", env="prod", tier!~'cache|db'}`)
+	assert.NilError(t, err)
+	assert.Equal(t, len(selector), 3)
+	assert.Equal(t, selector.String(), `app=~"web.*",env="prod",tier!~"cache|db"`)
+
+	// regular expressions match whole values, and missing labels match as empty
+	assert.Assert(t, selector.Matches(map[string]string{"app": "web-frontend", "env": "prod"}))
+	assert.Assert(t, !selector.Matches(map[string]string{"app": "api", "env": "prod"}))
+	assert.Assert(t, !selector.Matches(map[string]string{"app": "my-web", "env": "prod"}))
+	assert.Assert(t, !selector.Matches(map[string]string{"app": "web", "env": "prod", "tier": "cache"}))
+	assert.Assert(t, !selector.Matches(map[string]string{"app": "web"}))
+
+	// labels are named as kube-state-metrics exports them
+	selector, err = costModel.ParsePodSelector(`app_kubernetes_io_name="shop"`)
+	assert.NilError(t, err)
+	assert.Assert(t, selector.Matches(map[string]string{"app.kubernetes.io/name": "shop"}))
+
+	selector, err = costModel.ParsePodSelector(" {} ")
+	assert.NilError(t, err)
+	assert.Assert(t, selector == nil)
+
+	for _, invalid := range []string{
+		`app=~"web(.*"`,
+		`app=web`,
+		`app~"web"`,
+		`app="web" env="prod"`,
+		`{app="web"`,
+		`app="web`,
+		`app.name="web"`,
+	} {
+		_, err := costModel.ParsePodSelector(invalid)
+		assert.Assert(t, err != nil, invalid)
+	}
+}
+
+func TestSelectPodCostData(t *testing.T) {
+	var queries []string
+	server := newPodLabelsPrometheus(t, []string{",shop,web-1"}, &queries)
+	defer server.Close()
+
+	selector, err := costModel.ParsePodSelector(`app=~"web.*",env="prod"`)
+	assert.NilError(t, err)
+	costData := map[string]*costModel.CostData{
+		"shop,web-1,app":   {Namespace: "shop", PodName: "web-1", Name: "app"},
+		"shop,web-1,proxy": {Namespace: "shop", PodName: "web-1", Name: "proxy"},
+		"shop,api-1,app":   {Namespace: "shop", PodName: "api-1", Name: "app"},
+	}
+
+	selected, err := costModel.SelectPodCostData(newFakePrometheusClient(t, server.URL), costData, selector, "1d", "offset 1h", "cluster-one")
+	assert.NilError(t, err)
+	assert.Equal(t, len(selected), 2)
+	assert.Assert(t, selected["shop,web-1,proxy"] != nil)
+	assert.Equal(t, len(queries), 1)
+	assert.Assert(t, strings.Contains(queries[0], `kube_pod_labels{label_app=~"web.*",label_env="prod"}[1d] offset 1h`), queries[0])
+	assert.Assert(t, strings.Contains(queries[0], "by (cluster, namespace, pod)"), queries[0])
+}
+
+func TestSelectPodCostDataMultiCluster(t *testing.T) {
+	var queries []string
+	server := newPodLabelsPrometheus(t, []string{"cluster-two,shop,web-1", ",shop,api-1"}, &queries)
+	defer server.Close()
+
+	selector, err := costModel.ParsePodSelector(`app="web"`)
+	assert.NilError(t, err)
+	costData := map[string]*costModel.CostData{
+		"shop,web-1,app,node-1,cluster-one": {Namespace: "shop", PodName: "web-1", Name: "app", ClusterID: "cluster-one"},
+		"shop,web-1,app,node-2,cluster-two": {Namespace: "shop", PodName: "web-1", Name: "app", ClusterID: "cluster-two"},
+		"shop,api-1,app,node-1,cluster-one": {Namespace: "shop", PodName: "api-1", Name: "app", ClusterID: "cluster-one"},
+		"shop,api-1,app,node-2,cluster-two": {Namespace: "shop", PodName: "api-1", Name: "app", ClusterID: "cluster-two"},
+	}
+
+	// the pod of the same name in the other cluster isn't selected, and pods without a cluster label are local
+	selected, err := costModel.SelectPodCostData(newFakePrometheusClient(t, server.URL), costData, selector, "1d", "", "cluster-one")
+	assert.NilError(t, err)
+	assert.Equal(t, len(selected), 2)
+	assert.Assert(t, selected["shop,web-1,app,node-2,cluster-two"] != nil)
+	assert.Assert(t, selected["shop,api-1,app,node-1,cluster-one"] != nil)
+}
+
+func TestCostDataModelInvalidPodSelector(t *testing.T) {
+	a := &costModel.Accesses{}
+	w := httptest.NewRecorder()
+	a.CostDataModel(w, httptest.NewRequest("GET", `/costDataModel?timeWindow=1h&podSelector=app%3D~%22web(%22`, nil), nil)
+	assert.Equal(t, w.Code, http.StatusBadRequest)
+
+	var envelope costModel.DataEnvelope
+	assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &envelope))
+	assert.Equal(t, len(envelope.Errors), 1)
+	assert.Equal(t, envelope.Errors[0].Param, "podSelector")
+	assert.Assert(t, strings.Contains(envelope.Errors[0].Message, "regular expression"), envelope.Errors[0].Message)
+}
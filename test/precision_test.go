@@ -0,0 +1,74 @@
+package costmodel_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"gotest.tools/assert"
+
+	costModel "github.com/kubecost/cost-model/costmodel"
+)
+
+func newImpreciseAggregations() map[string]*costModel.Aggregation {
+	return map[string]*costModel.Aggregation{
+		"web": {
+			CPUCost:       0.0034000000000002,
+			RAMCost:       1.0000004,
+			SharedCost:    0.3333333333333333,
+			TotalCost:     1.3367337333333335,
+			CPUCostVector: []*costModel.Vector{{Timestamp: 10, Value: 0.0034000000000002}},
+		},
+	}
+}
+
+func TestRoundAggregations(t *testing.T) {
+	aggs := newImpreciseAggregations()
+	rounded := costModel.RoundAggregations(aggs, 6)
+
+	web := rounded["web"]
+	assert.Equal(t, web.CPUCost, 0.0034)
+	assert.Equal(t, web.RAMCost, 1.0)
+	assert.Equal(t, web.SharedCost, 0.333333)
+	assert.Equal(t, web.CPUCostVector[0].Value, 0.0034)
+	// the rounded total is the sum of the rounded costs
+	assert.Equal(t, web.TotalCost, 1.336733)
+
+	// the aggregations rounded, e.g. as cached, keep their full precision
+	assert.Equal(t, aggs["web"].CPUCost, 0.0034000000000002)
+	assert.Equal(t, aggs["web"].CPUCostVector[0].Value, 0.0034000000000002)
+
+	summary := costModel.RoundAggregationSummary(costModel.SummarizeAggregations(rounded), 2)
+	assert.Equal(t, summary.SharedCost, 0.33)
+	assert.Equal(t, summary.TotalCost, 1.33)
+}
+
+func TestRoundAggregationsFullPrecision(t *testing.T) {
+	aggs := newImpreciseAggregations()
+	rounded := costModel.RoundAggregations(aggs, -1)
+	assert.Equal(t, rounded["web"].CPUCost, 0.0034000000000002)
+	assert.Equal(t, rounded["web"].TotalCost, 1.3367337333333335)
+
+	summary := costModel.RoundAggregationSummary(costModel.SummarizeAggregations(rounded), -1)
+	assert.Equal(t, summary.SharedCost, 0.3333333333333333)
+}
+
+func TestAggregateCostModelPrecision(t *testing.T) {
+	server, _ := newSlowPrometheus(t, 0, false)
+	defer server.Close()
+	a := newTestAccesses(t, server.URL, "")
+
+	envelope := getAggregatedCostModel(t, a, "aggregation=namespace&window=1h&precision=2")
+	assert.Equal(t, envelope.Status, "success", envelope.Message)
+
+	for _, precision := range []string{"-1", "16", "two"} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/aggregatedCostModel?aggregation=namespace&window=1h&precision="+precision, nil)
+		a.AggregateCostModel(w, r, nil)
+		assert.Equal(t, w.Code, http.StatusBadRequest, precision)
+		var envelope costModel.DataEnvelope
+		assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &envelope))
+		assert.Equal(t, envelope.ErrorCode, costModel.ErrorCodeBadRequest, precision)
+	}
+}
@@ -0,0 +1,213 @@
+package costmodel_test
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"gotest.tools/assert"
+
+	"github.com/kubecost/cost-model/cloud"
+	costModel "github.com/kubecost/cost-model/costmodel"
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestRecordPricesOnceSkipsPVCWithoutValues(t *testing.T) {
+	server, _ := newSlowPrometheus(t, 0, false)
+	defer server.Close()
+	a := newTestRecordingAccesses(t, server.URL, time.Hour)
+	a.PriceRecordingErrors = prometheus.NewCounter(prometheus.CounterOpts{Name: "kubecost_price_recording_errors_total"})
+
+	data := map[string]*costModel.CostData{
+		"cluster-one,default,web,main,node-1": &costModel.CostData{
+			Name:      "main",
+			PodName:   "web",
+			Namespace: "default",
+			NodeName:  "node-1",
+			NodeData:  &cloud.Node{VCPU: "2", VCPUCost: "0.03"},
+			PVCData: []*costModel.PersistentVolumeClaimData{
+				&costModel.PersistentVolumeClaimData{Claim: "data", VolumeName: "pv-1", Volume: &cloud.PV{}},
+			},
+		},
+	}
+	err := a.RecordPricesOnce(costModel.NewPriceRecording(), data)
+	assert.NilError(t, err)
+	assert.Equal(t, counterValue(t, a.PriceRecordingErrors), 0.0)
+
+	// the rest of the container is still recorded
+	m := &dto.Metric{}
+	assert.NilError(t, a.CPUPriceRecorder.WithLabelValues("node-1", "node-1").Write(m))
+	assert.Equal(t, m.GetGauge().GetValue(), 0.03)
+}
+
+func TestRecordPricesOnceRecoversFromPanic(t *testing.T) {
+	server, _ := newSlowPrometheus(t, 0, false)
+	defer server.Close()
+	a := newTestRecordingAccesses(t, server.URL, time.Hour)
+	a.PriceRecordingErrors = prometheus.NewCounter(prometheus.CounterOpts{Name: "kubecost_price_recording_errors_total"})
+
+	// without a cluster cache the pass panics
+	a.Model = &costModel.CostModel{}
+	err := a.RecordPricesOnce(costModel.NewPriceRecording(), map[string]*costModel.CostData{})
+	assert.ErrorContains(t, err, "Price recording failed")
+	assert.Equal(t, counterValue(t, a.PriceRecordingErrors), 1.0)
+}
+
+func TestRecordingStats(t *testing.T) {
+	server, _ := newSlowPrometheus(t, 0, false)
+	defer server.Close()
+	a := newTestRecordingAccesses(t, server.URL, time.Hour)
+
+	getStats := func() *costModel.DataEnvelope {
+		w := httptest.NewRecorder()
+		a.RecordingStats(w, httptest.NewRequest("GET", "/recordingStats", nil), nil)
+		var envelope costModel.DataEnvelope
+		assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &envelope))
+		return &envelope
+	}
+	assert.Equal(t, getStats().Status, "error")
+
+	// a cancelled recording completes its first pass, whose stats are then reported
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	<-a.RecordPrices(ctx)
+	stats := a.LastRecordingStats()
+	assert.Assert(t, stats != nil)
+	assert.Assert(t, stats.CompletedAt != "")
+	assert.Assert(t, stats.DurationSeconds >= 0)
+	assert.Equal(t, stats.Error, "")
+
+	envelope := getStats()
+	assert.Equal(t, envelope.Status, "success")
+	assert.Equal(t, envelope.Data.(map[string]interface{})["completedAt"], stats.CompletedAt)
+
+	// two containers of one pod on one node are counted once for the pod and node
+	newDatum := func(container string) *costModel.CostData {
+		return &costModel.CostData{
+			Name:      container,
+			PodName:   "web",
+			Namespace: "default",
+			NodeName:  "node-1",
+			NodeData:  &cloud.Node{VCPU: "2", VCPUCost: "0.03"},
+		}
+	}
+	recording := costModel.NewPriceRecording()
+	assert.NilError(t, a.RecordPricesOnce(recording, map[string]*costModel.CostData{
+		"default,web,main,node-1":    newDatum("main"),
+		"default,web,sidecar,node-1": newDatum("sidecar"),
+		"default,web,lost,node-2":    &costModel.CostData{Name: "lost", PodName: "web", Namespace: "default", NodeName: "node-2"},
+	}))
+	priced := recording.Priced()
+	assert.Equal(t, priced.Nodes, 1)
+	assert.Equal(t, priced.Pods, 1)
+	assert.Equal(t, priced.Containers, 2)
+}
+
+func TestRecordPricesOnceNodeTotalsMatchIdleByNode(t *testing.T) {
+	server, _ := newSlowPrometheus(t, 0, false)
+	defer server.Close()
+	a := newTestRecordingAccesses(t, server.URL, time.Hour)
+
+	base := newTestProvider(t)
+	assert.NilError(t, base.DownloadPricingData())
+	_, err := base.UpdateConfig(strings.NewReader(`{"discount":"30%"}`), "")
+	assert.NilError(t, err)
+	cp := &catalogProvider{Provider: base, catalog: map[string]cloud.Node{
+		"p3.2xlarge": {VCPU: "8", VCPUCost: "0.1", RAMCost: "0.01", GPU: "1", GPUCost: "2.5"},
+	}}
+	a.Cloud = cp
+	a.Model = &costModel.CostModel{Cache: fakeClusterCache{nodes: []*v1.Node{newSizedNode("node-1", "p3.2xlarge", "8", "16Gi")}}}
+
+	assets, err := a.Model.ComputeAssets(cp)
+	assert.NilError(t, err)
+	assert.Equal(t, len(assets.Nodes), 1)
+
+	assert.NilError(t, a.RecordPricesOnce(costModel.NewPriceRecording(), map[string]*costModel.CostData{
+		"default,train,main,node-1": &costModel.CostData{
+			Name:      "main",
+			PodName:   "train",
+			Namespace: "default",
+			NodeName:  "node-1",
+			NodeData:  &cloud.Node{VCPU: "8", VCPUCost: "0.1", RAMBytes: "17179869184", RAMCost: "0.01", GPU: "1", GPUCost: "2.5"},
+		},
+	}))
+	gaugeValue := func(gv *prometheus.GaugeVec) float64 {
+		m := &dto.Metric{}
+		assert.NilError(t, gv.WithLabelValues("node-1", "node-1").Write(m))
+		return m.GetGauge().GetValue()
+	}
+
+	// the gauge is the list price, GPUs included, and its discounted variant matches the discounted node total
+	listCost := 8*0.1 + 16*0.01 + 2.5
+	assert.Assert(t, math.Abs(gaugeValue(a.NodeTotalPriceRecorder)-listCost) < 1e-9)
+	assert.Assert(t, math.Abs(assets.Nodes[0].TotalHourlyCost-listCost) < 1e-9)
+	assert.Assert(t, math.Abs(gaugeValue(a.NodeDiscountedPriceRecorder)-listCost*0.7) < 1e-9)
+
+	idle := costModel.ComputeIdleByNode(cp, nil, assets.Nodes, 24, 0.3)
+	assert.Assert(t, math.Abs(idle["node-1"].HourlyCost-gaugeValue(a.NodeTotalPriceRecorder)) < 1e-9)
+	assert.Assert(t, math.Abs(idle["node-1"].TotalCost-24*gaugeValue(a.NodeDiscountedPriceRecorder)) < 1e-9)
+}
+
+// gaugeSeries returns the labels of each series of the given gauge, e.g. "instance=node-1,node=node-1"
+func gaugeSeries(t *testing.T, gv *prometheus.GaugeVec) []string {
+	ch := make(chan prometheus.Metric, 16)
+	gv.Collect(ch)
+	close(ch)
+	series := []string{}
+	for metric := range ch {
+		m := &dto.Metric{}
+		assert.NilError(t, metric.Write(m))
+		labels := []string{}
+		for _, label := range m.GetLabel() {
+			labels = append(labels, label.GetName()+"="+label.GetValue())
+		}
+		series = append(series, strings.Join(labels, ","))
+	}
+	return series
+}
+
+func TestRecordPricesOnceInstanceLifecycleLabel(t *testing.T) {
+	server, _ := newSlowPrometheus(t, 0, false)
+	defer server.Close()
+	a := newTestRecordingAccesses(t, server.URL, time.Hour)
+	a.InstanceLifecycleLabel = true
+	a.CPUPriceRecorder = newTestGaugeVec("node_cpu_hourly_cost", "instance", "node", "instance_lifecycle")
+	a.RAMPriceRecorder = newTestGaugeVec("node_ram_hourly_cost", "instance", "node", "instance_lifecycle")
+	a.GPUPriceRecorder = newTestGaugeVec("node_gpu_hourly_cost", "instance", "node", "instance_lifecycle")
+	a.NodeTotalPriceRecorder = newTestGaugeVec("node_total_hourly_cost", "instance", "node", "instance_lifecycle")
+	a.NodeDiscountedPriceRecorder = newTestGaugeVec("node_total_hourly_cost_discounted", "instance", "node", "instance_lifecycle")
+	recorders := []*prometheus.GaugeVec{a.CPUPriceRecorder, a.RAMPriceRecorder, a.GPUPriceRecorder, a.NodeTotalPriceRecorder, a.NodeDiscountedPriceRecorder}
+
+	recording := costModel.NewPriceRecording()
+	record := func(lifecycle string) {
+		assert.NilError(t, a.RecordPricesOnce(recording, map[string]*costModel.CostData{
+			"default,web,main,node-1": &costModel.CostData{
+				Name:      "main",
+				PodName:   "web",
+				Namespace: "default",
+				NodeName:  "node-1",
+				NodeData:  &cloud.Node{VCPU: "2", VCPUCost: "0.03", Lifecycle: lifecycle},
+			},
+		}))
+	}
+
+	record(cloud.LifecycleOnDemand)
+	for _, gv := range recorders {
+		assert.DeepEqual(t, gaugeSeries(t, gv), []string{"instance=node-1,instance_lifecycle=on-demand,node=node-1"})
+	}
+	m := &dto.Metric{}
+	assert.NilError(t, a.CPUPriceRecorder.WithLabelValues("node-1", "node-1", "on-demand").Write(m))
+	assert.Equal(t, m.GetGauge().GetValue(), 0.03)
+
+	// once the node is replaced by a spot instance of the same name, only its spot series remains
+	record(cloud.LifecycleSpot)
+	for _, gv := range recorders {
+		assert.DeepEqual(t, gaugeSeries(t, gv), []string{"instance=node-1,instance_lifecycle=spot,node=node-1"})
+	}
+}
@@ -0,0 +1,264 @@
+package costmodel_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"gotest.tools/assert"
+
+	"github.com/kubecost/cost-model/cloud"
+	costModel "github.com/kubecost/cost-model/costmodel"
+)
+
+// flakyProvider fails to download pricing data the given number of times before succeeding
+type flakyProvider struct {
+	cloud.Provider
+	lock      sync.Mutex
+	failures  int
+	downloads int
+}
+
+func (p *flakyProvider) DownloadPricingData() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.downloads++
+	if p.downloads <= p.failures {
+		return fmt.Errorf("pricing API unavailable")
+	}
+	return nil
+}
+
+func (p *flakyProvider) Downloads() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.downloads
+}
+
+func counterValue(t *testing.T, c prometheus.Counter) float64 {
+	m := &dto.Metric{}
+	if err := c.Write(m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetCounter().GetValue()
+}
+
+func TestPricingRefresherCountsErrors(t *testing.T) {
+	cp := &flakyProvider{Provider: newTestProvider(t), failures: 1}
+	errors := prometheus.NewCounter(prometheus.CounterOpts{Name: "kubecost_pricing_refresh_errors_total"})
+	r := costModel.NewPricingRefresher(cp, time.Hour, errors)
+
+	time.Sleep(10 * time.Millisecond)
+	assert.ErrorContains(t, r.Refresh(), "pricing API unavailable")
+	assert.Equal(t, counterValue(t, errors), 1.0)
+	assert.Assert(t, r.Age() >= 10*time.Millisecond, "expected the age to count from creation until a refresh succeeds")
+
+	assert.NilError(t, r.Refresh())
+	assert.Equal(t, counterValue(t, errors), 1.0)
+	assert.Assert(t, r.Age() < 10*time.Millisecond)
+}
+
+func TestPricingRefresherRetriesWithBackoff(t *testing.T) {
+	cp := &flakyProvider{Provider: newTestProvider(t), failures: 3}
+	errors := prometheus.NewCounter(prometheus.CounterOpts{Name: "kubecost_pricing_refresh_errors_total"})
+	r := costModel.NewPricingRefresher(cp, 50*time.Millisecond, errors)
+	r.MinBackoff = time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := r.Run(ctx)
+
+	// The first refresh is due after about an interval, and the three failures are retried within another
+	deadline := time.Now().Add(5 * time.Second)
+	for cp.Downloads() < 4 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected failed refreshes to be retried; got %d downloads", cp.Downloads())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("pricing refresh did not stop after cancellation")
+	}
+	assert.Equal(t, counterValue(t, errors), 3.0)
+}
+
+// cachingProvider saves and restores its prices to and from the pricing cache
+type cachingProvider struct {
+	*flakyProvider
+	prices map[string]string
+}
+
+func (p *cachingProvider) SavePricingData(w io.Writer) error {
+	return json.NewEncoder(w).Encode(p.prices)
+}
+
+func (p *cachingProvider) LoadPricingData(r io.Reader) error {
+	return json.NewDecoder(r).Decode(&p.prices)
+}
+
+func TestPricingRefresherCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pricing-cache")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "pricing.json")
+
+	live := &cachingProvider{flakyProvider: &flakyProvider{Provider: newTestProvider(t)}, prices: map[string]string{"m5.large": "0.096"}}
+	r := costModel.NewPricingRefresher(live, time.Hour, nil)
+	r.CacheFile = path
+	assert.Equal(t, r.Status().Source, costModel.PricingSourceDefault)
+	assert.NilError(t, r.Refresh())
+	assert.Equal(t, r.Status().Source, costModel.PricingSourceLive)
+
+	// on restart, the cached prices are used until the pricing API can be reached again
+	restarted := &cachingProvider{flakyProvider: &flakyProvider{Provider: newTestProvider(t), failures: 1}}
+	r = costModel.NewPricingRefresher(restarted, time.Hour, nil)
+	r.CacheFile = path
+	assert.NilError(t, r.LoadCache())
+	assert.DeepEqual(t, restarted.prices, map[string]string{"m5.large": "0.096"})
+	assert.ErrorContains(t, r.Refresh(), "pricing API unavailable")
+	status := r.Status()
+	assert.Equal(t, status.Source, costModel.PricingSourceCached)
+	assert.Equal(t, status.CacheFile, path)
+	assert.Equal(t, status.LastError, "pricing API unavailable")
+	assert.Assert(t, status.UpdatedAt != "")
+
+	assert.NilError(t, r.Refresh())
+	status = r.Status()
+	assert.Equal(t, status.Source, costModel.PricingSourceLive)
+	assert.Equal(t, status.LastError, "")
+}
+
+// wipingProvider loses its prices when a download fails, like providers which reset their pricing data before
+// downloading it
+type wipingProvider struct {
+	*cachingProvider
+}
+
+func (p *wipingProvider) DownloadPricingData() error {
+	err := p.cachingProvider.DownloadPricingData()
+	if err != nil {
+		p.prices = nil
+	}
+	return err
+}
+
+func TestPricingRefresherFallsBackToStaleCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pricing-cache")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "pricing.json")
+
+	live := &cachingProvider{flakyProvider: &flakyProvider{Provider: newTestProvider(t)}, prices: map[string]string{"m5.large": "0.096"}}
+	r := costModel.NewPricingRefresher(live, time.Hour, nil)
+	r.CacheFile = path
+	assert.NilError(t, r.Refresh())
+	assert.Assert(t, !r.Status().Stale)
+
+	// the prices lost to a failed download are restored from the snapshot of the last successful one
+	failing := &wipingProvider{&cachingProvider{flakyProvider: &flakyProvider{Provider: newTestProvider(t), failures: 1}}}
+	r = costModel.NewPricingRefresher(failing, time.Hour, nil)
+	r.CacheFile = path
+	assert.ErrorContains(t, r.Refresh(), "pricing API unavailable")
+	assert.DeepEqual(t, failing.prices, map[string]string{"m5.large": "0.096"})
+	status := r.Status()
+	assert.Equal(t, status.Source, costModel.PricingSourceCached)
+	assert.Assert(t, status.Stale)
+
+	assert.NilError(t, r.Refresh())
+	assert.Assert(t, !r.Status().Stale)
+}
+
+func TestPricingRefresherRetriesFailedStartup(t *testing.T) {
+	cp := &flakyProvider{Provider: newTestProvider(t), failures: 2}
+	r := costModel.NewPricingRefresher(cp, time.Hour, nil)
+	r.MinBackoff = time.Millisecond
+
+	// without a cache, startup downloads right away, retrying failures long before the next scheduled refresh
+	ctx, cancel := context.WithCancel(context.Background())
+	done := r.Start(ctx)
+	deadline := time.Now().Add(5 * time.Second)
+	for cp.Downloads() < 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the failed download at startup to be retried; got %d downloads", cp.Downloads())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	cancel()
+	<-done
+	assert.Equal(t, r.Status().Source, costModel.PricingSourceLive)
+}
+
+func TestGCPPricingCacheRoundTrip(t *testing.T) {
+	saved := &cloud.GCP{Pricing: map[string]*cloud.GCPPricing{
+		"us-central1,n1standard,ondemand": &cloud.GCPPricing{Node: &cloud.Node{VCPUCost: "0.031611", RAMCost: "0.004237"}},
+	}}
+	var buf bytes.Buffer
+	assert.NilError(t, saved.SavePricingData(&buf))
+
+	restored := &cloud.GCP{}
+	assert.NilError(t, restored.LoadPricingData(&buf))
+	assert.Equal(t, restored.Pricing["us-central1,n1standard,ondemand"].Node.VCPUCost, "0.031611")
+}
+
+func TestPricingRefresherNotifiesWebhook(t *testing.T) {
+	events := make(chan costModel.PricingRefreshEvent, 2)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event costModel.PricingRefreshEvent
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			t.Error(err)
+		}
+		if r.Method != "POST" {
+			t.Errorf("expected a POST, got a %s", r.Method)
+		}
+		events <- event
+	}))
+	defer receiver.Close()
+
+	cp := &flakyProvider{Provider: newTestProvider(t), failures: 1}
+	r := costModel.NewPricingRefresher(cp, time.Hour, nil)
+	r.WebhookURL = receiver.URL
+
+	for _, success := range []bool{false, true} {
+		r.Refresh()
+		select {
+		case event := <-events:
+			assert.Equal(t, event.Success, success)
+			assert.Equal(t, event.Error != "", !success)
+			assert.Assert(t, event.DurationSeconds >= 0)
+			assert.Assert(t, event.CompletedAt != "")
+		case <-time.After(5 * time.Second):
+			t.Fatal("the webhook wasn't notified of the refresh")
+		}
+	}
+}
+
+func TestPricingRefresherIgnoresWebhookFailures(t *testing.T) {
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer receiver.Close()
+
+	r := costModel.NewPricingRefresher(&flakyProvider{Provider: newTestProvider(t)}, time.Hour, nil)
+	r.WebhookURL = receiver.URL
+	assert.NilError(t, r.Refresh())
+
+	// nor does an unreachable webhook fail the refresh
+	receiver.Close()
+	assert.NilError(t, r.Refresh())
+	assert.Equal(t, r.Status().Source, costModel.PricingSourceLive)
+}
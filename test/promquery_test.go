@@ -0,0 +1,403 @@
+package costmodel_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+	v1 "k8s.io/api/core/v1"
+
+	costModel "github.com/kubecost/cost-model/costmodel"
+	prometheusClient "github.com/prometheus/client_golang/api"
+)
+
+// newFakePrometheus serves range queries with a single series holding one sample per step, with value
+// equal to the sample's timestamp. Requests for which fail returns true get an error response.
+func newFakePrometheus(t *testing.T, fail func(start, end float64) bool) (*httptest.Server, *int) {
+	var lock sync.Mutex
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		requests++
+		lock.Unlock()
+
+		r.ParseForm()
+		start, _ := time.Parse(time.RFC3339Nano, r.Form.Get("start"))
+		end, _ := time.Parse(time.RFC3339Nano, r.Form.Get("end"))
+		step, _ := strconv.ParseFloat(r.Form.Get("step"), 64)
+
+		w.Header().Set("Content-Type", "application/json")
+		if fail != nil && fail(float64(start.Unix()), float64(end.Unix())) {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			w.Write([]byte(`{"status":"error","errorType":"execution","error":"query processing would load too many samples into memory"}`))
+			return
+		}
+
+		values := []interface{}{}
+		for ts := float64(start.Unix()); ts <= float64(end.Unix()); ts += step {
+			values = append(values, []interface{}{ts, strconv.FormatFloat(ts, 'f', -1, 64)})
+		}
+		resp, _ := json.Marshal(map[string]interface{}{
+			"status": "success",
+			"data": map[string]interface{}{
+				"resultType": "matrix",
+				"result": []interface{}{
+					map[string]interface{}{
+						"metric": map[string]string{"namespace": "test", "pod_name": "foo", "container_name": "bar", "node": "baz"},
+						"values": values,
+					},
+				},
+			},
+		})
+		w.Write(resp)
+	}))
+	return server, &requests
+}
+
+func newFakePrometheusClient(t *testing.T, address string) prometheusClient.Client {
+	cli, err := prometheusClient.NewClient(prometheusClient.Config{Address: address})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cli
+}
+
+func TestQueryRangeChunked(t *testing.T) {
+	server, requests := newFakePrometheus(t, nil)
+	defer server.Close()
+	cli := newFakePrometheusClient(t, server.URL)
+
+	end := time.Date(2019, 10, 1, 0, 0, 0, 0, time.UTC)
+	start := end.Add(-21 * 24 * time.Hour)
+
+	res, warnings, err := costModel.QueryRangeChunked(context.Background(), cli, "foo", start, end, time.Hour, 7*24*time.Hour, false)
+	assert.NilError(t, err)
+	assert.Equal(t, len(warnings), 0)
+	assert.Equal(t, *requests, 3)
+
+	vectors, err := costModel.GetContainerMetricVectors(res, false, 0)
+	assert.NilError(t, err)
+	assert.Equal(t, len(vectors), 1)
+	for _, values := range vectors {
+		// boundary samples shared by adjacent chunks must only be counted once
+		assert.Equal(t, len(values), 21*24+1)
+		for i := 1; i < len(values); i++ {
+			assert.Equal(t, values[i].Timestamp-values[i-1].Timestamp, 3600.0)
+		}
+	}
+}
+
+func TestQueryRangeChunkedPartialFailure(t *testing.T) {
+	end := time.Date(2019, 10, 1, 0, 0, 0, 0, time.UTC)
+	start := end.Add(-21 * 24 * time.Hour)
+	failedChunkStart := float64(start.Add(7 * 24 * time.Hour).Unix())
+
+	server, _ := newFakePrometheus(t, func(s, e float64) bool { return s == failedChunkStart })
+	defer server.Close()
+	cli := newFakePrometheusClient(t, server.URL)
+
+	_, _, err := costModel.QueryRangeChunked(context.Background(), cli, "foo", start, end, time.Hour, 7*24*time.Hour, false)
+	assert.Assert(t, err != nil)
+
+	res, warnings, err := costModel.QueryRangeChunked(context.Background(), cli, "foo", start, end, time.Hour, 7*24*time.Hour, true)
+	assert.NilError(t, err)
+	assert.Equal(t, len(warnings), 1)
+
+	vectors, err := costModel.GetContainerMetricVectors(res, false, 0)
+	assert.NilError(t, err)
+	for _, values := range vectors {
+		assert.Equal(t, len(values), 2*(7*24+1))
+	}
+}
+
+// newSlowPrometheus serves empty range query results and a normalization value of 1 for instant queries, holding
+// each request open for delay so that overlapping requests can be observed. It reports the total number of
+// requests and the highest number which were in flight at once.
+func newSlowPrometheus(t *testing.T, delay time.Duration, fail bool) (*httptest.Server, func() (int, int)) {
+	var lock sync.Mutex
+	requests, inFlight, maxInFlight := 0, 0, 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		requests++
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		lock.Unlock()
+		defer func() {
+			lock.Lock()
+			inFlight--
+			lock.Unlock()
+		}()
+
+		time.Sleep(delay)
+
+		w.Header().Set("Content-Type", "application/json")
+		if fail {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			w.Write([]byte(`{"status":"error","errorType":"execution","error":"query timed out"}`))
+			return
+		}
+		result := map[string]interface{}{"resultType": "matrix", "result": []interface{}{}}
+		if r.URL.Path == "/api/v1/query" {
+			result = map[string]interface{}{
+				"resultType": "vector",
+				"result": []interface{}{
+					map[string]interface{}{
+						"metric": map[string]string{},
+						"value":  []interface{}{float64(time.Now().Unix()), "1"},
+					},
+				},
+			}
+		}
+		resp, _ := json.Marshal(map[string]interface{}{"status": "success", "data": result})
+		w.Write(resp)
+	}))
+	return server, func() (int, int) {
+		lock.Lock()
+		defer lock.Unlock()
+		return requests, maxInFlight
+	}
+}
+
+func TestComputeCostDataRangeQueriesConcurrently(t *testing.T) {
+	os.Setenv("MAX_QUERY_CONCURRENCY", "3")
+	defer os.Unsetenv("MAX_QUERY_CONCURRENCY")
+
+	server, stats := newSlowPrometheus(t, 50*time.Millisecond, false)
+	defer server.Close()
+	cli := newFakePrometheusClient(t, server.URL)
+	cm := &costModel.CostModel{Cache: fakeClusterCache{}}
+
+	_, _, err := cm.ComputeCostDataRange(cli, nil, newTestProvider(t), "2019-10-01T00:00:00.000Z", "2019-10-02T00:00:00.000Z", "1h", "", "", false, false)
+	assert.NilError(t, err)
+
+	requests, maxInFlight := stats()
+	assert.Equal(t, requests, 10)
+	assert.Assert(t, maxInFlight > 1, "queries were dispatched sequentially")
+	assert.Assert(t, maxInFlight <= 3, "%d queries were in flight at once, more than MAX_QUERY_CONCURRENCY", maxInFlight)
+}
+
+func TestComputeCostDataRangeQueryFailure(t *testing.T) {
+	os.Setenv("MAX_QUERY_CONCURRENCY", "1")
+	defer os.Unsetenv("MAX_QUERY_CONCURRENCY")
+
+	server, stats := newSlowPrometheus(t, 10*time.Millisecond, true)
+	defer server.Close()
+	cli := newFakePrometheusClient(t, server.URL)
+	cm := &costModel.CostModel{Cache: fakeClusterCache{}}
+
+	_, _, err := cm.ComputeCostDataRange(cli, nil, newTestProvider(t), "2019-10-01T00:00:00.000Z", "2019-10-02T00:00:00.000Z", "1h", "", "", false, false)
+	assert.Assert(t, err != nil)
+
+	// the first failure cancels the queries still waiting for a slot
+	requests, _ := stats()
+	assert.Assert(t, requests < 10, "all %d queries were sent after the first failed", requests)
+}
+
+func TestPrometheusQueriesBounded(t *testing.T) {
+	costModel.SetMaxPrometheusQueries(2)
+	defer costModel.SetMaxPrometheusQueries(costModel.MaxPrometheusQueries())
+
+	server, stats := newSlowPrometheus(t, 20*time.Millisecond, false)
+	defer server.Close()
+	cli := newFakePrometheusClient(t, server.URL)
+
+	// queries of concurrent requests share the bound
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := costModel.Query(cli, "up")
+			assert.Check(t, err)
+		}()
+	}
+	wg.Wait()
+
+	requests, maxInFlight := stats()
+	assert.Equal(t, requests, 8)
+	assert.Equal(t, maxInFlight, 2)
+}
+
+func TestPrometheusQueriesWaitIsCancelled(t *testing.T) {
+	costModel.SetMaxPrometheusQueries(1)
+	defer costModel.SetMaxPrometheusQueries(costModel.MaxPrometheusQueries())
+
+	server, stats := newSlowPrometheus(t, 200*time.Millisecond, false)
+	defer server.Close()
+	cli := newFakePrometheusClient(t, server.URL)
+
+	slow := make(chan struct{})
+	go func() {
+		defer close(slow)
+		costModel.Query(cli, "up")
+	}()
+	for requests, _ := stats(); requests == 0; requests, _ = stats() {
+		time.Sleep(time.Millisecond)
+	}
+
+	// a query waiting for the slot held by the slow one gives up once its context is done
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, _, err := costModel.QueryRangeChunked(ctx, cli, "up", time.Now().Add(-time.Hour), time.Now(), time.Minute, 0, false)
+	assert.Assert(t, err != nil)
+	assert.Assert(t, time.Since(start) < 150*time.Millisecond, "waited %s for the slot", time.Since(start))
+	<-slow
+
+	requests, _ := stats()
+	assert.Equal(t, requests, 1)
+}
+
+func TestQueryRangeThanos(t *testing.T) {
+	os.Setenv("THANOS_ENABLED", "true")
+	defer os.Unsetenv("THANOS_ENABLED")
+
+	var params url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		params = r.Form
+
+		// the same series from each member of an HA pair, plus a warning about a store which is down
+		series := func(replica string) map[string]interface{} {
+			return map[string]interface{}{
+				"metric": map[string]string{"namespace": "test", "pod_name": "foo", "container_name": "bar", "node": "baz", "prometheus_replica": replica},
+				"values": []interface{}{[]interface{}{1569888000.0, "1"}},
+			}
+		}
+		resp, _ := json.Marshal(map[string]interface{}{
+			"status": "success",
+			"data": map[string]interface{}{
+				"resultType": "matrix",
+				"result":     []interface{}{series("prometheus-0"), series("prometheus-1")},
+			},
+			"warnings": []string{"fetch series for store 10.0.0.1:10901: connection refused"},
+		})
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(resp)
+	}))
+	defer server.Close()
+	cli := newFakePrometheusClient(t, server.URL)
+
+	end := time.Date(2019, 10, 1, 0, 0, 0, 0, time.UTC)
+	start := end.Add(-time.Hour)
+	res, warnings, err := costModel.QueryRangeChunked(context.Background(), cli, "foo", start, end, time.Hour, 7*24*time.Hour, false)
+	assert.NilError(t, err)
+
+	assert.Equal(t, params.Get("dedup"), "true")
+	assert.Equal(t, params.Get("partial_response"), "true")
+	assert.Equal(t, len(warnings), 1)
+
+	vectors, err := costModel.GetContainerMetricVectors(res, false, 0)
+	assert.NilError(t, err)
+	assert.Equal(t, len(vectors), 1)
+	for _, values := range vectors {
+		assert.Equal(t, len(values), 1)
+	}
+}
+
+func TestComputeCostDataThanosWarnings(t *testing.T) {
+	os.Setenv("THANOS_ENABLED", "true")
+	defer os.Unsetenv("THANOS_ENABLED")
+
+	// every instant query is served from the stores which are up, and warns about the one which is down
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		result := []interface{}{}
+		if strings.Contains(r.Form.Get("query"), "count_over_time(") {
+			result = append(result, map[string]interface{}{
+				"metric": map[string]string{},
+				"value":  []interface{}{float64(time.Now().Unix()), "60"},
+			})
+		}
+		resp, _ := json.Marshal(map[string]interface{}{
+			"status":   "success",
+			"data":     map[string]interface{}{"resultType": "vector", "result": result},
+			"warnings": []string{"fetch series for store 10.0.0.1:10901: connection refused"},
+		})
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(resp)
+	}))
+	defer server.Close()
+	cm := &costModel.CostModel{Cache: fakeClusterCache{
+		pods: []*v1.Pod{newRequestingPod("web-1", "web", 2*time.Hour)},
+	}}
+
+	_, warnings, err := cm.ComputeCostData(newFakePrometheusClient(t, server.URL), nil, newTestProvider(t), "1h", "", "")
+	assert.NilError(t, err)
+	partial := 0
+	for _, warning := range warnings {
+		if strings.Contains(warning, "10.0.0.1:10901") {
+			partial++
+		}
+	}
+	assert.Equal(t, partial, 1, "%v", warnings)
+}
+
+func TestQueryRangeWithRetention(t *testing.T) {
+	local, localRequests := newFakePrometheus(t, nil)
+	defer local.Close()
+	longTerm, longTermRequests := newFakePrometheus(t, nil)
+	defer longTerm.Close()
+	localCli := newFakePrometheusClient(t, local.URL)
+	longTermCli := newFakePrometheusClient(t, longTerm.URL)
+
+	end := time.Now().Truncate(time.Hour)
+	maxSpan := 7 * 24 * time.Hour
+
+	// entirely within local retention
+	_, _, err := costModel.QueryRangeWithRetention(context.Background(), localCli, longTermCli, 24*time.Hour, "foo", end.Add(-12*time.Hour), end, time.Hour, maxSpan, false)
+	assert.NilError(t, err)
+	assert.Equal(t, *localRequests, 1)
+	assert.Equal(t, *longTermRequests, 0)
+
+	// straddling the retention boundary
+	res, _, err := costModel.QueryRangeWithRetention(context.Background(), localCli, longTermCli, 24*time.Hour, "foo", end.Add(-48*time.Hour), end, time.Hour, maxSpan, false)
+	assert.NilError(t, err)
+	assert.Equal(t, *localRequests, 2)
+	assert.Equal(t, *longTermRequests, 1)
+
+	vectors, err := costModel.GetContainerMetricVectors(res, false, 0)
+	assert.NilError(t, err)
+	for _, values := range vectors {
+		assert.Equal(t, len(values), 48+1)
+		for i := 1; i < len(values); i++ {
+			assert.Equal(t, values[i].Timestamp-values[i-1].Timestamp, 3600.0)
+		}
+	}
+}
+
+func TestDownsampledResolution(t *testing.T) {
+	end := time.Date(2019, 10, 1, 0, 0, 0, 0, time.UTC)
+
+	// short ranges keep the requested step
+	assert.Equal(t, costModel.DownsampledResolution(end.Add(-7*24*time.Hour), end, time.Hour), time.Hour)
+
+	// a 90 day range at 1h would return 2161 points per series
+	start := end.Add(-90 * 24 * time.Hour)
+	resolution := costModel.DownsampledResolution(start, end, time.Hour)
+	assert.Assert(t, resolution > time.Hour)
+
+	server, _ := newFakePrometheus(t, nil)
+	defer server.Close()
+	cli := newFakePrometheusClient(t, server.URL)
+
+	res, _, err := costModel.QueryRangeChunked(context.Background(), cli, "foo", start, end, resolution, costModel.MaxQueryRangeSpan(), false)
+	assert.NilError(t, err)
+	vectors, err := costModel.GetContainerMetricVectors(res, false, 0)
+	assert.NilError(t, err)
+	assert.Equal(t, len(vectors), 1)
+	for _, values := range vectors {
+		assert.Assert(t, len(values) <= costModel.MaxRangePoints, "%d points returned for a 90 day range", len(values))
+	}
+}
@@ -0,0 +1,91 @@
+package costmodel_test
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+	v1 "k8s.io/api/core/v1"
+
+	"github.com/kubecost/cost-model/cloud"
+	costModel "github.com/kubecost/cost-model/costmodel"
+)
+
+func TestInstanceTypeRateOverrides(t *testing.T) {
+	newTestProvider(t)
+	gcp := &cloud.GCP{Pricing: map[string]*cloud.GCPPricing{
+		"us-central1,n2standard,ondemand": &cloud.GCPPricing{Node: &cloud.Node{VCPUCost: "0.031611", RAMCost: "0.004237"}},
+	}}
+	key := gcp.GetKey(map[string]string{v1.LabelInstanceType: "n2-standard-8", v1.LabelZoneRegion: "us-central1"})
+
+	node, err := gcp.NodePricing(key)
+	assert.NilError(t, err)
+	assert.Equal(t, node.VCPUCost, "0.031611")
+	assert.Equal(t, node.RateOverride, "")
+
+	// overrides take effect as soon as the config is updated
+	_, err = gcp.UpdateConfig(strings.NewReader(`{"instanceTypeRates":"n2-standard-8:cpu=0.02,ram=0.003;e2-small:0.017"}`), "")
+	assert.NilError(t, err)
+	node, err = gcp.NodePricing(key)
+	assert.NilError(t, err)
+	assert.Equal(t, node.VCPUCost, "0.02")
+	assert.Equal(t, node.RAMCost, "0.003")
+	assert.Equal(t, node.RateOverride, "n2-standard-8")
+	assert.Equal(t, gcp.Pricing["us-central1,n2standard,ondemand"].Node.VCPUCost, "0.031611")
+
+	// instance types without a list price are priced by their override as a whole
+	node, err = gcp.NodePricing(gcp.GetKey(map[string]string{v1.LabelInstanceType: "e2-small", v1.LabelZoneRegion: "us-central1"}))
+	assert.NilError(t, err)
+	assert.Equal(t, node.Cost, "0.017")
+	assert.Equal(t, node.RateOverride, "e2-small")
+
+	all, err := gcp.AllNodePricing()
+	assert.NilError(t, err)
+	pricing := all.(map[string]interface{})
+	assert.Equal(t, len(pricing), 3)
+	assert.Equal(t, pricing["override,n2-standard-8"].(*cloud.InstanceTypeRate).CPU, "0.02")
+
+	assert.Assert(t, cloud.ValidateCustomPricingValue("InstanceTypeRates", "n2-standard-8:cpu=0.02") != nil)
+	assert.Assert(t, cloud.ValidateCustomPricingValue("InstanceTypeRates", "m5.2xlarge:-1") != nil)
+}
+
+func TestRateOverridesComposeWithReservationsAndRules(t *testing.T) {
+	cp := newTestProvider(t)
+	dir, err := ioutil.TempDir("", "node-pricing")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+	path := writeNodePricingFile(t, dir, "pricing.csv", "name,selector,cpu\nfast,node-type=fast,0.05\n", time.Now())
+
+	_, err = cp.UpdateConfig(strings.NewReader(`{"instanceTypeRates":"n1-standard-2:cpu=0.02,ram=0.003;e2-standard-2:cpu=0.01,ram=0.002",`+
+		`"reservedInstances":"n1-standard,us-central1,1,50%","nodePricingFile":"`+path+`"}`), "")
+	assert.NilError(t, err)
+	assert.NilError(t, cp.DownloadPricingData())
+
+	fast := newTestNode("node3", "e2-standard-2")
+	fast.Labels["node-type"] = "fast"
+	cm := &costModel.CostModel{Cache: fakeClusterCache{
+		nodes: []*v1.Node{
+			newTestNode("node1", "n1-standard-2"),
+			newTestNode("node2", "n1-standard-2"),
+			fast,
+		},
+	}}
+	assets, err := cm.ComputeAssets(cp)
+	assert.NilError(t, err)
+	nodes := make(map[string]*costModel.NodeAsset)
+	for _, node := range assets.Nodes {
+		nodes[node.Name] = node
+	}
+
+	// the reservation covering one of the two n1 nodes blends its rate with the overridden rate
+	for _, name := range []string{"node1", "node2"} {
+		assert.Equal(t, nodes[name].PricingRate, cloud.PricingRateBlended)
+		assert.Assert(t, math.Abs(nodes[name].TotalHourlyCost-0.75*(2*0.02+4*0.003)) < 1e-9)
+	}
+	// the node pricing rule overrides the CPU rate only, keeping the overridden RAM rate
+	assert.Assert(t, math.Abs(nodes["node3"].TotalHourlyCost-(2*0.05+4*0.002)) < 1e-9)
+}
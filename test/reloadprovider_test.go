@@ -0,0 +1,99 @@
+package costmodel_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+
+	"github.com/kubecost/cost-model/cloud"
+	costModel "github.com/kubecost/cost-model/costmodel"
+)
+
+// keyedProvider is a provider constructed with an API key, whose pricing data can't be downloaded with a revoked key
+type keyedProvider struct {
+	cloud.Provider
+	apiKey string
+}
+
+func (p *keyedProvider) DownloadPricingData() error {
+	if p.apiKey == "revoked" {
+		return fmt.Errorf("API key %s is not valid", p.apiKey)
+	}
+	return nil
+}
+
+func TestReloadProvider(t *testing.T) {
+	base := newTestProvider(t)
+	newProvider := func(apiKey string) (cloud.Provider, error) {
+		return &keyedProvider{Provider: base, apiKey: apiKey}, nil
+	}
+	initial, _ := newProvider("old")
+	a := &costModel.Accesses{
+		Cloud:            initial,
+		NewCloudProvider: newProvider,
+		PricingRefresher: costModel.NewPricingRefresher(initial, time.Hour, nil),
+	}
+	reload := func() *costModel.DataEnvelope {
+		w := httptest.NewRecorder()
+		a.ReloadProvider(w, httptest.NewRequest("POST", "/reloadProvider", nil), nil)
+		var envelope costModel.DataEnvelope
+		assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &envelope))
+		return &envelope
+	}
+
+	// a request in flight keeps the provider it began with
+	inFlight := a.CloudProvider()
+
+	defer os.Unsetenv("CLOUD_PROVIDER_API_KEY")
+	os.Setenv("CLOUD_PROVIDER_API_KEY", "new")
+	envelope := reload()
+	assert.Equal(t, envelope.Status, "success", envelope.Message)
+	assert.Equal(t, a.CloudProvider().(*keyedProvider).apiKey, "new")
+	assert.Equal(t, a.PricingRefresher.Cloud.(*keyedProvider).apiKey, "new")
+	assert.Equal(t, a.PricingRefresher.Status().Source, costModel.PricingSourceLive)
+	assert.Equal(t, inFlight.(*keyedProvider).apiKey, "old")
+
+	// a provider whose pricing data can't be downloaded doesn't replace the one in use
+	os.Setenv("CLOUD_PROVIDER_API_KEY", "revoked")
+	envelope = reload()
+	assert.Equal(t, envelope.Status, "error")
+	assert.Assert(t, envelope.Message != "")
+	assert.Equal(t, a.CloudProvider().(*keyedProvider).apiKey, "new")
+	assert.Equal(t, a.PricingRefresher.Cloud.(*keyedProvider).apiKey, "new")
+}
+
+func TestReloadProviderConcurrently(t *testing.T) {
+	base := newTestProvider(t)
+	a := &costModel.Accesses{
+		Cloud: &keyedProvider{Provider: base, apiKey: "0"},
+		NewCloudProvider: func(apiKey string) (cloud.Provider, error) {
+			return &keyedProvider{Provider: base, apiKey: apiKey}, nil
+		},
+	}
+
+	var wg sync.WaitGroup
+	for i := 1; i <= 10; i++ {
+		wg.Add(2)
+		go func(key string) {
+			defer wg.Done()
+			assert.NilError(t, a.ReloadCloudProvider(key))
+		}(fmt.Sprintf("%d", i))
+		go func() {
+			defer wg.Done()
+			assert.Assert(t, a.CloudProvider() != nil)
+		}()
+	}
+	wg.Wait()
+	assert.Assert(t, a.CloudProvider().(*keyedProvider).apiKey != "0")
+}
+
+func TestReloadProviderNotEnabled(t *testing.T) {
+	a := &costModel.Accesses{Cloud: newTestProvider(t)}
+	assert.ErrorContains(t, a.ReloadCloudProvider("key"), "not enabled")
+}
@@ -0,0 +1,96 @@
+package costmodel_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"gotest.tools/assert"
+
+	costModel "github.com/kubecost/cost-model/costmodel"
+)
+
+func TestAggregateCostModelRequestPrometheus(t *testing.T) {
+	defaultServer, defaultStats := newSlowPrometheus(t, 0, false)
+	defer defaultServer.Close()
+	otherServer, otherStats := newSlowPrometheus(t, 0, false)
+	defer otherServer.Close()
+	a := newTestAccesses(t, defaultServer.URL, "")
+	a.AllowedPrometheusURLs = []string{otherServer.URL + "/"}
+
+	envelope := getAggregatedCostModel(t, a, "aggregation=namespace&window=1h&prometheus="+url.QueryEscape(otherServer.URL))
+	assert.Equal(t, envelope.Status, "success", envelope.Message)
+	defaultRequests, _ := defaultStats()
+	otherRequests, _ := otherStats()
+	assert.Equal(t, defaultRequests, 0)
+	assert.Assert(t, otherRequests > 0)
+
+	// results from another prometheus aren't served from the cache for the default one
+	envelope = getAggregatedCostModel(t, a, "aggregation=namespace&window=1h")
+	assert.Assert(t, strings.HasPrefix(envelope.Message, "cache miss"), envelope.Message)
+	defaultRequests, _ = defaultStats()
+	assert.Assert(t, defaultRequests > 0)
+	requests, _ := otherStats()
+	assert.Equal(t, requests, otherRequests)
+}
+
+func TestRequestPrometheusValidation(t *testing.T) {
+	server, stats := newSlowPrometheus(t, 0, false)
+	defer server.Close()
+	a := newTestAccesses(t, server.URL, "")
+
+	for _, address := range []string{"ftp://prometheus", "prometheus:9090", "http://"} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/costDataModel?timeWindow=1h&prometheus="+url.QueryEscape(address), nil)
+		a.CostDataModel(w, r, nil)
+		assert.Equal(t, w.Code, http.StatusBadRequest, address)
+		var envelope costModel.DataEnvelope
+		assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &envelope))
+		assert.Equal(t, envelope.ErrorCode, costModel.ErrorCodeBadRequest, address)
+	}
+	requests, _ := stats()
+	assert.Equal(t, requests, 0)
+}
+
+func TestRequestPrometheusAllowlist(t *testing.T) {
+	server, _ := newSlowPrometheus(t, 0, false)
+	defer server.Close()
+	other, otherStats := newSlowPrometheus(t, 0, false)
+	defer other.Close()
+	a := newTestAccesses(t, server.URL, "")
+
+	// no other prometheus may be queried unless it's allowed
+	envelope := getAggregatedCostModel(t, a, "aggregation=namespace&window=1h&prometheus="+url.QueryEscape(other.URL))
+	assert.Equal(t, envelope.ErrorCode, costModel.ErrorCodeBadRequest)
+	assert.Assert(t, strings.Contains(envelope.Message, "ALLOWED_PROMETHEUS_URLS"), envelope.Message)
+	a.AllowedPrometheusURLs = []string{"http://prometheus.monitoring:9090"}
+	envelope = getAggregatedCostModel(t, a, "aggregation=namespace&window=1h&prometheus="+url.QueryEscape(other.URL))
+	assert.Equal(t, envelope.ErrorCode, costModel.ErrorCodeBadRequest)
+	requests, _ := otherStats()
+	assert.Equal(t, requests, 0)
+
+	// the endpoints reporting the nodes and volumes of the local cluster can't query another prometheus
+	a.AllowedPrometheusURLs = []string{other.URL}
+	w := httptest.NewRecorder()
+	a.StorageSavings(w, httptest.NewRequest("GET", "/savings/storage?prometheus="+url.QueryEscape(other.URL), nil), nil)
+	assert.Equal(t, w.Code, http.StatusBadRequest)
+	requests, _ = otherStats()
+	assert.Equal(t, requests, 0)
+}
+
+func TestRequestPrometheusUnavailable(t *testing.T) {
+	server, _ := newSlowPrometheus(t, 0, false)
+	defer server.Close()
+	a := newTestAccesses(t, server.URL, "")
+
+	unavailable := httptest.NewServer(http.NotFoundHandler())
+	unavailable.Close()
+	a.AllowedPrometheusURLs = []string{unavailable.URL}
+
+	envelope := getAggregatedCostModel(t, a, "aggregation=namespace&window=1h&prometheus="+url.QueryEscape(unavailable.URL))
+	assert.Equal(t, envelope.Status, "error")
+	assert.Equal(t, envelope.ErrorCode, costModel.ErrorCodePromUnavailable, envelope.Message)
+}
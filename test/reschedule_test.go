@@ -0,0 +1,113 @@
+package costmodel_test
+
+import (
+	"math"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+
+	costModel "github.com/kubecost/cost-model/costmodel"
+	v1 "k8s.io/api/core/v1"
+)
+
+// newReschedulePrometheus returns a fake Prometheus scraping every minute, over the hour to 13:00 of which the
+// StatefulSet pod db-0, requesting a CPU, ran for 30 minutes on the node spot-1 before being rescheduled onto the
+// node ondemand-1 for the rest of the hour. kube-state-metrics recorded the pod on each node with its own UID and
+// version label.
+func newReschedulePrometheus(t *testing.T) *httptest.Server {
+	minutes := map[string]float64{"spot-1": 30, "ondemand-1": 30}
+	uids := map[string]string{"spot-1": "uid-spot", "ondemand-1": "uid-ondemand"}
+	versions := map[string]string{"spot-1": "1", "ondemand-1": "2"}
+	return newStubPrometheus(t, func(query string, instant bool) []interface{} {
+		var result []interface{}
+		if instant && (strings.Contains(query, "kube_pod_info") || strings.Contains(query, "kube_pod_labels")) {
+			for node, uid := range uids {
+				metric := map[string]string{"namespace": "db", "pod": "db-0", "uid": uid}
+				if strings.Contains(query, "kube_pod_info") {
+					metric["node"] = node
+				} else {
+					metric["label_version"] = versions[node]
+				}
+				result = append(result, promSample(metric, "1"))
+			}
+		} else if instant {
+			result = append(result, promSample(nil, "60"))
+		} else if strings.Contains(query, "kube_pod_container_resource_requests_cpu_cores") {
+			for node, n := range minutes {
+				value := 1.0
+				if strings.Contains(query, "count_over_time") {
+					value *= n
+				}
+				metric := map[string]string{"namespace": "db", "pod_name": "db-0", "container_name": "db", "node": node}
+				result = append(result, promSeries(metric, time.Date(2019, 10, 1, 13, 0, 0, 0, time.UTC), strconv.FormatFloat(value, 'f', -1, 64)))
+			}
+		}
+		return result
+	})
+}
+
+func TestComputeCostDataRangeRescheduledPod(t *testing.T) {
+	server := newReschedulePrometheus(t)
+	defer server.Close()
+	cli := newFakePrometheusClient(t, server.URL)
+	cp := newTestProvider(t)
+	assert.NilError(t, cp.DownloadPricingData())
+
+	spot := newTestNode("spot-1", "n1-standard-2")
+	spot.ObjectMeta.Labels["karpenter.sh/capacity-type"] = "spot"
+	pod := newTestPod("db-0", "db", "db", v1.PodRunning, ownedBy("StatefulSet", "db"), onNode("ondemand-1"))
+	pod.ObjectMeta.UID = "uid-ondemand"
+	cm := &costModel.CostModel{Cache: fakeClusterCache{
+		nodes: []*v1.Node{spot, newTestNode("ondemand-1", "n1-standard-2")},
+		pods:  []*v1.Pod{pod},
+	}}
+
+	data, _, err := cm.ComputeCostDataRange(cli, nil, cp, "2019-10-01T12:00:00.000Z", "2019-10-01T13:00:00.000Z", "1h", "", "", false, false)
+	assert.NilError(t, err)
+	assert.Equal(t, len(data), 2)
+
+	// each node's part of the hour is priced at its own rates, and keeps the metadata of the pod
+	clusterID := costModel.LocalClusterID(cp)
+	for node, price := range map[string]string{"spot-1": "0.006655", "ondemand-1": "0.031611"} {
+		costs, ok := data[clusterID+",db,db-0,db,"+node]
+		assert.Assert(t, ok, node)
+		assert.Equal(t, costs.NodeData.VCPUCost, price, node)
+		assert.DeepEqual(t, costs.Statefulsets, []string{"db"})
+	}
+	assert.Equal(t, data[clusterID+",db,db-0,db,spot-1"].PodUID, "uid-spot")
+	assert.Equal(t, data[clusterID+",db,db-0,db,ondemand-1"].PodUID, "uid-ondemand")
+
+	aggs := costModel.AggregateCostModel(cp, data, "statefulset", "", false, 0, 1.0, nil)
+	db, ok := aggs["db"]
+	assert.Assert(t, ok)
+	expected := 0.5*0.006655 + 0.5*0.031611
+	assert.Assert(t, math.Abs(db.CPUCost-expected) < 1e-9, "%f %f", db.CPUCost, expected)
+}
+
+func TestComputeCostDataRangeJoinsDeletedPodsByUID(t *testing.T) {
+	server := newReschedulePrometheus(t)
+	defer server.Close()
+	cli := newFakePrometheusClient(t, server.URL)
+	cp := newTestProvider(t)
+	assert.NilError(t, cp.DownloadPricingData())
+
+	// the pod has since been deleted, so neither of its nodes' data can take its metadata from the cluster cache
+	cm := &costModel.CostModel{Cache: fakeClusterCache{
+		nodes: []*v1.Node{newTestNode("spot-1", "n1-standard-2"), newTestNode("ondemand-1", "n1-standard-2")},
+	}}
+	data, _, err := cm.ComputeCostDataRange(cli, nil, cp, "2019-10-01T12:00:00.000Z", "2019-10-01T13:00:00.000Z", "1h", "", "", false, false)
+	assert.NilError(t, err)
+
+	// each node's data is of the pod with the UID recorded on that node, and has the labels recorded of that UID
+	clusterID := costModel.LocalClusterID(cp)
+	for node, expected := range map[string]struct{ uid, version string }{"spot-1": {"uid-spot", "1"}, "ondemand-1": {"uid-ondemand", "2"}} {
+		costs, ok := data[clusterID+",db,db-0,db,"+node]
+		assert.Assert(t, ok, node)
+		assert.Equal(t, costs.PodUID, expected.uid, node)
+		assert.Equal(t, costs.Labels["version"], expected.version, node)
+	}
+}
@@ -0,0 +1,98 @@
+package costmodel_test
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	"gotest.tools/assert"
+
+	"github.com/kubecost/cost-model/cloud"
+	costModel "github.com/kubecost/cost-model/costmodel"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func newTestNode(name, instanceType string) *v1.Node {
+	return &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+			Labels: map[string]string{
+				v1.LabelInstanceType: instanceType,
+				v1.LabelZoneRegion:   "us-central1",
+			},
+		},
+		Status: v1.NodeStatus{
+			Capacity: v1.ResourceList{
+				v1.ResourceCPU:    resource.MustParse("2"),
+				v1.ResourceMemory: resource.MustParse("4Gi"),
+			},
+		},
+	}
+}
+
+func TestReservationsBlendNodePricing(t *testing.T) {
+	cp := newTestProvider(t)
+	err := cp.DownloadPricingData()
+	assert.NilError(t, err)
+	// one of the two n1 nodes is reserved at half its on-demand rate
+	_, err = cp.UpdateConfig(strings.NewReader(`{"reservedInstances":"n1-standard,us-central1,1,50%;e2-standard-2,*,100%,0.01"}`), "")
+	assert.NilError(t, err)
+
+	cm := &costModel.CostModel{Cache: fakeClusterCache{
+		nodes: []*v1.Node{
+			newTestNode("node1", "n1-standard-2"),
+			newTestNode("node2", "n1-standard-2"),
+			newTestNode("node3", "e2-standard-2"),
+			newTestNode("node4", "c2-standard-4"),
+		},
+	}}
+	assets, err := cm.ComputeAssets(cp)
+	assert.NilError(t, err)
+
+	onDemand := 2*0.031611 + 4*0.004237
+	nodes := make(map[string]*costModel.NodeAsset)
+	for _, node := range assets.Nodes {
+		nodes[node.Name] = node
+	}
+	for _, name := range []string{"node1", "node2"} {
+		assert.Equal(t, nodes[name].PricingRate, cloud.PricingRateBlended)
+		assert.Assert(t, math.Abs(nodes[name].TotalHourlyCost-0.75*onDemand) < 1e-9)
+	}
+	assert.Equal(t, nodes["node3"].PricingRate, cloud.PricingRateReserved)
+	assert.Assert(t, math.Abs(nodes["node3"].TotalHourlyCost-0.01) < 1e-9)
+	assert.Equal(t, nodes["node4"].PricingRate, cloud.PricingRateOnDemand)
+	assert.Assert(t, math.Abs(nodes["node4"].TotalHourlyCost-onDemand) < 1e-9)
+}
+
+func TestReservationsInvalid(t *testing.T) {
+	for _, reservations := range []string{
+		"m5,us-east-1,60%",
+		"m5,us-east-1,150%,0.1",
+		"m5,us-east-1,2.5,0.1",
+		"m5,us-east-1,10,cheap",
+		",us-east-1,10,0.1",
+	} {
+		_, err := cloud.Reservations(&cloud.CustomPricing{ReservedInstances: reservations})
+		assert.Assert(t, err != nil, reservations)
+	}
+
+	r, err := cloud.Reservations(&cloud.CustomPricing{ReservedInstances: "m5, us-east-1, 60%, 62%"})
+	assert.NilError(t, err)
+	assert.Equal(t, len(r), 1)
+	assert.Equal(t, r[0].Coverage, 0.6)
+	assert.Equal(t, r[0].OnDemandFraction, 0.62)
+	assert.Assert(t, r[0].Matches("m5.xlarge", "us-east-1"))
+	assert.Assert(t, !r[0].Matches("m5a.xlarge", "us-east-1"))
+	assert.Assert(t, !r[0].Matches("m5.xlarge", "us-west-2"))
+}
+
+func TestInstanceLifecycle(t *testing.T) {
+	assert.Equal(t, costModel.InstanceLifecycle(&cloud.Node{Lifecycle: cloud.LifecycleSpot}), costModel.InstanceLifecycleSpot)
+	assert.Equal(t, costModel.InstanceLifecycle(&cloud.Node{UsageType: "preemptible"}), costModel.InstanceLifecycleSpot)
+	assert.Equal(t, costModel.InstanceLifecycle(&cloud.Node{PricingRate: cloud.PricingRateReserved}), costModel.InstanceLifecycleReserved)
+	// partially reserved nodes are labelled on-demand
+	assert.Equal(t, costModel.InstanceLifecycle(&cloud.Node{PricingRate: cloud.PricingRateBlended}), costModel.InstanceLifecycleOnDemand)
+	assert.Equal(t, costModel.InstanceLifecycle(&cloud.Node{}), costModel.InstanceLifecycleOnDemand)
+}
@@ -0,0 +1,102 @@
+package costmodel_test
+
+import (
+	"math"
+	"testing"
+
+	"gotest.tools/assert"
+
+	"github.com/kubecost/cost-model/cloud"
+	costModel "github.com/kubecost/cost-model/costmodel"
+)
+
+// newVectors returns vectors of the given values, an hour apart
+func newVectors(values ...float64) []*costModel.Vector {
+	vectors := []*costModel.Vector{}
+	for i, value := range values {
+		vectors = append(vectors, &costModel.Vector{Timestamp: float64(3600 * i), Value: value})
+	}
+	return vectors
+}
+
+func newTestSizingCostData() map[string]*costModel.CostData {
+	newDatum := func(namespace, pod, container string, cpuReq, ramReq float64, cpuUsed, ramUsed []*costModel.Vector) *costModel.CostData {
+		return &costModel.CostData{
+			Name:      container,
+			Namespace: namespace,
+			PodName:   pod,
+			NodeName:  "testnode",
+			NodeData: &cloud.Node{
+				VCPUCost: "1.0",
+				RAMCost:  "1.0",
+			},
+			CPUReq:  newVectors(cpuReq),
+			RAMReq:  newVectors(ramReq),
+			CPUUsed: cpuUsed,
+			RAMUsed: ramUsed,
+		}
+	}
+
+	initContainer := newDatum("default", "web", "migrate", 1.0, 0, newVectors(1.0), newVectors(0))
+	initContainer.IsInitContainer = true
+	return map[string]*costModel.CostData{
+		// web requests 2 cores and 4GiB, but uses at most 0.4 cores and 1GiB
+		"default,web,nginx,testnode": newDatum("default", "web", "nginx", 2.0, 4*1073741824,
+			newVectors(0.2, 0.4, 0.3, 0.4), newVectors(1073741824, 536870912, 1073741824, 1073741824)),
+		// batch requests half a core, but uses a whole one
+		"jobs,batch,worker,testnode": newDatum("jobs", "batch", "worker", 0.5, 0,
+			newVectors(1.0, 1.0, 1.0), newVectors(0, 0, 0)),
+		// canary has only just started
+		"default,canary,nginx,testnode": newDatum("default", "canary", "nginx", 1.0, 1073741824,
+			newVectors(0.1), newVectors(1073741824)),
+		"default,web,migrate,testnode": initContainer,
+	}
+}
+
+func TestVectorQuantile(t *testing.T) {
+	vectors := newVectors(5, 1, 4, 2, 3)
+	assert.Equal(t, costModel.VectorQuantile(vectors, 0.5), 3.0)
+	assert.Equal(t, costModel.VectorQuantile(vectors, 1), 5.0)
+	assert.Assert(t, math.Abs(costModel.VectorQuantile(vectors, 0.95)-4.8) < 1e-9)
+	assert.Equal(t, costModel.VectorQuantile(nil, 0.95), 0.0)
+}
+
+func TestComputeRequestSizing(t *testing.T) {
+	cp := newTestProvider(t)
+
+	sizings := costModel.ComputeRequestSizing(cp, newTestSizingCostData(), 1, 0.5, 0, costModel.RequestSizingSortBySavings)
+	assert.Equal(t, len(sizings), 3)
+
+	web := sizings[0]
+	assert.Equal(t, web.Pod, "web")
+	assert.Equal(t, *web.CPUUsage, 0.4)
+	assert.Equal(t, *web.RecommendedCPURequest, 0.8)
+	assert.Equal(t, *web.RecommendedRAMRequest, 2*1073741824.0)
+	assert.Equal(t, web.DataPoints, 4)
+	// 1.2 cores and 2GB fewer, at 1.0 each per hour
+	assert.Assert(t, math.Abs(*web.MonthlySavings-3.2*730) < 1e-9, *web.MonthlySavings)
+
+	// requesting too little costs more to fix
+	batch := sizings[1]
+	assert.Equal(t, batch.Pod, "batch")
+	assert.Equal(t, *batch.RecommendedCPURequest, 2.0)
+	assert.Assert(t, math.Abs(*batch.MonthlySavings+1.5*730) < 1e-9, *batch.MonthlySavings)
+
+	// too few samples of usage are marked as such, rather than recommending requests of nothing
+	canary := sizings[2]
+	assert.Equal(t, canary.Pod, "canary")
+	assert.Equal(t, canary.Status, costModel.RequestSizingInsufficientData)
+	assert.Assert(t, canary.RecommendedCPURequest == nil)
+	assert.Assert(t, canary.RecommendedRAMRequest == nil)
+	assert.Assert(t, canary.MonthlySavings == nil)
+	assert.Equal(t, canary.CPURequest, 1.0)
+
+	byName := costModel.ComputeRequestSizing(cp, newTestSizingCostData(), 1, 0.5, 0, costModel.RequestSizingSortByName)
+	assert.Equal(t, byName[0].Pod, "canary")
+	assert.Equal(t, byName[1].Pod, "web")
+	assert.Equal(t, byName[2].Pod, "batch")
+
+	// savings are discounted
+	discounted := costModel.ComputeRequestSizing(cp, newTestSizingCostData(), 1, 0.5, 0.5, costModel.RequestSizingSortBySavings)
+	assert.Assert(t, math.Abs(*discounted[0].MonthlySavings-1.6*730) < 1e-9, *discounted[0].MonthlySavings)
+}
@@ -0,0 +1,68 @@
+package costmodel_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"gotest.tools/assert"
+
+	costModel "github.com/kubecost/cost-model/costmodel"
+)
+
+// newScrapePrometheus returns a fake Prometheus with a kube-state-metrics target which is up, and two node-exporter
+// targets, one of which is down
+func newScrapePrometheus(t *testing.T) *httptest.Server {
+	targets := []map[string]string{
+		{"job": "kube-state-metrics", "instance": "10.0.0.1:8080", "up": "1"},
+		{"job": "prometheus-node-exporter", "instance": "10.0.1.1:9100", "up": "1"},
+		{"job": "prometheus-node-exporter", "instance": "10.0.1.2:9100", "up": "0"},
+	}
+	return newStubPrometheus(t, func(query string, instant bool) []interface{} {
+		var result []interface{}
+		if strings.HasPrefix(query, "up{job=~") {
+			for _, target := range targets {
+				result = append(result, promSample(map[string]string{"__name__": "up", "job": target["job"], "instance": target["instance"]}, target["up"]))
+			}
+		}
+		return result
+	})
+}
+
+func TestScrapeHealth(t *testing.T) {
+	server := newScrapePrometheus(t)
+	defer server.Close()
+	a := &costModel.Accesses{PrometheusClient: newFakePrometheusClient(t, server.URL)}
+
+	w := httptest.NewRecorder()
+	a.ScrapeHealth(w, httptest.NewRequest("GET", "/scrapeHealth", nil), nil)
+	var envelope struct {
+		Code    int                    `json:"code"`
+		Message string                 `json:"message"`
+		Data    costModel.ScrapeHealth `json:"data"`
+	}
+	assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &envelope))
+	assert.Equal(t, envelope.Code, http.StatusOK)
+	assert.Assert(t, !envelope.Data.Healthy)
+	assert.Assert(t, strings.Contains(envelope.Message, "node-exporter"), envelope.Message)
+	assert.Equal(t, len(envelope.Data.Jobs), 2)
+
+	ksm, nodeExporter := envelope.Data.Jobs[0], envelope.Data.Jobs[1]
+	assert.Equal(t, ksm.Job, "kube-state-metrics")
+	assert.Assert(t, ksm.Healthy)
+	assert.Equal(t, nodeExporter.Targets, 2)
+	assert.DeepEqual(t, nodeExporter.Down, []string{"10.0.1.2:9100"})
+	assert.Assert(t, !nodeExporter.Healthy)
+
+	// jobs without any target are missing
+	os.Setenv("SCRAPE_HEALTH_JOBS", "kube-state-metrics, kubelet")
+	defer os.Unsetenv("SCRAPE_HEALTH_JOBS")
+	health, err := costModel.ComputeScrapeHealth(a.PrometheusClient, costModel.ScrapeHealthJobs())
+	assert.NilError(t, err)
+	assert.Equal(t, health.Jobs[1].Job, "kubelet")
+	assert.Assert(t, health.Jobs[1].Missing)
+	assert.Assert(t, !health.Healthy)
+}
@@ -0,0 +1,79 @@
+package costmodel_test
+
+import (
+	"testing"
+
+	"gotest.tools/assert"
+
+	costModel "github.com/kubecost/cost-model/costmodel"
+)
+
+func newTestSharedCostData() map[string]*costModel.CostData {
+	ingress := newTestContainer("default", "ingress", "nginx")
+	ingress.Labels = map[string]string{"team": "platform"}
+	web := newTestContainer("default", "web", "nginx")
+	web.Labels = map[string]string{"team": "web"}
+
+	return map[string]*costModel.CostData{
+		"monitoring,prometheus,server,testnode":  newTestContainer("monitoring", "prometheus", "server"),
+		"monitoring,prometheus,sidecar,testnode": newTestContainer("monitoring", "prometheus", "sidecar"),
+		"default,ingress,nginx,testnode":         ingress,
+		"default,web,nginx,testnode":             web,
+	}
+}
+
+func TestComputeSharedResourcesByNamespace(t *testing.T) {
+	cp := newTestProvider(t)
+	sr := costModel.NewSharedResourceInfo(true, []string{"monitoring"}, []string{}, []string{})
+
+	shared := costModel.ComputeSharedResources(cp, newTestSharedCostData(), 0.0, sr)
+	assert.DeepEqual(t, shared.Namespaces, []string{"monitoring"})
+	assert.Equal(t, len(shared.Pods), 1)
+	assert.Equal(t, shared.Pods[0].Pod, "prometheus")
+	// both containers of the pod are counted, at 1.0 per CPU and 1.0 per GB of RAM
+	assert.Equal(t, shared.Pods[0].TotalCost, 4.0)
+	assert.Equal(t, shared.TotalCost, 4.0)
+}
+
+func TestComputeSharedResourcesByLabel(t *testing.T) {
+	cp := newTestProvider(t)
+	sr := costModel.NewSharedResourceInfo(true, []string{}, []string{"team"}, []string{"platform"})
+
+	shared := costModel.ComputeSharedResources(cp, newTestSharedCostData(), 0.5, sr)
+	assert.DeepEqual(t, shared.Namespaces, []string{"default"})
+	assert.Equal(t, len(shared.Pods), 1)
+	assert.Equal(t, shared.Pods[0].Namespace, "default")
+	assert.Equal(t, shared.Pods[0].Pod, "ingress")
+	assert.Equal(t, shared.TotalCost, 1.0)
+}
+
+func TestExcludeNamespacesWithDefaultSharedKubeSystem(t *testing.T) {
+	cp := newTestProvider(t)
+	costData := newTestSharedCostData()
+	dns := *costData["default,web,nginx,testnode"]
+	dns.Namespace = "kube-system"
+	dns.PodName = "dns"
+	costData["kube-system,dns,coredns,testnode"] = &dns
+	sr := costModel.NewSharedResourceInfo(true, []string{"monitoring"}, []string{}, []string{})
+
+	// monitoring (4.0) and, by default, kube-system (2.0) are shared into default (4.0)
+	aggs := costModel.AggregateCostModel(cp, costModel.ExcludeNamespaces(costData, nil), "namespace", "", false, 0.0, 1.0, sr)
+	assert.Equal(t, len(aggs), 1)
+	assert.Equal(t, aggs["default"].SharedCost, 6.0)
+	assert.Equal(t, aggs["default"].TotalCost, 10.0)
+
+	// an excluded namespace is not shared, even when shared by default
+	aggs = costModel.AggregateCostModel(cp, costModel.ExcludeNamespaces(costData, []string{"kube-system"}), "namespace", "", false, 0.0, 1.0, sr)
+	assert.Equal(t, len(aggs), 1)
+	assert.Equal(t, aggs["default"].SharedCost, 4.0)
+
+	aggs = costModel.AggregateCostModel(cp, costModel.ExcludeNamespaces(costData, []string{"monitoring"}), "namespace", "", false, 0.0, 1.0, sr)
+	assert.Equal(t, aggs["default"].SharedCost, 2.0)
+
+	// excluding every unshared namespace leaves nothing to share the rest into
+	aggs = costModel.AggregateCostModel(cp, costModel.ExcludeNamespaces(costData, []string{"default"}), "namespace", "", false, 0.0, 1.0, sr)
+	assert.Equal(t, len(aggs), 0)
+
+	// the original cost data is not modified
+	assert.Equal(t, len(costData), 5)
+}
@@ -0,0 +1,110 @@
+package costmodel_test
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+
+	costModel "github.com/kubecost/cost-model/costmodel"
+	v1 "k8s.io/api/core/v1"
+)
+
+// newCronJobPrometheus returns a fake Prometheus scraping every minute, which over the hour to 13:00 has 10
+// samples of the CronJob pod report-1, as its series go stale some minutes after it finishes, requesting a CPU
+// and using half of one while it ran. It has no samples of the pod report-2.
+func newCronJobPrometheus(t *testing.T) *httptest.Server {
+	return newStubPrometheus(t, func(query string, instant bool) []interface{} {
+		metric := map[string]string{"namespace": "batch", "pod_name": "report-1", "container_name": "report", "node": "node-1"}
+		at := time.Date(2019, 10, 1, 13, 0, 0, 0, time.UTC)
+		if instant {
+			return []interface{}{promSample(nil, "60")}
+		} else if strings.Contains(query, "kube_pod_container_resource_requests_cpu_cores") {
+			return []interface{}{promSeries(metric, at, "10")}
+		} else if strings.Contains(query, "container_cpu_usage_seconds_total") {
+			return []interface{}{promSeries(metric, at, "5")}
+		}
+		return nil
+	})
+}
+
+func newCronJobPod(name string, started time.Time, ran time.Duration) *v1.Pod {
+	return newTestPod(name, "batch", "report", v1.PodSucceeded, ownedBy("Job", "report"), requesting("1", "1Gi"), ranBetween(started, started.Add(ran)))
+}
+
+func TestComputeCostDataRangeShortLivedPods(t *testing.T) {
+	server := newCronJobPrometheus(t)
+	defer server.Close()
+	cp := newTestProvider(t)
+
+	cm := &costModel.CostModel{Cache: fakeClusterCache{
+		pods: []*v1.Pod{
+			newCronJobPod("report-1", time.Date(2019, 10, 1, 12, 20, 0, 0, time.UTC), 5*time.Minute),
+			newCronJobPod("report-2", time.Date(2019, 10, 1, 12, 40, 0, 0, time.UTC), 90*time.Second),
+			// ran before the window
+			newCronJobPod("report-0", time.Date(2019, 10, 1, 10, 0, 0, 0, time.UTC), 5*time.Minute),
+		},
+	}}
+
+	data, _, err := cm.ComputeCostDataRange(newFakePrometheusClient(t, server.URL), nil, cp, "2019-10-01T12:00:00.000Z", "2019-10-01T13:00:00.000Z", "1h", "", "", false, false)
+	assert.NilError(t, err)
+	assert.Equal(t, len(data), 2)
+
+	clusterID := costModel.LocalClusterID(cp)
+	// the pod ran for 5 minutes of the hour, not the 10 it was sampled for, and used half its request meanwhile
+	report1 := data[clusterID+",batch,report-1,report,node-1"]
+	assert.Assert(t, report1 != nil)
+	assert.Equal(t, len(report1.CPUAllocation), 1)
+	assert.Assert(t, math.Abs(report1.CPUAllocation[0].Value-5.0/60) < 1e-9, "%f", report1.CPUAllocation[0].Value)
+	assert.Assert(t, math.Abs(report1.CPUUsed[0].Value-2.5/60) < 1e-9, "%f", report1.CPUUsed[0].Value)
+	assert.Assert(t, math.Abs(report1.RAMAllocation[0].Value-1024*1024*1024*5.0/60) < 1e-3)
+
+	// the pod which ran between samples is allocated its requests for the 90 seconds it ran
+	report2 := data[clusterID+",batch,report-2,report,node-1"]
+	assert.Assert(t, report2 != nil)
+	assert.DeepEqual(t, report2.Jobs, []string{"report"})
+	assert.Equal(t, len(report2.CPUAllocation), 1)
+	assert.Assert(t, math.Abs(report2.CPUAllocation[0].Value-1.5/60) < 1e-9, "%f", report2.CPUAllocation[0].Value)
+	assert.Equal(t, report2.CPUAllocation[0].Timestamp, float64(time.Date(2019, 10, 1, 13, 0, 0, 0, time.UTC).Unix()))
+}
+
+func TestCostDataModelRangeMinResolution(t *testing.T) {
+	server, _ := newSlowPrometheus(t, 0, false)
+	defer server.Close()
+	a := newTestAccesses(t, server.URL, "")
+
+	resolutionOf := func(start, query string) (int, string) {
+		w := httptest.NewRecorder()
+		a.CostDataModelRange(w, httptest.NewRequest("GET", "/costDataModelRange?start="+start+"&end=2019-10-01T00:00:00.000Z&window=1m"+query, nil), nil)
+		var envelope costModel.DataEnvelope
+		assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &envelope))
+		return w.Code, envelope.Resolution
+	}
+
+	resolution := func(query string) (int, string) {
+		return resolutionOf("2019-09-01T00:00:00.000Z", query)
+	}
+
+	code, downsampled := resolution("")
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, downsampled, "2h")
+
+	// two days are queried at no coarser than the minimum resolution
+	code, finer := resolutionOf("2019-09-29T00:00:00.000Z", "&minResolution=15m")
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, finer, "15m")
+
+	// but the month is queried no finer than keeps it within MaxRangePoints points per series
+	code, finest := resolution("&minResolution=15m")
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, finest, "87m")
+	assert.Equal(t, costModel.MinRangeResolution(time.Date(2019, 9, 1, 0, 0, 0, 0, time.UTC), time.Date(2019, 10, 1, 0, 0, 0, 0, time.UTC)), 87*time.Minute)
+
+	code, _ = resolution("&minResolution=soon")
+	assert.Equal(t, code, http.StatusBadRequest)
+}
@@ -0,0 +1,92 @@
+package costmodel_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	"github.com/prometheus/client_golang/prometheus"
+	"gotest.tools/assert"
+
+	costModel "github.com/kubecost/cost-model/costmodel"
+)
+
+func newTestGaugeVec(name string, labels ...string) *prometheus.GaugeVec {
+	return prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: name}, labels)
+}
+
+func newTestRecordingAccesses(t *testing.T, prometheusAddress string, interval time.Duration) *costModel.Accesses {
+	return &costModel.Accesses{
+		PrometheusClient:              newFakePrometheusClient(t, prometheusAddress),
+		Cloud:                         newTestProvider(t),
+		CPUPriceRecorder:              newTestGaugeVec("node_cpu_hourly_cost", "instance", "node"),
+		RAMPriceRecorder:              newTestGaugeVec("node_ram_hourly_cost", "instance", "node"),
+		GPUPriceRecorder:              newTestGaugeVec("node_gpu_hourly_cost", "instance", "node"),
+		NodeTotalPriceRecorder:        newTestGaugeVec("node_total_hourly_cost", "instance", "node"),
+		NodeDiscountedPriceRecorder:   newTestGaugeVec("node_total_hourly_cost_discounted", "instance", "node"),
+		NodeSpotRecorder:              newTestGaugeVec("kubecost_node_is_spot", "instance", "node"),
+		NodeCPUCapacityRecorder:       newTestGaugeVec("kubecost_node_cpu_capacity_cores", "instance", "node"),
+		NodeRAMCapacityRecorder:       newTestGaugeVec("kubecost_node_ram_capacity_bytes", "instance", "node"),
+		NodeGPUCountRecorder:          newTestGaugeVec("kubecost_node_gpu_count", "instance", "node"),
+		NodeAllocatedCPURecorder:      newTestGaugeVec("kubecost_node_allocated_cpu_cores", "instance", "node"),
+		NodeAllocatedRAMRecorder:      newTestGaugeVec("kubecost_node_allocated_ram_bytes", "instance", "node"),
+		PersistentVolumePriceRecorder: newTestGaugeVec("pv_hourly_cost", "volumename", "persistentvolume"),
+		RAMAllocationRecorder:         newTestGaugeVec("container_memory_allocation_bytes", "namespace", "pod", "container", "instance", "node"),
+		CPUAllocationRecorder:         newTestGaugeVec("container_cpu_allocation", "namespace", "pod", "container", "instance", "node"),
+		GPUAllocationRecorder:         newTestGaugeVec("container_gpu_allocation", "namespace", "pod", "container", "instance", "node"),
+		PVAllocationRecorder:          newTestGaugeVec("pod_pvc_allocation", "namespace", "pod", "persistentvolumeclaim", "persistentvolume"),
+		ContainerUptimeRecorder:       newTestGaugeVec("container_uptime_seconds", "namespace", "pod", "container"),
+		NetworkZoneEgressRecorder:     prometheus.NewGauge(prometheus.GaugeOpts{Name: "kubecost_network_zone_egress_cost"}),
+		NetworkRegionEgressRecorder:   prometheus.NewGauge(prometheus.GaugeOpts{Name: "kubecost_network_region_egress_cost"}),
+		NetworkInternetEgressRecorder: prometheus.NewGauge(prometheus.GaugeOpts{Name: "kubecost_network_internet_egress_cost"}),
+		LoadBalancerCostRecorder:      newTestGaugeVec("kubecost_load_balancer_cost", "namespace", "service_name", "ingress_ip"),
+		Model:                         &costModel.CostModel{Cache: fakeClusterCache{}},
+		Cache:                         cache.New(time.Minute, time.Minute),
+		PriceRecordWindow:             "2m",
+		PriceRecordInterval:           interval,
+	}
+}
+
+func TestRecordPricesStopsOnCancel(t *testing.T) {
+	server, requests := newSlowPrometheus(t, 0, false)
+	defer server.Close()
+	a := newTestRecordingAccesses(t, server.URL, time.Hour)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := a.RecordPrices(ctx)
+
+	// The first pass runs immediately; wait for it to query prometheus before cancelling
+	deadline := time.Now().Add(5 * time.Second)
+	for count, _ := requests(); count == 0; count, _ = requests() {
+		if time.Now().After(deadline) {
+			t.Fatal("price recording never queried prometheus")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("price recording did not stop after cancellation")
+	}
+}
+
+func TestRecordPricesCompletesPassInProgress(t *testing.T) {
+	server, requests := newSlowPrometheus(t, 50*time.Millisecond, false)
+	defer server.Close()
+	a := newTestRecordingAccesses(t, server.URL, time.Hour)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	done := a.RecordPrices(ctx)
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("price recording did not stop after cancellation")
+	}
+	count, _ := requests()
+	assert.Assert(t, count > 0, "expected the pass in progress to complete before stopping")
+}
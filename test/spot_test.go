@@ -0,0 +1,154 @@
+package costmodel_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"strings"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+
+	"github.com/kubecost/cost-model/cloud"
+)
+
+func TestIsSpotNodeDefaultLabels(t *testing.T) {
+	spotNodes := []map[string]string{
+		{"cloud.google.com/gke-preemptible": "true"},
+		{"cloud.google.com/gke-spot": "true"},
+		{"karpenter.sh/capacity-type": "spot"},
+		{"eks.amazonaws.com/capacityType": "SPOT"},
+		{"kubernetes.azure.com/scalesetpriority": "spot"},
+		{"lifecycle": "EC2Spot"},
+	}
+	for _, labels := range spotNodes {
+		assert.Assert(t, cloud.IsSpotNode(labels, nil), "expected %v to be a spot node", labels)
+	}
+
+	onDemandNodes := []map[string]string{
+		{},
+		{"karpenter.sh/capacity-type": "on-demand"},
+		{"eks.amazonaws.com/capacityType": "ON_DEMAND"},
+		{"cloud.google.com/gke-preemptible": "false"},
+	}
+	for _, labels := range onDemandNodes {
+		assert.Assert(t, !cloud.IsSpotNode(labels, nil), "expected %v to be an on-demand node", labels)
+	}
+}
+
+func TestSpotNodeLabels(t *testing.T) {
+	labels, err := cloud.SpotNodeLabels(&cloud.CustomPricing{
+		SpotNodeLabels: "node-pool=spot, capacity=interruptible",
+		SpotLabel:      "kops.k8s.io/instancegroup",
+		SpotLabelValue: "spotgroup",
+	})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, labels, map[string]string{
+		"node-pool":                 "spot",
+		"capacity":                  "interruptible",
+		"kops.k8s.io/instancegroup": "spotgroup",
+	})
+	assert.Assert(t, !cloud.IsSpotNode(map[string]string{"karpenter.sh/capacity-type": "spot"}, labels))
+
+	_, err = cloud.SpotNodeLabels(&cloud.CustomPricing{SpotNodeLabels: "node-pool"})
+	assert.ErrorContains(t, err, "Invalid spot node label")
+}
+
+func TestNodeIsSpotByLifecycle(t *testing.T) {
+	assert.Assert(t, (&cloud.Node{Lifecycle: cloud.LifecycleSpot}).IsSpot())
+	assert.Assert(t, !(&cloud.Node{Lifecycle: cloud.LifecycleOnDemand, UsageType: "preemptible"}).IsSpot())
+	assert.Assert(t, (&cloud.Node{UsageType: "preemptible"}).IsSpot())
+}
+
+// gzipSpotFeed returns the given lines of a spot data feed file, gzipped
+func gzipSpotFeed(t *testing.T, lines ...string) *bytes.Buffer {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	_, err := gw.Write([]byte(strings.Join(lines, "\n") + "\n"))
+	assert.NilError(t, err)
+	assert.NilError(t, gw.Close())
+	return &buf
+}
+
+const spotFeedFields = "#Fields: Timestamp UsageType Operation InstanceID MyBidID MyMaxPrice MarketPrice Charge Version"
+
+func TestParseSpotFeed(t *testing.T) {
+	spots := map[string]*cloud.SpotInfo{
+		"i-old": {InstanceID: "i-old", Charge: "0.5 USD"},
+		"i-2":   {InstanceID: "i-2", Charge: "0.9 USD"},
+	}
+	feed := gzipSpotFeed(t,
+		"#Version: 1.0",
+		spotFeedFields,
+		"2020-01-01 00:00:00 UTC\tSpotUsage:m5.large\tRunInstances\ti-1\tsir-1\t0.096 USD\t0.035 USD\t0.035 USD\t1",
+		"a line which isn't a record",
+		"2020-01-01 00:00:00 UTC\tSpotUsage:m5.large\tRunInstances\ti-2\tsir-2\t0.096 USD\t0.036 USD\t0.036 USD\t1",
+	)
+	assert.NilError(t, cloud.ParseSpotFeed(feed, spots))
+
+	// the records of the file are added, replacing those already parsed of the same instances
+	assert.Equal(t, len(spots), 3)
+	assert.Equal(t, spots["i-1"].Charge, "0.035 USD")
+	assert.Equal(t, spots["i-1"].Timestamp, "2020-01-01 00:00:00 UTC")
+	assert.Equal(t, spots["i-2"].Charge, "0.036 USD")
+	assert.Equal(t, spots["i-old"].Charge, "0.5 USD")
+
+	assert.ErrorContains(t, cloud.ParseSpotFeed(gzipSpotFeed(t, "#Version: 2.0", spotFeedFields), spots), "Unsupported spot info feed version")
+
+	// a truncated file is an error, rather than a partial feed
+	truncated := gzipSpotFeed(t, "#Version: 1.0", spotFeedFields)
+	assert.Assert(t, cloud.ParseSpotFeed(bytes.NewReader(truncated.Bytes()[:10]), spots) != nil)
+	assert.Assert(t, cloud.ParseSpotFeed(strings.NewReader("not gzipped"), spots) != nil)
+}
+
+func TestSpotInfoHourlyCharge(t *testing.T) {
+	layout := "2006-01-02 15:04:05 MST"
+	recent := time.Now().UTC().Add(-time.Hour).Format(layout)
+	stale := time.Now().UTC().Add(-4 * time.Hour).Format(layout)
+
+	charge, err := (&cloud.SpotInfo{Timestamp: recent, Charge: "0.035 USD"}).HourlyCharge(3 * time.Hour)
+	assert.NilError(t, err)
+	assert.Equal(t, charge, "0.035")
+
+	// records older than the staleness are no longer trusted
+	_, err = (&cloud.SpotInfo{Timestamp: stale, Charge: "0.035 USD"}).HourlyCharge(3 * time.Hour)
+	assert.ErrorContains(t, err, "staleness")
+	_, err = (&cloud.SpotInfo{Timestamp: stale, Charge: "0.035 USD"}).HourlyCharge(5 * time.Hour)
+	assert.NilError(t, err)
+
+	_, err = (&cloud.SpotInfo{Timestamp: recent, Charge: "0.035"}).HourlyCharge(3 * time.Hour)
+	assert.ErrorContains(t, err, "malformed spot data charge")
+	_, err = (&cloud.SpotInfo{Timestamp: recent, Charge: "cheap USD"}).HourlyCharge(3 * time.Hour)
+	assert.ErrorContains(t, err, "malformed spot data charge")
+	_, err = (&cloud.SpotInfo{Timestamp: "yesterday", Charge: "0.035 USD"}).HourlyCharge(3 * time.Hour)
+	assert.ErrorContains(t, err, "malformed spot data timestamp")
+}
+
+func TestSortSpotFeedKeys(t *testing.T) {
+	names := []string{
+		"spot.feed.v1/123456789012.2020-01-02-00.001.b.gz",
+		"spot.feed.v1/123456789012.2020-01-01-23.002.a.gz",
+		"spot.feed.v1/unexpected.gz",
+		"spot.feed.v1/123456789012.2020-01-01-23.001.c.gz",
+		"spot.feed.v1/123456789012.2020-01-01-03.001.d.gz",
+	}
+	var keys []*string
+	for i := range names {
+		keys = append(keys, &names[i])
+	}
+	cloud.SortSpotFeedKeys(keys)
+
+	// files are ordered by the hour in their names, not by the dots of the prefix, and by name within an hour,
+	// with those without an hour first
+	var sorted []string
+	for _, key := range keys {
+		sorted = append(sorted, *key)
+	}
+	assert.DeepEqual(t, sorted, []string{
+		"spot.feed.v1/unexpected.gz",
+		"spot.feed.v1/123456789012.2020-01-01-03.001.d.gz",
+		"spot.feed.v1/123456789012.2020-01-01-23.001.c.gz",
+		"spot.feed.v1/123456789012.2020-01-01-23.002.a.gz",
+		"spot.feed.v1/123456789012.2020-01-02-00.001.b.gz",
+	})
+}
@@ -0,0 +1,38 @@
+package costmodel_test
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+
+	costModel "github.com/kubecost/cost-model/costmodel"
+)
+
+func TestCostDataAggregateFromSQLUnsupportedField(t *testing.T) {
+	// Label aggregations are not grouped in the database, and must be rejected before connecting to it
+	_, err := costModel.CostDataAggregateFromSQL("label", "app", "1h", "2020-01-01T00:00:00Z", "2020-01-02T00:00:00Z", 1024*1024*1024)
+	assert.Equal(t, err, costModel.ErrSQLAggregationUnsupported)
+}
+
+func TestCostDataAggregateFromDB(t *testing.T) {
+	db := newTestRemoteDB(t)
+	defer db.Close()
+
+	// two cores allocated for three hours on a node priced at 0.5 per core hour
+	start := time.Date(2019, 10, 1, 0, 0, 0, 0, time.UTC)
+	insertTestMetric(t, db, "container_cpu_allocation", `{"namespace":"web","pod":"api-1","container":"api","instance":"node-1","cluster_id":"c1"}`,
+		map[time.Time]float64{start: 2, start.Add(time.Hour): 2, start.Add(2 * time.Hour): 2})
+	insertTestMetric(t, db, "node_cpu_hourly_cost", `{"instance":"node-1","cluster_id":"c1"}`,
+		map[time.Time]float64{start: 0.5, start.Add(time.Hour): 0.5, start.Add(2 * time.Hour): 0.5})
+
+	// the cost is the same however the hours are bucketed
+	for _, window := range []string{"1h", "3h"} {
+		aggs, err := costModel.CostDataAggregateFromDB(db, "namespace", "", window, "2019-10-01T00:00:00Z", "2019-10-01T03:00:00Z", 1024*1024*1024)
+		assert.NilError(t, err)
+		assert.Equal(t, len(aggs), 1)
+		assert.Assert(t, math.Abs(aggs["web"].CPUCost-3.0) < 1e-9, "%s: %f", window, aggs["web"].CPUCost)
+		assert.Assert(t, math.Abs(aggs["web"].TotalCost-3.0) < 1e-9, window)
+	}
+}
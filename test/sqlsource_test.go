@@ -0,0 +1,53 @@
+package costmodel_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"gotest.tools/assert"
+
+	costModel "github.com/kubecost/cost-model/costmodel"
+)
+
+func TestCostDataModelRangeSQLSource(t *testing.T) {
+	server, stats := newSlowPrometheus(t, 0, false)
+	defer server.Close()
+	a := newTestAccesses(t, server.URL, "")
+
+	getRange := func(query string) (int, *costModel.DataEnvelope) {
+		w := httptest.NewRecorder()
+		a.CostDataModelRange(w, httptest.NewRequest("GET", "/costDataModelRange?start=2019-09-01T00:00:00Z&end=2019-09-02T00:00:00Z&window=1h&"+query, nil), nil)
+		var envelope costModel.DataEnvelope
+		assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &envelope))
+		return w.Code, &envelope
+	}
+
+	// without the remote database, reading from it is an error rather than a fallback to prometheus
+	os.Unsetenv("SQL_ADDRESS")
+	code, envelope := getRange("source=sql")
+	assert.Equal(t, code, http.StatusBadRequest)
+	assert.Equal(t, envelope.ErrorCode, costModel.ErrorCodeBadRequest)
+	assert.Assert(t, strings.Contains(envelope.Message, "SQL_ADDRESS"), envelope.Message)
+
+	// even when the remote database can't be reached, prometheus isn't queried instead
+	os.Setenv("SQL_ADDRESS", "127.0.0.1")
+	defer os.Unsetenv("SQL_ADDRESS")
+	_, envelope = getRange("source=sql")
+	assert.Equal(t, envelope.Status, "error")
+	requests, _ := stats()
+	assert.Equal(t, requests, 0)
+
+	code, envelope = getRange("source=thanos")
+	assert.Equal(t, code, http.StatusBadRequest)
+	assert.Equal(t, envelope.Errors[0].Param, "source")
+
+	// prometheus remains the default source
+	code, _ = getRange("")
+	assert.Equal(t, code, http.StatusOK)
+	requests, _ = stats()
+	assert.Assert(t, requests > 0)
+}
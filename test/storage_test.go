@@ -0,0 +1,81 @@
+package costmodel_test
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"testing"
+
+	"gotest.tools/assert"
+
+	"github.com/kubecost/cost-model/cloud"
+	costModel "github.com/kubecost/cost-model/costmodel"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func newTestClassPV(class string, size string) *v1.PersistentVolume {
+	return &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "pv-" + class,
+		},
+		Spec: v1.PersistentVolumeSpec{
+			StorageClassName: class,
+			Capacity: v1.ResourceList{
+				v1.ResourceStorage: resource.MustParse(size),
+			},
+		},
+	}
+}
+
+func TestStorageTierHourlyCost(t *testing.T) {
+	gp3 := &cloud.StorageTier{IOPSCost: 0.01, IncludedIOPS: 3000, ThroughputCost: 0.1, IncludedThroughput: 125}
+	assert.Equal(t, gp3.HourlyCost(3000, 125), 0.0)
+	assert.Assert(t, math.Abs(gp3.HourlyCost(4000, 225)-(1000*0.01+100*0.1)) < 1e-9)
+}
+
+func TestProvisionedPerformance(t *testing.T) {
+	pv := newTestClassPV("io1", "100Gi")
+	iops, throughput := cloud.ProvisionedPerformance(pv, map[string]string{"type": "io1", "iopsPerGB": "10"})
+	assert.Equal(t, iops, 1000.0)
+	assert.Equal(t, throughput, 0.0)
+
+	// CSI volume attributes take precedence over the storage class parameters
+	pv.Spec.CSI = &v1.CSIPersistentVolumeSource{
+		VolumeAttributes: map[string]string{"iops": "5000", "throughput": "500"},
+	}
+	iops, throughput = cloud.ProvisionedPerformance(pv, map[string]string{"iops": "3000"})
+	assert.Equal(t, iops, 5000.0)
+	assert.Equal(t, throughput, 500.0)
+}
+
+func TestGetPVCostStorageClassPricing(t *testing.T) {
+	cp := newTestProvider(t)
+	_, err := cp.UpdateConfig(strings.NewReader(`{"storageClassPricing":"fast:0.0001,0.001,0.002"}`), "")
+	assert.NilError(t, err)
+
+	// provisioned performance is spread over the capacity of the volume
+	pv := &cloud.PV{Parameters: map[string]string{"iops": "1000", "throughput": "250"}}
+	err = costModel.GetPVCost(pv, newTestClassPV("fast", "100Gi"), cp)
+	assert.NilError(t, err)
+	cost, err := strconv.ParseFloat(pv.Cost, 64)
+	assert.NilError(t, err)
+	assert.Assert(t, math.Abs(cost-(0.0001+1.5/100)) < 1e-12)
+	assert.Equal(t, pv.StorageCost, "0.0001")
+	assert.Equal(t, pv.PerformanceCost, "1.5")
+	assert.Equal(t, pv.IOPS, "1000")
+
+	// volumes of the class without provisioned performance are priced by capacity alone
+	pv = &cloud.PV{}
+	err = costModel.GetPVCost(pv, newTestClassPV("fast", "100Gi"), cp)
+	assert.NilError(t, err)
+	assert.Equal(t, pv.Cost, "0.0001")
+	assert.Equal(t, pv.PerformanceCost, "")
+
+	// other classes keep the default price
+	pv = &cloud.PV{Parameters: map[string]string{"iops": "1000"}}
+	err = costModel.GetPVCost(pv, newTestClassPV("standard", "100Gi"), cp)
+	assert.NilError(t, err)
+	assert.Equal(t, pv.Cost, "0.00005479452")
+}
@@ -0,0 +1,111 @@
+package costmodel_test
+
+import (
+	"math"
+	"testing"
+
+	"gotest.tools/assert"
+
+	"github.com/kubecost/cost-model/cloud"
+	costModel "github.com/kubecost/cost-model/costmodel"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// diskListingProvider lists a fixed set of unattached disks, as providers which can list orphaned disks do
+type diskListingProvider struct {
+	cloud.Provider
+	unattached []*cloud.Disk
+}
+
+func (p *diskListingProvider) ListOrphanedDisks(backing map[string]bool) ([]*cloud.Disk, error) {
+	orphaned := []*cloud.Disk{}
+	for _, disk := range p.unattached {
+		if !backing[disk.ID] {
+			orphaned = append(orphaned, disk)
+		}
+	}
+	return orphaned, nil
+}
+
+func newPhasedPV(name string, phase v1.PersistentVolumePhase, size string, claim string) *v1.PersistentVolume {
+	pv := &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   name,
+			Labels: map[string]string{v1.LabelZoneRegion: "us-east-1"},
+		},
+		Spec: v1.PersistentVolumeSpec{
+			StorageClassName: "standard",
+			Capacity: v1.ResourceList{
+				v1.ResourceStorage: resource.MustParse(size),
+			},
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				AWSElasticBlockStore: &v1.AWSElasticBlockStoreVolumeSource{VolumeID: "aws://us-east-1a/vol-" + name},
+			},
+		},
+		Status: v1.PersistentVolumeStatus{Phase: phase},
+	}
+	if claim != "" {
+		pv.Spec.ClaimRef = &v1.ObjectReference{Namespace: "shop", Name: claim}
+	}
+	return pv
+}
+
+func TestComputeStorageSavings(t *testing.T) {
+	base := newTestProvider(t)
+	assert.NilError(t, base.DownloadPricingData())
+
+	cm := &costModel.CostModel{Cache: fakeClusterCache{pvs: []*v1.PersistentVolume{
+		newPhasedPV("released", v1.VolumeReleased, "20Gi", "old-data"),
+		newPhasedPV("available", v1.VolumeAvailable, "10Gi", ""),
+		newPhasedPV("idle", v1.VolumeBound, "30Gi", "cache"),
+		newPhasedPV("mounted", v1.VolumeBound, "40Gi", "db"),
+		newPhasedPV("pending", v1.VolumePending, "50Gi", ""),
+	}}}
+	costData := map[string]*costModel.CostData{
+		"shop,db-0,postgres,node-1": {PVCData: []*costModel.PersistentVolumeClaimData{{Claim: "db", Namespace: "shop", VolumeName: "mounted"}}},
+	}
+
+	// priced with the custom provider default of 0.00005479452/GB of storage
+	gbMonthlyCost := 0.00005479452 * 730
+
+	// providers which can't list disks omit them
+	savings := cm.ComputeStorageSavings(base, costData)
+	assert.Equal(t, len(savings.ReleasedVolumes), 1)
+	assert.Equal(t, savings.ReleasedVolumes[0].Name, "released")
+	assert.Equal(t, savings.ReleasedVolumes[0].Claim, "old-data")
+	assert.Equal(t, len(savings.AvailableVolumes), 1)
+	assert.Equal(t, savings.AvailableVolumes[0].Name, "available")
+	assert.Equal(t, len(savings.UnusedClaims), 1)
+	assert.Equal(t, savings.UnusedClaims[0].Name, "idle")
+	assert.Equal(t, savings.UnusedClaims[0].Namespace, "shop")
+	assert.Assert(t, math.Abs(savings.UnusedClaims[0].MonthlyCost-30*gbMonthlyCost) < 1e-9)
+	assert.Assert(t, savings.OrphanedDisks == nil)
+	assert.Assert(t, math.Abs(savings.MonthlyCost-60*gbMonthlyCost) < 1e-9, savings.MonthlyCost)
+
+	// disks backing a volume of the cluster, in any phase, aren't orphaned
+	cp := &diskListingProvider{Provider: base, unattached: []*cloud.Disk{
+		{ID: "vol-released", Region: "us-east-1", Type: "gp2", Bytes: 20 * 1024 * 1024 * 1024},
+		{ID: "vol-small", Region: "us-east-1", Type: "gp2", Bytes: 5 * 1024 * 1024 * 1024},
+		{ID: "vol-big", Region: "us-east-1", Type: "gp2", Bytes: 100 * 1024 * 1024 * 1024},
+	}}
+	savings = cm.ComputeStorageSavings(cp, costData)
+	assert.Equal(t, len(savings.OrphanedDisks), 2)
+	assert.Equal(t, savings.OrphanedDisks[0].ID, "vol-big")
+	assert.Assert(t, math.Abs(savings.OrphanedDisks[0].MonthlyCost-100*gbMonthlyCost) < 1e-9)
+	assert.Equal(t, savings.OrphanedDisks[1].ID, "vol-small")
+	assert.Assert(t, math.Abs(savings.MonthlyCost-165*gbMonthlyCost) < 1e-9, savings.MonthlyCost)
+}
+
+func TestDiskID(t *testing.T) {
+	pv := &v1.PersistentVolume{}
+	assert.Equal(t, cloud.DiskID(pv), "")
+
+	pv.Spec.AWSElasticBlockStore = &v1.AWSElasticBlockStoreVolumeSource{VolumeID: "aws://us-east-1a/vol-0abc"}
+	assert.Equal(t, cloud.DiskID(pv), "vol-0abc")
+
+	pv.Spec.AWSElasticBlockStore = nil
+	pv.Spec.CSI = &v1.CSIPersistentVolumeSource{Driver: "pd.csi.storage.gke.io", VolumeHandle: "projects/p/zones/us-central1-a/disks/pvc-123"}
+	assert.Equal(t, cloud.DiskID(pv), "pvc-123")
+}
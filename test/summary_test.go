@@ -0,0 +1,65 @@
+package costmodel_test
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+
+	"gotest.tools/assert"
+
+	costModel "github.com/kubecost/cost-model/costmodel"
+)
+
+func TestSummarizeAggregations(t *testing.T) {
+	cp := newTestProvider(t)
+	costData := newTestCostData()
+	costData["test1,bar,nginx,testnode"].Namespace = "test2"
+	aggs := costModel.AggregateCostModel(cp, costData, "namespace", "", false, 0, 1.0, nil)
+	costModel.AddSharedCost(aggs, 3.0)
+
+	summary := costModel.SummarizeAggregations(aggs)
+	assert.Equal(t, summary.Count, 2)
+	assert.Assert(t, math.Abs(summary.SharedCost-3.0) < 1e-9)
+	assert.Assert(t, math.Abs(summary.TotalCost-totalAggregationCost(aggs)) < 1e-9)
+
+	// the total is the sum of the categories
+	categories := summary.CPUCost + summary.RAMCost + summary.GPUCost + summary.PVCost + summary.NetworkCost +
+		summary.LBCost + summary.SharedCost + summary.MarkupCost + summary.ExternalCost
+	assert.Assert(t, math.Abs(summary.TotalCost-categories) < 1e-9, "%f != %f", summary.TotalCost, categories)
+}
+
+func TestSummarizeAggregationsIdleCategory(t *testing.T) {
+	cp := newTestProvider(t)
+	aggs := costModel.AggregateCostModel(cp, newTestCostData(), "namespace", "", false, 0, 1.0, nil)
+	costModel.AddIdleAggregation(aggs, "namespace", "", 2.0)
+
+	// idle cost is a category of its own, so the total is still the sum of the categories, rounded or not
+	for _, precision := range []int{-1, 2} {
+		summary := costModel.RoundAggregationSummary(costModel.SummarizeAggregations(costModel.RoundAggregations(aggs, precision)), precision)
+		assert.Equal(t, summary.Count, 2)
+		assert.Equal(t, summary.IdleCost, 2.0, "precision %d", precision)
+		categories := summary.CPUCost + summary.RAMCost + summary.GPUCost + summary.PVCost + summary.NetworkCost +
+			summary.LBCost + summary.SharedCost + summary.MarkupCost + summary.ExternalCost + summary.IdleCost
+		assert.Assert(t, math.Abs(summary.TotalCost-categories) < 1e-9, "precision %d: %f != %f", precision, summary.TotalCost, categories)
+		assert.Assert(t, math.Abs(summary.TotalCost-10.0) < 1e-9, "precision %d: %f", precision, summary.TotalCost)
+	}
+}
+
+func TestAggregateCostModelSummary(t *testing.T) {
+	server, _ := newSlowPrometheus(t, 0, false)
+	defer server.Close()
+	a := newTestAccesses(t, server.URL, "")
+
+	for _, message := range []string{"cache miss", "cache hit"} {
+		envelope := getAggregatedCostModel(t, a, "aggregation=namespace&window=1h")
+		assert.Assert(t, envelope.Summary != nil, message)
+
+		b, err := json.Marshal(envelope.Data)
+		assert.NilError(t, err)
+		var response costModel.AggregationResponse
+		assert.NilError(t, json.Unmarshal(b, &response))
+		summary := costModel.SummarizeAggregations(response.Aggregations)
+		assert.Equal(t, envelope.Summary.Count, summary.Count, message)
+		assert.Assert(t, math.Abs(envelope.Summary.TotalCost-summary.TotalCost) < 1e-9, message)
+	}
+}
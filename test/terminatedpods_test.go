@@ -0,0 +1,87 @@
+package costmodel_test
+
+import (
+	"math"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+
+	"github.com/kubecost/cost-model/cloud"
+	costModel "github.com/kubecost/cost-model/costmodel"
+	v1 "k8s.io/api/core/v1"
+)
+
+// newUptimePrometheus returns a fake Prometheus scraping every minute, over the hour to 13:00 of which the job pod
+// migrate-1 ran for 20 minutes and the pod web-1 ran throughout, each requesting half a CPU and using 0.3. It
+// answers count_over_time of a series with its number of samples in the hour, like Prometheus would.
+func newUptimePrometheus(t *testing.T) *httptest.Server {
+	minutes := map[string]float64{"migrate-1": 20, "web-1": 60}
+	namespaces := map[string]string{"migrate-1": "batch", "web-1": "web"}
+	containers := map[string]string{"migrate-1": "migrate", "web-1": "web"}
+	series := func(query string, perSample float64) []interface{} {
+		var result []interface{}
+		for pod, n := range minutes {
+			value := perSample
+			if strings.Contains(query, "count_over_time") {
+				value *= n
+			}
+			metric := map[string]string{"namespace": namespaces[pod], "pod_name": pod, "container_name": containers[pod], "node": "node-1"}
+			result = append(result, promSeries(metric, time.Date(2019, 10, 1, 13, 0, 0, 0, time.UTC), strconv.FormatFloat(value, 'f', -1, 64)))
+		}
+		return result
+	}
+	return newStubPrometheus(t, func(query string, instant bool) []interface{} {
+		if instant {
+			// the most samples of any series in the hour
+			return []interface{}{promSample(nil, "60")}
+		} else if strings.Contains(query, "kube_pod_container_resource_requests_cpu_cores") {
+			return series(query, 0.5)
+		} else if strings.Contains(query, "container_cpu_usage_seconds_total") {
+			return series(query, 0.3)
+		}
+		return nil
+	})
+}
+
+func TestComputeCostDataRangeTerminatedPods(t *testing.T) {
+	server := newUptimePrometheus(t)
+	defer server.Close()
+	cli := newFakePrometheusClient(t, server.URL)
+	cp := newTestProvider(t)
+
+	cm := &costModel.CostModel{Cache: fakeClusterCache{
+		pods: []*v1.Pod{
+			newTestPod("migrate-1", "batch", "migrate", v1.PodSucceeded, ownedBy("Job", "migrate")),
+			newTestPod("web-1", "web", "web", v1.PodRunning),
+			// completed before the window, so without metrics in it
+			newTestPod("migrate-0", "batch", "migrate", v1.PodSucceeded, ownedBy("Job", "migrate")),
+		},
+	}}
+
+	data, _, err := cm.ComputeCostDataRange(cli, nil, cp, "2019-10-01T12:00:00.000Z", "2019-10-01T13:00:00.000Z", "1h", "", "", false, false)
+	assert.NilError(t, err)
+	assert.Equal(t, len(data), 2)
+
+	clusterID := costModel.LocalClusterID(cp)
+	migrate, ok := data[clusterID+",batch,migrate-1,migrate,node-1"]
+	assert.Assert(t, ok)
+	// the completed pod keeps the metadata of its pod
+	assert.DeepEqual(t, migrate.Jobs, []string{"migrate"})
+
+	for _, costs := range data {
+		costs.NodeData = &cloud.Node{VCPUCost: "1.0", RAMCost: "1.0"}
+	}
+	aggs := costModel.AggregateCostModel(cp, data, "namespace", "", false, 0, 1.0, nil)
+	// the pod which ran for 20 minutes of the hour costs a third of the one which ran throughout, although its
+	// CPU usage, while it ran, exceeded a third of its request
+	assert.Assert(t, aggs["web"].CPUCost > 0)
+	assert.Assert(t, math.Abs(aggs["batch"].CPUCost-aggs["web"].CPUCost/3) < 1e-9, "%f %f", aggs["batch"].CPUCost, aggs["web"].CPUCost)
+
+	jobs := costModel.AggregateCostModel(cp, data, "job", "", false, 0, 1.0, nil)
+	_, ok = jobs["migrate"]
+	assert.Assert(t, ok)
+}
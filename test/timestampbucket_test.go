@@ -0,0 +1,69 @@
+package costmodel_test
+
+import (
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+
+	"github.com/kubecost/cost-model/cloud"
+	costModel "github.com/kubecost/cost-model/costmodel"
+)
+
+// newBucketCostData returns two containers of a namespace sampled at the given timestamps, which are offset from
+// one another as samples of separate queries may be
+func newBucketCostData(first []float64, second []float64) map[string]*costModel.CostData {
+	vectors := func(timestamps []float64) []*costModel.Vector {
+		var v []*costModel.Vector
+		for _, ts := range timestamps {
+			v = append(v, &costModel.Vector{Timestamp: ts, Value: 1.0})
+		}
+		return v
+	}
+	costData := make(map[string]*costModel.CostData)
+	for name, timestamps := range map[string][]float64{"first": first, "second": second} {
+		costData[name] = &costModel.CostData{
+			Name:          name,
+			Namespace:     "test1",
+			NodeData:      &cloud.Node{VCPUCost: "1.0", RAMCost: "1.0"},
+			CPUAllocation: vectors(timestamps),
+		}
+	}
+	return costData
+}
+
+func timestamps(vectors []*costModel.Vector) []float64 {
+	var ts []float64
+	for _, v := range vectors {
+		ts = append(ts, v.Timestamp)
+	}
+	return ts
+}
+
+func TestTimestampBucket(t *testing.T) {
+	assert.Equal(t, costModel.TimestampBucket(0), 10.0)
+	assert.Equal(t, costModel.TimestampBucket(500*time.Millisecond), 10.0)
+	assert.Equal(t, costModel.TimestampBucket(5*time.Second), 5.0)
+	assert.Equal(t, costModel.TimestampBucket(time.Hour), 3600.0)
+}
+
+func TestAggregateCostModelAtResolution(t *testing.T) {
+	cp := newTestProvider(t)
+
+	// hourly samples a few seconds apart merge into one bucket per hour, aligned to the hour
+	costData := newBucketCostData([]float64{3594, 7194}, []float64{3606, 7206})
+	aggs := costModel.AggregateCostModelAtResolution(cp, costData, "namespace", "", true, 0, 1.0, nil, time.Hour)
+	assert.DeepEqual(t, timestamps(aggs["test1"].CPUCostVector), []float64{3600, 7200})
+	assert.Equal(t, aggs["test1"].CPUCostVector[0].Value, aggs["test1"].CPUCost/2)
+
+	// which, by the default buckets of 10 seconds, are spuriously split
+	costData = newBucketCostData([]float64{3594, 7194}, []float64{3606, 7206})
+	aggs = costModel.AggregateCostModel(cp, costData, "namespace", "", true, 0, 1.0, nil)
+	assert.DeepEqual(t, timestamps(aggs["test1"].CPUCostVector), []float64{3590, 3610, 7190, 7210})
+
+	// samples 4 seconds apart stay apart at a resolution of 5 seconds, rather than merging into buckets of 10
+	costData = newBucketCostData([]float64{100, 104}, []float64{100, 104})
+	aggs = costModel.AggregateCostModelAtResolution(cp, costData, "namespace", "", true, 0, 1.0, nil, 5*time.Second)
+	assert.DeepEqual(t, timestamps(aggs["test1"].CPUCostVector), []float64{100, 105})
+	assert.Equal(t, aggs["test1"].CPUCostVector[0].Value, aggs["test1"].CPUCostVector[1].Value)
+}
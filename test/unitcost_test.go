@@ -0,0 +1,53 @@
+package costmodel_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+
+	costModel "github.com/kubecost/cost-model/costmodel"
+)
+
+func TestUnitCosts(t *testing.T) {
+	// units are counted over the window ending at the given time, e.g. as offset
+	at := time.Date(2019, 10, 1, 0, 0, 0, 0, time.UTC)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("time") != "2019-10-01T00:00:00Z" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[
+			{"metric":{"namespace":"default","code":"200"},"value":[1570000000,"300"]},
+			{"metric":{"namespace":"default","code":"500"},"value":[1570000000,"100"]},
+			{"metric":{"namespace":"monitoring"},"value":[1570000000,"0"]},
+			{"metric":{"code":"200"},"value":[1570000000,"50"]}
+		]}}`))
+	}))
+	defer server.Close()
+	cli := newFakePrometheusClient(t, server.URL)
+
+	units, err := costModel.QueryUnits(cli, "sum(increase(http_requests_total[1d])) by (namespace, code)", costModel.UnitMetricLabel("namespace", ""), at)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, units, map[string]float64{"default": 400, "monitoring": 0})
+
+	aggregations := map[string]*costModel.Aggregation{
+		"default":     &costModel.Aggregation{TotalCost: 2.0},
+		"monitoring":  &costModel.Aggregation{TotalCost: 4.0},
+		"kube-system": &costModel.Aggregation{TotalCost: 1.0},
+	}
+	unitCosts := costModel.ComputeUnitCosts(aggregations, units)
+	assert.Equal(t, len(unitCosts), 3)
+	assert.Equal(t, unitCosts["default"].Units, 400.0)
+	assert.Equal(t, *unitCosts["default"].CostPerUnit, 0.005)
+
+	// groups serving no units have no cost per unit, rather than an infinite one
+	assert.Assert(t, unitCosts["monitoring"].CostPerUnit == nil)
+	assert.Assert(t, unitCosts["kube-system"].CostPerUnit == nil)
+	assert.Equal(t, unitCosts["kube-system"].TotalCost, 1.0)
+
+	assert.Equal(t, costModel.UnitMetricLabel("label", "app"), "app")
+}
@@ -0,0 +1,71 @@
+package costmodel_test
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+
+	costModel "github.com/kubecost/cost-model/costmodel"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func newTestPV(name string, created time.Time, claimRef *v1.ObjectReference) *v1.PersistentVolume {
+	return &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              name,
+			CreationTimestamp: metav1.NewTime(created),
+		},
+		Spec: v1.PersistentVolumeSpec{
+			Capacity: v1.ResourceList{
+				v1.ResourceStorage: resource.MustParse("10Gi"),
+			},
+			ClaimRef: claimRef,
+		},
+	}
+}
+
+func TestComputeUnmountedPVCost(t *testing.T) {
+	cp := newTestProvider(t)
+	end := time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)
+	start := end.Add(-10 * time.Hour)
+	cm := &costModel.CostModel{
+		Cache: fakeClusterCache{
+			pvs: []*v1.PersistentVolume{
+				newTestPV("foo", start.Add(-time.Hour), &v1.ObjectReference{Namespace: "test1", Name: "foo-claim"}),
+				newTestPV("orphan", end.Add(-5*time.Hour), &v1.ObjectReference{Namespace: "test2", Name: "orphan-claim"}),
+				newTestPV("available", start.Add(-time.Hour), nil),
+				newTestPV("later", end.Add(time.Hour), nil),
+			},
+		},
+	}
+
+	// volume foo was mounted during the window, and volume later was created after it
+	unmounted := cm.ComputeUnmountedPVCost(cp, map[string]bool{"foo": true}, start, end)
+	assert.Equal(t, len(unmounted), 2)
+	assert.Equal(t, unmounted[0].Name, "orphan")
+	assert.Equal(t, unmounted[0].Namespace, "test2")
+	assert.Equal(t, unmounted[0].Claim, "orphan-claim")
+	assert.Equal(t, unmounted[1].Name, "available")
+	assert.Equal(t, unmounted[1].Namespace, "")
+	assert.Equal(t, unmounted[0].Hours, 5.0)
+	assert.Equal(t, unmounted[1].Hours, 10.0)
+	assert.Assert(t, math.Abs(costModel.UnmountedPVCost(unmounted)-150*0.00005479452) < 1e-12)
+	hourly := costModel.UnmountedPVHourlyCost(unmounted)
+	assert.Assert(t, math.Abs(hourly-20*0.00005479452) < 1e-12)
+
+	// claimed volumes are reported in their claim's namespace, others at cluster scope, each costed for
+	// the part of the window it existed for
+	aggs := costModel.AggregateCostModel(cp, newTestCostData(), "namespace", "", false, 0.0, 1.0, nil)
+	costModel.AddUnmountedAggregations(aggs, "namespace", "", unmounted, 0.0, 1.0)
+	assert.Equal(t, aggs["test1"].TotalCost, 8.0)
+	assert.Assert(t, math.Abs(aggs["test2/"+costModel.UnmountedAggregationKey].TotalCost-50*0.00005479452) < 1e-12)
+	assert.Assert(t, math.Abs(aggs[costModel.UnmountedAggregationKey].TotalCost-100*0.00005479452) < 1e-12)
+
+	totals := &costModel.Totals{TotalCost: [][]string{[]string{"1", "100"}}}
+	costModel.AddUnmountedPVCost(totals, 1.0)
+	assert.DeepEqual(t, totals.UnmountedPVCost, [][]string{[]string{"1", "730.000000"}})
+}